@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// abrProfile is one rung of the adaptive bitrate ladder. Resolution and
+// MaxBitrate are passed to the camera as VAPIX stream parameters.
+type abrProfile struct {
+	Name       string
+	Resolution string
+	MaxBitrate int // kbit/s, 0 leaves the camera's setting
+	MinKbps    float64
+}
+
+// abrLadder lists profiles from best to lowest quality. MinKbps is the
+// viewer bandwidth below which the next profile down is used.
+var abrLadder = []abrProfile{
+	{Name: "high", MinKbps: 2500},
+	{Name: "medium", Resolution: "1280x720", MaxBitrate: 1500, MinKbps: 1000},
+	{Name: "low", Resolution: "640x360", MaxBitrate: 500},
+}
+
+// Switching thresholds
+const (
+	abrSwitchInterval = 10 * time.Second // minimum time between switches
+	abrUpgradeAfter   = 30 * time.Second // headroom must last this long to step up
+	abrUpgradeMargin  = 1.25
+	abrLossDowngrade  = 0.10
+	abrLossUpgrade    = 0.02
+)
+
+// abrController picks a camera profile from the viewer's bandwidth
+// estimates, REMB or the gateway's own from TWCC, and TWCC loss feedback
+type abrController struct {
+	lock sync.Mutex
+
+	level      int
+	estimate   float64 // kbit/s, 0 if unknown
+	loss       float64 // from TWCC feedback
+	lastSwitch time.Time
+	upSince    time.Time
+}
+
+func newABRController() *abrController {
+	return &abrController{lastSwitch: time.Now()}
+}
+
+// Profile returns the profile currently requested from the camera
+func (a *abrController) Profile() abrProfile {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return abrLadder[a.level]
+}
+
+// observe feeds RTCP feedback from the viewer; it returns the new ladder
+// level and true when the stream should switch profile
+func (a *abrController) observe(packets []rtcp.Packet) (int, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	updated := false
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			a.estimate = float64(p.Bitrate) / 1000
+			updated = true
+		case *rtcp.TransportLayerCC:
+			if received, lost := twccCounts(p); received+lost > 0 {
+				a.loss = float64(lost) / float64(received+lost)
+				updated = true
+			}
+		}
+	}
+	if !updated {
+		return a.level, false
+	}
+	return a.decide(time.Now())
+}
+
+// observeEstimate feeds the send-side bandwidth estimate of the viewer's
+// peer connection in kbit/s, as observe does REMB
+func (a *abrController) observeEstimate(kbps float64) (int, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.estimate = kbps
+	return a.decide(time.Now())
+}
+
+// decide must be called with the lock held
+func (a *abrController) decide(now time.Time) (int, bool) {
+	if now.Sub(a.lastSwitch) < abrSwitchInterval {
+		return a.level, false
+	}
+
+	// Step down as soon as the viewer can't keep up
+	current := abrLadder[a.level]
+	if a.level < len(abrLadder)-1 &&
+		((a.estimate > 0 && a.estimate < current.MinKbps) || a.loss > abrLossDowngrade) {
+		return a.switchTo(a.level+1, now), true
+	}
+
+	// Step up only after sustained headroom
+	if a.level > 0 {
+		better := abrLadder[a.level-1]
+		headroom := (a.estimate == 0 || a.estimate > better.MinKbps*abrUpgradeMargin) && a.loss < abrLossUpgrade
+		if !headroom {
+			a.upSince = time.Time{}
+		} else if a.upSince.IsZero() {
+			a.upSince = now
+		} else if now.Sub(a.upSince) >= abrUpgradeAfter {
+			return a.switchTo(a.level-1, now), true
+		}
+	}
+	return a.level, false
+}
+
+// switchTo must be called with the lock held
+func (a *abrController) switchTo(level int, now time.Time) int {
+	a.level = level
+	a.lastSwitch = now
+	a.upSince = time.Time{}
+	return level
+}
+
+// twccCounts tallies received and lost packets in a TWCC feedback packet
+func twccCounts(p *rtcp.TransportLayerCC) (received, lost int) {
+	remaining := int(p.PacketStatusCount)
+	count := func(symbol uint16, n int) {
+		if n > remaining {
+			n = remaining
+		}
+		remaining -= n
+		if symbol == rtcp.TypeTCCPacketNotReceived {
+			lost += n
+		} else {
+			received += n
+		}
+	}
+
+	for _, chunk := range p.PacketChunks {
+		switch c := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			count(c.PacketStatusSymbol, int(c.RunLength))
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range c.SymbolList {
+				count(symbol, 1)
+			}
+		}
+	}
+	return received, lost
+}
+
+// supportsABR reports whether the camera's stream can be re-profiled with
+// VAPIX stream parameters
+func supportsABR(camera *Camera) bool {
+	return strings.Contains(camera.RTSPUrl, "/axis-media/media.amp")
+}
+
+// withStreamProfile adds the profile's VAPIX stream parameters to an Axis
+// RTSP URL
+func withStreamProfile(rawURL string, profile abrProfile) string {
+	if profile.Resolution == "" && profile.MaxBitrate == 0 {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	if profile.Resolution != "" {
+		q.Set("resolution", profile.Resolution)
+	}
+	if profile.MaxBitrate > 0 {
+		q.Set("videomaxbitrate", strconv.Itoa(profile.MaxBitrate))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// switchStreamProfile restarts a stream's RTSP ingest with a new camera
+// profile. The video track and peer connections are kept.
+func (eg *EdgeGateway) switchStreamProfile(cs *CameraStream, level int) {
+	log.Printf("Switching camera %s to %s profile", cs.camera.ID, abrLadder[level].Name)
+	cs.restartIngest()
+	eg.sendEvent("stream_profile", map[string]interface{}{
+		"camera_id": cs.camera.ID,
+		"profile":   abrLadder[level].Name,
+	})
+}
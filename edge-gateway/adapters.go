@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSnapshotSize bounds a snapshot read from a camera
+const maxSnapshotSize = 8 << 20
+
+// eventStreamIdle is how long an adapter's event stream may go without
+// data, heartbeats included, before it is resubscribed
+const eventStreamIdle = 90 * time.Second
+
+// CameraSnapshot is the snapshot payload. Image is a JPEG, base64-encoded
+// in JSON.
+type CameraSnapshot struct {
+	CameraID string    `json:"camera_id"`
+	Time     time.Time `json:"time"`
+	Image    []byte    `json:"image"`
+}
+
+// cameraAdapter drives the cameras of one maker through their native HTTP
+// API, for what they don't offer or offer poorly over ONVIF
+type cameraAdapter interface {
+	// Identify fingerprints a camera, failing if it isn't the maker's
+	Identify(ctx context.Context, client *CameraHTTPClient) (*adapterDevice, error)
+	// PTZ runs a pan, tilt, zoom or stop action
+	PTZ(ctx context.Context, client *CameraHTTPClient, camera *Camera, cmd PTZCommand) error
+	// Snapshot returns a JPEG of the camera's video
+	Snapshot(ctx context.Context, client *CameraHTTPClient, camera *Camera) ([]byte, error)
+	// Subscribe streams the camera's events
+	Subscribe(ctx context.Context, client *CameraHTTPClient, camera *Camera) (cameraEventSource, error)
+}
+
+// adapterDevice is what an adapter's fingerprint read from a camera
+type adapterDevice struct {
+	Model    string
+	Firmware string
+	PTZ      bool
+}
+
+// cameraAdapters are the vendor adapters, by the name reported as adapter
+// in camera capabilities
+var cameraAdapters = map[string]cameraAdapter{
+	"hikvision": hikvisionAdapter{},
+	"dahua":     dahuaAdapter{},
+}
+
+// cameraAdapterOrder is the order cameras are fingerprinted in
+var cameraAdapterOrder = []string{"hikvision", "dahua"}
+
+// cameraEventSource is a subscription to a camera's events, through ONVIF
+// or an adapter
+type cameraEventSource interface {
+	// pull waits up to timeout for events
+	pull(ctx context.Context, timeout time.Duration) ([]CameraEvent, error)
+	unsubscribe(ctx context.Context) error
+}
+
+// identifyAdapter fingerprints a camera against each adapter in turn,
+// returning the name of the one that recognized it
+func identifyAdapter(ctx context.Context, client *CameraHTTPClient) (string, *adapterDevice) {
+	for _, name := range cameraAdapterOrder {
+		if device, err := cameraAdapters[name].Identify(ctx, client); err == nil {
+			return name, device
+		}
+	}
+	return "", nil
+}
+
+// cameraAdapterFor returns the adapter a camera was fingerprinted with, or
+// nil
+func cameraAdapterFor(camera *Camera) cameraAdapter {
+	if camera.Capabilities == nil {
+		return nil
+	}
+	return cameraAdapters[camera.Capabilities.Adapter]
+}
+
+// subscribeCameraEvents subscribes to a camera's events through its adapter,
+// or the ONVIF event service
+func (eg *EdgeGateway) subscribeCameraEvents(ctx context.Context, camera *Camera) (cameraEventSource, error) {
+	client := eg.httpClients.Client(camera)
+	if adapter := cameraAdapterFor(camera); adapter != nil {
+		return adapter.Subscribe(ctx, client, camera)
+	}
+	// A failed subscription must come back as a nil interface
+	sub, err := subscribeEvents(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// cameraSnapshot returns a JPEG of a camera's video, through its adapter,
+// VAPIX, or the snapshot URI of its ONVIF media profile, with its privacy
+// masks blacked out. Like its streams, a masked camera has none while
+// transcoding is off.
+func (eg *EdgeGateway) cameraSnapshot(ctx context.Context, cameraID string) ([]byte, error) {
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cameraID]
+	var copied Camera
+	if exists {
+		copied = *camera
+	}
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return nil, errCameraNotFound
+	}
+	if copied.Simulated || copied.Device != "" {
+		return nil, errors.New("simulated and local cameras have no snapshots")
+	}
+	if copied.Generic {
+		return nil, errors.New("generic RTSP sources have no snapshots")
+	}
+	if action := eg.maintenanceAction(&copied); action != "" {
+		return nil, fmt.Errorf("camera is under maintenance (%s)", action)
+	}
+	masks := eg.privacy.Get(cameraID)
+	if len(masks) > 0 && eg.transcoder == nil {
+		return nil, errPrivacyNeedsTranscoder
+	}
+
+	image, err := eg.fetchCameraSnapshot(ctx, &copied)
+	if err != nil || len(masks) == 0 {
+		return image, err
+	}
+	return maskSnapshot(ctx, eg.cfg.FFmpegPath, image, masks)
+}
+
+// fetchCameraSnapshot returns the camera's own JPEG of its video
+func (eg *EdgeGateway) fetchCameraSnapshot(ctx context.Context, camera *Camera) ([]byte, error) {
+	client := eg.httpClients.Client(camera)
+	if adapter := cameraAdapterFor(camera); adapter != nil {
+		return adapter.Snapshot(ctx, client, camera)
+	}
+	if camera.Capabilities != nil && camera.Capabilities.Source == "onvif" {
+		return onvifSnapshot(ctx, client, camera)
+	}
+	path := "/axis-cgi/jpg/image.cgi"
+	if camera.Channel > 0 {
+		path += fmt.Sprintf("?camera=%d", camera.Channel)
+	}
+	return fetchSnapshot(ctx, client, path)
+}
+
+// onvifSnapshot fetches the snapshot URI of the camera's media profile
+func onvifSnapshot(ctx context.Context, client *CameraHTTPClient, camera *Camera) ([]byte, error) {
+	profile, err := onvifProfileToken(ctx, client, camera.Channel)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, path := range onvifMediaPaths {
+		var snapshot struct {
+			URI string `xml:"GetSnapshotUriResponse>MediaUri>Uri"`
+		}
+		err := onvifCall(ctx, client, path, fmt.Sprintf(
+			`<GetSnapshotUri xmlns="http://www.onvif.org/ver10/media/wsdl"><ProfileToken>%s</ProfileToken></GetSnapshotUri>`,
+			xmlEscape(profile)), &snapshot)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// The camera may name itself by another address than ours
+		u, err := url.Parse(snapshot.URI)
+		if err != nil || u.Path == "" {
+			return nil, fmt.Errorf("camera returned an invalid snapshot URI %q", snapshot.URI)
+		}
+		return fetchSnapshot(ctx, client, u.RequestURI())
+	}
+	return nil, fmt.Errorf("ONVIF media service not available: %v", lastErr)
+}
+
+// fetchSnapshot GETs a JPEG from the camera
+func fetchSnapshot(ctx context.Context, client *CameraHTTPClient, path string) ([]byte, error) {
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("snapshot returned status %d", resp.StatusCode)
+	}
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > maxSnapshotSize {
+		return nil, errors.New("snapshot is too large")
+	}
+	if len(image) < 2 || image[0] != 0xff || image[1] != 0xd8 {
+		return nil, errors.New("snapshot is not a JPEG")
+	}
+	return image, nil
+}
+
+// streamEventSource reads a camera's long-lived event stream, such as
+// Hikvision's alertStream, in the background, buffering the events parsed
+// from it for pull
+type streamEventSource struct {
+	events   chan CameraEvent
+	done     chan struct{}
+	cancel   context.CancelFunc
+	lastData atomic.Int64 // unix nanoseconds
+
+	lock sync.Mutex
+	err  error
+}
+
+// startEventStream opens an event stream with GET path, and parses it with
+// parse, which reads the body and hands each event to emit until it fails
+func startEventStream(ctx context.Context, client *CameraHTTPClient, path string,
+	parse func(r *bufio.Reader, emit func(CameraEvent)) error) (cameraEventSource, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, client.url(path), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The stream outlasts CAMERA_HTTP_TIMEOUT; its context ends it
+	resp, err := client.Upload(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("event stream returned status %d", resp.StatusCode)
+	}
+
+	s := &streamEventSource{
+		events: make(chan CameraEvent, 64),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	s.lastData.Store(time.Now().UnixNano())
+	go func() {
+		defer close(s.done)
+		defer resp.Body.Close()
+		r := bufio.NewReader(&activityReader{r: resp.Body, seen: &s.lastData})
+		err := parse(r, func(event CameraEvent) {
+			select {
+			case s.events <- event:
+			case <-streamCtx.Done():
+			}
+		})
+		if err == nil || errors.Is(err, io.EOF) {
+			err = errors.New("camera closed the event stream")
+		}
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+	}()
+	return s, nil
+}
+
+// pull returns the buffered events, waiting up to timeout for the first
+func (s *streamEventSource) pull(ctx context.Context, timeout time.Duration) ([]CameraEvent, error) {
+	var events []CameraEvent
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case event := <-s.events:
+		events = append(events, event)
+	case <-s.done:
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		select {
+		case event := <-s.events:
+			events = append(events, event)
+			continue
+		default:
+		}
+		break
+	}
+	if len(events) > 0 {
+		return events, nil
+	}
+
+	select {
+	case <-s.done:
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return nil, s.err
+	default:
+	}
+	if idle := time.Since(time.Unix(0, s.lastData.Load())); idle > eventStreamIdle {
+		s.cancel()
+		return nil, fmt.Errorf("event stream silent for %s", idle.Round(time.Second))
+	}
+	return nil, nil
+}
+
+// unsubscribe closes the stream
+func (s *streamEventSource) unsubscribe(context.Context) error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// activityReader notes when data last arrived
+type activityReader struct {
+	r    io.Reader
+	seen *atomic.Int64
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.seen.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// ptzSpeed scales a PTZCommand speed of 0 to 1 to 1..top
+func ptzSpeed(speed float64, top int) int {
+	return min(max(int(speed*float64(top)+0.5), 1), top)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// analyticsChannelLabel is the label of the data channel viewers receive
+// analytics metadata on
+const analyticsChannelLabel = "analytics"
+
+// analyticsKeepAlive is how often the metadata session is kept alive with
+// OPTIONS; the camera must answer within twice that
+const analyticsKeepAlive = 30 * time.Second
+
+// analyticsObjectForget is how long an object must go unseen before it is
+// reported again
+const analyticsObjectForget = 30 * time.Second
+
+// analyticsMaxFrame bounds a metadata document reassembled from RTP
+const analyticsMaxFrame = 1 << 20
+
+// analyticsMaxBuffered is how much may wait on a viewer's data channel
+// before frames are dropped for it
+const analyticsMaxBuffered = 1 << 20
+
+// errNoMetadataTrack is returned for camera streams without an ONVIF
+// metadata track
+var errNoMetadataTrack = errors.New("no ONVIF metadata track")
+
+// AnalyticsBox is an object's bounding box, as fractions of the frame's
+// width and height from its top left corner
+type AnalyticsBox struct {
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Right  float64 `json:"right"`
+	Bottom float64 `json:"bottom"`
+}
+
+// AnalyticsObject is an object a camera detected
+type AnalyticsObject struct {
+	ID         string       `json:"id,omitempty"`    // the camera's, not set by inference
+	Class      string       `json:"class,omitempty"` // e.g. Human, Vehicle, Face
+	Likelihood float64      `json:"likelihood,omitempty"`
+	Box        AnalyticsBox `json:"box"`
+}
+
+// AnalyticsFrame is the objects a camera detected in one video frame, as
+// sent on the analytics data channel
+type AnalyticsFrame struct {
+	CameraID string            `json:"camera_id"`
+	Time     *time.Time        `json:"time,omitempty"` // of the video frame, by the camera's clock
+	Objects  []AnalyticsObject `json:"objects"`
+}
+
+// Sources of an ObjectDetected
+const (
+	objectSourceCamera    = "camera"    // the camera's analytics metadata
+	objectSourceInference = "inference" // the gateway's inference runner
+)
+
+// ObjectDetected is the object_detected payload, raised the first time a
+// camera classifies an object, or the inference runner finds a class of
+// object in a camera's frames
+type ObjectDetected struct {
+	CameraID string          `json:"camera_id"`
+	Time     *time.Time      `json:"time,omitempty"`
+	Source   string          `json:"source"`
+	Object   AnalyticsObject `json:"object"`
+}
+
+// onvifMetadataStream is the part of an ONVIF MetadataStream document
+// (ONVIF Profile M, AXIS Object Analytics) that describes objects
+type onvifMetadataStream struct {
+	Frames []struct {
+		UtcTime        string `xml:"UtcTime,attr"`
+		Transformation *struct {
+			Translate struct {
+				X float64 `xml:"x,attr"`
+				Y float64 `xml:"y,attr"`
+			} `xml:"Translate"`
+			Scale struct {
+				X float64 `xml:"x,attr"`
+				Y float64 `xml:"y,attr"`
+			} `xml:"Scale"`
+		} `xml:"Transformation"`
+		Objects []struct {
+			ObjectID string `xml:"ObjectId,attr"`
+			Box      *struct {
+				Left   float64 `xml:"left,attr"`
+				Top    float64 `xml:"top,attr"`
+				Right  float64 `xml:"right,attr"`
+				Bottom float64 `xml:"bottom,attr"`
+			} `xml:"Appearance>Shape>BoundingBox"`
+			Polygon []struct {
+				X float64 `xml:"x,attr"`
+				Y float64 `xml:"y,attr"`
+			} `xml:"Appearance>Shape>Polygon>Point"`
+			Types []struct {
+				Likelihood float64 `xml:"Likelihood,attr"`
+				Name       string  `xml:",chardata"`
+			} `xml:"Appearance>Class>Type"`
+			Candidates []struct {
+				Type       string  `xml:"Type"`
+				Likelihood float64 `xml:"Likelihood"`
+			} `xml:"Appearance>Class>ClassCandidate"`
+		} `xml:"Object"`
+	} `xml:"VideoAnalytics>Frame"`
+}
+
+// parseAnalyticsFrames reads the object frames of a MetadataStream document.
+// ONVIF coordinates run from -1 to 1 with y up, after the frame's
+// transformation; they are turned into fractions of the frame from its top
+// left.
+func parseAnalyticsFrames(cameraID string, data []byte) ([]AnalyticsFrame, error) {
+	var doc onvifMetadataStream
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	frames := make([]AnalyticsFrame, 0, len(doc.Frames))
+	for _, f := range doc.Frames {
+		frame := AnalyticsFrame{CameraID: cameraID, Objects: []AnalyticsObject{}}
+		if t, err := time.Parse(time.RFC3339Nano, f.UtcTime); err == nil {
+			frame.Time = &t
+		}
+		scaleX, scaleY, translateX, translateY := 1.0, 1.0, 0.0, 0.0
+		if tr := f.Transformation; tr != nil {
+			if tr.Scale.X != 0 && tr.Scale.Y != 0 {
+				scaleX, scaleY = tr.Scale.X, tr.Scale.Y
+			}
+			translateX, translateY = tr.Translate.X, tr.Translate.Y
+		}
+		toX := func(x float64) float64 { return clamp01((x*scaleX + translateX + 1) / 2) }
+		toY := func(y float64) float64 { return clamp01((1 - (y*scaleY + translateY)) / 2) }
+
+		for _, o := range f.Objects {
+			object := AnalyticsObject{ID: o.ObjectID}
+			switch {
+			case o.Box != nil:
+				object.Box = AnalyticsBox{
+					Left:   math.Min(toX(o.Box.Left), toX(o.Box.Right)),
+					Right:  math.Max(toX(o.Box.Left), toX(o.Box.Right)),
+					Top:    math.Min(toY(o.Box.Top), toY(o.Box.Bottom)),
+					Bottom: math.Max(toY(o.Box.Top), toY(o.Box.Bottom)),
+				}
+			case len(o.Polygon) > 0:
+				object.Box = AnalyticsBox{Left: 1, Top: 1}
+				for _, p := range o.Polygon {
+					x, y := toX(p.X), toY(p.Y)
+					object.Box.Left, object.Box.Right = math.Min(object.Box.Left, x), math.Max(object.Box.Right, x)
+					object.Box.Top, object.Box.Bottom = math.Min(object.Box.Top, y), math.Max(object.Box.Bottom, y)
+				}
+			default:
+				continue
+			}
+
+			// The most likely class, in the Profile M or the older form
+			for _, t := range o.Types {
+				if name := strings.TrimSpace(t.Name); name != "" && (object.Class == "" || t.Likelihood > object.Likelihood) {
+					object.Class, object.Likelihood = name, t.Likelihood
+				}
+			}
+			for _, c := range o.Candidates {
+				if name := strings.TrimSpace(c.Type); name != "" && (object.Class == "" || c.Likelihood > object.Likelihood) {
+					object.Class, object.Likelihood = name, c.Likelihood
+				}
+			}
+			frame.Objects = append(frame.Objects, object)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// analyticsSession reads a camera's analytics metadata while any of its
+// streams runs
+type analyticsSession struct {
+	streams int
+	cancel  context.CancelFunc
+}
+
+// analyticsEnabledFor reports whether analytics metadata is forwarded for a
+// camera
+func (eg *EdgeGateway) analyticsEnabledFor(cameraID string) bool {
+	if !eg.cfg.AnalyticsMetadata {
+		return false
+	}
+	if len(eg.cfg.AnalyticsCameras) == 0 {
+		return true
+	}
+	for _, id := range eg.cfg.AnalyticsCameras {
+		if id == cameraID {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireAnalytics notes a stream of a camera starting, starting its
+// metadata session with the first
+func (eg *EdgeGateway) acquireAnalytics(camera *Camera) {
+	// Local cameras have no metadata stream
+	if !eg.analyticsEnabledFor(camera.ID) || camera.Device != "" {
+		return
+	}
+	eg.analyticsLock.Lock()
+	defer eg.analyticsLock.Unlock()
+	if session, exists := eg.analytics[camera.ID]; exists {
+		session.streams++
+		return
+	}
+	ctx, cancel := context.WithCancel(eg.ctx)
+	eg.analytics[camera.ID] = &analyticsSession{streams: 1, cancel: cancel}
+	eg.goTracked(func() { eg.runAnalytics(ctx, camera) })
+}
+
+// releaseAnalytics notes a stream of a camera stopping, ending its metadata
+// session with the last
+func (eg *EdgeGateway) releaseAnalytics(cameraID string) {
+	eg.analyticsLock.Lock()
+	defer eg.analyticsLock.Unlock()
+	session, exists := eg.analytics[cameraID]
+	if !exists {
+		return
+	}
+	if session.streams--; session.streams <= 0 {
+		session.cancel()
+		delete(eg.analytics, cameraID)
+	}
+}
+
+// runAnalytics forwards a camera's analytics metadata until ctx is done,
+// reconnecting after failures. Cameras without a metadata track are left
+// alone until their streams restart.
+func (eg *EdgeGateway) runAnalytics(ctx context.Context, camera *Camera) {
+	seen := make(map[string]time.Time) // classified objects, by ID
+	handle := func(data []byte) {
+		frames, err := parseAnalyticsFrames(camera.ID, data)
+		if err != nil {
+			debugf("Camera %s sent unreadable analytics metadata: %v", camera.ID, err)
+			return
+		}
+		for _, frame := range frames {
+			eg.sendAnalytics(frame)
+			now := time.Now()
+			for _, object := range frame.Objects {
+				if object.Class == "" {
+					continue
+				}
+				if _, known := seen[object.ID]; !known {
+					eg.sendEvent("object_detected", ObjectDetected{
+						CameraID: camera.ID,
+						Time:     frame.Time,
+						Source:   objectSourceCamera,
+						Object:   object,
+					})
+				}
+				seen[object.ID] = now
+			}
+			for id, at := range seen {
+				if now.Sub(at) > analyticsObjectForget {
+					delete(seen, id)
+				}
+			}
+		}
+	}
+
+	rtspURL := eg.credentials.URL(camera.ID, analyticsURL(camera))
+	tlsConfig := cameraTLSConfig(eg.cfg, camera)
+	retry := 5 * time.Second
+	for {
+		started := time.Now()
+		err := readRTSPMetadata(ctx, rtspURL, tlsConfig, eg.cfg.RTSPDialTimeout, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errNoMetadataTrack) {
+			log.Printf("Camera %s has no analytics metadata track", camera.ID)
+			return
+		}
+		if time.Since(started) > time.Minute {
+			retry = 5 * time.Second
+		}
+		log.Printf("Analytics metadata of camera %s failed, retrying in %s: %v", camera.ID, retry, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, time.Minute)
+	}
+}
+
+// sendAnalytics sends a frame to the camera's viewers that negotiated the
+// analytics data channel
+func (eg *EdgeGateway) sendAnalytics(frame AnalyticsFrame) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+	eg.viewersLock.Lock()
+	defer eg.viewersLock.Unlock()
+	for _, v := range eg.viewers {
+		if v.CameraID != frame.CameraID {
+			continue
+		}
+		v.lock.Lock()
+		channel := v.analyticsChannel
+		v.lock.Unlock()
+		if channel != nil && channel.ReadyState() == webrtc.DataChannelStateOpen &&
+			channel.BufferedAmount() < analyticsMaxBuffered {
+			channel.SendText(string(data))
+		}
+	}
+}
+
+// analyticsURL returns the RTSP URL of a camera's metadata. Axis cameras
+// serve AXIS Object Analytics metadata on a stream of its own; ONVIF
+// Profile M cameras carry it alongside the video.
+func analyticsURL(camera *Camera) string {
+	u, err := url.Parse(camera.RTSPUrl)
+	if err != nil || !strings.Contains(u.Path, "/axis-media/media.amp") {
+		return camera.RTSPUrl
+	}
+	q := url.Values{}
+	if channel := u.Query().Get("camera"); channel != "" {
+		q.Set("camera", channel)
+	}
+	q.Set("video", "0")
+	q.Set("audio", "0")
+	q.Set("analytics", "polygon")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// readRTSPMetadata plays the ONVIF metadata track of an RTSP stream, over
+// TCP through an rtspTunnel, and hands each metadata document to handle
+// until ctx is done or the session fails
+func readRTSPMetadata(ctx context.Context, rtspURL string, tlsConfig *tls.Config, timeout time.Duration, handle func([]byte)) error {
+	localURL, err := openRTSPTunnel(ctx, rtspURL, tlsConfig, timeout)
+	if err != nil {
+		return errors.New(redactCredentials(err.Error()))
+	}
+	u, _ := url.Parse(localURL)
+	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	r := bufio.NewReader(conn)
+	var writeLock sync.Mutex
+	cseq := 0
+	send := func(method, uri string, headers ...string) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		cseq++
+		lines := append([]string{method + " " + uri + " RTSP/1.0", "CSeq: " + strconv.Itoa(cseq),
+			"User-Agent: edge-gateway"}, headers...)
+		return writeRTSPMessage(conn, &rtspMessage{lines: lines})
+	}
+	request := func(method, uri string, headers ...string) (*rtspMessage, error) {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := send(method, uri, headers...); err != nil {
+			return nil, err
+		}
+		for {
+			resp, err := readRTSPMessage(r)
+			if err != nil {
+				return nil, err
+			}
+			if resp.frame != nil {
+				continue
+			}
+			if status := rtspStatus(resp.lines[0]); status != 200 {
+				return nil, fmt.Errorf("%s returned %s", method, resp.lines[0])
+			}
+			return resp, nil
+		}
+	}
+
+	described, err := request("DESCRIBE", localURL, "Accept: application/sdp")
+	if err != nil {
+		return err
+	}
+	control, ok := sdpMetadataControl(string(described.body))
+	if !ok {
+		return errNoMetadataTrack
+	}
+	base := rtspHeader(described.lines, "Content-Base")
+	if base == "" {
+		base = localURL
+	}
+	setup, err := request("SETUP", resolveRTSPControl(base, control), "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	if err != nil {
+		return err
+	}
+	session, _, _ := strings.Cut(rtspHeader(setup.lines, "Session"), ";")
+	if _, err := request("PLAY", base, "Session: "+session, "Range: npt=0.000-"); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go func() {
+		ticker := time.NewTicker(analyticsKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if send("OPTIONS", base, "Session: "+session) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var document []byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * analyticsKeepAlive))
+		msg, err := readRTSPMessage(r)
+		if err != nil {
+			return err
+		}
+		if msg.frame == nil || msg.frame[1] != 0 {
+			continue
+		}
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(msg.frame[4:]); err != nil {
+			continue
+		}
+		// A document ends at the packet with the marker bit
+		if len(document)+len(pkt.Payload) <= analyticsMaxFrame {
+			document = append(document, pkt.Payload...)
+		}
+		if pkt.Marker {
+			handle(document)
+			document = nil
+		}
+	}
+}
+
+// sdpMetadataControl finds the control URL of the ONVIF metadata track in
+// an SDP
+func sdpMetadataControl(sdp string) (string, bool) {
+	var inApplication, isMetadata bool
+	var control string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if inApplication && isMetadata {
+				return control, true
+			}
+			inApplication = strings.HasPrefix(line, "m=application ")
+			isMetadata, control = false, ""
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			isMetadata = isMetadata || strings.Contains(strings.ToLower(line), "vnd.onvif.metadata")
+		case strings.HasPrefix(line, "a=control:"):
+			control = strings.TrimPrefix(line, "a=control:")
+		}
+	}
+	return control, inApplication && isMetadata
+}
+
+// resolveRTSPControl resolves a track's control attribute against the
+// stream's base URL
+func resolveRTSPControl(base, control string) string {
+	switch {
+	case control == "" || control == "*":
+		return base
+	case strings.Contains(control, "://"):
+		return control
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(control, "/")
+}
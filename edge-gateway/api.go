@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// startLocalAPI serves the gateway's local REST API until ctx is cancelled
+func (eg *EdgeGateway) startLocalAPI(ctx context.Context) {
+	if eg.cfg.LocalAPIAddr == "" || eg.cfg.LocalAPIAddr == "off" {
+		return
+	}
+	if eg.cfg.LocalAPIToken == "" && !loopbackAddr(eg.cfg.LocalAPIAddr) {
+		log.Printf("Not serving the local API on %s: LOCAL_API_TOKEN must be set to listen beyond loopback", eg.cfg.LocalAPIAddr)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", eg.handleHealthz)
+	mux.HandleFunc("/readyz", eg.handleReadyz)
+	mux.HandleFunc("/status", eg.handleStatus)
+	mux.HandleFunc("/api/capabilities", eg.handleCapabilitiesAPI)
+	mux.HandleFunc("/api/cameras", eg.handleCamerasAPI)
+	mux.HandleFunc("/api/cameras/", eg.handleCameraAPI)
+	mux.HandleFunc("/api/quarantine", eg.handleQuarantineAPI)
+	mux.HandleFunc("/api/quarantine/", eg.handleQuarantineAPI)
+	mux.HandleFunc("/api/credentials", eg.handleCredentialsAPI)
+	mux.HandleFunc("/api/scan", eg.handleScanAPI)
+	mux.HandleFunc("/api/streams", eg.handleStreamsAPI)
+	mux.HandleFunc("/api/relays", eg.handleRelaysAPI)
+	mux.HandleFunc("/api/viewers", eg.handleViewersAPI)
+	mux.HandleFunc("/api/ptz", eg.handlePTZAPI)
+	mux.HandleFunc("/api/cloud", eg.handleCloudAPI)
+	mux.HandleFunc("/api/cloud/events", eg.handleCloudAPI)
+	mux.HandleFunc("/api/e2ee", eg.handleE2EEAPI)
+	mux.HandleFunc("/api/e2ee/", eg.handleE2EEAPI)
+	mux.HandleFunc("/api/cluster", eg.handleClusterAPI)
+	mux.HandleFunc("/api/ha", eg.handleHAAPI)
+	mux.HandleFunc("/api/ha/state", eg.handleHAAPI)
+	mux.HandleFunc("/whep/", eg.handleWHEP)
+	mux.HandleFunc("/hls/", eg.handleHLS)
+
+	server := &http.Server{
+		Addr:              eg.cfg.LocalAPIAddr,
+		Handler:           eg.requireLocalAPIToken(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if eg.cfg.LocalAPITLSCert != "" {
+		log.Printf("Local API listening on %s over HTTPS", eg.cfg.LocalAPIAddr)
+		err = server.ListenAndServeTLS(eg.cfg.LocalAPITLSCert, eg.cfg.LocalAPITLSKey)
+	} else {
+		log.Printf("Local API listening on %s", eg.cfg.LocalAPIAddr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("Local API error: %v", err)
+	}
+}
+
+// localAPIHealthURL returns the URL of the local API's /healthz on host, and
+// a client for the gateway to ask it. Served over HTTPS, it's the gateway's
+// own certificate, which there's no point in verifying.
+func localAPIHealthURL(cfg *Config, host, port string, timeout time.Duration) (string, *http.Client) {
+	client := &http.Client{Timeout: timeout}
+	scheme := "http"
+	if cfg.LocalAPITLSCert != "" {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + "/healthz", client
+}
+
+// loopbackAddr reports whether a listen address only accepts connections
+// from the gateway's own host
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localAPIAuthorized reports whether a request carries LOCAL_API_TOKEN, or
+// no token is set
+func (eg *EdgeGateway) localAPIAuthorized(r *http.Request) bool {
+	if eg.cfg.LocalAPIToken == "" {
+		return true
+	}
+	want := "Bearer " + eg.cfg.LocalAPIToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// requireLocalAPIToken refuses requests without LOCAL_API_TOKEN. Health
+// checks and CORS preflights need none, the HA peer's state requests carry
+// HA_SECRET instead, and WHEP players carry a stream token instead when
+// STREAM_TOKEN_PUBLIC_KEY is set.
+func (eg *EdgeGateway) requireLocalAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodOptions,
+			r.URL.Path == "/healthz", r.URL.Path == "/readyz",
+			r.URL.Path == "/api/ha/state",
+			strings.HasPrefix(r.URL.Path, "/whep/") && eg.cfg.StreamTokenRequired,
+			eg.localAPIAuthorized(r):
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="edge-gateway"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid LOCAL_API_TOKEN")
+		}
+	})
+}
+
+// handleCapabilitiesAPI returns the gateway's capability document
+func (eg *EdgeGateway) handleCapabilitiesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.capabilities())
+}
+
+// handleCamerasAPI lists cameras (GET) or registers a camera manually (POST)
+func (eg *EdgeGateway) handleCamerasAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		cameras := []*Camera{}
+		for _, camera := range eg.listCameras() {
+			if camera.matchesMetadata(query.Get("site"), query.Get("zone"), query.Get("tag")) &&
+				(!query.Has("tenant") || camera.Tenant == query.Get("tenant")) {
+				cameras = append(cameras, camera)
+			}
+		}
+		writeJSON(w, http.StatusOK, cameras)
+
+	case http.MethodPost:
+		var req AddCameraRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		camera, err := eg.addCamera(r.Context(), req)
+		eg.auditAddCamera(localOrigin(r), req, camera, err)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, camera)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleCameraAPI returns a camera (GET /api/cameras/{cameraID}), updates
+// its metadata (PATCH) or runs a maintenance action on it (POST
+// /api/cameras/{cameraID}/maintenance)
+func (eg *EdgeGateway) handleCameraAPI(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(r.URL.Path, "/api/cameras/")
+	if id, found := strings.CutSuffix(cameraID, "/maintenance"); found {
+		eg.handleMaintenanceAPI(w, r, id)
+		return
+	}
+	if id, found := strings.CutSuffix(cameraID, "/snapshot"); found {
+		eg.handleSnapshotAPI(w, r, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		eg.camerasLock.RLock()
+		camera, exists := eg.cameras[cameraID]
+		eg.camerasLock.RUnlock()
+		if !exists {
+			writeError(w, http.StatusNotFound, errCameraNotFound.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, camera)
+
+	case http.MethodPatch:
+		var update CameraMetadataUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		update.CameraID = cameraID
+		camera, err := eg.setCameraMetadata(update)
+		eg.audit(localOrigin(r), "set_camera_metadata", cameraID, nil, err)
+		switch {
+		case err == errCameraNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeJSON(w, http.StatusOK, camera)
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleMaintenanceAPI runs a maintenance action on a camera. A started
+// reboot or factory reset answers 202 and reports its progress to the cloud
+// with maintenance_status.
+func (eg *EdgeGateway) handleMaintenanceAPI(w http.ResponseWriter, r *http.Request, cameraID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req CameraMaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.CameraID = cameraID
+	status, err := eg.cameraMaintenance(req)
+	eg.audit(localOrigin(r), "camera_maintenance", cameraID, map[string]interface{}{
+		"action": req.Action,
+		"mode":   status.Mode,
+		"state":  status.State,
+	}, err)
+	switch {
+	case err == errCameraNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errCameraBusy):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case status.State == maintenanceStateStarted:
+		writeJSON(w, http.StatusAccepted, status)
+	default:
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// handleSnapshotAPI serves a JPEG of a camera's video
+// (GET /api/cameras/{cameraID}/snapshot)
+func (eg *EdgeGateway) handleSnapshotAPI(w http.ResponseWriter, r *http.Request, cameraID string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	image, err := eg.cameraSnapshot(r.Context(), cameraID)
+	switch {
+	case err == errCameraNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(image)
+	}
+}
+
+// handleQuarantineAPI lists quarantined cameras (GET /api/quarantine) or
+// releases one (DELETE /api/quarantine/{cameraID})
+func (eg *EdgeGateway) handleQuarantineAPI(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/quarantine"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && cameraID == "":
+		writeJSON(w, http.StatusOK, eg.quarantine.List())
+
+	case r.Method == http.MethodDelete && cameraID != "":
+		if !eg.releaseCamera(cameraID) {
+			eg.audit(localOrigin(r), "release_camera", cameraID, nil, errors.New("camera is not quarantined"))
+			writeError(w, http.StatusNotFound, "camera is not quarantined")
+			return
+		}
+		eg.audit(localOrigin(r), "release_camera", cameraID, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleCredentialsAPI lists the discovered cameras waiting for their login
+// (GET /api/credentials). Logins are set from the cloud with set_credentials.
+func (eg *EdgeGateway) handleCredentialsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.listCredentialRequests())
+}
+
+// handleClusterAPI returns the gateway's cluster (GET /api/cluster), or
+// drains the gateway from it or puts it back (POST {"draining": true})
+func (eg *EdgeGateway) handleClusterAPI(w http.ResponseWriter, r *http.Request) {
+	if eg.cluster == nil {
+		writeError(w, http.StatusNotFound, "gateway isn't clustered")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, eg.clusterStatus())
+
+	case http.MethodPost:
+		var req struct {
+			Draining bool `json:"draining"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		err := eg.setClusterDraining(req.Draining, clusterHandoffGrace)
+		eg.audit(localOrigin(r), "cluster_drain", "", map[string]interface{}{"draining": req.Draining}, err)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, eg.clusterStatus())
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleHAAPI returns the gateway's part in its pair (GET /api/ha), or the
+// state a standby mirrors (GET /api/ha/state), which holds credentials and
+// is only served to the peer, with HA_SECRET
+func (eg *EdgeGateway) handleHAAPI(w http.ResponseWriter, r *http.Request) {
+	if eg.ha == nil {
+		writeError(w, http.StatusNotFound, "gateway isn't paired")
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Path == "/api/ha" {
+		writeJSON(w, http.StatusOK, eg.haStatus())
+		return
+	}
+	if r.TLS == nil {
+		log.Printf("HA: refused state request from %s over plain HTTP", r.RemoteAddr)
+		writeError(w, http.StatusForbidden, "HA state is only served over HTTPS")
+		return
+	}
+	if !eg.ha.authorized(r) {
+		log.Printf("HA: refused state request from %s without the pair's secret", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "invalid HA secret")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.haSnapshot())
+}
+
+// handleE2EEAPI lists the key IDs of cameras with end-to-end encryption
+// (GET /api/e2ee), or sets (PUT) or removes (DELETE) a camera's key at
+// /api/e2ee/{cameraID}. Keys are never returned.
+func (eg *EdgeGateway) handleE2EEAPI(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/e2ee"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && cameraID == "":
+		writeJSON(w, http.StatusOK, eg.e2ee.KeyIDs())
+
+	case r.Method == http.MethodPut && cameraID != "":
+		var req struct {
+			KeyID int    `json:"key_id"`
+			Key   string `json:"key"` // base64
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		raw, err := base64.StdEncoding.DecodeString(req.Key)
+		if err != nil {
+			err = errors.New("key must be base64")
+		} else {
+			err = eg.e2ee.Set(cameraID, req.KeyID, raw)
+		}
+		eg.audit(localOrigin(r), "set_e2ee_key", cameraID, map[string]interface{}{"key_id": req.KeyID}, err)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Set end-to-end encryption key %d for camera %s", req.KeyID, cameraID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && cameraID != "":
+		if !eg.e2ee.Delete(cameraID) {
+			eg.audit(localOrigin(r), "delete_e2ee_key", cameraID, nil, errors.New("camera has no encryption key"))
+			writeError(w, http.StatusNotFound, "camera has no encryption key")
+			return
+		}
+		eg.audit(localOrigin(r), "delete_e2ee_key", cameraID, nil, nil)
+		log.Printf("Removed end-to-end encryption key of camera %s", cameraID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleScanAPI reports scan progress (GET), starts a scan (POST), or
+// cancels the running scan (DELETE)
+func (eg *EdgeGateway) handleScanAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, eg.scanner.Progress())
+
+	case http.MethodPost:
+		eg.scanner.Trigger()
+		eg.audit(localOrigin(r), "scan_network", "", nil, nil)
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodDelete:
+		if !eg.scanner.Cancel() {
+			eg.audit(localOrigin(r), "cancel_scan", "", nil, errors.New("no scan running"))
+			writeError(w, http.StatusConflict, "no scan running")
+			return
+		}
+		eg.audit(localOrigin(r), "cancel_scan", "", nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleStreamsAPI reports the health of active streams
+func (eg *EdgeGateway) handleStreamsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.streamHealth())
+}
+
+// handleRelaysAPI lists active relays
+func (eg *EdgeGateway) handleRelaysAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.listRelays())
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
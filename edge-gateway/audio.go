@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// Kinds of audio_event
+const (
+	// audioSoundLevel is the camera's audio input crossing its trigger
+	// level
+	audioSoundLevel = "sound_level"
+	// audioDetectedSound is a sound classified by the camera, such as a
+	// scream or breaking glass
+	audioDetectedSound = "detected_sound"
+	// audioAnalytics is any other event of an audio analytics application
+	audioAnalytics = "audio_analytics"
+)
+
+// AudioEvent is the audio_event payload
+type AudioEvent struct {
+	CameraID string `json:"camera_id"`
+	Kind     string `json:"kind"`
+	Topic    string `json:"topic"`
+	// Sound is the class of a detected sound, as the camera names it
+	Sound string `json:"sound,omitempty"`
+	// Active is set for events that turn on and off, such as the trigger
+	// level
+	Active *bool     `json:"active,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// CameraAudioRequest is the set_camera_audio payload. Fields left out are
+// unchanged.
+type CameraAudioRequest struct {
+	CameraID    string `json:"camera_id"`
+	Enabled     *bool  `json:"enabled,omitempty"`
+	InputGainDB *int   `json:"input_gain_db,omitempty"`
+}
+
+// CameraAudio is the camera_audio payload: a camera's audio settings
+type CameraAudio struct {
+	CameraID string `json:"camera_id"`
+	Enabled  bool   `json:"enabled"`
+	// InputGain is the gain in dB, or mute
+	InputGain string `json:"input_gain,omitempty"`
+}
+
+// audioMimeTypes are the WebRTC MIME types of the camera audio codecs
+// viewers can be sent as they are. AAC would need transcoding.
+var audioMimeTypes = map[av.CodecType]string{
+	av.PCM_MULAW: webrtc.MimeTypePCMU,
+	av.PCM_ALAW:  webrtc.MimeTypePCMA,
+	av.OPUS:      webrtc.MimeTypeOpus,
+}
+
+// audioEventKind returns the kind of audio_event a camera event topic is,
+// or empty if it is not an audio event
+func audioEventKind(topic string) string {
+	switch {
+	case topic == "AudioSource/TriggerLevel":
+		return audioSoundLevel
+	case strings.HasPrefix(topic, "AudioAnalytics/"):
+		return audioDetectedSound
+	case strings.HasPrefix(topic, "CameraApplicationPlatform/") && strings.Contains(topic, "Audio"):
+		return audioAnalytics
+	}
+	return ""
+}
+
+// audioEvent converts a camera event to an audio_event, or returns nil if it
+// is not an audio event
+func audioEvent(cameraID string, event CameraEvent) *AudioEvent {
+	kind := audioEventKind(event.Topic)
+	if kind == "" {
+		return nil
+	}
+	e := &AudioEvent{CameraID: cameraID, Kind: kind, Topic: event.Topic, Time: event.Time.UTC()}
+	for _, name := range []string{"Type", "Class", "Sound"} {
+		if sound := event.Data[name]; sound != "" {
+			e.Sound = sound
+			break
+		}
+	}
+	if event.Stateful {
+		active := event.Active
+		e.Active = &active
+	}
+	return e
+}
+
+// audioEventsEnabledFor reports whether audio events are forwarded for a
+// camera
+func (eg *EdgeGateway) audioEventsEnabledFor(cameraID string) bool {
+	if !eg.cfg.AudioEvents {
+		return false
+	}
+	if len(eg.cfg.AudioEventCameras) == 0 {
+		return true
+	}
+	for _, id := range eg.cfg.AudioEventCameras {
+		if id == cameraID {
+			return true
+		}
+	}
+	return false
+}
+
+// runAudioEvents forwards the audio events of each approved camera selected
+// by AUDIO_EVENT_CAMERAS until ctx is cancelled
+func (eg *EdgeGateway) runAudioEvents(ctx context.Context) {
+	watchers := make(map[string]context.CancelFunc)
+	ticker := time.NewTicker(eventClipSyncInterval)
+	defer ticker.Stop()
+	for {
+		eg.camerasLock.RLock()
+		cameras := make(map[string]bool)
+		for id, camera := range eg.cameras {
+			// Sensors of a multi-sensor camera share its audio
+			if camera.Approval == "" && camera.ParentID == "" && !camera.Simulated && camera.Device == "" && !camera.Generic && eg.audioEventsEnabledFor(id) {
+				cameras[id] = true
+			}
+		}
+		eg.camerasLock.RUnlock()
+
+		for cameraID, cancel := range watchers {
+			if !cameras[cameraID] {
+				cancel()
+				delete(watchers, cameraID)
+			}
+		}
+		for cameraID := range cameras {
+			if _, exists := watchers[cameraID]; exists {
+				continue
+			}
+			watchCtx, cancel := context.WithCancel(ctx)
+			watchers[cameraID] = cancel
+			cameraID := cameraID
+			eg.goTracked(func() { eg.watchAudioEvents(watchCtx, cameraID) })
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, cancel := range watchers {
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchAudioEvents subscribes to a camera's events and sends its audio
+// events as audio_event until ctx is done
+func (eg *EdgeGateway) watchAudioEvents(ctx context.Context, cameraID string) {
+	pullTimeout := max(eg.cfg.CameraHTTPTimeout-2*time.Second, time.Second)
+	retry := eventClipMinRetry
+
+	var sub cameraEventSource
+	defer func() {
+		if sub != nil {
+			unsubscribeCtx, cancel := context.WithTimeout(context.Background(), eg.cfg.CameraHTTPTimeout)
+			sub.unsubscribe(unsubscribeCtx)
+			cancel()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if sub == nil {
+			eg.camerasLock.RLock()
+			camera, exists := eg.cameras[cameraID]
+			eg.camerasLock.RUnlock()
+			if !exists {
+				return
+			}
+			var err error
+			if sub, err = eg.subscribeCameraEvents(ctx, camera); err != nil {
+				log.Printf("Audio events: can't watch events of camera %s, retrying in %s: %v", cameraID, retry, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry):
+				}
+				retry = min(retry*2, eventClipMaxRetry)
+				continue
+			}
+			log.Printf("Audio events: watching events of camera %s", cameraID)
+		}
+
+		events, err := sub.pull(ctx, pullTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Audio events: lost event subscription of camera %s: %v", cameraID, err)
+			sub = nil
+			continue
+		}
+		retry = eventClipMinRetry
+		for _, event := range events {
+			if e := audioEvent(cameraID, event); e != nil {
+				debugf("Audio events: camera %s raised %s", cameraID, event.Topic)
+				eg.sendEvent("audio_event", e)
+			}
+		}
+	}
+}
+
+// setCameraAudio turns a camera's audio on or off and sets its input gain
+// through param.cgi, and returns the resulting settings. Running streams of
+// the camera are reconnected when audio is turned on or off, so they pick
+// up or drop the audio track.
+func (eg *EdgeGateway) setCameraAudio(ctx context.Context, req CameraAudioRequest) (CameraAudio, error) {
+	audio := CameraAudio{CameraID: req.CameraID}
+
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[req.CameraID]
+	var copied Camera
+	if exists {
+		copied = *camera
+	}
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return audio, errCameraNotFound
+	}
+	if copied.ParentID != "" {
+		return audio, fmt.Errorf("camera is a sensor of camera %s, which has the audio settings", copied.ParentID)
+	}
+	if copied.Simulated {
+		return audio, errors.New("simulated cameras have no audio settings")
+	}
+	if copied.Capabilities == nil || copied.Capabilities.Source != "vapix" {
+		return audio, errors.New("camera audio can only be set on Axis cameras")
+	}
+	if !copied.Capabilities.Audio {
+		return audio, errors.New("camera has no audio")
+	}
+	if req.Enabled == nil && req.InputGainDB == nil {
+		return audio, errors.New("no audio settings to set")
+	}
+
+	params := make(map[string]string)
+	if req.Enabled != nil {
+		params["Audio.A0.Enabled"] = "no"
+		if *req.Enabled {
+			params["Audio.A0.Enabled"] = "yes"
+		}
+	}
+	if req.InputGainDB != nil {
+		params["AudioSource.A0.InputGain"] = strconv.Itoa(*req.InputGainDB)
+	}
+
+	client := eg.httpClients.Client(&copied)
+	if err := vapixUpdateParams(ctx, client, params); err != nil {
+		return audio, err
+	}
+
+	if req.Enabled != nil {
+		restarted := 0
+		eg.streamsLock.RLock()
+		for _, stream := range eg.streams {
+			if stream.camera.ID == req.CameraID {
+				stream.restartIngest()
+				restarted++
+			}
+		}
+		eg.streamsLock.RUnlock()
+		if restarted > 0 {
+			log.Printf("Reconnecting %d streams of camera %s for its audio change", restarted, req.CameraID)
+		}
+	}
+
+	settings, err := vapixParams(ctx, client, "Audio")
+	if err != nil {
+		return audio, fmt.Errorf("audio settings were set but can't be read back: %v", err)
+	}
+	audio.Enabled = settings["root.Audio.A0.Enabled"] == "yes"
+	if source, err := vapixParams(ctx, client, "AudioSource"); err == nil {
+		audio.InputGain = source["root.AudioSource.A0.InputGain"]
+	}
+	return audio, nil
+}
+
+// audioStream returns the index of the ingest's audio stream viewers can be
+// sent, or -1, creating the stream's audio track the first time. The track
+// keeps the codec it was created with, so audio in another codec after the
+// camera is reconfigured isn't sent until the stream is reopened.
+func (cs *CameraStream) audioStream(codecs []av.CodecData) int {
+	for i, codec := range codecs {
+		mimeType, ok := audioMimeTypes[codec.Type()]
+		if !ok {
+			continue
+		}
+		cs.runningLock.Lock()
+		defer cs.runningLock.Unlock()
+		if cs.audioTrack == nil {
+			track, err := webrtc.NewTrackLocalStaticSample(
+				webrtc.RTPCodecCapability{MimeType: mimeType}, "audio", "video0")
+			if err != nil {
+				log.Printf("Failed to create audio track: %v", err)
+				return -1
+			}
+			cs.audioTrack = track
+		}
+		if cs.audioTrack.Codec().MimeType != mimeType {
+			log.Printf("Camera %s audio changed to %s, not sending it until its stream restarts", cs.camera.ID, mimeType)
+			return -1
+		}
+		return i
+	}
+	return -1
+}
+
+// audio returns the stream's audio track, or nil
+func (cs *CameraStream) audio() *webrtc.TrackLocalStaticSample {
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	return cs.audioTrack
+}
+
+// writeAudio sends an audio frame to the viewers that turned audio on
+func (cs *CameraStream) writeAudio(packet av.Packet) {
+	sample := media.Sample{Data: packet.Data, Duration: packet.Duration}
+	if err := cs.audio().WriteSample(sample); err != nil {
+		debugf("Failed to write audio sample for camera %s: %v", cs.camera.ID, err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Where a control action came from
+const (
+	auditSourceCloud    = "cloud"
+	auditSourceViewer   = "viewer" // a WebRTC viewer's data channel
+	auditSourceMQTT     = "mqtt"
+	auditSourceLocalAPI = "local_api"
+	auditSourceSignal   = "signal" // SIGHUP
+)
+
+// auditLogID is the Cloud Logging log audit records are shipped to
+const auditLogID = "edge-gateway-audit"
+
+// AuditOrigin is who asked for a control action. The orchestrator passes
+// the user and session behind a cloud message as its payload's actor.
+type AuditOrigin struct {
+	Source    string `json:"source"`
+	UserID    string `json:"user_id,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	Address   string `json:"address,omitempty"` // of a local API client
+	// TenantID is the tenant of the user, empty for the gateway's operator
+	TenantID string `json:"tenant_id,omitempty"`
+	// RequestID is the cloud message's request_id, answered with
+	// command_result
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// cloudOrigin returns the origin of a cloud message from its actor and
+// request_id
+func cloudOrigin(payload json.RawMessage) AuditOrigin {
+	var p struct {
+		Actor struct {
+			UserID    string `json:"user_id"`
+			SessionID string `json:"session_id"`
+			TenantID  string `json:"tenant_id"`
+		} `json:"actor"`
+		RequestID string `json:"request_id"`
+	}
+	json.Unmarshal(payload, &p)
+	return AuditOrigin{Source: auditSourceCloud, UserID: p.Actor.UserID, SessionID: p.Actor.SessionID, TenantID: p.Actor.TenantID, RequestID: p.RequestID}
+}
+
+// localOrigin returns the origin of a local API request
+func localOrigin(r *http.Request) AuditOrigin {
+	return AuditOrigin{Source: auditSourceLocalAPI, Address: r.RemoteAddr}
+}
+
+// AuditRecord is a control action and its result
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	AuditOrigin
+	Action   string                 `json:"action"`
+	CameraID string                 `json:"camera_id,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+	Result   string                 `json:"result"` // ok or error
+	Error    string                 `json:"error,omitempty"`
+}
+
+// AuditLog appends records to DATA_DIR/audit.log as JSON lines, rotating the
+// file when it reaches AUDIT_LOG_MAX_MB and keeping AUDIT_LOG_FILES old ones,
+// and ships them to Cloud Logging when AUDIT_CLOUD_LOGGING is set
+type AuditLog struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	files    int
+	file     *os.File
+	size     int64
+
+	client *logging.Client // nil unless shipping to Cloud Logging
+	logger *logging.Logger
+}
+
+func NewAuditLog(cfg *Config) *AuditLog {
+	return &AuditLog{
+		path:     filepath.Join(cfg.DataDir, "audit.log"),
+		maxBytes: int64(cfg.AuditLogMaxMB) << 20,
+		files:    cfg.AuditLogFiles,
+	}
+}
+
+// StartCloudLogging ships records from now on to the project's
+// edge-gateway-audit log, using application default credentials
+func (a *AuditLog) StartCloudLogging(ctx context.Context, projectID string) error {
+	if projectID == "" {
+		creds, err := google.FindDefaultCredentials(ctx, logging.WriteScope)
+		if err != nil {
+			return fmt.Errorf("no Google credentials for Cloud Logging: %v", err)
+		}
+		if projectID = creds.ProjectID; projectID == "" {
+			return fmt.Errorf("no project for Cloud Logging, set AUDIT_PROJECT_ID")
+		}
+	}
+
+	client, err := logging.NewClient(ctx, projectID,
+		option.WithGRPCDialOption(grpc.WithContextDialer(dialEgress)))
+	if err != nil {
+		return fmt.Errorf("failed to create Cloud Logging client: %v", err)
+	}
+	client.OnError = func(err error) {
+		log.Printf("Audit: Cloud Logging: %v", err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.client = client
+	a.logger = client.Logger(auditLogID, logging.CommonLabels(map[string]string{
+		"gateway_id": getGatewayID(),
+	}))
+	log.Printf("Audit: shipping records to Cloud Logging in project %s", projectID)
+	return nil
+}
+
+// Record appends a record to the log and queues it for Cloud Logging
+func (a *AuditLog) Record(r AuditRecord) {
+	data, _ := json.Marshal(r)
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.writeLocked(data); err != nil {
+		log.Printf("Audit: failed to write %s record: %v", r.Action, err)
+	}
+	if a.logger != nil {
+		severity := logging.Notice
+		if r.Result != "ok" {
+			severity = logging.Warning
+		}
+		a.logger.Log(logging.Entry{Timestamp: r.Time, Severity: severity, Payload: json.RawMessage(data[:len(data)-1])})
+	}
+}
+
+// writeLocked appends data to the file, rotating it first if data would
+// take it over the size limit. The caller holds lock.
+func (a *AuditLog) writeLocked(data []byte) error {
+	if a.file == nil {
+		if err := a.openLocked(); err != nil {
+			return err
+		}
+	}
+	if a.size > 0 && a.size+int64(len(data)) > a.maxBytes {
+		a.file.Close()
+		a.file = nil
+		a.rotateLocked()
+		if err := a.openLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// openLocked opens the file for appending. The caller holds lock.
+func (a *AuditLog) openLocked() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size = file, info.Size()
+	return nil
+}
+
+// rotateLocked shifts audit.log to audit.log.1, audit.log.1 to audit.log.2
+// and so on, dropping the oldest. The caller holds lock.
+func (a *AuditLog) rotateLocked() {
+	rotated := func(n int) string {
+		return a.path + "." + strconv.Itoa(n)
+	}
+	if a.files <= 0 {
+		os.Remove(a.path)
+		return
+	}
+	os.Remove(rotated(a.files))
+	for n := a.files - 1; n >= 1; n-- {
+		os.Rename(rotated(n), rotated(n+1))
+	}
+	if err := os.Rename(a.path, rotated(1)); err != nil {
+		log.Printf("Audit: failed to rotate log: %v", err)
+	}
+}
+
+// Close closes the file and sends the records still queued for Cloud Logging
+func (a *AuditLog) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.client != nil {
+		if err := a.client.Close(); err != nil {
+			log.Printf("Audit: failed to flush Cloud Logging: %v", err)
+		}
+		a.client, a.logger = nil, nil
+	}
+}
+
+// audit records a control action, failed if err is set
+func (eg *EdgeGateway) audit(origin AuditOrigin, action, cameraID string, details map[string]interface{}, err error) {
+	record := AuditRecord{
+		Time:        time.Now().UTC(),
+		AuditOrigin: origin,
+		Action:      action,
+		CameraID:    cameraID,
+		Details:     details,
+		Result:      "ok",
+	}
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+	}
+	eg.auditLog.Record(record)
+	eg.finishCommand(origin, action, cameraID, err)
+}
+
+// auditAddCamera audits an add_camera, noting whether it set the camera's
+// credentials but never what they are
+func (eg *EdgeGateway) auditAddCamera(origin AuditOrigin, req AddCameraRequest, camera *Camera, err error) {
+	cameraID := req.ID
+	if camera != nil {
+		cameraID = camera.ID
+	}
+	credentials := req.Username != "" || req.Password != ""
+	if u, err := url.Parse(req.RTSPUrl); err == nil && u.User != nil {
+		credentials = true
+	}
+	eg.audit(origin, "add_camera", cameraID, map[string]interface{}{
+		"ip":          req.IP,
+		"generic":     req.Generic,
+		"credentials": credentials,
+	}, err)
+}
+
+// configFields lists the settings a set_config delta changes, which is what
+// gets audited: values can hold ICE server credentials
+func configFields(delta RemoteConfig) []string {
+	data, _ := json.Marshal(delta)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
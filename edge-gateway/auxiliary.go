@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Auxiliary actions of a PTZCommand. The wiper and washer run once; the
+// IR illuminator and status LED are settings, with enabled.
+const (
+	auxIRIlluminator = "ir_illuminator"
+	auxStatusLED     = "status_led"
+	auxWiper         = "wiper"
+	auxWasher        = "washer"
+)
+
+// onvifPTZPaths are the PTZ service endpoints tried in order
+var onvifPTZPaths = []string{"/onvif/ptz_service", "/onvif/PTZ", "/onvif/ptz"}
+
+// onvifAuxiliaryNames map the ONVIF auxiliary command names, as in
+// tt:Wiper|On, to auxiliary actions
+var onvifAuxiliaryNames = map[string]string{
+	"tt:Wiper":            auxWiper,
+	"tt:Washer":           auxWasher,
+	"tt:WashingProcedure": auxWasher,
+	"tt:IRLamp":           auxIRIlluminator,
+}
+
+// isAuxiliaryAction reports whether a PTZCommand action controls an
+// auxiliary device
+func isAuxiliaryAction(action string) bool {
+	switch action {
+	case auxIRIlluminator, auxStatusLED, auxWiper, auxWasher:
+		return true
+	}
+	return false
+}
+
+// cameraHasAuxiliary reports whether a camera reported an auxiliary action
+func cameraHasAuxiliary(camera *Camera, action string) bool {
+	if camera.Capabilities == nil {
+		return false
+	}
+	for _, a := range camera.Capabilities.Auxiliary {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// vapixAuxiliary returns the auxiliary actions of an Axis camera: the
+// status LED if it has the StatusLED group, IR illuminators from the light
+// control API, and the wiper and washer if its PTZ driver takes auxiliary
+// requests
+func vapixAuxiliary(ctx context.Context, client *CameraHTTPClient, ptz map[string]string) []string {
+	var actions []string
+	if led, err := vapixParams(ctx, client, "StatusLED"); err == nil && led["root.StatusLED.Usage"] != "" {
+		actions = append(actions, auxStatusLED)
+	}
+	if lights, err := vapixIRLights(ctx, client); err == nil && len(lights) > 0 {
+		actions = append(actions, auxIRIlluminator)
+	}
+	if ptz["root.PTZ.Support.S1.AuxiliaryRequest"] == "true" {
+		actions = append(actions, auxWiper, auxWasher)
+	}
+	return actions
+}
+
+// vapixIRLights returns the IDs of a camera's IR illuminators
+func vapixIRLights(ctx context.Context, client *CameraHTTPClient) ([]string, error) {
+	var info struct {
+		Items []struct {
+			LightID   string `json:"lightID"`
+			LightType string `json:"lightType"`
+		} `json:"items"`
+	}
+	if err := vapixJSON(ctx, client, "/axis-cgi/lightcontrol.cgi", "1.0", "getLightInformation", nil, &info); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, item := range info.Items {
+		if strings.EqualFold(item.LightType, "IR") {
+			ids = append(ids, item.LightID)
+		}
+	}
+	return ids, nil
+}
+
+// onvifAuxiliaryCommands returns the auxiliary commands the camera's PTZ
+// nodes list, such as tt:Wiper|On or tt:IRLamp|On|Off|Auto
+func onvifAuxiliaryCommands(ctx context.Context, client *CameraHTTPClient) ([]string, error) {
+	var lastErr error
+	for _, path := range onvifPTZPaths {
+		var nodes struct {
+			Commands []string `xml:"GetNodesResponse>PTZNode>AuxiliaryCommands"`
+		}
+		if lastErr = onvifCall(ctx, client, path, `<GetNodes xmlns="http://www.onvif.org/ver20/ptz/wsdl"/>`, &nodes); lastErr == nil {
+			return nodes.Commands, nil
+		}
+	}
+	return nil, fmt.Errorf("ONVIF PTZ service not available: %v", lastErr)
+}
+
+// onvifAuxiliary returns the auxiliary actions of ONVIF auxiliary commands
+func onvifAuxiliary(commands []string) []string {
+	found := make(map[string]bool)
+	for _, command := range commands {
+		name, _, _ := strings.Cut(strings.TrimSpace(command), "|")
+		if action, ok := onvifAuxiliaryNames[name]; ok {
+			found[action] = true
+		}
+	}
+	return sortedKeys(found)
+}
+
+// sendAuxiliary runs an auxiliary action on the camera
+func sendAuxiliary(ctx context.Context, client *CameraHTTPClient, camera *Camera, cmd PTZCommand) error {
+	if (cmd.Action == auxIRIlluminator || cmd.Action == auxStatusLED) && cmd.Enabled == nil {
+		return fmt.Errorf("%s needs enabled", cmd.Action)
+	}
+	if camera.Capabilities != nil && camera.Capabilities.Source == "onvif" {
+		return onvifSendAuxiliary(ctx, client, camera, cmd)
+	}
+
+	switch cmd.Action {
+	case auxStatusLED:
+		usage := "off"
+		if *cmd.Enabled {
+			usage = "on"
+		}
+		return vapixUpdateParams(ctx, client, map[string]string{"StatusLED.Usage": usage})
+
+	case auxIRIlluminator:
+		lights, err := vapixIRLights(ctx, client)
+		if err != nil {
+			return err
+		}
+		if len(lights) == 0 {
+			return errors.New("camera has no IR illuminator")
+		}
+		method := "disableLight"
+		if *cmd.Enabled {
+			method = "enableLight"
+		}
+		for _, id := range lights {
+			if err := vapixJSON(ctx, client, "/axis-cgi/lightcontrol.cgi", "1.0", method, map[string]string{"lightID": id}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	command := "tt:Wiper|On"
+	if cmd.Action == auxWasher {
+		command = "tt:Washer|On"
+	}
+	resp, err := client.Get(ctx, "/axis-cgi/com/ptz.cgi?"+ptzQuery(camera, "auxiliary="+url.QueryEscape(command)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("ptz.cgi returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// onvifSendAuxiliary sends the auxiliary command of an action, as the
+// camera names it, to the PTZ service. ONVIF has no status LED command.
+func onvifSendAuxiliary(ctx context.Context, client *CameraHTTPClient, camera *Camera, cmd PTZCommand) error {
+	if cmd.Action == auxStatusLED {
+		return errors.New("status_led is not supported over ONVIF")
+	}
+	commands, err := onvifAuxiliaryCommands(ctx, client)
+	if err != nil {
+		return err
+	}
+	state := "On"
+	if cmd.Enabled != nil && !*cmd.Enabled {
+		state = "Off"
+	}
+	command := ""
+	for _, c := range commands {
+		name, states, _ := strings.Cut(strings.TrimSpace(c), "|")
+		if onvifAuxiliaryNames[name] != cmd.Action {
+			continue
+		}
+		if states != "" && !strings.Contains("|"+states+"|", "|"+state+"|") {
+			continue
+		}
+		// The washing procedure washes and wipes, so it is preferred over
+		// the bare washer
+		if command == "" || name == "tt:WashingProcedure" {
+			command = name + "|" + state
+		}
+	}
+	if command == "" {
+		return fmt.Errorf("camera has no ONVIF auxiliary command to turn %s %s", cmd.Action, strings.ToLower(state))
+	}
+
+	profile, err := onvifProfileToken(ctx, client, camera.Channel)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`<SendAuxiliaryCommand xmlns="http://www.onvif.org/ver20/ptz/wsdl">`+
+		`<ProfileToken>%s</ProfileToken><AuxiliaryData>%s</AuxiliaryData></SendAuxiliaryCommand>`,
+		xmlEscape(profile), xmlEscape(command))
+	var lastErr error
+	for _, path := range onvifPTZPaths {
+		if lastErr = onvifCall(ctx, client, path, body, &struct{}{}); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("ONVIF PTZ service: %v", lastErr)
+}
+
+// onvifProfileToken returns the token of the first media profile of a video
+// source, numbered from 1 as in onvifVideoSource
+func onvifProfileToken(ctx context.Context, client *CameraHTTPClient, channel int) (string, error) {
+	source, err := onvifVideoSource(ctx, client, channel)
+	if err != nil {
+		return "", err
+	}
+	var lastErr error
+	for _, path := range onvifMediaPaths {
+		var profiles struct {
+			Profiles []struct {
+				Token  string `xml:"token,attr"`
+				Source string `xml:"VideoSourceConfiguration>SourceToken"`
+			} `xml:"GetProfilesResponse>Profiles"`
+		}
+		if lastErr = onvifCall(ctx, client, path, `<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &profiles); lastErr != nil {
+			continue
+		}
+		for _, p := range profiles.Profiles {
+			if p.Source == source {
+				return p.Token, nil
+			}
+		}
+		return "", fmt.Errorf("camera has no ONVIF media profile of video source %s", source)
+	}
+	return "", fmt.Errorf("ONVIF media service not available: %v", lastErr)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops calls to a failing dependency for a cooldown period
+// and then lets a single trial call through before closing again
+type circuitBreaker struct {
+	lock      sync.Mutex
+	state     circuitState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call may proceed
+func (b *circuitBreaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trial = true
+		return true
+	case circuitHalfOpen:
+		// Only one trial call at a time while half-open
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful call and closes the breaker
+func (b *circuitBreaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = circuitClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure records a failed call; it returns true if the breaker just opened
+func (b *circuitBreaker) Failure() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trial = false
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		return true
+	}
+
+	b.failures++
+	if b.state == circuitClosed && b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// State returns the current breaker state
+func (b *circuitBreaker) State() circuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// A step is a call to the breaker, or "cooldown" for the cooldown
+	// passing, and what Allow or Failure returns
+	type step struct {
+		call string
+		want bool
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+		state     circuitState
+	}{
+		{
+			name:      "closed below threshold",
+			threshold: 3,
+			steps:     []step{{"failure", false}, {"failure", false}, {"allow", true}},
+			state:     circuitClosed,
+		},
+		{
+			name:      "opens at threshold",
+			threshold: 2,
+			steps:     []step{{"failure", false}, {"failure", true}, {"allow", false}},
+			state:     circuitOpen,
+		},
+		{
+			name:      "success resets failures",
+			threshold: 2,
+			steps:     []step{{"failure", false}, {"success", false}, {"failure", false}, {"allow", true}},
+			state:     circuitClosed,
+		},
+		{
+			name:      "half open after cooldown",
+			threshold: 1,
+			steps:     []step{{"failure", true}, {"cooldown", false}, {"allow", true}},
+			state:     circuitHalfOpen,
+		},
+		{
+			name:      "one trial at a time",
+			threshold: 1,
+			steps:     []step{{"failure", true}, {"cooldown", false}, {"allow", true}, {"allow", false}, {"allow", false}},
+			state:     circuitHalfOpen,
+		},
+		{
+			name:      "trial success closes",
+			threshold: 1,
+			steps:     []step{{"failure", true}, {"cooldown", false}, {"allow", true}, {"success", false}, {"allow", true}, {"allow", true}},
+			state:     circuitClosed,
+		},
+		{
+			name:      "trial failure reopens",
+			threshold: 3,
+			steps:     []step{{"failure", false}, {"failure", false}, {"failure", true}, {"cooldown", false}, {"allow", true}, {"failure", true}, {"allow", false}},
+			state:     circuitOpen,
+		},
+		{
+			name:      "reopened breaker tries again after cooldown",
+			threshold: 1,
+			steps:     []step{{"failure", true}, {"cooldown", false}, {"allow", true}, {"failure", true}, {"cooldown", false}, {"allow", true}, {"success", false}},
+			state:     circuitClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(tt.threshold, time.Hour)
+			for i, s := range tt.steps {
+				var got bool
+				switch s.call {
+				case "allow":
+					got = b.Allow()
+				case "failure":
+					got = b.Failure()
+				case "success":
+					b.Success()
+				case "cooldown":
+					b.lock.Lock()
+					b.openedAt = b.openedAt.Add(-b.cooldown)
+					b.lock.Unlock()
+				}
+				if got != s.want {
+					t.Fatalf("step %d %s returned %v, want %v", i, s.call, got, s.want)
+				}
+			}
+			if state := b.State(); state != tt.state {
+				t.Errorf("state %s, want %s", state, tt.state)
+			}
+		})
+	}
+}
+
+// A request waiting for a camera's busy request slot must not take a
+// half-open breaker's trial, or the breaker would stay half open
+func TestCameraHTTPTrialWaitsForSlot(t *testing.T) {
+	c := &CameraHTTPClient{
+		sem:     make(chan struct{}, 1),
+		breaker: newCircuitBreaker(1, time.Hour),
+	}
+	c.breaker.Failure()
+	c.breaker.openedAt = c.breaker.openedAt.Add(-time.Hour)
+	c.sem <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://camera.invalid/", nil)
+	_, err := c.send(req, func(*http.Request) (*http.Response, error) {
+		t.Fatal("sent without a request slot")
+		return nil, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the request's deadline", err)
+	}
+	if !c.breaker.Allow() {
+		t.Error("trial taken by a request that never ran")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// errOverCapacity refuses an outbound session that would exceed an uplink
+// budget or MAX_OUTBOUND_STREAMS
+var errOverCapacity = errors.New(sessionReasonOverCapacity)
+
+// outboundSession is a viewer or relay sending a camera's video off site
+type outboundSession struct {
+	cameraID string
+	profile  string
+}
+
+// parseCameraBudgets parses cameraID=kbps entries, rejecting invalid ones
+func parseCameraBudgets(field string, items []string) (map[string]int, error) {
+	budgets := make(map[string]int)
+	for _, item := range items {
+		cameraID, value, _ := strings.Cut(item, "=")
+		kbps, err := strconv.Atoi(strings.TrimSpace(value))
+		if cameraID = strings.TrimSpace(cameraID); cameraID == "" || err != nil || kbps < 0 {
+			return nil, fmt.Errorf("invalid camera budget %q in %s", item, field)
+		}
+		budgets[cameraID] = kbps
+	}
+	return budgets, nil
+}
+
+// cameraUplinkBudget is a camera's uplink budget in kbit/s, 0 if unlimited
+func (s Settings) cameraUplinkBudget(cameraID string) int {
+	if kbps, ok := s.CameraUplinkBudgets[cameraID]; ok {
+		return kbps
+	}
+	return s.CameraUplinkBudgetKbps
+}
+
+// profileKbps estimates the bitrate of a viewer profile whose stream hasn't
+// been measured: the ABR ladder's, or the main stream's scaled by the
+// resolution
+func profileKbps(profile string) float64 {
+	if profile == viewerProfileMain {
+		return abrLadder[0].MinKbps
+	}
+	for _, p := range abrLadder[1:] {
+		if p.Name == profile {
+			return float64(p.MaxBitrate)
+		}
+	}
+	var w, h int
+	if _, err := fmt.Sscanf(profile, "%dx%d", &w, &h); err == nil {
+		return abrLadder[0].MinKbps * float64(w*h) / (1920 * 1080)
+	}
+	return abrLadder[0].MinKbps
+}
+
+// streamKbps is what one outbound session of a camera's stream sends: the
+// stream's measured bitrate while it runs, otherwise an estimate
+func (eg *EdgeGateway) streamKbps(cameraID, profile string) float64 {
+	eg.streamsLock.RLock()
+	stream, exists := eg.streams[streamKey(cameraID, profile)]
+	eg.streamsLock.RUnlock()
+	if exists {
+		if kbps := stream.stats.health(cameraID).BitrateKbps; kbps > 0 {
+			return kbps
+		}
+	}
+	return profileKbps(profile)
+}
+
+// uplinkUsage returns the estimated bitrate of all outbound sessions and of
+// one camera's. Called with budgetLock held.
+func (eg *EdgeGateway) uplinkUsage(cameraID string) (total, camera float64) {
+	for _, session := range eg.outbound {
+		kbps := eg.streamKbps(session.cameraID, session.profile)
+		total += kbps
+		if session.cameraID == cameraID {
+			camera += kbps
+		}
+	}
+	return total, camera
+}
+
+// uplinkKbps returns the estimated bitrate of all outbound sessions
+func (eg *EdgeGateway) uplinkKbps() float64 {
+	eg.budgetLock.Lock()
+	defer eg.budgetLock.Unlock()
+	total, _ := eg.uplinkUsage("")
+	return total
+}
+
+// admitOutbound reserves uplink for a session sending a camera's video off
+// site, and returns the profile it gets: the one asked for if it fits the
+// budgets, otherwise, with downgrade set, the best lower profile that does.
+// It returns errOverCapacity if none fits or MAX_OUTBOUND_STREAMS are
+// running. The reservation lasts until releaseOutbound.
+func (eg *EdgeGateway) admitOutbound(sessionID, cameraID, profile string, downgrade bool) (string, error) {
+	settings := eg.settings()
+	eg.budgetLock.Lock()
+	defer eg.budgetLock.Unlock()
+	return eg.reserveOutbound(settings, sessionID, cameraID, profile, downgrade)
+}
+
+// switchOutbound moves a session's reservation to another profile of its
+// camera, keeping the one it has if the new one doesn't fit
+func (eg *EdgeGateway) switchOutbound(sessionID, cameraID, profile string) error {
+	settings := eg.settings()
+	eg.budgetLock.Lock()
+	defer eg.budgetLock.Unlock()
+	previous, reserved := eg.outbound[sessionID]
+	delete(eg.outbound, sessionID)
+	if _, err := eg.reserveOutbound(settings, sessionID, cameraID, profile, false); err != nil {
+		if reserved {
+			eg.outbound[sessionID] = previous
+		}
+		return err
+	}
+	return nil
+}
+
+// reserveOutbound is admitOutbound. Called with budgetLock held.
+func (eg *EdgeGateway) reserveOutbound(settings Settings, sessionID, cameraID, profile string, downgrade bool) (string, error) {
+	if settings.MaxOutboundStreams > 0 && len(eg.outbound) >= settings.MaxOutboundStreams {
+		log.Printf("Refusing session %s for camera %s: %d outbound streams running", sessionID, cameraID, len(eg.outbound))
+		return "", errOverCapacity
+	}
+
+	total, camera := eg.uplinkUsage(cameraID)
+	cameraBudget := settings.cameraUplinkBudget(cameraID)
+	fits := func(kbps float64) bool {
+		return (settings.UplinkBudgetKbps <= 0 || total+kbps <= float64(settings.UplinkBudgetKbps)) &&
+			(cameraBudget <= 0 || camera+kbps <= float64(cameraBudget))
+	}
+
+	requested := eg.streamKbps(cameraID, profile)
+	admitted, ok := profile, fits(requested)
+	if !ok && downgrade {
+		for _, p := range abrLadder[1:] {
+			if kbps := eg.streamKbps(cameraID, p.Name); kbps < requested && fits(kbps) {
+				admitted, ok = p.Name, true
+				log.Printf("Uplink budget: serving session %s for camera %s at %s profile", sessionID, cameraID, p.Name)
+				break
+			}
+		}
+	}
+	if !ok {
+		log.Printf("Refusing session %s for camera %s: uplink budget exhausted (%.0f kbps in use)", sessionID, cameraID, total)
+		return "", errOverCapacity
+	}
+
+	eg.outbound[sessionID] = outboundSession{cameraID: cameraID, profile: admitted}
+	return admitted, nil
+}
+
+// releaseOutbound frees the uplink reserved for a session
+func (eg *EdgeGateway) releaseOutbound(sessionID string) {
+	eg.budgetLock.Lock()
+	defer eg.budgetLock.Unlock()
+	delete(eg.outbound, sessionID)
+}
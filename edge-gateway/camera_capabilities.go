@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CameraCapabilities is what a camera reported it can do when probed, so the
+// cloud doesn't have to assume PTZ and a single H.264 stream
+type CameraCapabilities struct {
+	Source       string     `json:"source"` // vapix, onvif, hikvision or dahua
+	Firmware     string     `json:"firmware,omitempty"`
+	VideoSources int        `json:"video_sources"`
+	Resolutions  []string   `json:"resolutions,omitempty"`
+	Codecs       []string   `json:"codecs,omitempty"`
+	Audio        bool       `json:"audio"`
+	PTZ          bool       `json:"ptz"`
+	PTZLimits    *PTZLimits `json:"ptz_limits,omitempty"`
+	// Imaging is nil when the camera reports no lens or IR-cut controls
+	Imaging *ImagingCapabilities `json:"imaging,omitempty"`
+	// IOPorts are the digital inputs and outputs of Axis cameras
+	IOPorts []IOPort `json:"io_ports,omitempty"`
+	// Auxiliary are the auxiliary PTZCommand actions the camera takes, such
+	// as wiper or ir_illuminator
+	Auxiliary []string `json:"auxiliary,omitempty"`
+	// Adapter is the vendor adapter, hikvision or dahua, that drives the
+	// camera's PTZ, snapshots and events
+	Adapter string `json:"adapter,omitempty"`
+}
+
+// PTZLimits are the pan, tilt and zoom ranges of a PTZ camera. VAPIX reports
+// degrees and zoom steps; ONVIF reports its normalized -1..1 and 0..1 spaces.
+type PTZLimits struct {
+	MinPan  float64 `json:"min_pan"`
+	MaxPan  float64 `json:"max_pan"`
+	MinTilt float64 `json:"min_tilt"`
+	MaxTilt float64 `json:"max_tilt"`
+	MinZoom float64 `json:"min_zoom"`
+	MaxZoom float64 `json:"max_zoom"`
+}
+
+// probeCapabilities asks the camera what it supports, trying VAPIX first and
+// then ONVIF, and sets Capabilities, HasPTZ and Model from the answer. Other
+// cameras are fingerprinted for a vendor adapter, which stands in for ONVIF
+// if the camera doesn't answer it. A camera that answers none is left
+// without capabilities or PTZ.
+func (eg *EdgeGateway) probeCapabilities(ctx context.Context, camera *Camera) {
+	client := eg.httpClients.Client(camera)
+
+	caps, err := vapixCapabilities(ctx, client)
+	if err == nil {
+		if camera.Model == "" {
+			camera.Model = caps.model
+		}
+		camera.Capabilities = &caps.CameraCapabilities
+		camera.HasPTZ = caps.PTZ
+		return
+	}
+
+	adapter, device := identifyAdapter(ctx, client)
+	if device != nil && camera.Model == "" {
+		camera.Model = device.Model
+	}
+
+	onvifCaps, onvifErr := onvifCapabilities(ctx, client)
+	if onvifErr == nil {
+		if device != nil {
+			onvifCaps.Adapter = adapter
+			if onvifCaps.Firmware == "" {
+				onvifCaps.Firmware = device.Firmware
+			}
+		}
+		camera.Capabilities = onvifCaps
+		camera.HasPTZ = onvifCaps.PTZ
+		return
+	}
+	if device != nil {
+		camera.Capabilities = &CameraCapabilities{
+			Source:       adapter,
+			Adapter:      adapter,
+			Firmware:     device.Firmware,
+			VideoSources: 1,
+			PTZ:          device.PTZ,
+		}
+		camera.HasPTZ = device.PTZ
+		return
+	}
+
+	log.Printf("Could not probe capabilities of camera %s: vapix: %v; onvif: %v", camera.ID, err, onvifErr)
+	camera.Capabilities = nil
+	camera.HasPTZ = false
+}
+
+// vapixCaps adds the model name, which belongs on the Camera record
+type vapixCaps struct {
+	CameraCapabilities
+	model string
+}
+
+// vapixCapabilities reads the Properties group, which every Axis camera
+// serves, and the optional ImageSource, IOPort and PTZ groups. PTZ has the
+// limits and the lens and IR-cut controls. Auxiliary devices are read last.
+func vapixCapabilities(ctx context.Context, client *CameraHTTPClient) (*vapixCaps, error) {
+	props, err := vapixParams(ctx, client, "Properties")
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &vapixCaps{CameraCapabilities: CameraCapabilities{
+		Source:       "vapix",
+		Firmware:     props["root.Properties.Firmware.Version"],
+		VideoSources: 1,
+		Resolutions:  splitList(props["root.Properties.Image.Resolution"]),
+		Audio:        props["root.Properties.Audio.Audio"] == "yes",
+		PTZ:          props["root.Properties.PTZ.PTZ"] == "yes",
+	}}
+	for _, format := range splitList(props["root.Properties.Image.Format"]) {
+		// Image.Format also lists still-image formats
+		switch format {
+		case "h264", "h265", "mjpeg":
+			caps.Codecs = append(caps.Codecs, format)
+		}
+	}
+
+	if brand, err := vapixParams(ctx, client, "Brand"); err == nil {
+		caps.model = brand["root.Brand.ProdShortName"]
+	}
+	if sources, err := vapixParams(ctx, client, "ImageSource"); err == nil {
+		if n, err := strconv.Atoi(sources["root.ImageSource.NbrOfSources"]); err == nil && n > 0 {
+			caps.VideoSources = n
+		}
+	}
+	if ports, err := vapixParams(ctx, client, "IOPort"); err == nil {
+		caps.IOPorts = vapixIOPorts(ports)
+	}
+	var ptz map[string]string
+	if caps.PTZ {
+		if ptz, err = vapixParams(ctx, client, "PTZ"); err == nil {
+			caps.PTZLimits = vapixPTZLimits(ptz, 1)
+			caps.Imaging = vapixImaging(ptz, 1)
+		}
+	}
+	caps.Auxiliary = vapixAuxiliary(ctx, client, ptz)
+	return caps, nil
+}
+
+// vapixPTZLimits reads the limits of a video channel, numbered from 1
+func vapixPTZLimits(params map[string]string, channel int) *PTZLimits {
+	prefix := fmt.Sprintf("root.PTZ.Limit.L%d.", channel)
+	value := func(name string) (float64, bool) {
+		v, err := strconv.ParseFloat(params[prefix+name], 64)
+		return v, err == nil
+	}
+
+	var limits PTZLimits
+	found := false
+	for _, field := range []struct {
+		name string
+		dst  *float64
+	}{
+		{"MinPan", &limits.MinPan}, {"MaxPan", &limits.MaxPan},
+		{"MinTilt", &limits.MinTilt}, {"MaxTilt", &limits.MaxTilt},
+		{"MinZoom", &limits.MinZoom}, {"MaxZoom", &limits.MaxZoom},
+	} {
+		if v, ok := value(field.name); ok {
+			*field.dst = v
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &limits
+}
+
+// vapixParams lists a param.cgi group as a map of full parameter names to
+// values
+func vapixParams(ctx context.Context, client *CameraHTTPClient, group string) (map[string]string, error) {
+	resp, err := client.Get(ctx, "/axis-cgi/param.cgi?action=list&group="+group)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("param.cgi returned status %d", resp.StatusCode)
+	}
+
+	params := make(map[string]string)
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# Error") {
+			return nil, errors.New(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+		}
+		if name, value, ok := strings.Cut(line, "="); ok {
+			params[name] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("param.cgi returned no %s parameters", group)
+	}
+	return params, nil
+}
+
+// vapixUpdateParams sets param.cgi parameters, named without root.
+func vapixUpdateParams(ctx context.Context, client *CameraHTTPClient, params map[string]string) error {
+	query := url.Values{"action": {"update"}}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	resp, err := client.Get(ctx, "/axis-cgi/param.cgi?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("param.cgi returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if reply := strings.TrimSpace(string(body)); strings.HasPrefix(reply, "# Error") {
+		return errors.New(strings.TrimSpace(strings.TrimPrefix(reply, "#")))
+	}
+	return nil
+}
+
+// onvifCapabilities reads the camera's media profiles, which carry the
+// encoder, audio and PTZ configuration of each stream, and its firmware
+// version
+func onvifCapabilities(ctx context.Context, client *CameraHTTPClient) (*CameraCapabilities, error) {
+	var lastErr error
+	for _, path := range onvifMediaPaths {
+		var profiles struct {
+			Profiles []struct {
+				VideoSource struct {
+					SourceToken string `xml:"SourceToken"`
+				} `xml:"VideoSourceConfiguration"`
+				VideoEncoder *struct {
+					Encoding   string `xml:"Encoding"`
+					Resolution struct {
+						Width  int `xml:"Width"`
+						Height int `xml:"Height"`
+					} `xml:"Resolution"`
+				} `xml:"VideoEncoderConfiguration"`
+				AudioEncoder *struct{} `xml:"AudioEncoderConfiguration"`
+				PTZ          *struct {
+					PanTilt *struct {
+						X onvifRange `xml:"Range>XRange"`
+						Y onvifRange `xml:"Range>YRange"`
+					} `xml:"PanTiltLimits"`
+					Zoom *struct {
+						X onvifRange `xml:"Range>XRange"`
+					} `xml:"ZoomLimits"`
+				} `xml:"PTZConfiguration"`
+			} `xml:"GetProfilesResponse>Profiles"`
+		}
+		err := onvifCall(ctx, client, path,
+			`<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &profiles)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(profiles.Profiles) == 0 {
+			return nil, errors.New("camera reported no ONVIF media profiles")
+		}
+
+		caps := &CameraCapabilities{Source: "onvif"}
+		sources := make(map[string]bool)
+		resolutions := make(map[string]bool)
+		codecs := make(map[string]bool)
+		for _, p := range profiles.Profiles {
+			if p.VideoSource.SourceToken != "" {
+				sources[p.VideoSource.SourceToken] = true
+			}
+			if p.VideoEncoder != nil {
+				codecs[strings.ToLower(p.VideoEncoder.Encoding)] = true
+				if p.VideoEncoder.Resolution.Width > 0 {
+					resolutions[fmt.Sprintf("%dx%d", p.VideoEncoder.Resolution.Width, p.VideoEncoder.Resolution.Height)] = true
+				}
+			}
+			if p.AudioEncoder != nil {
+				caps.Audio = true
+			}
+			if p.PTZ != nil {
+				caps.PTZ = true
+				if caps.PTZLimits == nil && (p.PTZ.PanTilt != nil || p.PTZ.Zoom != nil) {
+					caps.PTZLimits = &PTZLimits{}
+					if pt := p.PTZ.PanTilt; pt != nil {
+						caps.PTZLimits.MinPan, caps.PTZLimits.MaxPan = pt.X.Min, pt.X.Max
+						caps.PTZLimits.MinTilt, caps.PTZLimits.MaxTilt = pt.Y.Min, pt.Y.Max
+					}
+					if z := p.PTZ.Zoom; z != nil {
+						caps.PTZLimits.MinZoom, caps.PTZLimits.MaxZoom = z.X.Min, z.X.Max
+					}
+				}
+			}
+		}
+		caps.VideoSources = len(sources)
+		if caps.VideoSources == 0 {
+			caps.VideoSources = 1
+		}
+		caps.Resolutions = sortedKeys(resolutions)
+		caps.Codecs = sortedKeys(codecs)
+		caps.Firmware = onvifFirmware(ctx, client)
+		if commands, err := onvifAuxiliaryCommands(ctx, client); err == nil {
+			caps.Auxiliary = onvifAuxiliary(commands)
+		}
+		return caps, nil
+	}
+	return nil, fmt.Errorf("ONVIF media service not available: %v", lastErr)
+}
+
+// onvifFirmware asks the ONVIF device service for the camera's firmware
+// version, or returns empty if it doesn't answer
+func onvifFirmware(ctx context.Context, client *CameraHTTPClient) string {
+	for _, path := range onvifDevicePaths {
+		var info struct {
+			Firmware string `xml:"GetDeviceInformationResponse>FirmwareVersion"`
+		}
+		err := onvifCall(ctx, client, path, `<GetDeviceInformation xmlns="http://www.onvif.org/ver10/device/wsdl"/>`, &info)
+		if err == nil {
+			return strings.TrimSpace(info.Firmware)
+		}
+	}
+	return ""
+}
+
+// onvifRange is an ONVIF FloatRange
+type onvifRange struct {
+	Min float64 `xml:"Min"`
+	Max float64 `xml:"Max"`
+}
+
+// splitList splits a comma-separated VAPIX value
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
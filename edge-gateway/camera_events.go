@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// onvifEventPaths are the event service endpoints tried in order. Axis
+// cameras serve their VAPIX events through ONVIF at /vapix/services.
+var onvifEventPaths = []string{"/vapix/services", "/onvif/event_service", "/onvif/Events"}
+
+// eventSubscriptionTerm is how long a pull point subscription lasts unless
+// renewed; it is renewed halfway through
+const eventSubscriptionTerm = time.Minute
+
+// WS-Addressing actions of the pull point requests
+const (
+	wsaPullMessages = "http://www.onvif.org/ver10/events/wsdl/PullPointSubscription/PullMessagesRequest"
+	wsaRenew        = "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/RenewRequest"
+	wsaUnsubscribe  = "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/UnsubscribeRequest"
+)
+
+// CameraEvent is a motion or analytics event raised by a camera
+type CameraEvent struct {
+	// Topic without namespace prefixes, e.g. VideoSource/MotionAlarm
+	Topic string
+	Time  time.Time
+	// Stateful events are raised when their state turns Active and again
+	// when it turns off; others are one-off
+	Stateful bool
+	Active   bool
+	// Data are the event's data items by name, such as a detected sound's
+	// Type
+	Data map[string]string
+}
+
+// eventSubscription is an ONVIF pull point subscription to a camera's
+// events
+type eventSubscription struct {
+	client  *CameraHTTPClient
+	path    string // of the pull point on the camera
+	address string
+	params  string // reference parameters to echo in every request
+	renewAt time.Time
+}
+
+// subscribeEvents creates a pull point subscription to all of a camera's
+// events
+func subscribeEvents(ctx context.Context, client *CameraHTTPClient) (*eventSubscription, error) {
+	var lastErr error
+	for _, path := range onvifEventPaths {
+		var created struct {
+			Address    string `xml:"CreatePullPointSubscriptionResponse>SubscriptionReference>Address"`
+			Parameters struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"CreatePullPointSubscriptionResponse>SubscriptionReference>ReferenceParameters"`
+		}
+		err := onvifCall(ctx, client, path, fmt.Sprintf(
+			`<CreatePullPointSubscription xmlns="http://www.onvif.org/ver10/events/wsdl">`+
+				`<InitialTerminationTime>%s</InitialTerminationTime></CreatePullPointSubscription>`,
+			xsdDuration(eventSubscriptionTerm)), &created)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		sub := &eventSubscription{
+			client:  client,
+			path:    path,
+			address: strings.TrimSpace(created.Address),
+			params:  created.Parameters.Inner,
+			renewAt: time.Now().Add(eventSubscriptionTerm / 2),
+		}
+		if sub.address == "" {
+			return nil, errors.New("camera returned no ONVIF pull point address")
+		}
+		// The camera may name itself by another address than ours
+		if u, err := url.Parse(sub.address); err == nil && u.Path != "" {
+			sub.path = u.RequestURI()
+		}
+		return sub, nil
+	}
+	return nil, fmt.Errorf("ONVIF event service not available: %v", lastErr)
+}
+
+// pull waits up to timeout for events, renewing the subscription when due
+func (s *eventSubscription) pull(ctx context.Context, timeout time.Duration) ([]CameraEvent, error) {
+	if time.Now().After(s.renewAt) {
+		err := s.call(ctx, wsaRenew, fmt.Sprintf(
+			`<Renew xmlns="http://docs.oasis-open.org/wsn/b-2"><TerminationTime>%s</TerminationTime></Renew>`,
+			xsdDuration(eventSubscriptionTerm)), &struct{}{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to renew event subscription: %v", err)
+		}
+		s.renewAt = time.Now().Add(eventSubscriptionTerm / 2)
+	}
+
+	var pulled struct {
+		Messages []struct {
+			Topic   string `xml:"Topic"`
+			Message struct {
+				UtcTime           string `xml:"UtcTime,attr"`
+				PropertyOperation string `xml:"PropertyOperation,attr"`
+				Data              []struct {
+					Name  string `xml:"Name,attr"`
+					Value string `xml:"Value,attr"`
+				} `xml:"Data>SimpleItem"`
+			} `xml:"Message>Message"`
+		} `xml:"PullMessagesResponse>NotificationMessage"`
+	}
+	err := s.call(ctx, wsaPullMessages, fmt.Sprintf(
+		`<PullMessages xmlns="http://www.onvif.org/ver10/events/wsdl">`+
+			`<Timeout>%s</Timeout><MessageLimit>32</MessageLimit></PullMessages>`,
+		xsdDuration(timeout)), &pulled)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]CameraEvent, 0, len(pulled.Messages))
+	for _, m := range pulled.Messages {
+		// Initialized reports the state at subscription, not a change
+		if m.Message.PropertyOperation == "Initialized" {
+			continue
+		}
+		event := CameraEvent{Topic: eventTopic(m.Topic), Time: time.Now()}
+		if t, err := time.Parse(time.RFC3339, m.Message.UtcTime); err == nil {
+			event.Time = t
+		}
+		// The first boolean data item, such as State or IsMotion, is the
+		// event's state
+		for _, item := range m.Message.Data {
+			if event.Data == nil {
+				event.Data = make(map[string]string, len(m.Message.Data))
+			}
+			event.Data[item.Name] = item.Value
+			value := strings.ToLower(item.Value)
+			if !event.Stateful && (value == "1" || value == "true" || value == "0" || value == "false") {
+				event.Stateful, event.Active = true, value == "1" || value == "true"
+			}
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// unsubscribe ends the subscription
+func (s *eventSubscription) unsubscribe(ctx context.Context) error {
+	return s.call(ctx, wsaUnsubscribe, `<Unsubscribe xmlns="http://docs.oasis-open.org/wsn/b-2"/>`, &struct{}{})
+}
+
+// call sends a request to the pull point, addressed as the camera asked
+func (s *eventSubscription) call(ctx context.Context, action, body string, out interface{}) error {
+	header := fmt.Sprintf(`<Action xmlns="http://www.w3.org/2005/08/addressing">%s</Action>`+
+		`<To xmlns="http://www.w3.org/2005/08/addressing">%s</To>%s`,
+		action, xmlEscape(s.address), s.params)
+	return onvifRequest(ctx, s.client, s.path, header, body, out)
+}
+
+// eventTopic strips the namespace prefixes from a topic such as
+// tns1:VideoSource/tnsaxis:MotionAlarm
+func eventTopic(topic string) string {
+	parts := strings.Split(strings.TrimSpace(topic), "/")
+	for i, part := range parts {
+		if _, name, ok := strings.Cut(part, ":"); ok {
+			parts[i] = name
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// xsdDuration formats a duration as an XML Schema duration in seconds
+func xsdDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%dS", max(int(d.Seconds()), 1))
+}
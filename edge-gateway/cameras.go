@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// AddCameraRequest describes a camera registered by an operator rather than
+// found by discovery
+type AddCameraRequest struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port,omitempty"`
+	RTSPUrl  string `json:"rtsp_url,omitempty"`
+	RTSPPath string `json:"rtsp_path,omitempty"`
+	Vendor   string `json:"vendor,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	HasPTZ   *bool  `json:"has_ptz,omitempty"`
+
+	// HTTPS for the camera's web server and, for it and rtsps:// URLs, a
+	// PEM CA bundle on the gateway or no verification
+	HTTPS         bool   `json:"https,omitempty"`
+	TLSCAFile     string `json:"tls_ca_file,omitempty"`
+	TLSSkipVerify bool   `json:"tls_skip_verify,omitempty"`
+
+	// Generic registers rtsp_url as it is, such as an NVR channel or a
+	// doorbell, without probing the device behind it
+	Generic  bool            `json:"generic,omitempty"`
+	Metadata *CameraMetadata `json:"metadata,omitempty"`
+	// Tenant the camera belongs to, by default that of its TENANT_SUBNETS
+	// entry or the camera it replaces
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// cameraIDFromIP returns the camera ID used for a device at the given address
+func cameraIDFromIP(ip string) string {
+	return fmt.Sprintf("axis-%s", strings.NewReplacer(".", "-", ":", "-").Replace(ip))
+}
+
+// genericCameraID returns the camera ID of a generic RTSP source. Channels
+// of one NVR share its host, so the path and query tell them apart.
+func genericCameraID(u *url.URL) string {
+	h := sha1.New()
+	h.Write([]byte(u.Port() + u.RequestURI()))
+	host := strings.NewReplacer(".", "-", ":", "-").Replace(strings.ToLower(u.Hostname()))
+	return fmt.Sprintf("rtsp-%s-%s", host, hex.EncodeToString(h.Sum(nil))[:8])
+}
+
+// registerCamera stores a camera in the inventory, reconciling a discovered
+// camera with what was known of it. Discovered cameras never replace
+// manually registered ones at the same ID. It returns false if the camera
+// was not stored.
+func (eg *EdgeGateway) registerCamera(camera *Camera) bool {
+	eg.camerasLock.Lock()
+	existing, exists := eg.cameras[camera.ID]
+	if exists && existing.Manual && !camera.Manual {
+		eg.camerasLock.Unlock()
+		return false
+	}
+	if exists && camera.Metadata == nil {
+		// Discovery and add_camera don't know what operators recorded
+		camera.Metadata = existing.Metadata
+	}
+	if camera.Metadata != nil && camera.Metadata.Name != "" {
+		camera.Name = camera.Metadata.Name
+	}
+	if exists && !camera.Manual && camera.Capabilities == nil && existing.Capabilities != nil {
+		// A probe that failed this time doesn't erase what the camera
+		// reported before
+		camera.Capabilities = existing.Capabilities
+		camera.HasPTZ = existing.HasPTZ
+		if camera.Model == "" {
+			camera.Model = existing.Model
+		}
+	}
+	var moved []*Camera
+	if !exists {
+		moved = eg.movedCameraLocked(camera)
+	}
+	switch {
+	case camera.Tenant != "":
+	case exists:
+		// Nor the tenant it was moved to
+		camera.Tenant = existing.Tenant
+	default:
+		camera.Tenant = eg.subnetTenant(camera.IP)
+	}
+	eg.cameras[camera.ID] = camera
+	if !exists || !reflect.DeepEqual(existing, camera) {
+		eg.saveCamerasLocked()
+	}
+	eg.camerasLock.Unlock()
+
+	for _, old := range moved {
+		eg.stopStream(old.ID)
+		if old.ParentID == "" {
+			log.Printf("Camera %s moved from %s to %s as %s", old.ID, old.IP, camera.IP, camera.ID)
+			eg.sendEvent("camera_status", map[string]interface{}{
+				"camera_id": old.ID,
+				"status":    "moved",
+				"moved_to":  camera.ID,
+			})
+		}
+	}
+	return true
+}
+
+// movedCameraLocked finds a discovered camera that is back at a new address,
+// by its MAC address, and removes its old record and channels from the
+// inventory. The new record keeps its credentials, approval and metadata. It returns
+// the removed records. The caller holds camerasLock.
+func (eg *EdgeGateway) movedCameraLocked(camera *Camera) []*Camera {
+	if camera.Manual || camera.MAC == "" || camera.ParentID != "" {
+		return nil
+	}
+	var old *Camera
+	for _, other := range eg.cameras {
+		if !other.Manual && other.ParentID == "" && other.MAC == camera.MAC && other.IP != camera.IP {
+			old = other
+			break
+		}
+	}
+	if old == nil {
+		return nil
+	}
+
+	camera.Approval = old.Approval
+	if camera.Tenant == "" {
+		camera.Tenant = old.Tenant
+	}
+	if camera.Metadata == nil && old.Metadata != nil {
+		camera.Metadata = old.Metadata
+		if old.Metadata.Name != "" {
+			camera.Name = old.Metadata.Name
+		}
+	}
+	if creds, ok := eg.credentials.Lookup(old.ID); ok {
+		if _, has := eg.credentials.Lookup(camera.ID); !has {
+			eg.credentials.Set(camera.ID, creds)
+		}
+	}
+
+	var removed []*Camera
+	for id, other := range eg.cameras {
+		if other == old || other.ParentID == old.ID {
+			delete(eg.cameras, id)
+			eg.credentials.Delete(id)
+			removed = append(removed, other)
+		}
+	}
+	return removed
+}
+
+func (eg *EdgeGateway) camerasPath() string {
+	return filepath.Join(eg.cfg.DataDir, "cameras.json")
+}
+
+func (eg *EdgeGateway) credentialsPath() string {
+	return filepath.Join(eg.cfg.DataDir, "credentials.json")
+}
+
+func (eg *EdgeGateway) e2eeKeysPath() string {
+	return filepath.Join(eg.cfg.DataDir, "e2ee_keys.json")
+}
+
+func (eg *EdgeGateway) privacyMasksPath() string {
+	return filepath.Join(eg.cfg.DataDir, "privacy_masks.json")
+}
+
+func (eg *EdgeGateway) encoderProfilesPath() string {
+	return filepath.Join(eg.cfg.DataDir, "encoder_profiles.json")
+}
+
+// saveCamerasLocked persists the inventory so cameras are known straight
+// away after a restart, even with the cloud unreachable. Credentials are
+// saved by the CredentialStore. The caller holds camerasLock.
+func (eg *EdgeGateway) saveCamerasLocked() {
+	cameras := make([]*Camera, 0, len(eg.cameras))
+	for _, camera := range eg.cameras {
+		if !camera.Simulated && camera.Device == "" {
+			cameras = append(cameras, camera)
+		}
+	}
+	sort.Slice(cameras, func(i, j int) bool { return cameras[i].ID < cameras[j].ID })
+
+	data, _ := json.Marshal(cameras)
+	if err := writeFileAtomic(eg.camerasPath(), data); err != nil {
+		log.Printf("Failed to save camera inventory: %v", err)
+	}
+}
+
+// loadCameras restores the inventory saved by a previous run. Discovery
+// refreshes the records as cameras are found again.
+func (eg *EdgeGateway) loadCameras() {
+	data, err := os.ReadFile(eg.camerasPath())
+	if err != nil {
+		return
+	}
+	var cameras []*Camera
+	if err := json.Unmarshal(data, &cameras); err != nil {
+		log.Printf("Discarding unreadable camera inventory: %v", err)
+		return
+	}
+	for _, camera := range cameras {
+		if eg.registerCamera(camera) {
+			eg.notifyCameraStatus(camera, "restored")
+		}
+	}
+	log.Printf("Restored %d cameras from the last run", len(cameras))
+}
+
+// addCamera validates and registers a manually configured camera. Its
+// credentials go to the credential store, never into the Camera record.
+func (eg *EdgeGateway) addCamera(ctx context.Context, req AddCameraRequest) (_ *Camera, err error) {
+	if req.IP == "" && req.RTSPUrl == "" {
+		return nil, errors.New("ip or rtsp_url is required")
+	}
+	if req.Generic && req.RTSPUrl == "" {
+		return nil, errors.New("generic cameras need rtsp_url")
+	}
+	var metadata *CameraMetadata
+	if md := req.Metadata; md != nil {
+		validated, err := CameraMetadataUpdate{Name: &md.Name, Site: &md.Site, Zone: &md.Zone, Tags: &md.Tags, Notes: &md.Notes}.apply(CameraMetadata{})
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata: %v", err)
+		}
+		if validated.Name != "" || validated.Site != "" || validated.Zone != "" || len(validated.Tags) > 0 || validated.Notes != "" {
+			metadata = &validated
+		}
+	}
+
+	var rtspURL *url.URL
+	if req.RTSPUrl != "" {
+		u, err := url.Parse(req.RTSPUrl)
+		if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid rtsp_url: %q", redactCredentials(req.RTSPUrl))
+		}
+		rtspURL = u
+
+		// Credentials embedded in the URL act as defaults
+		if u.User != nil {
+			if req.Username == "" {
+				req.Username = u.User.Username()
+			}
+			if password, ok := u.User.Password(); ok && req.Password == "" {
+				req.Password = password
+			}
+		}
+		if req.IP == "" {
+			req.IP = u.Hostname()
+		}
+	}
+
+	// Generic sources may be named, such as a doorbell's cloud relay
+	if net.ParseIP(req.IP) == nil && !req.Generic {
+		return nil, fmt.Errorf("invalid ip: %q", req.IP)
+	}
+
+	creds := defaultCredentials()
+	if req.Username != "" {
+		creds.Username = req.Username
+	}
+	if req.Password != "" {
+		creds.Password = req.Password
+	}
+
+	camera := &Camera{
+		ID:       req.ID,
+		Name:     req.Name,
+		IP:       req.IP,
+		Port:     req.Port,
+		Manual:   true,
+		Vendor:   strings.ToLower(req.Vendor),
+		RTSPPath: req.RTSPPath,
+
+		HTTPS:         req.HTTPS,
+		TLSCAFile:     req.TLSCAFile,
+		TLSSkipVerify: req.TLSSkipVerify,
+
+		Generic:  req.Generic,
+		Metadata: metadata,
+		Tenant:   req.Tenant,
+	}
+	switch {
+	case camera.ID != "":
+	case req.Generic:
+		camera.ID = genericCameraID(rtspURL)
+	default:
+		camera.ID = cameraIDFromIP(req.IP)
+	}
+
+	if req.Tenant != "" && !tenantIDPattern.MatchString(req.Tenant) {
+		return nil, fmt.Errorf("invalid tenant %q", req.Tenant)
+	}
+	if tenant, exists := eg.cameraTenant(camera.ID); exists && req.Tenant != "" && tenant != req.Tenant {
+		// Moving cameras between tenants is set_camera_tenant's
+		return nil, errTenantDenied
+	}
+
+	// Start a fresh HTTP client in case the TLS settings changed
+	eg.httpClients.Remove(camera.ID)
+
+	// Probing below needs the credentials; put back the old ones on failure
+	previous, hadPrevious := eg.credentials.Lookup(camera.ID)
+	eg.credentials.Set(camera.ID, creds)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if hadPrevious {
+			eg.credentials.Set(camera.ID, previous)
+		} else {
+			eg.credentials.Delete(camera.ID)
+		}
+	}()
+
+	switch {
+	case rtspURL != nil:
+		rtspURL.User = nil
+		camera.RTSPUrl = rtspURL.String()
+
+	case camera.RTSPPath != "" || camera.Vendor != "":
+		if camera.RTSPPath != "" && !strings.HasPrefix(camera.RTSPPath, "/") {
+			return nil, fmt.Errorf("invalid rtsp_path: %q", camera.RTSPPath)
+		}
+		resolved, err := eg.resolveRTSPURL(ctx, camera)
+		if err != nil {
+			return nil, err
+		}
+		camera.RTSPUrl = resolved
+
+	default:
+		// Probe vendor paths, falling back to the first profile if the
+		// camera can't be reached yet
+		if err := eg.detectRTSPProfile(ctx, camera); err != nil {
+			camera.Vendor = eg.cfg.RTSPProfiles[0].Vendor
+			resolved, err := eg.resolveRTSPURL(ctx, camera)
+			if err != nil {
+				return nil, err
+			}
+			camera.RTSPUrl = resolved
+		}
+	}
+	if u, err := url.Parse(camera.RTSPUrl); err == nil {
+		rtspURL = u
+	}
+	if camera.Name == "" {
+		camera.Name = fmt.Sprintf("Camera-%s", req.IP)
+	}
+	if camera.Port == 0 {
+		if port := rtspURL.Port(); port != "" {
+			fmt.Sscanf(port, "%d", &camera.Port)
+		} else if rtspURL.Scheme == "rtsps" {
+			fmt.Sscanf(rtspsDefaultPort, "%d", &camera.Port)
+		} else {
+			camera.Port = 554
+		}
+	}
+
+	if !camera.Generic {
+		eg.probeCapabilities(ctx, camera)
+	}
+	if req.HasPTZ != nil {
+		camera.HasPTZ = *req.HasPTZ
+	}
+
+	eg.registerCamera(camera)
+	log.Printf("Registered camera manually: %s at %s", camera.Name, camera.IP)
+
+	eg.notifyCameraStatus(camera, "added")
+	if !camera.Generic {
+		eg.registerChannels(ctx, camera, "added")
+	}
+	return camera, nil
+}
+
+// cameraTLSConfig returns the TLS settings for a camera's https:// and
+// rtsps:// connections: its own CA file and skip-verify flag, or the
+// CAMERA_TLS_* defaults. A CA file that can't be loaded is logged and the system roots
+// are used.
+func cameraTLSConfig(cfg *Config, camera *Camera) *tls.Config {
+	tlsConfig := &tls.Config{InsecureSkipVerify: camera.TLSSkipVerify || cfg.CameraTLSSkipVerify}
+	caFile := camera.TLSCAFile
+	if caFile == "" {
+		caFile = cfg.CameraTLSCAFile
+	}
+	if caFile == "" || tlsConfig.InsecureSkipVerify {
+		return tlsConfig
+	}
+
+	pool := x509.NewCertPool()
+	pem, err := os.ReadFile(caFile)
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = errors.New("no certificates found")
+	}
+	if err != nil {
+		log.Printf("Failed to load CA file %s for camera %s, using system roots: %v", caFile, camera.ID, err)
+		return tlsConfig
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig
+}
+
+// listCameras returns a snapshot of the camera inventory
+func (eg *EdgeGateway) listCameras() []*Camera {
+	eg.camerasLock.RLock()
+	defer eg.camerasLock.RUnlock()
+
+	cameras := make([]*Camera, 0, len(eg.cameras))
+	for _, camera := range eg.cameras {
+		cameras = append(cameras, camera)
+	}
+	return cameras
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+)
+
+// API versions spoken by this gateway; bump when a message or endpoint
+// changes incompatibly
+const (
+	wsProtocolVersion = 1
+	localAPIVersion   = 1
+	// The gatewaypb schema, for gRPC and the protobuf WebSocket encoding
+	protobufSchemaVersion = 2
+)
+
+// buildFeatures lists optional features compiled in via build tags. Files
+// behind a build tag register themselves here from init.
+var buildFeatures = map[string]bool{}
+
+// hardwareAccelDevices maps device nodes to the acceleration they indicate
+var hardwareAccelDevices = []struct {
+	path string
+	name string
+}{
+	{"/dev/dri/renderD128", "vaapi"},
+	{"/dev/nvidia0", "nvidia"},
+	{"/dev/video11", "v4l2m2m"},
+}
+
+// Capabilities describes what this gateway supports so the cloud UI only
+// renders controls that will work
+type Capabilities struct {
+	GatewayID            string          `json:"gateway_id"`
+	Version              string          `json:"version"`
+	BuildTime            string          `json:"build_time,omitempty"`
+	GoVersion            string          `json:"go_version,omitempty"`
+	APIVersions          map[string]int  `json:"api_versions"`
+	Codecs               CodecSupport    `json:"codecs"`
+	Features             map[string]bool `json:"features"`
+	HardwareAcceleration []string        `json:"hardware_acceleration"`
+	Storage              StorageInfo     `json:"storage"`
+}
+
+// CodecSupport lists the codecs the gateway can forward to viewers
+type CodecSupport struct {
+	Video []string `json:"video"`
+	Audio []string `json:"audio"`
+}
+
+// StorageInfo reports whether DATA_DIR is usable and how much space is left
+type StorageInfo struct {
+	Path       string `json:"path"`
+	Available  bool   `json:"available"`
+	FreeBytes  uint64 `json:"free_bytes,omitempty"`
+	TotalBytes uint64 `json:"total_bytes,omitempty"`
+}
+
+// capabilities builds the gateway's capability document
+func (eg *EdgeGateway) capabilities() *Capabilities {
+	storage := dataDirStorage(eg.cfg.DataDir)
+	settings := eg.settings()
+
+	features := map[string]bool{
+		"webrtc":                true,
+		"ptz":                   true,
+		"ptz_locking":           true,
+		"ptz_imaging":           true,
+		"mdns_discovery":        eg.cfg.MDNSEnabled,
+		"ipv6_discovery":        true,
+		"network_scan":          true,
+		"vendor_fingerprinting": true,
+		"scheduled_scan":        settings.ScanInterval > 0,
+		"scan_resume":           storage.Available,
+		"manual_cameras":        true,
+		"discovery_policy":      true,
+		"camera_metadata":       true,
+		"encoder_profiles":      true,
+		"gop_shortening":        eg.cfg.KeyframeMaxInterval > 0,
+		"credential_onboarding": true,
+		"axis_initialization":   eg.cfg.AxisInitialize,
+		"onvif":                 true,
+		"camera_capabilities":   true,
+		"multi_sensor":          true,
+		"quarantine":            true,
+		"stream_health":         eg.cfg.StreamHealthInterval > 0,
+		"stream_watchdog":       eg.cfg.StreamStallTimeout > 0,
+		"prebuffer":             eg.cfg.PrebufferMaxKB > 0,
+		"webrtc_stats":          eg.cfg.WebRTCStatsInterval > 0,
+		"viewer_sessions":       true,
+		"on_demand_streams":     eg.cfg.OnDemandStreams,
+		"uplink_budget":         true,
+		"resource_limits":       true,
+		"e2ee":                  true,
+		"stream_tokens":         eg.cfg.StreamTokenRequired,
+		"audit_log":             true,
+		"simulation":            eg.cfg.SimulateCameras > 0,
+		"replay":                settings.HLSEnabled || eg.cfg.HLSGCSBucket != "",
+		"telemetry":             eg.cfg.TelemetryInterval > 0,
+		"ice_restart":           true,
+		"renegotiation":         true,
+		"meta_channel":          true,
+		"watermark":             eg.transcoder != nil,
+		"tenants":               true,
+		"cluster":               eg.cluster != nil,
+		"ha_pair":               eg.ha != nil,
+		"adaptive_bitrate":      eg.cfg.AdaptiveBitrate,
+		"congestion_control":    eg.cfg.CongestionControl,
+		"viewer_profiles":       true,
+		"whep":                  eg.cfg.LocalAPIAddr != "" && eg.cfg.LocalAPIAddr != "off",
+		"hls":                   settings.HLSEnabled,
+		"hls_gcs":               settings.HLSEnabled && eg.cfg.HLSGCSBucket != "",
+		"event_clips":           eg.cfg.EventClipsEnabled,
+		"analytics_metadata":    eg.cfg.AnalyticsMetadata,
+		"inference":             eg.cfg.InferenceRunner != inferenceRunnerNone,
+		"privacy_masks":         eg.transcoder != nil,
+		"overlay":               eg.transcoder != nil,
+		"clock_audit":           eg.cfg.ClockCheckInterval > 0,
+		"firmware_upgrade":      true,
+		"maintenance":           true,
+		"io_ports":              true,
+		"io_input_events":       eg.cfg.IOPollInterval > 0,
+		"audio_events":          eg.cfg.AudioEvents,
+		"camera_audio":          true,
+		"auxiliary_commands":    true,
+		"snapshots":             true,
+		"vendor_adapters":       true,
+		"local_cameras":         len(eg.cfg.LocalCameras) > 0,
+		"transcode":             eg.cfg.TranscodeEnabled,
+		"vp9_av1":               eg.transcoder != nil && len(eg.cfg.TranscodeCodecs) > 0,
+		"simulcast":             eg.transcoder != nil,
+		"digital_ptz":           eg.cfg.DigitalPTZ && eg.cfg.TranscodeEnabled,
+		"relay":                 true,
+		"grpc_transport":        true,
+		"mqtt":                  eg.cfg.MQTTBrokerURL != "",
+		"offline_queue":         eg.cfg.OfflineQueueSize > 0,
+		"event_acks":            eg.cfg.OfflineQueueSize > 0 && eg.cfg.OfflineQueueAcks,
+		"camera_inventory":      eg.cfg.CameraInventoryDelay > 0,
+		"inventory_sync":        true,
+		"heartbeat":             true,
+		"command_results":       true,
+		"error_codes":           true,
+		"tracing":               eg.cfg.TracingEnabled,
+		"rtsp_server":           eg.cfg.RTSPServerAddr != "" && eg.cfg.RTSPServerAddr != "off" && eg.cfg.RTSPServerPassword != "",
+		"local_api":             eg.cfg.LocalAPIAddr != "" && eg.cfg.LocalAPIAddr != "off",
+		"remote_config":         true,
+		"self_update":           eg.cfg.UpdatePublicKey != nil,
+	}
+	for name, enabled := range buildFeatures {
+		features[name] = enabled
+	}
+
+	return &Capabilities{
+		GatewayID: getGatewayID(),
+		Version:   Version,
+		BuildTime: BuildTime,
+		GoVersion: GoVersion,
+		APIVersions: map[string]int{
+			"websocket": wsProtocolVersion,
+			"rest":      localAPIVersion,
+			"protobuf":  protobufSchemaVersion,
+		},
+		Codecs: CodecSupport{
+			Video: []string{"h264"},
+			Audio: []string{},
+		},
+		Features:             features,
+		HardwareAcceleration: detectHardwareAcceleration(),
+		Storage:              storage,
+	}
+}
+
+// detectHardwareAcceleration lists the acceleration devices present
+func detectHardwareAcceleration() []string {
+	found := []string{}
+	for _, dev := range hardwareAccelDevices {
+		if _, err := os.Stat(dev.path); err == nil {
+			found = append(found, dev.name)
+		}
+	}
+	return found
+}
+
+// dataDirStorage checks that the data directory is writable and reports
+// its free space
+func dataDirStorage(dir string) StorageInfo {
+	info := StorageInfo{Path: dir}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return info
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return info
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	info.Available = true
+	info.FreeBytes, info.TotalBytes, _ = diskUsage(dir)
+	return info
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// channelCameraID returns the ID of one sensor of a multi-sensor camera
+func channelCameraID(parentID string, channel int) string {
+	return fmt.Sprintf("%s-ch%d", parentID, channel)
+}
+
+// channelStreamURL returns the RTSP URL of one video source of a camera.
+// Axis cameras take a camera parameter, and Hikvision and Dahua number
+// channels in the path and query. Other cameras can't be split.
+func channelStreamURL(rtspURL string, channel int) (string, bool) {
+	u, err := url.Parse(rtspURL)
+	if err != nil {
+		return "", false
+	}
+
+	switch {
+	case strings.Contains(u.Path, "/axis-media/media.amp"):
+		q := u.Query()
+		q.Set("camera", strconv.Itoa(channel))
+		u.RawQuery = q.Encode()
+
+	case strings.HasPrefix(u.Path, "/Streaming/Channels/") && strings.HasSuffix(u.Path, "01"):
+		u.Path = fmt.Sprintf("/Streaming/Channels/%d01", channel)
+
+	case u.Path == "/cam/realmonitor":
+		q := u.Query()
+		q.Set("channel", strconv.Itoa(channel))
+		u.RawQuery = q.Encode()
+
+	default:
+		return "", false
+	}
+	return u.String(), true
+}
+
+// registerChannels registers a sub-camera for each sensor of a camera that
+// reported more than one video source, so each can be streamed, recorded and
+// steered on its own. The parent keeps serving the camera's default source.
+// Sub-cameras share the parent's credentials and report status with it.
+func (eg *EdgeGateway) registerChannels(ctx context.Context, camera *Camera, status string) {
+	caps := camera.Capabilities
+	if caps == nil || caps.VideoSources <= 1 || camera.Channel > 0 {
+		return
+	}
+
+	// Axis cameras say which sensors have PTZ and their limits
+	var ptz map[string]string
+	if caps.Source == "vapix" && caps.PTZ {
+		ptz, _ = vapixParams(ctx, eg.httpClients.Client(camera), "PTZ")
+	}
+	creds, hasCreds := eg.credentials.Lookup(camera.ID)
+
+	for channel := 1; channel <= caps.VideoSources; channel++ {
+		rtspURL, ok := channelStreamURL(camera.RTSPUrl, channel)
+		if !ok {
+			log.Printf("Camera %s has %d video sources but no known per-channel stream path", camera.ID, caps.VideoSources)
+			return
+		}
+
+		channelCaps := *caps
+		channelCaps.VideoSources = 1
+		if ptz != nil {
+			if enabled, ok := ptz[fmt.Sprintf("root.PTZ.ImageSource.I%d.PTZEnabled", channel-1)]; ok {
+				channelCaps.PTZ = enabled == "true"
+			}
+			channelCaps.PTZLimits = nil
+			if channelCaps.PTZ {
+				channelCaps.PTZLimits = vapixPTZLimits(ptz, channel)
+			}
+			channelCaps.Imaging = vapixImaging(ptz, channel)
+		}
+
+		sub := &Camera{
+			ID:            channelCameraID(camera.ID, channel),
+			Name:          fmt.Sprintf("%s (channel %d)", camera.Name, channel),
+			Model:         camera.Model,
+			IP:            camera.IP,
+			Port:          camera.Port,
+			RTSPUrl:       rtspURL,
+			HasPTZ:        channelCaps.PTZ,
+			Manual:        camera.Manual,
+			Vendor:        camera.Vendor,
+			HTTPS:         camera.HTTPS,
+			TLSCAFile:     camera.TLSCAFile,
+			TLSSkipVerify: camera.TLSSkipVerify,
+			ParentID:      camera.ID,
+			Channel:       channel,
+			Capabilities:  &channelCaps,
+			MAC:           camera.MAC,
+			Approval:      camera.Approval,
+		}
+		if hasCreds {
+			eg.credentials.Set(sub.ID, creds)
+		}
+		if eg.registerCamera(sub) {
+			eg.notifyCameraStatus(sub, status)
+		}
+	}
+}
+
+// ptzQuery adds the camera channel to a VAPIX PTZ command for sub-cameras
+func ptzQuery(camera *Camera, cmd string) string {
+	if camera.Channel > 0 {
+		return fmt.Sprintf("%s&camera=%d", cmd, camera.Channel)
+	}
+	return cmd
+}
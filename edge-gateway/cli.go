@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// cliCommands are the gateway's subcommands. Without one, or with flags
+// only, it runs the gateway as it did before it had subcommands.
+var cliCommands = []struct {
+	name    string
+	args    string
+	summary string
+}{
+	{"run", "[flags]", "Run the gateway (default)"},
+	{"discover", "[--once] [--scan] [flags]", "Find cameras on the network and print them"},
+	{"test-camera", "<ip> [flags]", "Diagnose a camera, from ping to PTZ, and print a report"},
+	{"config", "[flags]", "Print the effective configuration"},
+	{"version", "", "Print the version and build information"},
+	{"loadtest", "[flags]", "Load test a running gateway with synthetic viewers"},
+	{"healthcheck", "", "Check a running gateway's local API, for container healthchecks"},
+}
+
+// runCLI runs the subcommand args name, returning the exit code
+func runCLI(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return runGateway(args)
+	}
+	switch args[0] {
+	case "run":
+		return runGateway(args[1:])
+	case "discover":
+		return runDiscover(args[1:])
+	case "test-camera":
+		return runTestCamera(args[1:])
+	case "config":
+		return runPrintConfig(args[1:])
+	case "version":
+		return runVersion()
+	case "loadtest":
+		return runLoadTest(args[1:])
+	case "healthcheck":
+		return runHealthCheck()
+	case "help", "-h", "--help":
+		printUsage(os.Stdout)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "edge-gateway: unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	return 2
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: edge-gateway <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, command := range cliCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", command.name, command.args, command.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every setting can be given as an environment variable or as a flag of")
+	fmt.Fprintln(w, "run, discover, test-camera and config: --scan-interval=10m sets")
+	fmt.Fprintln(w, "SCAN_INTERVAL. Flags take precedence. See edge-gateway <command> -h.")
+}
+
+// envFlag sets a configuration variable from the command line
+type envFlag struct {
+	key    string
+	isBool bool
+}
+
+// String returns the variable's value as loadConfig last read it, for the
+// flag's default
+func (f *envFlag) String() string {
+	value := loadedSettings()[f.key].Value
+	if f.isBool && value == "false" {
+		// Left out of -h, as for other bool flags
+		return ""
+	}
+	if value != "" && secretSetting(f.key) {
+		return "REDACTED"
+	}
+	return redactCredentials(value)
+}
+
+func (f *envFlag) Set(value string) error {
+	if f.isBool {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return errors.New("must be true or false")
+		}
+	}
+	setFlagEnv(f.key, value)
+	return nil
+}
+
+func (f *envFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// settingFlag returns a variable's flag: SCAN_INTERVAL is --scan-interval
+func settingFlag(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// configFlags returns the flag set of a subcommand, with a flag for every
+// variable loadConfig reads. Flags must be parsed before loadConfig is
+// called again for them to take effect.
+func configFlags(name, args string) *flag.FlagSet {
+	// Read the configuration once, quietly, for its variables and defaults
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	loadConfig()
+	log.SetOutput(output)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	settings := loadedSettings()
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	// NO_PROXY before no_proxy
+	sort.Strings(keys)
+	for _, key := range keys {
+		if flags.Lookup(settingFlag(key)) != nil {
+			continue
+		}
+		flags.Var(&envFlag{key: key, isBool: settings[key].Bool}, settingFlag(key), "sets "+key)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: edge-gateway %s %s\n\nFlags override the environment variables they set:\n", name, strings.TrimSpace(args+" [flags]"))
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// flagExitCode returns the exit code for an error parsing flags, which
+// the flag set has printed
+func flagExitCode(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return 2
+}
+
+// writeSettings writes the variables loadConfig read as KEY=value lines,
+// which CONFIG_FILE reads back, without passwords or secrets
+func writeSettings(w io.Writer) {
+	settings := loadedSettings()
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := (&envFlag{key: key}).String()
+		fmt.Fprintf(w, "%s=%s\n", key, value)
+	}
+}
+
+// runPrintConfig prints the effective configuration: the environment,
+// files and flags, with the defaults filled in
+func runPrintConfig(args []string) int {
+	flags := configFlags("config", "")
+	if err := flags.Parse(args); err != nil {
+		return flagExitCode(err)
+	}
+	// Invalid values are logged as loadConfig replaces them
+	loadConfig()
+	writeSettings(os.Stdout)
+	return 0
+}
+
+// runVersion prints the version and build information
+func runVersion() int {
+	fmt.Printf("edge-gateway %s\n", Version)
+	if BuildTime != "" {
+		fmt.Printf("Built:    %s\n", BuildTime)
+	}
+	goVersion := GoVersion
+	if goVersion == "" {
+		goVersion = runtime.Version()
+	}
+	fmt.Printf("Go:       %s\n", goVersion)
+	fmt.Printf("Platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	return 0
+}
+
+// scratchGateway returns a gateway for a subcommand, which keeps what it
+// finds in a temporary DATA_DIR rather than the running gateway's. The
+// caller removes the directory.
+func scratchGateway(cfg *Config) (*EdgeGateway, string, error) {
+	dir, err := os.MkdirTemp("", "edge-gateway-")
+	if err != nil {
+		return nil, "", err
+	}
+	scratch := *cfg
+	scratch.DataDir = dir
+	return NewEdgeGateway(&scratch), dir, nil
+}
+
+// runDiscover browses mDNS for cameras, and scans the network with --scan,
+// printing the cameras it finds until interrupted, or for --timeout with
+// --once
+func runDiscover(args []string) int {
+	flags := configFlags("discover", "[--once] [--scan]")
+	once := flags.Bool("once", false, "stop after --timeout rather than when interrupted")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long --once looks for cameras, a --scan included")
+	scan := flags.Bool("scan", false, "also scan SCAN_SUBNETS, or the gateway's own subnets, for RTSP cameras")
+	asJSON := flags.Bool("json", false, "print each camera as a line of JSON")
+	if err := flags.Parse(args); err != nil {
+		return flagExitCode(err)
+	}
+
+	cfg := loadConfig()
+	setLogLevel(cfg.LogLevel)
+	setupProxy(cfg)
+	eg, dir, err := scratchGateway(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "discover: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *once {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	eg.browseMDNS(ctx)
+	if *scan {
+		go eg.scanner.scan(ctx)
+	}
+
+	// Cameras are printed as they are found, so the columns are fixed
+	const row = "%-20s %-24s %-15s %-8s %s\n"
+	if !*asJSON {
+		fmt.Printf(row, "ID", "NAME", "IP", "VENDOR", "RTSP URL")
+	}
+	printed := make(map[string]bool)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+		for _, camera := range eg.listCameras() {
+			if printed[camera.ID] {
+				continue
+			}
+			printed[camera.ID] = true
+			if *asJSON {
+				data, _ := json.Marshal(camera)
+				fmt.Println(string(data))
+				continue
+			}
+			fmt.Printf(row, camera.ID, camera.Name, camera.IP, camera.Vendor, camera.RTSPUrl)
+		}
+	}
+	if !*asJSON {
+		fmt.Fprintf(os.Stderr, "Found %d cameras\n", len(printed))
+	}
+	return 0
+}
+
+// runTestCamera runs the diagnostic ladder on a camera, printing a report,
+// and fails if a step does
+func runTestCamera(args []string) int {
+	flags := configFlags("test-camera", "<ip>")
+	username := flags.String("username", "", "camera `username` (default: CAMERA_USERNAME)")
+	password := flags.String("password", "", "camera `password` (default: CAMERA_PASSWORD)")
+	rtspURL := flags.String("rtsp-url", "", "test this RTSP `URL` rather than the one the camera's vendor has")
+	vendor := flags.String("vendor", "", "camera `vendor`, to skip probing RTSP_PATH_PROFILES")
+	https := flags.Bool("https", false, "use HTTPS for the camera's web server")
+	httpPort := flags.Int("http-port", 0, "the camera's web server `port`, if not the scheme's default")
+	timeout := flags.Duration("timeout", time.Minute, "give up after this long")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return flagExitCode(err)
+	}
+	// Flags after the address are parsed too
+	var ip string
+	if flags.NArg() > 0 {
+		ip = flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return flagExitCode(err)
+		}
+	}
+	if ip == "" && *rtspURL == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg := loadConfig()
+	setLogLevel(cfg.LogLevel)
+	setupProxy(cfg)
+	eg, dir, err := scratchGateway(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "test-camera: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	creds := defaultCredentials()
+	camera := &Camera{IP: ip, Vendor: strings.ToLower(*vendor), HTTPS: *https, HTTPPort: *httpPort}
+	if *rtspURL != "" {
+		u, err := url.Parse(*rtspURL)
+		if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Hostname() == "" {
+			fmt.Fprintf(os.Stderr, "test-camera: invalid RTSP URL %q\n", redactCredentials(*rtspURL))
+			return 2
+		}
+		// Credentials embedded in the URL act as defaults, as adding it would
+		if u.User != nil {
+			creds.Username = u.User.Username()
+			if password, ok := u.User.Password(); ok {
+				creds.Password = password
+			}
+		}
+		u.User = nil
+		camera.RTSPUrl = u.String()
+		if camera.IP == "" {
+			camera.IP = u.Hostname()
+		}
+	}
+	if *username != "" {
+		creds.Username = *username
+	}
+	if *password != "" {
+		creds.Password = *password
+	}
+	camera.ID = cameraIDFromIP(camera.IP)
+	eg.credentials.Set(camera.ID, creds)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	diagnosis := eg.diagnoseCamera(ctx, camera)
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(diagnosis, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		printDiagnosis(os.Stdout, diagnosis)
+	}
+	if !diagnosis.OK {
+		return 1
+	}
+	return 0
+}
+
+// printDiagnosis writes a camera's diagnostic report for people to read
+func printDiagnosis(w io.Writer, d *CameraDiagnosis) {
+	fmt.Fprintf(w, "Camera %s (%s)\n", d.IP, d.CameraID)
+	for _, field := range []struct{ name, value string }{
+		{"Vendor", d.Vendor}, {"Model", d.Model}, {"Firmware", d.Firmware}, {"RTSP URL", d.RTSPUrl},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(w, "  %-9s %s\n", field.name+":", field.value)
+		}
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, step := range d.Steps {
+		fmt.Fprintf(tw, "  %s\t%s\t%.0fms\t%s\n", strings.ToUpper(step.Status), step.Name, step.DurationMs, step.Detail)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	if d.OK {
+		fmt.Fprintln(w, "Result: OK")
+	} else {
+		fmt.Fprintln(w, "Result: FAILED")
+	}
+	if d.Hint != "" {
+		fmt.Fprintf(w, "Hint: %s\n", d.Hint)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4f"
+)
+
+// defaultEventClipTopics are the event topics that record a clip unless
+// EVENT_CLIP_TOPICS is set: motion detection, and the rules and ACAP
+// applications, such as AXIS Object Analytics, that raise analytics events
+var defaultEventClipTopics = []string{"VideoSource/MotionAlarm", "RuleEngine", "CameraApplicationPlatform"}
+
+// eventClipSyncInterval is how often cameras are checked for event
+// recording to start or stop
+const eventClipSyncInterval = 30 * time.Second
+
+// Retry delays of a camera's event subscription and stream
+const (
+	eventClipMinRetry = 5 * time.Second
+	eventClipMaxRetry = 5 * time.Minute
+)
+
+// EventClip is the clip_ready payload: a clip recorded for camera events
+// and uploaded to GCS
+type EventClip struct {
+	ClipID     string    `json:"clip_id"`
+	CameraID   string    `json:"camera_id"`
+	EventTypes []string  `json:"event_types"` // event topics, in the order raised
+	EventTime  time.Time `json:"event_time"`  // of the first event
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Duration   float64   `json:"duration"` // seconds
+	SizeBytes  int       `json:"size_bytes"`
+	URL        string    `json:"url"` // gs://bucket/object
+}
+
+// clipPacket is a video packet and when it arrived
+type clipPacket struct {
+	pkt av.Packet
+	at  time.Time
+}
+
+// eventClipRecording is a clip being recorded
+type eventClipRecording struct {
+	codec     av.CodecData
+	packets   []clipPacket
+	events    []string
+	eventTime time.Time
+	active    map[string]bool // stateful events still on
+	until     time.Time       // end of the post roll, zero while events are on
+}
+
+// clipRecorder is a stream sink that keeps the last pre roll of video and
+// records clips when the camera raises events
+type clipRecorder struct {
+	preRoll     time.Duration
+	postRoll    time.Duration
+	maxDuration time.Duration
+	done        func(*eventClipRecording) // called with each finished clip
+
+	lock     sync.Mutex
+	codec    av.CodecData // nil unless the video is H.264
+	videoIdx int8
+	buffer   []clipPacket // from a keyframe
+	clip     *eventClipRecording
+}
+
+func newClipRecorder(cfg *Config, done func(*eventClipRecording)) *clipRecorder {
+	return &clipRecorder{
+		preRoll:     cfg.EventClipPreRoll,
+		postRoll:    cfg.EventClipPostRoll,
+		maxDuration: cfg.EventClipMaxDuration,
+		done:        done,
+	}
+}
+
+// Reset finishes the clip being recorded, since a new session's codec
+// settings may differ
+func (r *clipRecorder) Reset(codecs []av.CodecData) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.finishLocked()
+	r.codec, r.buffer = nil, nil
+	for i, codec := range codecs {
+		if codec.Type() == av.H264 {
+			r.codec, r.videoIdx = codec, int8(i)
+			break
+		}
+	}
+}
+
+func (r *clipRecorder) WritePacket(pkt av.Packet) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.codec == nil || pkt.Idx != r.videoIdx {
+		return
+	}
+	cp := clipPacket{pkt: pkt, at: time.Now()}
+
+	if clip := r.clip; clip != nil {
+		if len(clip.packets) == 0 && !pkt.IsKeyFrame {
+			return
+		}
+		clip.packets = append(clip.packets, cp)
+		if r.dueLocked(cp.at) {
+			r.finishLocked()
+		}
+		return
+	}
+
+	if len(r.buffer) == 0 && !pkt.IsKeyFrame {
+		return
+	}
+	r.buffer = append(r.buffer, cp)
+	if pkt.IsKeyFrame {
+		r.trimLocked(cp.at)
+	}
+}
+
+// trimLocked drops the buffered packets before the last keyframe that is
+// at least the pre roll old. The caller holds lock.
+func (r *clipRecorder) trimLocked(now time.Time) {
+	for i := len(r.buffer) - 1; i > 0; i-- {
+		if r.buffer[i].pkt.IsKeyFrame && now.Sub(r.buffer[i].at) >= r.preRoll {
+			r.buffer = append([]clipPacket(nil), r.buffer[i:]...)
+			return
+		}
+	}
+}
+
+// trigger starts or extends a clip for an event
+func (r *clipRecorder) trigger(event CameraEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	clip := r.clip
+	if clip == nil {
+		// An event ending starts nothing
+		if event.Stateful && !event.Active {
+			return
+		}
+		clip = &eventClipRecording{
+			codec:     r.codec,
+			packets:   r.buffer,
+			eventTime: event.Time,
+			active:    make(map[string]bool),
+		}
+		r.clip, r.buffer = clip, nil
+	}
+
+	if !event.Stateful || event.Active {
+		found := false
+		for _, topic := range clip.events {
+			found = found || topic == event.Topic
+		}
+		if !found {
+			clip.events = append(clip.events, event.Topic)
+		}
+	}
+	if event.Stateful {
+		if event.Active {
+			clip.active[event.Topic] = true
+		} else {
+			delete(clip.active, event.Topic)
+		}
+	}
+
+	if len(clip.active) > 0 {
+		clip.until = time.Time{}
+	} else if end := now.Add(r.postRoll); end.After(clip.until) {
+		clip.until = end
+	}
+}
+
+// expire finishes the clip being recorded if its post roll is over, for
+// when the stream has stopped delivering video
+func (r *clipRecorder) expire() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.clip != nil && r.dueLocked(time.Now()) {
+		r.finishLocked()
+	}
+}
+
+// finish finishes the clip being recorded, if any
+func (r *clipRecorder) finish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.finishLocked()
+}
+
+// dueLocked reports whether the clip being recorded should end. The caller
+// holds lock.
+func (r *clipRecorder) dueLocked(now time.Time) bool {
+	clip := r.clip
+	if !clip.until.IsZero() && now.After(clip.until) {
+		return true
+	}
+	return len(clip.packets) > 0 && now.Sub(clip.packets[0].at) >= r.maxDuration
+}
+
+// finishLocked hands the clip being recorded over, keeping its last pre
+// roll as the buffer for the next. The caller holds lock.
+func (r *clipRecorder) finishLocked() {
+	clip := r.clip
+	if clip == nil {
+		return
+	}
+	r.clip = nil
+	if len(clip.packets) == 0 || clip.codec == nil {
+		return
+	}
+	r.buffer = clip.packets
+	r.trimLocked(clip.packets[len(clip.packets)-1].at)
+	r.done(clip)
+}
+
+// muxEventClip writes a clip's packets as a fragmented MP4 file
+func muxEventClip(codec av.CodecData, packets []clipPacket) ([]byte, error) {
+	muxer := mp4f.NewMuxer(nil)
+	if err := muxer.WriteHeader([]av.CodecData{codec}); err != nil {
+		return nil, err
+	}
+	_, data := muxer.GetInit([]av.CodecData{codec})
+	if len(data) == 0 {
+		return nil, fmt.Errorf("unsupported video codec")
+	}
+	for _, cp := range packets {
+		pkt := cp.pkt
+		pkt.Idx = 0
+		_, fragment, err := muxer.WritePacket(pkt, true)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, fragment...)
+	}
+	return append(data, muxer.Finalize()...), nil
+}
+
+// runEventClips records clips of cameras' events until ctx is cancelled,
+// watching the events of each approved camera selected by
+// EVENT_CLIP_CAMERAS
+func (eg *EdgeGateway) runEventClips(ctx context.Context) {
+	uploader, err := NewGCSUploader(ctx, eg.cfg.EventClipGCSBucket)
+	if err != nil {
+		log.Printf("Event clips disabled: %v", err)
+		eg.recordSubsystem("recorder", err)
+		return
+	}
+	log.Printf("Event clips: uploading to gs://%s/%s", eg.cfg.EventClipGCSBucket, eg.cfg.EventClipGCSPrefix)
+
+	watchers := make(map[string]context.CancelFunc)
+	ticker := time.NewTicker(eventClipSyncInterval)
+	defer ticker.Stop()
+	for {
+		cameras := eg.eventClipCameras()
+		for cameraID, cancel := range watchers {
+			if !cameras[cameraID] {
+				cancel()
+				delete(watchers, cameraID)
+			}
+		}
+		for cameraID := range cameras {
+			if _, exists := watchers[cameraID]; exists {
+				continue
+			}
+			watchCtx, cancel := context.WithCancel(ctx)
+			watchers[cameraID] = cancel
+			cameraID := cameraID
+			eg.goTracked(func() { eg.watchCameraEvents(watchCtx, cameraID, uploader) })
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, cancel := range watchers {
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// eventClipCameras returns the IDs of the cameras to record event clips of
+func (eg *EdgeGateway) eventClipCameras() map[string]bool {
+	selected := make(map[string]bool, len(eg.cfg.EventClipCameras))
+	for _, id := range eg.cfg.EventClipCameras {
+		selected[id] = true
+	}
+
+	eg.camerasLock.RLock()
+	defer eg.camerasLock.RUnlock()
+	cameras := make(map[string]bool)
+	for id, camera := range eg.cameras {
+		if camera.Approval == "" && (len(selected) == 0 || selected[id]) {
+			cameras[id] = true
+		}
+	}
+	return cameras
+}
+
+// watchCameraEvents keeps a camera's main stream open for its pre roll and
+// records a clip whenever it raises a selected event, until ctx is done
+func (eg *EdgeGateway) watchCameraEvents(ctx context.Context, cameraID string, uploader *GCSUploader) {
+	recorder := newClipRecorder(eg.cfg, func(clip *eventClipRecording) {
+		eg.goTracked(func() { eg.saveEventClip(uploader, cameraID, clip) })
+	})
+	pullTimeout := max(eg.cfg.CameraHTTPTimeout-2*time.Second, time.Second)
+
+	var stream *CameraStream
+	var sub cameraEventSource
+	var streamRetry, subRetry time.Time
+	retry := eventClipMinRetry
+	defer func() {
+		if sub != nil {
+			unsubscribeCtx, cancel := context.WithTimeout(context.Background(), eg.cfg.CameraHTTPTimeout)
+			sub.unsubscribe(unsubscribeCtx)
+			cancel()
+		}
+		if stream != nil {
+			stream.removeSink(recorder)
+			eg.releaseViewer(stream)
+		}
+		recorder.finish()
+	}()
+
+	for ctx.Err() == nil {
+		if (stream == nil || !stream.running()) && time.Now().After(streamRetry) {
+			if stream != nil {
+				stream.removeSink(recorder)
+				eg.releaseViewer(stream)
+				stream = nil
+			}
+			if s, err := eg.openStream(cameraID, viewerProfileMain, true); err == nil {
+				s.addViewer()
+				s.addSink(recorder)
+				stream = s
+			} else {
+				streamRetry = time.Now().Add(eventClipSyncInterval)
+			}
+		}
+
+		if sub == nil {
+			if time.Now().Before(subRetry) {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(subRetry)):
+				}
+				continue
+			}
+			eg.camerasLock.RLock()
+			camera, exists := eg.cameras[cameraID]
+			eg.camerasLock.RUnlock()
+			if !exists {
+				return
+			}
+			var err error
+			if sub, err = eg.subscribeCameraEvents(ctx, camera); err != nil {
+				log.Printf("Event clips: can't watch events of camera %s, retrying in %s: %v", cameraID, retry, err)
+				subRetry = time.Now().Add(retry)
+				retry = min(retry*2, eventClipMaxRetry)
+				continue
+			}
+			log.Printf("Event clips: watching events of camera %s", cameraID)
+		}
+
+		events, err := sub.pull(ctx, pullTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Event clips: lost event subscription of camera %s: %v", cameraID, err)
+			sub = nil
+			subRetry = time.Now().Add(retry)
+			retry = min(retry*2, eventClipMaxRetry)
+			continue
+		}
+		retry = eventClipMinRetry
+		for _, event := range events {
+			if eg.eventClipTopic(event.Topic) {
+				debugf("Event clips: camera %s raised %s (active %v)", cameraID, event.Topic, event.Active)
+				recorder.trigger(event)
+			}
+		}
+		recorder.expire()
+	}
+}
+
+// eventClipTopic reports whether an event topic records clips
+func (eg *EdgeGateway) eventClipTopic(topic string) bool {
+	for _, prefix := range eg.cfg.EventClipTopics {
+		if topic == prefix || strings.HasPrefix(topic, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// saveEventClip uploads a finished clip, tagged with its events, and
+// announces it with clip_ready
+func (eg *EdgeGateway) saveEventClip(uploader *GCSUploader, cameraID string, clip *eventClipRecording) {
+	data, err := muxEventClip(clip.codec, clip.packets)
+	if err != nil {
+		log.Printf("Event clips: failed to write clip of camera %s: %v", cameraID, err)
+		return
+	}
+
+	first, last := clip.packets[0], clip.packets[len(clip.packets)-1]
+	clipID := fmt.Sprintf("%s-%s", cameraID, first.at.UTC().Format("20060102T150405.000Z"))
+	name := path.Join(eg.cfg.EventClipGCSPrefix, getGatewayID(), cameraID, clipID+".mp4")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = uploader.UploadWithMetadata(ctx, name, "video/mp4", "max-age=3600", map[string]string{
+		"gateway_id":  getGatewayID(),
+		"camera_id":   cameraID,
+		"event_types": strings.Join(clip.events, ","),
+		"event_time":  clip.eventTime.UTC().Format(time.RFC3339),
+	}, data)
+	eg.recordSubsystem("recorder", err)
+	if err != nil {
+		log.Printf("Event clips: %v", err)
+		return
+	}
+
+	log.Printf("Event clips: uploaded %s clip of camera %s (%s, %d bytes)",
+		strings.Join(clip.events, ", "), cameraID, last.at.Sub(first.at).Round(time.Second), len(data))
+	eg.sendEvent("clip_ready", EventClip{
+		ClipID:     clipID,
+		CameraID:   cameraID,
+		EventTypes: clip.events,
+		EventTime:  clip.eventTime,
+		Start:      first.at,
+		End:        last.at,
+		Duration:   (last.pkt.Time - first.pkt.Time + last.pkt.Duration).Seconds(),
+		SizeBytes:  len(data),
+		URL:        fmt.Sprintf("gs://%s/%s", eg.cfg.EventClipGCSBucket, name),
+	})
+}
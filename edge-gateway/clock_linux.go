@@ -0,0 +1,20 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// staUnsync is the kernel's flag for a clock no time daemon is disciplining
+const staUnsync = 0x0040
+
+// kernelClockSynced reports whether NTP, through chrony, ntpd or
+// systemd-timesyncd, keeps the host's clock in sync
+func kernelClockSynced() (synced, ok bool) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, false
+	}
+	// TIME_ERROR is 5
+	return state != 5 && tx.Status&staUnsync == 0, true
+}
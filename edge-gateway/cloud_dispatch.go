@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// cloudDispatcher runs the handling of cloud messages on a pool of
+// workers. Messages with the same key, those for one camera, are handled
+// one at a time in the order they arrived, and messages with different keys
+// concurrently, up to CLOUD_MESSAGE_WORKERS at once, so a slow PTZ call
+// holds up only its own camera's messages.
+type cloudDispatcher struct {
+	workers chan struct{} // a slot for each key being handled
+
+	lock   sync.Mutex
+	queues map[string][]func() // by key, present while the key is handled
+	queued int
+}
+
+func newCloudDispatcher(workers int) *cloudDispatcher {
+	return &cloudDispatcher{
+		workers: make(chan struct{}, workers),
+		queues:  make(map[string][]func()),
+	}
+}
+
+// Dispatch queues fn behind the earlier messages with the same key
+func (d *cloudDispatcher) Dispatch(key string, fn func()) {
+	d.lock.Lock()
+	queue, handling := d.queues[key]
+	d.queues[key] = append(queue, fn)
+	d.queued++
+	d.lock.Unlock()
+	if !handling {
+		go d.run(key)
+	}
+}
+
+// run handles the key's messages, once a worker is free, until its queue is
+// empty
+func (d *cloudDispatcher) run(key string) {
+	d.workers <- struct{}{}
+	defer func() { <-d.workers }()
+	for {
+		d.lock.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.lock.Unlock()
+			return
+		}
+		fn := queue[0]
+		queue[0] = nil
+		d.queues[key] = queue[1:]
+		d.queued--
+		d.lock.Unlock()
+		fn()
+	}
+}
+
+// Depths returns the number of messages waiting, and the most waiting for
+// any one key
+func (d *cloudDispatcher) Depths() (queued, deepest int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, queue := range d.queues {
+		deepest = max(deepest, len(queue))
+	}
+	return d.queued, deepest
+}
+
+// cloudMessageKey is the queue a cloud message waits in: its camera's, or
+// its viewer session's for session messages that name no camera. Other
+// messages share the gateway's queue.
+func cloudMessageKey(msg WSMessage) string {
+	var ids struct {
+		CameraID  string `json:"camera_id"`
+		SessionID string `json:"session_id"`
+	}
+	json.Unmarshal(msg.Payload, &ids)
+	switch {
+	case ids.CameraID != "":
+		return "camera:" + ids.CameraID
+	case ids.SessionID != "":
+		return "session:" + ids.SessionID
+	}
+	return "gateway"
+}
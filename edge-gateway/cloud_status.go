@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Cloud connection states
+const (
+	cloudStateConnecting   = "connecting"
+	cloudStateConnected    = "connected"
+	cloudStateReconnecting = "reconnecting"
+	cloudStateClosed       = "closed"
+)
+
+// cloudReconnectBase is the first reconnect delay, doubled on each failure
+// up to CLOUD_RECONNECT_MAX_INTERVAL
+const cloudReconnectBase = time.Second
+
+// CloudStatus describes the gateway's link to the cloud orchestrator
+type CloudStatus struct {
+	State     string     `json:"state"`
+	URL       string     `json:"url"`
+	Transport string     `json:"transport"`
+	Since     time.Time  `json:"since"`
+	Attempt   int        `json:"attempt,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+	// Events waiting for the cloud
+	QueuedEvents int `json:"queued_events"`
+}
+
+// cloudWatcher receives cloud state changes for the local API
+type cloudWatcher chan CloudStatus
+
+// setCloudState records a connection state change and tells local API
+// watchers about it
+func (eg *EdgeGateway) setCloudState(state string, attempt int, err error, retryIn time.Duration) {
+	status := CloudStatus{
+		State:     state,
+		URL:       redactCredentials(eg.cloudURL),
+		Transport: cloudTransport(eg.cloudURL),
+		Since:     time.Now(),
+		Attempt:   attempt,
+	}
+	if err != nil {
+		status.LastError = redactCredentials(err.Error())
+	}
+	if retryIn > 0 {
+		next := status.Since.Add(retryIn)
+		status.NextRetry = &next
+	}
+
+	eg.cloudStateLock.Lock()
+	defer eg.cloudStateLock.Unlock()
+	eg.cloudStatus = status
+	for watcher := range eg.cloudWatchers {
+		select {
+		case watcher <- status:
+		default:
+			// A slow watcher catches up on the next change
+		}
+	}
+}
+
+// CloudStatus returns the current state of the cloud connection
+func (eg *EdgeGateway) CloudStatus() CloudStatus {
+	eg.cloudStateLock.Lock()
+	status := eg.cloudStatus
+	eg.cloudStateLock.Unlock()
+	status.QueuedEvents = eg.outbox.Len()
+	return status
+}
+
+// watchCloud subscribes to cloud state changes until the returned function
+// is called
+func (eg *EdgeGateway) watchCloud() (cloudWatcher, func()) {
+	watcher := make(cloudWatcher, 8)
+	eg.cloudStateLock.Lock()
+	eg.cloudWatchers[watcher] = struct{}{}
+	eg.cloudStateLock.Unlock()
+	return watcher, func() {
+		eg.cloudStateLock.Lock()
+		delete(eg.cloudWatchers, watcher)
+		eg.cloudStateLock.Unlock()
+	}
+}
+
+// cloudReconnectDelay returns the wait before reconnect attempt n (from 1):
+// exponential up to the configured cap, with the upper half jittered so a
+// fleet of gateways doesn't reconnect in lockstep after an outage
+func (eg *EdgeGateway) cloudReconnectDelay(attempt int) time.Duration {
+	limit := eg.cfg.CloudReconnectMaxInterval
+	if limit < cloudReconnectBase {
+		limit = cloudReconnectBase
+	}
+	delay := cloudReconnectBase
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// WebRTCSession is a cloud viewer's peer connection
+type WebRTCSession struct {
+	CameraID  string `json:"camera_id"`
+	SessionID string `json:"session_id"`
+	State     string `json:"state"`
+}
+
+// sendSessionResume tells the orchestrator, after a reconnect, which streams,
+// viewers and relays kept running while it was unreachable so it can
+// re-attach to them instead of starting over
+func (eg *EdgeGateway) sendSessionResume() {
+	eg.peerConnsLock.RLock()
+	sessions := []WebRTCSession{}
+	for sessionID, p := range eg.peerConns {
+		if p.pc == nil {
+			continue
+		}
+		sessions = append(sessions, WebRTCSession{CameraID: p.cameraID, SessionID: sessionID, State: p.pc.ConnectionState().String()})
+	}
+	eg.peerConnsLock.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CameraID != sessions[j].CameraID {
+			return sessions[i].CameraID < sessions[j].CameraID
+		}
+		return sessions[i].SessionID < sessions[j].SessionID
+	})
+
+	eg.sendEvent("session_resume", map[string]interface{}{
+		"streams":         eg.streamHealth(),
+		"webrtc_sessions": sessions,
+		"relays":          eg.listRelays(),
+	})
+}
+
+// handleCloudAPI reports the cloud connection state (GET /api/cloud) or
+// streams its changes as server-sent events (GET /api/cloud/events)
+func (eg *EdgeGateway) handleCloudAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Path != "/api/cloud/events" {
+		writeJSON(w, http.StatusOK, eg.CloudStatus())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	watcher, stop := eg.watchCloud()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Start with the current state so clients need not also poll
+	status := eg.CloudStatus()
+	for {
+		data, _ := json.Marshal(status)
+		if _, err := fmt.Fprintf(w, "event: cloud_state\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-eg.ctx.Done():
+			return
+		case status = <-watcher:
+		}
+	}
+}
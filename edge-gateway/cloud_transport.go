@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"edge-gateway/gatewaypb"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Encodings of cloud messages (CLOUD_ENCODING). auto prefers protobuf when
+// the orchestrator supports it.
+const (
+	cloudEncodingAuto     = "auto"
+	cloudEncodingJSON     = "json"
+	cloudEncodingProtobuf = "protobuf"
+)
+
+// WebSocket subprotocols, one per encoding, versioned with the gatewaypb
+// schema. An orchestrator that selects none gets JSON.
+const (
+	wsSubprotocolJSON     = "edge-gateway.v1.json"
+	wsSubprotocolProtobuf = "edge-gateway.v1.protobuf"
+)
+
+// CloudConn is a session with the cloud orchestrator. Send and Receive may be
+// called concurrently with each other, but not with themselves.
+type CloudConn interface {
+	Send(msg WSMessage) error
+	Receive() (WSMessage, error)
+	Close() error
+	// Encoding is json or protobuf
+	Encoding() string
+}
+
+// dialCloud connects to the orchestrator using the transport selected by the
+// URL scheme: ws:// and wss:// for WebSocket, grpc:// and grpcs:// for gRPC
+func dialCloud(ctx context.Context, cfg *Config, rawURL string) (CloudConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud URL: %v", err)
+	}
+	switch u.Scheme {
+	case "grpc", "grpcs":
+		return dialGRPCCloud(ctx, cfg, u)
+	default:
+		return dialWSCloud(ctx, cfg, rawURL)
+	}
+}
+
+// errCloudConnClosed is returned by Send once the connection is closed
+var errCloudConnClosed = errors.New("cloud connection closed")
+
+// wsCloudConn carries WSMessages as JSON text frames, or as binary frames
+// of gatewaypb messages when the protobuf subprotocol was negotiated.
+//
+// One goroutine, writePump, writes the frames Send hands it and pings the
+// orchestrator every half of CLOUD_WS_READ_TIMEOUT. Receive closes the
+// connection once nothing, not even a pong, has arrived for
+// CLOUD_WS_READ_TIMEOUT, so a dead TCP connection can't block it forever.
+type wsCloudConn struct {
+	conn         *websocket.Conn
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+	protobuf     bool
+
+	writes chan wsWrite
+	done   chan struct{}
+	close  sync.Once
+}
+
+// wsWrite is a frame waiting for writePump, and where to report the result
+type wsWrite struct {
+	kind   int
+	data   []byte
+	result chan error
+}
+
+func dialWSCloud(ctx context.Context, cfg *Config, rawURL string) (*wsCloudConn, error) {
+	header := http.Header{}
+	header.Add("X-Gateway-ID", getGatewayID())
+	header.Add("X-Gateway-Version", Version)
+
+	dialer := websocket.Dialer{
+		NetDialContext:   egress.DialContext,
+		HandshakeTimeout: cfg.CloudDialTimeout,
+	}
+	switch cfg.CloudEncoding {
+	case cloudEncodingJSON:
+		dialer.Subprotocols = []string{wsSubprotocolJSON}
+	case cloudEncodingProtobuf:
+		dialer.Subprotocols = []string{wsSubprotocolProtobuf}
+	default:
+		dialer.Subprotocols = []string{wsSubprotocolProtobuf, wsSubprotocolJSON}
+	}
+	// The handshake honors ctx's deadline but not its cancellation, so a
+	// hung orchestrator would hold up shutdown for the whole dial timeout;
+	// expiring the connection's deadline is what cancels it
+	var handshakeDone func() bool
+	dialer.NetDialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := egress.DialContext(dialCtx, network, addr)
+		if err == nil {
+			handshakeDone = context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+		}
+		return conn, err
+	}
+	conn, _, err := dialer.DialContext(ctx, rawURL, header)
+	if handshakeDone != nil && !handshakeDone() && err == nil {
+		conn.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	c := &wsCloudConn{
+		conn:         conn,
+		writeTimeout: cfg.CloudWriteTimeout,
+		readTimeout:  cfg.CloudWSReadTimeout,
+		protobuf:     conn.Subprotocol() == wsSubprotocolProtobuf,
+		writes:       make(chan wsWrite),
+		done:         make(chan struct{}),
+	}
+	if cfg.CloudEncoding == cloudEncodingProtobuf && !c.protobuf {
+		conn.Close()
+		return nil, fmt.Errorf("orchestrator did not accept the %s subprotocol", wsSubprotocolProtobuf)
+	}
+
+	// Any frame from the orchestrator shows the connection is alive
+	c.extendReadDeadline()
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+	conn.SetPingHandler(func(appData string) error {
+		c.extendReadDeadline()
+		// WriteControl may be called alongside writePump's writes
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(c.writeTimeout))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return err
+			}
+		}
+		return nil
+	})
+	go c.writePump()
+	return c, nil
+}
+
+// extendReadDeadline gives the orchestrator another CLOUD_WS_READ_TIMEOUT
+// to send something
+func (c *wsCloudConn) extendReadDeadline() {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+}
+
+// writePump writes frames handed over by Send, and pings the orchestrator,
+// until the connection is closed. A failed write closes the connection, so
+// Receive fails too and the gateway reconnects.
+func (c *wsCloudConn) writePump() {
+	var pings <-chan time.Time
+	if c.readTimeout > 0 {
+		ticker := time.NewTicker(c.readTimeout / 2)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case w := <-c.writes:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			err := c.conn.WriteMessage(w.kind, w.data)
+			w.result <- err
+			if err != nil {
+				c.Close()
+				return
+			}
+		case <-pings:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout))
+			if err != nil {
+				debugf("Cloud ping failed: %v", err)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Send hands a message to writePump and waits for it to be written
+func (c *wsCloudConn) Send(msg WSMessage) error {
+	w := wsWrite{kind: websocket.TextMessage, result: make(chan error, 1)}
+	var err error
+	if c.protobuf {
+		w.kind = websocket.BinaryMessage
+		w.data, err = proto.Marshal(toGatewayMessage(msg))
+	} else {
+		w.data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.writes <- w:
+		// writePump reports every write it takes, even when closing
+		return <-w.result
+	case <-c.done:
+		return errCloudConnClosed
+	}
+}
+
+// Receive reads the next message. Binary frames are gatewaypb messages and
+// text frames JSON, whichever was negotiated.
+func (c *wsCloudConn) Receive() (WSMessage, error) {
+	kind, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return WSMessage{}, err
+	}
+	c.extendReadDeadline()
+	if kind == websocket.BinaryMessage {
+		var m gatewaypb.CloudMessage
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return WSMessage{}, fmt.Errorf("invalid protobuf cloud message: %v", err)
+		}
+		return fromCloudMessage(&m)
+	}
+	var msg WSMessage
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+func (c *wsCloudConn) Encoding() string {
+	if c.protobuf {
+		return cloudEncodingProtobuf
+	}
+	return cloudEncodingJSON
+}
+
+// Close stops writePump, sends a close frame, so the orchestrator sees a
+// clean going-away rather than a dropped connection, then closes the
+// socket
+func (c *wsCloudConn) Close() error {
+	var err error
+	c.close.Do(func() {
+		close(c.done)
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// grpcCloudConn carries WSMessages over the GatewayService.Connect stream
+type grpcCloudConn struct {
+	cc     *grpc.ClientConn
+	stream gatewaypb.GatewayService_ConnectClient
+	cancel context.CancelFunc
+}
+
+func dialGRPCCloud(ctx context.Context, cfg *Config, u *url.URL) (*grpcCloudConn, error) {
+	target := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "grpc" {
+			port = "80"
+		}
+		target = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+	}
+
+	dialCtx, cancelDial := context.WithTimeout(ctx, cfg.CloudDialTimeout)
+	defer cancelDial()
+	cc, err := grpc.DialContext(dialCtx, target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(dialEgress),
+		grpc.WithBlock(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cfg.CloudGRPCKeepalive,
+			Timeout:             cfg.CloudWriteTimeout,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stream outlives ctx; it ends when the connection is closed
+	streamCtx, cancel := context.WithCancel(context.Background())
+	streamCtx = metadata.AppendToOutgoingContext(streamCtx,
+		"x-gateway-id", getGatewayID(),
+		"x-gateway-version", Version,
+	)
+	stream, err := gatewaypb.NewGatewayServiceClient(cc).Connect(streamCtx)
+	if err != nil {
+		cancel()
+		cc.Close()
+		return nil, err
+	}
+	return &grpcCloudConn{cc: cc, stream: stream, cancel: cancel}, nil
+}
+
+func (c *grpcCloudConn) Send(msg WSMessage) error {
+	return c.stream.Send(toGatewayMessage(msg))
+}
+
+func (c *grpcCloudConn) Encoding() string {
+	return cloudEncodingProtobuf
+}
+
+func (c *grpcCloudConn) Receive() (WSMessage, error) {
+	m, err := c.stream.Recv()
+	if err != nil {
+		return WSMessage{}, err
+	}
+	return fromCloudMessage(m)
+}
+
+// Close half-closes the stream, so the orchestrator sees a clean end rather
+// than a cancellation, then closes the connection
+func (c *grpcCloudConn) Close() error {
+	c.stream.CloseSend()
+	c.cancel()
+	return c.cc.Close()
+}
+
+// toGatewayMessage sets the GatewayMessage field named after msg.Type from
+// the JSON payload. Types without a field, and payloads that do not fit the
+// schema, are sent as Untyped so nothing is lost: those with a key their
+// message lacks, such as the event_id of queued events, included.
+func toGatewayMessage(msg WSMessage) *gatewaypb.GatewayMessage {
+	out := &gatewaypb.GatewayMessage{}
+	if setOneof(out, msg) {
+		return out
+	}
+	out.Message = &gatewaypb.GatewayMessage_Other{Other: untyped(msg)}
+	return out
+}
+
+// fromCloudMessage converts the set CloudMessage field back to a WSMessage
+func fromCloudMessage(m *gatewaypb.CloudMessage) (WSMessage, error) {
+	if other := m.GetOther(); other != nil {
+		payload := []byte("{}")
+		if other.Payload != nil {
+			data, err := protojson.Marshal(other.Payload)
+			if err != nil {
+				return WSMessage{}, err
+			}
+			payload = data
+		}
+		return WSMessage{Type: other.Type, Payload: payload}, nil
+	}
+
+	r := m.ProtoReflect()
+	field := r.WhichOneof(r.Descriptor().Oneofs().ByName("message"))
+	if field == nil {
+		return WSMessage{}, fmt.Errorf("empty cloud message")
+	}
+	payload, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(r.Get(field).Message().Interface())
+	if err != nil {
+		return WSMessage{}, err
+	}
+	return WSMessage{Type: string(field.Name()), Payload: payload}, nil
+}
+
+// setOneof fills the "message" oneof field named msg.Type, reporting false if
+// there is no such field or the payload does not decode into it whole. A
+// payload with a key the field's message lacks doesn't, so a field added to
+// a message without adding it to the schema is never dropped.
+func setOneof(m proto.Message, msg WSMessage) bool {
+	r := m.ProtoReflect()
+	field := r.Descriptor().Oneofs().ByName("message").Fields().ByName(protoreflect.Name(msg.Type))
+	if field == nil || field.Name() == "other" || field.Message() == nil {
+		return false
+	}
+
+	payload := []byte(msg.Payload)
+	if len(payload) == 0 || string(payload) == "null" {
+		payload = []byte("{}")
+	}
+	value := r.NewField(field)
+	if err := protojson.Unmarshal(payload, value.Message().Interface()); err != nil {
+		return false
+	}
+	r.Set(field, value)
+	return true
+}
+
+// untyped wraps a message's raw JSON payload
+func untyped(msg WSMessage) *gatewaypb.Untyped {
+	out := &gatewaypb.Untyped{Type: msg.Type}
+	var v interface{}
+	if err := json.Unmarshal(msg.Payload, &v); err == nil {
+		if value, err := structpb.NewValue(v); err == nil {
+			out.Payload = value
+		}
+	}
+	return out
+}
+
+// cloudTransport names the transport a cloud URL selects, for logs and
+// capabilities
+func cloudTransport(rawURL string) string {
+	if strings.HasPrefix(rawURL, "grpc://") || strings.HasPrefix(rawURL, "grpcs://") {
+		return "grpc"
+	}
+	return "websocket"
+}
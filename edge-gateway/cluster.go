@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// clusterService is the mDNS service the gateways of a cluster advertise
+// themselves as
+const clusterService = "_anava-gateway._tcp"
+
+// How often the cluster is browsed for, how long a browse listens, and how
+// long a gateway that stopped advertising is still a member
+const (
+	clusterBrowseInterval = 10 * time.Second
+	clusterBrowseTimeout  = 3 * time.Second
+	clusterMemberTTL      = 35 * time.Second
+)
+
+// clusterHandoffGrace is how long a draining gateway keeps a handed off
+// session, so its player can connect to the new gateway first
+const clusterHandoffGrace = 15 * time.Second
+
+// How a cluster elects its leader: the member with the lowest gateway ID,
+// or the one the orchestrator names with cluster_leader
+const (
+	clusterElectionMDNS  = "mdns"
+	clusterElectionCloud = "cloud"
+)
+
+// ClusterMember is a gateway of the cluster as it last advertised itself
+type ClusterMember struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address,omitempty"`
+	Load     int       `json:"load"` // its streams and viewers
+	Draining bool      `json:"draining,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ClusterStatus is the cluster as one gateway sees it. Only the leader
+// reports the assignments of discovered cameras to members.
+type ClusterStatus struct {
+	Name        string            `json:"name"`
+	GatewayID   string            `json:"gateway_id"`
+	Election    string            `json:"election"`
+	Leader      string            `json:"leader,omitempty"`
+	Draining    bool              `json:"draining"`
+	Members     []ClusterMember   `json:"members"`
+	Assignments map[string]string `json:"assignments,omitempty"`
+}
+
+// Cluster tracks the other gateways of CLUSTER_NAME on the LAN, and splits
+// the cameras every member discovers between those not draining
+type Cluster struct {
+	lock     sync.Mutex
+	name     string
+	self     string
+	election string
+	members  map[string]*ClusterMember // the other gateways, by ID
+	// cloudLeader is the leader the orchestrator named, with
+	// CLUSTER_ELECTION=cloud
+	cloudLeader string
+	draining    bool
+	load        int
+	server      *zeroconf.Server // nil until advertised
+}
+
+// NewCluster returns the gateway's cluster, or nil unless CLUSTER_ENABLED
+func NewCluster(cfg *Config) *Cluster {
+	if !cfg.ClusterEnabled {
+		return nil
+	}
+	return &Cluster{
+		name:     cfg.ClusterName,
+		self:     getGatewayID(),
+		election: cfg.ClusterElection,
+		members:  make(map[string]*ClusterMember),
+	}
+}
+
+// text is the TXT record the gateway advertises. The caller holds lock.
+func (c *Cluster) text() []string {
+	return []string{
+		"cluster=" + c.name,
+		"load=" + strconv.Itoa(c.load),
+		"draining=" + strconv.FormatBool(c.draining),
+	}
+}
+
+// observe records a gateway advertising itself
+func (c *Cluster) observe(entry *zeroconf.ServiceEntry, now time.Time) {
+	fields := make(map[string]string)
+	for _, txt := range entry.Text {
+		if key, value, ok := strings.Cut(txt, "="); ok {
+			fields[key] = value
+		}
+	}
+	if fields["cluster"] != c.name || entry.Instance == c.self {
+		return
+	}
+	load, _ := strconv.Atoi(fields["load"])
+	draining, _ := strconv.ParseBool(fields["draining"])
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.members[entry.Instance] = &ClusterMember{
+		ID:       entry.Instance,
+		Address:  discoveredAddress(entry),
+		Load:     load,
+		Draining: draining,
+		LastSeen: now,
+	}
+}
+
+// liveLocked returns the gateway itself and the members seen within
+// clusterMemberTTL, by ID, forgetting the others. The caller holds lock.
+func (c *Cluster) liveLocked(now time.Time) []ClusterMember {
+	live := []ClusterMember{{ID: c.self, Load: c.load, Draining: c.draining, LastSeen: now}}
+	for id, m := range c.members {
+		if now.Sub(m.LastSeen) > clusterMemberTTL {
+			delete(c.members, id)
+			continue
+		}
+		live = append(live, *m)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].ID < live[j].ID })
+	return live
+}
+
+// leaderLocked returns the cluster's leader, "" while there is none. The
+// caller holds lock.
+func (c *Cluster) leaderLocked(live []ClusterMember) string {
+	if c.election == clusterElectionCloud {
+		return c.cloudLeader
+	}
+	for _, m := range live {
+		if !m.Draining {
+			return m.ID
+		}
+	}
+	return ""
+}
+
+// ownerLocked picks the member that streams a camera by rendezvous hashing
+// over the members not draining, so members agree without talking and a
+// change of membership only moves the cameras of the member that came or
+// went. With every member draining, the gateway keeps its cameras. The
+// caller holds lock.
+func (c *Cluster) ownerLocked(live []ClusterMember, key string) string {
+	owner, best, found := c.self, uint64(0), false
+	for _, m := range live {
+		if m.Draining {
+			continue
+		}
+		sum := sha256.Sum256([]byte(m.ID + "/" + key))
+		if score := binary.BigEndian.Uint64(sum[:]); !found || score > best {
+			owner, best, found = m.ID, score, true
+		}
+	}
+	return owner
+}
+
+// clusterKey is what a camera is assigned by, or "" for cameras only this
+// gateway has: those registered by hand, local and simulated ones. Sensors
+// go with their camera.
+func clusterKey(camera *Camera) string {
+	if camera.Manual || camera.Device != "" || camera.Simulated {
+		return ""
+	}
+	if camera.ParentID != "" {
+		return camera.ParentID
+	}
+	return camera.ID
+}
+
+// clusterOwner returns the gateway that streams a camera: this one unless
+// it is clustered and the camera is assigned to another member
+func (eg *EdgeGateway) clusterOwner(cameraID string) string {
+	c := eg.cluster
+	if c == nil {
+		return getGatewayID()
+	}
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cameraID]
+	key := ""
+	if exists {
+		key = clusterKey(camera)
+	}
+	eg.camerasLock.RUnlock()
+	if key == "" {
+		return c.self
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ownerLocked(c.liveLocked(time.Now()), key)
+}
+
+// clusterOwns reports whether the gateway streams a camera
+func (eg *EdgeGateway) clusterOwns(cameraID string) bool {
+	return eg.clusterOwner(cameraID) == getGatewayID()
+}
+
+// clusterStatus returns the cluster as the gateway sees it
+func (eg *EdgeGateway) clusterStatus() ClusterStatus {
+	c := eg.cluster
+	eg.camerasLock.RLock()
+	keys := make(map[string]string)
+	for _, camera := range eg.cameras {
+		if key := clusterKey(camera); key != "" {
+			keys[camera.ID] = key
+		}
+	}
+	eg.camerasLock.RUnlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	live := c.liveLocked(time.Now())
+	status := ClusterStatus{
+		Name:      c.name,
+		GatewayID: c.self,
+		Election:  c.election,
+		Leader:    c.leaderLocked(live),
+		Draining:  c.draining,
+		Members:   live,
+	}
+	if status.Leader == c.self {
+		status.Assignments = make(map[string]string)
+		for cameraID, key := range keys {
+			status.Assignments[cameraID] = c.ownerLocked(live, key)
+		}
+	}
+	return status
+}
+
+// runCluster advertises the gateway to its cluster and browses for the
+// other members, reporting the cluster to the cloud whenever its members,
+// leader or assignments change
+func (eg *EdgeGateway) runCluster(ctx context.Context) {
+	c := eg.cluster
+	if c == nil {
+		return
+	}
+	port := 0
+	if _, p, err := net.SplitHostPort(eg.cfg.LocalAPIAddr); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+	c.lock.Lock()
+	c.load = eg.clusterLoad()
+	server, err := zeroconf.Register(c.self, clusterService, "local.", port, c.text(), nil)
+	if err == nil {
+		c.server = server
+	}
+	c.lock.Unlock()
+	if err != nil {
+		log.Printf("Failed to advertise gateway to cluster %s: %v", c.name, err)
+		return
+	}
+	defer func() {
+		c.lock.Lock()
+		c.server = nil
+		c.lock.Unlock()
+		// Shutting down says goodbye, so members reassign the cameras
+		// straight away
+		server.Shutdown()
+	}()
+	log.Printf("Joined gateway cluster %s (%s election)", c.name, c.election)
+
+	ticker := time.NewTicker(clusterBrowseInterval)
+	defer ticker.Stop()
+	reported := ""
+	for {
+		eg.browseCluster(ctx)
+
+		c.lock.Lock()
+		c.load = eg.clusterLoad()
+		server.SetText(c.text())
+		c.lock.Unlock()
+
+		status := eg.clusterStatus()
+		if fingerprint := status.fingerprint(); fingerprint != reported {
+			reported = fingerprint
+			eg.sendEvent("cluster_status", status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// browseCluster listens for the members' advertisements for
+// clusterBrowseTimeout
+func (eg *EdgeGateway) browseCluster(ctx context.Context) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		log.Printf("Failed to initialize cluster mDNS resolver: %v", err)
+		return
+	}
+	browseCtx, cancel := context.WithTimeout(ctx, clusterBrowseTimeout)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(browseCtx, clusterService, "local.", entries); err != nil {
+		log.Printf("Failed to browse %s: %v", clusterService, err)
+		return
+	}
+	for entry := range entries {
+		eg.cluster.observe(entry, time.Now())
+	}
+}
+
+// clusterLoad is the gateway's load as advertised to its cluster
+func (eg *EdgeGateway) clusterLoad() int {
+	l := eg.load()
+	return l.Streams + l.Viewers + l.WHEPViewers
+}
+
+// fingerprint identifies what a cluster_status reports, leaving out the
+// members' load and when they were seen
+func (s ClusterStatus) fingerprint() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%t", s.Leader, s.Draining)
+	for _, m := range s.Members {
+		fmt.Fprintf(&b, "|%s:%t", m.ID, m.Draining)
+	}
+	assignments, _ := json.Marshal(s.Assignments)
+	b.Write(assignments)
+	return b.String()
+}
+
+// setClusterLeader records the leader the orchestrator elected
+func (eg *EdgeGateway) setClusterLeader(leaderID string) error {
+	c := eg.cluster
+	if c == nil {
+		return errors.New("gateway isn't clustered")
+	}
+	if c.election != clusterElectionCloud {
+		return fmt.Errorf("cluster %s elects its leader over mDNS", c.name)
+	}
+	c.lock.Lock()
+	c.cloudLeader = leaderID
+	c.lock.Unlock()
+	log.Printf("Cluster %s leader is %s", c.name, leaderID)
+	eg.sendEvent("cluster_status", eg.clusterStatus())
+	return nil
+}
+
+// setClusterDraining takes the gateway out of its cluster's camera
+// assignments for maintenance, handing its viewer sessions off to the
+// members that now stream their cameras and closing them after grace, or
+// puts it back
+func (eg *EdgeGateway) setClusterDraining(draining bool, grace time.Duration) error {
+	c := eg.cluster
+	if c == nil {
+		return errors.New("gateway isn't clustered")
+	}
+	c.lock.Lock()
+	changed := c.draining != draining
+	c.draining = draining
+	if c.server != nil {
+		c.server.SetText(c.text())
+	}
+	c.lock.Unlock()
+	if !changed {
+		return nil
+	}
+
+	log.Printf("Gateway draining from cluster %s: %t", c.name, draining)
+	if draining {
+		eg.handoffSessions(grace)
+	}
+	eg.sendEvent("cluster_status", eg.clusterStatus())
+	return nil
+}
+
+// handoffSessions asks the cloud to move each WebRTC viewer session of a
+// camera now assigned to another member there, and closes the session
+// after grace, or as the gateway closes its viewers if grace is 0. WHEP
+// sessions are local, and cameras no other member has stay. It returns
+// how many sessions were handed off.
+func (eg *EdgeGateway) handoffSessions(grace time.Duration) int {
+	eg.viewersLock.Lock()
+	var viewers []*Viewer
+	for _, v := range eg.viewers {
+		if v.Kind == viewerKindWebRTC {
+			viewers = append(viewers, v)
+		}
+	}
+	eg.viewersLock.Unlock()
+
+	handedOff := 0
+	for _, v := range viewers {
+		owner := eg.clusterOwner(v.CameraID)
+		if owner == getGatewayID() {
+			continue
+		}
+		v.lock.Lock()
+		profile := v.Profile
+		if grace == 0 && v.closeReason == "" {
+			v.closeReason = sessionReasonHandoff
+		}
+		v.lock.Unlock()
+		eg.sendEvent("session_handoff", map[string]interface{}{
+			"session_id": v.ID,
+			"camera_id":  v.CameraID,
+			"profile":    profile,
+			"gateway_id": owner,
+		})
+		if grace > 0 {
+			time.AfterFunc(grace, func() { v.close(sessionReasonHandoff) })
+		}
+		handedOff++
+	}
+	if handedOff > 0 {
+		log.Printf("Handed off %d viewer sessions to other cluster members", handedOff)
+	}
+	return handedOff
+}
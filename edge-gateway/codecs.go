@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/pion/webrtc/v3"
+)
+
+// Video codecs of viewer sessions. H.264 is forwarded from the camera or
+// transcoded as needed; VP9 and AV1 are always encoded by the transcoder.
+const (
+	videoCodecH264 = ""
+	videoCodecVP9  = "vp9"
+	videoCodecAV1  = "av1"
+)
+
+// maxIVFFrameSize bounds a frame read from ffmpeg's IVF output
+const maxIVFFrameSize = 16 << 20
+
+// videoCodecMimeTypes are the WebRTC MIME types of the codecs
+var videoCodecMimeTypes = map[string]string{
+	videoCodecH264: webrtc.MimeTypeH264,
+	videoCodecVP9:  webrtc.MimeTypeVP9,
+	videoCodecAV1:  webrtc.MimeTypeAV1,
+}
+
+// codecName names a codec in logs and reports
+func codecName(codec string) string {
+	if codec == videoCodecH264 {
+		return "h264"
+	}
+	return codec
+}
+
+// codecStreamKey identifies a stream by camera, viewer profile and codec
+func codecStreamKey(cameraID, profile, codec string) string {
+	if codec == videoCodecH264 {
+		return streamKey(cameraID, profile)
+	}
+	return streamKey(cameraID, profile) + "#" + codec
+}
+
+// offerVideoCodecs returns the codecs an SDP offer's video sections can
+// receive, by the names of their rtpmap attributes, lowercased
+func offerVideoCodecs(sdp string) map[string]bool {
+	codecs := make(map[string]bool)
+	video := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if media, ok := strings.CutPrefix(line, "m="); ok {
+			video = strings.HasPrefix(media, "video ")
+			continue
+		}
+		rtpmap, ok := strings.CutPrefix(line, "a=rtpmap:")
+		if !video || !ok {
+			continue
+		}
+		if fields := strings.Fields(rtpmap); len(fields) == 2 {
+			name, _, _ := strings.Cut(fields[1], "/")
+			codecs[strings.ToLower(name)] = true
+		}
+	}
+	return codecs
+}
+
+// negotiateCodec picks the codec of a viewer session: the first of
+// TRANSCODE_CODECS the offer can receive, or H.264. Other codecs need the
+// transcoder, and aren't offered for local cameras, which are captured in
+// H.264 once, or end-to-end encrypted cameras, whose frames are encrypted
+// by H.264 NAL unit.
+func (eg *EdgeGateway) negotiateCodec(cameraID, sdp string) string {
+	if eg.transcoder == nil || len(eg.cfg.TranscodeCodecs) == 0 || eg.e2ee.Get(cameraID) != nil {
+		return videoCodecH264
+	}
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cameraID]
+	local := exists && camera.Device != ""
+	eg.camerasLock.RUnlock()
+	if !exists || local {
+		return videoCodecH264
+	}
+
+	offered := offerVideoCodecs(sdp)
+	for _, codec := range eg.cfg.TranscodeCodecs {
+		if offered[codec] {
+			return codec
+		}
+	}
+	return videoCodecH264
+}
+
+// ivfCodecData describes the video of an IVF file
+type ivfCodecData struct {
+	codec         av.CodecType
+	width, height int
+}
+
+func (c ivfCodecData) Type() av.CodecType { return c.codec }
+func (c ivfCodecData) Width() int         { return c.width }
+func (c ivfCodecData) Height() int        { return c.height }
+
+// ivfDemuxer reads the VP9 or AV1 frames of ffmpeg's IVF output: a 32-byte
+// file header, then each frame after a 12-byte header of its size and
+// timestamp
+type ivfDemuxer struct {
+	r        *bufio.Reader
+	codec    *ivfCodecData
+	rate     uint32 // timestamp units per scale seconds
+	scale    uint32
+	lastTime time.Duration
+	started  bool
+}
+
+func newIVFDemuxer(r io.Reader) *ivfDemuxer {
+	return &ivfDemuxer{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// Streams reads the file header
+func (d *ivfDemuxer) Streams() ([]av.CodecData, error) {
+	if d.codec == nil {
+		header := make([]byte, 32)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return nil, err
+		}
+		if string(header[:4]) != "DKIF" {
+			return nil, errors.New("not an IVF stream")
+		}
+		// The header may be longer in later versions
+		if size := int(binary.LittleEndian.Uint16(header[6:])); size > len(header) {
+			if _, err := d.r.Discard(size - len(header)); err != nil {
+				return nil, err
+			}
+		}
+
+		codec := &ivfCodecData{
+			width:  int(binary.LittleEndian.Uint16(header[12:])),
+			height: int(binary.LittleEndian.Uint16(header[14:])),
+		}
+		switch fourcc := string(header[8:12]); fourcc {
+		case "VP90":
+			codec.codec = av.VP9
+		case "AV01":
+			codec.codec = av.AV1
+		default:
+			return nil, fmt.Errorf("unsupported IVF codec %q", fourcc)
+		}
+		d.codec = codec
+		d.rate = binary.LittleEndian.Uint32(header[16:])
+		d.scale = binary.LittleEndian.Uint32(header[20:])
+		if d.rate == 0 || d.scale == 0 {
+			return nil, errors.New("IVF stream has no time base")
+		}
+	}
+	return []av.CodecData{*d.codec}, nil
+}
+
+// ReadPacket reads the next frame. Its duration is the time since the
+// previous frame, as the next one's timestamp isn't known yet.
+func (d *ivfDemuxer) ReadPacket() (av.Packet, error) {
+	if _, err := d.Streams(); err != nil {
+		return av.Packet{}, err
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return av.Packet{}, err
+	}
+	size := binary.LittleEndian.Uint32(header)
+	if size > maxIVFFrameSize {
+		return av.Packet{}, fmt.Errorf("IVF frame of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return av.Packet{}, err
+	}
+
+	pts := int64(binary.LittleEndian.Uint64(header[4:]))
+	t := time.Duration(pts) * time.Second * time.Duration(d.scale) / time.Duration(d.rate)
+	pkt := av.Packet{
+		IsKeyFrame: ivfKeyFrame(d.codec.codec, data),
+		Time:       t,
+		Data:       data,
+	}
+	if d.started && t > d.lastTime {
+		pkt.Duration = t - d.lastTime
+	}
+	d.lastTime, d.started = t, true
+	return pkt, nil
+}
+
+// ivfKeyFrame reports whether a frame is a keyframe. VP9 frames say so in
+// their uncompressed header. AV1 encoders repeat the sequence header
+// before each keyframe, so a temporal unit carrying one is taken for a
+// keyframe.
+func ivfKeyFrame(codec av.CodecType, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	switch codec {
+	case av.VP9:
+		b := frame[0]
+		if b>>6 != 2 { // frame_marker
+			return false
+		}
+		profile := b>>5&1 | b>>3&2
+		// show_existing_frame follows a reserved bit in profile 3
+		bit := 3
+		if profile == 3 {
+			bit = 2
+		}
+		if b>>bit&1 == 1 {
+			return false
+		}
+		return b>>(bit-1)&1 == 0 // frame_type KEY_FRAME
+
+	case av.AV1:
+		for len(frame) > 0 {
+			header := frame[0]
+			obuType := header >> 3 & 0xf
+			if obuType == 1 { // OBU_SEQUENCE_HEADER
+				return true
+			}
+			n := 1
+			if header&4 != 0 { // obu_extension_flag
+				n++
+			}
+			if header&2 == 0 || n > len(frame) { // no obu_size, the last OBU
+				return false
+			}
+			size, read := binary.Uvarint(frame[n:])
+			if read <= 0 || size > uint64(len(frame)-n-read) {
+				return false
+			}
+			frame = frame[n+read+int(size):]
+		}
+	}
+	return false
+}
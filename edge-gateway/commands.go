@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// How long, and how many, command results are kept for retries
+const (
+	commandResultTTL = 10 * time.Minute
+	commandResultMax = 1000
+)
+
+// Error codes of a failed command, so the orchestrator can tell its user
+// what to do about it
+const (
+	commandCodeInvalid      = "invalid_request" // the payload doesn't parse
+	commandCodeNotFound     = "not_found"
+	commandCodeForbidden    = "forbidden" // another tenant's camera or session
+	commandCodeUnauthorized = "unauthorized"
+	commandCodeBusy         = "busy"
+	commandCodeOverCapacity = "over_capacity"
+	commandCodeFailed       = "failed"
+)
+
+// cloudCommands are the cloud messages answered with a command_result when
+// they carry a request_id. Signalling is answered by the messages it
+// exchanges instead.
+var cloudCommands = map[string]bool{
+	"start_stream":        true,
+	"stop_stream":         true,
+	"session_close":       true,
+	"update_session":      true,
+	"select_layer":        true,
+	"replay_start":        true,
+	"replay_stop":         true,
+	"ptz_command":         true,
+	"scan_network":        true,
+	"cancel_scan":         true,
+	"approve_camera":      true,
+	"reject_camera":       true,
+	"set_camera_metadata": true,
+	"set_camera_tenant":   true,
+	"cluster_leader":      true,
+	"cluster_drain":       true,
+	"set_privacy_masks":   true,
+	"sync_camera_time":    true,
+	"release_camera":      true,
+	"start_relay":         true,
+	"stop_relay":          true,
+	"set_config":          true,
+	"update_gateway":      true,
+	"upgrade_firmware":    true,
+	"set_camera_audio":    true,
+	"take_snapshot":       true,
+	"set_output":          true,
+	"camera_maintenance":  true,
+	"add_camera":          true,
+	"set_encoder_profile": true,
+	"set_credentials":     true,
+}
+
+// CommandResult is the outcome of a cloud command, sent as command_result
+type CommandResult struct {
+	RequestID string `json:"request_id"`
+	Command   string `json:"command"`
+	CameraID  string `json:"camera_id,omitempty"`
+	Status    string `json:"status"` // ok or error
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"` // as on failure events
+}
+
+// trackedCommand is a command received with a request_id, and its result
+// once it has one
+type trackedCommand struct {
+	command string
+	result  *CommandResult
+	at      time.Time // received, or finished
+}
+
+// commandTracker remembers the commands received with a request_id, so a
+// retried one is answered with the first one's result rather than run
+// again. Request IDs are scoped to the sender's tenant.
+type commandTracker struct {
+	lock     sync.Mutex
+	commands map[string]*trackedCommand
+}
+
+// commandKey is a command's request_id within its sender's tenant
+func commandKey(origin AuditOrigin) string {
+	return origin.TenantID + "/" + origin.RequestID
+}
+
+// beginCommand records a command received with a request_id, and reports
+// whether it should run. A retry of one that finished is answered with its
+// result again; a retry of one still running is dropped, as its result is
+// on its way.
+func (eg *EdgeGateway) beginCommand(origin AuditOrigin, command string) bool {
+	if origin.RequestID == "" || !cloudCommands[command] {
+		return true
+	}
+	t := &eg.commands
+	t.lock.Lock()
+	now := time.Now()
+	if t.commands == nil {
+		t.commands = make(map[string]*trackedCommand)
+	}
+	var oldest string
+	for key, c := range t.commands {
+		if now.Sub(c.at) > commandResultTTL {
+			delete(t.commands, key)
+		} else if oldest == "" || c.at.Before(t.commands[oldest].at) {
+			oldest = key
+		}
+	}
+
+	key := commandKey(origin)
+	if c, seen := t.commands[key]; seen {
+		result := c.result
+		t.lock.Unlock()
+		if result == nil {
+			debugf("Command %s %s is already running", command, origin.RequestID)
+			return false
+		}
+		debugf("Command %s %s already finished, sending its result again", command, origin.RequestID)
+		eg.sendEvent("command_result", result)
+		return false
+	}
+	if len(t.commands) >= commandResultMax {
+		delete(t.commands, oldest)
+	}
+	t.commands[key] = &trackedCommand{command: command, at: now}
+	t.lock.Unlock()
+	return true
+}
+
+// finishCommand sends the result of a command received with a request_id.
+// Only its first result is sent; audit calls it for every action recorded.
+func (eg *EdgeGateway) finishCommand(origin AuditOrigin, command, cameraID string, err error) {
+	if origin.Source != auditSourceCloud || origin.RequestID == "" {
+		return
+	}
+	result := &CommandResult{
+		RequestID: origin.RequestID,
+		Command:   command,
+		CameraID:  cameraID,
+		Status:    "ok",
+	}
+	if err != nil {
+		result.Status = "error"
+		result.Code = commandCode(err)
+		result.Error = err.Error()
+		result.ErrorCode = errorCode(err)
+	}
+
+	t := &eg.commands
+	t.lock.Lock()
+	c := t.commands[commandKey(origin)]
+	if c == nil || c.result != nil || c.command != command {
+		t.lock.Unlock()
+		return
+	}
+	c.result, c.at = result, time.Now()
+	t.lock.Unlock()
+	eg.sendEvent("command_result", result)
+}
+
+// commandCode classifies why a command failed
+func commandCode(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return commandCodeInvalid
+	case errors.Is(err, errCameraNotFound):
+		return commandCodeNotFound
+	case errors.Is(err, errTenantDenied), errors.Is(err, errOperatorOnly):
+		return commandCodeForbidden
+	case errors.Is(err, errStreamDenied):
+		return commandCodeUnauthorized
+	case errors.Is(err, errCameraBusy):
+		return commandCodeBusy
+	case errors.Is(err, errOverCapacity):
+		return commandCodeOverCapacity
+	}
+	return commandCodeFailed
+}
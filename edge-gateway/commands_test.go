@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBeginCommand(t *testing.T) {
+	cloud := func(tenant, requestID string) AuditOrigin {
+		return AuditOrigin{Source: auditSourceCloud, TenantID: tenant, RequestID: requestID}
+	}
+	tests := []struct {
+		name string
+		// run returns whether the last command should run, and how many
+		// command_result were sent
+		run     func(eg *EdgeGateway) bool
+		want    bool
+		results int
+	}{
+		{
+			name: "first",
+			run: func(eg *EdgeGateway) bool {
+				return eg.beginCommand(cloud("", "req-1"), "stop_stream")
+			},
+			want: true,
+		},
+		{
+			name: "without request_id",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("", ""), "stop_stream")
+				return eg.beginCommand(cloud("", ""), "stop_stream")
+			},
+			want: true,
+		},
+		{
+			name: "retry while running",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("", "req-1"), "stop_stream")
+				return eg.beginCommand(cloud("", "req-1"), "stop_stream")
+			},
+		},
+		{
+			name: "retry once finished",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("", "req-1"), "stop_stream")
+				eg.finishCommand(cloud("", "req-1"), "stop_stream", "cam-1", nil)
+				return eg.beginCommand(cloud("", "req-1"), "stop_stream")
+			},
+			results: 2,
+		},
+		{
+			name: "finished twice",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("", "req-1"), "stop_stream")
+				eg.finishCommand(cloud("", "req-1"), "stop_stream", "cam-1", nil)
+				eg.finishCommand(cloud("", "req-1"), "stop_stream", "cam-1", nil)
+				return false
+			},
+			results: 1,
+		},
+		{
+			name: "same request_id of another tenant",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("tenant-a", "req-1"), "stop_stream")
+				return eg.beginCommand(cloud("tenant-b", "req-1"), "stop_stream")
+			},
+			want: true,
+		},
+		{
+			name: "retry after TTL",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("", "req-1"), "stop_stream")
+				eg.finishCommand(cloud("", "req-1"), "stop_stream", "cam-1", nil)
+				eg.commands.commands[commandKey(cloud("", "req-1"))].at = time.Now().Add(-commandResultTTL - time.Second)
+				return eg.beginCommand(cloud("", "req-1"), "stop_stream")
+			},
+			want:    true,
+			results: 1,
+		},
+		{
+			name: "retry within TTL",
+			run: func(eg *EdgeGateway) bool {
+				eg.beginCommand(cloud("", "req-1"), "stop_stream")
+				eg.commands.commands[commandKey(cloud("", "req-1"))].at = time.Now().Add(-commandResultTTL + time.Minute)
+				return eg.beginCommand(cloud("", "req-1"), "stop_stream")
+			},
+		},
+		{
+			name: "oldest forgotten at cap",
+			run: func(eg *EdgeGateway) bool {
+				for i := 0; i <= commandResultMax; i++ {
+					eg.beginCommand(cloud("", fmt.Sprintf("req-%d", i)), "stop_stream")
+					eg.commands.commands[commandKey(cloud("", fmt.Sprintf("req-%d", i)))].at = time.Now().Add(time.Duration(i-commandResultMax) * time.Millisecond)
+				}
+				if n := len(eg.commands.commands); n != commandResultMax {
+					return false
+				}
+				return eg.beginCommand(cloud("", "req-0"), "stop_stream")
+			},
+			want: true,
+		},
+		{
+			name: "newest kept at cap",
+			run: func(eg *EdgeGateway) bool {
+				for i := 0; i <= commandResultMax; i++ {
+					eg.beginCommand(cloud("", fmt.Sprintf("req-%d", i)), "stop_stream")
+					eg.commands.commands[commandKey(cloud("", fmt.Sprintf("req-%d", i)))].at = time.Now().Add(time.Duration(i-commandResultMax) * time.Millisecond)
+				}
+				return eg.beginCommand(cloud("", fmt.Sprintf("req-%d", commandResultMax)), "stop_stream")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eg := NewEdgeGateway(testConfig(t, nil))
+			conn := &fakeCloudConn{}
+			eg.cloudConn = conn
+			if got := tt.run(eg); got != tt.want {
+				t.Errorf("should run = %v, want %v", got, tt.want)
+			}
+			if n := conn.sentTypes()["command_result"]; n != tt.results {
+				t.Errorf("sent %d command_result, want %d", n, tt.results)
+			}
+			if n := len(eg.commands.commands); n > commandResultMax {
+				t.Errorf("tracking %d commands, over %d", n, commandResultMax)
+			}
+		})
+	}
+}
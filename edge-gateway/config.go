@@ -0,0 +1,1219 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the gateway settings read from the environment
+type Config struct {
+	// ws:// or wss:// for WebSocket, grpc:// or grpcs:// for gRPC
+	CloudURL string
+	// WebSocket message encoding: auto, json or protobuf
+	CloudEncoding string
+	LocalAPIAddr  string
+	// Bearer token the local API requires of its clients; it won't listen
+	// beyond loopback without one
+	LocalAPIToken string
+	// Certificate and key the local API is served over HTTPS with
+	LocalAPITLSCert string
+	LocalAPITLSKey  string
+	// gRPC keepalive ping interval; the server must permit it
+	CloudGRPCKeepalive time.Duration
+	// Close a WebSocket to the cloud that receives nothing, pongs
+	// included, for this long; it is pinged every half (0 disables)
+	CloudWSReadTimeout time.Duration
+	// Upper bound of the jittered reconnect backoff
+	CloudReconnectMaxInterval time.Duration
+	// Reconnect when the cloud stops answering heartbeats for this long
+	// (0 disables)
+	CloudPongTimeout time.Duration
+	// Cloud messages for different cameras handled at once; each camera's
+	// are handled in order
+	CloudMessageWorkers int
+	// Events held for the cloud while it is unreachable (0 disables)
+	OfflineQueueSize int
+	// Keep events sent to the cloud until it acknowledges them
+	OfflineQueueAcks bool
+
+	// Local RTSP re-streaming server for on-site NVR/VMS recording
+	RTSPServerAddr     string
+	RTSPServerUsername string
+	RTSPServerPassword string
+
+	// Proxy for connections to the cloud and other outbound HTTP (http://,
+	// https:// or socks5://), with basic or NTLM auth for HTTP proxies.
+	// Local addresses and NoProxy hosts, including cameras, go direct.
+	ProxyURL      string
+	ProxyAuth     string
+	ProxyUsername string
+	ProxyPassword string
+	NoProxy       []string
+
+	// Per-operation timeouts
+	CloudDialTimeout  time.Duration
+	CloudWriteTimeout time.Duration
+	RTSPDialTimeout   time.Duration
+	ShutdownTimeout   time.Duration
+	// Part of ShutdownTimeout spent closing viewers and flushing queues
+	ShutdownDrainTimeout time.Duration
+
+	// Self-update: the release signing key (nil disables update_gateway) and
+	// how long a new version has to reach the cloud before it is rolled back
+	UpdatePublicKey      ed25519.PublicKey
+	UpdateConfirmTimeout time.Duration
+	// How long a camera may take to come back after a firmware upgrade
+	FirmwareRebootTimeout time.Duration
+	// How long a camera may take to come back after a reboot or factory reset
+	CameraRebootTimeout time.Duration
+
+	// How often stream_health reports are sent (0 disables)
+	StreamHealthInterval time.Duration
+	// Reconnect a camera whose session delivers no video for this long (0
+	// disables), and suggest rebooting it after this many in a row
+	StreamStallTimeout     time.Duration
+	StreamStallRebootAfter int
+	// Cameras whose keyframes are more than KeyframeMaxInterval apart (0
+	// disables) are asked for one every KeyframeTargetInterval
+	KeyframeMaxInterval    time.Duration
+	KeyframeTargetInterval time.Duration
+	// How often webrtc_stats reports are sent (0 disables)
+	WebRTCStatsInterval time.Duration
+	// How often telemetry reports are sent (0 disables)
+	TelemetryInterval time.Duration
+	// Clock audit of the gateway and cameras every ClockCheckInterval (0
+	// disables). Cameras' NTP servers and time zone are set to the Camera
+	// ones when ClockSyncCameras is set.
+	ClockCheckInterval    time.Duration
+	ClockNTPServer        string
+	ClockMaxDrift         time.Duration
+	ClockSyncCameras      bool
+	ClockCameraNTPServers []string
+	ClockCameraTimeZone   string
+	// How often cameras are reconciled with their encoder profiles (0
+	// disables; profiles are still applied when set)
+	EncoderCheckInterval time.Duration
+	// How often cameras' digital inputs are read for io_input (0 disables)
+	IOPollInterval time.Duration
+	// How often interface addresses are checked for changes (0 disables)
+	NetworkWatchInterval time.Duration
+	// Close viewers that send no RTCP for this long (0 disables)
+	ViewerIdleTimeout time.Duration
+	// Open main streams for offers without start_stream, and stop streams
+	// opened by viewers this long after the last one leaves
+	OnDemandStreams   bool
+	StreamIdleTimeout time.Duration
+	// How long a PTZ lock lasts without commands, unless the lock asks
+	PTZLockTimeout time.Duration
+	// Stop a continuous PTZ move not repeated within this long (0 disables)
+	PTZWatchdogTimeout time.Duration
+	// Re-profile cameras when a viewer's bandwidth drops
+	AdaptiveBitrate bool
+	// Estimate each viewer's bandwidth from TWCC feedback and pace its
+	// video at the estimate, starting at and capped at kbit/s, queueing
+	// packets at most PacerMaxDelay
+	CongestionControl bool
+	BWEStartKbps      int
+	BWEMaxKbps        int
+	PacerMaxDelay     time.Duration
+	// Most of a stream's last GOP kept for new consumers, in KiB (0 disables)
+	PrebufferMaxKB int
+	// Uplink budgets in kbps for video sent off site, in total and per
+	// camera with overrides by camera ID, and the most viewers and relays
+	// at once (0 = unlimited)
+	UplinkBudgetKbps       int
+	CameraUplinkBudgetKbps int
+	CameraUplinkBudgets    map[string]int
+	MaxOutboundStreams     int
+	// Resource limits for small boxes (0 = unlimited): camera streams and
+	// viewer peer connections at once, goroutines and the soft memory
+	// limit in MiB past which new streams and peer connections are
+	// refused, and the frames waiting for a stream's WebRTC track in KiB
+	MaxStreams         int
+	MaxPeerConnections int
+	MaxGoroutines      int
+	MemoryLimitMB      int
+	StreamQueueMaxKB   int
+	// Refuse viewers of cameras without an end-to-end encryption key
+	E2EERequired bool
+	// Require webrtc_offer and added cameras to carry a stream token signed
+	// by one of the keys, whenever STREAM_TOKEN_PUBLIC_KEY is set
+	StreamTokenRequired bool
+	StreamTokenKeys     []ed25519.PublicKey
+
+	// WebRTC ports and addresses: an ephemeral UDP port range (0 = any),
+	// public IPs for a 1:1 NAT advertised as host or srflx candidates, and
+	// single-port ICE UDP and TCP listeners (0 = off)
+	WebRTCUDPPortMin           int
+	WebRTCUDPPortMax           int
+	WebRTCNAT1To1IPs           []string
+	WebRTCNAT1To1CandidateType string
+	WebRTCUDPMuxPort           int
+	WebRTCTCPMuxPort           int
+
+	// Transcoding with ffmpeg; listed cameras are always transcoded, others
+	// only for missing sub-streams and unsupported codecs
+	TranscodeEnabled     bool
+	TranscodeCameras     []string
+	TranscodeHWAccel     string
+	TranscodeDevice      string
+	TranscodeBitrate     int // kbps at full resolution
+	TranscodeTimestamp   bool
+	TranscodeMaxSessions int
+	// VP9 and AV1, in order of preference, encoded for viewers whose offer
+	// can receive them
+	TranscodeCodecs []string
+	// Cameras whose viewers can switch between full, half and quarter
+	// resolution layers, the smaller ones from the transcoder
+	SimulcastCameras []string
+	// Crop and scale fixed cameras' video for PTZ commands, through the
+	// transcoder
+	DigitalPTZ        bool
+	DigitalPTZMaxZoom float64
+	FFmpegPath        string
+	// Default on-screen display burned into transcoded video; cameras can
+	// have their own through set_config
+	Overlay OverlayConfig
+	// Video devices of the gateway itself streamed as cameras, encoded with
+	// a TRANSCODE_HWACCEL encoder, or copied if the device encodes H.264
+	LocalCameras           []string
+	LocalCameraEncoder     string
+	LocalCameraInputFormat string
+	LocalCameraResolution  string
+	LocalCameraFPS         int
+	LocalCameraBitrate     int // kbps
+
+	// HLS packaging; an empty camera list means all cameras
+	HLSEnabled          bool
+	HLSCameras          []string
+	HLSSegmentDuration  time.Duration
+	HLSPlaylistSegments int
+	HLSGCSBucket        string
+	HLSGCSPrefix        string
+
+	// Event clips: cameras' motion and analytics events whose topics start
+	// with one of EventClipTopics record a clip, with pre and post roll,
+	// uploaded to EventClipGCSBucket. An empty camera list means all cameras.
+	EventClipsEnabled    bool
+	EventClipCameras     []string
+	EventClipTopics      []string
+	EventClipPreRoll     time.Duration
+	EventClipPostRoll    time.Duration
+	EventClipMaxDuration time.Duration
+	EventClipGCSBucket   string
+	EventClipGCSPrefix   string
+
+	// Forward cameras' audio detections (trigger level, classified sounds)
+	// as audio_event; an empty camera list means all cameras
+	AudioEvents       bool
+	AudioEventCameras []string
+
+	// Forward cameras' analytics metadata (object detections) to viewers
+	// and as events; an empty camera list means all cameras
+	AnalyticsMetadata bool
+	AnalyticsCameras  []string
+
+	// On-gateway inference: frames of each camera's main stream, sampled at
+	// InferenceFPS, go to the InferenceRunner at InferenceEndpoint. An
+	// empty camera list means all cameras.
+	InferenceRunner   string
+	InferenceEndpoint string
+	InferenceCameras  []string
+	InferenceFPS      float64
+	InferenceWidth    int
+	InferenceMinScore float64
+	InferenceTimeout  time.Duration
+
+	// OpenTelemetry tracing of viewer setup, exported to Cloud Trace
+	TracingEnabled   bool
+	TraceProjectID   string
+	TraceSampleRatio float64
+
+	// MQTT bridge for home-automation/SCADA; an empty broker URL disables it
+	MQTTBrokerURL   string
+	MQTTClientID    string
+	MQTTUsername    string
+	MQTTPassword    string
+	MQTTTopicPrefix string
+
+	// debug, info, warn or error; debug adds a line per cloud message
+	LogLevel string
+
+	// Gateways on one LAN with the same ClusterName split its cameras and
+	// hand sessions off when one drains; ClusterElection is mdns or cloud
+	ClusterEnabled  bool
+	ClusterName     string
+	ClusterElection string
+
+	// An active/standby pair: HARole is active or standby, HAPeerURL the
+	// other gateway's local API over HTTPS, verified against HAPeerCAFile if
+	// set, and HASecret guards the state the standby mirrors. The standby
+	// takes over after HAFailoverTimeout without a healthy active.
+	HARole            string
+	HAPeerURL         string
+	HAPeerCAFile      string
+	HASecret          string
+	HAFailoverTimeout time.Duration
+
+	// Audit log of control actions, rotated at AuditLogMaxMB and optionally
+	// shipped to Cloud Logging
+	AuditLogMaxMB     int
+	AuditLogFiles     int
+	AuditCloudLogging bool
+	AuditProjectID    string
+
+	// Directory for persisted gateway state
+	DataDir string
+
+	// Simulated cameras for development and CI, playing SimulateSource (an
+	// MP4 or raw H.264 file) or a generated test pattern
+	SimulateCameras int
+	SimulateSource  string
+	SimulateFPS     int
+
+	// Vendor RTSP path templates, in probe order, and the vendors of MAC
+	// address prefixes, whose own template is probed first
+	RTSPProfiles []RTSPProfile
+	VendorOUIs   map[string]string
+
+	// Network scanner settings
+	ScanWorkers    int
+	ScanInterval   time.Duration
+	ScanAllowCIDRs []*net.IPNet
+	ScanDenyCIDRs  []*net.IPNet
+	// Discovery policy: which discovered devices become cameras, whether
+	// they wait for approval, and addresses never probed
+	CameraAllowOUIs   []string
+	CameraDenyOUIs    []string
+	CameraAllowModels []string
+	CameraDenyModels  []string
+	CameraApproval    bool
+	IgnoredIPs        []net.IP
+	// Set a generated root password on factory-new Axis cameras
+	AxisInitialize bool
+	// Least time between two camera_status of a camera, and how long
+	// statuses raised together are collected into one camera_inventory
+	// (0 disables either)
+	CameraStatusInterval time.Duration
+	CameraInventoryDelay time.Duration
+	// How often changes since the last inventory_snapshot or
+	// inventory_delta are looked for (0 disables deltas)
+	InventoryDeltaInterval time.Duration
+	// Extra subnets to scan, e.g. routed camera VLANs
+	ScanSubnets []*net.IPNet
+	// Cameras registered in these subnets belong to their tenant
+	TenantSubnets []tenantSubnet
+	// Interface networks larger than this prefix are narrowed to it
+	ScanInterfacePrefix int
+	// Maximum probes started per second (0 = unlimited)
+	ScanRate int
+	// mDNS service types browsed for cameras, and whether mDNS discovery
+	// runs at all, for networks where multicast is prohibited
+	MDNSEnabled  bool
+	MDNSServices []string
+
+	// Camera HTTP (VAPIX) client settings
+	CameraHTTPTimeout          time.Duration
+	CameraHTTPMaxConcurrent    int
+	CameraHTTPBreakerThreshold int
+	CameraHTTPBreakerCooldown  time.Duration
+
+	// Defaults for cameras without their own HTTPS and TLS settings
+	CameraHTTPS         bool
+	CameraTLSCAFile     string
+	CameraTLSSkipVerify bool
+
+	// Camera quarantine settings
+	QuarantineFailureThreshold int
+	QuarantineFailureWindow    time.Duration
+	QuarantineEventRate        int
+	QuarantineCooldown         time.Duration
+	QuarantineMaxCooldown      time.Duration
+	QuarantineProbation        time.Duration
+}
+
+// loadConfig reads the gateway configuration from environment variables
+func loadConfig() *Config {
+	// The environment takes precedence over KEY_FILE variables, those over
+	// CONFIG_DIR, and that over CONFIG_FILE
+	fileEnvLock.Lock()
+	loaded := make(map[string]string)
+	loadEnvFiles(loaded)
+	if dir := getEnv("CONFIG_DIR", ""); dir != "" {
+		loadConfigDir(dir, loaded)
+	}
+	if path := getEnv("CONFIG_FILE", ""); path != "" {
+		loadConfigFile(path, loaded)
+	}
+	applyFileEnv(loaded)
+	fileEnvLock.Unlock()
+
+	cfg := &Config{
+		CloudURL:                   getEnv("CLOUD_ORCHESTRATOR_URL", "wss://orchestrator.example.com/gateway"),
+		CloudEncoding:              getEnv("CLOUD_ENCODING", cloudEncodingAuto),
+		LocalAPIAddr:               getEnv("LOCAL_API_ADDR", "127.0.0.1:8080"),
+		LocalAPIToken:              getEnv("LOCAL_API_TOKEN", ""),
+		LocalAPITLSCert:            getEnv("LOCAL_API_TLS_CERT", ""),
+		LocalAPITLSKey:             getEnv("LOCAL_API_TLS_KEY", ""),
+		RTSPServerAddr:             getEnv("RTSP_SERVER_ADDR", ":8554"),
+		RTSPServerUsername:         getEnv("RTSP_SERVER_USERNAME", ""),
+		RTSPServerPassword:         getEnv("RTSP_SERVER_PASSWORD", ""),
+		ProxyURL:                   getEnv("PROXY_URL", firstEnv("HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy")),
+		ProxyAuth:                  getEnv("PROXY_AUTH", proxyAuthBasic),
+		ProxyUsername:              getEnv("PROXY_USERNAME", ""),
+		ProxyPassword:              getEnv("PROXY_PASSWORD", ""),
+		NoProxy:                    getEnvList(firstEnvName("NO_PROXY", "no_proxy")),
+		CloudDialTimeout:           getEnvDuration("CLOUD_DIAL_TIMEOUT", 30*time.Second),
+		CloudWriteTimeout:          getEnvDuration("CLOUD_WRITE_TIMEOUT", 10*time.Second),
+		CloudWSReadTimeout:         getEnvDuration("CLOUD_WS_READ_TIMEOUT", time.Minute),
+		CloudGRPCKeepalive:         getEnvDuration("CLOUD_GRPC_KEEPALIVE", time.Minute),
+		CloudReconnectMaxInterval:  getEnvDuration("CLOUD_RECONNECT_MAX_INTERVAL", time.Minute),
+		CloudPongTimeout:           getEnvDuration("CLOUD_PONG_TIMEOUT", 90*time.Second),
+		CloudMessageWorkers:        getEnvInt("CLOUD_MESSAGE_WORKERS", 8),
+		OfflineQueueSize:           getEnvInt("OFFLINE_QUEUE_SIZE", 1000),
+		OfflineQueueAcks:           getEnvBool("OFFLINE_QUEUE_ACKS", false),
+		RTSPDialTimeout:            getEnvDuration("RTSP_DIAL_TIMEOUT", 10*time.Second),
+		ShutdownTimeout:            getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		ShutdownDrainTimeout:       getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 5*time.Second),
+		UpdateConfirmTimeout:       getEnvDuration("UPDATE_CONFIRM_TIMEOUT", 2*time.Minute),
+		FirmwareRebootTimeout:      getEnvDuration("FIRMWARE_REBOOT_TIMEOUT", 10*time.Minute),
+		CameraRebootTimeout:        getEnvDuration("CAMERA_REBOOT_TIMEOUT", 5*time.Minute),
+		StreamHealthInterval:       getEnvDuration("STREAM_HEALTH_INTERVAL", 10*time.Second),
+		StreamStallTimeout:         getEnvDuration("STREAM_STALL_TIMEOUT", 20*time.Second),
+		StreamStallRebootAfter:     getEnvInt("STREAM_STALL_REBOOT_AFTER", 3),
+		KeyframeMaxInterval:        getEnvDuration("KEYFRAME_MAX_INTERVAL", 4*time.Second),
+		KeyframeTargetInterval:     getEnvDuration("KEYFRAME_TARGET_INTERVAL", time.Second),
+		WebRTCStatsInterval:        getEnvDuration("WEBRTC_STATS_INTERVAL", 10*time.Second),
+		TelemetryInterval:          getEnvDuration("TELEMETRY_INTERVAL", 30*time.Second),
+		ClockCheckInterval:         getEnvDuration("CLOCK_CHECK_INTERVAL", time.Hour),
+		EncoderCheckInterval:       getEnvDuration("ENCODER_CHECK_INTERVAL", 15*time.Minute),
+		ClockNTPServer:             getEnv("CLOCK_NTP_SERVER", ""),
+		ClockMaxDrift:              getEnvDuration("CLOCK_MAX_DRIFT", 2*time.Second),
+		ClockSyncCameras:           getEnvBool("CLOCK_SYNC_CAMERAS", false),
+		ClockCameraNTPServers:      getEnvList("CLOCK_CAMERA_NTP_SERVERS"),
+		ClockCameraTimeZone:        getEnv("CLOCK_CAMERA_TIMEZONE", ""),
+		IOPollInterval:             getEnvDuration("IO_POLL_INTERVAL", time.Second),
+		NetworkWatchInterval:       getEnvDuration("NETWORK_WATCH_INTERVAL", 5*time.Second),
+		ViewerIdleTimeout:          getEnvDuration("VIEWER_IDLE_TIMEOUT", 30*time.Second),
+		OnDemandStreams:            getEnvBool("ON_DEMAND_STREAMS", true),
+		StreamIdleTimeout:          getEnvDuration("STREAM_IDLE_TIMEOUT", 30*time.Second),
+		PTZLockTimeout:             getEnvDuration("PTZ_LOCK_TIMEOUT", 30*time.Second),
+		PTZWatchdogTimeout:         getEnvDuration("PTZ_WATCHDOG_TIMEOUT", 5*time.Second),
+		WebRTCUDPPortMin:           getEnvInt("WEBRTC_UDP_PORT_MIN", 0),
+		WebRTCUDPPortMax:           getEnvInt("WEBRTC_UDP_PORT_MAX", 0),
+		WebRTCNAT1To1IPs:           getEnvList("WEBRTC_NAT1TO1_IPS"),
+		WebRTCNAT1To1CandidateType: getEnv("WEBRTC_NAT1TO1_CANDIDATE_TYPE", "host"),
+		WebRTCUDPMuxPort:           getEnvInt("WEBRTC_UDP_MUX_PORT", 0),
+		WebRTCTCPMuxPort:           getEnvInt("WEBRTC_TCP_MUX_PORT", 0),
+		AdaptiveBitrate:            getEnvBool("ADAPTIVE_BITRATE", true),
+		CongestionControl:          getEnvBool("CONGESTION_CONTROL", false),
+		BWEStartKbps:               getEnvInt("BWE_START_KBPS", 2500),
+		BWEMaxKbps:                 getEnvInt("BWE_MAX_KBPS", 20000),
+		PacerMaxDelay:              getEnvDuration("PACER_MAX_DELAY", 250*time.Millisecond),
+		PrebufferMaxKB:             getEnvInt("PREBUFFER_MAX_KB", 4096),
+		UplinkBudgetKbps:           getEnvInt("UPLINK_BUDGET_KBPS", 0),
+		CameraUplinkBudgetKbps:     getEnvInt("CAMERA_UPLINK_BUDGET_KBPS", 0),
+		CameraUplinkBudgets:        getEnvBudgets("CAMERA_UPLINK_BUDGETS"),
+		MaxOutboundStreams:         getEnvInt("MAX_OUTBOUND_STREAMS", 0),
+		MaxStreams:                 getEnvInt("MAX_STREAMS", 0),
+		MaxPeerConnections:         getEnvInt("MAX_PEER_CONNECTIONS", 0),
+		MaxGoroutines:              getEnvInt("MAX_GOROUTINES", 0),
+		MemoryLimitMB:              getEnvInt("MEMORY_LIMIT_MB", 0),
+		StreamQueueMaxKB:           getEnvInt("STREAM_QUEUE_MAX_KB", 8192),
+		E2EERequired:               getEnvBool("E2EE_REQUIRED", false),
+		MQTTBrokerURL:              getEnv("MQTT_BROKER_URL", ""),
+		MQTTClientID:               getEnv("MQTT_CLIENT_ID", ""),
+		MQTTUsername:               getEnv("MQTT_USERNAME", ""),
+		MQTTPassword:               getEnv("MQTT_PASSWORD", ""),
+		MQTTTopicPrefix:            getEnv("MQTT_TOPIC_PREFIX", ""),
+		TranscodeEnabled:           getEnvBool("TRANSCODE_ENABLED", false),
+		TranscodeCameras:           getEnvList("TRANSCODE_CAMERAS"),
+		TranscodeHWAccel:           getEnv("TRANSCODE_HWACCEL", hwaccelNone),
+		TranscodeDevice:            getEnv("TRANSCODE_DEVICE", "/dev/dri/renderD128"),
+		TranscodeBitrate:           getEnvInt("TRANSCODE_BITRATE", 2500),
+		TranscodeTimestamp:         getEnvBool("TRANSCODE_TIMESTAMP", false),
+		TranscodeMaxSessions:       getEnvInt("TRANSCODE_MAX_SESSIONS", 2),
+		TranscodeCodecs:            getEnvList("TRANSCODE_CODECS"),
+		SimulcastCameras:           getEnvList("SIMULCAST_CAMERAS"),
+		DigitalPTZ:                 getEnvBool("DIGITAL_PTZ", false),
+		DigitalPTZMaxZoom:          getEnvFloat("DIGITAL_PTZ_MAX_ZOOM", 4),
+		FFmpegPath:                 getEnv("FFMPEG_PATH", "ffmpeg"),
+		LocalCameras:               getEnvList("LOCAL_CAMERAS"),
+		LocalCameraEncoder:         getEnv("LOCAL_CAMERA_ENCODER", hwaccelNone),
+		LocalCameraInputFormat:     getEnv("LOCAL_CAMERA_INPUT_FORMAT", ""),
+		LocalCameraResolution:      getEnv("LOCAL_CAMERA_RESOLUTION", ""),
+		LocalCameraFPS:             getEnvInt("LOCAL_CAMERA_FPS", 15),
+		LocalCameraBitrate:         getEnvInt("LOCAL_CAMERA_BITRATE", 2000),
+		Overlay: OverlayConfig{
+			Enabled:    getEnvBool("OVERLAY_ENABLED", false),
+			Position:   getEnv("OVERLAY_POSITION", overlayTopLeft),
+			TimeFormat: getEnv("OVERLAY_TIME_FORMAT", defaultOverlayTimeFormat),
+			UTC:        getEnvBool("OVERLAY_UTC", false),
+			CameraName: getEnvBool("OVERLAY_CAMERA_NAME", true),
+			GatewayID:  getEnvBool("OVERLAY_GATEWAY_ID", false),
+			FontSize:   getEnvInt("OVERLAY_FONT_SIZE", 24),
+		},
+		HLSEnabled:                 getEnvBool("HLS_ENABLED", false),
+		HLSCameras:                 getEnvList("HLS_CAMERAS"),
+		HLSSegmentDuration:         getEnvDuration("HLS_SEGMENT_DURATION", 2*time.Second),
+		HLSPlaylistSegments:        getEnvInt("HLS_PLAYLIST_SEGMENTS", 6),
+		HLSGCSBucket:               getEnv("HLS_GCS_BUCKET", ""),
+		HLSGCSPrefix:               getEnv("HLS_GCS_PREFIX", "hls"),
+		EventClipsEnabled:          getEnvBool("EVENT_CLIPS_ENABLED", false),
+		EventClipCameras:           getEnvList("EVENT_CLIP_CAMERAS"),
+		EventClipTopics:            getEnvList("EVENT_CLIP_TOPICS"),
+		EventClipPreRoll:           getEnvDuration("EVENT_CLIP_PRE_ROLL", 5*time.Second),
+		EventClipPostRoll:          getEnvDuration("EVENT_CLIP_POST_ROLL", 10*time.Second),
+		EventClipMaxDuration:       getEnvDuration("EVENT_CLIP_MAX_DURATION", 2*time.Minute),
+		EventClipGCSBucket:         getEnv("EVENT_CLIP_GCS_BUCKET", ""),
+		EventClipGCSPrefix:         getEnv("EVENT_CLIP_GCS_PREFIX", "clips"),
+		AudioEvents:                getEnvBool("AUDIO_EVENTS", false),
+		AudioEventCameras:          getEnvList("AUDIO_EVENT_CAMERAS"),
+		AnalyticsMetadata:          getEnvBool("ANALYTICS_METADATA", false),
+		AnalyticsCameras:           getEnvList("ANALYTICS_CAMERAS"),
+		InferenceRunner:            getEnv("INFERENCE_RUNNER", inferenceRunnerNone),
+		InferenceEndpoint:          getEnv("INFERENCE_ENDPOINT", ""),
+		InferenceCameras:           getEnvList("INFERENCE_CAMERAS"),
+		InferenceFPS:               getEnvFloat("INFERENCE_FPS", 1),
+		InferenceWidth:             getEnvInt("INFERENCE_WIDTH", 640),
+		InferenceMinScore:          getEnvFloat("INFERENCE_MIN_SCORE", 0.5),
+		InferenceTimeout:           getEnvDuration("INFERENCE_TIMEOUT", 5*time.Second),
+		TracingEnabled:             getEnvBool("TRACING_ENABLED", false),
+		TraceProjectID:             getEnv("TRACE_PROJECT_ID", os.Getenv("GOOGLE_CLOUD_PROJECT")),
+		TraceSampleRatio:           getEnvFloat("TRACE_SAMPLE_RATIO", 1.0),
+		LogLevel:                   getEnv("LOG_LEVEL", "info"),
+		ClusterEnabled:             getEnvBool("CLUSTER_ENABLED", false),
+		ClusterName:                getEnv("CLUSTER_NAME", "default"),
+		ClusterElection:            getEnv("CLUSTER_ELECTION", clusterElectionMDNS),
+		HARole:                     getEnv("HA_ROLE", ""),
+		HAPeerURL:                  strings.TrimSuffix(getEnv("HA_PEER_URL", ""), "/"),
+		HAPeerCAFile:               getEnv("HA_PEER_CA_FILE", ""),
+		HASecret:                   getEnv("HA_SECRET", ""),
+		HAFailoverTimeout:          getEnvDuration("HA_FAILOVER_TIMEOUT", 6*time.Second),
+		AuditLogMaxMB:              getEnvInt("AUDIT_LOG_MAX_MB", 10),
+		AuditLogFiles:              getEnvInt("AUDIT_LOG_FILES", 5),
+		AuditCloudLogging:          getEnvBool("AUDIT_CLOUD_LOGGING", false),
+		AuditProjectID:             getEnv("AUDIT_PROJECT_ID", os.Getenv("GOOGLE_CLOUD_PROJECT")),
+		DataDir:                    getEnv("DATA_DIR", "data"),
+		SimulateCameras:            getEnvInt("SIMULATE_CAMERAS", 0),
+		SimulateSource:             getEnv("SIMULATE_SOURCE", ""),
+		SimulateFPS:                getEnvInt("SIMULATE_FPS", 10),
+		RTSPProfiles:               parseRTSPProfiles(getEnv("RTSP_PATH_PROFILES", "")),
+		VendorOUIs:                 parseVendorOUIs(getEnv("CAMERA_VENDOR_OUIS", "")),
+		ScanWorkers:                getEnvInt("SCAN_WORKERS", 16),
+		ScanInterval:               getEnvDuration("SCAN_INTERVAL", time.Hour),
+		ScanAllowCIDRs:             getEnvCIDRs("SCAN_ALLOW_CIDRS"),
+		ScanDenyCIDRs:              getEnvCIDRs("SCAN_DENY_CIDRS"),
+		CameraAllowOUIs:            getEnvOUIs("CAMERA_ALLOW_OUIS"),
+		CameraDenyOUIs:             getEnvOUIs("CAMERA_DENY_OUIS"),
+		CameraAllowModels:          getEnvList("CAMERA_ALLOW_MODELS"),
+		CameraDenyModels:           getEnvList("CAMERA_DENY_MODELS"),
+		CameraApproval:             getEnvBool("CAMERA_APPROVAL_REQUIRED", false),
+		IgnoredIPs:                 getEnvIPs("CAMERA_IGNORE_IPS"),
+		AxisInitialize:             getEnvBool("AXIS_INITIALIZE_CAMERAS", false),
+		CameraStatusInterval:       getEnvDuration("CAMERA_STATUS_INTERVAL", 5*time.Second),
+		CameraInventoryDelay:       getEnvDuration("CAMERA_INVENTORY_DELAY", 2*time.Second),
+		InventoryDeltaInterval:     getEnvDuration("INVENTORY_DELTA_INTERVAL", 5*time.Second),
+		ScanSubnets:                getEnvCIDRs("SCAN_SUBNETS"),
+		TenantSubnets:              getEnvTenantSubnets("TENANT_SUBNETS"),
+		ScanInterfacePrefix:        getEnvInt("SCAN_INTERFACE_PREFIX", 24),
+		ScanRate:                   getEnvInt("SCAN_RATE", 100),
+		MDNSEnabled:                getEnvBool("MDNS_ENABLED", true),
+		MDNSServices:               getEnvMDNSServices("MDNS_SERVICES"),
+		CameraHTTPTimeout:          getEnvDuration("CAMERA_HTTP_TIMEOUT", 5*time.Second),
+		CameraHTTPMaxConcurrent:    getEnvInt("CAMERA_HTTP_MAX_CONCURRENT", 4),
+		CameraHTTPBreakerThreshold: getEnvInt("CAMERA_HTTP_BREAKER_THRESHOLD", 5),
+		CameraHTTPBreakerCooldown:  getEnvDuration("CAMERA_HTTP_BREAKER_COOLDOWN", 30*time.Second),
+		CameraHTTPS:                getEnvBool("CAMERA_HTTPS", false),
+		CameraTLSCAFile:            getEnv("CAMERA_TLS_CA_FILE", ""),
+		CameraTLSSkipVerify:        getEnvBool("CAMERA_TLS_SKIP_VERIFY", false),
+		QuarantineFailureThreshold: getEnvInt("QUARANTINE_FAILURE_THRESHOLD", 5),
+		QuarantineFailureWindow:    getEnvDuration("QUARANTINE_FAILURE_WINDOW", 5*time.Minute),
+		QuarantineEventRate:        getEnvInt("QUARANTINE_EVENT_RATE", 120),
+		QuarantineCooldown:         getEnvDuration("QUARANTINE_COOLDOWN", 10*time.Minute),
+		QuarantineMaxCooldown:      getEnvDuration("QUARANTINE_MAX_COOLDOWN", time.Hour),
+		QuarantineProbation:        getEnvDuration("QUARANTINE_PROBATION", 2*time.Minute),
+	}
+
+	// Default to WebSocket when no transport scheme is given
+	if !strings.Contains(cfg.CloudURL, "://") {
+		cfg.CloudURL = "wss://" + cfg.CloudURL
+	}
+
+	switch cfg.CloudEncoding {
+	case cloudEncodingAuto, cloudEncodingJSON, cloudEncodingProtobuf:
+	default:
+		log.Printf("Invalid value for CLOUD_ENCODING (%q), using default %s", cfg.CloudEncoding, cloudEncodingAuto)
+		cfg.CloudEncoding = cloudEncodingAuto
+	}
+
+	if cfg.PTZLockTimeout <= 0 {
+		log.Printf("Invalid value for PTZ_LOCK_TIMEOUT (%s), using default 30s", cfg.PTZLockTimeout)
+		cfg.PTZLockTimeout = 30 * time.Second
+	}
+
+	switch cfg.TranscodeHWAccel {
+	case hwaccelNone, hwaccelVAAPI, hwaccelNVENC, hwaccelV4L2M2M:
+	default:
+		log.Printf("Invalid value for TRANSCODE_HWACCEL (%q), using default %s", cfg.TranscodeHWAccel, hwaccelNone)
+		cfg.TranscodeHWAccel = hwaccelNone
+	}
+	if cfg.StreamIdleTimeout < 0 {
+		log.Printf("Invalid value for STREAM_IDLE_TIMEOUT (%s), using default 30s", cfg.StreamIdleTimeout)
+		cfg.StreamIdleTimeout = 30 * time.Second
+	}
+	if cfg.PrebufferMaxKB < 0 {
+		log.Printf("Invalid value for PREBUFFER_MAX_KB (%d), using default 4096", cfg.PrebufferMaxKB)
+		cfg.PrebufferMaxKB = 4096
+	}
+	if cfg.StreamStallTimeout < 0 {
+		log.Printf("Invalid value for STREAM_STALL_TIMEOUT (%s), using default 20s", cfg.StreamStallTimeout)
+		cfg.StreamStallTimeout = 20 * time.Second
+	}
+	if cfg.StreamStallRebootAfter < 1 {
+		log.Printf("Invalid value for STREAM_STALL_REBOOT_AFTER (%d), using default 3", cfg.StreamStallRebootAfter)
+		cfg.StreamStallRebootAfter = 3
+	}
+	if cfg.KeyframeTargetInterval <= 0 || cfg.KeyframeMaxInterval > 0 && cfg.KeyframeTargetInterval >= cfg.KeyframeMaxInterval {
+		log.Printf("Invalid value for KEYFRAME_TARGET_INTERVAL (%v), using default 1s", cfg.KeyframeTargetInterval)
+		cfg.KeyframeTargetInterval = time.Second
+	}
+	if cfg.CloudWSReadTimeout < 0 {
+		log.Printf("Invalid value for CLOUD_WS_READ_TIMEOUT (%v), using default 1m", cfg.CloudWSReadTimeout)
+		cfg.CloudWSReadTimeout = time.Minute
+	}
+	if cfg.CloudPongTimeout != 0 && cfg.CloudPongTimeout < cloudHeartbeatInterval {
+		log.Printf("Invalid value for CLOUD_PONG_TIMEOUT (%v), using default 1m30s", cfg.CloudPongTimeout)
+		cfg.CloudPongTimeout = 90 * time.Second
+	}
+	if cfg.CloudMessageWorkers < 1 {
+		log.Printf("Invalid value for CLOUD_MESSAGE_WORKERS (%d), using default 8", cfg.CloudMessageWorkers)
+		cfg.CloudMessageWorkers = 8
+	}
+	if cfg.CameraStatusInterval < 0 {
+		log.Printf("Invalid value for CAMERA_STATUS_INTERVAL (%v), using default 5s", cfg.CameraStatusInterval)
+		cfg.CameraStatusInterval = 5 * time.Second
+	}
+	if cfg.CameraInventoryDelay < 0 {
+		log.Printf("Invalid value for CAMERA_INVENTORY_DELAY (%v), using default 2s", cfg.CameraInventoryDelay)
+		cfg.CameraInventoryDelay = 2 * time.Second
+	}
+	if cfg.InventoryDeltaInterval < 0 {
+		log.Printf("Invalid value for INVENTORY_DELTA_INTERVAL (%v), using default 5s", cfg.InventoryDeltaInterval)
+		cfg.InventoryDeltaInterval = 5 * time.Second
+	}
+	if cfg.StreamQueueMaxKB < 0 {
+		log.Printf("Invalid value for STREAM_QUEUE_MAX_KB (%d), using default 8192", cfg.StreamQueueMaxKB)
+		cfg.StreamQueueMaxKB = 8192
+	}
+	if cfg.BWEStartKbps < bweMinBitrate/1000 {
+		log.Printf("Invalid value for BWE_START_KBPS (%d), using default 2500", cfg.BWEStartKbps)
+		cfg.BWEStartKbps = 2500
+	}
+	if cfg.BWEMaxKbps < cfg.BWEStartKbps {
+		log.Printf("Invalid value for BWE_MAX_KBPS (%d), using default 20000", cfg.BWEMaxKbps)
+		cfg.BWEMaxKbps = max(20000, cfg.BWEStartKbps)
+	}
+	if cfg.PacerMaxDelay <= 0 {
+		log.Printf("Invalid value for PACER_MAX_DELAY (%s), using default 250ms", cfg.PacerMaxDelay)
+		cfg.PacerMaxDelay = 250 * time.Millisecond
+	}
+	if cfg.AuditLogMaxMB < 1 {
+		log.Printf("Invalid value for AUDIT_LOG_MAX_MB (%d), using default 10", cfg.AuditLogMaxMB)
+		cfg.AuditLogMaxMB = 10
+	}
+	if cfg.AuditLogFiles < 0 {
+		log.Printf("Invalid value for AUDIT_LOG_FILES (%d), using default 5", cfg.AuditLogFiles)
+		cfg.AuditLogFiles = 5
+	}
+	if len(cfg.EventClipTopics) == 0 {
+		cfg.EventClipTopics = defaultEventClipTopics
+	}
+	if cfg.EventClipPreRoll < 0 {
+		log.Printf("Invalid value for EVENT_CLIP_PRE_ROLL (%s), using default 5s", cfg.EventClipPreRoll)
+		cfg.EventClipPreRoll = 5 * time.Second
+	}
+	if cfg.EventClipPostRoll < 0 {
+		log.Printf("Invalid value for EVENT_CLIP_POST_ROLL (%s), using default 10s", cfg.EventClipPostRoll)
+		cfg.EventClipPostRoll = 10 * time.Second
+	}
+	if cfg.EventClipMaxDuration <= 0 {
+		log.Printf("Invalid value for EVENT_CLIP_MAX_DURATION (%s), using default 2m", cfg.EventClipMaxDuration)
+		cfg.EventClipMaxDuration = 2 * time.Minute
+	}
+	if cfg.EventClipsEnabled && cfg.EventClipGCSBucket == "" {
+		log.Printf("EVENT_CLIPS_ENABLED needs EVENT_CLIP_GCS_BUCKET, event clips are off")
+		cfg.EventClipsEnabled = false
+	}
+	if cfg.ClusterElection != clusterElectionMDNS && cfg.ClusterElection != clusterElectionCloud {
+		log.Printf("Invalid value for CLUSTER_ELECTION (%q), using default %s", cfg.ClusterElection, clusterElectionMDNS)
+		cfg.ClusterElection = clusterElectionMDNS
+	}
+	switch cfg.HARole {
+	case "", haRoleActive, haRoleStandby:
+	default:
+		log.Printf("Invalid value for HA_ROLE (%q), high availability is off", cfg.HARole)
+		cfg.HARole = ""
+	}
+	if cfg.HARole != "" && (cfg.HAPeerURL == "" || cfg.HASecret == "") {
+		log.Printf("HA_ROLE needs HA_PEER_URL and HA_SECRET, high availability is off")
+		cfg.HARole = ""
+	}
+	// The standby mirrors camera credentials and E2EE keys
+	if cfg.HARole != "" && !strings.HasPrefix(cfg.HAPeerURL, "https://") {
+		log.Printf("HA_PEER_URL must be https://, the pair's state holds camera credentials; high availability is off")
+		cfg.HARole = ""
+	}
+	if (cfg.LocalAPITLSCert == "") != (cfg.LocalAPITLSKey == "") {
+		log.Printf("LOCAL_API_TLS_CERT and LOCAL_API_TLS_KEY must be set together, serving the local API over HTTP")
+		cfg.LocalAPITLSCert, cfg.LocalAPITLSKey = "", ""
+	}
+	if cfg.HAFailoverTimeout < 2*haHeartbeatInterval {
+		log.Printf("Invalid value for HA_FAILOVER_TIMEOUT (%s), using default 6s", cfg.HAFailoverTimeout)
+		cfg.HAFailoverTimeout = 6 * time.Second
+	}
+	switch cfg.InferenceRunner {
+	case inferenceRunnerNone, inferenceRunnerHTTP, inferenceRunnerGRPC, inferenceRunnerExec:
+	default:
+		log.Printf("Invalid value for INFERENCE_RUNNER (%q), inference is off", cfg.InferenceRunner)
+		cfg.InferenceRunner = inferenceRunnerNone
+	}
+	if cfg.InferenceRunner != inferenceRunnerNone && strings.TrimSpace(cfg.InferenceEndpoint) == "" {
+		log.Printf("INFERENCE_RUNNER needs INFERENCE_ENDPOINT, inference is off")
+		cfg.InferenceRunner = inferenceRunnerNone
+	}
+	if cfg.InferenceFPS <= 0 || cfg.InferenceFPS > 30 {
+		log.Printf("Invalid value for INFERENCE_FPS (%g), using default 1", cfg.InferenceFPS)
+		cfg.InferenceFPS = 1
+	}
+	if cfg.InferenceWidth < 64 {
+		log.Printf("Invalid value for INFERENCE_WIDTH (%d), using default 640", cfg.InferenceWidth)
+		cfg.InferenceWidth = 640
+	}
+	if cfg.InferenceMinScore < 0 || cfg.InferenceMinScore > 1 {
+		log.Printf("Invalid value for INFERENCE_MIN_SCORE (%g), using default 0.5", cfg.InferenceMinScore)
+		cfg.InferenceMinScore = 0.5
+	}
+	if cfg.InferenceTimeout <= 0 {
+		log.Printf("Invalid value for INFERENCE_TIMEOUT (%s), using default 5s", cfg.InferenceTimeout)
+		cfg.InferenceTimeout = 5 * time.Second
+	}
+	if cfg.SimulateFPS < 1 || cfg.SimulateFPS > 60 {
+		log.Printf("Invalid value for SIMULATE_FPS (%d), using default 10", cfg.SimulateFPS)
+		cfg.SimulateFPS = 10
+	}
+
+	if cfg.ClockMaxDrift <= 0 {
+		log.Printf("Invalid value for CLOCK_MAX_DRIFT (%v), using default 2s", cfg.ClockMaxDrift)
+		cfg.ClockMaxDrift = 2 * time.Second
+	}
+	if len(cfg.ClockCameraNTPServers) == 0 && cfg.ClockNTPServer != "" {
+		host, _, err := net.SplitHostPort(cfg.ClockNTPServer)
+		if err != nil {
+			host = cfg.ClockNTPServer
+		}
+		cfg.ClockCameraNTPServers = []string{host}
+	}
+	if cfg.ClockSyncCameras && len(cfg.ClockCameraNTPServers) == 0 && cfg.ClockCameraTimeZone == "" {
+		log.Printf("CLOCK_SYNC_CAMERAS needs CLOCK_CAMERA_NTP_SERVERS, CLOCK_NTP_SERVER or CLOCK_CAMERA_TIMEZONE, cameras' time settings are left alone")
+		cfg.ClockSyncCameras = false
+	}
+
+	if cfg.TranscodeMaxSessions < 1 {
+		cfg.TranscodeMaxSessions = 1
+	}
+	if cfg.DigitalPTZMaxZoom <= 1 {
+		log.Printf("Invalid value for DIGITAL_PTZ_MAX_ZOOM (%g), using default 4", cfg.DigitalPTZMaxZoom)
+		cfg.DigitalPTZMaxZoom = 4
+	}
+	if cfg.DigitalPTZ && !cfg.TranscodeEnabled {
+		log.Printf("DIGITAL_PTZ needs TRANSCODE_ENABLED, digital PTZ is off")
+	}
+	if err := cfg.Overlay.validate("OVERLAY"); err != nil {
+		log.Printf("Invalid value for OVERLAY settings (%v), using defaults", err)
+		cfg.Overlay = OverlayConfig{Enabled: cfg.Overlay.Enabled, UTC: cfg.Overlay.UTC,
+			CameraName: cfg.Overlay.CameraName, GatewayID: cfg.Overlay.GatewayID}
+		cfg.Overlay.validate("OVERLAY")
+	}
+	if cfg.Overlay.Enabled && !cfg.TranscodeEnabled {
+		log.Printf("OVERLAY_ENABLED needs TRANSCODE_ENABLED, the overlay is off")
+	}
+	var codecs []string
+	for _, codec := range cfg.TranscodeCodecs {
+		switch codec = strings.ToLower(codec); codec {
+		case videoCodecVP9, videoCodecAV1:
+			codecs = append(codecs, codec)
+		default:
+			log.Printf("Invalid value for TRANSCODE_CODECS (%q), skipping it", codec)
+		}
+	}
+	cfg.TranscodeCodecs = codecs
+	if len(codecs) > 0 && !cfg.TranscodeEnabled {
+		log.Printf("TRANSCODE_CODECS needs TRANSCODE_ENABLED, viewers get H.264")
+	}
+	if len(cfg.SimulcastCameras) > 0 && !cfg.TranscodeEnabled {
+		log.Printf("SIMULCAST_CAMERAS needs TRANSCODE_ENABLED, simulcast is off")
+	}
+	switch cfg.LocalCameraEncoder {
+	case hwaccelNone, hwaccelVAAPI, hwaccelNVENC, hwaccelV4L2M2M, localEncoderCopy:
+	default:
+		log.Printf("Invalid value for LOCAL_CAMERA_ENCODER (%q), using default none", cfg.LocalCameraEncoder)
+		cfg.LocalCameraEncoder = hwaccelNone
+	}
+	if cfg.LocalCameraResolution != "" && !resolutionPattern.MatchString(cfg.LocalCameraResolution) {
+		log.Printf("Invalid value for LOCAL_CAMERA_RESOLUTION (%q), using the device's default", cfg.LocalCameraResolution)
+		cfg.LocalCameraResolution = ""
+	}
+	if cfg.LocalCameraFPS < 1 || cfg.LocalCameraFPS > 60 {
+		log.Printf("Invalid value for LOCAL_CAMERA_FPS (%d), using default 15", cfg.LocalCameraFPS)
+		cfg.LocalCameraFPS = 15
+	}
+	if cfg.LocalCameraBitrate < 100 {
+		log.Printf("Invalid value for LOCAL_CAMERA_BITRATE (%d), using default 2000", cfg.LocalCameraBitrate)
+		cfg.LocalCameraBitrate = 2000
+	}
+
+	if key := getEnv("UPDATE_PUBLIC_KEY", ""); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			log.Printf("Invalid value for UPDATE_PUBLIC_KEY, self-update disabled")
+		} else {
+			cfg.UpdatePublicKey = ed25519.PublicKey(decoded)
+		}
+	}
+	// Several keys let the signing key be rotated
+	for _, key := range getEnvList("STREAM_TOKEN_PUBLIC_KEY") {
+		cfg.StreamTokenRequired = true
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			log.Printf("Invalid key in STREAM_TOKEN_PUBLIC_KEY, ignoring it")
+			continue
+		}
+		cfg.StreamTokenKeys = append(cfg.StreamTokenKeys, ed25519.PublicKey(decoded))
+	}
+	if cfg.StreamTokenRequired && len(cfg.StreamTokenKeys) == 0 {
+		log.Printf("No valid key in STREAM_TOKEN_PUBLIC_KEY, refusing all viewer offers")
+	}
+
+	if cfg.ProxyAuth != proxyAuthBasic && cfg.ProxyAuth != proxyAuthNTLM {
+		log.Printf("Invalid value for PROXY_AUTH (%q), using default %s", cfg.ProxyAuth, proxyAuthBasic)
+		cfg.ProxyAuth = proxyAuthBasic
+	}
+
+	if !validLogLevel(cfg.LogLevel) {
+		log.Printf("Invalid value for LOG_LEVEL (%q), using default info", cfg.LogLevel)
+		cfg.LogLevel = "info"
+	}
+
+	if t := cfg.WebRTCNAT1To1CandidateType; t != "host" && t != "srflx" {
+		log.Printf("Invalid value for WEBRTC_NAT1TO1_CANDIDATE_TYPE (%q), using default host", t)
+		cfg.WebRTCNAT1To1CandidateType = "host"
+	}
+
+	// Camera logins are read where they are used, so reloads change them
+	creds := defaultCredentials()
+	noteSetting("CAMERA_USERNAME", creds.Username, false)
+	noteSetting("CAMERA_PASSWORD", creds.Password, false)
+
+	return cfg
+}
+
+// debugLogging is set while LOG_LEVEL is debug
+var debugLogging atomic.Bool
+
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+// setLogLevel switches debug logging on or off
+func setLogLevel(level string) {
+	debugLogging.Store(level == "debug")
+}
+
+// debugf logs only at the debug level
+func debugf(format string, args ...interface{}) {
+	if debugLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// loadConfigFile sets the variables in a KEY=value file, in the format of
+// .env files, that aren't already set in the environment
+func loadConfigFile(path string, loaded map[string]string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read config file: %v", err)
+		return
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			log.Printf("Ignoring invalid line %d in %s", n+1, path)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if !envSet(loaded, key) {
+			loaded[key] = value
+		}
+	}
+}
+
+// fileEnv holds the variables the last loadConfig set from files, by
+// value. Unlike those of the environment itself, a reload may change them.
+var (
+	fileEnv     = make(map[string]string)
+	fileEnvLock sync.Mutex
+)
+
+// envSet reports whether a variable is set by the environment, or by a
+// file read earlier in this load. The caller holds fileEnvLock.
+func envSet(loaded map[string]string, key string) bool {
+	if _, ok := loaded[key]; ok {
+		return true
+	}
+	value, set := os.LookupEnv(key)
+	if previous, fromFile := fileEnv[key]; fromFile && value == previous {
+		return false
+	}
+	return set
+}
+
+// applyFileEnv sets the variables a load read from files, and unsets those
+// of the last load that no file sets any more. The caller holds
+// fileEnvLock.
+func applyFileEnv(loaded map[string]string) {
+	for key, previous := range fileEnv {
+		if _, ok := loaded[key]; !ok && os.Getenv(key) == previous {
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range loaded {
+		os.Setenv(key, value)
+	}
+	fileEnv = loaded
+}
+
+// fileSettings are the variables whose value names a file, rather than
+// holding a setting read from one
+var fileSettings = map[string]bool{
+	"CONFIG_FILE":        true,
+	"CAMERA_TLS_CA_FILE": true,
+	"HA_PEER_CA_FILE":    true,
+}
+
+// envNamePattern is what a variable set from a file may be called
+var envNamePattern = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// loadEnvFiles sets each unset KEY from the file named by KEY_FILE, as
+// Docker and Kubernetes secrets are mounted, without its final newline
+func loadEnvFiles(loaded map[string]string) {
+	for _, entry := range os.Environ() {
+		name, path, _ := strings.Cut(entry, "=")
+		key, ok := strings.CutSuffix(name, "_FILE")
+		if !ok || key == "" || fileSettings[name] || path == "" || envSet(loaded, key) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", name, err)
+			continue
+		}
+		loaded[key] = strings.TrimRight(string(data), "\r\n")
+	}
+}
+
+// loadConfigDir sets unset variables from the files of a directory, one
+// per variable and named after it in either case, as a Kubernetes ConfigMap
+// or Secret, or Docker secrets in /run/secrets, are mounted. Other files
+// and subdirectories are skipped.
+func loadConfigDir(dir string, loaded map[string]string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read config directory: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		key := strings.ToUpper(entry.Name())
+		if !envNamePattern.MatchString(key) || entry.IsDir() || envSet(loaded, key) {
+			continue
+		}
+		// Mounted ConfigMaps link their files to a hidden directory
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Printf("Failed to read %s from config directory: %v", key, err)
+			continue
+		}
+		loaded[key] = strings.TrimRight(string(data), "\r\n")
+	}
+}
+
+// firstEnv returns the first of several environment variables that is set
+func firstEnv(keys ...string) string {
+	return os.Getenv(firstEnvName(keys...))
+}
+
+// firstEnvName returns the name of the first of several environment
+// variables that is set, or the first name
+func firstEnvName(keys ...string) string {
+	for _, key := range keys {
+		if os.Getenv(key) != "" {
+			return key
+		}
+	}
+	return keys[0]
+}
+
+// configSetting is a variable loadConfig reads, with the value it took
+type configSetting struct {
+	Value string
+	Bool  bool // set with true or false
+}
+
+// configSettings are the variables the last loadConfig read, for the
+// command line's flags and `edge-gateway config`
+var (
+	configSettings     = make(map[string]configSetting)
+	configSettingsLock sync.Mutex
+)
+
+// noteSetting records a variable loadConfig read and the value it took
+func noteSetting(key, value string, isBool bool) {
+	configSettingsLock.Lock()
+	defer configSettingsLock.Unlock()
+	configSettings[key] = configSetting{Value: value, Bool: isBool}
+}
+
+// loadedSettings returns the variables loadConfig has read
+func loadedSettings() map[string]configSetting {
+	configSettingsLock.Lock()
+	defer configSettingsLock.Unlock()
+	settings := make(map[string]configSetting, len(configSettings))
+	for key, setting := range configSettings {
+		settings[key] = setting
+	}
+	return settings
+}
+
+// secretSetting reports whether a variable holds a password or key, which
+// is never printed
+func secretSetting(key string) bool {
+	return strings.Contains(key, "PASSWORD") || strings.Contains(key, "SECRET") || strings.Contains(key, "TOKEN")
+}
+
+// setFlagEnv sets a variable from the command line, which takes precedence
+// over files as the environment does, reloads included
+func setFlagEnv(key, value string) {
+	fileEnvLock.Lock()
+	defer fileEnvLock.Unlock()
+	delete(fileEnv, key)
+	os.Setenv(key, value)
+}
+
+// getEnv returns the value of an environment variable or a fallback
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = fallback
+	}
+	noteSetting(key, value, false)
+	return value
+}
+
+// getEnvFloat returns a floating-point environment variable or a fallback
+func getEnvFloat(key string, fallback float64) (f float64) {
+	defer func() { noteSetting(key, strconv.FormatFloat(f, 'g', -1, 64), false) }()
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+// getEnvInt returns an integer environment variable or a fallback
+func getEnvInt(key string, fallback int) (n int) {
+	defer func() { noteSetting(key, strconv.Itoa(n), false) }()
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvBool returns a boolean environment variable or a fallback
+func getEnvBool(key string, fallback bool) (b bool) {
+	defer func() { noteSetting(key, strconv.FormatBool(b), true) }()
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+// getEnvDuration returns a duration environment variable or a fallback
+func getEnvDuration(key string, fallback time.Duration) (d time.Duration) {
+	defer func() { noteSetting(key, d.String(), false) }()
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvList parses a comma-separated list, skipping empty entries
+func getEnvList(key string) []string {
+	noteSetting(key, os.Getenv(key), false)
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvOUIs parses a comma-separated list of MAC address prefixes, skipping
+// invalid entries
+func getEnvOUIs(key string) []string {
+	var ouis []string
+	for _, item := range getEnvList(key) {
+		oui, ok := parseOUI(item)
+		if !ok {
+			log.Printf("Ignoring invalid OUI %q in %s", item, key)
+			continue
+		}
+		ouis = append(ouis, oui)
+	}
+	return ouis
+}
+
+// mdnsServicePattern matches an mDNS service type such as _onvif._tcp
+var mdnsServicePattern = regexp.MustCompile(`^_[A-Za-z0-9][A-Za-z0-9-]*\._(tcp|udp)$`)
+
+// getEnvMDNSServices parses a comma-separated list of mDNS service types,
+// skipping invalid entries, or returns the default services if none is set
+func getEnvMDNSServices(key string) []string {
+	var services []string
+	for _, item := range getEnvList(key) {
+		if !mdnsServicePattern.MatchString(item) {
+			log.Printf("Ignoring invalid mDNS service %q in %s", item, key)
+			continue
+		}
+		services = append(services, item)
+	}
+	if len(services) == 0 {
+		return defaultMDNSServices
+	}
+	return services
+}
+
+// getEnvIPs parses a comma-separated list of IP addresses, skipping invalid
+// entries
+func getEnvBudgets(key string) map[string]int {
+	budgets := make(map[string]int)
+	for _, item := range getEnvList(key) {
+		parsed, err := parseCameraBudgets(key, []string{item})
+		if err != nil {
+			log.Printf("Ignoring %v", err)
+			continue
+		}
+		for cameraID, kbps := range parsed {
+			budgets[cameraID] = kbps
+		}
+	}
+	return budgets
+}
+
+func getEnvIPs(key string) []net.IP {
+	var ips []net.IP
+	for _, item := range getEnvList(key) {
+		ip := net.ParseIP(item)
+		if ip == nil {
+			log.Printf("Ignoring invalid IP %q in %s", item, key)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// getEnvTenantSubnets parses a comma-separated list of tenant=CIDR entries,
+// skipping invalid ones
+func getEnvTenantSubnets(key string) []tenantSubnet {
+	var subnets []tenantSubnet
+	for _, item := range getEnvList(key) {
+		parsed, err := parseTenantSubnets(key, []string{item})
+		if err != nil {
+			log.Printf("Ignoring %v", err)
+			continue
+		}
+		subnets = append(subnets, parsed...)
+	}
+	return subnets
+}
+
+// getEnvCIDRs parses a comma-separated list of CIDRs, skipping invalid entries
+func getEnvCIDRs(key string) []*net.IPNet {
+	noteSetting(key, os.Getenv(key), false)
+	var nets []*net.IPNet
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("Ignoring invalid CIDR %q in %s", item, key)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// healthCheckTimeout bounds the image's health check, under the
+// HEALTHCHECK timeout
+const healthCheckTimeout = 2 * time.Second
+
+// dockerBridgePool is the range Docker and Podman take bridge networks
+// from by default
+var dockerBridgePool = &net.IPNet{IP: net.IPv4(172, 16, 0, 0).To4(), Mask: net.CIDRMask(12, 32)}
+
+// runHealthCheck implements "edge-gateway healthcheck", the image's
+// HEALTHCHECK: it asks the local API of the gateway running alongside for
+// /healthz, wherever LOCAL_API_ADDR put it, so the image needs no HTTP
+// client of its own. It returns the exit code, 1 if the gateway is
+// unhealthy.
+func runHealthCheck() int {
+	cfg := loadConfig()
+	if cfg.LocalAPIAddr == "" || cfg.LocalAPIAddr == "off" {
+		// Nothing to ask; the container's state is the gateway's
+		return 0
+	}
+	host, port, err := net.SplitHostPort(cfg.LocalAPIAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: invalid LOCAL_API_ADDR: %v\n", err)
+		return 1
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	healthURL, client := localAPIHealthURL(cfg, host, port, healthCheckTimeout)
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "healthcheck: /healthz returned status %d\n", resp.StatusCode)
+		return 1
+	}
+	return 0
+}
+
+// inContainer reports whether the gateway runs in a Docker or Podman
+// container
+func inContainer() bool {
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// warnBridgedContainer warns when the gateway runs in a container on a
+// bridge network, where mDNS doesn't reach the cameras and subnet scans
+// only sweep the container's network
+func warnBridgedContainer(cfg *Config) {
+	if !inContainer() || len(cfg.ScanSubnets) > 0 {
+		return
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !dockerBridgePool.Contains(ipNet.IP) {
+				return
+			}
+		}
+	}
+	log.Printf("Running in a container on a bridge network: mDNS discovery won't reach cameras and network scans " +
+		"only sweep the container's network. Use host networking, the macvlan network (scripts/macvlan.sh), or SCAN_SUBNETS.")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dahuaTopics map Dahua event codes to the ONVIF topics the gateway selects
+// events by; others become Dahua/{Code}
+var dahuaTopics = map[string]string{
+	"VideoMotion":          "VideoSource/MotionAlarm",
+	"CrossLineDetection":   "RuleEngine/LineDetector/Crossed",
+	"CrossRegionDetection": "RuleEngine/FieldDetector/ObjectsInside",
+	"VideoBlind":           "VideoSource/GlobalSceneChange/ImagingService",
+	"SceneChange":          "VideoSource/GlobalSceneChange/ImagingService",
+	"AudioMutation":        "AudioSource/TriggerLevel",
+	"AudioAnomaly":         "AudioSource/TriggerLevel",
+	"AlarmLocal":           "Device/Trigger/DigitalInput",
+}
+
+// dahuaAdapter drives Dahua cameras through their HTTP CGI API
+type dahuaAdapter struct{}
+
+// dahuaChannel is the CGI channel of a camera, numbered from 1
+func dahuaChannel(camera *Camera) int {
+	return max(camera.Channel, 1)
+}
+
+// Identify reads the system info and software version from magicBox.cgi,
+// and whether the camera reports pan, tilt or zoom
+func (dahuaAdapter) Identify(ctx context.Context, client *CameraHTTPClient) (*adapterDevice, error) {
+	info, err := dahuaGet(ctx, client, "/cgi-bin/magicBox.cgi?action=getSystemInfo")
+	if err != nil {
+		return nil, err
+	}
+	if info["deviceType"] == "" {
+		return nil, errors.New("magicBox.cgi system info has no device type")
+	}
+	device := &adapterDevice{Model: info["deviceType"]}
+	if version, err := dahuaGet(ctx, client, "/cgi-bin/magicBox.cgi?action=getSoftwareVersion"); err == nil {
+		device.Firmware = version["version"]
+	}
+	if caps, err := dahuaGet(ctx, client, "/cgi-bin/ptz.cgi?action=getCurrentProtocolCaps&channel=1"); err == nil {
+		device.PTZ = caps["caps.Pan"] == "true" || caps["caps.Tile"] == "true" || caps["caps.Zoom"] == "true"
+	}
+	return device, nil
+}
+
+// PTZ sends a continuous move, with speeds of -8 to 8, or stopMove for stop
+func (dahuaAdapter) PTZ(ctx context.Context, client *CameraHTTPClient, camera *Camera, cmd PTZCommand) error {
+	speed := ptzSpeed(cmd.Speed, 8)
+	var pan, tilt, zoom int
+	switch cmd.Action {
+	case "pan_left":
+		pan = -speed
+	case "pan_right":
+		pan = speed
+	case "tilt_up":
+		tilt = speed
+	case "tilt_down":
+		tilt = -speed
+	case "zoom_in":
+		zoom = speed
+	case "zoom_out":
+		zoom = -speed
+	case "stop":
+	default:
+		return fmt.Errorf("unsupported PTZ action %s", cmd.Action)
+	}
+
+	action := "moveContinuously"
+	if cmd.Action == "stop" {
+		action = "stopMove"
+	}
+	// arg4 is the move's timeout in seconds, should the stop never come
+	path := fmt.Sprintf("/cgi-bin/ptz.cgi?action=%s&channel=%d&code=Continuously&arg1=%d&arg2=%d&arg3=%d&arg4=60",
+		action, dahuaChannel(camera), pan, tilt, zoom)
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ptz.cgi returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Snapshot fetches a snapshot of the channel
+func (dahuaAdapter) Snapshot(ctx context.Context, client *CameraHTTPClient, camera *Camera) ([]byte, error) {
+	return fetchSnapshot(ctx, client, fmt.Sprintf("/cgi-bin/snapshot.cgi?channel=%d", dahuaChannel(camera)))
+}
+
+// Subscribe attaches to eventManager.cgi, which sends a heartbeat every 5
+// seconds between events
+func (dahuaAdapter) Subscribe(ctx context.Context, client *CameraHTTPClient, camera *Camera) (cameraEventSource, error) {
+	channel := camera.Channel
+	return startEventStream(ctx, client, "/cgi-bin/eventManager.cgi?action=attach&codes=%5BAll%5D&heartbeat=5", func(r *bufio.Reader, emit func(CameraEvent)) error {
+		return readDahuaEvents(r, func(line string) {
+			if event, ok := dahuaEvent(line, channel); ok {
+				emit(event)
+			}
+		})
+	})
+}
+
+// dahuaEvent converts an event line such as
+// Code=VideoMotion;action=Start;index=0 to a CameraEvent, dropping the
+// events of channels other than channel, unless it is 0
+func dahuaEvent(line string, channel int) (CameraEvent, bool) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(line, ";") {
+		if name, value, ok := strings.Cut(field, "="); ok {
+			fields[name] = value
+		}
+	}
+	code := fields["Code"]
+	if code == "" {
+		return CameraEvent{}, false
+	}
+	// index counts channels from 0
+	if index, err := strconv.Atoi(fields["index"]); err == nil && channel > 0 && index+1 != channel {
+		return CameraEvent{}, false
+	}
+
+	topic, ok := dahuaTopics[code]
+	if !ok {
+		topic = "Dahua/" + code
+	}
+	event := CameraEvent{Topic: topic, Time: time.Now(), Data: map[string]string{"Type": code}}
+	switch fields["action"] {
+	case "Start":
+		event.Stateful, event.Active = true, true
+	case "Stop":
+		event.Stateful = true
+	}
+	return event, true
+}
+
+// readDahuaEvents reads the event lines of an eventManager.cgi stream,
+// skipping its multipart framing and heartbeats
+func readDahuaEvents(r *bufio.Reader, handle func(line string)) error {
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "Code=") {
+			handle(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dahuaGet GETs a CGI response of name=value lines
+func dahuaGet(ctx context.Context, client *CameraHTTPClient, path string) (map[string]string, error) {
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 64<<10))
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "="); ok {
+			values[name] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtsp"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The outcomes of a diagnostic step. A warning doesn't fail the camera,
+// such as a ping it drops.
+const (
+	diagnosticPass = "pass"
+	diagnosticWarn = "warn"
+	diagnosticFail = "fail"
+	diagnosticSkip = "skip"
+)
+
+// diagnosticKeyframeTimeout is how long the keyframe step waits for one,
+// enough for cameras with a long GOP
+const diagnosticKeyframeTimeout = 10 * time.Second
+
+// errPingNotPermitted is returned when the gateway may open neither kind of
+// ICMP socket
+var errPingNotPermitted = errors.New("ICMP sockets not permitted")
+
+// DiagnosticStep is one rung of a camera's diagnostic ladder
+type DiagnosticStep struct {
+	Name       string  `json:"name"`   // ping, rtsp_port, rtsp_describe, keyframe, vapix_auth or ptz
+	Status     string  `json:"status"` // pass, warn, fail or skip
+	Detail     string  `json:"detail,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// CameraDiagnosis is the report of a camera's diagnostic ladder. Hint is
+// what the first failure most likely means, for an installer to act on.
+type CameraDiagnosis struct {
+	CameraID string           `json:"camera_id"`
+	IP       string           `json:"ip"`
+	Vendor   string           `json:"vendor,omitempty"`
+	Model    string           `json:"model,omitempty"`
+	Firmware string           `json:"firmware,omitempty"`
+	RTSPUrl  string           `json:"rtsp_url,omitempty"` // without credentials
+	Steps    []DiagnosticStep `json:"steps"`
+	OK       bool             `json:"ok"`
+	Hint     string           `json:"hint,omitempty"`
+}
+
+// diagnoseCamera runs the diagnostic ladder on a camera whose credentials
+// are in the store: ping, the RTSP port, an RTSP DESCRIBE, decoding the
+// first keyframe, VAPIX auth and a PTZ probe. A step that needs one that
+// failed is skipped. Without an RTSP URL, the camera's vendor profile gives
+// it, or each profile is tried as adding the camera would.
+func (eg *EdgeGateway) diagnoseCamera(ctx context.Context, camera *Camera) *CameraDiagnosis {
+	d := &CameraDiagnosis{CameraID: camera.ID, IP: camera.IP}
+	run := func(name string, step func() (status, detail string)) string {
+		start := time.Now()
+		status, detail := step()
+		d.Steps = append(d.Steps, DiagnosticStep{
+			Name:       name,
+			Status:     status,
+			Detail:     detail,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		})
+		return status
+	}
+	hint := func(text string) {
+		if d.Hint == "" {
+			d.Hint = text
+		}
+	}
+
+	pinged := run("ping", func() (string, string) {
+		ip := net.ParseIP(camera.IP)
+		if ip == nil {
+			return diagnosticSkip, "not an IP address"
+		}
+		rtt, err := icmpPing(ctx, ip, 2*time.Second)
+		if errors.Is(err, errPingNotPermitted) {
+			return diagnosticSkip, "ICMP not permitted; run as root or allow the gateway's group in net.ipv4.ping_group_range"
+		}
+		if err != nil {
+			return diagnosticWarn, fmt.Sprintf("no reply (%v); the camera or network may drop pings", err)
+		}
+		return diagnosticPass, fmt.Sprintf("reply in %s", rtt.Round(time.Microsecond))
+	})
+
+	portOpen := run("rtsp_port", func() (string, string) {
+		address := net.JoinHostPort(camera.IP, "554")
+		if camera.RTSPUrl != "" {
+			if u, err := url.Parse(camera.RTSPUrl); err == nil {
+				port := u.Port()
+				switch {
+				case port != "":
+				case u.Scheme == "rtsps":
+					port = rtspsDefaultPort
+				default:
+					port = "554"
+				}
+				address = net.JoinHostPort(u.Hostname(), port)
+			}
+		}
+		dialer := net.Dialer{Timeout: eg.cfg.RTSPDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			if pinged == diagnosticPass {
+				hint("The camera answers pings but not on its RTSP port: check that RTSP is enabled on it, and its port")
+			} else {
+				hint("The camera can't be reached: check its IP address, power and cabling, and that the gateway is on its network or VLAN")
+			}
+			return diagnosticFail, fmt.Sprintf("%s: %v", address, err)
+		}
+		conn.Close()
+		return diagnosticPass, address + " open"
+	})
+
+	var client *rtsp.Client
+	described := run("rtsp_describe", func() (string, string) {
+		if portOpen != diagnosticPass {
+			return diagnosticSkip, "RTSP port not open"
+		}
+		if camera.RTSPUrl == "" {
+			var err error
+			if camera.Vendor != "" || camera.RTSPPath != "" {
+				camera.RTSPUrl, err = eg.resolveRTSPURL(ctx, camera)
+			} else {
+				err = eg.detectRTSPProfile(ctx, camera)
+			}
+			if err != nil {
+				rtspHint(err, hint)
+				return diagnosticFail, fmt.Sprintf("no vendor profile's stream answered: %s", redactCredentials(err.Error()))
+			}
+		}
+		var err error
+		client, err = dialRTSP(ctx, eg.credentials.URL(camera.ID, camera.RTSPUrl), cameraTLSConfig(eg.cfg, camera), eg.cfg.RTSPDialTimeout)
+		if err != nil {
+			rtspHint(err, hint)
+			return diagnosticFail, err.Error()
+		}
+		stop := closeOnDone(ctx, client)
+		medias, err := client.Describe()
+		stop()
+		if err != nil {
+			client.Close()
+			client = nil
+			rtspHint(err, hint)
+			return diagnosticFail, redactCredentials(err.Error())
+		}
+		var tracks []string
+		for _, media := range medias {
+			track := media.AVType
+			if media.Type != av.CodecType(0) {
+				track += " " + media.Type.String()
+			}
+			tracks = append(tracks, track)
+		}
+		return diagnosticPass, fmt.Sprintf("%s: %s", camera.RTSPUrl, strings.Join(tracks, ", "))
+	})
+	d.RTSPUrl = camera.RTSPUrl
+	if client != nil {
+		defer client.Close()
+	}
+
+	run("keyframe", func() (string, string) {
+		if described != diagnosticPass {
+			return diagnosticSkip, "stream not described"
+		}
+		status, detail := eg.diagnoseKeyframe(ctx, client)
+		if status == diagnosticFail {
+			hint("The camera serves the stream but its video can't be played: check its encoding is H.264 or H.265, and that RTP isn't blocked between it and the gateway")
+		}
+		return status, detail
+	})
+
+	run("vapix_auth", func() (string, string) {
+		if camera.Vendor != "" && camera.Vendor != "axis" {
+			return diagnosticSkip, fmt.Sprintf("not an Axis camera (%s)", camera.Vendor)
+		}
+		resp, err := eg.httpClients.Client(camera).Get(ctx, "/axis-cgi/param.cgi?action=list&group=Brand")
+		if err != nil {
+			hint("The camera's web server can't be reached: check HTTPS and its HTTP port")
+			return diagnosticFail, err.Error()
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusUnauthorized, http.StatusForbidden:
+			hint("The camera rejected the credentials for VAPIX: check the user exists with operator or administrator rights")
+			return diagnosticFail, fmt.Sprintf("credentials rejected (status %d)", resp.StatusCode)
+		case http.StatusNotFound:
+			return diagnosticSkip, "the camera doesn't serve VAPIX"
+		default:
+			return diagnosticFail, fmt.Sprintf("param.cgi returned status %d", resp.StatusCode)
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		for _, line := range strings.Split(string(body), "\n") {
+			if name, ok := strings.CutPrefix(strings.TrimSpace(line), "root.Brand.ProdFullName="); ok {
+				return diagnosticPass, "authenticated, " + name
+			}
+		}
+		return diagnosticPass, "authenticated"
+	})
+
+	run("ptz", func() (string, string) {
+		eg.probeCapabilities(ctx, camera)
+		caps := camera.Capabilities
+		if caps == nil {
+			return diagnosticSkip, "the camera answered neither VAPIX nor ONVIF"
+		}
+		d.Model, d.Firmware = camera.Model, caps.Firmware
+		if !camera.HasPTZ {
+			return diagnosticSkip, fmt.Sprintf("no PTZ reported over %s", caps.Source)
+		}
+		if caps.Source != "vapix" {
+			return diagnosticPass, fmt.Sprintf("PTZ reported over %s", caps.Source)
+		}
+		resp, err := eg.httpClients.Client(camera).Get(ctx, "/axis-cgi/com/ptz.cgi?"+ptzQuery(camera, "query=position"))
+		if err != nil {
+			return diagnosticFail, err.Error()
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			hint("The camera reports PTZ but refused a position query: check the user has operator rights and PTZ control is enabled")
+			return diagnosticFail, fmt.Sprintf("position query returned status %d", resp.StatusCode)
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		position := parsePTZPosition(string(body))
+		var at []string
+		for _, axis := range []struct {
+			name  string
+			value *float64
+		}{{"pan", position.Pan}, {"tilt", position.Tilt}, {"zoom", position.Zoom}} {
+			if axis.value != nil {
+				at = append(at, fmt.Sprintf("%s %g", axis.name, *axis.value))
+			}
+		}
+		return diagnosticPass, "at " + strings.Join(at, ", ")
+	})
+	d.Vendor = camera.Vendor
+
+	d.OK = true
+	for _, step := range d.Steps {
+		if step.Status == diagnosticFail {
+			d.OK = false
+		}
+	}
+	return d
+}
+
+// rtspHint explains an RTSP failure by the status the camera answered with
+func rtspHint(err error, hint func(string)) {
+	switch {
+	case isRTSPAuthError(err):
+		hint("The camera rejected the credentials for RTSP: check the username and password")
+	case strings.Contains(err.Error(), "StatusCode=404"):
+		hint("The camera has no stream at that path: give its vendor, or the full RTSP URL")
+	default:
+		hint("The camera's RTSP server didn't answer as expected: check its RTSP settings and firmware")
+	}
+}
+
+// diagnoseKeyframe waits for the stream's first video keyframe and decodes
+// it with ffmpeg, if it is installed
+func (eg *EdgeGateway) diagnoseKeyframe(ctx context.Context, client *rtsp.Client) (string, string) {
+	ctx, cancel := context.WithTimeout(ctx, diagnosticKeyframeTimeout)
+	defer cancel()
+	stop := closeOnDone(ctx, client)
+	defer stop()
+
+	start := time.Now()
+	codecs, err := client.Streams()
+	if err != nil {
+		return diagnosticFail, redactCredentials(err.Error())
+	}
+	video := -1
+	for i, codec := range codecs {
+		if codec.Type().IsVideo() {
+			video = i
+			break
+		}
+	}
+	if video < 0 {
+		return diagnosticFail, "the stream has no video track"
+	}
+	for {
+		pkt, err := client.ReadPacket()
+		if err != nil {
+			if ctx.Err() != nil {
+				return diagnosticFail, fmt.Sprintf("no keyframe within %s", diagnosticKeyframeTimeout)
+			}
+			return diagnosticFail, redactCredentials(err.Error())
+		}
+		if int(pkt.Idx) != video || !pkt.IsKeyFrame {
+			continue
+		}
+		detail := fmt.Sprintf("%s keyframe after %s", codecs[video].Type(), time.Since(start).Round(time.Millisecond))
+		if v, ok := codecs[video].(av.VideoCodecData); ok {
+			detail = fmt.Sprintf("%dx%d %s", v.Width(), v.Height(), detail)
+		}
+		if err := decodeKeyframe(ctx, eg.cfg.FFmpegPath, codecs[video], pkt.Data); err != nil {
+			if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+				return diagnosticPass, detail + ", not decoded: ffmpeg not installed"
+			}
+			return diagnosticFail, fmt.Sprintf("%s, decoding failed: %v", detail, err)
+		}
+		return diagnosticPass, detail + ", decoded"
+	}
+}
+
+// decodeKeyframe decodes a keyframe with ffmpeg, its parameter sets first
+func decodeKeyframe(ctx context.Context, ffmpegPath string, codec av.CodecData, frame []byte) error {
+	var format string
+	var nalus [][]byte
+	switch c := codec.(type) {
+	case h264parser.CodecData:
+		format, nalus = "h264", [][]byte{c.SPS(), c.PPS()}
+	case h265parser.CodecData:
+		format, nalus = "hevc", [][]byte{c.VPS(), c.SPS(), c.PPS()}
+	default:
+		return fmt.Errorf("%s can't be decoded", codec.Type())
+	}
+	split, _ := h264parser.SplitNALUs(frame)
+	var au []byte
+	for _, nalu := range append(nalus, split...) {
+		au = append(au, 0, 0, 0, 1)
+		au = append(au, nalu...)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error",
+		"-f", format, "-i", "pipe:0", "-frames:v", "1", "-f", "null", "-")
+	cmd.Stdin = bytes.NewReader(au)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			lines := strings.Split(message, "\n")
+			return errors.New(lines[len(lines)-1])
+		}
+		return err
+	}
+	if strings.TrimSpace(stderr.String()) != "" {
+		return errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// icmpPing sends an ICMP echo request and waits for the reply, over an
+// unprivileged socket where net.ipv4.ping_group_range allows one and a raw
+// socket otherwise
+func icmpPing(ctx context.Context, ip net.IP, timeout time.Duration) (time.Duration, error) {
+	networks := []string{"udp6", "ip6:ipv6-icmp"}
+	protocol := 58
+	var request, reply icmp.Type = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	if ip.To4() != nil {
+		networks = []string{"udp4", "ip4:icmp"}
+		protocol = 1
+		request, reply = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	}
+
+	var conn *icmp.PacketConn
+	var dst net.Addr
+	for _, network := range networks {
+		var err error
+		if conn, err = icmp.ListenPacket(network, ""); err == nil {
+			if strings.HasPrefix(network, "udp") {
+				dst = &net.UDPAddr{IP: ip}
+			} else {
+				dst = &net.IPAddr{IP: ip}
+			}
+			break
+		}
+	}
+	if conn == nil {
+		return 0, errPingNotPermitted
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	// Unprivileged sockets have their ID set by the kernel, so the reply is
+	// matched by its sequence number and sender
+	seq := int(time.Now().UnixNano() & 0xffff)
+	message := icmp.Message{Type: request, Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("edge-gateway")}}
+	data, err := message.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(data, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		answer, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || answer.Type != reply {
+			continue
+		}
+		echo, ok := answer.Body.(*icmp.Echo)
+		host, _, _ := net.SplitHostPort(peer.String())
+		if host == "" {
+			host = peer.String()
+		}
+		if ok && echo.Seq == seq && net.ParseIP(host).Equal(ip) {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// diskUsage is not supported on this platform
+func diskUsage(path string) (free, total uint64, ok bool) {
+	return 0, 0, false
+}
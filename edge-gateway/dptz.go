@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Digital PTZ moves at speed 1.0: the view pans half its own width or height
+// per second and its magnification changes by 1x per second
+const (
+	digitalPanRate  = 0.5
+	digitalZoomRate = 1.0
+	// digitalFrameRate is the output frame rate of digitally zoomed video,
+	// which zoompan needs fixed
+	digitalFrameRate = 25
+)
+
+// digitalView is the part of the frame digital PTZ shows: magnified by Zoom
+// around a center given as fractions of the frame's width and height
+type digitalView struct {
+	Zoom float64 `json:"zoom"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+// digitalPTZ crops and scales a fixed camera's video in the transcoder, so
+// pan, tilt and zoom commands work on it like on a PTZ camera. A move is
+// expressed in the ffmpeg filter as a function of time, so the view only
+// needs a new transcoder session when a move starts or stops.
+type digitalPTZ struct {
+	lock    sync.Mutex
+	maxZoom float64
+	view    digitalView // as of since
+	move    digitalView // change per second from since, zero when still
+	since   time.Time
+}
+
+func newDigitalPTZ(maxZoom float64) *digitalPTZ {
+	return &digitalPTZ{
+		maxZoom: maxZoom,
+		view:    digitalView{Zoom: 1, X: 0.5, Y: 0.5},
+	}
+}
+
+// at returns the view at a time, kept within the frame. Called with d.lock
+// held.
+func (d *digitalPTZ) at(now time.Time) digitalView {
+	elapsed := now.Sub(d.since).Seconds()
+	v := digitalView{
+		Zoom: math.Min(math.Max(d.view.Zoom+d.move.Zoom*elapsed, 1), d.maxZoom),
+		X:    d.view.X + d.move.X*elapsed,
+		Y:    d.view.Y + d.move.Y*elapsed,
+	}
+	half := 0.5 / v.Zoom
+	v.X = math.Min(math.Max(v.X, half), 1-half)
+	v.Y = math.Min(math.Max(v.Y, half), 1-half)
+	return v
+}
+
+// active reports whether the stream must be cropped: the view is zoomed in
+// or zooming in
+func (d *digitalPTZ) active() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.view.Zoom > 1 || d.move.Zoom > 0
+}
+
+// command starts or stops a move. It returns the view, and reports whether
+// the move changed; a repeated move carries on as it was.
+func (d *digitalPTZ) command(cmd PTZCommand, now time.Time) (digitalView, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	view := d.at(now)
+	speed := math.Min(math.Max(cmd.Speed, 0), 1)
+	var move digitalView
+	switch cmd.Action {
+	case "pan_left":
+		move.X = -speed * digitalPanRate / view.Zoom
+	case "pan_right":
+		move.X = speed * digitalPanRate / view.Zoom
+	case "tilt_up":
+		move.Y = -speed * digitalPanRate / view.Zoom
+	case "tilt_down":
+		move.Y = speed * digitalPanRate / view.Zoom
+	case "zoom_in":
+		move.Zoom = speed * digitalZoomRate
+	case "zoom_out":
+		move.Zoom = -speed * digitalZoomRate
+	}
+	// The whole frame can't be panned, nor zoomed past its limits
+	if view.Zoom <= 1 && (move.X != 0 || move.Y != 0 || move.Zoom < 0) ||
+		view.Zoom >= d.maxZoom && move.Zoom > 0 {
+		move = digitalView{}
+	}
+
+	if move == d.move {
+		return view, false
+	}
+	d.view, d.move, d.since = view, move, now
+	return view, true
+}
+
+// filter is the ffmpeg filter chain showing the view from now on, moving if
+// a move is under way, scaled to width x height
+func (d *digitalPTZ) filter(width, height int) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	view, move := d.at(time.Now()), d.move
+
+	// it is seconds since the session started, and zoom the frame's
+	// magnification as z evaluated it
+	z := fmt.Sprintf("clip(%.4f+%.4f*it,1,%.4f)", view.Zoom, move.Zoom, d.maxZoom)
+	x := fmt.Sprintf("clip((%.4f+%.4f*it)*iw-iw/zoom/2,0,iw-iw/zoom)", view.X, move.X)
+	y := fmt.Sprintf("clip((%.4f+%.4f*it)*ih-ih/zoom/2,0,ih-ih/zoom)", view.Y, move.Y)
+	return fmt.Sprintf("setpts=PTS-STARTPTS,fps=%d,zoompan=z='%s':x='%s':y='%s':d=1:s=%dx%d:fps=%d",
+		digitalFrameRate, z, x, y, width, height, digitalFrameRate)
+}
+
+// digitalPTZSize is the size of a camera's digitally zoomed video: its
+// largest reported resolution, or 1080p, scaled to height if it is set
+func digitalPTZSize(camera *Camera, height int) (int, int) {
+	width, full := 1920, 1080
+	if caps := camera.Capabilities; caps != nil {
+		for _, resolution := range caps.Resolutions {
+			var w, h int
+			if _, err := fmt.Sscanf(resolution, "%dx%d", &w, &h); err == nil && w*h > width*full {
+				width, full = w, h
+			}
+		}
+	}
+	if height <= 0 {
+		return width &^ 1, full &^ 1
+	}
+	return (width * height / full) &^ 1, height &^ 1
+}
+
+// digitalFilter is the digital PTZ filter for the stream's next transcoder
+// session, or empty if the camera shows its whole frame
+func (cs *CameraStream) digitalFilter() string {
+	if cs.dptz == nil || !cs.dptz.active() {
+		return ""
+	}
+	height, _ := cs.transcoder.profileSize(cs.profile)
+	return cs.dptz.filter(digitalPTZSize(cs.camera, height))
+}
+
+// isDigitalPTZ reports whether digital PTZ handles a PTZCommand action
+func isDigitalPTZ(action string) bool {
+	switch action {
+	case "pan_left", "pan_right", "tilt_up", "tilt_down", "zoom_in", "zoom_out",
+		"stop", ptzActionLock, ptzActionUnlock:
+		return true
+	}
+	return false
+}
+
+// digitalPTZ returns the digital PTZ of a camera without mechanical PTZ,
+// creating it on first use, or nil if DIGITAL_PTZ is off or the camera
+// can't use it
+func (eg *EdgeGateway) digitalPTZ(camera *Camera) *digitalPTZ {
+	if !eg.cfg.DigitalPTZ || eg.transcoder == nil || camera.HasPTZ {
+		return nil
+	}
+	eg.ptzLock.Lock()
+	defer eg.ptzLock.Unlock()
+	d, ok := eg.dptz[camera.ID]
+	if !ok {
+		d = newDigitalPTZ(eg.cfg.DigitalPTZMaxZoom)
+		eg.dptz[camera.ID] = d
+	}
+	return d
+}
+
+// moveDigitalPTZ applies a PTZ command to a camera's digital view. When a
+// move starts or stops, the camera's streams restart their ingest with the
+// new filter, or without one once the view is back to the whole frame.
+func (eg *EdgeGateway) moveDigitalPTZ(camera *Camera, cmd PTZCommand) {
+	d := eg.digitalPTZ(camera)
+	if d == nil {
+		return
+	}
+	view, changed := d.command(cmd, time.Now())
+	if !changed {
+		return
+	}
+	debugf("Digital PTZ %s on camera %s from %.2fx at %.2f,%.2f", cmd.Action, camera.ID, view.Zoom, view.X, view.Y)
+
+	eg.streamsLock.Lock()
+	for _, stream := range eg.streams {
+		if stream.dptz == d {
+			stream.restartIngest()
+		}
+	}
+	eg.streamsLock.Unlock()
+
+	eg.sendEvent("ptz_view", map[string]interface{}{
+		"camera_id": camera.ID,
+		"action":    cmd.Action,
+		"zoom":      view.Zoom,
+		"x":         view.X,
+		"y":         view.Y,
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+// e2eeNonceSize is the AES-GCM nonce sent with each encrypted NAL unit
+const e2eeNonceSize = 12
+
+// e2eeKey is a camera's end-to-end encryption key
+type e2eeKey struct {
+	id   int // 1 to 255, sent with every encrypted NAL unit
+	raw  []byte
+	aead cipher.AEAD
+}
+
+func newE2EEKey(id int, raw []byte) (*e2eeKey, error) {
+	if id < 1 || id > 255 {
+		return nil, fmt.Errorf("key_id must be 1 to 255")
+	}
+	if len(raw) != 16 && len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 16 or 32 bytes")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eeKey{id: id, raw: raw, aead: aead}, nil
+}
+
+// encryptFrame encrypts an H.264 access unit for players that decrypt it
+// with insertable streams. Each slice and SEI NAL unit keeps its header
+// byte in the clear, so packetizers, SFUs and the player's depacketizer
+// still see its type, and its payload becomes
+//
+//	ciphertext | GCM tag (16) | nonce (12) | key ID (1)
+//
+// authenticated with the header byte, with emulation prevention bytes
+// inserted so no start code appears inside. Parameter sets stay clear. The
+// result is in Annex B form.
+func (k *e2eeKey) encryptFrame(data []byte) []byte {
+	nalus, _ := h264parser.SplitNALUs(data)
+	out := make([]byte, 0, len(data)+len(nalus)*64)
+	for _, nalu := range nalus {
+		out = append(out, 0, 0, 0, 1)
+		if len(nalu) < 2 || nalu[0]&0x1f < 1 || nalu[0]&0x1f > 6 {
+			out = append(out, nalu...)
+			continue
+		}
+
+		nonce := make([]byte, e2eeNonceSize)
+		rand.Read(nonce)
+		sealed := k.aead.Seal(nil, nonce, nalu[1:], nalu[:1])
+		sealed = append(append(sealed, nonce...), byte(k.id))
+		out = append(out, nalu[0])
+		out = appendEscaped(out, sealed)
+	}
+	return out
+}
+
+// appendEscaped appends b with an emulation prevention byte after every two
+// zero bytes followed by a byte up to 3, as H.264 NAL units require
+func appendEscaped(out, b []byte) []byte {
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// E2EEKeyStore holds the end-to-end encryption keys of cameras by camera ID.
+// Keys reach the gateway over the local API, never through the cloud. Once
+// loaded from a file, every change is saved back to it.
+type E2EEKeyStore struct {
+	lock sync.RWMutex
+	keys map[string]*e2eeKey
+	path string
+}
+
+// savedE2EEKey is a key as saved to disk
+type savedE2EEKey struct {
+	KeyID int    `json:"key_id"`
+	Key   string `json:"key"` // base64
+}
+
+func NewE2EEKeyStore() *E2EEKeyStore {
+	return &E2EEKeyStore{keys: make(map[string]*e2eeKey)}
+}
+
+// Get returns a camera's key, or nil if its video is not encrypted
+func (s *E2EEKeyStore) Get(cameraID string) *e2eeKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.keys[cameraID]
+}
+
+// Set gives a camera a key, replacing any earlier one
+func (s *E2EEKeyStore) Set(cameraID string, keyID int, raw []byte) error {
+	key, err := newE2EEKey(keyID, raw)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys[cameraID] = key
+	s.saveLocked()
+	return nil
+}
+
+// Delete stops encrypting a camera's video, reporting whether it had a key
+func (s *E2EEKeyStore) Delete(cameraID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.keys[cameraID]; !ok {
+		return false
+	}
+	delete(s.keys, cameraID)
+	s.saveLocked()
+	return true
+}
+
+// KeyIDs returns the ID of each camera's key, never the keys
+func (s *E2EEKeyStore) KeyIDs() map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ids := make(map[string]int, len(s.keys))
+	for cameraID, key := range s.keys {
+		ids[cameraID] = key.id
+	}
+	return ids
+}
+
+// Load restores the keys saved at path, which is only readable by the
+// gateway's user, and saves later changes there
+func (s *E2EEKeyStore) Load(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read saved encryption keys: %v", err)
+		}
+		return
+	}
+	var saved map[string]savedE2EEKey
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Discarding unreadable saved encryption keys: %v", err)
+		return
+	}
+	for cameraID, entry := range saved {
+		raw, err := base64.StdEncoding.DecodeString(entry.Key)
+		if err != nil {
+			log.Printf("Discarding saved encryption key of camera %s: %v", cameraID, err)
+			continue
+		}
+		key, err := newE2EEKey(entry.KeyID, raw)
+		if err != nil {
+			log.Printf("Discarding saved encryption key of camera %s: %v", cameraID, err)
+			continue
+		}
+		s.keys[cameraID] = key
+	}
+}
+
+// saveLocked writes the keys to the store's file, if it has one. The caller
+// holds lock.
+func (s *E2EEKeyStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	saved := make(map[string]savedE2EEKey, len(s.keys))
+	for cameraID, key := range s.keys {
+		saved[cameraID] = savedE2EEKey{KeyID: key.id, Key: base64.StdEncoding.EncodeToString(key.raw)}
+	}
+	data, _ := json.Marshal(saved)
+	if err := writeFileAtomic(s.path, data); err != nil {
+		log.Printf("Failed to save encryption keys: %v", err)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// encoderCheckTimeout bounds checking and configuring one camera's encoder
+const encoderCheckTimeout = 20 * time.Second
+
+// encoderCheckWorkers is how many cameras are reconciled at once
+const encoderCheckWorkers = 4
+
+// gopRetryInterval is how long the gateway waits before asking a camera
+// whose keyframes are still too far apart for a shorter GOP again
+const gopRetryInterval = time.Hour
+
+// Bitrate control modes
+const (
+	bitrateModeVBR = "vbr"
+	bitrateModeCBR = "cbr"
+	bitrateModeMBR = "mbr" // variable, up to a maximum bitrate
+)
+
+// zipstreamStrengths are the Axis MPEG.ZStrength values of each Zipstream
+// level
+var zipstreamStrengths = map[string]string{
+	"off":     "0",
+	"low":     "10",
+	"medium":  "20",
+	"high":    "30",
+	"higher":  "40",
+	"extreme": "50",
+}
+
+// EncoderProfile is the encoder configuration a camera is kept at, for
+// consistent WebRTC delivery across the fleet. Settings left out are left
+// as the camera has them.
+type EncoderProfile struct {
+	Resolution  string `json:"resolution,omitempty"`   // WIDTHxHEIGHT
+	GOPLength   int    `json:"gop_length,omitempty"`   // frames from one keyframe to the next
+	BitrateMode string `json:"bitrate_mode,omitempty"` // vbr, cbr or mbr
+	BitrateKbps int    `json:"bitrate_kbps,omitempty"` // the target of cbr, the maximum of mbr
+	Zipstream   string `json:"zipstream,omitempty"`    // off, low, medium, high, higher or extreme
+}
+
+// validate checks the profile's settings
+func (p EncoderProfile) validate() error {
+	if p == (EncoderProfile{}) {
+		return errors.New("encoder profile sets nothing")
+	}
+	if p.Resolution != "" && !resolutionPattern.MatchString(p.Resolution) {
+		return fmt.Errorf("invalid resolution %q", p.Resolution)
+	}
+	if p.GOPLength < 0 || p.GOPLength > 1000 {
+		return fmt.Errorf("invalid gop_length %d", p.GOPLength)
+	}
+	switch p.BitrateMode {
+	case "", bitrateModeVBR, bitrateModeCBR, bitrateModeMBR:
+	default:
+		return fmt.Errorf("invalid bitrate_mode %q", p.BitrateMode)
+	}
+	if p.BitrateKbps < 0 || p.BitrateKbps > 100_000 {
+		return fmt.Errorf("invalid bitrate_kbps %d", p.BitrateKbps)
+	}
+	if p.Zipstream != "" && zipstreamStrengths[p.Zipstream] == "" {
+		return fmt.Errorf("invalid zipstream %q", p.Zipstream)
+	}
+	return nil
+}
+
+// EncoderProfileUpdate sets a camera's encoder profile, or without a
+// camera_id the default of every camera without one of its own. A null
+// profile removes it.
+type EncoderProfileUpdate struct {
+	CameraID string          `json:"camera_id,omitempty"`
+	Profile  *EncoderProfile `json:"profile"`
+}
+
+// EncoderStatus is a camera's encoder checked against its profile: the
+// settings that differed and were set, and those its API can't take
+type EncoderStatus struct {
+	CameraID    string          `json:"camera_id"`
+	Profile     *EncoderProfile `json:"profile"`
+	Source      string          `json:"source,omitempty"` // vapix or onvif
+	Drift       []string        `json:"drift,omitempty"`
+	Unsupported []string        `json:"unsupported,omitempty"`
+	Applied     bool            `json:"applied"`
+	Error       string          `json:"error,omitempty"`
+	// KeyframeInterval is set when the GOP was shortened because keyframes
+	// were this many seconds apart
+	KeyframeInterval float64 `json:"keyframe_interval_secs,omitempty"`
+}
+
+// EncoderProfileStore holds the default encoder profile, under the empty
+// camera ID, and those of single cameras. Once loaded from a file, every
+// change is saved back to it.
+type EncoderProfileStore struct {
+	lock     sync.RWMutex
+	profiles map[string]EncoderProfile
+	path     string
+}
+
+func NewEncoderProfileStore() *EncoderProfileStore {
+	return &EncoderProfileStore{profiles: make(map[string]EncoderProfile)}
+}
+
+// Get returns the profile a camera is kept at: its own, or else the default
+func (s *EncoderProfileStore) Get(cameraID string) (EncoderProfile, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if profile, ok := s.profiles[cameraID]; ok {
+		return profile, true
+	}
+	profile, ok := s.profiles[""]
+	return profile, ok
+}
+
+// Set replaces or, given nil, removes a profile
+func (s *EncoderProfileStore) Set(cameraID string, profile *EncoderProfile) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if profile == nil {
+		delete(s.profiles, cameraID)
+	} else {
+		s.profiles[cameraID] = *profile
+	}
+	s.saveLocked()
+}
+
+// Load restores the profiles saved at path and saves later changes there
+func (s *EncoderProfileStore) Load(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read saved encoder profiles: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.profiles); err != nil {
+		log.Printf("Discarding unreadable saved encoder profiles: %v", err)
+		s.profiles = make(map[string]EncoderProfile)
+	}
+}
+
+// saveLocked writes the profiles to the store's file, if it has one. The
+// caller holds lock.
+func (s *EncoderProfileStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	data, _ := json.Marshal(s.profiles)
+	if err := writeFileAtomic(s.path, data); err != nil {
+		log.Printf("Failed to save encoder profiles: %v", err)
+	}
+}
+
+// setEncoderProfile stores a profile and configures the cameras it applies
+// to in the background, reporting each in encoder_status. A tenant's user
+// may only set the profiles of the tenant's cameras.
+func (eg *EdgeGateway) setEncoderProfile(ctx context.Context, tenant string, u EncoderProfileUpdate) error {
+	if u.Profile != nil {
+		if err := u.Profile.validate(); err != nil {
+			return err
+		}
+	}
+	if u.CameraID == "" && tenant != "" {
+		return errTenantDenied
+	}
+	if u.CameraID != "" {
+		eg.camerasLock.RLock()
+		_, exists := eg.cameras[u.CameraID]
+		eg.camerasLock.RUnlock()
+		if !exists {
+			return errCameraNotFound
+		}
+	}
+
+	eg.encoderProfiles.Set(u.CameraID, u.Profile)
+	if u.CameraID == "" {
+		log.Printf("Default encoder profile set to %+v", u.Profile)
+	} else {
+		log.Printf("Encoder profile of camera %s set to %+v", u.CameraID, u.Profile)
+	}
+	go func() {
+		for _, status := range eg.reconcileEncoders(ctx, u.CameraID) {
+			eg.sendEvent("encoder_status", status)
+		}
+	}()
+	return nil
+}
+
+// monitorEncoders reconciles cameras with their encoder profiles every
+// ENCODER_CHECK_INTERVAL, reporting the cameras it configured or couldn't
+// check
+func (eg *EdgeGateway) monitorEncoders(ctx context.Context) {
+	if eg.cfg.EncoderCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(eg.cfg.EncoderCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// Give discovery a moment to restore and probe the cameras
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		for _, status := range eg.reconcileEncoders(ctx, "") {
+			if status.Applied || status.Error != "" {
+				eg.sendEvent("encoder_status", status)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcileEncoders checks the approved cameras that have an encoder
+// profile, or only the one given, and sets the settings that differ
+func (eg *EdgeGateway) reconcileEncoders(ctx context.Context, cameraID string) []EncoderStatus {
+	type target struct {
+		camera  Camera
+		profile EncoderProfile
+	}
+	eg.camerasLock.RLock()
+	var targets []target
+	for _, camera := range eg.cameras {
+		if cameraID != "" && camera.ID != cameraID {
+			continue
+		}
+		if camera.Approval != "" || camera.Simulated || camera.Device != "" || camera.Generic {
+			continue
+		}
+		if profile, ok := eg.encoderProfiles.Get(camera.ID); ok {
+			targets = append(targets, target{*camera, profile})
+		}
+	}
+	eg.camerasLock.RUnlock()
+
+	results := make([]EncoderStatus, len(targets))
+	slots := make(chan struct{}, encoderCheckWorkers)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, t target) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = eg.reconcileEncoder(ctx, &t.camera, t.profile)
+		}(i, t)
+	}
+	wg.Wait()
+	slices.SortFunc(results, func(a, b EncoderStatus) int { return strings.Compare(a.CameraID, b.CameraID) })
+	return results
+}
+
+// reconcileEncoder sets the settings of a camera's encoder that differ
+// from its profile, through VAPIX parameters or else the ONVIF media
+// service, and restarts the camera's streams so they pick them up
+func (eg *EdgeGateway) reconcileEncoder(ctx context.Context, camera *Camera, profile EncoderProfile) EncoderStatus {
+	ctx, cancel := context.WithTimeout(ctx, encoderCheckTimeout)
+	defer cancel()
+	client := eg.httpClients.Client(camera)
+	status := EncoderStatus{CameraID: camera.ID, Profile: &profile}
+
+	var err error
+	useONVIF := camera.Capabilities != nil && camera.Capabilities.Source == "onvif"
+	if !useONVIF {
+		status.Source = "vapix"
+		err = vapixEncoder(ctx, client, camera, profile, &status)
+		useONVIF = err != nil && (camera.Capabilities == nil || camera.Capabilities.Source != "vapix")
+	}
+	if useONVIF {
+		status = EncoderStatus{CameraID: camera.ID, Profile: &profile, Source: "onvif"}
+		err = onvifEncoder(ctx, client, camera, profile, &status)
+	}
+	if err != nil {
+		log.Printf("Could not reconcile encoder of camera %s: %v", camera.ID, err)
+		status.Error = err.Error()
+		return status
+	}
+	if status.Applied {
+		log.Printf("Set %s of camera %s to its encoder profile", strings.Join(status.Drift, ", "), camera.ID)
+		eg.streamsLock.RLock()
+		for _, stream := range eg.streams {
+			if stream.camera.ID == camera.ID {
+				stream.restartIngest()
+			}
+		}
+		eg.streamsLock.RUnlock()
+	}
+	return status
+}
+
+// vapixEncoder compares the camera's Image.I{n} parameters, of its video
+// channel, with the profile and updates those that differ. A parameter the
+// firmware doesn't list is reported as unsupported.
+func vapixEncoder(ctx context.Context, client *CameraHTTPClient, camera *Camera, profile EncoderProfile, status *EncoderStatus) error {
+	group := fmt.Sprintf("Image.I%d", max(camera.Channel-1, 0))
+	params, err := vapixParams(ctx, client, group)
+	if err != nil {
+		return err
+	}
+
+	updates := url.Values{"action": {"update"}}
+	set := func(setting, param, value string) {
+		name := "root." + group + "." + param
+		current, listed := params[name]
+		switch {
+		case !listed:
+			status.Unsupported = append(status.Unsupported, setting)
+		case !strings.EqualFold(current, value):
+			status.Drift = append(status.Drift, setting)
+			updates.Set(name, value)
+		}
+	}
+	if profile.Resolution != "" {
+		set("resolution", "Appearance.Resolution", profile.Resolution)
+	}
+	if profile.GOPLength > 0 {
+		set("gop_length", "MPEG.PCount", strconv.Itoa(profile.GOPLength))
+	}
+	if profile.BitrateMode != "" {
+		set("bitrate_mode", "RateControl.Mode", profile.BitrateMode)
+	}
+	if profile.BitrateKbps > 0 {
+		param := "RateControl.TargetBitrate"
+		if profile.BitrateMode == bitrateModeMBR {
+			param = "RateControl.MaxBitrate"
+		}
+		set("bitrate_kbps", param, strconv.Itoa(profile.BitrateKbps))
+	}
+	if profile.Zipstream != "" {
+		set("zipstream", "MPEG.ZStrength", zipstreamStrengths[profile.Zipstream])
+	}
+	if len(status.Drift) == 0 {
+		return nil
+	}
+
+	resp, err := client.Get(ctx, "/axis-cgi/param.cgi?"+updates.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || strings.HasPrefix(string(body), "# Error") {
+		return fmt.Errorf("param.cgi update returned status %d: %s", resp.StatusCode, strings.TrimSpace(strings.TrimPrefix(string(body), "#")))
+	}
+	status.Applied = true
+	return nil
+}
+
+// onvifEncoderConfiguration is an ONVIF media (ver10) video encoder
+// configuration, as far as SetVideoEncoderConfiguration needs it back
+type onvifEncoderConfiguration struct {
+	Token      string  `xml:"token,attr"`
+	Name       string  `xml:"Name"`
+	UseCount   int     `xml:"UseCount"`
+	Encoding   string  `xml:"Encoding"`
+	Width      int     `xml:"Resolution>Width"`
+	Height     int     `xml:"Resolution>Height"`
+	Quality    float64 `xml:"Quality"`
+	FrameRate  int     `xml:"RateControl>FrameRateLimit"`
+	Interval   int     `xml:"RateControl>EncodingInterval"`
+	Bitrate    int     `xml:"RateControl>BitrateLimit"`
+	GovLength  int     `xml:"H264>GovLength"`
+	H264       string  `xml:"H264>H264Profile"`
+	Multicast  string  `xml:"Multicast>Address>IPv4Address"`
+	Port       int     `xml:"Multicast>Port"`
+	TTL        int     `xml:"Multicast>TTL"`
+	AutoStart  bool    `xml:"Multicast>AutoStart"`
+	SessionTTL string  `xml:"SessionTimeout"`
+}
+
+// onvifEncoder compares the video encoder configuration of the camera's
+// first media profile with the profile and sets it if it differs. The
+// media service has no bitrate modes or Zipstream, so those are reported
+// as unsupported; bitrate_kbps becomes the bitrate limit.
+func onvifEncoder(ctx context.Context, client *CameraHTTPClient, camera *Camera, profile EncoderProfile, status *EncoderStatus) error {
+	if camera.Channel > 0 {
+		return errors.New("sensors of ONVIF cameras are configured through the camera")
+	}
+	var lastErr error
+	for _, path := range onvifMediaPaths {
+		var profiles struct {
+			Profiles []struct {
+				Encoder *onvifEncoderConfiguration `xml:"VideoEncoderConfiguration"`
+			} `xml:"GetProfilesResponse>Profiles"`
+		}
+		err := onvifCall(ctx, client, path, `<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &profiles)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(profiles.Profiles) == 0 || profiles.Profiles[0].Encoder == nil {
+			return errors.New("camera reported no ONVIF video encoder configuration")
+		}
+		c := profiles.Profiles[0].Encoder
+
+		if profile.Resolution != "" {
+			// validate checked the resolution's form
+			width, height, _ := strings.Cut(profile.Resolution, "x")
+			w, _ := strconv.Atoi(width)
+			h, _ := strconv.Atoi(height)
+			if w != c.Width || h != c.Height {
+				status.Drift = append(status.Drift, "resolution")
+				c.Width, c.Height = w, h
+			}
+		}
+		if profile.GOPLength > 0 {
+			switch {
+			case c.Encoding != "H264":
+				status.Unsupported = append(status.Unsupported, "gop_length")
+			case c.GovLength != profile.GOPLength:
+				status.Drift = append(status.Drift, "gop_length")
+				c.GovLength = profile.GOPLength
+			}
+		}
+		if profile.BitrateMode != "" {
+			status.Unsupported = append(status.Unsupported, "bitrate_mode")
+		}
+		if profile.BitrateKbps > 0 && c.Bitrate != profile.BitrateKbps {
+			status.Drift = append(status.Drift, "bitrate_kbps")
+			c.Bitrate = profile.BitrateKbps
+		}
+		if profile.Zipstream != "" {
+			status.Unsupported = append(status.Unsupported, "zipstream")
+		}
+		if len(status.Drift) == 0 {
+			return nil
+		}
+
+		h264 := ""
+		if c.Encoding == "H264" {
+			h264 = fmt.Sprintf(`<tt:H264><tt:GovLength>%d</tt:GovLength><tt:H264Profile>%s</tt:H264Profile></tt:H264>`, c.GovLength, xmlEscape(c.H264))
+		}
+		multicast, timeout := c.Multicast, c.SessionTTL
+		if multicast == "" {
+			multicast = "0.0.0.0"
+		}
+		if timeout == "" {
+			timeout = "PT60S"
+		}
+		body := fmt.Sprintf(`<SetVideoEncoderConfiguration xmlns="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">`+
+			`<Configuration token="%s"><tt:Name>%s</tt:Name><tt:UseCount>%d</tt:UseCount><tt:Encoding>%s</tt:Encoding>`+
+			`<tt:Resolution><tt:Width>%d</tt:Width><tt:Height>%d</tt:Height></tt:Resolution><tt:Quality>%g</tt:Quality>`+
+			`<tt:RateControl><tt:FrameRateLimit>%d</tt:FrameRateLimit><tt:EncodingInterval>%d</tt:EncodingInterval><tt:BitrateLimit>%d</tt:BitrateLimit></tt:RateControl>`+
+			`%s<tt:Multicast><tt:Address><tt:Type>IPv4</tt:Type><tt:IPv4Address>%s</tt:IPv4Address></tt:Address>`+
+			`<tt:Port>%d</tt:Port><tt:TTL>%d</tt:TTL><tt:AutoStart>%t</tt:AutoStart></tt:Multicast>`+
+			`<tt:SessionTimeout>%s</tt:SessionTimeout></Configuration><ForcePersistence>true</ForcePersistence></SetVideoEncoderConfiguration>`,
+			xmlEscape(c.Token), xmlEscape(c.Name), c.UseCount, xmlEscape(c.Encoding), c.Width, c.Height, c.Quality,
+			c.FrameRate, max(c.Interval, 1), c.Bitrate, h264, xmlEscape(multicast), c.Port, c.TTL, c.AutoStart, xmlEscape(timeout))
+		if err := onvifCall(ctx, client, path, body, &struct{}{}); err != nil {
+			return err
+		}
+		status.Applied = true
+		return nil
+	}
+	return fmt.Errorf("ONVIF media service not available: %v", lastErr)
+}
+
+// checkGOP is called by a camera's ingest at each keyframe with the time
+// since the previous one and the video frames in between. Viewers joining
+// a stream wait up to a GOP for their first picture, so when keyframes are
+// more than KEYFRAME_MAX_INTERVAL apart the camera is asked for a GOP of
+// KEYFRAME_TARGET_INTERVAL, through the same settings as encoder profiles,
+// at most once per gopRetryInterval. A GOP set by the camera's encoder
+// profile is left alone.
+func (eg *EdgeGateway) checkGOP(camera *Camera, gap time.Duration, frames int) {
+	if eg.cfg.KeyframeMaxInterval <= 0 || gap <= eg.cfg.KeyframeMaxInterval || frames < 1 {
+		return
+	}
+	eg.gopLock.Lock()
+	if last, ok := eg.gopRequests[camera.ID]; ok && time.Since(last) < gopRetryInterval {
+		eg.gopLock.Unlock()
+		return
+	}
+	eg.gopRequests[camera.ID] = time.Now()
+	eg.gopLock.Unlock()
+
+	if profile, ok := eg.encoderProfiles.Get(camera.ID); ok && profile.GOPLength > 0 {
+		log.Printf("Camera %s sends a keyframe every %.1fs, keeping the GOP of its encoder profile", camera.ID, gap.Seconds())
+		return
+	}
+	// Frames per second from the GOP itself, which the camera keeps
+	length := max(1, int(math.Round(float64(frames)*eg.cfg.KeyframeTargetInterval.Seconds()/gap.Seconds())))
+	log.Printf("Camera %s sends a keyframe every %.1fs, asking for one every %d frames", camera.ID, gap.Seconds(), length)
+	copied := *camera
+	go func() {
+		status := eg.reconcileEncoder(eg.ctx, &copied, EncoderProfile{GOPLength: length})
+		status.KeyframeInterval = gap.Seconds()
+		eg.sendEvent("encoder_status", status)
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Error codes on failure events, so the cloud UI can suggest what to do
+// about a failure rather than show it as a stream that failed
+const (
+	errorCodeCameraUnreachable = "CAMERA_UNREACHABLE" // check its power, cabling and address
+	errorCodeAuthFailed        = "AUTH_FAILED"        // set its login with set_credentials
+	errorCodeCodecUnsupported  = "CODEC_UNSUPPORTED"  // set it to H.264 or enable transcoding
+	errorCodeICEFailed         = "ICE_FAILED"         // the viewer's network blocks WebRTC
+	errorCodeOverCapacity      = "OVER_CAPACITY"      // the gateway's uplink or CPU is full
+)
+
+// unreachableErrors are what dial failures say once an error has been
+// flattened to its message, as ingest errors are
+var unreachableErrors = []string{
+	"connection refused",
+	"no route to host",
+	"network is unreachable",
+	"host is down",
+	"no such host",
+	"i/o timeout",
+	"connection reset",
+}
+
+// errorCode classifies an error for a failure event's error_code, or
+// returns "" for errors that fit none of the codes
+func errorCode(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errOverCapacity):
+		return errorCodeOverCapacity
+	case errors.Is(err, errCredentialsRejected):
+		return errorCodeAuthFailed
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return errorCodeCameraUnreachable
+	}
+	return errorMessageCode(err.Error())
+}
+
+// errorMessageCode classifies an error by its message alone. RTSP logins
+// are refused as isRTSPAuthError recognizes them.
+func errorMessageCode(message string) string {
+	switch {
+	case strings.Contains(message, "StatusCode=401"), strings.Contains(message, "no username"), strings.Contains(message, "status 401"):
+		return errorCodeAuthFailed
+	case strings.Contains(message, "unsupported") && (strings.Contains(message, "rtsp:") || strings.Contains(message, "codec")):
+		return errorCodeCodecUnsupported
+	}
+	for _, s := range unreachableErrors {
+		if strings.Contains(message, s) {
+			return errorCodeCameraUnreachable
+		}
+	}
+	return ""
+}
+
+// addError adds the error, and its error_code, to a failure event
+func addError(payload map[string]interface{}, err error) {
+	payload["error"] = err.Error()
+	if code := errorCode(err); code != "" {
+		payload["error_code"] = code
+	}
+}
+
+// sendError sends a failure event with the error and its error_code
+func (eg *EdgeGateway) sendError(msgType string, payload map[string]interface{}, err error) {
+	addError(payload, err)
+	eg.sendEvent(msgType, payload)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Firmware upgrade states reported in firmware_status messages
+const (
+	firmwareStateDownloading = "downloading"
+	firmwareStateUploading   = "uploading"
+	firmwareStateRebooting   = "rebooting"
+	firmwareStateCompleted   = "completed"
+	firmwareStateUpToDate    = "up_to_date"
+	firmwareStateFailed      = "failed"
+)
+
+// firmwareMaxSize bounds a downloaded firmware image
+const firmwareMaxSize = 1 << 30
+
+// firmwarePollInterval is how often a rebooting camera is asked for its
+// firmware version
+const firmwarePollInterval = 10 * time.Second
+
+// FirmwareUpgradeRequest is the upgrade_firmware payload. The image is
+// downloaded once and installed on the cameras one at a time.
+type FirmwareUpgradeRequest struct {
+	CameraIDs []string `json:"camera_ids"`
+	Version   string   `json:"version"`
+	URL       string   `json:"url"`
+	SHA256    string   `json:"sha256"`
+	// FactoryDefault is none, the default, or soft, which resets all
+	// settings but the network ones
+	FactoryDefault string `json:"factory_default,omitempty"`
+}
+
+// validate checks the request before anything is downloaded
+func (r FirmwareUpgradeRequest) validate() error {
+	if len(r.CameraIDs) == 0 || r.Version == "" || r.SHA256 == "" {
+		return errors.New("camera_ids, version and sha256 are required")
+	}
+	if sum, err := hex.DecodeString(r.SHA256); err != nil || len(sum) != sha256.Size {
+		return errors.New("invalid sha256")
+	}
+	if u, err := url.Parse(r.URL); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("invalid firmware URL %q: https is required", redactCredentials(r.URL))
+	}
+	switch r.FactoryDefault {
+	case "", "none", "soft":
+	default:
+		return fmt.Errorf("invalid factory_default %q", r.FactoryDefault)
+	}
+	return nil
+}
+
+// reportFirmware sends a firmware_status message
+func (eg *EdgeGateway) reportFirmware(cameraID, version, state, current string, err error) {
+	payload := map[string]interface{}{
+		"camera_id": cameraID,
+		"version":   version,
+		"state":     state,
+	}
+	if current != "" {
+		payload["firmware"] = current
+	}
+	if err != nil {
+		addError(payload, err)
+		log.Printf("Firmware upgrade of camera %s to %s %s: %v", cameraID, version, state, err)
+	} else {
+		log.Printf("Firmware upgrade of camera %s to %s: %s", cameraID, version, state)
+	}
+	eg.sendEvent("firmware_status", payload)
+}
+
+// handleUpgradeFirmware holds the cameras of an upgrade_firmware request
+// and starts upgrading them, reporting each camera's progress in
+// firmware_status. It returns why the request was rejected as a whole.
+func (eg *EdgeGateway) handleUpgradeFirmware(ctx context.Context, req FirmwareUpgradeRequest) error {
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	// Hold the cameras, so a second request for one of them is refused
+	var cameras []string
+	for _, cameraID := range req.CameraIDs {
+		eg.camerasLock.RLock()
+		camera, exists := eg.cameras[cameraID]
+		var err error
+		switch {
+		case !exists:
+			err = errCameraNotFound
+		case camera.ParentID != "":
+			err = fmt.Errorf("camera is a sensor of camera %s, which must be upgraded instead", camera.ParentID)
+		case camera.Simulated:
+			err = errors.New("simulated cameras have no firmware")
+		case camera.Capabilities == nil || camera.Capabilities.Source != "vapix":
+			err = errors.New("firmware upgrades need an Axis camera")
+		}
+		eg.camerasLock.RUnlock()
+
+		if err == nil {
+			err = eg.beginMaintenance(cameraID, maintenanceFirmware)
+		}
+		if err != nil {
+			eg.reportFirmware(cameraID, req.Version, firmwareStateFailed, "", err)
+			continue
+		}
+		cameras = append(cameras, cameraID)
+	}
+	if len(cameras) == 0 {
+		return nil
+	}
+	// The download and the upgrades can take the better part of an hour, so
+	// they run in the background rather than hold up the cloud's messages
+	eg.goTracked(func() { eg.runFirmwareUpgrade(ctx, req, cameras) })
+	return nil
+}
+
+// runFirmwareUpgrade downloads the image and upgrades the held cameras,
+// reporting each one's progress with firmware_status
+func (eg *EdgeGateway) runFirmwareUpgrade(ctx context.Context, req FirmwareUpgradeRequest, cameras []string) {
+	for _, cameraID := range cameras {
+		eg.reportFirmware(cameraID, req.Version, firmwareStateDownloading, "", nil)
+	}
+	image, err := eg.downloadFirmware(ctx, req)
+	if err != nil {
+		for _, cameraID := range cameras {
+			eg.endMaintenance(cameraID)
+			eg.reportFirmware(cameraID, req.Version, firmwareStateFailed, "", err)
+		}
+		return
+	}
+	defer os.Remove(image)
+
+	// One camera at a time, so a bad image takes down one camera at most
+	for _, cameraID := range cameras {
+		current, err := eg.upgradeCamera(ctx, cameraID, req, image)
+		switch {
+		case err != nil:
+			eg.reportFirmware(cameraID, req.Version, firmwareStateFailed, current, err)
+		case current == "":
+			eg.reportFirmware(cameraID, req.Version, firmwareStateUpToDate, req.Version, nil)
+		default:
+			eg.reportFirmware(cameraID, req.Version, firmwareStateCompleted, current, nil)
+		}
+	}
+}
+
+// downloadFirmware saves the image to DATA_DIR and checks its SHA-256
+func (eg *EdgeGateway) downloadFirmware(ctx context.Context, req FirmwareUpgradeRequest) (string, error) {
+	f, err := os.CreateTemp(eg.cfg.DataDir, ".firmware-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	client := &http.Client{Timeout: 30 * time.Minute}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("download failed: %v", redactCredentials(err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("download failed with status %d", resp.StatusCode)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, firmwareMaxSize+1))
+	if err == nil && n > firmwareMaxSize {
+		err = errors.New("firmware image is too large")
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil && !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), req.SHA256) {
+		err = fmt.Errorf("checksum mismatch: got %s", hex.EncodeToString(h.Sum(nil)))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// upgradeCamera installs the image on a camera through the VAPIX firmware
+// management API and waits for it to come back up with the new version. The
+// camera's streams are stopped meanwhile and restarted once it is released
+// from maintenance. It returns the version the camera runs, or empty if it
+// already ran the requested one.
+func (eg *EdgeGateway) upgradeCamera(ctx context.Context, cameraID string, req FirmwareUpgradeRequest, image string) (string, error) {
+	streaming := false
+	defer func() {
+		eg.endMaintenance(cameraID)
+		if streaming {
+			if err := eg.startStream(cameraID); err != nil {
+				log.Printf("Failed to restart stream of camera %s after its firmware upgrade: %v", cameraID, err)
+			}
+		}
+	}()
+
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cameraID]
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return "", errCameraNotFound
+	}
+	client := eg.httpClients.Client(camera)
+
+	previous, err := vapixFirmwareVersion(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	if previous == req.Version {
+		return "", nil
+	}
+
+	streaming = eg.stopCameraStreams(cameraID)
+
+	eg.reportFirmware(cameraID, req.Version, firmwareStateUploading, previous, nil)
+	if err := vapixUploadFirmware(ctx, client, image, req.FactoryDefault); err != nil {
+		return previous, err
+	}
+
+	eg.reportFirmware(cameraID, req.Version, firmwareStateRebooting, previous, nil)
+	current, err := eg.awaitFirmware(ctx, client, previous, req.Version)
+	if err != nil {
+		return current, err
+	}
+	eg.setCameraFirmware(cameraID, current)
+	return current, nil
+}
+
+// stopCameraStreams stops the streams of a camera and its sensors,
+// reporting whether any were running
+func (eg *EdgeGateway) stopCameraStreams(cameraID string) bool {
+	eg.camerasLock.RLock()
+	ids := []string{cameraID}
+	for id, camera := range eg.cameras {
+		if camera.ParentID == cameraID {
+			ids = append(ids, id)
+		}
+	}
+	eg.camerasLock.RUnlock()
+
+	streaming := false
+	eg.streamsLock.RLock()
+	for _, stream := range eg.streams {
+		if stream.camera.ID == cameraID {
+			streaming = true
+		}
+	}
+	eg.streamsLock.RUnlock()
+	for _, id := range ids {
+		eg.stopStream(id)
+	}
+	return streaming
+}
+
+// awaitFirmware polls a rebooting camera until it runs the new version. A
+// camera that answers with its previous version after it went down rolled
+// the upgrade back.
+func (eg *EdgeGateway) awaitFirmware(ctx context.Context, client *CameraHTTPClient, previous, version string) (string, error) {
+	deadline := time.Now().Add(eg.cfg.FirmwareRebootTimeout)
+	wentDown := false
+	for {
+		select {
+		case <-ctx.Done():
+			return previous, ctx.Err()
+		case <-time.After(firmwarePollInterval):
+		}
+
+		current, err := vapixFirmwareVersion(ctx, client)
+		switch {
+		case err != nil:
+			wentDown = true
+		case current == version:
+			return current, nil
+		case current != previous:
+			return current, fmt.Errorf("camera came back with firmware %s", current)
+		case wentDown:
+			return current, errors.New("camera rolled back to its previous firmware")
+		}
+		if time.Now().After(deadline) {
+			return previous, fmt.Errorf("camera did not come back with the new firmware within %s", eg.cfg.FirmwareRebootTimeout)
+		}
+	}
+}
+
+// setCameraFirmware records a camera's new firmware version, and its
+// sensors', and reports the updated cameras
+func (eg *EdgeGateway) setCameraFirmware(cameraID, version string) {
+	eg.camerasLock.Lock()
+	var updated []*Camera
+	for id, camera := range eg.cameras {
+		if (id == cameraID || camera.ParentID == cameraID) && camera.Capabilities != nil {
+			copied := *camera
+			caps := *camera.Capabilities
+			caps.Firmware = version
+			copied.Capabilities = &caps
+			eg.cameras[id] = &copied
+			updated = append(updated, &copied)
+		}
+	}
+	eg.saveCamerasLocked()
+	eg.camerasLock.Unlock()
+
+	for _, camera := range updated {
+		eg.notifyCameraStatus(camera, "updated")
+	}
+}
+
+// vapixFirmwareVersion asks the firmware management API for the version the
+// camera runs
+func vapixFirmwareVersion(ctx context.Context, client *CameraHTTPClient) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, clockCheckTimeout)
+	defer cancel()
+	var status struct {
+		ActiveFirmwareVersion string `json:"activeFirmwareVersion"`
+	}
+	if err := vapixJSON(ctx, client, "/axis-cgi/firmwaremanagement.cgi", "1.0", "status", nil, &status); err != nil {
+		return "", err
+	}
+	if status.ActiveFirmwareVersion == "" {
+		return "", errors.New("camera reported no firmware version")
+	}
+	return status.ActiveFirmwareVersion, nil
+}
+
+// vapixUploadFirmware sends the image to the camera's firmware management
+// API, which installs it and reboots. The camera rolls back by itself if
+// the new firmware fails to start.
+func vapixUploadFirmware(ctx context.Context, client *CameraHTTPClient, image, factoryDefault string) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if factoryDefault == "" {
+		factoryDefault = "none"
+	}
+	params, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "1.0",
+		"method":     "upgrade",
+		"params":     map[string]interface{}{"factoryDefaultMode": factoryDefault},
+	})
+	boundary := randomHex(16)
+	head := fmt.Sprintf("--%s\r\nContent-Disposition: form-data; name=\"json\"\r\nContent-Type: application/json\r\n\r\n%s\r\n"+
+		"--%s\r\nContent-Disposition: form-data; name=\"file\"; filename=\"%s\"\r\nContent-Type: application/octet-stream\r\n\r\n",
+		boundary, params, boundary, filepath.Base(image))
+	tail := "\r\n--" + boundary + "--\r\n"
+	body := func() io.Reader {
+		return io.MultiReader(strings.NewReader(head), io.NewSectionReader(f, 0, info.Size()), strings.NewReader(tail))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.url("/axis-cgi/firmwaremanagement.cgi"), body())
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(head)) + info.Size() + int64(len(tail))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(body()), nil }
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+
+	resp, err := client.Upload(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload failed with status %d", resp.StatusCode)
+	}
+	var result struct {
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &result); err != nil {
+		return fmt.Errorf("invalid upgrade response: %v", err)
+	}
+	if result.Error != nil {
+		return fmt.Errorf("camera refused the firmware: %s (%d)", result.Error.Message, result.Error.Code)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Gateway <-> cloud orchestrator protocol over gRPC, and the binary
+// encoding of the WebSocket protocol (subprotocol edge-gateway.v1.protobuf),
+// where each frame is one GatewayMessage or CloudMessage.
+//
+// Each message type of the WebSocket protocol is a field of the
+// GatewayMessage or CloudMessage oneof, named after the WebSocket "type"
+// string. Field names match the WebSocket JSON keys, so a payload converts
+// with protojson (UseProtoNames) in either direction. A payload with a key
+// its message lacks is sent as Untyped instead, so nothing is dropped.
+//
+// Schema version 2, reported as api_versions.protobuf in hello. Version 2
+// added the actor and request_id of cloud commands, viewer session IDs,
+// stream tokens and watermarks, and the tenant_id and error_code of events.
+//
+// Regenerate with `make proto`.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v25.1.0
+// source: gateway.proto
+
+package gatewaypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	GatewayService_Connect_FullMethodName = "/anava.edgegateway.v1.GatewayService/Connect"
+)
+
+// GatewayServiceClient is the client API for GatewayService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type GatewayServiceClient interface {
+	// Connect opens a gateway session. The gateway identifies itself with
+	// x-gateway-id and x-gateway-version metadata, then both sides stream
+	// messages until either closes.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (GatewayService_ConnectClient, error)
+}
+
+type gatewayServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGatewayServiceClient(cc grpc.ClientConnInterface) GatewayServiceClient {
+	return &gatewayServiceClient{cc}
+}
+
+func (c *gatewayServiceClient) Connect(ctx context.Context, opts ...grpc.CallOption) (GatewayService_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &GatewayService_ServiceDesc.Streams[0], GatewayService_Connect_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gatewayServiceConnectClient{stream}
+	return x, nil
+}
+
+type GatewayService_ConnectClient interface {
+	Send(*GatewayMessage) error
+	Recv() (*CloudMessage, error)
+	grpc.ClientStream
+}
+
+type gatewayServiceConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *gatewayServiceConnectClient) Send(m *GatewayMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *gatewayServiceConnectClient) Recv() (*CloudMessage, error) {
+	m := new(CloudMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GatewayServiceServer is the server API for GatewayService service.
+// All implementations must embed UnimplementedGatewayServiceServer
+// for forward compatibility
+type GatewayServiceServer interface {
+	// Connect opens a gateway session. The gateway identifies itself with
+	// x-gateway-id and x-gateway-version metadata, then both sides stream
+	// messages until either closes.
+	Connect(GatewayService_ConnectServer) error
+	mustEmbedUnimplementedGatewayServiceServer()
+}
+
+// UnimplementedGatewayServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedGatewayServiceServer struct {
+}
+
+func (UnimplementedGatewayServiceServer) Connect(GatewayService_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedGatewayServiceServer) mustEmbedUnimplementedGatewayServiceServer() {}
+
+// UnsafeGatewayServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GatewayServiceServer will
+// result in compilation errors.
+type UnsafeGatewayServiceServer interface {
+	mustEmbedUnimplementedGatewayServiceServer()
+}
+
+func RegisterGatewayServiceServer(s grpc.ServiceRegistrar, srv GatewayServiceServer) {
+	s.RegisterService(&GatewayService_ServiceDesc, srv)
+}
+
+func _GatewayService_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GatewayServiceServer).Connect(&gatewayServiceConnectServer{stream})
+}
+
+type GatewayService_ConnectServer interface {
+	Send(*CloudMessage) error
+	Recv() (*GatewayMessage, error)
+	grpc.ServerStream
+}
+
+type gatewayServiceConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *gatewayServiceConnectServer) Send(m *CloudMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *gatewayServiceConnectServer) Recv() (*GatewayMessage, error) {
+	m := new(GatewayMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GatewayService_ServiceDesc is the grpc.ServiceDesc for GatewayService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var GatewayService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "anava.edgegateway.v1.GatewayService",
+	HandlerType: (*GatewayServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _GatewayService_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "gateway.proto",
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// GCSUploader writes and reads objects of a Cloud Storage bucket using
+// application default credentials
+type GCSUploader struct {
+	bucket string
+	client *http.Client
+}
+
+func NewGCSUploader(ctx context.Context, bucket string) (*GCSUploader, error) {
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, fmt.Errorf("no Google credentials for GCS: %v", err)
+	}
+	return &GCSUploader{
+		bucket: bucket,
+		client: oauth2.NewClient(ctx, ts),
+	}, nil
+}
+
+// Upload stores data as the named object, replacing any existing object
+func (u *GCSUploader) Upload(ctx context.Context, name, contentType, cacheControl string, data []byte) error {
+	return u.UploadWithMetadata(ctx, name, contentType, cacheControl, nil, data)
+}
+
+// UploadWithMetadata is Upload, giving the object custom metadata
+func (u *GCSUploader) UploadWithMetadata(ctx context.Context, name, contentType, cacheControl string, custom map[string]string, data []byte) error {
+	fields := map[string]interface{}{
+		"name":         name,
+		"contentType":  contentType,
+		"cacheControl": cacheControl,
+	}
+	if len(custom) > 0 {
+		fields["metadata"] = custom
+	}
+	metadata, _ := json.Marshal(fields)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	part.Write(metadata)
+	part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	part.Write(data)
+	mw.Close()
+
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=multipart",
+		url.PathEscape(u.bucket))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/related; boundary="+mw.Boundary())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GCS upload of %s failed with status %d: %s", name, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Download reads the named object
+func (u *GCSUploader) Download(ctx context.Context, name string) ([]byte, error) {
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+		url.PathEscape(u.bucket), url.PathEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GCS download of %s failed with status %d: %s", name, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return io.ReadAll(resp.Body)
+}
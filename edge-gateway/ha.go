@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The roles of the gateways of a high-availability pair, as configured.
+// Either can be the active one at any time.
+const (
+	haRoleActive  = "active"
+	haRoleStandby = "standby"
+)
+
+// haHeartbeatInterval is how often each gateway of a pair checks the other
+const haHeartbeatInterval = 2 * time.Second
+
+// Why a gateway of a pair became active, or stepped down
+const (
+	haReasonStartup         = "startup"
+	haReasonPeerUnreachable = "peer_unreachable"
+	haReasonPeerStandby     = "peer_standby"
+	haReasonPeerActive      = "peer_active"
+)
+
+// haMirroredFiles are the files in DATA_DIR a standby copies from the
+// active: the camera inventory and credentials, encryption keys, privacy
+// masks and the config set from the cloud. Taking over starts from them as
+// the active would after a restart.
+var haMirroredFiles = []string{
+	"cameras.json",
+	"credentials.json",
+	"e2ee_keys.json",
+	"privacy_masks.json",
+	"config.json",
+}
+
+// HASnapshot is a gateway of a pair as its peer sees it. Only the active
+// sends the files the standby mirrors.
+type HASnapshot struct {
+	GatewayID   string            `json:"gateway_id"`
+	Active      bool              `json:"active"`
+	ActiveSince *time.Time        `json:"active_since,omitempty"`
+	Files       map[string][]byte `json:"files,omitempty"`
+}
+
+// HAPeer is the other gateway of the pair as last checked
+type HAPeer struct {
+	URL       string     `json:"url"`
+	ID        string     `json:"id,omitempty"`
+	Reachable bool       `json:"reachable"`
+	Active    bool       `json:"active"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// HAStatus is the gateway's part in its pair
+type HAStatus struct {
+	Role                string     `json:"role"`
+	State               string     `json:"state"` // active or standby
+	GatewayID           string     `json:"gateway_id"`
+	ActiveSince         *time.Time `json:"active_since,omitempty"`
+	LastSync            *time.Time `json:"last_sync,omitempty"`
+	FailoverTimeoutSecs float64    `json:"failover_timeout_secs"`
+	Peer                HAPeer     `json:"peer"`
+}
+
+// HAPair is the gateway's side of an active/standby pair. The standby runs
+// nothing but the local API, mirrors the active's state, and takes over the
+// cloud connection and cameras when the active fails.
+type HAPair struct {
+	lock     sync.Mutex
+	role     string
+	secret   string
+	timeout  time.Duration
+	client   *http.Client
+	active   bool
+	since    time.Time // when the gateway became active
+	peer     HAPeer
+	lastSync time.Time
+}
+
+// NewHAPair returns the gateway's side of its pair, or nil unless HA_ROLE
+// is set
+func NewHAPair(cfg *Config) *HAPair {
+	if cfg.HARole == "" {
+		return nil
+	}
+	return &HAPair{
+		role:    cfg.HARole,
+		secret:  cfg.HASecret,
+		timeout: cfg.HAFailoverTimeout,
+		client: &http.Client{
+			Timeout:   haHeartbeatInterval,
+			Transport: &http.Transport{TLSClientConfig: haPeerTLSConfig(cfg)},
+		},
+		peer: HAPeer{URL: cfg.HAPeerURL},
+	}
+}
+
+// haPeerTLSConfig verifies the peer's certificate against HA_PEER_CA_FILE,
+// or the system roots without it
+func haPeerTLSConfig(cfg *Config) *tls.Config {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.HAPeerCAFile == "" {
+		return tlsConfig
+	}
+	pool := x509.NewCertPool()
+	pem, err := os.ReadFile(cfg.HAPeerCAFile)
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = errors.New("no certificates found")
+	}
+	if err != nil {
+		log.Printf("HA: failed to load CA file %s, using system roots: %v", cfg.HAPeerCAFile, err)
+		return tlsConfig
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig
+}
+
+// isActive reports whether the gateway is the active one of its pair
+func (h *HAPair) isActive() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.active
+}
+
+// authorized reports whether a request carries the pair's secret
+func (h *HAPair) authorized(r *http.Request) bool {
+	want := "Bearer " + h.secret
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// pollPeer fetches the peer's snapshot and records how it answered
+func (h *HAPair) pollPeer(ctx context.Context) (*HASnapshot, error) {
+	snapshot, err := h.fetchPeer(ctx)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.peer.Reachable = err == nil
+	h.peer.Error = ""
+	if err != nil {
+		h.peer.Active = false
+		h.peer.Error = err.Error()
+		return nil, err
+	}
+	now := time.Now().UTC()
+	h.peer.ID = snapshot.GatewayID
+	h.peer.Active = snapshot.Active
+	h.peer.LastSeen = &now
+	return snapshot, nil
+}
+
+func (h *HAPair) fetchPeer(ctx context.Context) (*HASnapshot, error) {
+	// The snapshot holds camera credentials and E2EE keys
+	if !strings.HasPrefix(h.peer.URL, "https://") {
+		return nil, errors.New("HA_PEER_URL isn't https://")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.peer.URL+"/api/ha/state", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.secret)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+	var snapshot HASnapshot
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.GatewayID == getGatewayID() {
+		return nil, errors.New("HA_PEER_URL points at this gateway")
+	}
+	return &snapshot, nil
+}
+
+// haSnapshot returns the gateway as its peer sees it, with the mirrored
+// files if it is active
+func (eg *EdgeGateway) haSnapshot() HASnapshot {
+	h := eg.ha
+	h.lock.Lock()
+	snapshot := HASnapshot{GatewayID: getGatewayID(), Active: h.active}
+	if h.active {
+		since := h.since
+		snapshot.ActiveSince = &since
+	}
+	h.lock.Unlock()
+	if !snapshot.Active {
+		return snapshot
+	}
+
+	snapshot.Files = make(map[string][]byte)
+	for _, name := range haMirroredFiles {
+		data, err := os.ReadFile(filepath.Join(eg.cfg.DataDir, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("HA: failed to read %s for the standby: %v", name, err)
+			}
+			continue
+		}
+		snapshot.Files[name] = data
+	}
+	return snapshot
+}
+
+// mirrorPeer copies the active's files to DATA_DIR, removing those it
+// doesn't have
+func (eg *EdgeGateway) mirrorPeer(snapshot *HASnapshot) error {
+	for _, name := range haMirroredFiles {
+		path := filepath.Join(eg.cfg.DataDir, name)
+		data, exists := snapshot.Files[name]
+		if !exists {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+			continue
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+		debugf("HA: mirrored %s from %s", name, snapshot.GatewayID)
+	}
+	h := eg.ha
+	h.lock.Lock()
+	h.lastSync = time.Now().UTC()
+	h.lock.Unlock()
+	return nil
+}
+
+// awaitActive returns once the gateway is the active one of its pair, or
+// false if ctx ends first. A gateway configured as active becomes it at
+// once unless its peer took over while it was down; otherwise it mirrors
+// the active, and takes over after HA_FAILOVER_TIMEOUT without reaching
+// it. A configured active waiting as standby takes back over as soon as
+// its peer is up but not active.
+func (eg *EdgeGateway) awaitActive(ctx context.Context) bool {
+	h := eg.ha
+	if h == nil {
+		return true
+	}
+	if h.role == haRoleActive {
+		snapshot, err := h.pollPeer(ctx)
+		if err != nil || !snapshot.Active {
+			eg.becomeActive(haReasonStartup)
+			return true
+		}
+		log.Printf("HA: peer %s took over while this gateway was down, waiting as its standby", snapshot.GatewayID)
+	}
+
+	log.Printf("HA: standby for %s, taking over after %s without a healthy active", h.peer.URL, h.timeout)
+	sdNotify("READY=1\nSTATUS=Standby for " + h.peer.URL)
+	ticker := time.NewTicker(haHeartbeatInterval)
+	defer ticker.Stop()
+	lastActive := time.Now()
+	for {
+		snapshot, err := h.pollPeer(ctx)
+		switch {
+		case err == nil && snapshot.Active:
+			lastActive = time.Now()
+			if err := eg.mirrorPeer(snapshot); err != nil {
+				log.Printf("HA: failed to mirror %s: %v", snapshot.GatewayID, err)
+			}
+		case err == nil && h.role == haRoleActive:
+			eg.becomeActive(haReasonPeerStandby)
+			return true
+		case time.Since(lastActive) >= h.timeout:
+			reason := haReasonPeerStandby
+			if err != nil {
+				reason = haReasonPeerUnreachable
+				log.Printf("HA: active unreachable for %s: %v", h.timeout, err)
+			}
+			eg.becomeActive(reason)
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// becomeActive makes the gateway the active one of its pair, and tells the
+// cloud, once connected, so it routes the pair's cameras here
+func (eg *EdgeGateway) becomeActive(reason string) {
+	h := eg.ha
+	h.lock.Lock()
+	h.active = true
+	h.since = time.Now().UTC()
+	since, peerID := h.since, h.peer.ID
+	h.lock.Unlock()
+
+	log.Printf("HA: gateway is active (%s)", reason)
+	sdNotify("STATUS=Active")
+	eg.sendEvent("ha_state", map[string]interface{}{
+		"state":        haRoleActive,
+		"reason":       reason,
+		"peer_id":      peerID,
+		"active_since": since,
+	})
+}
+
+// runHA checks on the standby while the gateway is active. Should the
+// peer have become active too, after the pair lost sight of each other,
+// the gateway that became active first steps down, restarting to wait as
+// the standby of the other, which the cloud was told to route to last.
+func (eg *EdgeGateway) runHA(ctx context.Context) {
+	h := eg.ha
+	if h == nil {
+		return
+	}
+	ticker := time.NewTicker(haHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		snapshot, err := h.pollPeer(ctx)
+		if err != nil || !snapshot.Active || snapshot.ActiveSince == nil {
+			continue
+		}
+		h.lock.Lock()
+		since := h.since
+		h.lock.Unlock()
+		peerSince := *snapshot.ActiveSince
+		if since.After(peerSince) || since.Equal(peerSince) && getGatewayID() > snapshot.GatewayID {
+			continue
+		}
+
+		log.Printf("HA: peer %s is active too, stepping down", snapshot.GatewayID)
+		eg.sendEvent("ha_state", map[string]interface{}{
+			"state":   haRoleStandby,
+			"reason":  haReasonPeerActive,
+			"peer_id": snapshot.GatewayID,
+		})
+		eg.requestRestart("ha_standby")
+		return
+	}
+}
+
+// haStatus returns the gateway's part in its pair
+func (eg *EdgeGateway) haStatus() HAStatus {
+	h := eg.ha
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	status := HAStatus{
+		Role:                h.role,
+		State:               haRoleStandby,
+		GatewayID:           getGatewayID(),
+		FailoverTimeoutSecs: h.timeout.Seconds(),
+		Peer:                h.peer,
+	}
+	if h.active {
+		since := h.since
+		status.State = haRoleActive
+		status.ActiveSince = &since
+	}
+	if !h.lastSync.IsZero() {
+		lastSync := h.lastSync
+		status.LastSync = &lastSync
+	}
+	return status
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Camera states in the /status document, besides the quarantine states
+const (
+	cameraStatusStreaming = "streaming"
+	cameraStatusIdle      = "idle"
+)
+
+// GatewayStatus is the /status document: readiness, the cloud link, and the
+// health of every camera
+type GatewayStatus struct {
+	GatewayID  string                     `json:"gateway_id"`
+	Version    string                     `json:"version"`
+	UptimeSecs float64                    `json:"uptime_secs"`
+	Ready      bool                       `json:"ready"`
+	Reason     string                     `json:"reason"`
+	Cloud      CloudStatus                `json:"cloud"`
+	Resources  *Telemetry                 `json:"resources,omitempty"` // as of the last telemetry report
+	Subsystems map[string]SubsystemHealth `json:"subsystems"`
+	Cameras    []CameraHealth             `json:"cameras"`
+}
+
+// CameraHealth summarizes one camera for /status
+type CameraHealth struct {
+	CameraID string         `json:"camera_id"`
+	Name     string         `json:"name"`
+	IP       string         `json:"ip"`
+	State    string         `json:"state"`
+	Streams  []StreamHealth `json:"streams"`
+}
+
+// readiness reports whether the gateway can do its job: it is connected to
+// the cloud, or it can run offline because DATA_DIR is usable for the
+// camera inventory and the event queue
+func (eg *EdgeGateway) readiness() (bool, string) {
+	switch {
+	case eg.ctx.Err() != nil:
+		return false, "shutting_down"
+	case eg.ha != nil && !eg.ha.isActive():
+		return false, "standby"
+	case eg.CloudStatus().State == cloudStateConnected:
+		return true, "cloud_connected"
+	case dataDirStorage(eg.cfg.DataDir).Available:
+		return true, "offline"
+	}
+	return false, "cloud_unreachable_and_data_dir_unavailable"
+}
+
+// cameraHealth returns every camera's state: its quarantine state if it is
+// quarantined or on probation, otherwise the worst state of its streams, or
+// idle if none are running
+func (eg *EdgeGateway) cameraHealth() []CameraHealth {
+	streams := make(map[string][]StreamHealth)
+	for _, h := range eg.streamHealth() {
+		streams[h.CameraID] = append(streams[h.CameraID], h)
+	}
+
+	cameras := eg.listCameras()
+	health := make([]CameraHealth, 0, len(cameras))
+	for _, camera := range cameras {
+		h := CameraHealth{
+			CameraID: camera.ID,
+			Name:     camera.Name,
+			IP:       camera.IP,
+			State:    eg.quarantine.State(camera.ID),
+			Streams:  streams[camera.ID],
+		}
+		if h.Streams == nil {
+			h.Streams = []StreamHealth{}
+		}
+		if h.State == cameraStateHealthy {
+			h.State = worstStreamState(h.Streams)
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].CameraID < health[j].CameraID })
+	return health
+}
+
+// worstStreamState returns stalled, degraded or streaming for a camera's
+// streams, or idle if it has none
+func worstStreamState(streams []StreamHealth) string {
+	if len(streams) == 0 {
+		return cameraStatusIdle
+	}
+	state := cameraStatusStreaming
+	for _, s := range streams {
+		switch s.State {
+		case streamStalled:
+			return streamStalled
+		case streamDegraded:
+			state = streamDegraded
+		}
+	}
+	return state
+}
+
+// handleHealthz answers liveness probes: the process is up and serving
+func (eg *EdgeGateway) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz answers readiness probes with 503 until the gateway is ready
+func (eg *EdgeGateway) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, reason := eg.readiness()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"ready":  ready,
+		"reason": reason,
+	})
+}
+
+// handleStatus returns the full status document
+func (eg *EdgeGateway) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ready, reason := eg.readiness()
+	writeJSON(w, http.StatusOK, GatewayStatus{
+		GatewayID:  getGatewayID(),
+		Version:    Version,
+		UptimeSecs: time.Since(eg.startedAt).Seconds(),
+		Ready:      ready,
+		Reason:     reason,
+		Cloud:      eg.CloudStatus(),
+		Resources:  eg.latestTelemetry(),
+		Subsystems: eg.subsystems(),
+		Cameras:    eg.cameraHealth(),
+	})
+}
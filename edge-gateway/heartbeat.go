@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// cloudHeartbeatInterval is how often the gateway pings the cloud with its
+// heartbeat
+const cloudHeartbeatInterval = 30 * time.Second
+
+// Subsystem states in heartbeats and /status
+const (
+	subsystemOK       = "ok"
+	subsystemDegraded = "degraded"
+	subsystemDown     = "down"
+	subsystemDisabled = "disabled"
+)
+
+// SubsystemHealth is the state of one part of the gateway
+type SubsystemHealth struct {
+	State string `json:"state"`
+	// What it looks after: cameras, streams, viewers or recorded cameras
+	Count  int    `json:"count"`
+	Detail string `json:"detail,omitempty"` // why it isn't ok
+}
+
+// Heartbeat is the payload of the pings the gateway sends the cloud
+type Heartbeat struct {
+	Seq        uint64                     `json:"seq"`
+	Version    string                     `json:"version"`
+	UptimeSecs float64                    `json:"uptime_secs"`
+	Subsystems map[string]SubsystemHealth `json:"subsystems"`
+	Queues     map[string]int             `json:"queues"` // items waiting, by queue
+}
+
+// subsystemResult is when a subsystem that is only known by what it last
+// did last failed and last succeeded
+type subsystemResult struct {
+	err      string
+	failedAt time.Time
+	okAt     time.Time
+}
+
+// subsystemResults are the latest results of discovery and recording
+type subsystemResults struct {
+	lock    sync.Mutex
+	results map[string]subsystemResult
+}
+
+// recordSubsystem notes that an operation of a subsystem succeeded or
+// failed
+func (eg *EdgeGateway) recordSubsystem(name string, err error) {
+	r := &eg.subsystemResults
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.results == nil {
+		r.results = make(map[string]subsystemResult)
+	}
+	result := r.results[name]
+	if err != nil {
+		result.err, result.failedAt = err.Error(), time.Now()
+	} else {
+		result.okAt = time.Now()
+	}
+	r.results[name] = result
+}
+
+// subsystemError returns a subsystem's last failure, unless it has
+// succeeded since
+func (eg *EdgeGateway) subsystemError(name string) string {
+	r := &eg.subsystemResults
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := r.results[name]
+	if result.err == "" || result.okAt.After(result.failedAt) {
+		return ""
+	}
+	return result.err
+}
+
+// subsystems reports the health of discovery, camera ingest, WebRTC
+// delivery and recording to GCS
+func (eg *EdgeGateway) subsystems() map[string]SubsystemHealth {
+	eg.camerasLock.RLock()
+	cameras := len(eg.cameras)
+	eg.camerasLock.RUnlock()
+	discovery := SubsystemHealth{State: subsystemOK, Count: cameras}
+	if err := eg.subsystemError("discovery"); err != "" {
+		discovery.State, discovery.Detail = subsystemDegraded, err
+	}
+
+	streams := eg.streamHealth()
+	ingest := SubsystemHealth{State: subsystemOK, Count: len(streams)}
+	stalled, degraded := 0, 0
+	for _, h := range streams {
+		switch h.State {
+		case streamStalled:
+			stalled++
+		case streamDegraded:
+			degraded++
+		}
+	}
+	switch {
+	case stalled > 0 && stalled == len(streams):
+		ingest.State, ingest.Detail = subsystemDown, "every stream stalled"
+	case stalled > 0:
+		ingest.State, ingest.Detail = subsystemDegraded, fmt.Sprintf("%d of %d streams stalled", stalled, len(streams))
+	case degraded > 0:
+		ingest.State, ingest.Detail = subsystemDegraded, fmt.Sprintf("%d of %d streams degraded", degraded, len(streams))
+	}
+
+	eg.viewersLock.Lock()
+	viewers := make([]*Viewer, 0, len(eg.viewers))
+	for _, v := range eg.viewers {
+		viewers = append(viewers, v)
+	}
+	eg.viewersLock.Unlock()
+	delivery := SubsystemHealth{State: subsystemOK, Count: len(viewers)}
+	disconnected := 0
+	for _, v := range viewers {
+		switch v.pc.ConnectionState() {
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+			disconnected++
+		}
+	}
+	if disconnected > 0 {
+		delivery.State, delivery.Detail = subsystemDegraded, fmt.Sprintf("%d of %d viewers disconnected", disconnected, len(viewers))
+	}
+
+	recorder := SubsystemHealth{State: subsystemDisabled}
+	if eg.cfg.EventClipsEnabled || eg.cfg.HLSGCSBucket != "" {
+		recorder.State = subsystemOK
+		if eg.cfg.EventClipsEnabled {
+			recorder.Count = len(eg.eventClipCameras())
+		}
+		if err := eg.subsystemError("recorder"); err != "" {
+			recorder.State, recorder.Detail = subsystemDegraded, err
+		}
+	}
+
+	return map[string]SubsystemHealth{
+		"discovery": discovery,
+		"ingest":    ingest,
+		"webrtc":    delivery,
+		"recorder":  recorder,
+	}
+}
+
+// queueDepths returns the items waiting in the gateway's queues
+func (eg *EdgeGateway) queueDepths() map[string]int {
+	queues := map[string]int{
+		"cloud_events": eg.outbox.Len(),
+		"hls_uploads":  int(eg.hlsPending.Load()),
+	}
+	if eg.mqtt != nil {
+		queues["mqtt"] = len(eg.mqtt.queue)
+	}
+	queues["cloud_messages"], queues["cloud_messages_deepest"] = eg.dispatcher.Depths()
+	eg.credentialRequestsLock.Lock()
+	queues["credential_requests"] = len(eg.credentialRequests)
+	eg.credentialRequestsLock.Unlock()
+	return queues
+}
+
+// sendHeartbeat pings the cloud with the gateway's health
+func (eg *EdgeGateway) sendHeartbeat() {
+	data, err := json.Marshal(Heartbeat{
+		Seq:        eg.heartbeatSeq.Add(1),
+		Version:    Version,
+		UptimeSecs: time.Since(eg.startedAt).Seconds(),
+		Subsystems: eg.subsystems(),
+		Queues:     eg.queueDepths(),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal heartbeat: %v", err)
+		return
+	}
+	eg.sendToCloud(WSMessage{Type: "ping", Payload: data})
+}
+
+// checkPong closes the cloud connection once the orchestrator, having
+// answered pings on it, hasn't for CLOUD_PONG_TIMEOUT, so the gateway
+// reconnects instead of waiting for TCP to notice a dead path.
+// Orchestrators that never answer aren't affected.
+func (eg *EdgeGateway) checkPong() {
+	timeout := eg.cfg.CloudPongTimeout
+	last := eg.lastPong.Load()
+	if timeout <= 0 || last == 0 || time.Since(time.Unix(0, last)) < timeout {
+		return
+	}
+	eg.cloudLock.Lock()
+	conn := eg.cloudConn
+	eg.cloudLock.Unlock()
+	if conn == nil {
+		return
+	}
+	log.Printf("No pong from the cloud for %s, reconnecting", time.Since(time.Unix(0, last)).Round(time.Second))
+	eg.lastPong.Store(0)
+	conn.Close()
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4f"
+)
+
+// hlsLeaseTimeout is how long an on-demand stream stays up after the last
+// HLS request
+const hlsLeaseTimeout = 30 * time.Second
+
+// hlsDateTimeFormat is the ISO 8601 form of EXT-X-PROGRAM-DATE-TIME
+const hlsDateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// hlsSegment is one fMP4 media segment held in memory
+type hlsSegment struct {
+	seq           int
+	start         time.Time // wall clock time of its first frame
+	duration      time.Duration
+	initVersion   int
+	discontinuity bool
+	data          []byte
+}
+
+// HLSPackager cuts a camera's video into fMP4 segments and keeps a sliding
+// window of them for HLS playback
+type HLSPackager struct {
+	cameraID        string
+	segmentDuration time.Duration
+	maxSegments     int
+	upload          func(name, contentType, cacheControl string, data []byte)
+
+	lock     sync.RWMutex
+	muxer    *mp4f.Muxer
+	videoIdx int8
+	inits    map[int][]byte
+	initVer  int
+	segments []hlsSegment
+	nextSeq  int
+	discSeq  int
+
+	// Segment being assembled
+	pending      []byte
+	pendingStart time.Duration
+	pendingWall  time.Time
+	lastTime     time.Duration // time of the last fragment in pending
+	started      bool
+	discontinue  bool
+	// finished is set once the playlist has been ended
+	finished bool
+}
+
+func NewHLSPackager(cameraID string, segmentDuration time.Duration, maxSegments int) *HLSPackager {
+	return &HLSPackager{
+		cameraID:        cameraID,
+		segmentDuration: segmentDuration,
+		maxSegments:     maxSegments,
+		inits:           make(map[int][]byte),
+	}
+}
+
+// Reset starts a new muxer for a fresh RTSP session. The next segment is
+// marked as a discontinuity since timestamps and codec settings may change.
+func (h *HLSPackager) Reset(codecs []av.CodecData) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.muxer = nil
+	for i, codec := range codecs {
+		if codec.Type().IsVideo() {
+			muxer := mp4f.NewMuxer(nil)
+			muxer.WriteHeader([]av.CodecData{codec})
+			_, init := muxer.GetInit([]av.CodecData{codec})
+			if len(init) == 0 {
+				log.Printf("HLS: unsupported video codec for camera %s", h.cameraID)
+				return
+			}
+			h.muxer = muxer
+			h.videoIdx = int8(i)
+			h.initVer++
+			h.inits[h.initVer] = init
+			h.publish(fmt.Sprintf("init-%d.mp4", h.initVer), "video/mp4", "max-age=3600", init)
+			break
+		}
+	}
+
+	h.pending = nil
+	h.started = false
+	h.discontinue = len(h.segments) > 0
+}
+
+// WritePacket adds a packet from the RTSP session
+func (h *HLSPackager) WritePacket(pkt av.Packet) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.muxer == nil || h.finished || pkt.Idx != h.videoIdx {
+		return
+	}
+	// Segments must start on a keyframe
+	if !h.started {
+		if !pkt.IsKeyFrame {
+			return
+		}
+		h.started = true
+		h.pendingStart = pkt.Time
+		h.pendingWall = time.Now()
+	}
+
+	pkt.Idx = 0
+	got, fragment, err := h.muxer.WritePacket(pkt, true)
+	if err != nil {
+		log.Printf("HLS: mux error for camera %s: %v", h.cameraID, err)
+		return
+	}
+	if !got {
+		return
+	}
+
+	// A fragment is emitted at each keyframe and holds the previous GOP
+	h.pending = append(h.pending, fragment...)
+	h.lastTime = pkt.Time
+	if elapsed := pkt.Time - h.pendingStart; elapsed >= h.segmentDuration {
+		h.closeSegment(elapsed)
+		h.pendingStart = pkt.Time
+		h.pendingWall = time.Now()
+	}
+}
+
+// closeSegment must be called with the lock held
+func (h *HLSPackager) closeSegment(duration time.Duration) {
+	seg := hlsSegment{
+		seq:           h.nextSeq,
+		start:         h.pendingWall,
+		duration:      duration,
+		initVersion:   h.initVer,
+		discontinuity: h.discontinue,
+		data:          h.pending,
+	}
+	h.nextSeq++
+	h.pending = nil
+	h.discontinue = false
+
+	h.segments = append(h.segments, seg)
+	for len(h.segments) > h.maxSegments {
+		if h.segments[0].discontinuity {
+			h.discSeq++
+		}
+		h.segments = h.segments[1:]
+	}
+
+	// Drop init segments no longer referenced
+	for version := range h.inits {
+		if version < h.segments[0].initVersion {
+			delete(h.inits, version)
+		}
+	}
+
+	h.publish(fmt.Sprintf("seg-%d.m4s", seg.seq), "video/iso.segment", "max-age=3600", seg.data)
+	h.publish("index.m3u8", "application/vnd.apple.mpegurl", "no-cache", []byte(h.playlistLocked()))
+}
+
+// Finish closes the segment in progress and ends the playlist. Packets
+// written afterwards are ignored.
+func (h *HLSPackager) Finish() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.finished {
+		return
+	}
+	h.finished = true
+	if len(h.pending) > 0 {
+		h.closeSegment(h.lastTime - h.pendingStart)
+	} else if len(h.segments) > 0 {
+		h.publish("index.m3u8", "application/vnd.apple.mpegurl", "no-cache", []byte(h.playlistLocked()))
+	}
+}
+
+// publish must be called with the lock held
+func (h *HLSPackager) publish(name, contentType, cacheControl string, data []byte) {
+	if h.upload != nil {
+		h.upload(name, contentType, cacheControl, data)
+	}
+}
+
+// Playlist returns the live media playlist
+func (h *HLSPackager) Playlist() (string, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.segments) == 0 {
+		return "", false
+	}
+	return h.playlistLocked(), true
+}
+
+func (h *HLSPackager) playlistLocked() string {
+	target := h.segmentDuration
+	for _, seg := range h.segments {
+		if seg.duration > target {
+			target = seg.duration
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.segments[0].seq)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", h.discSeq)
+
+	initVersion := 0
+	for _, seg := range h.segments {
+		if seg.discontinuity && initVersion != 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.initVersion != initVersion {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", seg.initVersion)
+			initVersion = seg.initVersion
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.start.UTC().Format(hlsDateTimeFormat))
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg-%d.m4s\n", seg.duration.Seconds(), seg.seq)
+	}
+	if h.finished {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+// Init returns an init segment by version
+func (h *HLSPackager) Init(version int) ([]byte, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	data, ok := h.inits[version]
+	return data, ok
+}
+
+// Segment returns a media segment by sequence number
+func (h *HLSPackager) Segment(seq int) ([]byte, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, seg := range h.segments {
+		if seg.seq == seq {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+// hlsEnabledFor reports whether HLS packaging is configured for a camera
+func (eg *EdgeGateway) hlsEnabledFor(cameraID string) bool {
+	settings := eg.settings()
+	if !settings.HLSEnabled {
+		return false
+	}
+	if len(settings.HLSCameras) == 0 {
+		return true
+	}
+	for _, id := range settings.HLSCameras {
+		if id == cameraID {
+			return true
+		}
+	}
+	return false
+}
+
+// newHLSPackager creates a packager for a camera, wired to the GCS uploader
+// when one is configured
+func (eg *EdgeGateway) newHLSPackager(cameraID string) *HLSPackager {
+	h := NewHLSPackager(cameraID, eg.cfg.HLSSegmentDuration, eg.cfg.HLSPlaylistSegments)
+	if eg.hlsUploads != nil {
+		prefix := path.Join(eg.cfg.HLSGCSPrefix, getGatewayID(), cameraID)
+		h.upload = func(name, contentType, cacheControl string, data []byte) {
+			eg.hlsPending.Add(1)
+			select {
+			case eg.hlsUploads <- hlsUpload{path.Join(prefix, name), contentType, cacheControl, data}:
+			default:
+				eg.hlsPending.Add(-1)
+				log.Printf("HLS: upload queue full, dropping %s", name)
+			}
+		}
+	}
+	return h
+}
+
+// hlsUpload is a queued GCS object write
+type hlsUpload struct {
+	name         string
+	contentType  string
+	cacheControl string
+	data         []byte
+}
+
+// runHLSUploads pushes HLS objects to GCS until ctx is cancelled. Shutdown
+// cancels ctx only after draining, so final segments and playlists get out.
+func (eg *EdgeGateway) runHLSUploads(ctx context.Context) {
+	uploader, err := NewGCSUploader(ctx, eg.cfg.HLSGCSBucket)
+	if err != nil {
+		log.Printf("HLS: GCS upload disabled: %v", err)
+		eg.recordSubsystem("recorder", err)
+	} else {
+		log.Printf("HLS: pushing segments to gs://%s/%s", eg.cfg.HLSGCSBucket, eg.cfg.HLSGCSPrefix)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case up := <-eg.hlsUploads:
+			if uploader != nil {
+				uctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				err := uploader.Upload(uctx, up.name, up.contentType, up.cacheControl, up.data)
+				if err != nil {
+					log.Printf("HLS: %v", err)
+				}
+				cancel()
+				eg.recordSubsystem("recorder", err)
+			}
+			eg.hlsPending.Add(-1)
+		}
+	}
+}
+
+// handleHLS serves /hls/{cameraID}/index.m3u8 and the segments it lists.
+// The camera's stream is opened on demand and kept up while players poll.
+func (eg *EdgeGateway) handleHLS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	cameraID, name := path.Split(strings.TrimPrefix(r.URL.Path, "/hls/"))
+	cameraID = strings.Trim(cameraID, "/")
+	if !eg.hlsEnabledFor(cameraID) {
+		writeError(w, http.StatusNotFound, "HLS not enabled for camera")
+		return
+	}
+
+	stream := eg.leaseHLSStream(cameraID)
+	if stream == nil || stream.hls == nil {
+		writeError(w, http.StatusServiceUnavailable, "no stream available for camera")
+		return
+	}
+	h := stream.hls
+
+	switch {
+	case name == "index.m3u8":
+		playlist, ok := h.Playlist()
+		if !ok {
+			// The first segment isn't ready yet
+			w.Header().Set("Retry-After", "2")
+			writeError(w, http.StatusServiceUnavailable, "stream starting")
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+
+	case strings.HasPrefix(name, "init-") && strings.HasSuffix(name, ".mp4"):
+		version, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "init-"), ".mp4"))
+		data, ok := h.Init(version)
+		if !ok {
+			writeError(w, http.StatusNotFound, "init segment not found")
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(data)
+
+	case strings.HasPrefix(name, "seg-") && strings.HasSuffix(name, ".m4s"):
+		seq, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg-"), ".m4s"))
+		data, ok := h.Segment(seq)
+		if !ok {
+			writeError(w, http.StatusNotFound, "segment not found")
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Write(data)
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// leaseHLSStream opens the camera's main stream on demand and holds it as a
+// viewer until no HLS request has arrived for hlsLeaseTimeout
+func (eg *EdgeGateway) leaseHLSStream(cameraID string) *CameraStream {
+	eg.hlsLock.Lock()
+	defer eg.hlsLock.Unlock()
+
+	if lease, exists := eg.hlsLeases[cameraID]; exists && lease.stream.running() {
+		lease.timer.Reset(hlsLeaseTimeout)
+		return lease.stream
+	}
+
+	stream, err := eg.openStream(cameraID, viewerProfileMain, true)
+	if err != nil {
+		return nil
+	}
+	stream.addViewer()
+
+	lease := &hlsLease{stream: stream}
+	lease.timer = time.AfterFunc(hlsLeaseTimeout, func() {
+		eg.hlsLock.Lock()
+		if eg.hlsLeases[cameraID] == lease {
+			delete(eg.hlsLeases, cameraID)
+		}
+		eg.hlsLock.Unlock()
+		eg.releaseViewer(stream)
+	})
+	eg.hlsLeases[cameraID] = lease
+	return stream
+}
+
+// hlsLease keeps an on-demand stream open for HLS players
+type hlsLease struct {
+	stream *CameraStream
+	timer  *time.Timer
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// iceRestartTimeout bounds how long a restart offer waits for the viewer's
+// answer before the peer connection is given up on
+const iceRestartTimeout = 20 * time.Second
+
+// restartICE renegotiates a cloud viewer's connection with fresh ICE
+// credentials and candidates, sending the offer to the cloud as
+// webrtc_restart. If a restart is already waiting for an answer its offer is
+// sent again. WHEP viewers can't be offered to, so they are left alone.
+func (eg *EdgeGateway) restartICE(v *Viewer, reason string) {
+	if v.Kind != viewerKindWebRTC || v.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+
+	v.lock.Lock()
+	var offer *webrtc.SessionDescription
+	switch v.pc.SignalingState() {
+	case webrtc.SignalingStateStable:
+		sd, err := v.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+		if err == nil {
+			err = v.pc.SetLocalDescription(sd)
+		}
+		if err != nil {
+			v.lock.Unlock()
+			log.Printf("ICE restart for camera %s failed: %v", v.CameraID, err)
+			return
+		}
+		offer = &sd
+	case webrtc.SignalingStateHaveLocalOffer:
+		offer = v.pc.PendingLocalDescription()
+	}
+	if offer == nil {
+		v.lock.Unlock()
+		return
+	}
+	v.restartGen++
+	gen := v.restartGen
+	v.lock.Unlock()
+	if v.simulcast {
+		sent := *offer
+		sent.SDP = sendOnlySimulcast(sent.SDP)
+		offer = &sent
+	}
+
+	log.Printf("Restarting ICE for camera %s viewer %s (%s)", v.CameraID, v.ID, reason)
+	eg.sendEvent("webrtc_restart", map[string]interface{}{
+		"camera_id":  v.CameraID,
+		"viewer_id":  v.ID,
+		"session_id": v.ID,
+		"reason":     reason,
+		"sdp":        offer,
+	})
+
+	time.AfterFunc(iceRestartTimeout, func() {
+		v.lock.Lock()
+		expired := v.restartGen == gen && v.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer
+		v.lock.Unlock()
+		if !expired {
+			return
+		}
+		log.Printf("No ICE restart answer for camera %s viewer %s, closing", v.CameraID, v.ID)
+		eg.sendEvent("webrtc_closed", map[string]interface{}{
+			"camera_id": v.CameraID,
+			"reason":    sessionReasonRestartTimeout,
+		})
+		v.close(sessionReasonRestartTimeout)
+	})
+}
+
+// handleRestartAnswer applies the viewer's answer to a webrtc_restart offer
+func (eg *EdgeGateway) handleRestartAnswer(sessionID, cameraID string, answer webrtc.SessionDescription) {
+	eg.peerConnsLock.RLock()
+	p := eg.peerFor(sessionID, cameraID)
+	eg.peerConnsLock.RUnlock()
+	if p == nil || p.pc == nil {
+		return
+	}
+	pc := p.pc
+
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("Failed to apply ICE restart answer for camera %s: %v", cameraID, err)
+	}
+}
+
+// restartViewersICE restarts ICE on every cloud viewer. With onlyUnhealthy
+// set, viewers whose connection is still up are skipped.
+func (eg *EdgeGateway) restartViewersICE(reason string, onlyUnhealthy bool) int {
+	eg.viewersLock.Lock()
+	viewers := make([]*Viewer, 0, len(eg.viewers))
+	for _, v := range eg.viewers {
+		viewers = append(viewers, v)
+	}
+	eg.viewersLock.Unlock()
+
+	restarted := 0
+	for _, v := range viewers {
+		if v.Kind != viewerKindWebRTC {
+			continue
+		}
+		if onlyUnhealthy && v.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		eg.restartICE(v, reason)
+		restarted++
+	}
+	return restarted
+}
+
+// watchNetwork polls the local interface addresses and, when they change
+// (an uplink failover or a new DHCP lease), restarts ICE on cloud viewers so
+// they move to a path that still works
+func (eg *EdgeGateway) watchNetwork(ctx context.Context) {
+	if eg.cfg.NetworkWatchInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(eg.cfg.NetworkWatchInterval)
+	defer ticker.Stop()
+
+	last := localAddresses()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			addrs := localAddresses()
+			if addrs == nil || strings.Join(addrs, ",") == strings.Join(last, ",") {
+				continue
+			}
+			log.Printf("Network addresses changed: %v -> %v", last, addrs)
+			last = addrs
+
+			restarted := eg.restartViewersICE("network_change", false)
+			eg.sendEvent("network_changed", map[string]interface{}{
+				"addresses":     addrs,
+				"ice_restarted": restarted,
+			})
+		}
+	}
+}
+
+// localAddresses returns the sorted addresses of the interfaces that are up,
+// leaving out loopback and link-local addresses, which don't change with the
+// uplink
+func localAddresses() []string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	addrs := []string{}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, ipNet.IP.String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
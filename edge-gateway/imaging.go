@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Imaging actions of a PTZCommand. Focus and iris moves are continuous, like
+// pan, tilt and zoom, and end with stop; the others are settings.
+const (
+	imagingFocusNear = "focus_near"
+	imagingFocusFar  = "focus_far"
+	imagingIrisOpen  = "iris_open"
+	imagingIrisClose = "iris_close"
+	imagingAutoFocus = "autofocus" // with enabled
+	imagingAutoIris  = "auto_iris" // with enabled
+	imagingIRCut     = "ir_cut"    // with mode on, off or auto
+)
+
+// onvifImagingPaths are the imaging service endpoints tried in order
+var onvifImagingPaths = []string{"/onvif/imaging_service", "/onvif/Imaging", "/onvif/imaging"}
+
+// ImagingCapabilities are the lens and filter controls a camera offers
+type ImagingCapabilities struct {
+	Focus     bool `json:"focus"`
+	Iris      bool `json:"iris"`
+	AutoFocus bool `json:"autofocus"`
+	AutoIris  bool `json:"auto_iris"`
+	IRCut     bool `json:"ir_cut"`
+}
+
+// isImagingAction reports whether a PTZCommand action controls the lens or
+// IR-cut filter rather than moving the camera
+func isImagingAction(action string) bool {
+	switch action {
+	case imagingFocusNear, imagingFocusFar, imagingIrisOpen, imagingIrisClose,
+		imagingAutoFocus, imagingAutoIris, imagingIRCut:
+		return true
+	}
+	return false
+}
+
+// isContinuousPTZ reports whether an action keeps the camera moving until
+// stop
+func isContinuousPTZ(action string) bool {
+	switch action {
+	case "stop", imagingAutoFocus, imagingAutoIris, imagingIRCut:
+		return false
+	}
+	return !isAuxiliaryAction(action)
+}
+
+// cameraSupportsPTZ reports whether a camera takes a PTZCommand action. Lens
+// and IR-cut actions need the matching imaging control, or ONVIF, and
+// auxiliary actions the camera to report them; stop and locking need PTZ or
+// any imaging or auxiliary control.
+func cameraSupportsPTZ(camera *Camera, action string) bool {
+	caps := camera.Capabilities
+	onvif := caps != nil && caps.Source == "onvif"
+	var imaging ImagingCapabilities
+	if caps != nil && caps.Imaging != nil {
+		imaging = *caps.Imaging
+	}
+
+	switch action {
+	case "stop", ptzActionLock, ptzActionUnlock:
+		return camera.HasPTZ || onvif || imaging != (ImagingCapabilities{}) || caps != nil && len(caps.Auxiliary) > 0
+	case imagingFocusNear, imagingFocusFar:
+		return imaging.Focus || onvif
+	case imagingIrisOpen, imagingIrisClose:
+		return imaging.Iris
+	case imagingAutoFocus:
+		return imaging.AutoFocus || onvif
+	case imagingAutoIris:
+		return imaging.AutoIris || onvif
+	case imagingIRCut:
+		return imaging.IRCut || onvif
+	case auxIRIlluminator, auxStatusLED, auxWiper, auxWasher:
+		return cameraHasAuxiliary(camera, action)
+	}
+	return camera.HasPTZ
+}
+
+// vapixImaging reads a video channel's imaging support, numbered from 1, from
+// the PTZ.Support group. The PTZ driver serves these controls, so cameras
+// without it report none.
+func vapixImaging(params map[string]string, channel int) *ImagingCapabilities {
+	prefix := fmt.Sprintf("root.PTZ.Support.S%d.", channel)
+	supported := func(name string) bool {
+		return params[prefix+name] == "true"
+	}
+	caps := &ImagingCapabilities{
+		Focus:     supported("ContinuousFocus"),
+		Iris:      supported("ContinuousIris"),
+		AutoFocus: supported("AutoFocus"),
+		AutoIris:  supported("AutoIris"),
+		IRCut:     supported("IrCutFilter"),
+	}
+	if *caps == (ImagingCapabilities{}) {
+		return nil
+	}
+	return caps
+}
+
+// vapixImagingQuery is the ptz.cgi query for an imaging action
+func vapixImagingQuery(cmd PTZCommand) (string, error) {
+	// Continuous focus and iris speeds are -100 to 100
+	speed := int(math.Round(cmd.Speed * 100))
+	if speed < 1 {
+		speed = 1
+	} else if speed > 100 {
+		speed = 100
+	}
+
+	switch cmd.Action {
+	case imagingFocusNear:
+		return fmt.Sprintf("continuousfocusmove=-%d", speed), nil
+	case imagingFocusFar:
+		return fmt.Sprintf("continuousfocusmove=%d", speed), nil
+	case imagingIrisClose:
+		return fmt.Sprintf("continuousirismove=-%d", speed), nil
+	case imagingIrisOpen:
+		return fmt.Sprintf("continuousirismove=%d", speed), nil
+	case imagingAutoFocus, imagingAutoIris:
+		if cmd.Enabled == nil {
+			return "", fmt.Errorf("%s needs enabled", cmd.Action)
+		}
+		value := "off"
+		if *cmd.Enabled {
+			value = "on"
+		}
+		return strings.ReplaceAll(cmd.Action, "_", "") + "=" + value, nil
+	case imagingIRCut:
+		switch cmd.Mode {
+		case "on", "off", "auto":
+			return "ircutfilter=" + cmd.Mode, nil
+		}
+		return "", fmt.Errorf("invalid ir_cut mode %q", cmd.Mode)
+	}
+	return "", fmt.Errorf("unknown imaging action %s", cmd.Action)
+}
+
+// onvifImaging runs an imaging action, or stop, through the camera's ONVIF
+// imaging service. Continuous iris moves have no ONVIF equivalent.
+func onvifImaging(ctx context.Context, client *CameraHTTPClient, camera *Camera, cmd PTZCommand) error {
+	const tt = "http://www.onvif.org/ver10/schema"
+
+	// The operation and what follows its VideoSourceToken
+	var operation, args string
+	switch cmd.Action {
+	case imagingFocusNear, imagingFocusFar:
+		speed := math.Min(math.Max(cmd.Speed, 0), 1)
+		if cmd.Action == imagingFocusNear {
+			speed = -speed
+		}
+		operation = "Move"
+		args = fmt.Sprintf(`<Focus><Continuous xmlns="%s"><Speed>%.2f</Speed></Continuous></Focus>`, tt, speed)
+	case "stop":
+		operation = "Stop"
+	case imagingAutoFocus, imagingAutoIris:
+		if cmd.Enabled == nil {
+			return fmt.Errorf("%s needs enabled", cmd.Action)
+		}
+		mode := "MANUAL"
+		if *cmd.Enabled {
+			mode = "AUTO"
+		}
+		operation = "SetImagingSettings"
+		if cmd.Action == imagingAutoFocus {
+			args = fmt.Sprintf(`<ImagingSettings><Focus xmlns="%s"><AutoFocusMode>%s</AutoFocusMode></Focus></ImagingSettings>`, tt, mode)
+		} else {
+			args = fmt.Sprintf(`<ImagingSettings><Exposure xmlns="%s"><Mode>%s</Mode></Exposure></ImagingSettings>`, tt, mode)
+		}
+	case imagingIRCut:
+		switch cmd.Mode {
+		case "on", "off", "auto":
+		default:
+			return fmt.Errorf("invalid ir_cut mode %q", cmd.Mode)
+		}
+		operation = "SetImagingSettings"
+		args = fmt.Sprintf(`<ImagingSettings><IrCutFilter xmlns="%s">%s</IrCutFilter></ImagingSettings>`, tt, strings.ToUpper(cmd.Mode))
+	case imagingIrisOpen, imagingIrisClose:
+		return errors.New("continuous iris moves are not supported over ONVIF")
+	default:
+		return fmt.Errorf("unknown imaging action %s", cmd.Action)
+	}
+
+	source, err := onvifVideoSource(ctx, client, camera.Channel)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`<%s xmlns="http://www.onvif.org/ver20/imaging/wsdl"><VideoSourceToken>%s</VideoSourceToken>%s</%s>`,
+		operation, xmlEscape(source), args, operation)
+
+	var lastErr error
+	for _, path := range onvifImagingPaths {
+		var resp struct{}
+		if lastErr = onvifCall(ctx, client, path, body, &resp); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("ONVIF imaging service: %v", lastErr)
+}
+
+// onvifVideoSource returns the token of a video source, numbered from 1 in
+// the order of the media profiles, or the first for channel 0
+func onvifVideoSource(ctx context.Context, client *CameraHTTPClient, channel int) (string, error) {
+	var lastErr error
+	for _, path := range onvifMediaPaths {
+		var profiles struct {
+			Sources []string `xml:"GetProfilesResponse>Profiles>VideoSourceConfiguration>SourceToken"`
+		}
+		err := onvifCall(ctx, client, path,
+			`<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &profiles)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var sources []string
+		seen := make(map[string]bool)
+		for _, token := range profiles.Sources {
+			if token != "" && !seen[token] {
+				seen[token] = true
+				sources = append(sources, token)
+			}
+		}
+		if channel < 1 {
+			channel = 1
+		}
+		if channel > len(sources) {
+			return "", fmt.Errorf("camera has no ONVIF video source %d", channel)
+		}
+		return sources[channel-1], nil
+	}
+	return "", fmt.Errorf("ONVIF media service not available: %v", lastErr)
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Inference runners
+const (
+	inferenceRunnerNone = ""
+	inferenceRunnerHTTP = "http" // POSTs each JPEG frame to a URL
+	inferenceRunnerGRPC = "grpc" // calls inferenceGRPCMethod on host:port
+	inferenceRunnerExec = "exec" // exchanges JSON lines with a local process
+)
+
+// inferenceGRPCMethod takes and returns a google.protobuf.Struct holding
+// the same JSON as the exec runner
+const inferenceGRPCMethod = "/edgegateway.inference.v1.Detector/Detect"
+
+// inferenceQueueSize is how many access units may wait for the decoder
+// before the sampler drops to the next keyframe
+const inferenceQueueSize = 64
+
+// inferenceMaxFrame bounds a JPEG frame read from the decoder
+const inferenceMaxFrame = 8 << 20
+
+// inferenceRetry is how long to wait before restarting a failed decoder
+const inferenceRetry = 5 * time.Second
+
+// inferenceIdleTimeout is how long the decoder may go without a frame, at
+// least, before it is restarted, in case the stream stopped
+const inferenceIdleTimeout = 30 * time.Second
+
+// Detection is an object a model found in a frame
+type Detection struct {
+	Class string       `json:"class"`
+	Score float64      `json:"score"`
+	Box   AnalyticsBox `json:"box"` // as fractions of the frame, from its top left
+}
+
+// inferenceRequest is a frame as the gRPC and exec runners send it
+type inferenceRequest struct {
+	CameraID string    `json:"camera_id"`
+	Time     time.Time `json:"time"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Image    []byte    `json:"image"` // JPEG, base64 in JSON
+}
+
+// inferenceResponse is what every runner answers with
+type inferenceResponse struct {
+	Detections []Detection `json:"detections"`
+}
+
+// inferenceRunner runs a model on frames
+type inferenceRunner interface {
+	Detect(ctx context.Context, req *inferenceRequest) ([]Detection, error)
+	Close() error
+}
+
+// newInferenceRunner connects to the runner INFERENCE_RUNNER names
+func newInferenceRunner(cfg *Config) (inferenceRunner, error) {
+	switch cfg.InferenceRunner {
+	case inferenceRunnerHTTP:
+		return &httpInferenceRunner{url: cfg.InferenceEndpoint, client: &http.Client{}}, nil
+	case inferenceRunnerGRPC:
+		conn, err := grpc.Dial(cfg.InferenceEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, err
+		}
+		return &grpcInferenceRunner{conn: conn}, nil
+	case inferenceRunnerExec:
+		args := strings.Fields(cfg.InferenceEndpoint)
+		return &execInferenceRunner{args: args}, nil
+	}
+	return nil, fmt.Errorf("unknown inference runner %q", cfg.InferenceRunner)
+}
+
+// httpInferenceRunner POSTs frames as image/jpeg, naming the camera, frame
+// time and size in headers
+type httpInferenceRunner struct {
+	url    string
+	client *http.Client
+}
+
+func (r *httpInferenceRunner) Detect(ctx context.Context, req *inferenceRequest) ([]Detection, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(req.Image))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "image/jpeg")
+	httpReq.Header.Set("X-Camera-ID", req.CameraID)
+	httpReq.Header.Set("X-Frame-Time", req.Time.UTC().Format(time.RFC3339Nano))
+	httpReq.Header.Set("X-Frame-Width", strconv.Itoa(req.Width))
+	httpReq.Header.Set("X-Frame-Height", strconv.Itoa(req.Height))
+
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inference service returned %s", resp.Status)
+	}
+	var out inferenceResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("unreadable inference response: %v", err)
+	}
+	return out.Detections, nil
+}
+
+func (r *httpInferenceRunner) Close() error {
+	r.client.CloseIdleConnections()
+	return nil
+}
+
+// grpcInferenceRunner calls an external gRPC inference service
+type grpcInferenceRunner struct {
+	conn *grpc.ClientConn
+}
+
+func (r *grpcInferenceRunner) Detect(ctx context.Context, req *inferenceRequest) ([]Detection, error) {
+	var fields map[string]interface{}
+	data, _ := json.Marshal(req)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	in, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	out := &structpb.Struct{}
+	if err := r.conn.Invoke(ctx, inferenceGRPCMethod, in, out); err != nil {
+		return nil, err
+	}
+
+	data, err = out.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var resp inferenceResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("unreadable inference response: %v", err)
+	}
+	return resp.Detections, nil
+}
+
+func (r *grpcInferenceRunner) Close() error {
+	return r.conn.Close()
+}
+
+// execInferenceRunner runs a local model runner, such as a TFLite or ONNX
+// script, writing each request to its stdin and reading the response from
+// its stdout, one JSON document per line. The process is started on first
+// use and again after it fails or times out.
+type execInferenceRunner struct {
+	args []string
+
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *tailWriter
+}
+
+func (r *execInferenceRunner) Detect(ctx context.Context, req *inferenceRequest) ([]Detection, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.cmd == nil {
+		if err := r.startLocked(); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The process can't be interrupted mid-frame, so a slow one is killed
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	stdin, stdout := r.stdin, r.stdout
+	go func() {
+		if _, err := stdin.Write(append(data, '\n')); err != nil {
+			done <- result{err: err}
+			return
+		}
+		line, err := stdout.ReadBytes('\n')
+		done <- result{line, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			err := fmt.Errorf("inference runner failed: %v (%s)", res.err, strings.TrimSpace(r.stderr.String()))
+			r.stopLocked()
+			return nil, err
+		}
+		var resp inferenceResponse
+		if err := json.Unmarshal(res.line, &resp); err != nil {
+			return nil, fmt.Errorf("unreadable inference response: %v", err)
+		}
+		return resp.Detections, nil
+	case <-ctx.Done():
+		r.stopLocked()
+		return nil, ctx.Err()
+	}
+}
+
+// startLocked starts the runner process. The caller holds lock.
+func (r *execInferenceRunner) startLocked() error {
+	cmd := exec.Command(r.args[0], r.args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	r.stderr = &tailWriter{limit: 2048}
+	cmd.Stderr = r.stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start inference runner: %v", err)
+	}
+	r.cmd, r.stdin, r.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stopLocked kills the runner process. The caller holds lock.
+func (r *execInferenceRunner) stopLocked() {
+	if r.cmd == nil {
+		return
+	}
+	r.stdin.Close()
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+	r.cmd = nil
+}
+
+func (r *execInferenceRunner) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stopLocked()
+	return nil
+}
+
+// inferenceSampler is a packetSink that queues a stream's H.264 as Annex B
+// access units for the decoder, dropping to the next keyframe when the
+// decoder falls behind
+type inferenceSampler struct {
+	lock     sync.Mutex
+	codec    *h264parser.CodecData
+	videoIdx int8
+	waitKey  bool
+	queue    chan []byte
+}
+
+func newInferenceSampler() *inferenceSampler {
+	return &inferenceSampler{queue: make(chan []byte, inferenceQueueSize)}
+}
+
+func (s *inferenceSampler) Reset(codecs []av.CodecData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.codec, s.waitKey = nil, true
+	for i, codec := range codecs {
+		if h264, ok := codec.(h264parser.CodecData); ok {
+			s.codec, s.videoIdx = &h264, int8(i)
+			break
+		}
+	}
+}
+
+func (s *inferenceSampler) WritePacket(pkt av.Packet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.codec == nil || pkt.Idx != s.videoIdx || (s.waitKey && !pkt.IsKeyFrame) {
+		return
+	}
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	if pkt.IsKeyFrame {
+		nalus = append([][]byte{s.codec.SPS(), s.codec.PPS()}, nalus...)
+	}
+	var au []byte
+	for _, nalu := range nalus {
+		au = append(au, 0, 0, 0, 1)
+		au = append(au, nalu...)
+	}
+	select {
+	case s.queue <- au:
+		s.waitKey = false
+	default:
+		s.waitKey = true
+	}
+}
+
+// inferenceEnabledFor reports whether frames of a camera are run through
+// the inference runner
+func (eg *EdgeGateway) inferenceEnabledFor(cameraID string) bool {
+	if eg.cfg.InferenceRunner == inferenceRunnerNone {
+		return false
+	}
+	if len(eg.cfg.InferenceCameras) == 0 {
+		return true
+	}
+	for _, id := range eg.cfg.InferenceCameras {
+		if id == cameraID {
+			return true
+		}
+	}
+	return false
+}
+
+// runInference feeds sampled frames of the selected cameras to the
+// inference runner until ctx is done, following camera changes
+func (eg *EdgeGateway) runInference(ctx context.Context) {
+	runner, err := newInferenceRunner(eg.cfg)
+	if err != nil {
+		log.Printf("Inference disabled: %v", err)
+		return
+	}
+	defer runner.Close()
+	log.Printf("Inference: sending frames at %g fps to the %s runner", eg.cfg.InferenceFPS, eg.cfg.InferenceRunner)
+
+	workers := make(map[string]context.CancelFunc)
+	ticker := time.NewTicker(eventClipSyncInterval)
+	defer ticker.Stop()
+	for {
+		eg.camerasLock.RLock()
+		cameras := make(map[string]bool)
+		for id, camera := range eg.cameras {
+			if camera.Approval == "" && eg.inferenceEnabledFor(id) {
+				cameras[id] = true
+			}
+		}
+		eg.camerasLock.RUnlock()
+
+		for cameraID, cancel := range workers {
+			if !cameras[cameraID] {
+				cancel()
+				delete(workers, cameraID)
+			}
+		}
+		for cameraID := range cameras {
+			if _, exists := workers[cameraID]; exists {
+				continue
+			}
+			workerCtx, cancel := context.WithCancel(ctx)
+			workers[cameraID] = cancel
+			cameraID := cameraID
+			eg.goTracked(func() { eg.inferCamera(workerCtx, cameraID, runner) })
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, cancel := range workers {
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// inferCamera keeps a camera's main stream open and its frames decoded and
+// run through the model until ctx is done
+func (eg *EdgeGateway) inferCamera(ctx context.Context, cameraID string, runner inferenceRunner) {
+	sampler := newInferenceSampler()
+	frames := make(chan *inferenceRequest, 1) // only the latest waits
+	eg.goTracked(func() { eg.detectFrames(ctx, runner, frames) })
+
+	var stream *CameraStream
+	defer func() {
+		if stream != nil {
+			stream.removeSink(sampler)
+			eg.releaseViewer(stream)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if stream == nil || !stream.running() {
+			if stream != nil {
+				stream.removeSink(sampler)
+				eg.releaseViewer(stream)
+				stream = nil
+			}
+			s, err := eg.openStream(cameraID, viewerProfileMain, true)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(eventClipSyncInterval):
+				}
+				continue
+			}
+			s.addViewer()
+			s.addSink(sampler)
+			stream = s
+		}
+
+		err := decodeFrames(ctx, eg.cfg, sampler.queue, func(image []byte) {
+			req := &inferenceRequest{CameraID: cameraID, Time: time.Now(), Image: image}
+			if config, err := jpeg.DecodeConfig(bytes.NewReader(image)); err == nil {
+				req.Width, req.Height = config.Width, config.Height
+			}
+			select {
+			case <-frames:
+			default:
+			}
+			frames <- req
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Inference: decoder for camera %s failed, restarting in %s: %v", cameraID, inferenceRetry, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(inferenceRetry):
+		}
+	}
+}
+
+// detectFrames runs frames through the model and publishes what it finds:
+// every result to the camera's viewers, and object_detected the first time
+// a class is seen
+func (eg *EdgeGateway) detectFrames(ctx context.Context, runner inferenceRunner, frames <-chan *inferenceRequest) {
+	seen := make(map[string]time.Time) // classes, by name
+	var lastErr string
+	for {
+		var req *inferenceRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req = <-frames:
+		}
+
+		detectCtx, cancel := context.WithTimeout(ctx, eg.cfg.InferenceTimeout)
+		detections, err := runner.Detect(detectCtx, req)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Log a failing runner once, not for every frame
+			if err.Error() != lastErr {
+				log.Printf("Inference on camera %s failed: %v", req.CameraID, err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+
+		frame := AnalyticsFrame{CameraID: req.CameraID, Time: &req.Time, Objects: []AnalyticsObject{}}
+		for _, d := range detections {
+			if d.Score < eg.cfg.InferenceMinScore || d.Class == "" {
+				continue
+			}
+			object := AnalyticsObject{Class: d.Class, Likelihood: d.Score, Box: AnalyticsBox{
+				Left:   clamp01(d.Box.Left),
+				Top:    clamp01(d.Box.Top),
+				Right:  clamp01(d.Box.Right),
+				Bottom: clamp01(d.Box.Bottom),
+			}}
+			frame.Objects = append(frame.Objects, object)
+			if _, known := seen[d.Class]; !known {
+				eg.sendEvent("object_detected", ObjectDetected{
+					CameraID: req.CameraID,
+					Time:     frame.Time,
+					Source:   objectSourceInference,
+					Object:   object,
+				})
+			}
+			seen[d.Class] = req.Time
+		}
+		for class, at := range seen {
+			if req.Time.Sub(at) > analyticsObjectForget {
+				delete(seen, class)
+			}
+		}
+		eg.sendAnalytics(frame)
+	}
+}
+
+// decodeFrames decodes the access units from queue with ffmpeg, calling
+// frame with a JPEG at INFERENCE_FPS, no wider than INFERENCE_WIDTH, until
+// ctx is done or ffmpeg fails. Frames are timed by their arrival, as the
+// Annex B stream carries no timestamps.
+func decodeFrames(ctx context.Context, cfg *Config, queue <-chan []byte, frame func([]byte)) error {
+	cmd := exec.Command(cfg.FFmpegPath,
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-use_wallclock_as_timestamps", "1", "-f", "h264", "-i", "pipe:0",
+		"-vf", fmt.Sprintf("fps=%g,scale='min(%d,iw)':-2", cfg.InferenceFPS, cfg.InferenceWidth),
+		"-an", "-q:v", "4", "-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &tailWriter{limit: 2048}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	decodeCtx, stopDecode := context.WithCancel(ctx)
+	defer stopDecode()
+	idleTimeout := max(inferenceIdleTimeout, time.Duration(3*float64(time.Second)/cfg.InferenceFPS))
+	idle := time.AfterFunc(idleTimeout, stopDecode)
+	defer idle.Stop()
+	go func() {
+		defer stdin.Close()
+		for {
+			select {
+			case <-decodeCtx.Done():
+				return
+			case au := <-queue:
+				if _, err := stdin.Write(au); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	stop := closeOnDone(decodeCtx, stdout)
+	defer stop()
+
+	r := bufio.NewReaderSize(stdout, 64*1024)
+	for {
+		image, err := readJPEG(r)
+		if err != nil {
+			idled := decodeCtx.Err() != nil && ctx.Err() == nil
+			stopDecode()
+			cmd.Process.Kill()
+			cmd.Wait()
+			if idled {
+				return fmt.Errorf("no frames for %s", idleTimeout)
+			}
+			if msg := strings.TrimSpace(stderr.String()); msg != "" && ctx.Err() == nil {
+				return fmt.Errorf("%v: %s", err, msg)
+			}
+			return err
+		}
+		idle.Reset(idleTimeout)
+		frame(image)
+	}
+}
+
+// readJPEG reads the next JPEG image from a stream of them, from its start
+// of image marker to its end of image marker. Marker bytes can't occur in
+// the entropy-coded data, where 0xFF is always stuffed.
+func readJPEG(r *bufio.Reader) ([]byte, error) {
+	var prev byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if prev == 0xFF && b == 0xD8 {
+			break
+		}
+		prev = b
+	}
+
+	image := []byte{0xFF, 0xD8}
+	prev = 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		image = append(image, b)
+		if prev == 0xFF && b == 0xD9 {
+			return image, nil
+		}
+		if len(image) > inferenceMaxFrame {
+			return nil, errors.New("decoded frame too large")
+		}
+		prev = b
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// inventoryBatchSize bounds the cameras in one camera_inventory message
+const inventoryBatchSize = 100
+
+// inventoryStatuses are reported in camera_inventory batches rather than a
+// camera_status each: those a whole site's cameras get at once, on startup,
+// a reconnect or a rescan
+var inventoryStatuses = map[string]bool{
+	"discovered":  true,
+	"restored":    true,
+	"reconnected": true,
+}
+
+// CameraStatusEntry is a camera's status in camera_inventory, as it would
+// be in camera_status
+type CameraStatusEntry struct {
+	Camera *Camera `json:"camera"`
+	Status string  `json:"status"`
+}
+
+// cameraNotice is the camera_status last sent for a camera, and the one
+// held back until CAMERA_STATUS_INTERVAL has passed since
+type cameraNotice struct {
+	sent          []byte // the camera as last reported
+	sentAt        time.Time
+	pending       *Camera
+	pendingStatus string
+	timer         *time.Timer
+}
+
+// reportCameraStatus sends a camera's status, unless it is a rediscovery
+// of a camera reported as it is now. A status follows the camera's
+// previous one by at least CAMERA_STATUS_INTERVAL, and only the latest of
+// those raised meanwhile is sent. reconnected isn't held back, so it
+// arrives before session_resume.
+func (eg *EdgeGateway) reportCameraStatus(camera *Camera, status string) {
+	reported, _ := json.Marshal(camera)
+	now := time.Now()
+
+	eg.cameraNoticesLock.Lock()
+	notice := eg.cameraNotices[camera.ID]
+	if notice == nil {
+		notice = &cameraNotice{}
+		eg.cameraNotices[camera.ID] = notice
+	}
+	if status == "discovered" && notice.pending == nil && bytes.Equal(notice.sent, reported) {
+		eg.cameraNoticesLock.Unlock()
+		debugf("Camera %s rediscovered unchanged", camera.ID)
+		return
+	}
+	interval := eg.cfg.CameraStatusInterval
+	if wait := notice.sentAt.Add(interval).Sub(now); interval > 0 && wait > 0 && status != "reconnected" {
+		held := *camera
+		notice.pending, notice.pendingStatus = &held, status
+		if notice.timer == nil {
+			cameraID := camera.ID
+			notice.timer = time.AfterFunc(wait, func() { eg.flushCameraStatus(cameraID) })
+		}
+		eg.cameraNoticesLock.Unlock()
+		return
+	}
+	notice.sent, notice.sentAt = reported, now
+	eg.cameraNoticesLock.Unlock()
+
+	eg.emitCameraStatus(camera, status)
+}
+
+// flushCameraStatus sends the status held back for a camera
+func (eg *EdgeGateway) flushCameraStatus(cameraID string) {
+	eg.cameraNoticesLock.Lock()
+	notice := eg.cameraNotices[cameraID]
+	camera, status := notice.pending, notice.pendingStatus
+	notice.pending, notice.timer = nil, nil
+	if camera != nil {
+		notice.sent, _ = json.Marshal(camera)
+		notice.sentAt = time.Now()
+	}
+	eg.cameraNoticesLock.Unlock()
+
+	if camera != nil {
+		eg.emitCameraStatus(camera, status)
+	}
+}
+
+// emitCameraStatus sends a camera_status, or adds the camera to the next
+// camera_inventory. MQTT gets each camera's status as it is raised either
+// way.
+func (eg *EdgeGateway) emitCameraStatus(camera *Camera, status string) {
+	delay := eg.cfg.CameraInventoryDelay
+	if delay <= 0 || !inventoryStatuses[status] {
+		// Keep the batch ahead of later news about its cameras
+		eg.flushInventory()
+		eg.sendEvent("camera_status", map[string]interface{}{
+			"camera": camera,
+			"status": status,
+		})
+		return
+	}
+
+	if eg.mqtt != nil {
+		data, err := json.Marshal(CameraStatusEntry{Camera: camera, Status: status})
+		if err == nil {
+			eg.mqtt.Publish("camera_status", eg.labelTenant(data))
+		}
+	}
+	eg.inventoryLock.Lock()
+	defer eg.inventoryLock.Unlock()
+	eg.inventory = append(eg.inventory, CameraStatusEntry{Camera: camera, Status: status})
+	if eg.inventoryTimer == nil {
+		eg.inventoryTimer = time.AfterFunc(delay, eg.flushInventory)
+	}
+}
+
+// flushInventory sends the batched camera statuses, in camera_inventory
+// messages of up to inventoryBatchSize cameras of one tenant
+func (eg *EdgeGateway) flushInventory() {
+	eg.inventoryLock.Lock()
+	entries := eg.inventory
+	eg.inventory = nil
+	if eg.inventoryTimer != nil {
+		eg.inventoryTimer.Stop()
+		eg.inventoryTimer = nil
+	}
+	eg.inventoryLock.Unlock()
+
+	var tenants []string
+	byTenant := make(map[string][]CameraStatusEntry)
+	for _, entry := range entries {
+		tenant := entry.Camera.Tenant
+		if _, seen := byTenant[tenant]; !seen {
+			tenants = append(tenants, tenant)
+		}
+		byTenant[tenant] = append(byTenant[tenant], entry)
+	}
+	for _, tenant := range tenants {
+		cameras := byTenant[tenant]
+		for len(cameras) > 0 {
+			batch := cameras[:min(len(cameras), inventoryBatchSize)]
+			cameras = cameras[len(batch):]
+			payload := map[string]interface{}{"cameras": batch}
+			if tenant != "" {
+				payload["tenant_id"] = tenant
+			}
+			eg.sendEvent("camera_inventory", payload)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InventoryStream is a running stream in inventory_snapshot and
+// inventory_delta: which stream it is and its state, not its statistics
+type InventoryStream struct {
+	CameraID string `json:"camera_id"`
+	Profile  string `json:"profile,omitempty"`
+	Codec    string `json:"codec,omitempty"` // vp9 or av1, empty for H.264
+	State    string `json:"state"`           // a stream health state, or stopped in deltas
+}
+
+func (s InventoryStream) key() string {
+	return s.CameraID + "/" + s.Profile + "/" + s.Codec
+}
+
+// InventorySession is a viewer session in inventory_snapshot and
+// inventory_delta
+type InventorySession struct {
+	SessionID string `json:"session_id"`
+	Kind      string `json:"kind"`
+	CameraID  string `json:"camera_id"`
+	Profile   string `json:"profile,omitempty"`
+	Codec     string `json:"codec,omitempty"`
+	Layer     string `json:"layer,omitempty"`
+	State     string `json:"state"` // the peer connection state, or closed in deltas
+}
+
+// InventoryDelta is what changed in the inventory since the snapshot or
+// delta numbered Seq-1
+type InventoryDelta struct {
+	Epoch          string             `json:"epoch"`
+	Seq            uint64             `json:"seq"`
+	Cameras        []*Camera          `json:"cameras,omitempty"`
+	RemovedCameras []string           `json:"removed_cameras,omitempty"`
+	Streams        []InventoryStream  `json:"streams,omitempty"`
+	Sessions       []InventorySession `json:"sessions,omitempty"`
+}
+
+// inventorySync numbers inventory_snapshot and inventory_delta messages and
+// keeps the inventory as last sent, which deltas are taken against. epoch
+// tells this run's numbers from a previous run's. Deltas start with the
+// first snapshot.
+type inventorySync struct {
+	lock     sync.Mutex
+	epoch    string
+	seq      uint64
+	started  bool
+	cameras  map[string][]byte // as JSON
+	streams  map[string]InventoryStream
+	sessions map[string]InventorySession
+}
+
+// collectInventory returns the cameras, running streams and viewer
+// sessions, each sorted
+func (eg *EdgeGateway) collectInventory() ([]*Camera, []InventoryStream, []InventorySession) {
+	cameras := eg.listCameras()
+	sort.Slice(cameras, func(i, j int) bool { return cameras[i].ID < cameras[j].ID })
+
+	eg.streamsLock.RLock()
+	streams := make([]InventoryStream, 0, len(eg.streams))
+	for _, stream := range eg.streams {
+		streams = append(streams, InventoryStream{
+			CameraID: stream.camera.ID,
+			Profile:  stream.profile,
+			Codec:    stream.codec,
+			State:    stream.stats.health(stream.camera.ID).State,
+		})
+	}
+	eg.streamsLock.RUnlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].key() < streams[j].key() })
+
+	eg.viewersLock.Lock()
+	viewers := make([]*Viewer, 0, len(eg.viewers))
+	for _, v := range eg.viewers {
+		viewers = append(viewers, v)
+	}
+	eg.viewersLock.Unlock()
+	sessions := make([]InventorySession, 0, len(viewers))
+	for _, v := range viewers {
+		session := InventorySession{
+			SessionID: v.ID,
+			Kind:      v.Kind,
+			CameraID:  v.CameraID,
+			State:     v.pc.ConnectionState().String(),
+		}
+		if v.Codec != videoCodecH264 {
+			session.Codec = v.Codec
+		}
+		v.lock.Lock()
+		session.Profile, session.Layer = v.Profile, v.Layer
+		v.lock.Unlock()
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SessionID < sessions[j].SessionID })
+
+	return cameras, streams, sessions
+}
+
+// sendInventorySnapshot sends the whole inventory in inventory_snapshot, and
+// takes later deltas against it
+func (eg *EdgeGateway) sendInventorySnapshot() {
+	s := &eg.inventorySync
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cameras, streams, sessions := eg.collectInventory()
+	if s.epoch == "" {
+		s.epoch = randomHex(8)
+	}
+	s.seq++
+	s.started = true
+	s.cameras = make(map[string][]byte, len(cameras))
+	for _, camera := range cameras {
+		s.cameras[camera.ID], _ = json.Marshal(camera)
+	}
+	s.streams = make(map[string]InventoryStream, len(streams))
+	for _, stream := range streams {
+		s.streams[stream.key()] = stream
+	}
+	s.sessions = make(map[string]InventorySession, len(sessions))
+	for _, session := range sessions {
+		s.sessions[session.SessionID] = session
+	}
+
+	eg.sendEvent("inventory_snapshot", map[string]interface{}{
+		"epoch":    s.epoch,
+		"seq":      s.seq,
+		"cameras":  cameras,
+		"streams":  streams,
+		"sessions": sessions,
+	})
+}
+
+// sendInventoryDelta sends what changed in the inventory since the last
+// snapshot or delta, if anything did
+func (eg *EdgeGateway) sendInventoryDelta() {
+	s := &eg.inventorySync
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.started {
+		return
+	}
+
+	cameras, streams, sessions := eg.collectInventory()
+	delta := InventoryDelta{Epoch: s.epoch}
+
+	current := make(map[string][]byte, len(cameras))
+	for _, camera := range cameras {
+		data, _ := json.Marshal(camera)
+		current[camera.ID] = data
+		if !bytes.Equal(s.cameras[camera.ID], data) {
+			delta.Cameras = append(delta.Cameras, camera)
+		}
+	}
+	for id := range s.cameras {
+		if _, exists := current[id]; !exists {
+			delta.RemovedCameras = append(delta.RemovedCameras, id)
+		}
+	}
+	sort.Strings(delta.RemovedCameras)
+
+	currentStreams := make(map[string]InventoryStream, len(streams))
+	for _, stream := range streams {
+		currentStreams[stream.key()] = stream
+		if s.streams[stream.key()] != stream {
+			delta.Streams = append(delta.Streams, stream)
+		}
+	}
+	for key, stream := range s.streams {
+		if _, running := currentStreams[key]; !running {
+			stream.State = "stopped"
+			delta.Streams = append(delta.Streams, stream)
+		}
+	}
+
+	currentSessions := make(map[string]InventorySession, len(sessions))
+	for _, session := range sessions {
+		currentSessions[session.SessionID] = session
+		if s.sessions[session.SessionID] != session {
+			delta.Sessions = append(delta.Sessions, session)
+		}
+	}
+	for id, session := range s.sessions {
+		if _, open := currentSessions[id]; !open {
+			session.State = "closed"
+			delta.Sessions = append(delta.Sessions, session)
+		}
+	}
+
+	if len(delta.Cameras)+len(delta.RemovedCameras)+len(delta.Streams)+len(delta.Sessions) == 0 {
+		return
+	}
+	s.seq++
+	delta.Seq = s.seq
+	s.cameras, s.streams, s.sessions = current, currentStreams, currentSessions
+	eg.sendEvent("inventory_delta", delta)
+}
+
+// monitorInventory sends an inventory_delta every INVENTORY_DELTA_INTERVAL
+// in which the inventory changed, once the orchestrator has asked for a
+// snapshot
+func (eg *EdgeGateway) monitorInventory(ctx context.Context) {
+	if eg.cfg.InventoryDeltaInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(eg.cfg.InventoryDeltaInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			eg.sendInventoryDelta()
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxOutputPulse bounds set_output pulses, so a typo can't hold a door
+// strike open for hours
+const maxOutputPulse = time.Minute
+
+// ioPollWorkers is how many cameras' inputs are read at once
+const ioPollWorkers = 8
+
+// IOPort is a digital input or output of a camera, numbered from 1 as in
+// port.cgi
+type IOPort struct {
+	Port      int    `json:"port"`
+	Direction string `json:"direction"` // input or output
+	Name      string `json:"name,omitempty"`
+}
+
+// SetOutputRequest is the set_output payload. With PulseMs the output is
+// set to Active for that long and then back.
+type SetOutputRequest struct {
+	CameraID string `json:"camera_id"`
+	Port     int    `json:"port"`
+	Active   bool   `json:"active"`
+	PulseMs  int    `json:"pulse_ms,omitempty"`
+}
+
+// IOInputEvent reports a change of a camera's input, such as a door contact
+// opening
+type IOInputEvent struct {
+	CameraID string    `json:"camera_id"`
+	Port     int       `json:"port"`
+	Name     string    `json:"name,omitempty"`
+	Active   bool      `json:"active"`
+	Time     time.Time `json:"time"`
+}
+
+// vapixIOPorts reads the ports from the IOPort group, where port I0 is
+// port 1. Configurable ports are listed with their current direction.
+func vapixIOPorts(params map[string]string) []IOPort {
+	var ports []IOPort
+	for name, direction := range params {
+		rest, ok := strings.CutPrefix(name, "root.IOPort.I")
+		if !ok {
+			continue
+		}
+		index, field, _ := strings.Cut(rest, ".")
+		n, err := strconv.Atoi(index)
+		if err != nil || field != "Direction" || (direction != "input" && direction != "output") {
+			continue
+		}
+		port := IOPort{Port: n + 1, Direction: direction}
+		if direction == "input" {
+			port.Name = params[fmt.Sprintf("root.IOPort.I%d.Input.Name", n)]
+		} else {
+			port.Name = params[fmt.Sprintf("root.IOPort.I%d.Output.Name", n)]
+		}
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports
+}
+
+// setOutput sets or pulses a camera output through port.cgi
+func (eg *EdgeGateway) setOutput(ctx context.Context, req SetOutputRequest) error {
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[req.CameraID]
+	var copied Camera
+	if exists {
+		copied = *camera
+	}
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return errCameraNotFound
+	}
+	if copied.ParentID != "" {
+		return fmt.Errorf("camera is a sensor of camera %s, which has the I/O ports", copied.ParentID)
+	}
+	if copied.Simulated {
+		return errors.New("simulated cameras have no I/O ports")
+	}
+	if action := eg.maintenanceAction(&copied); action != "" {
+		return fmt.Errorf("camera is under maintenance (%s)", action)
+	}
+
+	output := false
+	if copied.Capabilities != nil {
+		for _, port := range copied.Capabilities.IOPorts {
+			if port.Port == req.Port {
+				output = port.Direction == "output"
+				break
+			}
+		}
+	}
+	if !output {
+		return fmt.Errorf("camera has no output port %d", req.Port)
+	}
+	pulse := time.Duration(req.PulseMs) * time.Millisecond
+	if pulse < 0 || pulse > maxOutputPulse {
+		return fmt.Errorf("pulse_ms must be between 0 and %d", maxOutputPulse.Milliseconds())
+	}
+
+	// "/" sets the port active and "\" inactive; a pulse is the state, the
+	// wait in milliseconds, and the opposite state
+	on, off := "/", `\`
+	if !req.Active {
+		on, off = off, on
+	}
+	action := fmt.Sprintf("%d:%s", req.Port, on)
+	if pulse > 0 {
+		action += strconv.Itoa(req.PulseMs) + off
+	}
+
+	resp, err := eg.httpClients.Client(&copied).Get(ctx, "/axis-cgi/io/port.cgi?action="+action)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("port.cgi returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// vapixInputStates reads whether each of the given ports is active
+func vapixInputStates(ctx context.Context, client *CameraHTTPClient, ports []int) (map[int]bool, error) {
+	list := make([]string, len(ports))
+	for i, port := range ports {
+		list[i] = strconv.Itoa(port)
+	}
+	resp, err := client.Get(ctx, "/axis-cgi/io/port.cgi?checkactive="+strings.Join(list, ","))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("port.cgi returned status %d", resp.StatusCode)
+	}
+
+	// One port{n}=active or port{n}=inactive line per port
+	states := make(map[int]bool, len(ports))
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 64<<10))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimPrefix(name, "port"))
+		if err != nil {
+			continue
+		}
+		states[port] = value == "active"
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(states) == 0 {
+		return nil, errors.New("port.cgi returned no port states")
+	}
+	return states, nil
+}
+
+// cameraInputs is the last known state of a camera's inputs
+type cameraInputs struct {
+	states  map[int]bool
+	failing bool
+}
+
+// monitorIOInputs polls the inputs of the approved Axis cameras every
+// IO_POLL_INTERVAL and sends io_input when one changes. The first read of a
+// camera only records its inputs' states.
+func (eg *EdgeGateway) monitorIOInputs(ctx context.Context) {
+	if eg.cfg.IOPollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(eg.cfg.IOPollInterval)
+	defer ticker.Stop()
+
+	known := make(map[string]*cameraInputs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		eg.camerasLock.RLock()
+		var cameras []*Camera
+		for _, camera := range eg.cameras {
+			if camera.Approval == "" && camera.ParentID == "" && !camera.Simulated && len(cameraInputPorts(camera)) > 0 {
+				copied := *camera
+				cameras = append(cameras, &copied)
+			}
+		}
+		eg.camerasLock.RUnlock()
+
+		polled := make(map[string]bool, len(cameras))
+		slots := make(chan struct{}, ioPollWorkers)
+		var wg sync.WaitGroup
+		for _, camera := range cameras {
+			// A rebooting camera would only report errors
+			if eg.maintenanceAction(camera) != "" {
+				continue
+			}
+			inputs := known[camera.ID]
+			if inputs == nil {
+				inputs = &cameraInputs{}
+				known[camera.ID] = inputs
+			}
+			polled[camera.ID] = true
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(camera *Camera, inputs *cameraInputs) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				eg.pollInputs(ctx, camera, inputs)
+			}(camera, inputs)
+		}
+		wg.Wait()
+
+		for cameraID := range known {
+			if !polled[cameraID] {
+				delete(known, cameraID)
+			}
+		}
+	}
+}
+
+// pollInputs reads a camera's inputs and reports those that changed
+func (eg *EdgeGateway) pollInputs(ctx context.Context, camera *Camera, inputs *cameraInputs) {
+	ports := cameraInputPorts(camera)
+	numbers := make([]int, len(ports))
+	for i, port := range ports {
+		numbers[i] = port.Port
+	}
+
+	states, err := vapixInputStates(ctx, eg.httpClients.Client(camera), numbers)
+	if err != nil {
+		if ctx.Err() == nil && !inputs.failing {
+			log.Printf("Can't read the inputs of camera %s: %v", camera.ID, err)
+		}
+		inputs.failing = true
+		return
+	}
+	if inputs.failing {
+		log.Printf("Reading the inputs of camera %s again", camera.ID)
+		inputs.failing = false
+	}
+
+	first := inputs.states == nil
+	now := time.Now().UTC()
+	for _, port := range ports {
+		active, read := states[port.Port]
+		if !read {
+			continue
+		}
+		if !first && active != inputs.states[port.Port] {
+			debugf("Camera %s input %d is now active %v", camera.ID, port.Port, active)
+			eg.sendEvent("io_input", IOInputEvent{
+				CameraID: camera.ID,
+				Port:     port.Port,
+				Name:     port.Name,
+				Active:   active,
+				Time:     now,
+			})
+		}
+	}
+	inputs.states = states
+}
+
+// cameraInputPorts returns a camera's input ports
+func cameraInputPorts(camera *Camera) []IOPort {
+	if camera.Capabilities == nil {
+		return nil
+	}
+	var ports []IOPort
+	for _, port := range camera.Capabilities.IOPorts {
+		if port.Direction == "input" {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
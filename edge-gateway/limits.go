@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+)
+
+// The resources the gateway limits, as named in capacity_exceeded
+const (
+	resourceStreams         = "streams"
+	resourcePeerConnections = "peer_connections"
+	resourceGoroutines      = "goroutines"
+	resourceMemory          = "memory"
+	resourceStreamQueue     = "stream_queue"
+)
+
+// capacityEventInterval is how often capacity_exceeded is sent at most for
+// each resource, so a gateway turning work away doesn't flood the cloud
+const capacityEventInterval = time.Minute
+
+// memoryHeadroom is the share of MEMORY_LIMIT_MB the live heap may reach
+// before new streams and peer connections are refused, leaving the rest
+// for the garbage collector to work in
+const memoryHeadroom = 0.9
+
+// capacityError refuses new work that would take a resource past its
+// limit. It matches errOverCapacity, so viewers refused for it are told
+// over_capacity like those over the uplink budget.
+type capacityError struct {
+	resource string
+	inUse    int
+	limit    int
+}
+
+func (e *capacityError) Error() string {
+	if e.resource == resourceMemory {
+		return fmt.Sprintf("gateway at capacity: %d MiB of %d MiB memory in use", e.inUse, e.limit)
+	}
+	return fmt.Sprintf("gateway at capacity: %d of %d %s", e.inUse, e.limit, e.resource)
+}
+
+func (e *capacityError) Is(target error) bool {
+	return target == errOverCapacity
+}
+
+// applyMemoryLimit makes MEMORY_LIMIT_MB the Go runtime's soft memory
+// limit, unless GOMEMLIMIT sets one
+func applyMemoryLimit(cfg *Config) {
+	if cfg.MemoryLimitMB > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(int64(cfg.MemoryLimitMB) << 20)
+	}
+}
+
+// liveHeapMB is the heap the last garbage collection found in use
+func liveHeapMB() int {
+	sample := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int(sample[0].Value.Uint64() >> 20)
+}
+
+// checkHeadroom returns why no new stream or peer connection can start:
+// the gateway's goroutines or heap are over their limits
+func (eg *EdgeGateway) checkHeadroom(cameraID string) error {
+	if limit := eg.cfg.MaxGoroutines; limit > 0 {
+		if n := runtime.NumGoroutine(); n >= limit {
+			return eg.overCapacity(resourceGoroutines, n, limit, cameraID)
+		}
+	}
+	if limit := eg.cfg.MemoryLimitMB; limit > 0 {
+		if mb := liveHeapMB(); float64(mb) >= float64(limit)*memoryHeadroom {
+			return eg.overCapacity(resourceMemory, mb, limit, cameraID)
+		}
+	}
+	return nil
+}
+
+// overCapacity logs work refused at a resource's limit, tells the cloud at
+// most every capacityEventInterval, and returns the error to refuse it with
+func (eg *EdgeGateway) overCapacity(resource string, inUse, limit int, cameraID string) error {
+	err := &capacityError{resource: resource, inUse: inUse, limit: limit}
+	if cameraID != "" {
+		log.Printf("Camera %s: %v", cameraID, err)
+	} else {
+		log.Print(err)
+	}
+
+	eg.capacityLock.Lock()
+	last, sent := eg.capacityEvents[resource]
+	due := !sent || time.Since(last) >= capacityEventInterval
+	if due {
+		eg.capacityEvents[resource] = time.Now()
+	}
+	eg.capacityLock.Unlock()
+	if due {
+		payload := map[string]interface{}{
+			"resource": resource,
+			"in_use":   inUse,
+			"limit":    limit,
+		}
+		if cameraID != "" {
+			payload["camera_id"] = cameraID
+		}
+		// Called from ingest loops, which must not wait on the cloud
+		go eg.sendEvent("capacity_exceeded", payload)
+	}
+	return err
+}
+
+// admitStream returns why no new stream can start for a camera: the
+// gateway runs MAX_STREAMS already, or has no headroom left. Called with
+// streamsLock held.
+func (eg *EdgeGateway) admitStream(cameraID string) error {
+	if limit := eg.cfg.MaxStreams; limit > 0 {
+		running := 0
+		for _, stream := range eg.streams {
+			if stream.running() {
+				running++
+			}
+		}
+		if running >= limit {
+			return eg.overCapacity(resourceStreams, running, limit, cameraID)
+		}
+	}
+	return eg.checkHeadroom(cameraID)
+}
+
+// reservePeerConnection takes one of MAX_PEER_CONNECTIONS for a peer
+// connection about to be created. release gives it back, once: when the
+// peer connection closes, or if it couldn't be created.
+func (eg *EdgeGateway) reservePeerConnection() (release func(), err error) {
+	if err := eg.checkHeadroom(""); err != nil {
+		return nil, err
+	}
+	limit := int64(eg.cfg.MaxPeerConnections)
+	for {
+		n := eg.peerConnCount.Load()
+		if limit > 0 && n >= limit {
+			return nil, eg.overCapacity(resourcePeerConnections, int(n), int(limit), "")
+		}
+		if eg.peerConnCount.CompareAndSwap(n, n+1) {
+			return sync.OnceFunc(func() { eg.peerConnCount.Add(-1) }), nil
+		}
+	}
+}
+
+// peerCountFactory creates the interceptor that gives a peer connection's
+// reservation back when it closes
+type peerCountFactory struct {
+	release func()
+}
+
+func (f peerCountFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &peerCountInterceptor{release: f.release}, nil
+}
+
+type peerCountInterceptor struct {
+	interceptor.NoOp
+	release func()
+}
+
+// Close is called when the peer connection closes
+func (i *peerCountInterceptor) Close() error {
+	i.release()
+	return nil
+}
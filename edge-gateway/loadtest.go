@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// loadTestStallAfter is how long a playing viewer can go without video
+// before it counts as stalled
+const loadTestStallAfter = 2 * time.Second
+
+// runLoadTest runs "edge-gateway loadtest": it connects synthetic WHEP
+// viewers to a running gateway, holds them for a soak period, and reports
+// time to first frame, packet loss and failures. It returns the exit code,
+// 1 if a viewer failed or a threshold was exceeded.
+func runLoadTest(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	gateway := flags.String("gateway", "http://localhost:8080", "gateway local API `URL`")
+	cameraList := flags.String("cameras", "", "comma-separated camera `IDs` to spread viewers over (default: every approved camera)")
+	viewers := flags.Int("viewers", 10, "synthetic viewers to connect")
+	profile := flags.String("profile", "", "viewer `profile` (main, low, medium or WxH)")
+	ramp := flags.Duration("ramp", 200*time.Millisecond, "delay between starting viewers")
+	duration := flags.Duration("duration", time.Minute, "how long to hold the viewers once all are started")
+	firstFrameTimeout := flags.Duration("first-frame-timeout", 15*time.Second, "fail a viewer with no frame by then")
+	interval := flags.Duration("report-interval", 10*time.Second, "how often to print progress (0 disables)")
+	maxTTFF := flags.Duration("max-ttff", 0, "fail if the 95th percentile time to first frame is longer (0 disables)")
+	maxLoss := flags.Float64("max-loss", 0, "fail if more than this percentage of packets is lost (0 disables)")
+	flags.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	base := strings.TrimRight(*gateway, "/")
+	var cameras []string
+	if *cameraList != "" {
+		for _, id := range strings.Split(*cameraList, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				cameras = append(cameras, id)
+			}
+		}
+	} else {
+		var err error
+		if cameras, err = loadTestCameras(ctx, base); err != nil {
+			fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+			return 1
+		}
+	}
+	if len(cameras) == 0 || *viewers <= 0 {
+		fmt.Fprintln(os.Stderr, "loadtest: no cameras or viewers to test")
+		return 1
+	}
+
+	fmt.Printf("Starting %d viewers on %d cameras at %s\n", *viewers, len(cameras), base)
+	started := time.Now()
+	test := make([]*loadTestViewer, *viewers)
+	var wg sync.WaitGroup
+	for i := range test {
+		v := &loadTestViewer{cameraID: cameras[i%len(cameras)]}
+		test[i] = v
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.run(ctx, base, *profile, *firstFrameTimeout)
+		}()
+
+		if i < len(test)-1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*ramp):
+			}
+		}
+		if ctx.Err() != nil {
+			test = test[:i+1]
+			break
+		}
+	}
+
+	// Soak, reporting progress
+	var ticks <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	soak := time.NewTimer(*duration)
+	defer soak.Stop()
+soaking:
+	for {
+		select {
+		case <-ctx.Done():
+			break soaking
+		case <-soak.C:
+			break soaking
+		case <-ticks:
+			fmt.Printf("[%s] %s\n", time.Since(started).Round(time.Second), summarizeLoadTest(test).progress())
+		}
+	}
+
+	summary := summarizeLoadTest(test)
+	for _, v := range test {
+		v.stop(base)
+	}
+	wg.Wait()
+	summary.print(os.Stdout)
+
+	code := 0
+	if summary.failed > 0 {
+		code = 1
+	}
+	if *maxTTFF > 0 && summary.percentile(0.95) > *maxTTFF {
+		fmt.Printf("FAIL: p95 time to first frame over %s\n", *maxTTFF)
+		code = 1
+	}
+	if *maxLoss > 0 && summary.lossPercent() > *maxLoss {
+		fmt.Printf("FAIL: packet loss over %.2f%%\n", *maxLoss)
+		code = 1
+	}
+	return code
+}
+
+// loadTestCameras lists the cameras the gateway can stream
+func loadTestCameras(ctx context.Context, base string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/cameras", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing cameras: %s", resp.Status)
+	}
+
+	var cameras []Camera
+	if err := json.NewDecoder(resp.Body).Decode(&cameras); err != nil {
+		return nil, fmt.Errorf("listing cameras: %v", err)
+	}
+	var ids []string
+	for _, camera := range cameras {
+		if camera.Approval == "" {
+			ids = append(ids, camera.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// loadTestViewer is one synthetic WHEP viewer
+type loadTestViewer struct {
+	cameraID string
+
+	lock       sync.Mutex
+	pc         *webrtc.PeerConnection
+	location   string // WHEP session path, once created
+	started    time.Time
+	err        error
+	firstFrame time.Duration // 0 until the first frame arrives
+	frames     uint64
+	packets    uint64
+	lost       uint64
+	bytes      uint64
+	lastPacket time.Time
+	nextSeq    uint16
+	stopped    bool
+}
+
+// run connects the viewer and waits for its first frame
+func (v *loadTestViewer) run(ctx context.Context, base, profile string, firstFrameTimeout time.Duration) {
+	v.lock.Lock()
+	v.started = time.Now()
+	v.lock.Unlock()
+
+	if err := v.connect(ctx, base, profile); err != nil {
+		v.fail(err)
+		return
+	}
+
+	timer := time.NewTimer(firstFrameTimeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		v.lock.Lock()
+		noFrame := v.firstFrame == 0 && !v.stopped
+		v.lock.Unlock()
+		if noFrame {
+			v.fail(fmt.Errorf("no frame within %s", firstFrameTimeout))
+		}
+	}
+}
+
+// connect offers to receive the camera's video over WHEP
+func (v *loadTestViewer) connect(ctx context.Context, base, profile string) error {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	v.lock.Lock()
+	v.pc = pc
+	v.lock.Unlock()
+
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return err
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			v.read(track)
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			v.fail(errors.New("connection failed"))
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	url := base + "/whep/" + v.cameraID
+	if profile != "" {
+		url += "?profile=" + profile
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBufferString(pc.LocalDescription().SDP))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusCreated {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%d %s", resp.StatusCode, apiErr.Error)
+		}
+		return errors.New(resp.Status)
+	}
+
+	v.lock.Lock()
+	v.location = resp.Header.Get("Location")
+	v.lock.Unlock()
+	return pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)})
+}
+
+// read counts the track's packets and frames, and packets lost going by
+// gaps in sequence numbers
+func (v *loadTestViewer) read(track *webrtc.TrackRemote) {
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		now := time.Now()
+
+		v.lock.Lock()
+		if v.packets > 0 {
+			if gap := pkt.SequenceNumber - v.nextSeq; gap < 0x8000 {
+				v.lost += uint64(gap)
+			} else {
+				// Reordered or repeated; not a loss
+				v.lock.Unlock()
+				continue
+			}
+		}
+		v.nextSeq = pkt.SequenceNumber + 1
+		v.packets++
+		v.bytes += uint64(len(pkt.Payload))
+		v.lastPacket = now
+		if pkt.Marker {
+			v.frames++
+			if v.firstFrame == 0 {
+				v.firstFrame = now.Sub(v.started)
+			}
+		}
+		v.lock.Unlock()
+	}
+}
+
+// fail records why the viewer failed, if it hadn't yet, and closes it
+func (v *loadTestViewer) fail(err error) {
+	v.lock.Lock()
+	if v.err != nil || v.stopped {
+		v.lock.Unlock()
+		return
+	}
+	v.err = err
+	pc := v.pc
+	v.lock.Unlock()
+	if pc != nil {
+		pc.Close()
+	}
+}
+
+// stop ends the viewer's WHEP session
+func (v *loadTestViewer) stop(base string) {
+	v.lock.Lock()
+	v.stopped = true
+	pc, location := v.pc, v.location
+	v.lock.Unlock()
+
+	if location != "" {
+		if req, err := http.NewRequest(http.MethodDelete, base+location, nil); err == nil {
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	if pc != nil {
+		pc.Close()
+	}
+}
+
+// loadTestSummary totals the viewers of a load test
+type loadTestSummary struct {
+	viewers  int
+	playing  int // received a frame and not failed
+	stalled  int // playing, but nothing for loadTestStallAfter
+	failed   int
+	errors   map[string]int
+	ttff     []time.Duration // sorted
+	packets  uint64
+	lost     uint64
+	frames   uint64
+	bytes    uint64
+	duration time.Duration // summed over playing viewers since their first frame
+}
+
+func summarizeLoadTest(viewers []*loadTestViewer) *loadTestSummary {
+	s := &loadTestSummary{viewers: len(viewers), errors: make(map[string]int)}
+	now := time.Now()
+	for _, v := range viewers {
+		v.lock.Lock()
+		if v.firstFrame > 0 {
+			s.ttff = append(s.ttff, v.firstFrame)
+		}
+		s.packets += v.packets
+		s.lost += v.lost
+		s.frames += v.frames
+		s.bytes += v.bytes
+		switch {
+		case v.err != nil:
+			s.failed++
+			s.errors[v.err.Error()]++
+		case v.firstFrame > 0:
+			s.playing++
+			s.duration += now.Sub(v.started) - v.firstFrame
+			if now.Sub(v.lastPacket) > loadTestStallAfter {
+				s.stalled++
+			}
+		}
+		v.lock.Unlock()
+	}
+	sort.Slice(s.ttff, func(i, j int) bool { return s.ttff[i] < s.ttff[j] })
+	return s
+}
+
+// percentile returns the time to first frame p of the viewers got within
+func (s *loadTestSummary) percentile(p float64) time.Duration {
+	if len(s.ttff) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(s.ttff)))) - 1
+	return s.ttff[max(i, 0)]
+}
+
+func (s *loadTestSummary) lossPercent() float64 {
+	if s.packets+s.lost == 0 {
+		return 0
+	}
+	return float64(s.lost) * 100 / float64(s.packets+s.lost)
+}
+
+// progress is a one-line status for periodic reports
+func (s *loadTestSummary) progress() string {
+	return fmt.Sprintf("%d/%d playing, %d stalled, %d failed, %.2f%% lost",
+		s.playing, s.viewers, s.stalled, s.failed, s.lossPercent())
+}
+
+func (s *loadTestSummary) print(w io.Writer) {
+	fmt.Fprintf(w, "Viewers: %d, playing %d, stalled %d, failed %d\n", s.viewers, s.playing, s.stalled, s.failed)
+	reasons := make([]string, 0, len(s.errors))
+	for reason := range s.errors {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %d x %s\n", s.errors[reason], reason)
+	}
+
+	if len(s.ttff) > 0 {
+		fmt.Fprintf(w, "Time to first frame: p50 %s, p95 %s, max %s\n",
+			s.percentile(0.5).Round(time.Millisecond), s.percentile(0.95).Round(time.Millisecond),
+			s.ttff[len(s.ttff)-1].Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "Packets: %d received, %d lost (%.2f%%)\n", s.packets, s.lost, s.lossPercent())
+	if seconds := s.duration.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, "Per viewer: %.1f frames/s, %.0f kbps\n", float64(s.frames)/seconds, float64(s.bytes)*8/1000/seconds)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// localEncoderCopy is the LOCAL_CAMERA_ENCODER that forwards the H.264 of
+// cameras that encode it themselves, such as many UVC webcams
+const localEncoderCopy = "copy"
+
+// localCameraPrefix starts the IDs of local cameras
+const localCameraPrefix = "local-"
+
+// registerLocalCameras registers a camera for each LOCAL_CAMERAS device. A
+// device that isn't plugged in yet is registered all the same, and streams
+// once it is.
+func (eg *EdgeGateway) registerLocalCameras() {
+	for _, device := range eg.cfg.LocalCameras {
+		if _, err := os.Stat(device); err != nil {
+			log.Printf("Local camera %s: %v", device, err)
+		}
+		camera := &Camera{
+			ID:     localCameraID(device),
+			Name:   "Local Camera " + filepath.Base(device),
+			Model:  localDeviceName(device),
+			Device: device,
+			Manual: true,
+		}
+		if eg.registerCamera(camera) {
+			eg.notifyCameraStatus(camera, "added")
+		}
+	}
+	if len(eg.cfg.LocalCameras) > 0 {
+		log.Printf("Registered %d local cameras, encoder %s", len(eg.cfg.LocalCameras), eg.cfg.LocalCameraEncoder)
+	}
+}
+
+// localCameraID derives a camera ID from a device path, such as
+// local-video0 for /dev/video0
+func localCameraID(device string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, filepath.Base(device))
+	return localCameraPrefix + name
+}
+
+// localDeviceName returns the name the V4L2 driver gives a device, such as
+// HD Pro Webcam C920, or a generic model if it can't be read
+func localDeviceName(device string) string {
+	// Stable names such as /dev/v4l/by-id/... link to /dev/videoN
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/class/video4linux", filepath.Base(device), "name"))
+	if name := strings.TrimSpace(string(data)); err == nil && name != "" {
+		return name
+	}
+	return "V4L2 device"
+}
+
+// startLocalDevice runs ffmpeg on a camera's video device, encoding it to
+// H.264 in MPEG-TS on stdout. zoom is a digital PTZ filter, mask a privacy
+// mask filter and osd an overlay filter, any of them empty.
+func startLocalDevice(cfg *Config, camera *Camera, zoom, mask, osd string) (ingestSource, error) {
+	if err := localDeviceReady(camera); err != nil {
+		return nil, err
+	}
+	session, err := startFFmpeg(cfg.FFmpegPath, localDeviceArgs(cfg, camera.Device, zoom, mask, osd), videoCodecH264, func() {})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Capturing camera %s from %s (%s)", camera.ID, camera.Device, cfg.LocalCameraEncoder)
+	return session, nil
+}
+
+// localDeviceArgs builds the ffmpeg command line of a local device: capture
+// it at LOCAL_CAMERA_RESOLUTION and LOCAL_CAMERA_FPS, apply the filters, and
+// encode it with LOCAL_CAMERA_ENCODER
+func localDeviceArgs(cfg *Config, device, zoom, mask, osd string) []string {
+	encoder := cfg.LocalCameraEncoder
+	var filters []string
+	for _, filter := range []string{mask, zoom, osd} {
+		if filter != "" {
+			filters = append(filters, filter)
+		}
+	}
+	// Filters need decoded frames
+	if encoder == localEncoderCopy && len(filters) > 0 {
+		encoder = hwaccelNone
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	if encoder == hwaccelVAAPI {
+		args = append(args, "-init_hw_device", "vaapi=va:"+cfg.TranscodeDevice, "-filter_hw_device", "va")
+	}
+	args = append(args, "-f", "v4l2")
+	if cfg.LocalCameraInputFormat != "" {
+		args = append(args, "-input_format", cfg.LocalCameraInputFormat)
+	}
+	if cfg.LocalCameraResolution != "" {
+		args = append(args, "-video_size", cfg.LocalCameraResolution)
+	}
+	args = append(args,
+		"-framerate", strconv.Itoa(cfg.LocalCameraFPS),
+		"-i", device,
+		"-map", "0:v:0")
+
+	if encoder == localEncoderCopy {
+		args = append(args, "-c:v", "copy")
+	} else {
+		switch encoder {
+		case hwaccelVAAPI:
+			filters = append(filters, "format=nv12", "hwupload")
+		default:
+			filters = append(filters, "format=yuv420p")
+		}
+		args = append(args, "-vf", strings.Join(filters, ","))
+		args = append(args, h264EncoderArgs(encoder, cfg.LocalCameraBitrate)...)
+	}
+	return append(args, "-f", "mpegts", "-flush_packets", "1", "pipe:1")
+}
+
+// localDeviceReady checks that a local camera's device is plugged in
+func localDeviceReady(camera *Camera) error {
+	info, err := os.Stat(camera.Device)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a video device", camera.Device)
+	}
+	return nil
+}
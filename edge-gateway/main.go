@@ -2,64 +2,269 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/pion/rtcp"
-	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/deepch/vdk/av"
-	"github.com/deepch/vdk/codec/h264parser"
-	"github.com/deepch/vdk/format/rtsp"
 	"github.com/grandcat/zeroconf"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Build information, set with -ldflags by the Makefile
+var (
+	Version   = "1.0.0"
+	BuildTime = ""
+	GoVersion = ""
 )
 
 // Camera represents a discovered camera
 type Camera struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Model       string `json:"model"`
-	IP          string `json:"ip"`
-	Port        int    `json:"port"`
-	RTSPUrl     string `json:"rtsp_url"`
-	Username    string `json:"username"`
-	Password    string `json:"password"`
-	HasPTZ      bool   `json:"has_ptz"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Model    string `json:"model"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	RTSPUrl  string `json:"rtsp_url"` // without credentials; see CredentialStore
+	HasPTZ   bool   `json:"has_ptz"`
+	Manual   bool   `json:"manual"`
+	Vendor   string `json:"vendor,omitempty"`
+	RTSPPath string `json:"rtsp_path,omitempty"`
+
+	// Sensors of a multi-sensor camera are sub-cameras of the camera at
+	// ParentID, one per video source numbered from 1
+	ParentID string `json:"parent_id,omitempty"`
+	Channel  int    `json:"channel,omitempty"`
+
+	// HTTPS for VAPIX and ONVIF calls, and TLS settings for those and
+	// rtsps:// streams, over the CAMERA_HTTPS and CAMERA_TLS_* defaults
+	HTTPS         bool   `json:"https,omitempty"`
+	TLSCAFile     string `json:"tls_ca_file,omitempty"`
+	TLSSkipVerify bool   `json:"tls_skip_verify,omitempty"`
+
+	Capabilities *CameraCapabilities `json:"capabilities,omitempty"`
+
+	// MAC is the address discovery saw the camera at, on the gateway's own
+	// subnets. Approval is pending or rejected for a discovered camera not
+	// yet approved, which can't stream.
+	MAC      string `json:"mac,omitempty"`
+	Approval string `json:"approval,omitempty"`
+
+	// Metadata is set by operators; its name, if any, is also Name
+	Metadata *CameraMetadata `json:"metadata,omitempty"`
+	// Tenant is the customer or department the camera belongs to, empty
+	// for the gateway's operator
+	Tenant string `json:"tenant,omitempty"`
+
+	// HTTPPort is the camera's web server port, if not the scheme's default
+	HTTPPort int `json:"http_port,omitempty"`
+	// Simulated cameras are served by the gateway itself (--simulate) and
+	// never saved to the inventory
+	Simulated bool `json:"simulated,omitempty"`
+	// Device is the video device of a local camera (LOCAL_CAMERAS), such as
+	// /dev/video0, captured instead of an RTSP stream. Local cameras are
+	// never saved to the inventory either.
+	Device string `json:"device,omitempty"`
+	// Generic cameras are RTSP sources registered as they are, such as NVR
+	// channels and doorbells. Nothing is probed or controlled on the device
+	// behind them.
+	Generic bool `json:"generic,omitempty"`
 }
 
 // EdgeGateway manages the gateway operations
 type EdgeGateway struct {
-	cloudURL      string
-	wsConn        *websocket.Conn
-	wsLock        sync.Mutex
-	cameras       map[string]*Camera
-	camerasLock   sync.RWMutex
-	streams       map[string]*CameraStream
-	streamsLock   sync.RWMutex
-	peerConns     map[string]*webrtc.PeerConnection
-	peerConnsLock sync.RWMutex
+	cfg       *Config
+	ctx       context.Context    // cancelled when the gateway shuts down
+	stop      context.CancelFunc // cancels ctx
+	startedAt time.Time
+	workers   sync.WaitGroup
+	cloudURL  string
+	cloudConn CloudConn
+	cloudLock sync.Mutex
+	// cloudStatus and cloudWatchers are guarded by cloudStateLock
+	cloudStatus      CloudStatus
+	cloudWatchers    map[cloudWatcher]struct{}
+	cloudStateLock   sync.Mutex
+	cameras          map[string]*Camera
+	camerasLock      sync.RWMutex
+	streams          map[string]*CameraStream
+	streamsLock      sync.RWMutex
+	peerConns        map[string]*cloudPeer // by viewer session ID
+	peerConnsLock    sync.RWMutex
+	whepSessions     map[string]*webrtc.PeerConnection
+	whepLock         sync.Mutex
+	viewers          map[string]*Viewer
+	viewersLock      sync.Mutex
+	webrtcSettings   webrtc.SettingEngine
+	iceMuxes         []io.Closer // shared ICE sockets, closed at cleanup
+	hlsLeases        map[string]*hlsLease
+	hlsLock          sync.Mutex
+	hlsUploads       chan hlsUpload // nil unless segments are pushed to GCS
+	hlsPending       atomic.Int64   // queued or in-flight uploads
+	analytics        map[string]*analyticsSession
+	analyticsLock    sync.Mutex // never held while taking another lock
+	relays           map[string]*Relay
+	relaysLock       sync.Mutex
+	outbound         map[string]outboundSession // by viewer or relay session
+	budgetLock       sync.Mutex
+	peerConnCount    atomic.Int64         // open viewer peer connections
+	capacityEvents   map[string]time.Time // last capacity_exceeded by resource
+	capacityLock     sync.Mutex
+	stalls           map[string]int // stuck sessions in a row by camera
+	stallsLock       sync.Mutex
+	gopRequests      map[string]time.Time // last asked for a shorter GOP by camera
+	gopLock          sync.Mutex
+	ptz              map[string]*ptzController
+	ptzLock          sync.Mutex
+	dptz             map[string]*digitalPTZ // guarded by ptzLock
+	credentials      *CredentialStore
+	e2ee             *E2EEKeyStore
+	privacy          *PrivacyMaskStore
+	encoderProfiles  *EncoderProfileStore
+	auditLog         *AuditLog
+	mqtt             *MQTTBridge // nil unless MQTT_BROKER_URL is set
+	cluster          *Cluster    // nil unless CLUSTER_ENABLED is set
+	ha               *HAPair     // nil unless HA_ROLE is set
+	transcoder       *Transcoder // nil unless TRANSCODE_ENABLED is set
+	outbox           *Outbox
+	dispatcher       *cloudDispatcher
+	commands         commandTracker
+	httpClients      *CameraHTTPManager
+	quarantine       *QuarantineManager
+	scanner          *NetworkScanner
+	telemetrySampler telemetrySampler
+	clockAudit       clockAudit
+	// heartbeatSeq numbers heartbeats, lastPong is when the cloud last
+	// answered one on this connection in Unix nanoseconds, 0 until it does
+	heartbeatSeq     atomic.Uint64
+	lastPong         atomic.Int64
+	subsystemResults subsystemResults
+	inventorySync    inventorySync
+	// maintenance holds the action running on each camera under
+	// maintenance, and resetConfirmations the factory resets awaiting
+	// confirmation; both guarded by maintenanceLock
+	maintenance        map[string]string
+	resetConfirmations map[string]resetConfirmation
+	maintenanceLock    sync.Mutex
+	// credentialRequests are the discovered cameras waiting for a login,
+	// by camera ID
+	credentialRequests     map[string]*CredentialRequest
+	credentialRequestsLock sync.Mutex
+	// cameraNotices are the camera_status last sent for each camera,
+	// guarded by cameraNoticesLock; inventory is the batch of statuses
+	// waiting to go out in camera_inventory, guarded by inventoryLock
+	cameraNotices     map[string]*cameraNotice
+	cameraNoticesLock sync.Mutex
+	inventory         []CameraStatusEntry
+	inventoryTimer    *time.Timer
+	inventoryLock     sync.Mutex
+	// updating is set while an update is installed or confirmed, and
+	// restartReason once main should start the binary again
+	updating      atomic.Bool
+	restartReason string
+	restartLock   sync.Mutex
+	// liveSettings are baseSettings, those of the environment as last
+	// loaded, with remoteConfig, the accumulated set_config deltas,
+	// applied; all guarded by settingsLock
+	liveSettings Settings
+	baseSettings Settings
+	remoteConfig RemoteConfig
+	settingsLock sync.RWMutex
 }
 
 // CameraStream manages RTSP to WebRTC conversion
 type CameraStream struct {
-	camera       *Camera
-	rtspClient   *rtsp.RTSPClient
-	videoTrack   *webrtc.TrackLocalStaticSample
-	audioTrack   *webrtc.TrackLocalStaticSample
-	stopChan     chan bool
-	isRunning    bool
-	runningLock  sync.Mutex
+	camera     *Camera
+	profile    string       // viewer profile, viewerProfileMain for the main stream
+	codec      string       // videoCodecH264, or VP9 or AV1 from the transcoder
+	source     ingestSource // the current RTSP session or transcoder
+	videoTrack *rtpTrack
+	// audioTrack carries the camera's audio to viewers that turned it on,
+	// created once an ingest has G.711 or Opus audio, guarded by
+	// runningLock
+	audioTrack *webrtc.TrackLocalStaticSample
+	// ridTrack carries the same video with the RTP stream ID of the
+	// stream's simulcast layer, for SFUs; nil for other streams
+	ridTrack *rtpTrack
+	// videoQueue feeds videoTrack from its own goroutine, which alone uses
+	// packetizer; videoWaitKey is set by the ingest after an overflow until
+	// the next keyframe. videoQueued is the bytes waiting, capped at
+	// STREAM_QUEUE_MAX_KB, and onQueueFull reports an overflow against it.
+	videoQueue   chan av.Packet
+	videoQueued  atomic.Int64
+	onQueueFull  func(kb int)
+	packetizer   *videoPacketizer
+	videoWaitKey bool
+	stats        *streamStats
+	abr          *abrController // nil if the camera can't be re-profiled
+	hls          *HLSPackager   // nil unless HLS is enabled for the camera
+	transcoder   *Transcoder    // nil unless transcoding is enabled
+	dptz         *digitalPTZ    // nil unless the camera uses digital PTZ
+	overlay      func() string  // the camera's current overlay filter
+	localConfig  *Config        // the capture settings of local cameras
+	// watermark is drawn on streams that are one viewer session's own
+	watermark *streamWatermark
+
+	credentials *CredentialStore
+	e2ee        *E2EEKeyStore
+	privacy     *PrivacyMaskStore
+	tlsConfig   *tls.Config // for rtsps:// cameras
+
+	// sinks receive every packet of the ingest, and gop keeps the packets
+	// since its last keyframe, guarded by sinksLock
+	sinks       []packetSink
+	codecs      []av.CodecData
+	gop         gopBuffer
+	sinksLock   sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	isRunning   bool
+	runningLock sync.Mutex
+
+	// cancelSession ends the current RTSP session, and stuck marks one
+	// ended by the stall watchdog, guarded by runningLock. lastVideo is
+	// when the session last delivered video, in Unix nanoseconds.
+	cancelSession context.CancelFunc
+	stuck         bool
+	lastVideo     atomic.Int64
+	// viewers counts attached peers, onDemand marks streams opened by a
+	// viewer rather than start_stream, and idleTimer stops an on-demand
+	// stream left without viewers, all guarded by runningLock
+	viewers   int
+	onDemand  bool
+	idleTimer *time.Timer
+	// frameWaiters are closed when the next video frame reaches viewers,
+	// guarded by runningLock
+	frameWaiters []chan struct{}
+	// onGOP is called by the ingest at each keyframe after the first of a
+	// session, with the time since the last and the video frames between
+	onGOP func(gap time.Duration, frames int)
+	// onFrame is called with each frame sent to viewers, and lastFrameMeta
+	// is when one was last reported on the meta channel, only touched by
+	// writeVideo
+	onFrame       func(av.Packet)
+	lastFrameMeta time.Time
+	// unsupportedCodec marks a camera codec that must be transcoded and
+	// transcoding names the hardware of the current session, if any, both
+	// guarded by runningLock
+	unsupportedCodec bool
+	transcoding      string
 }
 
 // Message types for WebSocket communication
@@ -71,561 +276,2077 @@ type WSMessage struct {
 type OfferMessage struct {
 	CameraID string                    `json:"camera_id"`
 	SDP      webrtc.SessionDescription `json:"sdp"`
+	Profile  string                    `json:"profile,omitempty"` // high, medium, low, or WxH
+	// SessionID names the viewer session; the gateway picks one if empty
+	SessionID string `json:"session_id,omitempty"`
+	// TraceParent continues the cloud's trace (W3C trace context)
+	TraceParent string `json:"traceparent,omitempty"`
+	// Watermark is the viewer identity drawn on the session's video, if any
+	Watermark string `json:"watermark,omitempty"`
+	// Token permits the session to view the camera, if
+	// STREAM_TOKEN_PUBLIC_KEY requires one
+	Token string `json:"token,omitempty"`
 }
 
 type PTZCommand struct {
-	CameraID string  `json:"camera_id"`
-	Action   string  `json:"action"` // pan_left, pan_right, tilt_up, tilt_down, zoom_in, zoom_out, stop
-	Speed    float64 `json:"speed"`  // 0.0 to 1.0
+	CameraID string `json:"camera_id"`
+	// pan_left, pan_right, tilt_up, tilt_down, zoom_in, zoom_out,
+	// focus_near, focus_far, iris_open, iris_close, autofocus, auto_iris,
+	// ir_cut, ir_illuminator, status_led, wiper, washer, stop, lock, unlock
+	Action string  `json:"action"`
+	Speed  float64 `json:"speed"` // 0.0 to 1.0
+	// Enabled turns autofocus, auto_iris, ir_illuminator or status_led on
+	// or off
+	Enabled *bool `json:"enabled,omitempty"`
+	// Mode is the ir_cut filter mode: on, off or auto
+	Mode string `json:"mode,omitempty"`
+	// Operator identifies who is in control, for locking
+	Operator string `json:"operator,omitempty"`
+	Priority string `json:"priority,omitempty"` // automation, operator (default), or admin
+	// LeaseSecs is how long a lock lasts without commands
+	LeaseSecs float64 `json:"lease_secs,omitempty"`
 }
 
-func NewEdgeGateway(cloudURL string) *EdgeGateway {
-	return &EdgeGateway{
-		cloudURL:  cloudURL,
-		cameras:   make(map[string]*Camera),
-		streams:   make(map[string]*CameraStream),
-		peerConns: make(map[string]*webrtc.PeerConnection),
+func NewEdgeGateway(cfg *Config) *EdgeGateway {
+	credentials := NewCredentialStore()
+	eg := &EdgeGateway{
+		cfg:                cfg,
+		ctx:                context.Background(),
+		startedAt:          time.Now(),
+		cloudURL:           cfg.CloudURL,
+		cameras:            make(map[string]*Camera),
+		streams:            make(map[string]*CameraStream),
+		peerConns:          make(map[string]*cloudPeer),
+		whepSessions:       make(map[string]*webrtc.PeerConnection),
+		viewers:            make(map[string]*Viewer),
+		analytics:          make(map[string]*analyticsSession),
+		hlsLeases:          make(map[string]*hlsLease),
+		relays:             make(map[string]*Relay),
+		outbound:           make(map[string]outboundSession),
+		capacityEvents:     make(map[string]time.Time),
+		stalls:             make(map[string]int),
+		gopRequests:        make(map[string]time.Time),
+		ptz:                make(map[string]*ptzController),
+		dptz:               make(map[string]*digitalPTZ),
+		maintenance:        make(map[string]string),
+		resetConfirmations: make(map[string]resetConfirmation),
+		cloudWatchers:      make(map[cloudWatcher]struct{}),
+		credentials:        credentials,
+		credentialRequests: make(map[string]*CredentialRequest),
+		cameraNotices:      make(map[string]*cameraNotice),
+		e2ee:               NewE2EEKeyStore(),
+		privacy:            NewPrivacyMaskStore(),
+		encoderProfiles:    NewEncoderProfileStore(),
+		auditLog:           NewAuditLog(cfg),
+		httpClients:        NewCameraHTTPManager(cfg, credentials),
+		quarantine:         NewQuarantineManager(cfg),
+		outbox:             NewOutbox(cfg),
+		dispatcher:         newCloudDispatcher(cfg.CloudMessageWorkers),
+		liveSettings:       settingsFromConfig(cfg),
+		baseSettings:       settingsFromConfig(cfg),
 	}
+	eg.scanner = NewNetworkScanner(eg)
+	eg.mqtt = NewMQTTBridge(eg, cfg)
+	eg.cluster = NewCluster(cfg)
+	eg.ha = NewHAPair(cfg)
+	eg.transcoder = NewTranscoder(cfg)
+	// HLS can be enabled later with set_config
+	if cfg.HLSGCSBucket != "" {
+		eg.hlsUploads = make(chan hlsUpload, 64)
+	}
+	return eg
 }
 
 // Start initializes and runs the edge gateway
 func (eg *EdgeGateway) Start(ctx context.Context) error {
-	// Connect to cloud orchestrator
-	if err := eg.connectToCloud(); err != nil {
-		return fmt.Errorf("failed to connect to cloud: %v", err)
+	ctx, eg.stop = context.WithCancel(ctx)
+	defer eg.stop()
+	eg.ctx = ctx
+
+	// Local REST API, served while a standby waits too
+	eg.goTracked(func() { eg.startLocalAPI(ctx) })
+
+	// Ping the systemd watchdog while healthy
+	eg.goTracked(func() { eg.runWatchdog(ctx) })
+
+	// A standby mirrors the active's state until it fails, then starts from
+	// that state as the active would after a restart
+	if !eg.awaitActive(ctx) {
+		eg.workers.Wait()
+		return nil
+	}
+
+	// Confirm or roll back an update installed by the last run
+	eg.checkPendingUpdate()
+	eg.loadRemoteConfig()
+
+	// Connect to cloud orchestrator. Cameras are served locally while it is
+	// unreachable, and the message handler keeps retrying.
+	eg.setupWebRTCNetwork()
+	eg.setCloudState(cloudStateConnecting, 0, nil, 0)
+	eg.outbox.Load()
+	eg.credentials.Load(eg.credentialsPath())
+	eg.e2ee.Load(eg.e2eeKeysPath())
+	eg.privacy.Load(eg.privacyMasksPath())
+	eg.encoderProfiles.Load(eg.encoderProfilesPath())
+	// Records raised while shutting down are shipped too, so the client
+	// outlives ctx until cleanup closes it
+	if eg.cfg.AuditCloudLogging {
+		if err := eg.auditLog.StartCloudLogging(context.Background(), eg.cfg.AuditProjectID); err != nil {
+			log.Printf("Audit: Cloud Logging disabled: %v", err)
+		}
+	}
+	eg.loadCameras()
+	eg.startSimulator(ctx)
+	eg.registerLocalCameras()
+	if err := eg.connectToCloud(ctx); err != nil {
+		log.Printf("Failed to connect to cloud: %v", redactCredentials(err.Error()))
 	}
 
 	// Start camera discovery
-	go eg.discoverCameras(ctx)
+	eg.goTracked(func() { eg.discoverCameras(ctx) })
 
 	// Start WebSocket message handler
-	go eg.handleWebSocketMessages(ctx)
+	eg.goTracked(func() { eg.handleWebSocketMessages(ctx) })
 
 	// Keep alive loop
-	go eg.keepAlive(ctx)
+	eg.goTracked(func() { eg.keepAlive(ctx) })
+
+	// Local RTSP server for NVR/VMS recording
+	eg.goTracked(func() { eg.startRTSPServer(ctx) })
+
+	// Re-test quarantined cameras
+	eg.goTracked(func() { eg.monitorQuarantine(ctx) })
+
+	// Report stream quality
+	eg.goTracked(func() { eg.monitorStreamHealth(ctx) })
+
+	// Report viewers' connection quality
+	eg.goTracked(func() { eg.monitorViewerStats(ctx) })
+
+	// Close viewers that stopped sending RTCP
+	eg.goTracked(func() { eg.reapIdleSessions(ctx) })
+
+	// Send PTZ positions and stream health to viewers' meta channels
+	eg.goTracked(func() { eg.runMetaBus(ctx) })
+
+	// Report resource usage and load
+	eg.goTracked(func() { eg.monitorTelemetry(ctx) })
+
+	// Check the gateway's and cameras' clocks
+	eg.goTracked(func() { eg.monitorClocks(ctx) })
+
+	// Keep cameras' encoders at their profiles
+	eg.goTracked(func() { eg.monitorEncoders(ctx) })
+
+	// Send inventory changes once the orchestrator has a snapshot
+	eg.goTracked(func() { eg.monitorInventory(ctx) })
+
+	// Report changes of cameras' digital inputs
+	eg.goTracked(func() { eg.monitorIOInputs(ctx) })
+
+	// Restart viewers' ICE when the uplink changes
+	eg.goTracked(func() { eg.watchNetwork(ctx) })
+
+	// Record clips of camera events
+	if eg.cfg.EventClipsEnabled {
+		eg.goTracked(func() { eg.runEventClips(ctx) })
+	}
+
+	// Forward cameras' audio detections
+	if eg.cfg.AudioEvents {
+		eg.goTracked(func() { eg.runAudioEvents(ctx) })
+	}
+
+	// Run sampled frames through the inference runner
+	if eg.cfg.InferenceRunner != inferenceRunnerNone {
+		eg.goTracked(func() { eg.runInference(ctx) })
+	}
+
+	// Mirror events to MQTT and accept commands from it
+	if eg.mqtt != nil {
+		eg.goTracked(func() { eg.mqtt.Run(ctx) })
+	}
+
+	// Find the other gateways of the cluster and split cameras with them
+	if eg.cluster != nil {
+		eg.goTracked(func() { eg.runCluster(ctx) })
+	}
+
+	// Watch the standby, and step down should both become active
+	if eg.ha != nil {
+		eg.goTracked(func() { eg.runHA(ctx) })
+	}
+
+	// Push HLS segments to GCS, until draining has flushed the last ones
+	uploadCtx, stopUploads := context.WithCancel(context.Background())
+	defer stopUploads()
+	if eg.hlsUploads != nil {
+		eg.goTracked(func() { eg.runHLSUploads(uploadCtx) })
+	}
+
+	sdNotify("READY=1")
 
 	// Wait for context cancellation
 	<-ctx.Done()
+	sdNotify("STOPPING=1")
+	shutdownStarted := time.Now()
+	eg.drain()
+	stopUploads()
 	eg.cleanup()
+
+	// Give background work the rest of the shutdown timeout to observe
+	// cancellation
+	done := make(chan struct{})
+	go func() {
+		eg.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(eg.cfg.ShutdownTimeout - time.Since(shutdownStarted)):
+		log.Printf("Background tasks still running after %s", eg.cfg.ShutdownTimeout)
+	}
+	log.Printf("Shutdown completed in %s", time.Since(shutdownStarted).Round(time.Millisecond))
 	return nil
 }
 
-// connectToCloud establishes WebSocket connection to cloud orchestrator
-func (eg *EdgeGateway) connectToCloud() error {
-	header := http.Header{}
-	header.Add("X-Gateway-ID", getGatewayID())
-	header.Add("X-Gateway-Version", "1.0.0")
+// goTracked runs fn in a goroutine that shutdown waits for
+func (eg *EdgeGateway) goTracked(fn func()) {
+	eg.workers.Add(1)
+	go func() {
+		defer eg.workers.Done()
+		fn()
+	}()
+}
 
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 30 * time.Second,
+// connectToCloud establishes a WebSocket or gRPC session with the cloud
+// orchestrator
+func (eg *EdgeGateway) connectToCloud(ctx context.Context) error {
+	conn, err := dialCloud(ctx, eg.cfg, eg.cloudURL)
+	if err != nil {
+		return err
 	}
 
-	conn, _, err := dialer.Dial(eg.cloudURL, header)
+	// Tell the orchestrator what this gateway can do, then deliver what
+	// happened while offline, before any new events go out
+	hello, err := json.Marshal(eg.capabilities())
 	if err != nil {
+		conn.Close()
 		return err
 	}
+	eg.cloudLock.Lock()
+	if err := conn.Send(WSMessage{Type: "hello", Payload: hello}); err != nil {
+		eg.cloudLock.Unlock()
+		conn.Close()
+		return err
+	}
+	eg.cloudConn = conn
+	eg.lastPong.Store(0)
+	eg.deliverOutbox()
+	eg.cloudLock.Unlock()
+	eg.setCloudState(cloudStateConnected, 0, nil, 0)
 
-	eg.wsLock.Lock()
-	eg.wsConn = conn
-	eg.wsLock.Unlock()
-
-	log.Printf("Connected to cloud orchestrator at %s", eg.cloudURL)
+	log.Printf("Connected to cloud orchestrator at %s over %s (%s)", eg.cloudURL, cloudTransport(eg.cloudURL), conn.Encoding())
 	return nil
 }
 
-// discoverCameras uses mDNS/Bonjour to find Axis cameras
+// discoverCameras uses mDNS/Bonjour and network scans to find cameras
 func (eg *EdgeGateway) discoverCameras(ctx context.Context) {
+	eg.browseMDNS(ctx)
+
+	// Also scan local subnets for RTSP cameras
+	eg.goTracked(func() { eg.scanner.Run(ctx) })
+}
+
+// defaultMDNSServices are browsed unless MDNS_SERVICES is set
+var defaultMDNSServices = []string{"_axis-video._tcp", "_rtsp._tcp", "_http._tcp"}
+
+// genericMDNSServices are announced by all sorts of devices, so only the
+// Axis cameras among them are taken
+var genericMDNSServices = map[string]bool{
+	"_rtsp._tcp": true,
+	"_http._tcp": true,
+}
+
+// browseMDNS registers the cameras mDNS announces until ctx ends
+func (eg *EdgeGateway) browseMDNS(ctx context.Context) {
+	if !eg.cfg.MDNSEnabled {
+		log.Printf("mDNS discovery is disabled")
+		return
+	}
 	resolver, err := zeroconf.NewResolver(nil)
+	eg.recordSubsystem("discovery", err)
 	if err != nil {
 		log.Printf("Failed to initialize mDNS resolver: %v", err)
 		return
 	}
 
-	entries := make(chan *zeroconf.ServiceEntry)
-	go func() {
-		for entry := range entries {
-			// Check if it's an Axis camera
-			if strings.Contains(strings.ToLower(entry.Instance), "axis") ||
-				strings.Contains(strings.ToLower(entry.Service), "axis") {
-				eg.processDiscoveredCamera(entry)
+	// Search for cameras via mDNS. Each browse closes its channel when ctx
+	// ends, so they can't share one.
+	for _, service := range eg.cfg.MDNSServices {
+		entries := make(chan *zeroconf.ServiceEntry)
+		go func(svc string) {
+			for entry := range entries {
+				isAxis := strings.Contains(strings.ToLower(entry.Instance), "axis") ||
+					strings.Contains(strings.ToLower(entry.Service), "axis")
+				switch {
+				case isAxis:
+					eg.processDiscoveredCamera(ctx, entry, "axis")
+				case !genericMDNSServices[svc]:
+					// Other services say nothing of the vendor
+					eg.processDiscoveredCamera(ctx, entry, "")
+				}
 			}
-		}
-	}()
-
-	// Search for Axis cameras via mDNS
-	services := []string{"_axis-video._tcp", "_rtsp._tcp", "_http._tcp"}
-	for _, service := range services {
+		}(service)
 		go func(svc string) {
 			err := resolver.Browse(ctx, svc, "local.", entries)
 			if err != nil {
 				log.Printf("Failed to browse %s: %v", svc, err)
+				eg.recordSubsystem("discovery", fmt.Errorf("mDNS: %w", err))
 			}
 		}(service)
 	}
-
-	// Also scan common RTSP ports
-	go eg.scanNetworkForCameras(ctx)
 }
 
-// processDiscoveredCamera processes a discovered camera
-func (eg *EdgeGateway) processDiscoveredCamera(entry *zeroconf.ServiceEntry) {
-	if len(entry.AddrIPv4) == 0 {
+// processDiscoveredCamera processes a discovered camera. A camera of no
+// vendor is probed for its vendor's RTSP path, as the scanner does.
+func (eg *EdgeGateway) processDiscoveredCamera(ctx context.Context, entry *zeroconf.ServiceEntry, vendor string) {
+	ip := discoveredAddress(entry)
+	if ip == "" {
 		return
 	}
-
-	ip := entry.AddrIPv4[0].String()
-	camera := &Camera{
-		ID:       fmt.Sprintf("axis-%s", strings.ReplaceAll(ip, ".", "-")),
-		Name:     entry.Instance,
-		IP:       ip,
-		Port:     entry.Port,
-		Username: os.Getenv("CAMERA_USERNAME"),
-		Password: os.Getenv("CAMERA_PASSWORD"),
+	// Waiting for its login
+	if eg.credentialsPending(ip) {
+		return
 	}
 
-	// Default credentials if not set
-	if camera.Username == "" {
-		camera.Username = "root"
+	camera := &Camera{
+		ID:     cameraIDFromIP(ip),
+		Name:   entry.Instance,
+		IP:     ip,
+		Port:   entry.Port,
+		Vendor: vendor,
 	}
-	if camera.Password == "" {
-		camera.Password = "pass"
+	status := "discovered"
+	if vendor == "" {
+		// Known cameras aren't probed again, as the scanner skips them
+		if eg.knownCameraIP(ip) {
+			return
+		}
+		if err := eg.detectRTSPProfile(ctx, camera); err != nil {
+			if !errors.Is(err, errCredentialsRejected) {
+				log.Printf("Failed to find an RTSP stream on %s: %v", camera.IP, err)
+				return
+			}
+			if !eg.initializeCamera(ctx, camera) {
+				eg.requireCredentials(camera, "mdns", err)
+				return
+			}
+			if err := eg.detectRTSPProfile(ctx, camera); err != nil {
+				log.Printf("Camera at %s initialized but not streaming: %v", ip, err)
+				return
+			}
+			status = "provisioned"
+		}
+	} else {
+		rtspURL, err := eg.resolveRTSPURL(ctx, camera)
+		if err != nil {
+			log.Printf("Failed to resolve RTSP URL for %s: %v", camera.IP, err)
+			return
+		}
+		camera.RTSPUrl = rtspURL
 	}
 
-	// Build RTSP URL
-	camera.RTSPUrl = fmt.Sprintf("rtsp://%s:%s@%s:554/axis-media/media.amp",
-		camera.Username, camera.Password, camera.IP)
+	// Initialize new cameras that refuse the default login if they are
+	// factory-new, and otherwise ask the cloud for it. Probing for the
+	// vendor has done so already.
+	if vendor != "" && !eg.knownCameraIP(ip) {
+		err := probeRTSP(ctx, eg.credentials.URL(camera.ID, camera.RTSPUrl), cameraTLSConfig(eg.cfg, camera), eg.cfg.RTSPDialTimeout)
+		if isRTSPAuthError(err) {
+			if !eg.initializeCamera(ctx, camera) {
+				eg.requireCredentials(camera, "mdns", fmt.Errorf("%w (%v)", errCredentialsRejected, err))
+				return
+			}
+			status = "provisioned"
+		}
+	}
 
-	// Check if camera supports PTZ
-	camera.HasPTZ = eg.checkPTZSupport(camera)
+	// Ask the camera what it supports, including PTZ
+	eg.probeCapabilities(ctx, camera)
 
-	eg.camerasLock.Lock()
-	eg.cameras[camera.ID] = camera
-	eg.camerasLock.Unlock()
+	if !eg.admitCamera(camera) || !eg.registerCamera(camera) {
+		return
+	}
 
 	log.Printf("Discovered camera: %s at %s", camera.Name, camera.IP)
 
 	// Notify cloud about new camera
-	eg.notifyCameraStatus(camera, "discovered")
+	eg.notifyCameraStatus(camera, status)
+	eg.registerChannels(ctx, camera, status)
 }
 
-// scanNetworkForCameras scans local network for cameras on common ports
-func (eg *EdgeGateway) scanNetworkForCameras(ctx context.Context) {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		log.Printf("Failed to get network interfaces: %v", err)
-		return
+// discoveredAddress picks the address to reach an mDNS entry at. IPv4 is
+// preferred; link-local IPv6 addresses are skipped since they need a zone.
+func discoveredAddress(entry *zeroconf.ServiceEntry) string {
+	if len(entry.AddrIPv4) > 0 {
+		return entry.AddrIPv4[0].String()
 	}
-
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
+	for _, ip := range entry.AddrIPv6 {
+		if !ip.IsLinkLocalUnicast() {
+			return ip.String()
 		}
+	}
+	return ""
+}
 
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
+// handleWebSocketMessages processes messages from cloud orchestrator
+func (eg *EdgeGateway) handleWebSocketMessages(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			eg.cloudLock.Lock()
+			conn := eg.cloudConn
+			eg.cloudLock.Unlock()
 
-		for _, addr := range addrs {
-			ipNet, ok := addr.(*net.IPNet)
-			if !ok || ipNet.IP.To4() == nil {
+			if conn == nil {
+				eg.reconnectToCloud(ctx, nil)
+				continue
+			}
+
+			msg, err := conn.Receive()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Cloud read error: %v", err)
+				eg.reconnectToCloud(ctx, err)
 				continue
 			}
 
-			// Scan subnet
-			go eg.scanSubnet(ctx, ipNet)
+			if !eg.handleConnectionMessage(msg) {
+				eg.dispatcher.Dispatch(cloudMessageKey(msg), func() { eg.handleCloudMessage(ctx, msg) })
+			}
 		}
 	}
 }
 
-// scanSubnet scans a subnet for RTSP cameras
-func (eg *EdgeGateway) scanSubnet(ctx context.Context, ipNet *net.IPNet) {
-	ip := ipNet.IP.Mask(ipNet.Mask)
-	for i := 1; i < 255; i++ {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			ip[3] = byte(i)
-			targetIP := net.IP(make([]byte, 4))
-			copy(targetIP, ip)
-			
-			go eg.checkRTSPPort(targetIP.String())
+// handleConnectionMessage handles, in the read loop, the cloud messages
+// about the connection itself, so that a busy dispatcher can't hold back a
+// pong until the connection is taken for dead. It reports whether msg was
+// one of them.
+func (eg *EdgeGateway) handleConnectionMessage(msg WSMessage) bool {
+	switch msg.Type {
+	case "pong":
+		eg.lastPong.Store(time.Now().UnixNano())
+
+	case "events_ack":
+		origin := cloudOrigin(msg.Payload)
+		if err := eg.authorizeTenant(origin, msg.Type, msg.Payload); err != nil {
+			eg.denyTenant(origin, msg.Type, msg.Payload, err)
+			return true
+		}
+		var ack struct {
+			EventIDs []string `json:"event_ids"`
 		}
+		if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+			log.Printf("Invalid events_ack payload: %v", err)
+			return true
+		}
+		n := eg.outbox.Ack(ack.EventIDs)
+		debugf("Cloud acknowledged %d of %d events", n, len(ack.EventIDs))
+
+	default:
+		return false
 	}
+	return true
 }
 
-// checkRTSPPort checks if RTSP is available on the given IP
-func (eg *EdgeGateway) checkRTSPPort(ip string) {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:554", ip), timeout)
-	if err != nil {
+// handleCloudMessage acts on a message from the cloud. The dispatcher
+// calls it for each camera's messages in turn, and each is handled before
+// the next of its camera starts; only offers are set up concurrently, as
+// their candidates are held for them.
+func (eg *EdgeGateway) handleCloudMessage(ctx context.Context, msg WSMessage) {
+	debugf("Cloud message: %s", msg.Type)
+	origin := cloudOrigin(msg.Payload)
+	if !eg.beginCommand(origin, msg.Type) {
 		return
 	}
-	conn.Close()
-
-	// Try to connect via RTSP
-	username := os.Getenv("CAMERA_USERNAME")
-	password := os.Getenv("CAMERA_PASSWORD")
-	if username == "" {
-		username = "root"
-	}
-	if password == "" {
-		password = "pass"
-	}
-
-	rtspURL := fmt.Sprintf("rtsp://%s:%s@%s:554/axis-media/media.amp", username, password, ip)
-	
-	// Quick RTSP test
-	client, err := rtsp.DialTimeout(rtspURL, 3*time.Second)
-	if err != nil {
+	if err := eg.authorizeTenant(origin, msg.Type, msg.Payload); err != nil {
+		eg.denyTenant(origin, msg.Type, msg.Payload, err)
 		return
 	}
-	client.Close()
+	switch msg.Type {
+	case "start_stream":
+		var payload struct {
+			CameraID string `json:"camera_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.startStream(payload.CameraID)
+		eg.audit(origin, msg.Type, payload.CameraID, nil, err)
 
-	// Found a camera
-	camera := &Camera{
-		ID:       fmt.Sprintf("axis-%s", strings.ReplaceAll(ip, ".", "-")),
-		Name:     fmt.Sprintf("Camera-%s", ip),
-		IP:       ip,
-		Port:     554,
-		RTSPUrl:  rtspURL,
-		Username: username,
-		Password: password,
-		HasPTZ:   true, // Assume PTZ for now
-	}
+	case "stop_stream":
+		var payload struct {
+			CameraID string `json:"camera_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		eg.stopStream(payload.CameraID)
+		eg.audit(origin, msg.Type, payload.CameraID, nil, nil)
+
+	case "webrtc_offer":
+		var offer OfferMessage
+		json.Unmarshal(msg.Payload, &offer)
+		if err := eg.authorizeStream(offer.Token, offer.SessionID, offer.CameraID); err != nil {
+			eg.audit(origin, msg.Type, offer.CameraID, map[string]interface{}{"viewer_session_id": offer.SessionID}, err)
+			eg.refuseOffer(offer, err)
+			return
+		}
+		// Offers are set up concurrently, holding the candidates
+		// that follow until each has its remote description
+		if offer.SessionID == "" {
+			offer.SessionID = randomHex(8)
+		}
+		eg.holdCandidates(offer.SessionID, offer.CameraID)
+		go eg.handleWebRTCOffer(offer)
 
-	eg.camerasLock.Lock()
-	eg.cameras[camera.ID] = camera
-	eg.camerasLock.Unlock()
+	case "session_close":
+		var payload struct {
+			SessionID string `json:"session_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.handleSessionClose(payload.SessionID)
+		eg.audit(origin, msg.Type, "", map[string]interface{}{"viewer_session_id": payload.SessionID}, err)
+
+	case "webrtc_restart_answer":
+		var answer struct {
+			CameraID  string                    `json:"camera_id"`
+			SessionID string                    `json:"session_id"`
+			SDP       webrtc.SessionDescription `json:"sdp"`
+		}
+		json.Unmarshal(msg.Payload, &answer)
+		eg.handleRestartAnswer(answer.SessionID, answer.CameraID, answer.SDP)
 
-	log.Printf("Found camera via network scan: %s", ip)
-	eg.notifyCameraStatus(camera, "discovered")
-}
+	case "webrtc_renegotiate_answer":
+		var answer struct {
+			SessionID string                    `json:"session_id"`
+			SDP       webrtc.SessionDescription `json:"sdp"`
+		}
+		json.Unmarshal(msg.Payload, &answer)
+		eg.handleRenegotiateAnswer(answer.SessionID, answer.SDP)
+
+	case "ice_candidate":
+		var candidate struct {
+			CameraID  string                  `json:"camera_id"`
+			SessionID string                  `json:"session_id"`
+			Candidate webrtc.ICECandidateInit `json:"candidate"`
+		}
+		json.Unmarshal(msg.Payload, &candidate)
+		eg.handleICECandidate(candidate.SessionID, candidate.CameraID, candidate.Candidate)
+
+	case "update_session":
+		var req SessionUpdate
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid update_session payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.updateSession(req)
+		cameraID := ""
+		if v := eg.viewer(req.SessionID); v != nil {
+			cameraID = v.CameraID
+		}
+		eg.audit(origin, msg.Type, cameraID, map[string]interface{}{
+			"viewer_session_id": req.SessionID,
+			"profile":           req.Profile,
+			"audio":             req.Audio,
+			"add_cameras":       req.AddCameras,
+			"remove_cameras":    req.RemoveCameras,
+			"watermark":         req.Watermark != nil,
+		}, err)
+		if err != nil {
+			log.Printf("Failed to update session %s: %v", req.SessionID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id":  cameraID,
+				"session_id": req.SessionID,
+			}, err)
+		}
 
-// checkPTZSupport checks if camera supports PTZ
-func (eg *EdgeGateway) checkPTZSupport(camera *Camera) bool {
-	// Try to access PTZ API endpoint
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/axis-cgi/param.cgi?action=list&group=PTZ", camera.IP), nil)
-	if err != nil {
-		return false
-	}
-	req.SetBasicAuth(camera.Username, camera.Password)
+	case "select_layer":
+		var payload struct {
+			SessionID string `json:"session_id"`
+			Layer     string `json:"layer"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.selectLayer(payload.SessionID, payload.Layer)
+		cameraID := ""
+		if v := eg.viewer(payload.SessionID); v != nil {
+			cameraID = v.CameraID
+		}
+		eg.audit(origin, msg.Type, cameraID, map[string]interface{}{
+			"viewer_session_id": payload.SessionID,
+			"layer":             payload.Layer,
+		}, err)
+		if err != nil {
+			log.Printf("Failed to select layer %s for session %s: %v", payload.Layer, payload.SessionID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id":  cameraID,
+				"session_id": payload.SessionID,
+			}, err)
+			return
+		}
+		eg.sendEvent("layer_selected", map[string]interface{}{
+			"camera_id":  cameraID,
+			"session_id": payload.SessionID,
+			"layer":      payload.Layer,
+		})
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
+	case "replay_start":
+		var req ReplayRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid replay_start payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.startReplay(ctx, req)
+		cameraID := ""
+		if v := eg.viewer(req.SessionID); v != nil {
+			cameraID = v.CameraID
+		}
+		eg.audit(origin, msg.Type, cameraID, map[string]interface{}{
+			"viewer_session_id": req.SessionID,
+			"source":            req.Source,
+		}, err)
+		if err != nil {
+			log.Printf("Failed to start replay for session %s: %v", req.SessionID, err)
+			eg.sendEvent("replay_status", ReplayStatus{
+				SessionID: req.SessionID,
+				CameraID:  cameraID,
+				State:     replayStateError,
+				Error:     err.Error(),
+			})
+		}
 
-	return resp.StatusCode == http.StatusOK
-}
+	case "replay_stop":
+		var payload struct {
+			SessionID string `json:"session_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.stopReplay(payload.SessionID)
+		eg.audit(origin, msg.Type, "", map[string]interface{}{"viewer_session_id": payload.SessionID}, err)
+
+	case "ptz_command":
+		var cmd PTZCommand
+		json.Unmarshal(msg.Payload, &cmd)
+		eg.controlPTZ(origin, cmd)
+
+	case "scan_network":
+		eg.scanner.Trigger()
+		eg.audit(origin, msg.Type, "", nil, nil)
+
+	case "cancel_scan":
+		var err error
+		if !eg.scanner.Cancel() {
+			err = errors.New("no scan running")
+		}
+		eg.audit(origin, msg.Type, "", nil, err)
 
-// handleWebSocketMessages processes messages from cloud orchestrator
-func (eg *EdgeGateway) handleWebSocketMessages(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
+	case "approve_camera", "reject_camera":
+		var payload struct {
+			CameraID string `json:"camera_id"`
+			Ignore   bool   `json:"ignore"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		var ok bool
+		switch {
+		case msg.Type == "approve_camera":
+			ok = eg.setCameraApproval(payload.CameraID, "")
+		case payload.Ignore:
+			ok = eg.ignoreCamera(payload.CameraID)
 		default:
-			eg.wsLock.Lock()
-			conn := eg.wsConn
-			eg.wsLock.Unlock()
+			ok = eg.setCameraApproval(payload.CameraID, cameraApprovalRejected)
+		}
+		var err error
+		if !ok {
+			log.Printf("No discovered camera %s to %s", payload.CameraID, strings.TrimSuffix(msg.Type, "_camera"))
+			err = errCameraNotFound
+		}
+		eg.audit(origin, msg.Type, payload.CameraID, map[string]interface{}{"ignore": payload.Ignore}, err)
 
-			if conn == nil {
-				time.Sleep(time.Second)
-				continue
-			}
+	case "set_camera_metadata":
+		var update CameraMetadataUpdate
+		if err := json.Unmarshal(msg.Payload, &update); err != nil {
+			log.Printf("Invalid set_camera_metadata payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		_, err := eg.setCameraMetadata(update)
+		if err != nil {
+			log.Printf("Failed to update metadata of camera %s: %v", update.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": update.CameraID,
+			}, err)
+		}
+		eg.audit(origin, msg.Type, update.CameraID, nil, err)
 
-			var msg WSMessage
-			err := conn.ReadJSON(&msg)
-			if err != nil {
-				log.Printf("WebSocket read error: %v", err)
-				eg.reconnectToCloud()
-				continue
-			}
+	case "set_camera_tenant":
+		var update CameraTenantUpdate
+		if err := json.Unmarshal(msg.Payload, &update); err != nil {
+			log.Printf("Invalid set_camera_tenant payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.setCameraTenant(update)
+		if err != nil {
+			log.Printf("Failed to set tenant of camera %s: %v", update.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": update.CameraID,
+			}, err)
+		}
+		eg.audit(origin, msg.Type, update.CameraID, map[string]interface{}{"tenant": update.Tenant}, err)
 
-			switch msg.Type {
-			case "start_stream":
-				var payload struct {
-					CameraID string `json:"camera_id"`
-				}
-				json.Unmarshal(msg.Payload, &payload)
-				eg.startStream(payload.CameraID)
+	case "cluster_leader":
+		var payload struct {
+			LeaderID string `json:"leader_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.setClusterLeader(payload.LeaderID)
+		if err != nil {
+			log.Printf("Ignored cluster_leader: %v", err)
+		}
+		eg.audit(origin, msg.Type, "", map[string]interface{}{"leader_id": payload.LeaderID}, err)
+
+	case "cluster_drain":
+		payload := struct {
+			Draining bool `json:"draining"`
+		}{Draining: true}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.setClusterDraining(payload.Draining, clusterHandoffGrace)
+		if err != nil {
+			log.Printf("Ignored cluster_drain: %v", err)
+		}
+		eg.audit(origin, msg.Type, "", map[string]interface{}{"draining": payload.Draining}, err)
 
-			case "stop_stream":
-				var payload struct {
-					CameraID string `json:"camera_id"`
-				}
-				json.Unmarshal(msg.Payload, &payload)
-				eg.stopStream(payload.CameraID)
-
-			case "webrtc_offer":
-				var offer OfferMessage
-				json.Unmarshal(msg.Payload, &offer)
-				eg.handleWebRTCOffer(offer)
-
-			case "ice_candidate":
-				var candidate struct {
-					CameraID  string                  `json:"camera_id"`
-					Candidate webrtc.ICECandidateInit `json:"candidate"`
-				}
-				json.Unmarshal(msg.Payload, &candidate)
-				eg.handleICECandidate(candidate.CameraID, candidate.Candidate)
+	case "set_privacy_masks":
+		var update PrivacyMaskUpdate
+		if err := json.Unmarshal(msg.Payload, &update); err != nil {
+			log.Printf("Invalid set_privacy_masks payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.setPrivacyMasks(update)
+		if err != nil {
+			log.Printf("Failed to set privacy masks of camera %s: %v", update.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": update.CameraID,
+			}, err)
+		}
+		eg.audit(origin, msg.Type, update.CameraID, map[string]interface{}{"masks": len(update.Masks)}, err)
 
-			case "ptz_command":
-				var cmd PTZCommand
-				json.Unmarshal(msg.Payload, &cmd)
-				eg.handlePTZCommand(cmd)
+	case "sync_camera_time":
+		var req CameraTimeSync
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid sync_camera_time payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		clock, err := eg.syncCameraTime(ctx, req)
+		eg.audit(origin, msg.Type, req.CameraID, map[string]interface{}{
+			"ntp_servers": req.NTPServers,
+			"time_zone":   req.TimeZone,
+		}, err)
+		if err != nil {
+			log.Printf("Failed to set time of camera %s: %v", req.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": req.CameraID,
+			}, err)
+			return
+		}
+		eg.sendEvent("camera_clock", clock)
+
+	case "release_camera":
+		var payload struct {
+			CameraID string `json:"camera_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		var err error
+		if !eg.releaseCamera(payload.CameraID) {
+			log.Printf("Camera %s is not quarantined", payload.CameraID)
+			err = errors.New("camera is not quarantined")
+		}
+		eg.audit(origin, msg.Type, payload.CameraID, nil, err)
+
+	case "start_relay":
+		var req RelayRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid start_relay payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		_, err := eg.startRelay(req)
+		eg.audit(origin, msg.Type, req.CameraID, map[string]interface{}{
+			"relay_id": req.RelayID,
+			"url":      redactURL(req.URL),
+		}, err)
+		if err != nil {
+			log.Printf("Failed to start relay for camera %s: %v", req.CameraID, err)
+			eg.sendEvent("relay_status", RelayStatus{
+				RelayID:  req.RelayID,
+				CameraID: req.CameraID,
+				URL:      redactURL(req.URL),
+				State:    relayStateStopped,
+				Error:    err.Error(),
+				Since:    time.Now(),
+			})
+		}
+
+	case "stop_relay":
+		var payload struct {
+			RelayID  string `json:"relay_id"`
+			CameraID string `json:"camera_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+		err := eg.stopRelay(origin, payload.RelayID, payload.CameraID)
+		if errors.Is(err, errTenantDenied) {
+			eg.denyTenant(origin, msg.Type, msg.Payload, err)
+			return
+		}
+		if err != nil {
+			log.Printf("No relay matches %s%s", payload.RelayID, payload.CameraID)
+		}
+		eg.audit(origin, msg.Type, payload.CameraID, map[string]interface{}{"relay_id": payload.RelayID}, err)
+
+	case "set_config":
+		var delta RemoteConfig
+		if err := json.Unmarshal(msg.Payload, &delta); err != nil {
+			log.Printf("Invalid set_config payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			eg.sendEvent("config_ack", map[string]interface{}{
+				"applied": false,
+				"error":   "invalid payload: " + err.Error(),
+				"config":  eg.settings().remoteConfig(),
+			})
+			return
+		}
+		err := eg.handleSetConfig(delta)
+		eg.audit(origin, msg.Type, "", map[string]interface{}{"fields": configFields(delta)}, err)
+
+	case "update_gateway":
+		var req UpdateRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid update_gateway payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		// Recorded, and answered, once installed or failed. The download
+		// runs in the background, so it doesn't hold up the messages
+		// sharing the gateway's queue.
+		eg.goTracked(func() {
+			err := eg.handleUpdateGateway(req)
+			eg.audit(origin, msg.Type, "", map[string]interface{}{"version": req.Version}, err)
+		})
+
+	case "upgrade_firmware":
+		var req FirmwareUpgradeRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid upgrade_firmware payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.handleUpgradeFirmware(ctx, req)
+		eg.audit(origin, msg.Type, "", map[string]interface{}{
+			"camera_ids": req.CameraIDs,
+			"version":    req.Version,
+		}, err)
+		if err != nil {
+			log.Printf("Rejected upgrade_firmware: %v", err)
+			for _, cameraID := range req.CameraIDs {
+				eg.reportFirmware(cameraID, req.Version, firmwareStateFailed, "", err)
 			}
 		}
+
+	case "set_camera_audio":
+		var req CameraAudioRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid set_camera_audio payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		audio, err := eg.setCameraAudio(ctx, req)
+		eg.audit(origin, msg.Type, req.CameraID, map[string]interface{}{
+			"enabled":       req.Enabled,
+			"input_gain_db": req.InputGainDB,
+		}, err)
+		if err != nil {
+			log.Printf("Failed to set audio of camera %s: %v", req.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": req.CameraID,
+			}, err)
+			return
+		}
+		eg.sendEvent("camera_audio", audio)
+
+	case "take_snapshot":
+		var payload struct {
+			CameraID string `json:"camera_id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Invalid take_snapshot payload: %v", err)
+			eg.finishCommand(origin, msg.Type, "", err)
+			return
+		}
+		image, err := eg.cameraSnapshot(ctx, payload.CameraID)
+		eg.finishCommand(origin, msg.Type, payload.CameraID, err)
+		if err != nil {
+			log.Printf("Failed to take a snapshot of camera %s: %v", payload.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": payload.CameraID,
+			}, err)
+			return
+		}
+		eg.sendEvent("snapshot", CameraSnapshot{
+			CameraID: payload.CameraID,
+			Time:     time.Now().UTC(),
+			Image:    image,
+		})
+
+	case "set_output":
+		var req SetOutputRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid set_output payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.setOutput(ctx, req)
+		eg.audit(origin, msg.Type, req.CameraID, map[string]interface{}{
+			"port":     req.Port,
+			"active":   req.Active,
+			"pulse_ms": req.PulseMs,
+		}, err)
+		if err != nil {
+			log.Printf("Failed to set output %d of camera %s: %v", req.Port, req.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": req.CameraID,
+			}, err)
+			return
+		}
+		log.Printf("Set output %d of camera %s active %v (pulse %dms)", req.Port, req.CameraID, req.Active, req.PulseMs)
+		eg.sendEvent("io_output", req)
+
+	case "camera_maintenance":
+		var req CameraMaintenanceRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid camera_maintenance payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		status, err := eg.cameraMaintenance(req)
+		eg.audit(origin, msg.Type, req.CameraID, map[string]interface{}{
+			"action": req.Action,
+			"mode":   status.Mode,
+			"state":  status.State,
+		}, err)
+		if err != nil {
+			log.Printf("Rejected camera_maintenance for camera %s: %v", req.CameraID, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": req.CameraID,
+			}, err)
+		} else if status.State != maintenanceStateStarted {
+			// Started is reported by cameraMaintenance itself
+			eg.sendEvent("maintenance_status", status)
+		}
+
+	case "add_camera":
+		var req AddCameraRequest
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			log.Printf("Invalid add_camera payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		if origin.TenantID != "" {
+			// Tenants' users add cameras of their own tenant
+			req.Tenant = origin.TenantID
+		}
+		camera, err := eg.addCamera(ctx, req)
+		eg.auditAddCamera(origin, req, camera, err)
+		if err != nil {
+			log.Printf("Failed to add camera %s: %v", req.IP, err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"ip": req.IP,
+			}, err)
+		}
+
+	case "set_encoder_profile":
+		var u EncoderProfileUpdate
+		if err := json.Unmarshal(msg.Payload, &u); err != nil {
+			log.Printf("Invalid set_encoder_profile payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.setEncoderProfile(ctx, origin.TenantID, u)
+		eg.audit(origin, msg.Type, u.CameraID, map[string]interface{}{"profile": u.Profile}, err)
+		if err != nil {
+			log.Printf("Rejected set_encoder_profile: %v", err)
+			eg.sendError("camera_error", map[string]interface{}{
+				"camera_id": u.CameraID,
+			}, err)
+		}
+
+	case "set_credentials":
+		var u CredentialsUpdate
+		if err := json.Unmarshal(msg.Payload, &u); err != nil {
+			log.Printf("Invalid set_credentials payload: %v", err)
+			eg.audit(origin, msg.Type, "", nil, err)
+			return
+		}
+		err := eg.setCredentials(ctx, origin.TenantID, u)
+		// Never the password
+		eg.audit(origin, msg.Type, u.CameraID, map[string]interface{}{
+			"username": u.Username,
+		}, err)
+		eg.reportCredentials(u.CameraID, err)
+
+	case "inventory_request":
+		eg.sendInventorySnapshot()
 	}
 }
 
 // startStream starts RTSP to WebRTC conversion for a camera
-func (eg *EdgeGateway) startStream(cameraID string) {
+func (eg *EdgeGateway) startStream(cameraID string) error {
+	_, err := eg.openStream(cameraID, viewerProfileMain, false)
+	return err
+}
+
+// openStream returns the camera's stream for a viewer profile, starting it
+// if it isn't running, or why it can't. On-demand streams stop when their
+// last viewer leaves; opening a stream explicitly keeps it running.
+func (eg *EdgeGateway) openStream(cameraID, profile string, onDemand bool) (*CameraStream, error) {
+	return eg.openCodecStream(cameraID, profile, videoCodecH264, onDemand)
+}
+
+// openCodecStream is openStream for a codec. VP9 and AV1 streams are
+// separate streams, always transcoded.
+func (eg *EdgeGateway) openCodecStream(cameraID, profile, codec string, onDemand bool) (*CameraStream, error) {
+	return eg.openVariantStream(cameraID, profile, codec, nil, onDemand)
+}
+
+// openVariantStream is openCodecStream for a watermark. A watermarked
+// stream is one viewer session's own, always transcoded.
+func (eg *EdgeGateway) openVariantStream(cameraID, profile, codec string, wm *streamWatermark, onDemand bool) (*CameraStream, error) {
 	eg.camerasLock.RLock()
 	camera, exists := eg.cameras[cameraID]
 	eg.camerasLock.RUnlock()
 
 	if !exists {
 		log.Printf("Camera not found: %s", cameraID)
-		return
+		return nil, errCameraNotFound
+	}
+
+	if eg.quarantine.IsQuarantined(cameraID) {
+		log.Printf("Camera %s is quarantined, not starting stream", cameraID)
+		eg.notifyQuarantine(cameraID)
+		return nil, fmt.Errorf("camera is quarantined")
+	}
+	if camera.Approval != "" {
+		log.Printf("Camera %s is not approved (%s), not starting stream", cameraID, camera.Approval)
+		return nil, fmt.Errorf("camera is not approved (%s)", camera.Approval)
+	}
+	if action := eg.maintenanceAction(camera); action != "" {
+		log.Printf("Camera %s is under maintenance (%s), not starting stream", cameraID, action)
+		return nil, fmt.Errorf("camera is under maintenance (%s)", action)
+	}
+	if len(eg.privacy.Get(cameraID)) > 0 && eg.transcoder == nil && camera.Device == "" {
+		log.Printf("Camera %s: %v, not starting stream", cameraID, errPrivacyNeedsTranscoder)
+		return nil, errPrivacyNeedsTranscoder
+	}
+
+	// A device is captured once, so viewers of a local camera share its
+	// main stream whatever profile they picked
+	if camera.Device != "" {
+		profile, codec = viewerProfileMain, videoCodecH264
+	}
+	if codec != videoCodecH264 && eg.transcoder == nil {
+		return nil, fmt.Errorf("%s needs TRANSCODE_ENABLED", codecName(codec))
+	}
+	if wm != nil && (eg.transcoder == nil || camera.Device != "") {
+		return nil, errWatermarkUnsupported
 	}
 
 	eg.streamsLock.Lock()
 	defer eg.streamsLock.Unlock()
 
-	if stream, exists := eg.streams[cameraID]; exists && stream.isRunning {
-		log.Printf("Stream already running for camera: %s", cameraID)
-		return
+	key := codecStreamKey(cameraID, profile, codec) + wm.keySuffix()
+	if stream, exists := eg.streams[key]; exists && stream.running() {
+		stream.runningLock.Lock()
+		if !onDemand {
+			log.Printf("Stream already running for camera: %s", key)
+			stream.onDemand = false
+		}
+		// Give the caller a full idle period to attach its viewer
+		if stream.idleTimer != nil {
+			stream.idleTimer.Reset(eg.cfg.StreamIdleTimeout)
+		}
+		stream.runningLock.Unlock()
+		return stream, nil
+	}
+	if err := eg.admitStream(cameraID); err != nil {
+		return nil, err
+	}
+
+	// The track outlives individual RTSP sessions so viewers survive ingest restarts
+	videoTrack, err := newRTPTrack(codec)
+	if err != nil {
+		log.Printf("Failed to create video track: %v", err)
+		return nil, err
 	}
 
+	var ridTrack *rtpTrack
+	if layer, ok := profileLayer(profile); ok && codec == videoCodecH264 {
+		ridTrack, err = newRTPTrack(codec, webrtc.WithRTPStreamID(layer.RID))
+		if err != nil {
+			log.Printf("Failed to create video track: %v", err)
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(eg.ctx)
 	stream := &CameraStream{
-		camera:   camera,
-		stopChan: make(chan bool),
+		camera:      camera,
+		profile:     profile,
+		codec:       codec,
+		videoTrack:  videoTrack,
+		ridTrack:    ridTrack,
+		videoQueue:  make(chan av.Packet, videoQueueSize),
+		packetizer:  newVideoPacketizer(codec),
+		stats:       newStreamStats(),
+		transcoder:  eg.transcoder,
+		dptz:        eg.digitalPTZ(camera),
+		watermark:   wm,
+		overlay:     func() string { return eg.overlayFilter(cameraID) },
+		localConfig: eg.cfg,
+		gop:         gopBuffer{maxBytes: eg.cfg.PrebufferMaxKB * 1024},
+		credentials: eg.credentials,
+		e2ee:        eg.e2ee,
+		privacy:     eg.privacy,
+		tlsConfig:   cameraTLSConfig(eg.cfg, camera),
+		ctx:         ctx,
+		cancel:      cancel,
+		isRunning:   true,
+		onDemand:    onDemand,
+	}
+	if wm != nil {
+		stream.overlay = func() string { return eg.watermarkFilter(cameraID, wm) }
+	}
+	stream.onFrame = func(packet av.Packet) { eg.sendFrameMeta(stream, packet) }
+	stream.onQueueFull = func(kb int) {
+		eg.overCapacity(resourceStreamQueue, kb, eg.cfg.StreamQueueMaxKB, cameraID)
+	}
+	if !camera.Simulated && camera.Device == "" && !camera.Generic && camera.Approval == "" {
+		stream.onGOP = func(gap time.Duration, frames int) { eg.checkGOP(camera, gap, frames) }
 	}
 
-	eg.streams[cameraID] = stream
-	go stream.start()
+	// Viewers that picked a profile get exactly that; only the main H.264
+	// stream adapts, and is packaged as HLS
+	primary := profile == viewerProfileMain && codec == videoCodecH264 && wm == nil
+	if primary && eg.cfg.AdaptiveBitrate && supportsABR(camera) {
+		stream.abr = newABRController()
+	}
+	if primary && eg.hlsEnabledFor(cameraID) {
+		stream.hls = eg.newHLSPackager(cameraID)
+		stream.addSink(stream.hls)
+	}
+
+	eg.streams[key] = stream
+	eg.acquireAnalytics(camera)
+	eg.goTracked(func() { eg.runStream(stream) })
+	eg.goTracked(stream.writeVideo)
+	return stream, nil
 }
 
-// start begins the RTSP to WebRTC conversion
-func (cs *CameraStream) start() {
+// runStream keeps a camera's ingest running, restarting it after failures
+// until the stream is stopped or the camera is quarantined
+func (eg *EdgeGateway) runStream(cs *CameraStream) {
+	defer func() {
+		cs.runningLock.Lock()
+		cs.isRunning = false
+		cs.runningLock.Unlock()
+		eg.releaseAnalytics(cs.camera.ID)
+	}()
+
+	cameraID := cs.camera.ID
+	for attempt := 1; ; attempt++ {
+		// Clear failure history once the ingest stays up for the probation period
+		healthy := time.AfterFunc(eg.cfg.QuarantineProbation, func() {
+			eg.quarantine.RecordSuccess(cameraID)
+			eg.clearStalls(cameraID)
+		})
+		err := cs.start(eg.cfg.RTSPDialTimeout)
+		healthy.Stop()
+
+		if err == nil {
+			return
+		}
+		if err == errIngestRestart {
+			attempt = 0
+			continue
+		}
+		log.Printf("Stream for camera %s failed: %v", cameraID, err)
+		if errors.Is(err, errStreamStuck) {
+			eg.recordStall(cameraID)
+		}
+
+		if eg.quarantine.RecordFailure(cameraID, err.Error(), true) {
+			eg.streamsLock.Lock()
+			for key, stream := range eg.streams {
+				if stream.camera.ID == cameraID {
+					stream.cancel()
+					delete(eg.streams, key)
+				}
+			}
+			eg.streamsLock.Unlock()
+			eg.notifyQuarantine(cameraID)
+			return
+		}
+
+		delay := time.Duration(attempt) * 2 * time.Second
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		select {
+		case <-cs.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		cs.stats.recordRestart()
+	}
+}
+
+// running reports whether the stream's ingest loop is active
+func (cs *CameraStream) running() bool {
 	cs.runningLock.Lock()
-	cs.isRunning = true
+	defer cs.runningLock.Unlock()
+	return cs.isRunning
+}
+
+// errIngestRestart is returned by start when the session was ended to
+// switch camera profile
+var errIngestRestart = errors.New("ingest restart requested")
+
+// start runs one RTSP session, forwarding packets until the stream is stopped
+// (returning nil) or the session fails
+func (cs *CameraStream) start(dialTimeout time.Duration) error {
+	session, cancelSession := context.WithCancel(cs.ctx)
+	defer cancelSession()
+	cs.runningLock.Lock()
+	cs.cancelSession = cancelSession
 	cs.runningLock.Unlock()
 
-	defer func() {
+	// stopped maps errors caused by stopping or restarting the session
+	stopped := func(err error) error {
+		if cs.ctx.Err() != nil {
+			return nil
+		}
+		if stuck := cs.takeStuck(); stuck != nil {
+			return stuck
+		}
+		if session.Err() != nil {
+			return errIngestRestart
+		}
+		return err
+	}
+
+	rtspURL := subStreamURL(cs.camera, cs.profile)
+	if cs.abr != nil {
+		rtspURL = withStreamProfile(rtspURL, cs.abr.Profile())
+	}
+
+	// Masked video only leaves the gateway through the transcoder, or the
+	// encoder of a local camera
+	local := cs.camera.Device != ""
+	masks := cs.privacy.Get(cs.camera.ID)
+	if len(masks) > 0 && cs.transcoder == nil && !local {
+		log.Printf("Stopping stream for camera %s: %v", cs.camera.ID, errPrivacyNeedsTranscoder)
+		return nil
+	}
+
+	// Connect to RTSP stream, through ffmpeg if it must be re-encoded
+	transcode := !local && cs.transcoder != nil && cs.transcoder.needed(cs, rtspURL)
+	_, connectSpan := tracer.Start(session, "rtsp.connect", trace.WithAttributes(
+		attribute.String("camera.id", cs.camera.ID),
+		attribute.String("stream.profile", profileName(cs.profile)),
+		attribute.Bool("stream.transcoded", transcode),
+	))
+	var source ingestSource
+	var err error
+	switch {
+	case local:
+		source, err = startLocalDevice(cs.localConfig, cs.camera, cs.digitalFilter(), privacyFilter(masks), cs.overlay())
+	case transcode:
+		source, err = cs.transcoder.Start(session, cs.camera.ID, cs.credentials.URL(cs.camera.ID, rtspURL), cs.profile, cs.codec, cs.digitalFilter(), privacyFilter(masks), cs.overlay())
+	default:
+		source, err = dialRTSP(session, cs.credentials.URL(cs.camera.ID, rtspURL), cs.tlsConfig, dialTimeout)
+	}
+	if err != nil {
+		endSpan(connectSpan, err)
+		return stopped(fmt.Errorf("failed to connect to RTSP stream: %v", err))
+	}
+	cs.source = source
+	defer source.Close()
+
+	// Unblock the packet reader as soon as the session ends
+	stopWatch := closeOnDone(session, source)
+	defer stopWatch()
+
+	// Get stream info
+	codecs, err := source.Streams()
+	endSpan(connectSpan, err)
+	if err != nil && !transcode && cs.transcoder != nil && strings.Contains(err.Error(), "unsupported") {
+		// H.265 and other codecs viewers can't play are converted to H.264
+		log.Printf("Camera %s: %v, transcoding", cs.camera.ID, err)
 		cs.runningLock.Lock()
-		cs.isRunning = false
+		cs.unsupportedCodec = true
 		cs.runningLock.Unlock()
+		return errIngestRestart
+	}
+	if err != nil {
+		return stopped(fmt.Errorf("failed to get stream info: %v", err))
+	}
+	cs.runningLock.Lock()
+	cs.transcoding = ""
+	if transcode {
+		cs.transcoding = cs.transcoder.hwaccel(cs.codec)
+	} else if local && cs.localConfig.LocalCameraEncoder != localEncoderCopy {
+		cs.transcoding = cs.localConfig.LocalCameraEncoder
+	}
+	cs.runningLock.Unlock()
+	cs.resetSinks(codecs)
+	audioIdx := cs.audioStream(codecs)
+
+	log.Printf("Started stream for camera: %s", cs.camera.ID)
+	go cs.watchStall(session, cs.localConfig.StreamStallTimeout, cancelSession)
+
+	// Read and forward packets, timing the session's GOPs
+	var lastKeyframe time.Time
+	gopFrames := 0
+	for {
+		packet, err := source.ReadPacket()
+		if err != nil {
+			return stopped(fmt.Errorf("error reading RTSP packet: %v", err))
+		}
+		if int(packet.Idx) != audioIdx {
+			now := time.Now()
+			cs.lastVideo.Store(now.UnixNano())
+			if packet.IsKeyFrame {
+				if !lastKeyframe.IsZero() && cs.onGOP != nil {
+					cs.onGOP(now.Sub(lastKeyframe), gopFrames)
+				}
+				lastKeyframe, gopFrames = now, 0
+			}
+			gopFrames++
+		}
+
+		cs.stats.recordFrame(len(packet.Data), packet.IsKeyFrame)
+		cs.writeSinks(packet)
+
+		if int(packet.Idx) == audioIdx {
+			cs.writeAudio(packet)
+			continue
+		}
+
+		// Process H264 packets
+		if packet.IsKeyFrame {
+			cs.queueVideo(packet)
+		}
+	}
+}
+
+// restartIngest ends the current RTSP session so it is reopened at once,
+// keeping the video track and its peer connections
+func (cs *CameraStream) restartIngest() {
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	if cs.cancelSession != nil {
+		cs.cancelSession()
+	}
+}
+
+// videoQueueSize bounds the frames waiting for the WebRTC track. When
+// viewers' connections back up further, frames are dropped up to the next
+// keyframe rather than stalling the ingest and every other consumer.
+const videoQueueSize = 64
+
+// queueVideo hands a frame to the track writer without blocking. It is only
+// called from the ingest loop.
+func (cs *CameraStream) queueVideo(packet av.Packet) {
+	if cs.videoWaitKey && !packet.IsKeyFrame {
+		cs.stats.recordDrop()
+		return
+	}
+	if cs.enqueueVideo(packet) {
+		cs.videoWaitKey = false
+	} else {
+		cs.videoWaitKey = true
+		cs.stats.recordDrop()
+	}
+}
+
+// enqueueVideo adds a frame to videoQueue unless it is full, in frames or
+// in bytes
+func (cs *CameraStream) enqueueVideo(packet av.Packet) bool {
+	size := int64(len(packet.Data))
+	if limit := int64(cs.localConfig.StreamQueueMaxKB) << 10; limit > 0 {
+		if queued := cs.videoQueued.Load(); queued > 0 && queued+size > limit {
+			if cs.onQueueFull != nil {
+				cs.onQueueFull(int(queued >> 10))
+			}
+			return false
+		}
+	}
+	select {
+	case cs.videoQueue <- packet:
+		cs.videoQueued.Add(size)
+		return true
+	default:
+		return false
+	}
+}
+
+// writeVideo sends queued frames to viewers until the stream stops
+func (cs *CameraStream) writeVideo() {
+	for {
+		select {
+		case <-cs.ctx.Done():
+			return
+		case packet := <-cs.videoQueue:
+			cs.videoQueued.Add(-int64(len(packet.Data)))
+			started := time.Now()
+			cs.processVideoPacket(packet)
+			cs.stats.recordWrite(time.Since(started))
+		}
+	}
+}
+
+// processVideoPacket processes video packets from RTSP
+func (cs *CameraStream) processVideoPacket(packet av.Packet) {
+	if cs.videoTrack == nil {
+		return
+	}
+
+	// Frames are packetized once for both tracks, and only while a peer
+	// connection is bound to either
+	if cs.videoTrack.bound.Load() > 0 || cs.ridTrack != nil && cs.ridTrack.bound.Load() > 0 {
+		data := packet.Data
+		if key := cs.e2ee.Get(cs.camera.ID); key != nil {
+			data = key.encryptFrame(data)
+		}
+		var params [][]byte
+		if packet.IsKeyFrame {
+			params = cs.parameterSets()
+		}
+		packets := cs.packetizer.packetize(data, params, time.Duration(packet.Duration))
+
+		if err := cs.videoTrack.writePackets(packets); err != nil {
+			log.Printf("Failed to write video sample: %v", err)
+			return
+		}
+		if cs.ridTrack != nil {
+			if err := cs.ridTrack.writePackets(packets); err != nil {
+				log.Printf("Failed to write video sample: %v", err)
+			}
+		}
+	}
+
+	if cs.onFrame != nil {
+		cs.onFrame(packet)
+	}
+
+	cs.runningLock.Lock()
+	for _, waiter := range cs.frameWaiters {
+		close(waiter)
+	}
+	cs.frameWaiters = nil
+	cs.runningLock.Unlock()
+}
+
+// nextFrame returns a channel closed when the next video frame is sent
+func (cs *CameraStream) nextFrame() <-chan struct{} {
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	waiter := make(chan struct{})
+	cs.frameWaiters = append(cs.frameWaiters, waiter)
+	return waiter
+}
+
+// handleWebRTCOffer handles WebRTC offer from cloud
+func (eg *EdgeGateway) handleWebRTCOffer(offer OfferMessage) {
+	// Candidates that arrived meanwhile are added once the remote
+	// description is set
+	var described *webrtc.PeerConnection
+	defer func() { eg.applyCandidates(offer.SessionID, described) }()
+
+	if offer.SessionID == "" {
+		offer.SessionID = randomHex(8)
+	} else if v := eg.viewer(offer.SessionID); v != nil {
+		// The player renegotiates a session it already has
+		if v.Kind == viewerKindWebRTC && v.CameraID == offer.CameraID {
+			eg.handleReoffer(v, offer)
+			described = v.pc
+			return
+		}
+		log.Printf("Rejecting offer for camera %s: session %s already exists", offer.CameraID, offer.SessionID)
+		return
+	}
+	if owner := eg.clusterOwner(offer.CameraID); owner != getGatewayID() {
+		// Another member of the cluster streams the camera
+		log.Printf("Redirecting offer for camera %s to gateway %s", offer.CameraID, owner)
+		eg.sendEvent("webrtc_closed", map[string]interface{}{
+			"camera_id":  offer.CameraID,
+			"session_id": offer.SessionID,
+			"reason":     sessionReasonClusterRedirect,
+			"gateway_id": owner,
+		})
+		return
+	}
+
+	// Spans cover offer to first frame
+	ctx, span := startViewerSpan("webrtc.viewer_setup", offer.TraceParent, offer.CameraID, offer.Profile)
+
+	profile, err := normalizeViewerProfile(offer.Profile)
+	if err != nil {
+		log.Printf("Rejecting offer for camera %s: %v", offer.CameraID, err)
+		endSpan(span, err)
+		eg.failOffer(offer, err)
+		return
+	}
+	codec := eg.negotiateCodec(offer.CameraID, offer.SDP.SDP)
+	watermark := newWatermark(offer.SessionID, offer.Watermark)
+
+	// The camera's RTSP session connects while the peer connection is
+	// created and the offer answered, rather than after
+	type created struct {
+		pc    *webrtc.PeerConnection
+		stats stats.Getter
+		bwe   cc.BandwidthEstimator
+		err   error
+	}
+	creating := make(chan created, 1)
+	go func() {
+		pc, getter, bwe, err := eg.newPeerConnection()
+		creating <- created{pc, getter, bwe, err}
 	}()
+	requireRunning := profile == viewerProfileMain && !eg.cfg.OnDemandStreams
+	if !requireRunning && watermark == nil {
+		defer eg.prewarmStream(offer.CameraID, profile, codec)()
+	}
+	result := <-creating
+	if result.err != nil {
+		log.Printf("Failed to create peer connection: %v", result.err)
+		endSpan(span, result.err)
+		eg.failOffer(offer, result.err)
+		return
+	}
+	peerConnection := result.pc
 
-	// Connect to RTSP stream
-	rtspClient, err := rtsp.DialTimeout(cs.camera.RTSPUrl, 10*time.Second)
+	// Store peer connection
+	eg.peerConnsLock.Lock()
+	if p := eg.peerConns[offer.SessionID]; p != nil {
+		p.pc = peerConnection
+	} else {
+		eg.peerConns[offer.SessionID] = &cloudPeer{cameraID: offer.CameraID, pc: peerConnection}
+	}
+	eg.peerConnsLock.Unlock()
+
+	// Unless streams open on demand, the main stream must already be
+	// started; sub-streams always open on demand
+	viewer := &Viewer{
+		ID:        offer.SessionID,
+		Kind:      viewerKindWebRTC,
+		CameraID:  offer.CameraID,
+		Profile:   profile,
+		Codec:     codec,
+		pc:        peerConnection,
+		simulcast: offerSimulcast(offer.SDP.SDP),
+		watermark: watermark,
+		stats:     result.stats,
+		bwe:       result.bwe,
+		token:     offer.Token,
+	}
+	forget := func() {
+		eg.peerConnsLock.Lock()
+		if p := eg.peerConns[offer.SessionID]; p != nil && p.pc == peerConnection {
+			delete(eg.peerConns, offer.SessionID)
+		}
+		eg.peerConnsLock.Unlock()
+	}
+	stream, err := eg.attachViewer(viewer, requireRunning, forget)
 	if err != nil {
-		log.Printf("Failed to connect to RTSP stream %s: %v", cs.camera.RTSPUrl, err)
+		log.Printf("Failed to attach viewer: %v", err)
+		endSpan(span, err)
+		peerConnection.Close()
+		eg.failOffer(offer, err)
+		return
+	}
+	traceViewerSetup(ctx, span, peerConnection, stream)
+
+	// Set up ICE candidate handling
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		eg.sendEvent("ice_candidate", map[string]interface{}{
+			"camera_id":  offer.CameraID,
+			"session_id": offer.SessionID,
+			"candidate":  candidate.ToJSON(),
+		})
+	})
+
+	// Set remote description
+	_, answerSpan := tracer.Start(ctx, "webrtc.answer")
+	if err := peerConnection.SetRemoteDescription(offer.SDP); err != nil {
+		log.Printf("Failed to set remote description: %v", err)
+		endSpan(answerSpan, err)
+		peerConnection.Close()
+		eg.failOffer(offer, err)
 		return
 	}
-	cs.rtspClient = rtspClient
-	defer rtspClient.Close()
+	described = peerConnection
 
-	// Get stream info
-	codecs, err := rtspClient.Streams()
+	// Create answer
+	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		log.Printf("Failed to get stream info: %v", err)
+		log.Printf("Failed to create answer: %v", err)
+		endSpan(answerSpan, err)
+		peerConnection.Close()
+		eg.failOffer(offer, err)
 		return
 	}
 
-	// Create video track
-	cs.videoTrack, err = webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
-		"video", "video0")
-	if err != nil {
-		log.Printf("Failed to create video track: %v", err)
+	// Set local description
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		log.Printf("Failed to set local description: %v", err)
+		endSpan(answerSpan, err)
+		peerConnection.Close()
+		eg.failOffer(offer, err)
 		return
 	}
+	answerSpan.End()
 
-	log.Printf("Started stream for camera: %s", cs.camera.ID)
+	// The SFU gets the answer without the offer's receive simulcast attributes
+	if viewer.simulcast {
+		answer.SDP = sendOnlySimulcast(answer.SDP)
+	}
 
-	// Read and forward packets
-	for {
-		select {
-		case <-cs.stopChan:
-			return
-		default:
-			packet, err := rtspClient.ReadPacket()
-			if err != nil {
-				log.Printf("Error reading RTSP packet: %v", err)
-				return
-			}
+	// Send answer to cloud
+	eg.sendEvent("webrtc_answer", map[string]interface{}{
+		"camera_id":  offer.CameraID,
+		"session_id": offer.SessionID,
+		"sdp":        answer,
+		"codec":      codecName(viewer.Codec),
+	})
+}
 
-			// Process H264 packets
-			if packet.IsKeyFrame {
-				cs.processVideoPacket(packet)
-			}
-		}
-	}
+// refuseOverCapacity tells the cloud an offer was refused for the uplink
+// budget or a resource limit
+func (eg *EdgeGateway) refuseOverCapacity(offer OfferMessage) {
+	eg.sendEvent("webrtc_closed", map[string]interface{}{
+		"camera_id":  offer.CameraID,
+		"session_id": offer.SessionID,
+		"reason":     sessionReasonOverCapacity,
+		"error_code": errorCodeOverCapacity,
+	})
 }
 
-// processVideoPacket processes video packets from RTSP
-func (cs *CameraStream) processVideoPacket(packet av.Packet) {
-	if cs.videoTrack == nil {
+// failOffer tells the cloud an offer couldn't be answered, and why, so the
+// player stops waiting for an answer
+func (eg *EdgeGateway) failOffer(offer OfferMessage, err error) {
+	if errors.Is(err, errOverCapacity) {
+		eg.refuseOverCapacity(offer)
 		return
 	}
+	eg.sendError("webrtc_closed", map[string]interface{}{
+		"camera_id":  offer.CameraID,
+		"session_id": offer.SessionID,
+		"reason":     sessionReasonSetupFailed,
+	}, err)
+}
 
-	// Convert to RTP packet format
-	sample := media.Sample{
-		Data:     packet.Data,
-		Duration: time.Duration(packet.Duration),
-	}
-
-	if err := cs.videoTrack.WriteSample(sample); err != nil {
-		log.Printf("Failed to write video sample: %v", err)
+// prewarmStream opens the camera's on-demand stream for an offer still
+// being set up, so its RTSP session connects meanwhile. The returned func
+// releases it once the viewer is attached, or failed to be.
+func (eg *EdgeGateway) prewarmStream(cameraID, profile, codec string) func() {
+	stream, err := eg.openCodecStream(cameraID, profile, codec, true)
+	if err != nil {
+		// attachViewer reports why
+		return func() {}
 	}
+	stream.addViewer()
+	return func() { eg.releaseViewer(stream) }
 }
 
-// handleWebRTCOffer handles WebRTC offer from cloud
-func (eg *EdgeGateway) handleWebRTCOffer(offer OfferMessage) {
-	// Create peer connection
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+// attachViewer adds the camera's stream for a profile to a viewer's peer
+// connection. With requireRunning false the stream is opened on demand and
+// stopped again when its last viewer disconnects. onClose, if set, runs
+// once when the peer connection closes or fails. The viewer is reported in
+// stats until then.
+func (eg *EdgeGateway) attachViewer(v *Viewer, requireRunning bool, onClose func()) (*CameraStream, error) {
+	pc, cameraID := v.pc, v.CameraID
+	if eg.cfg.E2EERequired && eg.e2ee.Get(cameraID) == nil {
+		return nil, fmt.Errorf("camera %s has no end-to-end encryption key", cameraID)
 	}
-
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	v.Tenant, _ = eg.cameraTenant(cameraID)
+	profile, err := eg.admitOutbound(v.ID, cameraID, v.Profile, true)
 	if err != nil {
-		log.Printf("Failed to create peer connection: %v", err)
-		return
+		return nil, err
+	}
+	if profile != v.Profile {
+		// Lower profiles are separate streams, opened on demand
+		v.Profile = profile
+		requireRunning = false
+	}
+	if v.Codec != videoCodecH264 || v.watermark != nil {
+		// So are other codecs, and each watermarked session's video
+		requireRunning = false
 	}
 
-	// Store peer connection
-	eg.peerConnsLock.Lock()
-	eg.peerConns[offer.CameraID] = peerConnection
-	eg.peerConnsLock.Unlock()
+	var stream *CameraStream
+	if requireRunning {
+		eg.streamsLock.RLock()
+		stream = eg.streams[codecStreamKey(cameraID, profile, v.Codec)]
+		eg.streamsLock.RUnlock()
+	} else if stream, err = eg.openVariantStream(cameraID, profile, v.Codec, v.watermark, true); err != nil {
+		eg.releaseOutbound(v.ID)
+		return nil, err
+	}
 
-	// Get stream for this camera
-	eg.streamsLock.RLock()
-	stream, exists := eg.streams[offer.CameraID]
-	eg.streamsLock.RUnlock()
+	if stream == nil || stream.videoTrack == nil {
+		eg.releaseOutbound(v.ID)
+		return nil, fmt.Errorf("no stream available for camera: %s", cameraID)
+	}
 
-	if !exists || stream.videoTrack == nil {
-		log.Printf("No stream available for camera: %s", offer.CameraID)
-		peerConnection.Close()
-		return
+	// Viewers of a simulcast camera's main stream can switch layers, and
+	// SFUs that offered to receive them get every layer at once
+	releaseLayers := func() {}
+	if profile == viewerProfileMain && v.Codec == videoCodecH264 && v.watermark == nil && eg.simulcastEnabledFor(stream.camera) {
+		layers, release, err := eg.openLayers(stream)
+		if err != nil {
+			eg.releaseOutbound(v.ID)
+			return nil, err
+		}
+		v.layers, v.Layer, releaseLayers = layers, simulcastLayers[0].Name, release
 	}
+	v.simulcast = v.simulcast && v.layers != nil
 
 	// Add video track to peer connection
-	rtpSender, err := peerConnection.AddTrack(stream.videoTrack)
+	var rtpSender *webrtc.RTPSender
+	if v.simulcast {
+		rtpSender, err = addSimulcastSender(pc, v.layers)
+	} else {
+		rtpSender, err = pc.AddTrack(stream.videoTrack)
+	}
 	if err != nil {
-		log.Printf("Failed to add video track: %v", err)
-		peerConnection.Close()
-		return
+		releaseLayers()
+		eg.releaseOutbound(v.ID)
+		return nil, fmt.Errorf("failed to add video track: %v", err)
+	}
+	if v.simulcast {
+		// The other layers' receiver reports
+		for _, layer := range simulcastLayers[1:] {
+			rid := layer.RID
+			go func() {
+				for {
+					if _, _, err := rtpSender.ReadSimulcastRTCP(rid); err != nil {
+						return
+					}
+				}
+			}()
+		}
 	}
 
-	// Read incoming RTCP packets
+	// Read incoming RTCP packets, keeping the viewer's loss reports
 	go func() {
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			v.touch()
+			// The viewer may have switched profile since
+			v.lock.Lock()
+			current := v.profileStream
+			v.lock.Unlock()
+			current.stats.recordRTCP(packets)
+
+			if current.abr != nil {
+				if level, switched := current.abr.observe(packets); switched {
+					eg.switchStreamProfile(current, level)
+				}
+			}
 		}
 	}()
 
+	if params := rtpSender.GetParameters(); len(params.Encodings) > 0 {
+		v.ssrc = uint32(params.Encodings[0].SSRC)
+	}
+	v.sender, v.stream, v.profileStream = rtpSender, stream, stream
+	v.since = time.Now()
+	if v.bwe != nil {
+		// The send-side estimate, for viewers that no longer send REMB
+		v.bwe.OnTargetBitrateChange(func(bitrate int) {
+			v.lock.Lock()
+			current := v.profileStream
+			v.lock.Unlock()
+			if current.abr != nil {
+				if level, switched := current.abr.observeEstimate(float64(bitrate) / 1000); switched {
+					eg.switchStreamProfile(current, level)
+				}
+			}
+		})
+	}
+	eg.trackViewer(v)
+	eg.openSession(v)
+
+	stream.addViewer()
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			v.lock.Lock()
+			live := v.stream
+			v.lock.Unlock()
+			live.sendBufferedKeyframe()
+		}
+		if state == webrtc.PeerConnectionStateDisconnected {
+			// Try a new path before the connection fails for good
+			go eg.restartICE(v, "disconnected")
+		}
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			once.Do(func() {
+				v.stopReplay()
+				eg.untrackViewer(v)
+				eg.releaseOutbound(v.ID)
+				eg.endSession(v, v.endReason(state))
+				v.lock.Lock()
+				held := v.profileStream
+				v.lock.Unlock()
+				eg.releaseViewer(held)
+				releaseLayers()
+				eg.releaseViewerCameras(v)
+				if onClose != nil {
+					onClose()
+				}
+				if state == webrtc.PeerConnectionStateFailed {
+					// Frees its sockets, and its place under
+					// MAX_PEER_CONNECTIONS
+					go pc.Close()
+				}
+			})
+		}
+	})
+
 	// Create data channel for PTZ commands
 	if stream.camera.HasPTZ {
-		dataChannel, err := peerConnection.CreateDataChannel("ptz", nil)
+		dataChannel, err := pc.CreateDataChannel("ptz", nil)
 		if err != nil {
 			log.Printf("Failed to create PTZ data channel: %v", err)
 		} else {
 			dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
 				var cmd PTZCommand
 				if err := json.Unmarshal(msg.Data, &cmd); err == nil {
-					cmd.CameraID = offer.CameraID
-					eg.handlePTZCommand(cmd)
+					cmd.CameraID = cameraID
+					origin := AuditOrigin{Source: auditSourceViewer, SessionID: v.ID}
+					if err := eg.authorizePTZ(v, cameraID); err != nil {
+						log.Printf("Refusing PTZ %s on camera %s from session %s: %v", cmd.Action, cameraID, v.ID, err)
+						eg.audit(origin, "ptz_command", cameraID, map[string]interface{}{"action": cmd.Action}, err)
+						return
+					}
+					// Viewers act as operators at most, always under their
+					// session ID, so a player can't pass as the lock holder
+					if cmd.Priority == ptzPriorityAdmin {
+						cmd.Priority = ptzPriorityOperator
+					}
+					cmd.Operator = v.ID
+					eg.controlPTZ(origin, cmd)
 				}
 			})
 		}
 	}
 
-	// Set up ICE candidate handling
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
-		}
+	// Create data channel for replay controls
+	replayChannel, err := pc.CreateDataChannel(replayChannelLabel, nil)
+	if err != nil {
+		log.Printf("Failed to create replay data channel: %v", err)
+	} else {
+		v.replayChannel = replayChannel
+		replayChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			v.handleReplayControl(msg.Data)
+		})
+	}
 
-		candidateJSON, err := json.Marshal(candidate.ToJSON())
+	// Create data channel for frame timestamps, PTZ positions, stream
+	// health and events
+	metaChannel, err := pc.CreateDataChannel(metaChannelLabel, nil)
+	if err != nil {
+		log.Printf("Failed to create meta data channel: %v", err)
+	} else {
+		v.lock.Lock()
+		v.metaChannel = metaChannel
+		v.lock.Unlock()
+	}
+
+	// Create data channel for analytics metadata and inference results
+	if eg.analyticsEnabledFor(cameraID) || eg.inferenceEnabledFor(cameraID) {
+		analyticsChannel, err := pc.CreateDataChannel(analyticsChannelLabel, nil)
 		if err != nil {
-			return
+			log.Printf("Failed to create analytics data channel: %v", err)
+		} else {
+			v.lock.Lock()
+			v.analyticsChannel = analyticsChannel
+			v.lock.Unlock()
 		}
+	}
+	return stream, nil
+}
 
-		eg.sendToCloud(WSMessage{
-			Type: "ice_candidate",
-			Payload: json.RawMessage(fmt.Sprintf(`{"camera_id":"%s","candidate":%s}`,
-				offer.CameraID, candidateJSON)),
-		})
-	})
+// cloudPeer is a cloud viewer session's peer connection, and the remote
+// candidates held while its offer is set up
+type cloudPeer struct {
+	cameraID string
+	pc       *webrtc.PeerConnection // nil until created
+	held     []webrtc.ICECandidateInit
+	holding  bool // until the offer has its remote description
+}
 
-	// Set remote description
-	if err := peerConnection.SetRemoteDescription(offer.SDP); err != nil {
-		log.Printf("Failed to set remote description: %v", err)
-		peerConnection.Close()
-		return
+// peerFor returns a viewer session's cloud peer. Messages from players that
+// name only the camera find its peer if the camera has just one. The caller
+// holds peerConnsLock.
+func (eg *EdgeGateway) peerFor(sessionID, cameraID string) *cloudPeer {
+	if sessionID != "" {
+		return eg.peerConns[sessionID]
+	}
+	var found *cloudPeer
+	for _, p := range eg.peerConns {
+		if p.cameraID == cameraID {
+			if found != nil {
+				return nil
+			}
+			found = p
+		}
 	}
+	return found
+}
 
-	// Create answer
-	answer, err := peerConnection.CreateAnswer(nil)
-	if err != nil {
-		log.Printf("Failed to create answer: %v", err)
-		peerConnection.Close()
+// handleICECandidate handles ICE candidate from cloud
+func (eg *EdgeGateway) handleICECandidate(sessionID, cameraID string, candidate webrtc.ICECandidateInit) {
+	eg.peerConnsLock.Lock()
+	p := eg.peerFor(sessionID, cameraID)
+	if p == nil {
+		eg.peerConnsLock.Unlock()
 		return
 	}
-
-	// Set local description
-	if err := peerConnection.SetLocalDescription(answer); err != nil {
-		log.Printf("Failed to set local description: %v", err)
-		peerConnection.Close()
+	if p.holding {
+		if len(p.held) < maxPendingCandidates {
+			p.held = append(p.held, candidate)
+		}
+		eg.peerConnsLock.Unlock()
 		return
 	}
+	pc := p.pc
+	eg.peerConnsLock.Unlock()
 
-	// Send answer to cloud
-	answerJSON, _ := json.Marshal(answer)
-	eg.sendToCloud(WSMessage{
-		Type: "webrtc_answer",
-		Payload: json.RawMessage(fmt.Sprintf(`{"camera_id":"%s","sdp":%s}`,
-			offer.CameraID, answerJSON)),
-	})
+	if err := pc.AddICECandidate(candidate); err != nil {
+		log.Printf("Failed to add ICE candidate: %v", err)
+	}
 }
 
-// handleICECandidate handles ICE candidate from cloud
-func (eg *EdgeGateway) handleICECandidate(cameraID string, candidate webrtc.ICECandidateInit) {
-	eg.peerConnsLock.RLock()
-	pc, exists := eg.peerConns[cameraID]
-	eg.peerConnsLock.RUnlock()
+// maxPendingCandidates bounds the candidates held for an offer
+const maxPendingCandidates = 64
 
-	if !exists {
-		return
+// holdCandidates holds the session's remote candidates until its offer has
+// its remote description, when applyCandidates adds them
+func (eg *EdgeGateway) holdCandidates(sessionID, cameraID string) {
+	eg.peerConnsLock.Lock()
+	defer eg.peerConnsLock.Unlock()
+	p := eg.peerConns[sessionID]
+	if p == nil {
+		p = &cloudPeer{cameraID: cameraID}
+		eg.peerConns[sessionID] = p
 	}
+	p.holding = true
+}
 
-	if err := pc.AddICECandidate(candidate); err != nil {
-		log.Printf("Failed to add ICE candidate: %v", err)
+// applyCandidates adds the candidates held for a session to its peer
+// connection, or drops them if setting up the offer failed (pc is nil)
+func (eg *EdgeGateway) applyCandidates(sessionID string, pc *webrtc.PeerConnection) {
+	eg.peerConnsLock.Lock()
+	p := eg.peerConns[sessionID]
+	if p == nil {
+		eg.peerConnsLock.Unlock()
+		return
+	}
+	pending := p.held
+	p.held, p.holding = nil, false
+	if pc == nil && (p.pc == nil || p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed) {
+		delete(eg.peerConns, sessionID)
+	}
+	eg.peerConnsLock.Unlock()
+	if pc == nil {
+		return
+	}
+	for _, candidate := range pending {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Failed to add ICE candidate: %v", err)
+		}
 	}
 }
 
-// handlePTZCommand handles PTZ commands
-func (eg *EdgeGateway) handlePTZCommand(cmd PTZCommand) {
-	eg.camerasLock.RLock()
-	camera, exists := eg.cameras[cmd.CameraID]
-	eg.camerasLock.RUnlock()
+// sendPTZCommand sends a PTZ command to the camera
+func (eg *EdgeGateway) sendPTZCommand(ctx context.Context, camera *Camera, cmd PTZCommand) {
+	client := eg.httpClients.Client(camera)
+
+	// Fixed cameras pan, tilt and zoom digitally; stop also ends lens moves
+	if eg.digitalPTZ(camera) != nil && isDigitalPTZ(cmd.Action) {
+		eg.moveDigitalPTZ(camera, cmd)
+		if cmd.Action != "stop" {
+			return
+		}
+	}
+
+	// Auxiliary devices have commands of their own
+	if isAuxiliaryAction(cmd.Action) {
+		if err := sendAuxiliary(ctx, client, camera, cmd); err != nil {
+			log.Printf("Failed to execute %s on camera %s: %v", cmd.Action, camera.ID, err)
+		}
+		return
+	}
 
-	if !exists || !camera.HasPTZ {
-		log.Printf("Camera not found or doesn't support PTZ: %s", cmd.CameraID)
+	// ONVIF cameras take lens and IR-cut commands through the imaging service
+	if camera.Capabilities != nil && camera.Capabilities.Source == "onvif" &&
+		(isImagingAction(cmd.Action) || cmd.Action == "stop") {
+		err := onvifImaging(ctx, client, camera, cmd)
+		if cmd.Action != "stop" {
+			if err != nil {
+				log.Printf("Failed to execute %s on camera %s: %v", cmd.Action, camera.ID, err)
+			}
+			return
+		}
+		if err != nil {
+			debugf("ONVIF imaging stop for camera %s: %v", camera.ID, err)
+		}
+		if !camera.HasPTZ {
+			return
+		}
+	}
+
+	// Hikvision and Dahua cameras move through their native API, which
+	// outlasts their ONVIF PTZ on older firmware
+	if adapter := cameraAdapterFor(camera); adapter != nil && !isImagingAction(cmd.Action) {
+		if cmd.Action == "stop" && !camera.HasPTZ {
+			return
+		}
+		if err := adapter.PTZ(ctx, client, camera, cmd); err != nil {
+			log.Printf("Failed to execute %s on camera %s: %v", cmd.Action, camera.ID, err)
+		}
 		return
 	}
 
@@ -645,23 +2366,37 @@ func (eg *EdgeGateway) handlePTZCommand(cmd PTZCommand) {
 	case "zoom_out":
 		ptzCmd = fmt.Sprintf("continuouszoommove=-%.2f", cmd.Speed)
 	case "stop":
-		ptzCmd = "continuouspantiltmove=0,0&continuouszoommove=0"
+		var moves []string
+		if camera.HasPTZ {
+			moves = append(moves, "continuouspantiltmove=0,0", "continuouszoommove=0")
+		}
+		if caps := camera.Capabilities; caps != nil && caps.Imaging != nil {
+			if caps.Imaging.Focus {
+				moves = append(moves, "continuousfocusmove=0")
+			}
+			if caps.Imaging.Iris {
+				moves = append(moves, "continuousirismove=0")
+			}
+		}
+		if len(moves) == 0 {
+			return
+		}
+		ptzCmd = strings.Join(moves, "&")
 	default:
-		log.Printf("Unknown PTZ command: %s", cmd.Action)
-		return
+		if !isImagingAction(cmd.Action) {
+			log.Printf("Unknown PTZ command: %s", cmd.Action)
+			return
+		}
+		query, err := vapixImagingQuery(cmd)
+		if err != nil {
+			log.Printf("Invalid %s command for camera %s: %v", cmd.Action, camera.ID, err)
+			return
+		}
+		ptzCmd = query
 	}
 
 	// Send PTZ command
-	ptzURL := fmt.Sprintf("http://%s/axis-cgi/com/ptz.cgi?%s", camera.IP, ptzCmd)
-	req, err := http.NewRequest("GET", ptzURL, nil)
-	if err != nil {
-		log.Printf("Failed to create PTZ request: %v", err)
-		return
-	}
-	req.SetBasicAuth(camera.Username, camera.Password)
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := client.Get(ctx, "/axis-cgi/com/ptz.cgi?"+ptzQuery(camera, ptzCmd))
 	if err != nil {
 		log.Printf("Failed to execute PTZ command: %v", err)
 		return
@@ -675,76 +2410,186 @@ func (eg *EdgeGateway) handlePTZCommand(cmd PTZCommand) {
 
 // stopStream stops the stream for a camera
 func (eg *EdgeGateway) stopStream(cameraID string) {
+	// Stop the main stream and any sub-streams
 	eg.streamsLock.Lock()
-	stream, exists := eg.streams[cameraID]
-	if exists {
-		close(stream.stopChan)
-		delete(eg.streams, cameraID)
+	for key, stream := range eg.streams {
+		if stream.camera.ID == cameraID {
+			stream.cancel()
+			delete(eg.streams, key)
+		}
 	}
 	eg.streamsLock.Unlock()
 
 	eg.peerConnsLock.Lock()
-	if pc, exists := eg.peerConns[cameraID]; exists {
-		pc.Close()
-		delete(eg.peerConns, cameraID)
+	for sessionID, p := range eg.peerConns {
+		if p.cameraID == cameraID && p.pc != nil {
+			p.pc.Close()
+			delete(eg.peerConns, sessionID)
+		}
 	}
 	eg.peerConnsLock.Unlock()
 }
 
+// addViewer notes a peer watching the stream
+func (cs *CameraStream) addViewer() {
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	cs.viewers++
+	if cs.idleTimer != nil {
+		cs.idleTimer.Stop()
+		cs.idleTimer = nil
+	}
+}
+
+// releaseViewer drops a viewer from a stream. Once no one is watching, the
+// stream is stopped after STREAM_IDLE_TIMEOUT, unless it was started
+// explicitly or a viewer comes back first.
+func (eg *EdgeGateway) releaseViewer(cs *CameraStream) {
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	cs.viewers--
+	if cs.viewers > 0 || !cs.onDemand {
+		return
+	}
+
+	if cs.idleTimer != nil {
+		cs.idleTimer.Stop()
+	}
+	cs.idleTimer = time.AfterFunc(eg.cfg.StreamIdleTimeout, func() {
+		eg.stopIdleStream(cs)
+	})
+}
+
+// stopIdleStream stops an on-demand stream that still has no viewers
+func (eg *EdgeGateway) stopIdleStream(cs *CameraStream) {
+	key := codecStreamKey(cs.camera.ID, cs.profile, cs.codec) + cs.watermark.keySuffix()
+	eg.streamsLock.Lock()
+	defer eg.streamsLock.Unlock()
+
+	cs.runningLock.Lock()
+	idle := cs.viewers <= 0 && cs.onDemand
+	cs.runningLock.Unlock()
+	if !idle {
+		return
+	}
+
+	if eg.streams[key] == cs {
+		delete(eg.streams, key)
+		debugf("Stopped idle stream for camera: %s", key)
+	}
+	cs.cancel()
+}
+
 // notifyCameraStatus sends camera status update to cloud
 func (eg *EdgeGateway) notifyCameraStatus(camera *Camera, status string) {
-	payload, _ := json.Marshal(map[string]interface{}{
-		"camera": camera,
-		"status": status,
-	})
+	// Quarantined cameras stay quiet until released
+	if eg.quarantine.IsQuarantined(camera.ID) {
+		return
+	}
+	if eg.quarantine.RecordEvent(camera.ID) {
+		eg.notifyQuarantine(camera.ID)
+		return
+	}
+	// Cameras every member of a cluster discovers are reported by one
+	if status == "discovered" && !eg.clusterOwns(camera.ID) {
+		return
+	}
+	eg.reportCameraStatus(camera, status)
+}
+
+// sendEvent marshals a payload and sends it to cloud as the given message type
+func (eg *EdgeGateway) sendEvent(msgType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal %s payload: %v", msgType, err)
+		return
+	}
+	data = eg.labelTenant(data)
+	if eg.mqtt != nil {
+		eg.mqtt.Publish(msgType, data)
+	}
+	eg.forwardMetaEvent(msgType, data)
 
 	eg.sendToCloud(WSMessage{
-		Type:    "camera_status",
-		Payload: json.RawMessage(payload),
+		Type:    msgType,
+		Payload: json.RawMessage(data),
 	})
 }
 
 // sendToCloud sends a message to cloud orchestrator
 func (eg *EdgeGateway) sendToCloud(msg WSMessage) {
-	eg.wsLock.Lock()
-	defer eg.wsLock.Unlock()
+	eg.cloudLock.Lock()
+	defer eg.cloudLock.Unlock()
 
-	if eg.wsConn == nil {
+	// Hold events for delivery on reconnect while the cloud is unreachable
+	if eg.cloudConn == nil {
+		eg.outbox.Add(msg)
 		return
 	}
 
-	if err := eg.wsConn.WriteJSON(msg); err != nil {
+	// With acks, kept until the cloud acknowledges it, and sent again on
+	// reconnect if it doesn't
+	tracked := eg.outbox.Tracks(msg)
+	if tracked {
+		msg = eg.outbox.Sent(msg)
+	}
+	if err := eg.cloudConn.Send(msg); err != nil {
 		log.Printf("Failed to send message to cloud: %v", err)
+		if !tracked {
+			eg.outbox.Add(msg)
+		}
 	}
 }
 
-// reconnectToCloud attempts to reconnect to cloud orchestrator
-func (eg *EdgeGateway) reconnectToCloud() {
-	eg.wsLock.Lock()
-	if eg.wsConn != nil {
-		eg.wsConn.Close()
-		eg.wsConn = nil
+// reconnectToCloud reconnects to the cloud orchestrator with jittered
+// exponential backoff, retrying until it succeeds or ctx is cancelled. Streams
+// and viewers keep running meanwhile and are reported once reconnected.
+func (eg *EdgeGateway) reconnectToCloud(ctx context.Context, cause error) {
+	eg.cloudLock.Lock()
+	if eg.cloudConn != nil {
+		eg.cloudConn.Close()
+		eg.cloudConn = nil
 	}
-	eg.wsLock.Unlock()
+	eg.cloudLock.Unlock()
 
-	for retries := 0; retries < 5; retries++ {
-		log.Printf("Attempting to reconnect to cloud (attempt %d/5)", retries+1)
-		if err := eg.connectToCloud(); err == nil {
-			// Re-send camera list
-			eg.camerasLock.RLock()
-			for _, camera := range eg.cameras {
-				eg.notifyCameraStatus(camera, "reconnected")
-			}
-			eg.camerasLock.RUnlock()
+	err := cause
+	for attempt := 1; ; attempt++ {
+		delay := eg.cloudReconnectDelay(attempt)
+		eg.setCloudState(cloudStateReconnecting, attempt, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		log.Printf("Attempting to reconnect to cloud (attempt %d)", attempt)
+		if err = eg.connectToCloud(ctx); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
 			return
 		}
-		time.Sleep(time.Duration(retries+1) * 5 * time.Second)
+		log.Printf("Cloud reconnect failed: %v", redactCredentials(err.Error()))
+	}
+
+	// Re-send camera list
+	eg.camerasLock.RLock()
+	for _, camera := range eg.cameras {
+		eg.notifyCameraStatus(camera, "reconnected")
 	}
+	eg.camerasLock.RUnlock()
+	eg.flushInventory()
+	eg.sendSessionResume()
+
+	// Viewers that lost their path along with the cloud link need new
+	// candidates, and any restart offered while offline was never delivered
+	eg.restartViewersICE("cloud_reconnected", true)
 }
 
-// keepAlive sends periodic ping messages
+// keepAlive sends periodic heartbeat pings, and reconnects when the cloud
+// stops answering them
 func (eg *EdgeGateway) keepAlive(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(cloudHeartbeatInterval)
 	defer ticker.Stop()
 
 	for {
@@ -752,10 +2597,8 @@ func (eg *EdgeGateway) keepAlive(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			eg.sendToCloud(WSMessage{
-				Type:    "ping",
-				Payload: json.RawMessage(`{}`),
-			})
+			eg.checkPong()
+			eg.sendHeartbeat()
 		}
 	}
 }
@@ -765,24 +2608,43 @@ func (eg *EdgeGateway) cleanup() {
 	// Stop all streams
 	eg.streamsLock.Lock()
 	for cameraID, stream := range eg.streams {
-		close(stream.stopChan)
+		stream.cancel()
 		delete(eg.streams, cameraID)
 	}
 	eg.streamsLock.Unlock()
 
 	// Close all peer connections
 	eg.peerConnsLock.Lock()
-	for _, pc := range eg.peerConns {
-		pc.Close()
+	for _, p := range eg.peerConns {
+		if p.pc != nil {
+			p.pc.Close()
+		}
 	}
 	eg.peerConnsLock.Unlock()
 
-	// Close WebSocket connection
-	eg.wsLock.Lock()
-	if eg.wsConn != nil {
-		eg.wsConn.Close()
+	// Close WHEP sessions
+	eg.whepLock.Lock()
+	for _, pc := range eg.whepSessions {
+		pc.Close()
+	}
+	eg.whepLock.Unlock()
+
+	// Close the cloud connection
+	eg.cloudLock.Lock()
+	if eg.cloudConn != nil {
+		eg.cloudConn.Close()
 	}
-	eg.wsLock.Unlock()
+	eg.cloudLock.Unlock()
+	eg.setCloudState(cloudStateClosed, 0, nil, 0)
+
+	// Undelivered events are journaled for the next run
+	eg.outbox.Close()
+	eg.auditLog.Close()
+
+	// Close pooled camera HTTP connections
+	eg.httpClients.CloseAll()
+
+	eg.closeICEMuxes()
 }
 
 // getGatewayID returns a unique ID for this gateway
@@ -800,35 +2662,92 @@ func getGatewayID() string {
 }
 
 func main() {
-	cloudURL := os.Getenv("CLOUD_ORCHESTRATOR_URL")
-	if cloudURL == "" {
-		cloudURL = "wss://orchestrator.example.com/gateway"
-	}
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	// Ensure WebSocket URL
-	if !strings.HasPrefix(cloudURL, "ws://") && !strings.HasPrefix(cloudURL, "wss://") {
-		cloudURL = "wss://" + cloudURL
+// runGateway runs the gateway until it is signalled to stop
+func runGateway(args []string) int {
+	flags := configFlags("run", "")
+	// Kept from before every variable had a flag
+	flags.Var(flags.Lookup("simulate-cameras").Value, "simulate", "sets SIMULATE_CAMERAS, as --simulate-cameras")
+	if err := flags.Parse(args); err != nil {
+		return flagExitCode(err)
 	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "run: unexpected argument %q\n", flags.Arg(0))
+		return 2
+	}
+
+	cfg := loadConfig()
+	setLogLevel(cfg.LogLevel)
+	setupProxy(cfg)
+	applyMemoryLimit(cfg)
 
 	log.Printf("Edge Gateway starting...")
 	log.Printf("Gateway ID: %s", getGatewayID())
-	log.Printf("Cloud URL: %s", cloudURL)
+	log.Printf("Cloud URL: %s", cfg.CloudURL)
+	if debugLogging.Load() {
+		var settings strings.Builder
+		writeSettings(&settings)
+		debugf("Effective configuration:\n%s", settings.String())
+	}
+	warnBridgedContainer(cfg)
 
-	gateway := NewEdgeGateway(cloudURL)
+	gateway := NewEdgeGateway(cfg)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Handle shutdown gracefully
+	shutdownTracing, err := initTracing(ctx, cfg)
+	if err != nil {
+		log.Printf("Tracing disabled: %v", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	// Handle shutdown gracefully, but never take longer than the shutdown
+	// timeout to exit
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	// SIGHUP reloads the configuration files
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Println("Reloading configuration...")
+			gateway.reload()
+		}
+	}()
 	go func() {
 		<-sigChan
 		log.Println("Shutting down...")
 		cancel()
+
+		time.AfterFunc(cfg.ShutdownTimeout+time.Second, func() {
+			log.Printf("Shutdown did not finish within %s, forcing exit", cfg.ShutdownTimeout)
+			os.Exit(1)
+		})
+
+		// A second signal exits immediately
+		<-sigChan
+		log.Println("Forced exit")
+		os.Exit(1)
 	}()
 
 	if err := gateway.Start(ctx); err != nil {
 		log.Fatalf("Gateway error: %v", err)
 	}
-}
\ No newline at end of file
+
+	// Flush buffered spans
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	shutdownTracing(flushCtx)
+
+	if reason := gateway.pendingRestart(); reason != "" {
+		log.Printf("Restarting (%s)", reason)
+		if err := restartSelf(); err != nil {
+			log.Printf("Exiting for the service manager to restart the gateway: %v", err)
+			return 1
+		}
+	}
+	return 0
+}
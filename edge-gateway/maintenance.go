@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Maintenance actions of a CameraMaintenanceRequest
+const (
+	maintenanceReboot        = "reboot"
+	maintenanceRestartStream = "restart_stream"
+	maintenanceFactoryReset  = "factory_reset"
+	// maintenanceFirmware is an upgrade_firmware request, which holds a
+	// camera like the others
+	maintenanceFirmware = "firmware_upgrade"
+)
+
+// Maintenance states reported in maintenance_status messages
+const (
+	maintenanceStateConfirm   = "confirm"
+	maintenanceStateStarted   = "started"
+	maintenanceStateRebooting = "rebooting"
+	maintenanceStateCompleted = "completed"
+	maintenanceStateFailed    = "failed"
+)
+
+// Factory reset modes
+const (
+	factoryResetSoft = "soft" // keeps the network settings
+	factoryResetHard = "hard"
+)
+
+// maintenanceConfirmTTL is how long a factory reset confirmation token is
+// valid
+const maintenanceConfirmTTL = 2 * time.Minute
+
+// maintenancePollInterval is how often a rebooting camera is checked
+const maintenancePollInterval = 5 * time.Second
+
+// errCameraBusy is returned when another maintenance action holds a camera
+var errCameraBusy = errors.New("camera is busy")
+
+// CameraMaintenanceRequest is the camera_maintenance payload, and the body of
+// POST /api/cameras/{cameraID}/maintenance
+type CameraMaintenanceRequest struct {
+	CameraID string `json:"camera_id"`
+	Action   string `json:"action"`
+	// Mode and Confirm are for factory_reset: soft or hard, and the token
+	// of the confirm status answering the request without one
+	Mode    string `json:"mode,omitempty"`
+	Confirm string `json:"confirm,omitempty"`
+}
+
+// MaintenanceStatus reports a maintenance action's progress
+type MaintenanceStatus struct {
+	CameraID  string     `json:"camera_id"`
+	Action    string     `json:"action"`
+	Mode      string     `json:"mode,omitempty"`
+	State     string     `json:"state"`
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// resetConfirmation is an outstanding factory reset confirmation token
+type resetConfirmation struct {
+	token   string
+	mode    string
+	expires time.Time
+}
+
+// beginMaintenance holds a camera for a maintenance action, refusing if
+// another is running. The camera's streams are refused until
+// endMaintenance.
+func (eg *EdgeGateway) beginMaintenance(cameraID, action string) error {
+	eg.maintenanceLock.Lock()
+	defer eg.maintenanceLock.Unlock()
+	if running, busy := eg.maintenance[cameraID]; busy {
+		return fmt.Errorf("%w with %s", errCameraBusy, running)
+	}
+	eg.maintenance[cameraID] = action
+	return nil
+}
+
+func (eg *EdgeGateway) endMaintenance(cameraID string) {
+	eg.maintenanceLock.Lock()
+	defer eg.maintenanceLock.Unlock()
+	delete(eg.maintenance, cameraID)
+}
+
+// maintenanceAction returns the maintenance action holding a camera, or the
+// camera it is a sensor of, or empty if there is none
+func (eg *EdgeGateway) maintenanceAction(camera *Camera) string {
+	eg.maintenanceLock.Lock()
+	defer eg.maintenanceLock.Unlock()
+	if action, busy := eg.maintenance[camera.ID]; busy {
+		return action
+	}
+	if camera.ParentID != "" {
+		return eg.maintenance[camera.ParentID]
+	}
+	return ""
+}
+
+// reportMaintenance sends a maintenance_status message
+func (eg *EdgeGateway) reportMaintenance(status MaintenanceStatus) {
+	if status.Error != "" {
+		log.Printf("Camera %s %s %s: %s", status.CameraID, status.Action, status.State, status.Error)
+	} else {
+		log.Printf("Camera %s %s: %s", status.CameraID, status.Action, status.State)
+	}
+	eg.sendEvent("maintenance_status", status)
+}
+
+// cameraMaintenance runs a maintenance action on a camera. Stream restarts
+// complete at once. Reboots and factory resets start in the background and
+// report their progress with maintenance_status; a factory reset without a
+// valid confirmation token only returns a token to confirm it with.
+func (eg *EdgeGateway) cameraMaintenance(req CameraMaintenanceRequest) (MaintenanceStatus, error) {
+	status := MaintenanceStatus{CameraID: req.CameraID, Action: req.Action}
+
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[req.CameraID]
+	var copied Camera
+	if exists {
+		copied = *camera
+	}
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return status, errCameraNotFound
+	}
+
+	switch req.Action {
+	case maintenanceRestartStream:
+		restarted := 0
+		eg.streamsLock.RLock()
+		for _, stream := range eg.streams {
+			if stream.camera.ID == req.CameraID {
+				stream.restartIngest()
+				restarted++
+			}
+		}
+		eg.streamsLock.RUnlock()
+		if restarted == 0 {
+			return status, errors.New("camera has no running streams")
+		}
+		log.Printf("Restarted %d streams of camera %s", restarted, req.CameraID)
+		status.State = maintenanceStateCompleted
+		return status, nil
+
+	case maintenanceReboot:
+	case maintenanceFactoryReset:
+		if req.Mode == "" {
+			req.Mode = factoryResetSoft
+		}
+		if req.Mode != factoryResetSoft && req.Mode != factoryResetHard {
+			return status, fmt.Errorf("invalid factory reset mode %q", req.Mode)
+		}
+		status.Mode = req.Mode
+	default:
+		return status, fmt.Errorf("unknown maintenance action %q", req.Action)
+	}
+
+	if copied.Simulated {
+		return status, errors.New("simulated cameras can't be rebooted or reset")
+	}
+	if copied.Device != "" {
+		return status, errors.New("local cameras can't be rebooted or reset")
+	}
+	if copied.Generic {
+		return status, errors.New("generic RTSP sources can't be rebooted or reset")
+	}
+	if copied.ParentID != "" {
+		return status, fmt.Errorf("camera is a sensor of camera %s, which must be maintained instead", copied.ParentID)
+	}
+
+	if req.Action == maintenanceFactoryReset && !eg.confirmReset(req) {
+		token := randomHex(16)
+		expires := time.Now().Add(maintenanceConfirmTTL).UTC()
+		eg.maintenanceLock.Lock()
+		eg.resetConfirmations[req.CameraID] = resetConfirmation{token: token, mode: req.Mode, expires: expires}
+		eg.maintenanceLock.Unlock()
+		status.State = maintenanceStateConfirm
+		status.Token = token
+		status.ExpiresAt = &expires
+		return status, nil
+	}
+
+	if err := eg.beginMaintenance(req.CameraID, req.Action); err != nil {
+		return status, err
+	}
+	status.State = maintenanceStateStarted
+	eg.reportMaintenance(status)
+	eg.goTracked(func() { eg.runMaintenance(&copied, status) })
+	return status, nil
+}
+
+// confirmReset reports whether a factory reset carries the outstanding
+// token for its camera and mode, using it up
+func (eg *EdgeGateway) confirmReset(req CameraMaintenanceRequest) bool {
+	eg.maintenanceLock.Lock()
+	defer eg.maintenanceLock.Unlock()
+	pending, exists := eg.resetConfirmations[req.CameraID]
+	if !exists || req.Confirm == "" {
+		return false
+	}
+	delete(eg.resetConfirmations, req.CameraID)
+	return req.Confirm == pending.token && req.Mode == pending.mode && time.Now().Before(pending.expires)
+}
+
+// runMaintenance reboots or resets a camera and waits for it to come back.
+// Its streams are stopped meanwhile, and after a reboot restarted. A hard
+// reset usually moves the camera to another address, so it completes once
+// the camera took the command. The camera is released from maintenance at
+// the end.
+func (eg *EdgeGateway) runMaintenance(camera *Camera, status MaintenanceStatus) {
+	streaming := eg.stopCameraStreams(camera.ID)
+	defer func() {
+		eg.endMaintenance(camera.ID)
+		if streaming && status.State == maintenanceStateCompleted && status.Action == maintenanceReboot {
+			if err := eg.startStream(camera.ID); err != nil {
+				log.Printf("Failed to restart stream of camera %s after its reboot: %v", camera.ID, err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(eg.ctx, clockCheckTimeout)
+	err := sendMaintenance(ctx, eg.httpClients.Client(camera), camera, status.Action, status.Mode)
+	cancel()
+	if err != nil {
+		status.State = maintenanceStateFailed
+		status.Error = err.Error()
+		eg.reportMaintenance(status)
+		return
+	}
+	if status.Mode == factoryResetHard {
+		status.State = maintenanceStateCompleted
+		eg.reportMaintenance(status)
+		return
+	}
+
+	status.State = maintenanceStateRebooting
+	eg.reportMaintenance(status)
+	if err := eg.awaitReboot(camera); err != nil {
+		status.State = maintenanceStateFailed
+		status.Error = err.Error()
+		eg.reportMaintenance(status)
+		return
+	}
+	status.State = maintenanceStateCompleted
+	eg.reportMaintenance(status)
+}
+
+// sendMaintenance sends a reboot or factory reset to the camera, through
+// VAPIX or, for ONVIF cameras, the device service
+func sendMaintenance(ctx context.Context, client *CameraHTTPClient, camera *Camera, action, mode string) error {
+	if camera.Capabilities != nil && camera.Capabilities.Source == "onvif" {
+		body := `<SystemReboot xmlns="http://www.onvif.org/ver10/device/wsdl"/>`
+		if action == maintenanceFactoryReset {
+			value := "Soft"
+			if mode == factoryResetHard {
+				value = "Hard"
+			}
+			body = `<SetSystemFactoryDefault xmlns="http://www.onvif.org/ver10/device/wsdl"><FactoryDefault>` + value + `</FactoryDefault></SetSystemFactoryDefault>`
+		}
+		var lastErr error
+		for _, path := range onvifDevicePaths {
+			if lastErr = onvifCall(ctx, client, path, body, &struct{}{}); lastErr == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("ONVIF device service not available: %v", lastErr)
+	}
+
+	path := "/axis-cgi/restart.cgi"
+	if action == maintenanceFactoryReset {
+		path = "/axis-cgi/factorydefault.cgi"
+		if mode == factoryResetHard {
+			path = "/axis-cgi/hardfactorydefault.cgi"
+		}
+	}
+	resp, err := client.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+// awaitReboot waits for a camera's RTSP port to go down and come back up,
+// within CAMERA_REBOOT_TIMEOUT
+func (eg *EdgeGateway) awaitReboot(camera *Camera) error {
+	port := camera.Port
+	if port == 0 {
+		port = 554
+	}
+	addr := net.JoinHostPort(camera.IP, strconv.Itoa(port))
+	deadline := time.Now().Add(eg.cfg.CameraRebootTimeout)
+	wentDown := false
+	for time.Now().Before(deadline) {
+		select {
+		case <-eg.ctx.Done():
+			return eg.ctx.Err()
+		case <-time.After(maintenancePollInterval):
+		}
+		conn, err := net.DialTimeout("tcp", addr, eg.cfg.RTSPDialTimeout)
+		if err != nil {
+			wentDown = true
+			continue
+		}
+		conn.Close()
+		if wentDown {
+			return nil
+		}
+	}
+	if !wentDown {
+		return fmt.Errorf("camera did not restart within %s", eg.cfg.CameraRebootTimeout)
+	}
+	return fmt.Errorf("camera did not come back within %s", eg.cfg.CameraRebootTimeout)
+}
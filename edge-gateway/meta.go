@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/pion/webrtc/v3"
+)
+
+// metaChannelLabel is the label of the data channel every viewer session
+// receives frame timestamps, PTZ positions, stream health and events on
+const metaChannelLabel = "meta"
+
+// How often the meta channel carries frame timestamps, PTZ positions (when
+// they change) and stream health
+const (
+	metaFrameInterval  = time.Second
+	metaPTZInterval    = time.Second
+	metaHealthInterval = 5 * time.Second
+)
+
+// metaMaxBuffered is how much may wait on a viewer's meta channel before
+// messages are dropped for it
+const metaMaxBuffered = 256 << 10
+
+// metaEventTypes are the camera messages to the cloud that are also sent to
+// the camera's viewers as meta events
+var metaEventTypes = map[string]bool{
+	"object_detected": true,
+	"audio_event":     true,
+	"io_input":        true,
+	"clip_ready":      true,
+	"ptz_lock":        true,
+	"ptz_view":        true,
+	"stream_profile":  true,
+}
+
+// MetaMessage is a message on the meta data channel. Type is frame, ptz,
+// health or event, and says which of the other fields are set.
+type MetaMessage struct {
+	Type     string        `json:"type"`
+	CameraID string        `json:"camera_id"`
+	Time     time.Time     `json:"time"`
+	Frame    *MetaFrame    `json:"frame,omitempty"`
+	PTZ      *PTZPosition  `json:"ptz,omitempty"`
+	Health   *StreamHealth `json:"health,omitempty"`
+	Viewer   *ViewerStats  `json:"viewer,omitempty"`
+	// Event is the type of the message to the cloud carried as Payload
+	Event   string          `json:"event,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// MetaFrame is a video frame as the gateway sent it, at Time of its message
+type MetaFrame struct {
+	// PTSMs is its presentation time in the camera's stream, in ms
+	PTSMs    int64 `json:"pts_ms"`
+	KeyFrame bool  `json:"keyframe"`
+}
+
+// PTZPosition is where a camera points: pan and tilt in degrees and zoom in
+// VAPIX units (1 to 9999) for PTZ cameras, or the view of digital PTZ
+type PTZPosition struct {
+	Pan     *float64     `json:"pan,omitempty"`
+	Tilt    *float64     `json:"tilt,omitempty"`
+	Zoom    *float64     `json:"zoom,omitempty"`
+	Digital *digitalView `json:"digital,omitempty"`
+}
+
+// sendMeta sends a message to the open meta channels of viewers watching
+// its camera, on their own connection or added to another's. With stream
+// set, only viewers of that stream get it.
+func (eg *EdgeGateway) sendMeta(msg MetaMessage, stream *CameraStream) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	eg.viewersLock.Lock()
+	defer eg.viewersLock.Unlock()
+	for _, v := range eg.viewers {
+		v.lock.Lock()
+		channel := v.metaChannel
+		_, added := v.cameras[msg.CameraID]
+		watching := v.CameraID == msg.CameraID || added
+		if stream != nil {
+			watching = v.stream == stream || added && v.cameras[msg.CameraID].stream == stream
+		}
+		v.lock.Unlock()
+		if watching && channel != nil && channel.ReadyState() == webrtc.DataChannelStateOpen &&
+			channel.BufferedAmount() < metaMaxBuffered {
+			channel.SendText(string(data))
+		}
+	}
+}
+
+// sendFrameMeta reports a frame the stream sent, at most once per
+// metaFrameInterval. It is only called from the stream's track writer.
+func (eg *EdgeGateway) sendFrameMeta(cs *CameraStream, packet av.Packet) {
+	now := time.Now()
+	if now.Sub(cs.lastFrameMeta) < metaFrameInterval {
+		return
+	}
+	cs.lastFrameMeta = now
+	eg.sendMeta(MetaMessage{
+		Type:     "frame",
+		CameraID: cs.camera.ID,
+		Time:     now.UTC(),
+		Frame:    &MetaFrame{PTSMs: packet.Time.Milliseconds(), KeyFrame: packet.IsKeyFrame},
+	}, cs)
+}
+
+// forwardMetaEvent sends a camera message to the cloud to the camera's
+// viewers too
+func (eg *EdgeGateway) forwardMetaEvent(msgType string, data []byte) {
+	if !metaEventTypes[msgType] {
+		return
+	}
+	var event struct {
+		CameraID string `json:"camera_id"`
+	}
+	if json.Unmarshal(data, &event) != nil || event.CameraID == "" {
+		return
+	}
+	eg.sendMeta(MetaMessage{
+		Type:     "event",
+		CameraID: event.CameraID,
+		Time:     time.Now().UTC(),
+		Event:    msgType,
+		Payload:  data,
+	}, nil)
+}
+
+// runMetaBus sends the PTZ positions of watched cameras as they change, and
+// every viewer its stream's health, to the meta channels
+func (eg *EdgeGateway) runMetaBus(ctx context.Context) {
+	ptzTicker := time.NewTicker(metaPTZInterval)
+	defer ptzTicker.Stop()
+	healthTicker := time.NewTicker(metaHealthInterval)
+	defer healthTicker.Stop()
+
+	positions := make(map[string]string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ptzTicker.C:
+			watched := make(map[string]bool)
+			for _, v := range eg.metaViewers() {
+				v.lock.Lock()
+				watched[v.CameraID] = true
+				for cameraID := range v.cameras {
+					watched[cameraID] = true
+				}
+				v.lock.Unlock()
+			}
+			for cameraID := range positions {
+				if !watched[cameraID] {
+					delete(positions, cameraID)
+				}
+			}
+			for cameraID := range watched {
+				position, err := eg.ptzPosition(ctx, cameraID)
+				if err != nil {
+					debugf("PTZ position of camera %s: %v", cameraID, err)
+					continue
+				}
+				if position == nil {
+					continue
+				}
+				data, _ := json.Marshal(position)
+				if positions[cameraID] == string(data) {
+					continue
+				}
+				positions[cameraID] = string(data)
+				eg.sendMeta(MetaMessage{Type: "ptz", CameraID: cameraID, Time: time.Now().UTC(), PTZ: position}, nil)
+			}
+
+		case <-healthTicker.C:
+			for _, v := range eg.metaViewers() {
+				v.lock.Lock()
+				stream, channel := v.stream, v.metaChannel
+				v.lock.Unlock()
+				health := stream.stats.health(v.CameraID)
+				viewer := v.sample(false)
+				data, err := json.Marshal(MetaMessage{
+					Type:     "health",
+					CameraID: v.CameraID,
+					Time:     time.Now().UTC(),
+					Health:   &health,
+					Viewer:   &viewer,
+				})
+				if err == nil && channel.BufferedAmount() < metaMaxBuffered {
+					channel.SendText(string(data))
+				}
+			}
+		}
+	}
+}
+
+// metaViewers returns the viewers whose meta channel is open
+func (eg *EdgeGateway) metaViewers() []*Viewer {
+	eg.viewersLock.Lock()
+	defer eg.viewersLock.Unlock()
+	var viewers []*Viewer
+	for _, v := range eg.viewers {
+		v.lock.Lock()
+		open := v.metaChannel != nil && v.metaChannel.ReadyState() == webrtc.DataChannelStateOpen
+		v.lock.Unlock()
+		if open {
+			viewers = append(viewers, v)
+		}
+	}
+	return viewers
+}
+
+// ptzPosition returns where a camera points: its digital PTZ view, or the
+// position of an Axis PTZ camera. Other cameras have none, and nil is
+// returned.
+func (eg *EdgeGateway) ptzPosition(ctx context.Context, cameraID string) (*PTZPosition, error) {
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cameraID]
+	var copied Camera
+	if exists {
+		copied = *camera
+	}
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return nil, nil
+	}
+
+	if d := eg.digitalPTZ(&copied); d != nil {
+		d.lock.Lock()
+		view := d.at(time.Now())
+		d.lock.Unlock()
+		return &PTZPosition{Digital: &view}, nil
+	}
+	vapix := copied.Capabilities == nil || copied.Capabilities.Source != "onvif"
+	if !copied.HasPTZ || !vapix || cameraAdapterFor(&copied) != nil || copied.Device != "" || copied.Generic {
+		return nil, nil
+	}
+	if eg.maintenanceAction(&copied) != "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, metaPTZInterval)
+	defer cancel()
+	resp, err := eg.httpClients.Client(&copied).Get(ctx, "/axis-cgi/com/ptz.cgi?"+ptzQuery(&copied, "query=position"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("position query returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	return parsePTZPosition(string(body)), nil
+}
+
+// parsePTZPosition reads the pan, tilt and zoom of a VAPIX position query
+func parsePTZPosition(body string) *PTZPosition {
+	position := &PTZPosition{}
+	for _, line := range strings.Split(body, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "pan":
+			position.Pan = &f
+		case "tilt":
+			position.Tilt = &f
+		case "zoom":
+			position.Zoom = &f
+		}
+	}
+	return position
+}
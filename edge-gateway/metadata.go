@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on camera metadata, which travels in every camera_status
+const (
+	metadataMaxText  = 128 // name, site, zone and each tag
+	metadataMaxNotes = 4096
+	metadataMaxTags  = 32
+)
+
+// errCameraNotFound is returned for updates to a camera that isn't known
+var errCameraNotFound = errors.New("camera not found")
+
+// CameraMetadata is what operators record about a camera: a friendly name,
+// where it is, how it is grouped, and notes for installers. Discovery never
+// changes it.
+type CameraMetadata struct {
+	Name  string   `json:"name,omitempty"`
+	Site  string   `json:"site,omitempty"`
+	Zone  string   `json:"zone,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+}
+
+// CameraMetadataUpdate changes a camera's metadata: fields left out are
+// unchanged, and an empty value or list clears one
+type CameraMetadataUpdate struct {
+	CameraID string    `json:"camera_id,omitempty"`
+	Name     *string   `json:"name,omitempty"`
+	Site     *string   `json:"site,omitempty"`
+	Zone     *string   `json:"zone,omitempty"`
+	Tags     *[]string `json:"tags,omitempty"`
+	Notes    *string   `json:"notes,omitempty"`
+}
+
+// apply validates u and returns md with it applied
+func (u CameraMetadataUpdate) apply(md CameraMetadata) (CameraMetadata, error) {
+	text := func(field string, value *string, limit int, dst *string) error {
+		if value == nil {
+			return nil
+		}
+		v := strings.TrimSpace(*value)
+		if utf8.RuneCountInString(v) > limit {
+			return fmt.Errorf("%s is longer than %d characters", field, limit)
+		}
+		*dst = v
+		return nil
+	}
+	if err := text("name", u.Name, metadataMaxText, &md.Name); err != nil {
+		return md, err
+	}
+	if err := text("site", u.Site, metadataMaxText, &md.Site); err != nil {
+		return md, err
+	}
+	if err := text("zone", u.Zone, metadataMaxText, &md.Zone); err != nil {
+		return md, err
+	}
+	if err := text("notes", u.Notes, metadataMaxNotes, &md.Notes); err != nil {
+		return md, err
+	}
+
+	if u.Tags != nil {
+		seen := make(map[string]bool)
+		tags := []string{}
+		for _, tag := range *u.Tags {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || seen[tag] {
+				continue
+			}
+			if utf8.RuneCountInString(tag) > metadataMaxText {
+				return md, fmt.Errorf("tag %q is longer than %d characters", tag, metadataMaxText)
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		if len(tags) > metadataMaxTags {
+			return md, fmt.Errorf("more than %d tags", metadataMaxTags)
+		}
+		sort.Strings(tags)
+		md.Tags = tags
+		if len(tags) == 0 {
+			md.Tags = nil
+		}
+	}
+	return md, nil
+}
+
+// setCameraMetadata updates a camera's metadata, saves the inventory and
+// reports the camera with status updated. A name replaces the camera's
+// own; clearing it leaves the current name until discovery refreshes it.
+func (eg *EdgeGateway) setCameraMetadata(u CameraMetadataUpdate) (*Camera, error) {
+	eg.camerasLock.Lock()
+	camera, exists := eg.cameras[u.CameraID]
+	if !exists {
+		eg.camerasLock.Unlock()
+		return nil, errCameraNotFound
+	}
+	var md CameraMetadata
+	if camera.Metadata != nil {
+		md = *camera.Metadata
+	}
+	md, err := u.apply(md)
+	if err != nil {
+		eg.camerasLock.Unlock()
+		return nil, err
+	}
+
+	updated := *camera
+	updated.Metadata = &md
+	if md.Name == "" && md.Site == "" && md.Zone == "" && md.Tags == nil && md.Notes == "" {
+		updated.Metadata = nil
+	}
+	if md.Name != "" {
+		updated.Name = md.Name
+	}
+	eg.cameras[camera.ID] = &updated
+	eg.saveCamerasLocked()
+	eg.camerasLock.Unlock()
+
+	log.Printf("Updated metadata of camera %s", camera.ID)
+	eg.notifyCameraStatus(&updated, "updated")
+	return &updated, nil
+}
+
+// matchesMetadata reports whether a camera is at a site and zone and has a
+// tag, each ignored when empty
+func (c *Camera) matchesMetadata(site, zone, tag string) bool {
+	var md CameraMetadata
+	if c.Metadata != nil {
+		md = *c.Metadata
+	}
+	if site != "" && md.Site != site || zone != "" && md.Zone != zone {
+		return false
+	}
+	if tag == "" {
+		return true
+	}
+	for _, t := range md.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttQueueSize bounds events waiting for the broker; more are dropped
+const mqttQueueSize = 256
+
+// mqttEvents are the cloud events mirrored to MQTT. WebRTC signalling and
+// the hello document stay between the gateway and the cloud.
+var mqttEvents = map[string]bool{
+	"camera_status":   true,
+	"camera_error":    true,
+	"scan_progress":   true,
+	"stream_health":   true,
+	"stream_profile":  true,
+	"relay_status":    true,
+	"ptz_lock":        true,
+	"clip_ready":      true,
+	"object_detected": true,
+	"io_input":        true,
+	"audio_event":     true,
+	"telemetry":       true,
+}
+
+// mqttMessage is an event waiting to be published
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// MQTTBridge mirrors camera events to an MQTT broker and accepts PTZ and
+// stream commands from it, for home-automation and SCADA systems.
+//
+// Topics, under the configured prefix:
+//
+//	status                        online/offline (retained, last will)
+//	cameras/{id}/status           camera_status payloads (retained)
+//	cameras/{id}/{event}          other events about one camera
+//	events/{event}                gateway-wide events such as scan_progress
+//	cameras/{id}/ptz/set          PTZ command: {"action": "pan_left", "speed": 0.5} or just "stop"
+//	cameras/{id}/stream/set       "start" or "stop"
+type MQTTBridge struct {
+	eg     *EdgeGateway
+	client mqtt.Client
+	prefix string
+	queue  chan mqttMessage
+}
+
+// NewMQTTBridge returns nil when no broker is configured
+func NewMQTTBridge(eg *EdgeGateway, cfg *Config) *MQTTBridge {
+	if cfg.MQTTBrokerURL == "" {
+		return nil
+	}
+
+	b := &MQTTBridge{
+		eg:     eg,
+		prefix: strings.TrimSuffix(cfg.MQTTTopicPrefix, "/"),
+		queue:  make(chan mqttMessage, mqttQueueSize),
+	}
+	if b.prefix == "" {
+		b.prefix = "edge-gateway/" + getGatewayID()
+	}
+
+	clientID := cfg.MQTTClientID
+	if clientID == "" {
+		clientID = getGatewayID()
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBrokerURL).
+		SetClientID(clientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetConnectTimeout(cfg.CloudDialTimeout).
+		SetWriteTimeout(cfg.CloudWriteTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOrderMatters(false).
+		SetWill(b.topic("status"), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		})
+	b.client = mqtt.NewClient(opts)
+	return b
+}
+
+// Run connects to the broker and publishes queued events until ctx is done
+func (b *MQTTBridge) Run(ctx context.Context) {
+	// With ConnectRetry the token only completes once connected
+	b.client.Connect()
+	defer func() {
+		if b.client.IsConnectionOpen() {
+			b.client.Publish(b.topic("status"), 1, true, "offline").WaitTimeout(time.Second)
+		}
+		b.client.Disconnect(250)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Flush what is already queued before going offline
+			for {
+				select {
+				case msg := <-b.queue:
+					b.send(msg)
+				default:
+					return
+				}
+			}
+		case msg := <-b.queue:
+			b.send(msg)
+		}
+	}
+}
+
+// send publishes a queued event if the broker is reachable
+func (b *MQTTBridge) send(msg mqttMessage) {
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+	qos := byte(0)
+	if msg.retained {
+		qos = 1
+	}
+	b.client.Publish(msg.topic, qos, msg.retained, msg.payload)
+}
+
+// onConnect announces the gateway and subscribes to command topics. It runs
+// on every reconnect, since subscriptions do not survive a clean session.
+func (b *MQTTBridge) onConnect(client mqtt.Client) {
+	log.Printf("Connected to MQTT broker, topic prefix %s", b.prefix)
+	client.Publish(b.topic("status"), 1, true, "online")
+
+	filters := map[string]byte{
+		b.topic("cameras/+/ptz/set"):    1,
+		b.topic("cameras/+/stream/set"): 1,
+	}
+	token := client.SubscribeMultiple(filters, b.handleCommand)
+	go func() {
+		if token.WaitTimeout(b.eg.cfg.CloudWriteTimeout) && token.Error() != nil {
+			log.Printf("MQTT subscribe failed: %v", token.Error())
+		}
+	}()
+}
+
+// Publish mirrors a cloud event to MQTT without blocking the caller
+func (b *MQTTBridge) Publish(msgType string, payload []byte) {
+	if !mqttEvents[msgType] {
+		return
+	}
+
+	msg := mqttMessage{topic: b.topic("events/" + msgType), payload: payload}
+	if cameraID := eventCameraID(payload); cameraID != "" {
+		if msgType == "camera_status" {
+			msg = mqttMessage{topic: b.topic("cameras/" + cameraID + "/status"), payload: payload, retained: true}
+		} else {
+			msg.topic = b.topic("cameras/" + cameraID + "/" + msgType)
+		}
+	}
+
+	select {
+	case b.queue <- msg:
+	default:
+		log.Printf("MQTT queue full, dropping %s", msgType)
+	}
+}
+
+// handleCommand dispatches a message from a command topic
+func (b *MQTTBridge) handleCommand(_ mqtt.Client, m mqtt.Message) {
+	// {prefix}/cameras/{id}/{command}/set
+	parts := strings.Split(strings.TrimPrefix(m.Topic(), b.prefix+"/"), "/")
+	if len(parts) != 4 || parts[0] != "cameras" || parts[3] != "set" {
+		return
+	}
+	cameraID, command := parts[1], parts[2]
+	payload := strings.TrimSpace(string(m.Payload()))
+
+	switch command {
+	case "ptz":
+		cmd := PTZCommand{CameraID: cameraID, Speed: 0.5}
+		if strings.HasPrefix(payload, "{") {
+			if err := json.Unmarshal([]byte(payload), &cmd); err != nil {
+				log.Printf("Invalid MQTT PTZ command for %s: %v", cameraID, err)
+				return
+			}
+			cmd.CameraID = cameraID
+		} else {
+			cmd.Action = payload
+		}
+		// MQTT is automation, which yields to operators' locks
+		cmd.Priority = ptzPriorityAutomation
+		b.eg.controlPTZ(AuditOrigin{Source: auditSourceMQTT}, cmd)
+
+	case "stream":
+		switch payload {
+		case "start":
+			err := b.eg.startStream(cameraID)
+			b.eg.audit(AuditOrigin{Source: auditSourceMQTT}, "start_stream", cameraID, nil, err)
+		case "stop":
+			b.eg.stopStream(cameraID)
+			b.eg.audit(AuditOrigin{Source: auditSourceMQTT}, "stop_stream", cameraID, nil, nil)
+		default:
+			log.Printf("Unknown MQTT stream command for %s: %q", cameraID, payload)
+		}
+	}
+}
+
+// topic returns a topic under the bridge's prefix
+func (b *MQTTBridge) topic(name string) string {
+	return b.prefix + "/" + name
+}
+
+// eventCameraID finds the camera an event is about, from either a camera_id
+// field or an embedded camera record
+func eventCameraID(payload []byte) string {
+	var event struct {
+		CameraID string `json:"camera_id"`
+		Camera   *struct {
+			ID string `json:"id"`
+		} `json:"camera"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return ""
+	}
+	if event.CameraID != "" {
+		return event.CameraID
+	}
+	if event.Camera != nil {
+		return event.Camera.ID
+	}
+	return ""
+}
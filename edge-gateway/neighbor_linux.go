@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// neighborMAC returns the MAC address the kernel's ARP table holds for an
+// IPv4 address, or empty if it has none
+func neighborMAC(ip string) string {
+	data, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	// IP address, HW type, Flags, HW address, Mask, Device
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != ip {
+			continue
+		}
+		if mac := strings.ToLower(fields[3]); mac != "00:00:00:00:00:00" {
+			return mac
+		}
+	}
+	return ""
+}
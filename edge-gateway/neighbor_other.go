@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// neighborMAC is not supported on this platform; cameras then have no MAC
+// address for the OUI lists
+func neighborMAC(ip string) string {
+	return ""
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errCredentialsRejected is returned when a camera refuses the gateway's
+// login over RTSP or VAPIX
+var errCredentialsRejected = errors.New("the camera rejected the credentials")
+
+// States of a set_credentials reported in credentials_status
+const (
+	credentialsAccepted = "accepted"
+	credentialsRejected = "rejected" // the camera refused the login
+	credentialsFailed   = "failed"   // the login couldn't be checked
+)
+
+// CredentialRequest is a camera found refusing the default credentials. It
+// isn't managed until the cloud supplies a login it accepts.
+type CredentialRequest struct {
+	CameraID  string    `json:"camera_id"`
+	IP        string    `json:"ip"`
+	Source    string    `json:"source"` // scan or mdns
+	Error     string    `json:"error"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Since     time.Time `json:"since"`
+
+	camera *Camera
+}
+
+// CredentialsUpdate is the set_credentials payload
+type CredentialsUpdate struct {
+	CameraID string `json:"camera_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// requireCredentials records a discovered camera that refused the default
+// credentials, and asks the cloud for its login with credentials_required.
+// The camera isn't probed again until the login is supplied. Addresses the
+// scan lists exclude aren't asked about.
+func (eg *EdgeGateway) requireCredentials(camera *Camera, source string, err error) {
+	if ip := net.ParseIP(camera.IP); ip == nil || !eg.scanAllowed(ip) {
+		return
+	}
+	eg.credentialRequestsLock.Lock()
+	if _, pending := eg.credentialRequests[camera.ID]; pending {
+		eg.credentialRequestsLock.Unlock()
+		return
+	}
+	req := &CredentialRequest{
+		CameraID:  camera.ID,
+		IP:        camera.IP,
+		Source:    source,
+		Error:     err.Error(),
+		ErrorCode: errorCode(err),
+		Since:     time.Now().UTC(),
+		camera:    camera,
+	}
+	eg.credentialRequests[camera.ID] = req
+	eg.credentialRequestsLock.Unlock()
+
+	log.Printf("Camera at %s refused the default credentials, waiting for its login", camera.IP)
+	eg.sendEvent("credentials_required", map[string]interface{}{
+		"camera_id":  req.CameraID,
+		"ip":         req.IP,
+		"source":     req.Source,
+		"error":      req.Error,
+		"error_code": req.ErrorCode,
+		"tenant":     eg.subnetTenant(req.IP),
+	})
+}
+
+// credentialsPending reports whether the camera at ip is waiting for its
+// login
+func (eg *EdgeGateway) credentialsPending(ip string) bool {
+	eg.credentialRequestsLock.Lock()
+	defer eg.credentialRequestsLock.Unlock()
+	for _, req := range eg.credentialRequests {
+		if req.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// listCredentialRequests returns the cameras waiting for their login, oldest
+// first
+func (eg *EdgeGateway) listCredentialRequests() []CredentialRequest {
+	eg.credentialRequestsLock.Lock()
+	defer eg.credentialRequestsLock.Unlock()
+	requests := make([]CredentialRequest, 0, len(eg.credentialRequests))
+	for _, req := range eg.credentialRequests {
+		requests = append(requests, *req)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Since.Before(requests[j].Since) })
+	return requests
+}
+
+// setCredentials checks a camera's login against its RTSP stream and, for
+// Axis cameras, VAPIX, and saves it only if the camera accepts it. A camera
+// waiting for its login is then registered as discovered. The camera's
+// previous credentials are kept if the login fails. A tenant's user may
+// only set the login of the tenant's cameras.
+func (eg *EdgeGateway) setCredentials(ctx context.Context, tenant string, u CredentialsUpdate) (err error) {
+	if u.CameraID == "" || u.Username == "" {
+		return errors.New("camera_id and username are required")
+	}
+
+	eg.credentialRequestsLock.Lock()
+	req := eg.credentialRequests[u.CameraID]
+	eg.credentialRequestsLock.Unlock()
+	var camera Camera
+	if req != nil {
+		camera = *req.camera
+	} else {
+		eg.camerasLock.RLock()
+		existing, exists := eg.cameras[u.CameraID]
+		eg.camerasLock.RUnlock()
+		if !exists {
+			return errCameraNotFound
+		}
+		if existing.Simulated || existing.Device != "" || existing.ParentID != "" {
+			return errors.New("the camera's login can't be set")
+		}
+		camera = *existing
+	}
+	owner := camera.Tenant
+	if req != nil {
+		owner = eg.subnetTenant(camera.IP)
+	}
+	if tenant != "" && tenant != owner {
+		return errTenantDenied
+	}
+
+	// Probing below needs the credentials; put back the old ones on failure
+	previous, hadPrevious := eg.credentials.Lookup(camera.ID)
+	eg.credentials.Set(camera.ID, Credentials{Username: u.Username, Password: u.Password})
+	eg.httpClients.Remove(camera.ID)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if hadPrevious {
+			eg.credentials.Set(camera.ID, previous)
+		} else {
+			eg.credentials.Delete(camera.ID)
+		}
+		eg.httpClients.Remove(camera.ID)
+	}()
+
+	if camera.RTSPUrl == "" {
+		err = eg.detectRTSPProfile(ctx, &camera)
+	} else {
+		err = probeRTSP(ctx, eg.credentials.URL(camera.ID, camera.RTSPUrl), cameraTLSConfig(eg.cfg, &camera), eg.cfg.RTSPDialTimeout)
+		if isRTSPAuthError(err) {
+			err = errCredentialsRejected
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("RTSP: %w", err)
+	}
+	if camera.Vendor == "axis" && !camera.Generic {
+		if err := eg.checkVAPIXLogin(ctx, &camera); err != nil {
+			return fmt.Errorf("VAPIX: %w", err)
+		}
+	}
+
+	if req == nil {
+		log.Printf("Updated the login of camera %s", camera.ID)
+		return nil
+	}
+	eg.probeCapabilities(ctx, &camera)
+	if !eg.admitCamera(&camera) || !eg.registerCamera(&camera) {
+		return errors.New("the camera is excluded by the discovery policy")
+	}
+	eg.credentialRequestsLock.Lock()
+	delete(eg.credentialRequests, camera.ID)
+	eg.credentialRequestsLock.Unlock()
+	log.Printf("Camera at %s accepted its login, registered as %s", camera.IP, camera.ID)
+	eg.notifyCameraStatus(&camera, "discovered")
+	eg.registerChannels(ctx, &camera, "discovered")
+	return nil
+}
+
+// checkVAPIXLogin checks that the camera accepts its login for VAPIX.
+// Cameras that don't serve VAPIX pass.
+func (eg *EdgeGateway) checkVAPIXLogin(ctx context.Context, camera *Camera) error {
+	resp, err := eg.httpClients.Client(camera).Get(ctx, "/axis-cgi/param.cgi?action=list&group=Brand")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errCredentialsRejected
+	default:
+		return fmt.Errorf("param.cgi returned status %d", resp.StatusCode)
+	}
+}
+
+// reportCredentials sends the outcome of a set_credentials
+func (eg *EdgeGateway) reportCredentials(cameraID string, err error) {
+	payload := map[string]interface{}{
+		"camera_id": cameraID,
+		"state":     credentialsAccepted,
+	}
+	if err != nil {
+		log.Printf("Login for camera %s not saved: %v", cameraID, err)
+		payload["state"] = credentialsFailed
+		if errors.Is(err, errCredentialsRejected) {
+			payload["state"] = credentialsRejected
+		}
+		addError(payload, err)
+	}
+	eg.sendEvent("credentials_status", payload)
+}
+
+// initialPasswordLength is the length of the root passwords set on
+// factory-new Axis cameras
+const initialPasswordLength = 24
+
+// initializeCamera gives a factory-new Axis camera, which streams nothing
+// until its root password is set, a generated one and saves it as the
+// camera's credentials. It reports whether the camera was initialized.
+// Cameras of a cluster are initialized by the member that owns them.
+func (eg *EdgeGateway) initializeCamera(ctx context.Context, camera *Camera) bool {
+	if !eg.cfg.AxisInitialize || !eg.clusterOwns(camera.ID) {
+		return false
+	}
+	client := eg.httpClients.Client(camera)
+	if !axisUninitialized(ctx, client) {
+		return false
+	}
+	password, err := generatePassword(initialPasswordLength)
+	if err != nil {
+		log.Printf("Failed to generate a password for camera at %s: %v", camera.IP, err)
+		return false
+	}
+
+	// Saved first, so the password isn't lost if the gateway stops before
+	// the camera answers
+	previous, hadPrevious := eg.credentials.Lookup(camera.ID)
+	eg.credentials.Set(camera.ID, Credentials{Username: "root", Password: password})
+	if err := vapixAddRoot(ctx, client, password); err != nil {
+		log.Printf("Failed to initialize camera at %s: %v", camera.IP, err)
+		// The camera may have taken the password before failing to answer
+		if !axisUninitialized(ctx, client) {
+			return false
+		}
+		if hadPrevious {
+			eg.credentials.Set(camera.ID, previous)
+		} else {
+			eg.credentials.Delete(camera.ID)
+		}
+		return false
+	}
+	eg.httpClients.Remove(camera.ID)
+	log.Printf("Initialized factory-new camera at %s with a generated root password", camera.IP)
+	return true
+}
+
+// axisUninitialized reports whether a camera answers for its users without
+// a login, as Axis cameras do only until the root password is set
+func axisUninitialized(ctx context.Context, client *CameraHTTPClient) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.url("/axis-cgi/pwdgrp.cgi?action=get"), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.DoAnonymous(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// vapixAddRoot creates the root account of a factory-new Axis camera
+func vapixAddRoot(ctx context.Context, client *CameraHTTPClient, password string) error {
+	query := url.Values{
+		"action": {"add"},
+		"user":   {"root"},
+		"pwd":    {password},
+		"grp":    {"root"},
+		"sgrp":   {"admin:operator:viewer:ptz"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.url("/axis-cgi/pwdgrp.cgi?"+query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.DoAnonymous(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Created account") {
+		return fmt.Errorf("pwdgrp.cgi returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// generatePassword returns a random alphanumeric password, which every
+// camera accepts without escaping
+func generatePassword(length int) (string, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// onvifMediaPaths are the media service endpoints tried in order
+var onvifMediaPaths = []string{"/onvif/media_service", "/onvif/Media", "/onvif/media"}
+
+// onvifDevicePaths are the device service endpoints tried in order
+var onvifDevicePaths = []string{"/onvif/device_service", "/onvif/Device", "/onvif/device"}
+
+const soapEnvelope = `<?xml version="1.0" encoding="UTF-8"?>` +
+	`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope">` +
+	`<s:Header>%s</s:Header><s:Body>%s</s:Body></s:Envelope>`
+
+// onvifCall sends a SOAP request to an ONVIF service on the camera and
+// decodes the response body into out
+func onvifCall(ctx context.Context, client *CameraHTTPClient, path, body string, out interface{}) error {
+	return onvifRequest(ctx, client, path, "", body, out)
+}
+
+// onvifRequest is onvifCall with extra SOAP header elements, such as the
+// WS-Addressing ones of an event subscription
+func onvifRequest(ctx context.Context, client *CameraHTTPClient, path, header, body string, out interface{}) error {
+	creds := client.login()
+	envelope := fmt.Sprintf(soapEnvelope, onvifSecurityHeader(creds.Username, creds.Password)+header, body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.url(path), bytes.NewReader([]byte(envelope)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ONVIF %s returned status %d", path, resp.StatusCode)
+	}
+
+	var envelopeResp struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(data, &envelopeResp); err != nil {
+		return fmt.Errorf("invalid ONVIF response: %v", err)
+	}
+	// Decode with Body as the root, so out's paths start at the response
+	// element, e.g. GetProfilesResponse>Profiles
+	inner := append(append([]byte("<Body>"), envelopeResp.Body.Inner...), "</Body>"...)
+	return xml.Unmarshal(inner, out)
+}
+
+// onvifSecurityHeader builds a WS-Security UsernameToken with a password digest
+func onvifSecurityHeader(username, password string) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(password))
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	return fmt.Sprintf(`<Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">`+
+		`<UsernameToken><Username>%s</Username>`+
+		`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">%s</Password>`+
+		`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">%s</Nonce>`+
+		`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%s</Created>`+
+		`</UsernameToken></Security>`,
+		xmlEscape(username), digest, base64.StdEncoding.EncodeToString(nonce), created)
+}
+
+// onvifStreamURI asks the camera's ONVIF media service for the RTSP URI of
+// its first media profile
+func onvifStreamURI(ctx context.Context, client *CameraHTTPClient) (string, error) {
+	var lastErr error
+	for _, path := range onvifMediaPaths {
+		var profiles struct {
+			Profiles []struct {
+				Token string `xml:"token,attr"`
+			} `xml:"GetProfilesResponse>Profiles"`
+		}
+		err := onvifCall(ctx, client, path,
+			`<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &profiles)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(profiles.Profiles) == 0 {
+			return "", errors.New("camera reported no ONVIF media profiles")
+		}
+
+		var streamURI struct {
+			URI string `xml:"GetStreamUriResponse>MediaUri>Uri"`
+		}
+		err = onvifCall(ctx, client, path, fmt.Sprintf(
+			`<GetStreamUri xmlns="http://www.onvif.org/ver10/media/wsdl">`+
+				`<StreamSetup><Stream xmlns="http://www.onvif.org/ver10/schema">RTP-Unicast</Stream>`+
+				`<Transport xmlns="http://www.onvif.org/ver10/schema"><Protocol>RTSP</Protocol></Transport></StreamSetup>`+
+				`<ProfileToken>%s</ProfileToken></GetStreamUri>`, xmlEscape(profiles.Profiles[0].Token)), &streamURI)
+		if err != nil {
+			return "", err
+		}
+		if streamURI.URI == "" {
+			return "", errors.New("camera returned an empty ONVIF stream URI")
+		}
+		return strings.TrimSpace(streamURI.URI), nil
+	}
+	return "", fmt.Errorf("ONVIF media service not available: %v", lastErr)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// outboxSkipped are messages not worth delivering late: keepalives, the
+// hello and session_resume documents (sent fresh on every connect), and
+// WebRTC signalling for offers the cloud has long given up on
+var outboxSkipped = map[string]bool{
+	"ping":           true,
+	"hello":          true,
+	"session_resume": true,
+	// Only meaningful to the session that was shutting down
+	"gateway_shutdown":   true,
+	"webrtc_closed":      true,
+	"webrtc_answer":      true,
+	"webrtc_restart":     true,
+	"webrtc_renegotiate": true,
+	"ice_candidate":      true,
+}
+
+// outboxLatestOnly are periodic reports where only the newest one matters
+var outboxLatestOnly = map[string]bool{
+	"stream_health": true,
+	"webrtc_stats":  true,
+	"scan_progress": true,
+	"telemetry":     true,
+}
+
+// outboxEvent is a queued message and the event_id it carries, as a line of
+// the outbox journal
+type outboxEvent struct {
+	ID      string    `json:"id"`
+	Message WSMessage `json:"message"`
+}
+
+// outboxAck is the line of the outbox journal that forgets events the cloud
+// acknowledged
+type outboxAck struct {
+	Acked []string `json:"acked"`
+}
+
+// Outbox holds events raised while the cloud is unreachable, in order, for
+// delivery on reconnect. When full the oldest events are dropped. Queued
+// events carry an event_id, the same on every delivery, so the cloud can
+// drop the ones it already has. Each is appended to a journal in the data
+// directory as it is queued, so neither a restart nor a crash during an
+// outage loses them.
+//
+// With acks, events are also kept once sent, until the cloud acknowledges
+// them with events_ack, and those still unacknowledged are sent again on
+// reconnect. An acknowledgement is appended to the journal too; it is only
+// rewritten once it holds twice as many lines as the limit. Without acks,
+// drained events stay in the journal until they have all been sent.
+type Outbox struct {
+	lock     sync.Mutex
+	unacked  []outboxEvent // sent, waiting for events_ack or, without acks, for Delivered
+	messages []outboxEvent // waiting to be sent
+	limit    int
+	dropped  int
+	acks     bool
+
+	path      string
+	journal   *os.File
+	journaled int // lines in the journal, events and acknowledgements
+	idPrefix  string
+	idSeq     uint64
+}
+
+func NewOutbox(cfg *Config) *Outbox {
+	prefix := make([]byte, 6)
+	rand.Read(prefix)
+	return &Outbox{
+		limit:    cfg.OfflineQueueSize,
+		acks:     cfg.OfflineQueueAcks,
+		path:     filepath.Join(cfg.DataDir, "outbox.jsonl"),
+		idPrefix: hex.EncodeToString(prefix),
+	}
+}
+
+// Add queues a message, unless it isn't worth delivering late
+func (o *Outbox) Add(msg WSMessage) {
+	if outboxSkipped[msg.Type] || o.limit <= 0 {
+		return
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	event, ok := o.stamp(msg)
+	if !ok {
+		return
+	}
+	o.queue(event)
+	o.appendJournal(event)
+}
+
+// Tracks reports whether a message sent while connected is kept until the
+// cloud acknowledges it. Periodic reports aren't; the next one replaces
+// them.
+func (o *Outbox) Tracks(msg WSMessage) bool {
+	return o.acks && o.limit > 0 && !outboxSkipped[msg.Type] && !outboxLatestOnly[msg.Type]
+}
+
+// Sent keeps a message that is about to be sent until the cloud
+// acknowledges it, and returns it with its event_id
+func (o *Outbox) Sent(msg WSMessage) WSMessage {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	event, ok := o.stamp(msg)
+	if !ok {
+		return msg
+	}
+	o.unacked = append(o.unacked, event)
+	o.trim()
+	o.appendJournal(event)
+	return event.Message
+}
+
+// Ack forgets the acknowledged events
+func (o *Outbox) Ack(ids []string) int {
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	unacked := o.unacked[:0]
+	var removed []string
+	for _, event := range o.unacked {
+		if acked[event.ID] {
+			removed = append(removed, event.ID)
+		} else {
+			unacked = append(unacked, event)
+		}
+	}
+	clear(o.unacked[len(unacked):])
+	o.unacked = unacked
+	switch {
+	case len(removed) == 0:
+	case len(o.unacked)+len(o.messages) == 0:
+		// Nothing left to rewrite; the journal is just removed
+		o.compact()
+	default:
+		o.appendJournal(outboxAck{Acked: removed})
+	}
+	return len(removed)
+}
+
+// Drain returns the events to deliver, those still unacknowledged first,
+// and how many were dropped since the last drain. They are kept, and
+// journaled, until acknowledged or, without acks, until Delivered.
+func (o *Outbox) Drain() ([]WSMessage, int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	pending := append(o.unacked, o.messages...)
+	messages := make([]WSMessage, len(pending))
+	for i, event := range pending {
+		messages[i] = event.Message
+	}
+	dropped := o.dropped
+	o.messages, o.dropped = nil, 0
+	o.unacked = pending
+	return messages, dropped
+}
+
+// Delivered forgets the drained events once they have all been sent, unless
+// they are kept until acknowledged
+func (o *Outbox) Delivered() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.acks || len(o.unacked) == 0 {
+		return
+	}
+	clear(o.unacked)
+	o.unacked = nil
+	o.compact()
+}
+
+// Requeue puts undelivered messages back ahead of anything queued since,
+// forgetting the drained ones that were sent. With acks they are all kept
+// until acknowledged.
+func (o *Outbox) Requeue(messages []WSMessage) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.acks {
+		return
+	}
+	o.unacked = nil
+	requeued := make([]outboxEvent, 0, len(messages))
+	for _, msg := range messages {
+		if event, ok := o.stamp(msg); ok {
+			requeued = append(requeued, event)
+		}
+	}
+	o.messages = append(requeued, o.messages...)
+	o.trim()
+	o.compact()
+}
+
+// Len returns the number of events not yet delivered, or with acks not yet
+// acknowledged
+func (o *Outbox) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.unacked) + len(o.messages)
+}
+
+// stamp gives a message the next event_id, or returns the one it has. A
+// message whose payload isn't a JSON object can't carry one and isn't
+// queued. The caller holds lock.
+func (o *Outbox) stamp(msg WSMessage) (outboxEvent, bool) {
+	var payload struct {
+		EventID string `json:"event_id"`
+	}
+	data := bytes.TrimSpace(msg.Payload)
+	if len(data) == 0 || string(data) == "null" {
+		data = []byte("{}")
+	}
+	if data[0] != '{' || json.Unmarshal(data, &payload) != nil {
+		log.Printf("Not queueing %s for the cloud: payload isn't an object", msg.Type)
+		return outboxEvent{}, false
+	}
+	if payload.EventID != "" {
+		return outboxEvent{ID: payload.EventID, Message: msg}, true
+	}
+
+	o.idSeq++
+	id := fmt.Sprintf("%s-%d", o.idPrefix, o.idSeq)
+	field := `"event_id":` + fmt.Sprintf("%q", id)
+	rest := bytes.TrimSpace(data[1:])
+	if rest[0] != '}' {
+		field += ","
+	}
+	stamped := append([]byte("{"+field), rest...)
+	return outboxEvent{ID: id, Message: WSMessage{Type: msg.Type, Payload: stamped}}, true
+}
+
+// queue adds an event behind the others, replacing the previous report of
+// a periodic type. The caller holds lock.
+func (o *Outbox) queue(event outboxEvent) {
+	if outboxLatestOnly[event.Message.Type] {
+		for i, queued := range o.messages {
+			if queued.Message.Type == event.Message.Type {
+				o.messages = append(o.messages[:i], o.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	o.messages = append(o.messages, event)
+	o.trim()
+}
+
+// trim drops the oldest events over the limit, unacknowledged ones first.
+// The caller holds lock.
+func (o *Outbox) trim() {
+	over := len(o.unacked) + len(o.messages) - o.limit
+	if over <= 0 {
+		return
+	}
+	o.dropped += over
+	n := min(over, len(o.unacked))
+	o.unacked = append([]outboxEvent(nil), o.unacked[n:]...)
+	o.messages = append([]outboxEvent(nil), o.messages[over-n:]...)
+}
+
+// appendJournal writes an event or acknowledgement to the journal,
+// rewriting it instead once it holds mostly replaced reports and forgotten
+// events. The caller holds lock.
+func (o *Outbox) appendJournal(line interface{}) {
+	if o.journaled >= 2*o.limit {
+		o.compact()
+		return
+	}
+	if o.journal == nil {
+		f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("Failed to open outbox journal: %v", err)
+			return
+		}
+		o.journal = f
+	}
+	data, _ := json.Marshal(line)
+	if _, err := o.journal.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write outbox journal: %v", err)
+		return
+	}
+	o.journaled++
+}
+
+// compact rewrites the journal with the events held, or removes it if there
+// are none. The caller holds lock.
+func (o *Outbox) compact() {
+	if o.journal != nil {
+		o.journal.Close()
+		o.journal = nil
+	}
+	o.journaled = 0
+	events := append(append([]outboxEvent(nil), o.unacked...), o.messages...)
+	if len(events) == 0 {
+		os.Remove(o.path)
+		return
+	}
+	var data []byte
+	for _, event := range events {
+		line, _ := json.Marshal(event)
+		data = append(append(data, line...), '\n')
+	}
+	if err := writeFileAtomic(o.path, data); err != nil {
+		log.Printf("Failed to save outbox: %v", err)
+		return
+	}
+	o.journaled = len(events)
+}
+
+// deliverOutbox sends the events queued while offline, and with acks those
+// not yet acknowledged. The caller holds cloudLock with cloudConn set.
+func (eg *EdgeGateway) deliverOutbox() {
+	messages, dropped := eg.outbox.Drain()
+	if dropped > 0 {
+		log.Printf("Dropped %d cloud events while offline, queue full", dropped)
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	log.Printf("Delivering %d cloud events queued while offline", len(messages))
+	for i, msg := range messages {
+		if err := eg.cloudConn.Send(msg); err != nil {
+			log.Printf("Failed to deliver queued events: %v", err)
+			eg.outbox.Requeue(messages[i:])
+			return
+		}
+	}
+	eg.outbox.Delivered()
+}
+
+// Load restores events journaled by a previous run. With acks, events that
+// were sent but not acknowledged are delivered again.
+func (o *Outbox) Load() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.limit <= 0 {
+		return
+	}
+
+	if f, err := os.Open(o.path); err == nil {
+		decoder := json.NewDecoder(f)
+		for {
+			var line struct {
+				outboxEvent
+				outboxAck
+			}
+			if err := decoder.Decode(&line); err != nil {
+				// A crash can leave the last line half written
+				if err != io.EOF {
+					log.Printf("Outbox journal truncated: %v", err)
+				}
+				break
+			}
+			if line.ID != "" {
+				o.queue(line.outboxEvent)
+			}
+			if len(line.Acked) > 0 {
+				o.forget(line.Acked)
+			}
+		}
+		f.Close()
+	}
+
+	o.compact()
+	if len(o.messages) > 0 {
+		log.Printf("Restored %d undelivered cloud events", len(o.messages))
+	}
+}
+
+// forget drops journaled events that were acknowledged later on. The
+// caller holds lock.
+func (o *Outbox) forget(ids []string) {
+	o.messages = slices.DeleteFunc(o.messages, func(event outboxEvent) bool {
+		return slices.Contains(ids, event.ID)
+	})
+}
+
+// Close closes the journal on shutdown, rewriting it without replaced
+// reports
+func (o *Outbox) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.compact()
+}
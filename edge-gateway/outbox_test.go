@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func testOutbox(dir string, limit int, acks bool) *Outbox {
+	return NewOutbox(&Config{DataDir: dir, OfflineQueueSize: limit, OfflineQueueAcks: acks})
+}
+
+func outboxMessage(msgType string, seq int) WSMessage {
+	return WSMessage{Type: msgType, Payload: json.RawMessage(fmt.Sprintf(`{"seq":%d}`, seq))}
+}
+
+// outboxSummary describes messages as type:seq, with whether each carries
+// an event_id
+func outboxSummary(t *testing.T, messages []WSMessage) []string {
+	t.Helper()
+	var summary []string
+	for _, msg := range messages {
+		var payload struct {
+			EventID string `json:"event_id"`
+			Seq     int    `json:"seq"`
+		}
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.EventID == "" {
+			t.Errorf("%s %d has no event_id", msg.Type, payload.Seq)
+		}
+		summary = append(summary, fmt.Sprintf("%s:%d", msg.Type, payload.Seq))
+	}
+	return summary
+}
+
+func journalLines(t *testing.T, dir string) int {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "outbox.jsonl"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestOutboxReplay(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		acks  bool
+		// run queues events and returns without closing, as a crash would
+		run  func(o *Outbox)
+		want []string
+	}{
+		{
+			name:  "queued in order",
+			limit: 10,
+			run: func(o *Outbox) {
+				for i := 1; i <= 3; i++ {
+					o.Add(outboxMessage("camera_event", i))
+				}
+			},
+			want: []string{"camera_event:1", "camera_event:2", "camera_event:3"},
+		},
+		{
+			name:  "latest report only",
+			limit: 10,
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("telemetry", 1))
+				o.Add(outboxMessage("camera_event", 1))
+				o.Add(outboxMessage("telemetry", 2))
+			},
+			want: []string{"camera_event:1", "telemetry:2"},
+		},
+		{
+			name:  "skipped types",
+			limit: 10,
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("ping", 1))
+				o.Add(outboxMessage("ice_candidate", 1))
+				o.Add(outboxMessage("camera_event", 1))
+			},
+			want: []string{"camera_event:1"},
+		},
+		{
+			name:  "oldest dropped when full",
+			limit: 2,
+			run: func(o *Outbox) {
+				for i := 1; i <= 4; i++ {
+					o.Add(outboxMessage("camera_event", i))
+				}
+			},
+			want: []string{"camera_event:3", "camera_event:4"},
+		},
+		{
+			name:  "crash while delivering",
+			limit: 10,
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("camera_event", 1))
+				o.Add(outboxMessage("camera_event", 2))
+				o.Drain()
+			},
+			want: []string{"camera_event:1", "camera_event:2"},
+		},
+		{
+			name:  "delivered",
+			limit: 10,
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("camera_event", 1))
+				o.Drain()
+				o.Delivered()
+				o.Add(outboxMessage("camera_event", 2))
+			},
+			want: []string{"camera_event:2"},
+		},
+		{
+			name:  "unsent requeued",
+			limit: 10,
+			run: func(o *Outbox) {
+				for i := 1; i <= 3; i++ {
+					o.Add(outboxMessage("camera_event", i))
+				}
+				messages, _ := o.Drain()
+				o.Add(outboxMessage("camera_event", 4))
+				o.Requeue(messages[1:])
+			},
+			want: []string{"camera_event:2", "camera_event:3", "camera_event:4"},
+		},
+		{
+			name:  "unacknowledged sent again",
+			limit: 10,
+			acks:  true,
+			run: func(o *Outbox) {
+				first := o.Sent(outboxMessage("camera_event", 1))
+				o.Sent(outboxMessage("camera_event", 2))
+				o.Add(outboxMessage("camera_event", 3))
+				var payload struct {
+					EventID string `json:"event_id"`
+				}
+				json.Unmarshal(first.Payload, &payload)
+				o.Ack([]string{payload.EventID, "unknown"})
+			},
+			want: []string{"camera_event:2", "camera_event:3"},
+		},
+		{
+			name:  "drained kept until acknowledged",
+			limit: 10,
+			acks:  true,
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("camera_event", 1))
+				o.Drain()
+				o.Delivered()
+			},
+			want: []string{"camera_event:1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			before := testOutbox(dir, tt.limit, tt.acks)
+			tt.run(before)
+			pending, _ := before.Drain()
+			before.journal.Close()
+
+			after := testOutbox(dir, tt.limit, tt.acks)
+			after.Load()
+			replayed, _ := after.Drain()
+			if got := outboxSummary(t, replayed); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+			// The same event_ids, so the cloud can drop duplicates
+			if !slices.EqualFunc(pending, replayed, func(a, b WSMessage) bool {
+				return bytes.Equal(a.Payload, b.Payload)
+			}) {
+				t.Errorf("replayed %s, want %s", replayed, pending)
+			}
+		})
+	}
+}
+
+func TestOutboxTruncatedJournal(t *testing.T) {
+	dir := t.TempDir()
+	o := testOutbox(dir, 10, false)
+	o.Add(outboxMessage("camera_event", 1))
+	o.Add(outboxMessage("camera_event", 2))
+	o.journal.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, "outbox.jsonl"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"x-3","message":{"type":"camera_ev`)
+	f.Close()
+
+	replayed := testOutbox(dir, 10, false)
+	replayed.Load()
+	messages, _ := replayed.Drain()
+	want := []string{"camera_event:1", "camera_event:2"}
+	if got := outboxSummary(t, messages); !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if n := journalLines(t, dir); n != 2 {
+		t.Errorf("journal has %d lines after loading, want the 2 whole events", n)
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		acks     bool
+		run      func(o *Outbox)
+		minLines int
+		maxLines int
+	}{
+		{
+			name: "replaced reports",
+			run: func(o *Outbox) {
+				for i := 0; i < 20; i++ {
+					o.Add(outboxMessage("telemetry", i))
+				}
+			},
+			// Rewritten once it reaches twice the limit
+			maxLines: 8,
+		},
+		{
+			name: "delivered",
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("camera_event", 1))
+				o.Add(outboxMessage("camera_event", 2))
+				o.Drain()
+				o.Delivered()
+			},
+			maxLines: 0,
+		},
+		{
+			name: "requeued",
+			run: func(o *Outbox) {
+				o.Add(outboxMessage("camera_event", 1))
+				o.Add(outboxMessage("camera_event", 2))
+				messages, _ := o.Drain()
+				o.Requeue(messages[1:])
+			},
+			maxLines: 1,
+		},
+		{
+			name: "acknowledged",
+			acks: true,
+			run: func(o *Outbox) {
+				var ids []string
+				for i := 0; i < 3; i++ {
+					msg := o.Sent(outboxMessage("camera_event", i))
+					var payload struct {
+						EventID string `json:"event_id"`
+					}
+					json.Unmarshal(msg.Payload, &payload)
+					ids = append(ids, payload.EventID)
+				}
+				o.Ack(ids)
+			},
+			maxLines: 0,
+		},
+		{
+			name: "acknowledged in part",
+			acks: true,
+			run: func(o *Outbox) {
+				var ids []string
+				for i := 0; i < 3; i++ {
+					msg := o.Sent(outboxMessage("camera_event", i))
+					var payload struct {
+						EventID string `json:"event_id"`
+					}
+					json.Unmarshal(msg.Payload, &payload)
+					ids = append(ids, payload.EventID)
+				}
+				o.Ack(ids[:1])
+				o.Ack(ids[1:2])
+			},
+			// Appended, not rewritten
+			minLines: 5,
+			maxLines: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o := testOutbox(dir, 4, tt.acks)
+			tt.run(o)
+			if n := journalLines(t, dir); n < tt.minLines || n > tt.maxLines {
+				t.Errorf("journal has %d lines, want %d to %d", n, tt.minLines, tt.maxLines)
+			}
+			o.Close()
+			if n, want := journalLines(t, dir), o.Len(); n != want {
+				t.Errorf("journal has %d lines after closing, want one per held event, %d", n, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Overlay positions
+const (
+	overlayTopLeft     = "top_left"
+	overlayTopRight    = "top_right"
+	overlayBottomLeft  = "bottom_left"
+	overlayBottomRight = "bottom_right"
+)
+
+// defaultOverlayTimeFormat is the strftime format of overlay timestamps
+const defaultOverlayTimeFormat = "%Y-%m-%d %H:%M:%S"
+
+// OverlayConfig is the on-screen display burned into a camera's video for
+// evidentiary use: the time, and optionally the camera's name and the
+// gateway's ID, in one corner of the frame
+type OverlayConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Position   string `json:"position,omitempty"`    // top_left, top_right, bottom_left or bottom_right
+	TimeFormat string `json:"time_format,omitempty"` // strftime
+	UTC        bool   `json:"utc,omitempty"`         // instead of the gateway's local time
+	CameraName bool   `json:"camera_name,omitempty"`
+	GatewayID  bool   `json:"gateway_id,omitempty"`
+	FontSize   int    `json:"font_size,omitempty"`
+}
+
+// validate checks an overlay, filling in the defaults of fields left empty
+func (o *OverlayConfig) validate(field string) error {
+	switch o.Position {
+	case "":
+		o.Position = overlayTopLeft
+	case overlayTopLeft, overlayTopRight, overlayBottomLeft, overlayBottomRight:
+	default:
+		return fmt.Errorf("invalid %s position %q", field, o.Position)
+	}
+	if o.TimeFormat == "" {
+		o.TimeFormat = defaultOverlayTimeFormat
+	}
+	// ffmpeg's filter syntax leaves little else safe to pass through
+	for _, r := range o.TimeFormat {
+		if !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || strings.ContainsRune(" %:./_-", r)) {
+			return fmt.Errorf("invalid %s time_format %q", field, o.TimeFormat)
+		}
+	}
+	if o.FontSize == 0 {
+		o.FontSize = 24
+	}
+	if o.FontSize < 8 || o.FontSize > 128 {
+		return fmt.Errorf("invalid %s font_size %d", field, o.FontSize)
+	}
+	return nil
+}
+
+// overlayFor returns the overlay of a camera: its own if it has one,
+// otherwise the default
+func (s Settings) overlayFor(cameraID string) OverlayConfig {
+	if o, ok := s.CameraOverlays[cameraID]; ok {
+		return o
+	}
+	return s.Overlay
+}
+
+// filter is the ffmpeg drawtext filter drawing the overlay on a camera's
+// video, or empty if it is off
+func (o OverlayConfig) filter(cameraName, gatewayID string) string {
+	if !o.Enabled {
+		return ""
+	}
+	clock := "localtime"
+	if o.UTC {
+		clock = "gmtime"
+	}
+	text := fmt.Sprintf(`%%{%s\:%s}`, clock, strings.ReplaceAll(o.TimeFormat, ":", `\\\:`))
+	if o.UTC {
+		text += " UTC"
+	}
+	var labels []string
+	if o.CameraName {
+		labels = append(labels, overlayText(cameraName))
+	}
+	if o.GatewayID {
+		labels = append(labels, overlayText(gatewayID))
+	}
+	for _, label := range labels {
+		if label != "" {
+			text += "  " + label
+		}
+	}
+
+	x, y := "8", "8"
+	if o.Position == overlayTopRight || o.Position == overlayBottomRight {
+		x = "w-tw-8"
+	}
+	if o.Position == overlayBottomLeft || o.Position == overlayBottomRight {
+		y = "h-th-8"
+	}
+	return fmt.Sprintf("drawtext=text='%s':x=%s:y=%s:fontsize=%d:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=4",
+		text, x, y, o.FontSize)
+}
+
+// overlayText makes a name safe to draw, keeping letters, digits, spaces
+// and a few punctuation marks and dropping the rest
+func overlayText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" ._#()/@-", r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune(' ')
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// overlayFilter is the overlay filter for a camera's next transcoder
+// session, or empty if it has none
+func (eg *EdgeGateway) overlayFilter(cameraID string) string {
+	overlay := eg.settings().overlayFor(cameraID)
+	if !overlay.Enabled {
+		return ""
+	}
+	eg.camerasLock.RLock()
+	name := cameraID
+	if camera, ok := eg.cameras[cameraID]; ok && camera.Name != "" {
+		name = camera.Name
+	}
+	eg.camerasLock.RUnlock()
+	return overlay.filter(name, getGatewayID())
+}
+
+// restartOverlaid restarts the ingest of the streams of cameras whose
+// overlay changed between two settings
+func (eg *EdgeGateway) restartOverlaid(previous, current Settings) {
+	eg.streamsLock.RLock()
+	defer eg.streamsLock.RUnlock()
+	for _, stream := range eg.streams {
+		if previous.overlayFor(stream.camera.ID) != current.overlayFor(stream.camera.ID) {
+			stream.restartIngest()
+		}
+	}
+}
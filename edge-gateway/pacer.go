@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtp"
+)
+
+// Pacing
+const (
+	pacingInterval = 5 * time.Millisecond
+	pacingFactor   = 2.5 // of the target bitrate, as libwebrtc paces
+	bweMinBitrate  = 100_000
+)
+
+// congestionControl returns the interceptor that estimates each peer
+// connection's bandwidth from the viewer's TWCC feedback, Google Congestion
+// Control as browsers do, and paces its RTP at the estimate
+func (eg *EdgeGateway) congestionControl() (*cc.InterceptorFactory, error) {
+	start, maxDelay := eg.cfg.BWEStartKbps*1000, eg.cfg.PacerMaxDelay
+	return cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(start),
+			gcc.SendSideBWEMinBitrate(bweMinBitrate),
+			gcc.SendSideBWEMaxBitrate(eg.cfg.BWEMaxKbps*1000),
+			gcc.SendSideBWEPacer(newMediaPacer(start, maxDelay)),
+		)
+	})
+}
+
+// pacedPacket is an RTP packet waiting in a mediaPacer
+type pacedPacket struct {
+	header     rtp.Header
+	payload    *[]byte // from pacerBuffers
+	attributes interceptor.Attributes
+}
+
+// pacerBuffers holds the payload copies of queued packets, shared by every
+// pacer so a viewer's queue costs no allocation once warm
+var pacerBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, rtpMTU+16)
+		return &buf
+	},
+}
+
+// mediaPacer sends a peer connection's RTP at its bandwidth estimate
+// rather than in the bursts frames are packetized in. A keyframe is tens of
+// packets written at once, whose tail consumer routers with shallow buffers
+// drop. Should the queue take longer than maxDelay to drain at the estimate
+// it is sent faster, so a lagging estimate delays video by at most that.
+// It implements gcc.Pacer.
+type mediaPacer struct {
+	maxDelay time.Duration
+	done     chan struct{}
+	close    sync.Once
+	wake     chan struct{} // when the queue stops being empty
+
+	lock    sync.Mutex
+	rate    float64 // bit/s
+	writers map[uint32]interceptor.RTPWriter
+	queue   []pacedPacket
+	bytes   int // queued
+}
+
+func newMediaPacer(initialBitrate int, maxDelay time.Duration) *mediaPacer {
+	p := &mediaPacer{
+		maxDelay: maxDelay,
+		done:     make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+		rate:     pacingFactor * float64(initialBitrate),
+		writers:  make(map[uint32]interceptor.RTPWriter),
+	}
+	go p.run()
+	return p
+}
+
+// AddStream registers the writer of the stream with the SSRC
+func (p *mediaPacer) AddStream(ssrc uint32, writer interceptor.RTPWriter) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.writers[ssrc] = writer
+}
+
+// SetTargetBitrate sets the bandwidth estimate in bit/s
+func (p *mediaPacer) SetTargetBitrate(bitrate int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rate = pacingFactor * float64(bitrate)
+}
+
+// Write queues a packet. The NACK responder releases a retransmission's
+// buffer as soon as Write returns, and tracks share a header between
+// viewers, so it keeps a copy of both; the payload's in a pooled buffer.
+func (p *mediaPacer) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	select {
+	case <-p.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	buf := pacerBuffers.Get().(*[]byte)
+	*buf = append((*buf)[:0], payload...)
+	packet := pacedPacket{
+		header:     header.Clone(),
+		payload:    buf,
+		attributes: attributes,
+	}
+	p.lock.Lock()
+	idle := len(p.queue) == 0
+	p.queue = append(p.queue, packet)
+	p.bytes += len(payload)
+	p.lock.Unlock()
+	if idle {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+	return header.MarshalSize() + len(payload), nil
+}
+
+// run sends queued packets every pacingInterval, as many as the rate
+// allows since the last. It only ticks while there is something queued.
+func (p *mediaPacer) run() {
+	ticker := time.NewTicker(pacingInterval)
+	ticker.Stop()
+	defer ticker.Stop()
+	var budget float64 // bytes
+	var last time.Time
+	for {
+		var now time.Time
+		select {
+		case <-p.done:
+			p.lock.Lock()
+			for _, packet := range p.queue {
+				pacerBuffers.Put(packet.payload)
+			}
+			p.queue = nil
+			p.lock.Unlock()
+			return
+		case <-p.wake:
+			// The first packets after a pause go at once, up to an
+			// interval's budget
+			ticker.Reset(pacingInterval)
+			now = time.Now()
+			budget, last = 0, now.Add(-pacingInterval)
+		case now = <-ticker.C:
+		}
+
+		p.lock.Lock()
+		rate := p.rate
+		if len(p.queue) == 0 {
+			ticker.Stop()
+			p.lock.Unlock()
+			continue
+		}
+		if drain := float64(p.bytes*8) / p.maxDelay.Seconds(); drain > rate {
+			rate = drain
+		}
+		budget = min(budget+now.Sub(last).Seconds()*rate/8, rate/8*pacingInterval.Seconds()*2)
+		last = now
+		for len(p.queue) > 0 && budget > 0 {
+			packet := p.queue[0]
+			p.queue[0] = pacedPacket{}
+			p.queue = p.queue[1:]
+			p.bytes -= len(*packet.payload)
+			writer := p.writers[packet.header.SSRC]
+			p.lock.Unlock()
+
+			if writer != nil {
+				n, _ := writer.Write(&packet.header, *packet.payload, packet.attributes)
+				budget -= float64(n)
+			}
+			pacerBuffers.Put(packet.payload)
+			p.lock.Lock()
+		}
+		p.lock.Unlock()
+	}
+}
+
+// Close stops the pacer, dropping what is queued
+func (p *mediaPacer) Close() error {
+	p.close.Do(func() { close(p.done) })
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtpMTU is the largest RTP payload sent to viewers, as pion's own
+// packetizer uses
+const rtpMTU = 1200
+
+// videoClockRate is the RTP clock rate of every WebRTC video codec
+const videoClockRate = 90000
+
+// H.264 RTP payload types, RFC 6184
+const (
+	h264STAPA      = 24
+	h264FUA        = 28
+	h264NALUFiller = 12
+)
+
+// rtpTrack is a stream's WebRTC video track. Packets written to it go to
+// every peer connection it is bound to, each with its own SSRC and payload
+// type; the packets themselves are shared.
+type rtpTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	bound atomic.Int32
+}
+
+func newRTPTrack(codec string, options ...func(*webrtc.TrackLocalStaticRTP)) (*rtpTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: videoCodecMimeTypes[codec]},
+		"video", "video0", options...)
+	if err != nil {
+		return nil, err
+	}
+	return &rtpTrack{TrackLocalStaticRTP: track}, nil
+}
+
+// Bind is called by a peer connection once it negotiated the track
+func (t *rtpTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err == nil {
+		t.bound.Add(1)
+	}
+	return codec, err
+}
+
+// Unbind is called by a peer connection that stopped sending the track
+func (t *rtpTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	err := t.TrackLocalStaticRTP.Unbind(ctx)
+	if err == nil {
+		t.bound.Add(-1)
+	}
+	return err
+}
+
+// writePackets sends a frame's packets, returning the first error
+func (t *rtpTrack) writePackets(packets []rtp.Packet) error {
+	var first error
+	for i := range packets {
+		if err := t.WriteRTP(&packets[i]); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// videoPacketizer packetizes a stream's frames once for its tracks, however
+// many viewers they go to. H.264 NAL units that fit a packet are sent from
+// the frame as they are; only fragments and aggregates are copied, into a
+// buffer reused frame to frame. The packets are reused too: track writes
+// are synchronous and the NACK responder copies the packets it keeps, so
+// none outlives its frame.
+type videoPacketizer struct {
+	payloader rtp.Payloader // for VP9 and AV1; H.264 is packetized here
+	sequencer rtp.Sequencer
+	timestamp uint32
+	packets   []rtp.Packet
+	buf       []byte
+	copied    []bufSpan // packets whose payload is in buf
+}
+
+// bufSpan is where a packet's payload lies in the packetizer's buffer,
+// which may move while a frame is packetized
+type bufSpan struct {
+	packet, start, end int
+}
+
+func newVideoPacketizer(codec string) *videoPacketizer {
+	p := &videoPacketizer{
+		sequencer: rtp.NewRandomSequencer(),
+		timestamp: rand.Uint32(),
+	}
+	switch codec {
+	case videoCodecVP9:
+		p.payloader = &codecs.VP9Payloader{}
+	case videoCodecAV1:
+		p.payloader = &codecs.AV1Payloader{}
+	}
+	return p
+}
+
+// packetize returns a frame's RTP packets, valid until the next call.
+// params are the parameter sets sent ahead of an H.264 keyframe that lacks
+// them.
+func (p *videoPacketizer) packetize(data []byte, params [][]byte, duration time.Duration) []rtp.Packet {
+	p.packets, p.buf, p.copied = p.packets[:0], p.buf[:0], p.copied[:0]
+	if p.payloader != nil {
+		for _, payload := range p.payloader.Payload(rtpMTU, data) {
+			p.add(payload)
+		}
+	} else {
+		p.packetizeH264(data, params)
+	}
+	for _, span := range p.copied {
+		p.packets[span.packet].Payload = p.buf[span.start:span.end]
+	}
+	if n := len(p.packets); n > 0 {
+		p.packets[n-1].Marker = true
+	}
+	p.timestamp += uint32(duration.Seconds() * videoClockRate)
+	return p.packets
+}
+
+// packetizeH264 packetizes an access unit in AVCC or Annex B form. Its
+// parameter sets, or params if it has none, go first in one STAP-A.
+func (p *videoPacketizer) packetizeH264(data []byte, params [][]byte) {
+	nalus, _ := h264parser.SplitNALUs(data)
+	if containsSPS(nalus) {
+		params = nil
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+			if typ := nalu[0] & 0x1f; typ == h264parser.NALU_SPS || typ == h264parser.NALU_PPS {
+				params = append(params, nalu)
+			}
+		}
+	}
+	p.aggregate(params)
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS, h264parser.NALU_PPS, h264parser.NALU_AUD, h264NALUFiller:
+			continue
+		}
+		if len(nalu) <= rtpMTU {
+			p.add(nalu)
+			continue
+		}
+
+		// FU-A: the NAL unit's header is carried in each fragment's
+		indicator := nalu[0]&0x60 | h264FUA
+		for offset := 1; offset < len(nalu); {
+			end := min(offset+rtpMTU-2, len(nalu))
+			header := nalu[0] & 0x1f
+			if offset == 1 {
+				header |= 0x80
+			}
+			if end == len(nalu) {
+				header |= 0x40
+			}
+			start := len(p.buf)
+			p.buf = append(p.buf, indicator, header)
+			p.buf = append(p.buf, nalu[offset:end]...)
+			p.addCopied(start)
+			offset = end
+		}
+	}
+}
+
+// aggregate sends NAL units in one STAP-A, or one by one if they don't fit
+func (p *videoPacketizer) aggregate(nalus [][]byte) {
+	size := 1
+	for _, nalu := range nalus {
+		size += 2 + len(nalu)
+	}
+	if len(nalus) < 2 || size > rtpMTU {
+		for _, nalu := range nalus {
+			if len(nalu) > 0 && len(nalu) <= rtpMTU {
+				p.add(nalu)
+			}
+		}
+		return
+	}
+
+	start := len(p.buf)
+	p.buf = append(p.buf, 0x60|h264STAPA)
+	for _, nalu := range nalus {
+		p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(len(nalu)))
+		p.buf = append(p.buf, nalu...)
+	}
+	p.addCopied(start)
+}
+
+func (p *videoPacketizer) add(payload []byte) {
+	p.packets = append(p.packets, rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: p.sequencer.NextSequenceNumber(),
+			Timestamp:      p.timestamp,
+		},
+		Payload: payload,
+	})
+}
+
+// addCopied adds a packet whose payload is in buf from start to its end
+func (p *videoPacketizer) addCopied(start int) {
+	p.copied = append(p.copied, bufSpan{packet: len(p.packets), start: start, end: len(p.buf)})
+	p.add(nil)
+}
+
+// parameterSets returns the session's H.264 SPS and PPS, or nil for other
+// codecs
+func (cs *CameraStream) parameterSets() [][]byte {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+	for _, c := range cs.codecs {
+		if codec, ok := c.(h264parser.CodecData); ok {
+			return [][]byte{codec.SPS(), codec.PPS()}
+		}
+	}
+	return nil
+}
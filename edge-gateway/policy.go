@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+)
+
+// Approval states of a discovered camera. Approved cameras, and cameras
+// added by an operator, have none.
+const (
+	cameraApprovalPending  = "pending"
+	cameraApprovalRejected = "rejected"
+)
+
+// parseOUI normalizes a MAC address prefix such as AC:CC:8E, ac-cc-8e or
+// ACCC8E to six upper-case hex digits
+func parseOUI(s string) (string, bool) {
+	oui := strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.TrimSpace(s)))
+	if len(oui) != 6 {
+		return "", false
+	}
+	for _, c := range oui {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return "", false
+		}
+	}
+	return oui, true
+}
+
+// parseOUIList parses a list of OUIs, rejecting any invalid entry
+func parseOUIList(field string, items []string) ([]string, error) {
+	ouis := []string{}
+	for _, item := range items {
+		oui, ok := parseOUI(item)
+		if !ok {
+			return nil, fmt.Errorf("invalid OUI %q in %s", item, field)
+		}
+		ouis = append(ouis, oui)
+	}
+	return ouis, nil
+}
+
+// parseModelList checks a list of model patterns, rejecting malformed ones
+func parseModelList(field string, items []string) ([]string, error) {
+	patterns := []string{}
+	for _, item := range items {
+		pattern := strings.TrimSpace(item)
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid model pattern %q in %s", item, field)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseIPList parses a list of IP addresses, rejecting any invalid entry
+func parseIPList(field string, items []string) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, item := range items {
+		ip := net.ParseIP(strings.TrimSpace(item))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q in %s", item, field)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// matchOUI reports whether a MAC address starts with one of the OUIs
+func matchOUI(mac string, ouis []string) bool {
+	if len(mac) < 8 {
+		return false
+	}
+	prefix, ok := parseOUI(mac[:8])
+	if !ok {
+		return false
+	}
+	for _, oui := range ouis {
+		if prefix == oui {
+			return true
+		}
+	}
+	return false
+}
+
+// matchModel reports whether a model matches one of the patterns, ignoring
+// case
+func matchModel(model string, patterns []string) bool {
+	model = strings.ToLower(model)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// admitCamera applies the discovery policy to a camera found by mDNS or the
+// network scan, after its capabilities are probed. It returns false if the
+// camera must not be managed. Otherwise it records the camera's MAC address
+// and its approval state: kept from the inventory, or pending for a new
+// camera when approval is required.
+func (eg *EdgeGateway) admitCamera(camera *Camera) bool {
+	settings := eg.settings()
+
+	refuse := func(reason string) bool {
+		debugf("Not managing camera at %s: %s", camera.IP, reason)
+		return false
+	}
+	if ip := net.ParseIP(camera.IP); ip == nil || !eg.scanAllowed(ip) {
+		return refuse("address is ignored or outside the allowed ranges")
+	}
+	if matchModel(camera.Model, settings.CameraDenyModels) {
+		return refuse(fmt.Sprintf("model %q is denied", camera.Model))
+	}
+	if len(settings.CameraAllowModels) > 0 && !matchModel(camera.Model, settings.CameraAllowModels) {
+		return refuse(fmt.Sprintf("model %q is not allowed", camera.Model))
+	}
+
+	// Cameras behind a router have no MAC address of their own in the
+	// ARP table, so they only pass an empty allow list
+	camera.MAC = neighborMAC(camera.IP)
+	if matchOUI(camera.MAC, settings.CameraDenyOUIs) {
+		return refuse(fmt.Sprintf("MAC address %s is denied", camera.MAC))
+	}
+	if len(settings.CameraAllowOUIs) > 0 && !matchOUI(camera.MAC, settings.CameraAllowOUIs) {
+		return refuse(fmt.Sprintf("MAC address %q is not allowed", camera.MAC))
+	}
+
+	eg.camerasLock.RLock()
+	existing, exists := eg.cameras[camera.ID]
+	eg.camerasLock.RUnlock()
+	switch {
+	case exists:
+		camera.Approval = existing.Approval
+		if camera.MAC == "" {
+			camera.MAC = existing.MAC
+		}
+	case settings.CameraApproval:
+		camera.Approval = cameraApprovalPending
+		log.Printf("Camera at %s is waiting for approval", camera.IP)
+	}
+	return true
+}
+
+// setCameraApproval approves or rejects a camera and its channels. Rejected
+// cameras stay in the inventory, so rediscovery doesn't ask again, but
+// can't stream.
+func (eg *EdgeGateway) setCameraApproval(cameraID, approval string) bool {
+	eg.camerasLock.Lock()
+	var changed []*Camera
+	for _, camera := range eg.cameras {
+		if camera.ID != cameraID && camera.ParentID != cameraID || camera.Manual {
+			continue
+		}
+		if camera.Approval != approval {
+			updated := *camera
+			updated.Approval = approval
+			eg.cameras[camera.ID] = &updated
+			changed = append(changed, &updated)
+		}
+	}
+	_, exists := eg.cameras[cameraID]
+	if len(changed) > 0 {
+		eg.saveCamerasLocked()
+	}
+	eg.camerasLock.Unlock()
+	if !exists {
+		return false
+	}
+
+	status := "approved"
+	if approval == cameraApprovalRejected {
+		status = "rejected"
+		eg.stopStream(cameraID)
+		for _, camera := range changed {
+			if camera.ParentID == cameraID {
+				eg.stopStream(camera.ID)
+			}
+		}
+	}
+	for _, camera := range changed {
+		log.Printf("Camera %s %s", camera.ID, status)
+		eg.notifyCameraStatus(camera, status)
+	}
+	return true
+}
+
+// ignoreCamera rejects a camera and adds its address to the ignored IPs, so
+// it is neither probed nor reported again
+func (eg *EdgeGateway) ignoreCamera(cameraID string) bool {
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cameraID]
+	eg.camerasLock.RUnlock()
+	if !exists || camera.Manual || !eg.setCameraApproval(cameraID, cameraApprovalRejected) {
+		return false
+	}
+
+	ips := []string{}
+	for _, ip := range eg.settings().IgnoredIPs {
+		if ip.String() == camera.IP {
+			return true
+		}
+		ips = append(ips, ip.String())
+	}
+	ips = append(ips, camera.IP)
+	eg.handleSetConfig(RemoteConfig{IgnoredIPs: &ips})
+	return true
+}
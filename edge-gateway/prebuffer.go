@@ -0,0 +1,73 @@
+package main
+
+import "github.com/deepch/vdk/av"
+
+// gopBuffer holds a stream's packets since its last keyframe, so consumers
+// that attach mid-GOP start on that keyframe instead of waiting for the
+// next one. It stays empty until the first keyframe, and once the GOP grows
+// past maxBytes until the keyframe after that.
+type gopBuffer struct {
+	maxBytes int // 0 disables buffering
+	packets  []av.Packet
+	size     int
+}
+
+// add records a packet of the current session
+func (b *gopBuffer) add(pkt av.Packet) {
+	if b.maxBytes <= 0 {
+		return
+	}
+	if pkt.IsKeyFrame {
+		b.reset()
+	} else if b.packets == nil {
+		return
+	}
+	if b.size+len(pkt.Data) > b.maxBytes {
+		b.reset()
+		return
+	}
+	b.packets = append(b.packets, pkt)
+	b.size += len(pkt.Data)
+}
+
+// reset drops the buffered GOP, as when a new session starts
+func (b *gopBuffer) reset() {
+	b.packets = nil
+	b.size = 0
+}
+
+// keyframe returns the buffered GOP's keyframe
+func (b *gopBuffer) keyframe() (av.Packet, bool) {
+	if len(b.packets) == 0 {
+		return av.Packet{}, false
+	}
+	return b.packets[0], true
+}
+
+// playSink runs play, which makes a sink added earlier start taking
+// packets, and then writes the buffered GOP to it ahead of any newer packet
+func (cs *CameraStream) playSink(sink packetSink, play func()) {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+
+	play()
+	for _, pkt := range cs.gop.packets {
+		sink.WritePacket(pkt)
+	}
+}
+
+// sendBufferedKeyframe queues the buffered keyframe for the WebRTC track, so
+// a viewer that just connected has a picture without waiting for the next
+// one. Viewers already watching get it again, which their decoders take as
+// a refresh.
+func (cs *CameraStream) sendBufferedKeyframe() {
+	cs.sinksLock.Lock()
+	pkt, ok := cs.gop.keyframe()
+	cs.sinksLock.Unlock()
+	// Frames already waiting are newer and will reach the viewer soon
+	if !ok || len(cs.videoQueue) > 0 {
+		return
+	}
+
+	cs.enqueueVideo(pkt)
+}
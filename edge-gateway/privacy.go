@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// privacyMaxMasks bounds the masks of one camera
+const privacyMaxMasks = 32
+
+// errPrivacyNeedsTranscoder is returned for streams of masked cameras when
+// the transcoder that draws the masks is off
+var errPrivacyNeedsTranscoder = errors.New("camera has privacy masks and transcoding is off")
+
+// PrivacyMask is a region of a camera's frame that is blacked out before
+// its video leaves the gateway, as fractions of the frame's width and
+// height from its top left corner
+type PrivacyMask struct {
+	Name   string  `json:"name,omitempty"`
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Right  float64 `json:"right"`
+	Bottom float64 `json:"bottom"`
+}
+
+// PrivacyMaskUpdate replaces a camera's masks; an empty list removes them
+type PrivacyMaskUpdate struct {
+	CameraID string        `json:"camera_id"`
+	Masks    []PrivacyMask `json:"masks"`
+}
+
+// validate checks that every mask lies within the frame and covers some of it
+func (u PrivacyMaskUpdate) validate() error {
+	if len(u.Masks) > privacyMaxMasks {
+		return fmt.Errorf("more than %d privacy masks", privacyMaxMasks)
+	}
+	for i, m := range u.Masks {
+		if m.Left < 0 || m.Top < 0 || m.Right > 1 || m.Bottom > 1 || m.Left >= m.Right || m.Top >= m.Bottom {
+			return fmt.Errorf("privacy mask %d is not a region of the frame", i+1)
+		}
+		if utf8.RuneCountInString(m.Name) > metadataMaxText {
+			return fmt.Errorf("privacy mask %d has a name longer than %d characters", i+1, metadataMaxText)
+		}
+	}
+	return nil
+}
+
+// PrivacyMaskStore holds the privacy masks of each camera. Once loaded from
+// a file, every change is saved back to it.
+type PrivacyMaskStore struct {
+	lock  sync.RWMutex
+	masks map[string][]PrivacyMask
+	path  string
+}
+
+func NewPrivacyMaskStore() *PrivacyMaskStore {
+	return &PrivacyMaskStore{masks: make(map[string][]PrivacyMask)}
+}
+
+// Get returns a camera's masks, or nil if it has none
+func (s *PrivacyMaskStore) Get(cameraID string) []PrivacyMask {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.masks[cameraID]
+}
+
+// Set replaces a camera's masks, reporting whether they changed
+func (s *PrivacyMaskStore) Set(cameraID string, masks []PrivacyMask) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, _ := json.Marshal(s.masks[cameraID])
+	if len(masks) == 0 {
+		delete(s.masks, cameraID)
+	} else {
+		s.masks[cameraID] = append([]PrivacyMask(nil), masks...)
+	}
+	if updated, _ := json.Marshal(s.masks[cameraID]); string(updated) == string(old) {
+		return false
+	}
+	s.saveLocked()
+	return true
+}
+
+// Load restores the masks saved at path and saves later changes there
+func (s *PrivacyMaskStore) Load(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read saved privacy masks: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.masks); err != nil {
+		log.Printf("Discarding unreadable saved privacy masks: %v", err)
+		s.masks = make(map[string][]PrivacyMask)
+	}
+}
+
+// saveLocked writes the masks to the store's file, if it has one. The
+// caller holds lock.
+func (s *PrivacyMaskStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	data, _ := json.Marshal(s.masks)
+	if err := writeFileAtomic(s.path, data); err != nil {
+		log.Printf("Failed to save privacy masks: %v", err)
+	}
+}
+
+// privacyFilter is the ffmpeg filter chain blacking out masks, applied to
+// the camera's full frame before any other filter, or empty without masks.
+// Boxes are rounded outwards so no edge pixels of a region show.
+func privacyFilter(masks []PrivacyMask) string {
+	boxes := make([]string, 0, len(masks))
+	for _, m := range masks {
+		boxes = append(boxes, fmt.Sprintf("drawbox=x=floor(iw*%.4f):y=floor(ih*%.4f):w=ceil(iw*%.4f)+1:h=ceil(ih*%.4f)+1:color=black:t=fill",
+			m.Left, m.Top, m.Right-m.Left, m.Bottom-m.Top))
+	}
+	return strings.Join(boxes, ",")
+}
+
+// maskSnapshot blacks out masks on a camera's JPEG with ffmpeg, as its
+// streams are
+func maskSnapshot(ctx context.Context, ffmpegPath string, image []byte, masks []PrivacyMask) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error",
+		"-f", "image2pipe", "-i", "pipe:0", "-vf", privacyFilter(masks),
+		"-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-q:v", "3", "pipe:1")
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			lines := strings.Split(message, "\n")
+			return nil, fmt.Errorf("masking snapshot: %s", lines[len(lines)-1])
+		}
+		return nil, fmt.Errorf("masking snapshot: %v", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("masking snapshot: ffmpeg returned no image")
+	}
+	return stdout.Bytes(), nil
+}
+
+// setPrivacyMasks replaces a camera's masks and restarts its streams'
+// ingest so they take effect, or stops its streams if the transcoder that
+// draws them is off
+func (eg *EdgeGateway) setPrivacyMasks(u PrivacyMaskUpdate) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	eg.camerasLock.RLock()
+	_, exists := eg.cameras[u.CameraID]
+	eg.camerasLock.RUnlock()
+	if !exists {
+		return errCameraNotFound
+	}
+
+	if eg.privacy.Set(u.CameraID, u.Masks) {
+		log.Printf("Camera %s has %d privacy masks", u.CameraID, len(u.Masks))
+		if len(u.Masks) > 0 && eg.transcoder == nil {
+			log.Printf("Stopping streams of camera %s: %v", u.CameraID, errPrivacyNeedsTranscoder)
+			eg.stopStream(u.CameraID)
+		} else {
+			eg.streamsLock.RLock()
+			for _, stream := range eg.streams {
+				if stream.camera.ID == u.CameraID {
+					stream.restartIngest()
+				}
+			}
+			eg.streamsLock.RUnlock()
+		}
+	}
+
+	masks := eg.privacy.Get(u.CameraID)
+	if masks == nil {
+		masks = []PrivacyMask{}
+	}
+	eg.sendEvent("privacy_masks", map[string]interface{}{
+		"camera_id": u.CameraID,
+		"masks":     masks,
+		"enforced":  len(masks) == 0 || eg.transcoder != nil,
+	})
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Proxy authentication schemes
+const (
+	proxyAuthBasic = "basic"
+	proxyAuthNTLM  = "ntlm"
+)
+
+// proxyDialer makes the gateway's outbound connections: to the cloud, GCS,
+// Cloud Trace and release downloads. Through an HTTP proxy it tunnels with
+// CONNECT, authenticating with basic or NTLM, or through a SOCKS5 proxy.
+// Local addresses and NO_PROXY hosts are dialed directly, so camera traffic
+// never goes through the proxy.
+type proxyDialer struct {
+	proxy    *url.URL // nil to always dial directly
+	auth     string
+	username string
+	password string
+	noProxy  []string
+	direct   net.Dialer
+}
+
+// egress is the dialer for outbound connections, set up by setupProxy
+var egress = &proxyDialer{}
+
+// setupProxy routes outbound connections through the configured proxy,
+// including those of libraries using http.DefaultTransport
+func setupProxy(cfg *Config) {
+	d := &proxyDialer{
+		auth:     cfg.ProxyAuth,
+		username: cfg.ProxyUsername,
+		password: cfg.ProxyPassword,
+		noProxy:  cfg.NoProxy,
+		direct:   net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	if cfg.ProxyURL != "" {
+		raw := cfg.ProxyURL
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			log.Printf("Invalid proxy URL %q, connecting directly", redactCredentials(cfg.ProxyURL))
+		} else {
+			d.proxy = u
+			if u.User != nil && d.username == "" {
+				d.username = u.User.Username()
+				d.password, _ = u.User.Password()
+			}
+			log.Printf("Outbound connections go through proxy %s://%s (%s auth)", u.Scheme, u.Host, d.auth)
+		}
+	}
+	egress = d
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = d.DialContext
+	http.DefaultTransport = transport
+}
+
+// DialContext connects to addr, through the proxy unless it is excluded
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.proxy == nil || d.bypass(addr) {
+		return d.direct.DialContext(ctx, network, addr)
+	}
+
+	switch d.proxy.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if d.username != "" {
+			auth = &proxy.Auth{User: d.username, Password: d.password}
+		}
+		socks, err := proxy.SOCKS5("tcp", d.proxy.Host, auth, &d.direct)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	case "http", "https":
+		return d.connect(ctx, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", d.proxy.Scheme)
+}
+
+// dialEgress is DialContext in the form gRPC takes
+func dialEgress(ctx context.Context, addr string) (net.Conn, error) {
+	return egress.DialContext(ctx, "tcp", addr)
+}
+
+// bypass reports whether addr is dialed directly: loopback, private and
+// link-local addresses, and hosts matching NO_PROXY
+func (d *proxyDialer) bypass(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+		return true
+	}
+
+	for _, entry := range d.noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+		default:
+			// example.com and .example.com both match the domain and its subdomains
+			domain := strings.TrimPrefix(entry, ".")
+			if h, _, err := net.SplitHostPort(domain); err == nil {
+				domain = h
+			}
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connect opens a CONNECT tunnel to addr through the HTTP proxy
+func (d *proxyDialer) connect(ctx context.Context, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+
+	conn, err := d.direct.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if d.proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy: TLS handshake failed: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	r := bufio.NewReader(conn)
+	if err := d.handshake(conn, r, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if r.Buffered() > 0 {
+		// The server spoke first and the reader took some of it
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what its reader buffered before the connection itself
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// handshake sends CONNECT on conn, answering an NTLM challenge on the same
+// connection as NTLM requires
+func (d *proxyDialer) handshake(conn net.Conn, r *bufio.Reader, addr string) error {
+	var authorization string
+	switch {
+	case d.username == "":
+	case d.auth == proxyAuthNTLM:
+		authorization = "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate())
+	default:
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(d.username+":"+d.password))
+	}
+
+	resp, err := sendConnect(conn, r, addr, authorization)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && d.auth == proxyAuthNTLM && d.username != "" {
+		challenge, err := ntlmChallengeFrom(resp.Header.Values("Proxy-Authenticate"))
+		if err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+		authenticate, err := ntlmAuthenticate(challenge, d.username, d.password)
+		if err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+		resp, err = sendConnect(conn, r, addr, "NTLM "+base64.StdEncoding.EncodeToString(authenticate))
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusProxyAuthRequired && d.username == "":
+		return errors.New("proxy: authentication required but no proxy credentials are configured")
+	default:
+		return fmt.Errorf("proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+}
+
+// sendConnect writes a CONNECT request and reads the response, discarding
+// its body so the connection can be reused for the next round
+func sendConnect(conn net.Conn, r *bufio.Reader, addr, authorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{"User-Agent": {"edge-gateway/" + Version}},
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+	}
+	return resp, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PTZ priorities: a command or lock from a higher priority overrides a lock
+// held at a lower one
+const (
+	ptzPriorityAutomation = "automation" // MQTT and other unattended control
+	ptzPriorityOperator   = "operator"
+	ptzPriorityAdmin      = "admin"
+)
+
+var ptzPriorityLevels = map[string]int{
+	ptzPriorityAutomation: 0,
+	ptzPriorityOperator:   1,
+	ptzPriorityAdmin:      2,
+}
+
+// PTZ lock actions, sent as ptz_command actions
+const (
+	ptzActionLock   = "lock"
+	ptzActionUnlock = "unlock"
+)
+
+const (
+	// ptzQueueSize bounds the commands waiting for a camera
+	ptzQueueSize = 8
+	// ptzMaxLease caps the lease an operator can ask for
+	ptzMaxLease = time.Hour
+)
+
+// PTZLease is an operator's exclusive control of a camera's PTZ
+type PTZLease struct {
+	CameraID  string    `json:"camera_id"`
+	Operator  string    `json:"operator"`
+	Priority  string    `json:"priority"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ptzController serializes a camera's PTZ commands, highest priority first,
+// and holds its lease
+type ptzController struct {
+	lock    sync.Mutex
+	queue   []PTZCommand
+	running bool // a worker is draining the queue
+	lease   *PTZLease
+	expiry  *time.Timer
+	// watchdog stops a continuous move that isn't repeated or stopped
+	watchdog *time.Timer
+}
+
+// ptzPriority returns a command's priority level, operator if unset
+func ptzPriority(name string) (int, bool) {
+	if name == "" {
+		name = ptzPriorityOperator
+	}
+	level, ok := ptzPriorityLevels[name]
+	return level, ok
+}
+
+// ptzController returns the camera's controller, creating it on first use
+func (eg *EdgeGateway) ptzController(cameraID string) *ptzController {
+	eg.ptzLock.Lock()
+	defer eg.ptzLock.Unlock()
+	c, ok := eg.ptz[cameraID]
+	if !ok {
+		c = &ptzController{}
+		eg.ptz[cameraID] = c
+	}
+	return c
+}
+
+// controlPTZ handles a PTZ command from origin and audits the outcome
+func (eg *EdgeGateway) controlPTZ(origin AuditOrigin, cmd PTZCommand) {
+	err := eg.handlePTZCommand(cmd)
+	details := map[string]interface{}{"action": cmd.Action}
+	if cmd.Operator != "" {
+		details["operator"] = cmd.Operator
+	}
+	if cmd.Priority != "" {
+		details["priority"] = cmd.Priority
+	}
+	eg.audit(origin, "ptz_command", cmd.CameraID, details, err)
+}
+
+// handlePTZCommand arbitrates a PTZ command. Lock and unlock take effect at
+// once. Other commands are refused while another operator holds the lock at
+// the same or a higher priority, and are otherwise queued for the camera.
+// It returns why a command was refused.
+func (eg *EdgeGateway) handlePTZCommand(cmd PTZCommand) error {
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[cmd.CameraID]
+	eg.camerasLock.RUnlock()
+
+	digital := exists && eg.digitalPTZ(camera) != nil && isDigitalPTZ(cmd.Action)
+	if !exists || !cameraSupportsPTZ(camera, cmd.Action) && !digital {
+		log.Printf("Camera not found or doesn't support PTZ %s: %s", cmd.Action, cmd.CameraID)
+		return fmt.Errorf("camera not found or doesn't support PTZ %s", cmd.Action)
+	}
+	if camera.Approval != "" {
+		log.Printf("Camera %s is not approved (%s), ignoring PTZ %s", cmd.CameraID, camera.Approval, cmd.Action)
+		return fmt.Errorf("camera is not approved (%s)", camera.Approval)
+	}
+	if cmd.Priority == "" {
+		cmd.Priority = ptzPriorityOperator
+	}
+	level, ok := ptzPriority(cmd.Priority)
+	if !ok {
+		log.Printf("Unknown PTZ priority %q for camera %s", cmd.Priority, cmd.CameraID)
+		return fmt.Errorf("unknown PTZ priority %q", cmd.Priority)
+	}
+
+	c := eg.ptzController(cmd.CameraID)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	holder := c.lease
+	held := holder != nil && holder.Operator != cmd.Operator
+	if held {
+		heldLevel, _ := ptzPriority(holder.Priority)
+		held = level <= heldLevel
+	}
+
+	switch cmd.Action {
+	case ptzActionLock:
+		if cmd.Operator == "" {
+			log.Printf("PTZ lock for camera %s has no operator", cmd.CameraID)
+			return fmt.Errorf("PTZ lock has no operator")
+		}
+		if held {
+			return eg.denyPTZ(cmd, holder)
+		}
+		eg.lockPTZ(c, cmd)
+
+	case ptzActionUnlock:
+		if holder == nil {
+			return nil
+		}
+		if held {
+			return eg.denyPTZ(cmd, holder)
+		}
+		eg.releasePTZ(c, "released")
+
+	default:
+		if held {
+			return eg.denyPTZ(cmd, holder)
+		}
+		if holder != nil && holder.Operator == cmd.Operator {
+			// Activity keeps the lease for at least PTZ_LOCK_TIMEOUT
+			if remaining := time.Until(holder.ExpiresAt); remaining < eg.cfg.PTZLockTimeout {
+				eg.renewPTZ(c, eg.cfg.PTZLockTimeout)
+			}
+		}
+		eg.enqueuePTZ(c, cmd, level)
+	}
+	return nil
+}
+
+// lockPTZ gives cmd's operator the camera's lease, taking it from a lower
+// priority holder. Queued commands from other operators are dropped. Called
+// with c.lock held.
+func (eg *EdgeGateway) lockPTZ(c *ptzController, cmd PTZCommand) {
+	lease := time.Duration(cmd.LeaseSecs * float64(time.Second))
+	if lease <= 0 {
+		lease = eg.cfg.PTZLockTimeout
+	}
+	if lease > ptzMaxLease {
+		lease = ptzMaxLease
+	}
+
+	previous := ""
+	if c.lease != nil && c.lease.Operator != cmd.Operator {
+		previous = c.lease.Operator
+	}
+	c.lease = &PTZLease{CameraID: cmd.CameraID, Operator: cmd.Operator, Priority: cmd.Priority}
+	eg.renewPTZ(c, lease)
+
+	kept := c.queue[:0]
+	for _, queued := range c.queue {
+		if queued.Operator == cmd.Operator {
+			kept = append(kept, queued)
+		}
+	}
+	c.queue = kept
+
+	if previous != "" {
+		log.Printf("PTZ lock on camera %s taken from %s by %s (%s)", cmd.CameraID, previous, cmd.Operator, cmd.Priority)
+	}
+	eg.sendPTZLock(c.lease, "locked", previous)
+}
+
+// renewPTZ sets the lease to expire after d. Called with c.lock held.
+func (eg *EdgeGateway) renewPTZ(c *ptzController, d time.Duration) {
+	c.lease.ExpiresAt = time.Now().Add(d)
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	lease := c.lease
+	c.expiry = time.AfterFunc(d, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.lease == lease {
+			eg.releasePTZ(c, "expired")
+		}
+	})
+}
+
+// releasePTZ ends the lease, stopping any movement the operator left going.
+// Called with c.lock held.
+func (eg *EdgeGateway) releasePTZ(c *ptzController, state string) {
+	lease := c.lease
+	c.lease = nil
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	eg.sendPTZLock(lease, state, "")
+	eg.stopPTZ(c, lease.CameraID)
+}
+
+// stopPTZ queues a stop ahead of every other command. Called with c.lock
+// held.
+func (eg *EdgeGateway) stopPTZ(c *ptzController, cameraID string) {
+	eg.enqueuePTZ(c, PTZCommand{CameraID: cameraID, Action: "stop", Priority: ptzPriorityAdmin}, ptzPriorityLevels[ptzPriorityAdmin])
+}
+
+// watchPTZ arms the watchdog after a continuous move is sent, and disarms
+// it after a stop. A move that is neither repeated nor stopped within
+// PTZ_WATCHDOG_TIMEOUT, for example because the stop was lost with the
+// connection mid-drag, is stopped.
+func (eg *EdgeGateway) watchPTZ(c *ptzController, cmd PTZCommand) {
+	timeout := eg.cfg.PTZWatchdogTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !isContinuousPTZ(cmd.Action) && cmd.Action != "stop" {
+		// A setting doesn't start or end a move
+		return
+	}
+	if c.watchdog != nil {
+		c.watchdog.Stop()
+		c.watchdog = nil
+	}
+	if cmd.Action == "stop" {
+		return
+	}
+
+	var watchdog *time.Timer
+	watchdog = time.AfterFunc(timeout, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.watchdog != watchdog {
+			return
+		}
+		c.watchdog = nil
+		log.Printf("No PTZ command for camera %s within %s of %s, stopping", cmd.CameraID, timeout, cmd.Action)
+		eg.stopPTZ(c, cmd.CameraID)
+	})
+	c.watchdog = watchdog
+}
+
+// enqueuePTZ queues a command behind those of the same or higher priority,
+// starting the camera's worker if it is idle. When the queue is full the
+// oldest lowest priority command is dropped. Called with c.lock held.
+func (eg *EdgeGateway) enqueuePTZ(c *ptzController, cmd PTZCommand, level int) {
+	if len(c.queue) >= ptzQueueSize {
+		drop := len(c.queue) - 1
+		dropLevel, _ := ptzPriority(c.queue[drop].Priority)
+		for i := drop - 1; i >= 0; i-- {
+			if l, _ := ptzPriority(c.queue[i].Priority); l == dropLevel {
+				drop = i
+			}
+		}
+		if dropLevel > level {
+			log.Printf("PTZ queue for camera %s is full, dropping %s", cmd.CameraID, cmd.Action)
+			return
+		}
+		c.queue = append(c.queue[:drop], c.queue[drop+1:]...)
+	}
+
+	i := sort.Search(len(c.queue), func(i int) bool {
+		l, _ := ptzPriority(c.queue[i].Priority)
+		return l < level
+	})
+	c.queue = append(c.queue, PTZCommand{})
+	copy(c.queue[i+1:], c.queue[i:])
+	c.queue[i] = cmd
+
+	if !c.running {
+		c.running = true
+		go eg.runPTZQueue(c)
+	}
+}
+
+// runPTZQueue sends a camera's queued commands one at a time, so moves from
+// different sources don't interleave at the camera
+func (eg *EdgeGateway) runPTZQueue(c *ptzController) {
+	for {
+		c.lock.Lock()
+		if len(c.queue) == 0 {
+			c.running = false
+			c.lock.Unlock()
+			return
+		}
+		cmd := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+
+		eg.camerasLock.RLock()
+		camera, exists := eg.cameras[cmd.CameraID]
+		eg.camerasLock.RUnlock()
+		if exists {
+			eg.sendPTZCommand(eg.ctx, camera, cmd)
+			eg.watchPTZ(c, cmd)
+		}
+	}
+}
+
+// denyPTZ tells the cloud a command was refused because of another
+// operator's lock, and returns the refusal
+func (eg *EdgeGateway) denyPTZ(cmd PTZCommand, holder *PTZLease) error {
+	log.Printf("PTZ %s on camera %s from %q refused: locked by %s", cmd.Action, cmd.CameraID, cmd.Operator, holder.Operator)
+	eg.sendEvent("ptz_denied", map[string]interface{}{
+		"camera_id":     cmd.CameraID,
+		"operator":      cmd.Operator,
+		"action":        cmd.Action,
+		"locked_by":     holder.Operator,
+		"lock_priority": holder.Priority,
+	})
+	return fmt.Errorf("locked by %s", holder.Operator)
+}
+
+// sendPTZLock reports a lease change: locked, released, or expired
+func (eg *EdgeGateway) sendPTZLock(lease *PTZLease, state, previous string) {
+	payload := map[string]interface{}{
+		"camera_id": lease.CameraID,
+		"state":     state,
+		"operator":  lease.Operator,
+		"priority":  lease.Priority,
+	}
+	if state == "locked" {
+		payload["expires_at"] = lease.ExpiresAt
+	}
+	if previous != "" {
+		payload["previous_operator"] = previous
+	}
+	eg.sendEvent("ptz_lock", payload)
+}
+
+// ptzLeases returns the current PTZ locks
+func (eg *EdgeGateway) ptzLeases() []PTZLease {
+	eg.ptzLock.Lock()
+	controllers := make([]*ptzController, 0, len(eg.ptz))
+	for _, c := range eg.ptz {
+		controllers = append(controllers, c)
+	}
+	eg.ptzLock.Unlock()
+
+	leases := []PTZLease{}
+	for _, c := range controllers {
+		c.lock.Lock()
+		if c.lease != nil {
+			leases = append(leases, *c.lease)
+		}
+		c.lock.Unlock()
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].CameraID < leases[j].CameraID })
+	return leases
+}
+
+// handlePTZAPI reports the current PTZ locks
+func (eg *EdgeGateway) handlePTZAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.ptzLeases())
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Camera health states tracked by the quarantine manager
+const (
+	cameraStateHealthy     = "healthy"
+	cameraStateQuarantined = "quarantined"
+	cameraStateProbation   = "probation"
+)
+
+// QuarantineEntry describes a camera that is quarantined or on probation
+type QuarantineEntry struct {
+	CameraID  string    `json:"camera_id"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason"`
+	ErrorCode string    `json:"error_code,omitempty"` // of the last failure
+	Until     time.Time `json:"until,omitempty"`
+	Count     int       `json:"count"`
+
+	// resume is set when the camera was streaming when it was quarantined
+	resume   bool
+	cooldown time.Duration
+}
+
+// cameraRecord tracks recent failures and events for one camera
+type cameraRecord struct {
+	failures []time.Time
+	events   []time.Time
+	entry    *QuarantineEntry
+}
+
+// QuarantineManager stops the gateway from retry-looping against cameras
+// that keep crashing the ingest or flooding events
+type QuarantineManager struct {
+	cfg     *Config
+	cameras map[string]*cameraRecord
+	lock    sync.Mutex
+}
+
+func NewQuarantineManager(cfg *Config) *QuarantineManager {
+	return &QuarantineManager{
+		cfg:     cfg,
+		cameras: make(map[string]*cameraRecord),
+	}
+}
+
+func (q *QuarantineManager) record(cameraID string) *cameraRecord {
+	rec, exists := q.cameras[cameraID]
+	if !exists {
+		rec = &cameraRecord{}
+		q.cameras[cameraID] = rec
+	}
+	return rec
+}
+
+// RecordFailure notes an ingest failure; it returns true if the camera was
+// quarantined as a result
+func (q *QuarantineManager) RecordFailure(cameraID, reason string, streaming bool) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rec := q.record(cameraID)
+	now := time.Now()
+
+	// A failure while on probation sends the camera straight back
+	if rec.entry != nil && rec.entry.State == cameraStateProbation {
+		q.quarantine(rec, cameraID, reason, rec.entry.cooldown*2, streaming)
+		return true
+	}
+
+	rec.failures = pruneBefore(append(rec.failures, now), now.Add(-q.cfg.QuarantineFailureWindow))
+	if len(rec.failures) >= q.cfg.QuarantineFailureThreshold {
+		q.quarantine(rec, cameraID, reason, q.cfg.QuarantineCooldown, streaming)
+		return true
+	}
+	return false
+}
+
+// RecordEvent notes an event from a camera; it returns true if the camera
+// was quarantined for flooding
+func (q *QuarantineManager) RecordEvent(cameraID string) bool {
+	if q.cfg.QuarantineEventRate <= 0 {
+		return false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rec := q.record(cameraID)
+	if rec.entry != nil && rec.entry.State == cameraStateQuarantined {
+		return false
+	}
+
+	now := time.Now()
+	rec.events = pruneBefore(append(rec.events, now), now.Add(-time.Minute))
+	if len(rec.events) > q.cfg.QuarantineEventRate {
+		q.quarantine(rec, cameraID, "event flood", q.cfg.QuarantineCooldown, false)
+		return true
+	}
+	return false
+}
+
+// RecordSuccess clears failure history once a camera has behaved for the
+// probation period
+func (q *QuarantineManager) RecordSuccess(cameraID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rec := q.record(cameraID)
+	rec.failures = nil
+	if rec.entry != nil && rec.entry.State == cameraStateProbation {
+		log.Printf("Camera %s passed probation", cameraID)
+		rec.entry = nil
+	}
+}
+
+// quarantine must be called with the lock held
+func (q *QuarantineManager) quarantine(rec *cameraRecord, cameraID, reason string, cooldown time.Duration, streaming bool) {
+	if cooldown > q.cfg.QuarantineMaxCooldown {
+		cooldown = q.cfg.QuarantineMaxCooldown
+	}
+
+	count := 1
+	resume := streaming
+	if rec.entry != nil {
+		count = rec.entry.Count + 1
+		resume = resume || rec.entry.resume
+	}
+
+	rec.failures = nil
+	rec.events = nil
+	rec.entry = &QuarantineEntry{
+		CameraID:  cameraID,
+		State:     cameraStateQuarantined,
+		Reason:    reason,
+		ErrorCode: errorMessageCode(reason),
+		Until:     time.Now().Add(cooldown),
+		Count:     count,
+		resume:    resume,
+		cooldown:  cooldown,
+	}
+	log.Printf("Camera %s quarantined for %s: %s", cameraID, cooldown, reason)
+}
+
+// IsQuarantined reports whether the camera is currently held off
+func (q *QuarantineManager) IsQuarantined(cameraID string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rec, exists := q.cameras[cameraID]
+	return exists && rec.entry != nil && rec.entry.State == cameraStateQuarantined
+}
+
+// State returns the camera's health state
+func (q *QuarantineManager) State(cameraID string) string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if rec, exists := q.cameras[cameraID]; exists && rec.entry != nil {
+		return rec.entry.State
+	}
+	return cameraStateHealthy
+}
+
+// Release lifts a quarantine; it returns the released entry or nil
+func (q *QuarantineManager) Release(cameraID string) *QuarantineEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rec, exists := q.cameras[cameraID]
+	if !exists || rec.entry == nil {
+		return nil
+	}
+	entry := rec.entry
+	delete(q.cameras, cameraID)
+	return entry
+}
+
+// dueForProbation moves cameras whose cooldown has expired onto probation
+// and returns them
+func (q *QuarantineManager) dueForProbation() []QuarantineEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var due []QuarantineEntry
+	now := time.Now()
+	for _, rec := range q.cameras {
+		if rec.entry != nil && rec.entry.State == cameraStateQuarantined && now.After(rec.entry.Until) {
+			rec.entry.State = cameraStateProbation
+			due = append(due, *rec.entry)
+		}
+	}
+	return due
+}
+
+// List returns all cameras that are quarantined or on probation
+func (q *QuarantineManager) List() []QuarantineEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entries := []QuarantineEntry{}
+	for _, rec := range q.cameras {
+		if rec.entry != nil {
+			entries = append(entries, *rec.entry)
+		}
+	}
+	return entries
+}
+
+// pruneBefore drops timestamps older than cutoff
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// monitorQuarantine periodically re-tests quarantined cameras whose cooldown
+// has expired
+func (eg *EdgeGateway) monitorQuarantine(ctx context.Context) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, entry := range eg.quarantine.dueForProbation() {
+				entry := entry
+				eg.goTracked(func() { eg.probeQuarantinedCamera(entry) })
+			}
+		}
+	}
+}
+
+// probeQuarantinedCamera re-tests a camera on probation and either resumes
+// it or sends it back to quarantine
+func (eg *EdgeGateway) probeQuarantinedCamera(entry QuarantineEntry) {
+	eg.camerasLock.RLock()
+	camera, exists := eg.cameras[entry.CameraID]
+	eg.camerasLock.RUnlock()
+	if !exists {
+		eg.quarantine.Release(entry.CameraID)
+		return
+	}
+
+	var err error
+	if camera.Device != "" {
+		err = localDeviceReady(camera)
+	} else {
+		err = probeRTSP(eg.ctx, eg.credentials.URL(camera.ID, camera.RTSPUrl), cameraTLSConfig(eg.cfg, camera), 5*time.Second)
+	}
+	if err != nil {
+		eg.quarantine.RecordFailure(camera.ID, "probation test failed: "+err.Error(), entry.resume)
+		eg.notifyQuarantine(camera.ID)
+		return
+	}
+
+	log.Printf("Camera %s on probation", camera.ID)
+	eg.notifyQuarantine(camera.ID)
+	if entry.resume {
+		// The stream must stay up for the probation period to clear it
+		eg.startStream(camera.ID)
+	} else {
+		eg.quarantine.RecordSuccess(camera.ID)
+	}
+}
+
+// releaseCamera manually lifts a camera's quarantine
+func (eg *EdgeGateway) releaseCamera(cameraID string) bool {
+	entry := eg.quarantine.Release(cameraID)
+	if entry == nil {
+		return false
+	}
+
+	log.Printf("Camera %s released from quarantine", cameraID)
+	eg.sendEvent("camera_status", map[string]interface{}{
+		"camera_id": cameraID,
+		"status":    "released",
+	})
+	if entry.resume {
+		eg.startStream(cameraID)
+	}
+	return true
+}
+
+// notifyQuarantine sends the camera's current quarantine state to cloud
+func (eg *EdgeGateway) notifyQuarantine(cameraID string) {
+	for _, entry := range eg.quarantine.List() {
+		if entry.CameraID == cameraID {
+			eg.sendEvent("camera_status", map[string]interface{}{
+				"camera_id":  cameraID,
+				"status":     entry.State,
+				"quarantine": entry,
+			})
+			return
+		}
+	}
+}
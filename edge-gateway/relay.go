@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	srt "github.com/datarhei/gosrt"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtmp"
+	"github.com/deepch/vdk/format/ts"
+)
+
+// Relay states reported in relay_status messages
+const (
+	relayStateConnecting = "connecting"
+	relayStateLive       = "live"
+	relayStateRetrying   = "retrying"
+	relayStateStopped    = "stopped"
+)
+
+// relayQueueSize is how many packets a relay buffers before dropping
+const relayQueueSize = 512
+
+// RelayRequest is the payload of a start_relay message
+type RelayRequest struct {
+	RelayID   string `json:"relay_id,omitempty"`
+	CameraID  string `json:"camera_id"`
+	URL       string `json:"url"`
+	StreamKey string `json:"stream_key,omitempty"`
+}
+
+// RelayStatus describes a relay for relay_status messages and the local API
+type RelayStatus struct {
+	RelayID  string    `json:"relay_id"`
+	CameraID string    `json:"camera_id"`
+	URL      string    `json:"url"` // without stream key or credentials
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"`
+	Dropped  int       `json:"dropped_packets"`
+}
+
+// relayOutput is an RTMP or SRT publishing connection
+type relayOutput interface {
+	WriteHeader(codecs []av.CodecData) error
+	WritePacket(pkt av.Packet) error
+	Close() error
+}
+
+// relayEvent is either a new session's codecs or a packet
+type relayEvent struct {
+	codecs []av.CodecData
+	packet av.Packet
+}
+
+// Relay pushes a camera stream to an external RTMP or SRT ingest
+type Relay struct {
+	eg     *EdgeGateway
+	req    RelayRequest
+	stream *CameraStream
+	events chan relayEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock   sync.Mutex
+	status RelayStatus
+	// waitKey drops packets until the next keyframe after an overflow
+	waitKey bool
+}
+
+// Reset implements packetSink
+func (r *Relay) Reset(codecs []av.CodecData) {
+	select {
+	case r.events <- relayEvent{codecs: codecs}:
+	default:
+		r.drop()
+	}
+}
+
+// WritePacket implements packetSink without blocking the ingest
+func (r *Relay) WritePacket(pkt av.Packet) {
+	r.lock.Lock()
+	if r.waitKey && !pkt.IsKeyFrame {
+		r.lock.Unlock()
+		return
+	}
+	r.waitKey = false
+	r.lock.Unlock()
+
+	select {
+	case r.events <- relayEvent{packet: pkt}:
+	default:
+		r.drop()
+	}
+}
+
+func (r *Relay) drop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status.Dropped++
+	r.waitKey = true
+}
+
+// Status returns a copy of the relay's status
+func (r *Relay) Status() RelayStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+func (r *Relay) setState(state string, err error) {
+	r.lock.Lock()
+	r.status.State = state
+	r.status.Error = ""
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	r.status.Since = time.Now()
+	status := r.status
+	r.lock.Unlock()
+
+	r.eg.sendEvent("relay_status", status)
+}
+
+// run publishes to the destination, reconnecting with backoff on errors,
+// until the relay or its stream is stopped
+func (r *Relay) run() {
+	defer func() {
+		r.stream.removeSink(r)
+		r.eg.releaseViewer(r.stream)
+		r.eg.removeRelay(r)
+		r.eg.releaseOutbound(relaySession(r.req.RelayID))
+		r.setState(relayStateStopped, nil)
+	}()
+
+	var codecs []av.CodecData
+	for attempt := 1; ; attempt++ {
+		// Wait for the stream's codecs before connecting
+		for codecs == nil {
+			select {
+			case <-r.ctx.Done():
+				return
+			case ev := <-r.events:
+				codecs = ev.codecs
+			}
+		}
+
+		r.setState(relayStateConnecting, nil)
+		next, err := r.publish(codecs)
+		if err == nil {
+			return
+		}
+		codecs = next
+		log.Printf("Relay %s to %s failed: %v", r.req.RelayID, r.status.URL, err)
+		r.setState(relayStateRetrying, err)
+
+		delay := time.Duration(attempt) * 2 * time.Second
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// publish runs one connection to the destination. It returns nil when the
+// relay is stopped, or the error and the latest codecs seen.
+func (r *Relay) publish(codecs []av.CodecData) ([]av.CodecData, error) {
+	out, err := dialRelayOutput(r.req.URL, r.req.StreamKey)
+	if err != nil {
+		if r.ctx.Err() != nil {
+			return nil, nil
+		}
+		return codecs, err
+	}
+	defer out.Close()
+
+	// Only forward codecs the containers can carry
+	supported, idx := relayCodecs(codecs)
+	if len(supported) == 0 {
+		return codecs, fmt.Errorf("no codec the destination supports")
+	}
+	if err := out.WriteHeader(supported); err != nil {
+		return codecs, err
+	}
+	r.setState(relayStateLive, nil)
+
+	started := false
+	for {
+		select {
+		case <-r.ctx.Done():
+			return nil, nil
+		case ev := <-r.events:
+			if ev.codecs != nil {
+				// A new ingest session may change codec parameters
+				return ev.codecs, fmt.Errorf("camera stream restarted")
+			}
+
+			pkt := ev.packet
+			newIdx, ok := idx[pkt.Idx]
+			if !ok {
+				continue
+			}
+			// Start the output on a keyframe
+			if !started {
+				if !pkt.IsKeyFrame {
+					continue
+				}
+				started = true
+			}
+			pkt.Idx = newIdx
+			if err := out.WritePacket(pkt); err != nil {
+				return codecs, err
+			}
+		}
+	}
+}
+
+// relayCodecs picks the H.264 and AAC streams, returning them and a map
+// from ingest stream index to output index
+func relayCodecs(codecs []av.CodecData) ([]av.CodecData, map[int8]int8) {
+	var supported []av.CodecData
+	idx := make(map[int8]int8)
+	for i, codec := range codecs {
+		if codec.Type() == av.H264 || codec.Type() == av.AAC {
+			idx[int8(i)] = int8(len(supported))
+			supported = append(supported, codec)
+		}
+	}
+	return supported, idx
+}
+
+// dialRelayOutput connects to an rtmp:// or srt:// destination
+func dialRelayOutput(rawURL, streamKey string) (relayOutput, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "rtmp":
+		if streamKey != "" {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/" + streamKey
+		}
+		conn, err := rtmp.DialTimeout(u.String(), 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+
+	case "srt":
+		config := srt.DefaultConfig()
+		// Keep SRT payloads aligned to whole TS packets
+		config.PayloadSize = 7 * 188
+		address, err := config.UnmarshalURL(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if streamKey != "" {
+			config.StreamId = streamKey
+		}
+		conn, err := srt.Dial("srt", address, config)
+		if err != nil {
+			return nil, err
+		}
+		return newSRTOutput(conn), nil
+	}
+	return nil, fmt.Errorf("unsupported relay URL scheme %q", u.Scheme)
+}
+
+// srtOutput muxes packets into MPEG-TS over an SRT connection
+type srtOutput struct {
+	conn srt.Conn
+	buf  *bufio.Writer
+	mux  *ts.Muxer
+}
+
+func newSRTOutput(conn srt.Conn) *srtOutput {
+	buf := bufio.NewWriterSize(conn, 7*188)
+	return &srtOutput{conn: conn, buf: buf, mux: ts.NewMuxer(buf)}
+}
+
+func (o *srtOutput) WriteHeader(codecs []av.CodecData) error {
+	if err := o.mux.WriteHeader(codecs); err != nil {
+		return err
+	}
+	return o.buf.Flush()
+}
+
+func (o *srtOutput) WritePacket(pkt av.Packet) error {
+	if err := o.mux.WritePacket(pkt); err != nil {
+		return err
+	}
+	return o.buf.Flush()
+}
+
+func (o *srtOutput) Close() error {
+	return o.conn.Close()
+}
+
+// redactURL strips credentials and query parameters from a destination URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// startRelay begins pushing a camera's main stream to an external ingest
+func (eg *EdgeGateway) startRelay(req RelayRequest) (*RelayStatus, error) {
+	if _, err := url.Parse(req.URL); err != nil || req.URL == "" {
+		return nil, fmt.Errorf("invalid relay url")
+	}
+	if req.RelayID == "" {
+		req.RelayID = "relay-" + randomHex(4)
+	}
+
+	eg.relaysLock.Lock()
+	if _, exists := eg.relays[req.RelayID]; exists {
+		eg.relaysLock.Unlock()
+		return nil, fmt.Errorf("relay %s already exists", req.RelayID)
+	}
+	eg.relaysLock.Unlock()
+
+	// Relays send the main stream as is
+	if _, err := eg.admitOutbound(relaySession(req.RelayID), req.CameraID, viewerProfileMain, false); err != nil {
+		return nil, err
+	}
+	stream, err := eg.openStream(req.CameraID, viewerProfileMain, true)
+	if err != nil {
+		eg.releaseOutbound(relaySession(req.RelayID))
+		return nil, err
+	}
+	stream.addViewer()
+
+	ctx, cancel := context.WithCancel(stream.ctx)
+	relay := &Relay{
+		eg:     eg,
+		req:    req,
+		stream: stream,
+		events: make(chan relayEvent, relayQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		status: RelayStatus{
+			RelayID:  req.RelayID,
+			CameraID: req.CameraID,
+			URL:      redactURL(req.URL),
+			State:    relayStateConnecting,
+			Since:    time.Now(),
+		},
+	}
+
+	eg.relaysLock.Lock()
+	eg.relays[req.RelayID] = relay
+	eg.relaysLock.Unlock()
+
+	stream.addSink(relay)
+	eg.goTracked(relay.run)
+
+	log.Printf("Relaying camera %s to %s", req.CameraID, relay.status.URL)
+	status := relay.Status()
+	return &status, nil
+}
+
+// stopRelay stops a relay by ID, or every relay of a camera. A relay is
+// found by its ID alone, so its camera is checked against the sender's
+// tenant before anything is stopped.
+func (eg *EdgeGateway) stopRelay(origin AuditOrigin, relayID, cameraID string) error {
+	var matched []*Relay
+	eg.relaysLock.Lock()
+	for id, relay := range eg.relays {
+		if id == relayID || (relayID == "" && relay.req.CameraID == cameraID) {
+			matched = append(matched, relay)
+		}
+	}
+	eg.relaysLock.Unlock()
+
+	if len(matched) == 0 {
+		return errors.New("no matching relay")
+	}
+	for _, relay := range matched {
+		if err := eg.authorizeCamera(origin, relay.req.CameraID); err != nil {
+			return err
+		}
+	}
+	for _, relay := range matched {
+		relay.cancel()
+	}
+	return nil
+}
+
+// relaySession names a relay's uplink reservation apart from viewers'
+func relaySession(relayID string) string {
+	return "relay:" + relayID
+}
+
+func (eg *EdgeGateway) removeRelay(relay *Relay) {
+	eg.relaysLock.Lock()
+	defer eg.relaysLock.Unlock()
+	if eg.relays[relay.req.RelayID] == relay {
+		delete(eg.relays, relay.req.RelayID)
+	}
+}
+
+// listRelays returns the status of every active relay
+func (eg *EdgeGateway) listRelays() []RelayStatus {
+	eg.relaysLock.Lock()
+	defer eg.relaysLock.Unlock()
+
+	relays := []RelayStatus{}
+	for _, relay := range eg.relays {
+		relays = append(relays, relay.Status())
+	}
+	sort.Slice(relays, func(i, j int) bool { return relays[i].RelayID < relays[j].RelayID })
+	return relays
+}
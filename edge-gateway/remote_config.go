@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings are the parts of the configuration the cloud can change at run
+// time with set_config. They start from the environment; read them through
+// eg.settings().
+type Settings struct {
+	ScanSubnets    []*net.IPNet
+	ScanAllowCIDRs []*net.IPNet
+	ScanDenyCIDRs  []*net.IPNet
+	ScanInterval   time.Duration
+	// Discovery policy
+	CameraAllowOUIs   []string
+	CameraDenyOUIs    []string
+	CameraAllowModels []string
+	CameraDenyModels  []string
+	CameraApproval    bool
+	IgnoredIPs        []net.IP
+	// Uplink budgets, 0 if unlimited
+	UplinkBudgetKbps       int
+	CameraUplinkBudgetKbps int
+	CameraUplinkBudgets    map[string]int
+	MaxOutboundStreams     int
+	ICEServers             []ICEServerConfig // nil for the default STUN server
+	HLSEnabled             bool
+	HLSCameras             []string
+	SimulcastCameras       []string
+	LogLevel               string
+	// Video overlay, by default and per camera
+	Overlay        OverlayConfig
+	CameraOverlays map[string]OverlayConfig
+}
+
+// ICEServerConfig is a STUN or TURN server for viewer peer connections
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// RemoteConfig is a set_config delta: fields left out are unchanged, and an
+// empty list clears a list. config_ack reports the effective settings in the
+// same form, without ICE server credentials.
+type RemoteConfig struct {
+	ScanSubnets    *[]string `json:"scan_subnets,omitempty"`
+	ScanAllowCIDRs *[]string `json:"scan_allow_cidrs,omitempty"`
+	ScanDenyCIDRs  *[]string `json:"scan_deny_cidrs,omitempty"`
+	ScanInterval   *string   `json:"scan_interval,omitempty"`
+
+	CameraAllowOUIs   *[]string `json:"camera_allow_ouis,omitempty"`
+	CameraDenyOUIs    *[]string `json:"camera_deny_ouis,omitempty"`
+	CameraAllowModels *[]string `json:"camera_allow_models,omitempty"`
+	CameraDenyModels  *[]string `json:"camera_deny_models,omitempty"`
+	CameraApproval    *bool     `json:"camera_approval_required,omitempty"`
+	IgnoredIPs        *[]string `json:"ignored_ips,omitempty"`
+
+	UplinkBudgetKbps       *int            `json:"uplink_budget_kbps,omitempty"`
+	CameraUplinkBudgetKbps *int            `json:"camera_uplink_budget_kbps,omitempty"`
+	CameraUplinkBudgets    *map[string]int `json:"camera_uplink_budgets,omitempty"`
+	MaxOutboundStreams     *int            `json:"max_outbound_streams,omitempty"`
+
+	ICEServers *[]ICEServerConfig `json:"ice_servers,omitempty"`
+	HLSEnabled *bool              `json:"hls_enabled,omitempty"`
+	HLSCameras *[]string          `json:"hls_cameras,omitempty"`
+	LogLevel   *string            `json:"log_level,omitempty"`
+
+	SimulcastCameras *[]string `json:"simulcast_cameras,omitempty"`
+
+	Overlay        *OverlayConfig            `json:"overlay,omitempty"`
+	CameraOverlays *map[string]OverlayConfig `json:"camera_overlays,omitempty"`
+}
+
+// settingsFromConfig returns the settings given by the environment
+func settingsFromConfig(cfg *Config) Settings {
+	return Settings{
+		ScanSubnets:    cfg.ScanSubnets,
+		ScanAllowCIDRs: cfg.ScanAllowCIDRs,
+		ScanDenyCIDRs:  cfg.ScanDenyCIDRs,
+		ScanInterval:   cfg.ScanInterval,
+
+		CameraAllowOUIs:   cfg.CameraAllowOUIs,
+		CameraDenyOUIs:    cfg.CameraDenyOUIs,
+		CameraAllowModels: cfg.CameraAllowModels,
+		CameraDenyModels:  cfg.CameraDenyModels,
+		CameraApproval:    cfg.CameraApproval,
+		IgnoredIPs:        cfg.IgnoredIPs,
+
+		UplinkBudgetKbps:       cfg.UplinkBudgetKbps,
+		CameraUplinkBudgetKbps: cfg.CameraUplinkBudgetKbps,
+		CameraUplinkBudgets:    cfg.CameraUplinkBudgets,
+		MaxOutboundStreams:     cfg.MaxOutboundStreams,
+
+		HLSEnabled: cfg.HLSEnabled,
+		HLSCameras: cfg.HLSCameras,
+		LogLevel:   cfg.LogLevel,
+
+		SimulcastCameras: cfg.SimulcastCameras,
+
+		Overlay: cfg.Overlay,
+	}
+}
+
+// settings returns the current settings. Their slices are replaced, never
+// modified, so the copy can be used without the lock.
+func (eg *EdgeGateway) settings() Settings {
+	eg.settingsLock.RLock()
+	defer eg.settingsLock.RUnlock()
+	return eg.liveSettings
+}
+
+// merge returns c with the fields set in delta replaced
+func (c RemoteConfig) merge(delta RemoteConfig) RemoteConfig {
+	if delta.ScanSubnets != nil {
+		c.ScanSubnets = delta.ScanSubnets
+	}
+	if delta.ScanAllowCIDRs != nil {
+		c.ScanAllowCIDRs = delta.ScanAllowCIDRs
+	}
+	if delta.ScanDenyCIDRs != nil {
+		c.ScanDenyCIDRs = delta.ScanDenyCIDRs
+	}
+	if delta.ScanInterval != nil {
+		c.ScanInterval = delta.ScanInterval
+	}
+	if delta.CameraAllowOUIs != nil {
+		c.CameraAllowOUIs = delta.CameraAllowOUIs
+	}
+	if delta.CameraDenyOUIs != nil {
+		c.CameraDenyOUIs = delta.CameraDenyOUIs
+	}
+	if delta.CameraAllowModels != nil {
+		c.CameraAllowModels = delta.CameraAllowModels
+	}
+	if delta.CameraDenyModels != nil {
+		c.CameraDenyModels = delta.CameraDenyModels
+	}
+	if delta.CameraApproval != nil {
+		c.CameraApproval = delta.CameraApproval
+	}
+	if delta.IgnoredIPs != nil {
+		c.IgnoredIPs = delta.IgnoredIPs
+	}
+	if delta.UplinkBudgetKbps != nil {
+		c.UplinkBudgetKbps = delta.UplinkBudgetKbps
+	}
+	if delta.CameraUplinkBudgetKbps != nil {
+		c.CameraUplinkBudgetKbps = delta.CameraUplinkBudgetKbps
+	}
+	if delta.CameraUplinkBudgets != nil {
+		c.CameraUplinkBudgets = delta.CameraUplinkBudgets
+	}
+	if delta.MaxOutboundStreams != nil {
+		c.MaxOutboundStreams = delta.MaxOutboundStreams
+	}
+	if delta.ICEServers != nil {
+		c.ICEServers = delta.ICEServers
+	}
+	if delta.HLSEnabled != nil {
+		c.HLSEnabled = delta.HLSEnabled
+	}
+	if delta.HLSCameras != nil {
+		c.HLSCameras = delta.HLSCameras
+	}
+	if delta.LogLevel != nil {
+		c.LogLevel = delta.LogLevel
+	}
+	if delta.SimulcastCameras != nil {
+		c.SimulcastCameras = delta.SimulcastCameras
+	}
+	if delta.Overlay != nil {
+		c.Overlay = delta.Overlay
+	}
+	if delta.CameraOverlays != nil {
+		c.CameraOverlays = delta.CameraOverlays
+	}
+	return c
+}
+
+// apply validates c and returns s with it applied. Nothing is applied if any
+// field is invalid.
+func (c RemoteConfig) apply(s Settings) (Settings, error) {
+	var err error
+	if c.ScanSubnets != nil {
+		if s.ScanSubnets, err = parseCIDRList("scan_subnets", *c.ScanSubnets); err != nil {
+			return s, err
+		}
+	}
+	if c.ScanAllowCIDRs != nil {
+		if s.ScanAllowCIDRs, err = parseCIDRList("scan_allow_cidrs", *c.ScanAllowCIDRs); err != nil {
+			return s, err
+		}
+	}
+	if c.ScanDenyCIDRs != nil {
+		if s.ScanDenyCIDRs, err = parseCIDRList("scan_deny_cidrs", *c.ScanDenyCIDRs); err != nil {
+			return s, err
+		}
+	}
+	if c.ScanInterval != nil {
+		d, err := time.ParseDuration(*c.ScanInterval)
+		if err != nil || d < 0 {
+			return s, fmt.Errorf("invalid scan_interval %q", *c.ScanInterval)
+		}
+		s.ScanInterval = d
+	}
+	if c.CameraAllowOUIs != nil {
+		if s.CameraAllowOUIs, err = parseOUIList("camera_allow_ouis", *c.CameraAllowOUIs); err != nil {
+			return s, err
+		}
+	}
+	if c.CameraDenyOUIs != nil {
+		if s.CameraDenyOUIs, err = parseOUIList("camera_deny_ouis", *c.CameraDenyOUIs); err != nil {
+			return s, err
+		}
+	}
+	if c.CameraAllowModels != nil {
+		if s.CameraAllowModels, err = parseModelList("camera_allow_models", *c.CameraAllowModels); err != nil {
+			return s, err
+		}
+	}
+	if c.CameraDenyModels != nil {
+		if s.CameraDenyModels, err = parseModelList("camera_deny_models", *c.CameraDenyModels); err != nil {
+			return s, err
+		}
+	}
+	if c.CameraApproval != nil {
+		s.CameraApproval = *c.CameraApproval
+	}
+	if c.IgnoredIPs != nil {
+		if s.IgnoredIPs, err = parseIPList("ignored_ips", *c.IgnoredIPs); err != nil {
+			return s, err
+		}
+	}
+	nonNegative := func(field string, value *int, dst *int) error {
+		if value == nil {
+			return nil
+		}
+		if *value < 0 {
+			return fmt.Errorf("invalid %s %d", field, *value)
+		}
+		*dst = *value
+		return nil
+	}
+	if err := nonNegative("uplink_budget_kbps", c.UplinkBudgetKbps, &s.UplinkBudgetKbps); err != nil {
+		return s, err
+	}
+	if err := nonNegative("camera_uplink_budget_kbps", c.CameraUplinkBudgetKbps, &s.CameraUplinkBudgetKbps); err != nil {
+		return s, err
+	}
+	if err := nonNegative("max_outbound_streams", c.MaxOutboundStreams, &s.MaxOutboundStreams); err != nil {
+		return s, err
+	}
+	if c.CameraUplinkBudgets != nil {
+		for cameraID, kbps := range *c.CameraUplinkBudgets {
+			if kbps < 0 {
+				return s, fmt.Errorf("invalid camera_uplink_budgets entry %s: %d", cameraID, kbps)
+			}
+		}
+		s.CameraUplinkBudgets = *c.CameraUplinkBudgets
+	}
+	if c.Overlay != nil {
+		overlay := *c.Overlay
+		if err := overlay.validate("overlay"); err != nil {
+			return s, err
+		}
+		s.Overlay = overlay
+	}
+	if c.CameraOverlays != nil {
+		overlays := make(map[string]OverlayConfig, len(*c.CameraOverlays))
+		for cameraID, overlay := range *c.CameraOverlays {
+			if err := overlay.validate("camera_overlays entry " + cameraID); err != nil {
+				return s, err
+			}
+			overlays[cameraID] = overlay
+		}
+		s.CameraOverlays = overlays
+	}
+	if c.ICEServers != nil {
+		for _, server := range *c.ICEServers {
+			if len(server.URLs) == 0 {
+				return s, fmt.Errorf("ice_servers entry without urls")
+			}
+			for _, u := range server.URLs {
+				scheme, host, _ := strings.Cut(u, ":")
+				switch {
+				case host == "":
+					return s, fmt.Errorf("invalid ICE server URL %q", u)
+				case scheme == "stun" || scheme == "stuns":
+				case scheme == "turn" || scheme == "turns":
+					if server.Username == "" || server.Credential == "" {
+						return s, fmt.Errorf("TURN server %q needs a username and credential", u)
+					}
+				default:
+					return s, fmt.Errorf("unsupported ICE server URL %q", u)
+				}
+			}
+		}
+		s.ICEServers = *c.ICEServers
+	}
+	if c.HLSEnabled != nil {
+		s.HLSEnabled = *c.HLSEnabled
+	}
+	if c.HLSCameras != nil {
+		s.HLSCameras = *c.HLSCameras
+	}
+	if c.SimulcastCameras != nil {
+		s.SimulcastCameras = *c.SimulcastCameras
+	}
+	if c.LogLevel != nil {
+		if !validLogLevel(*c.LogLevel) {
+			return s, fmt.Errorf("invalid log_level %q", *c.LogLevel)
+		}
+		s.LogLevel = *c.LogLevel
+	}
+	return s, nil
+}
+
+// parseCIDRList parses a list of CIDRs, rejecting any invalid entry
+func parseCIDRList(field string, items []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, item := range items {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q in %s", item, field)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// remoteConfig returns settings in set_config form
+func (s Settings) remoteConfig() RemoteConfig {
+	cidrs := func(nets []*net.IPNet) *[]string {
+		items := make([]string, 0, len(nets))
+		for _, n := range nets {
+			items = append(items, n.String())
+		}
+		return &items
+	}
+	interval := s.ScanInterval.String()
+	servers := make([]ICEServerConfig, 0, len(s.ICEServers))
+	for _, server := range s.ICEServers {
+		servers = append(servers, ICEServerConfig{URLs: server.URLs, Username: server.Username})
+	}
+	list := func(items []string) *[]string {
+		copied := append([]string{}, items...)
+		return &copied
+	}
+	ignored := make([]string, 0, len(s.IgnoredIPs))
+	for _, ip := range s.IgnoredIPs {
+		ignored = append(ignored, ip.String())
+	}
+	budgets := make(map[string]int, len(s.CameraUplinkBudgets))
+	for cameraID, kbps := range s.CameraUplinkBudgets {
+		budgets[cameraID] = kbps
+	}
+	hlsCameras := append([]string{}, s.HLSCameras...)
+	logLevel := s.LogLevel
+	overlay := s.Overlay
+	overlays := make(map[string]OverlayConfig, len(s.CameraOverlays))
+	for cameraID, o := range s.CameraOverlays {
+		overlays[cameraID] = o
+	}
+	return RemoteConfig{
+		ScanSubnets:    cidrs(s.ScanSubnets),
+		ScanAllowCIDRs: cidrs(s.ScanAllowCIDRs),
+		ScanDenyCIDRs:  cidrs(s.ScanDenyCIDRs),
+		ScanInterval:   &interval,
+
+		CameraAllowOUIs:   list(s.CameraAllowOUIs),
+		CameraDenyOUIs:    list(s.CameraDenyOUIs),
+		CameraAllowModels: list(s.CameraAllowModels),
+		CameraDenyModels:  list(s.CameraDenyModels),
+		CameraApproval:    &s.CameraApproval,
+		IgnoredIPs:        &ignored,
+
+		UplinkBudgetKbps:       &s.UplinkBudgetKbps,
+		CameraUplinkBudgetKbps: &s.CameraUplinkBudgetKbps,
+		CameraUplinkBudgets:    &budgets,
+		MaxOutboundStreams:     &s.MaxOutboundStreams,
+
+		ICEServers: &servers,
+		HLSEnabled: &s.HLSEnabled,
+		HLSCameras: &hlsCameras,
+		LogLevel:   &logLevel,
+
+		SimulcastCameras: list(s.SimulcastCameras),
+
+		Overlay:        &overlay,
+		CameraOverlays: &overlays,
+	}
+}
+
+func (eg *EdgeGateway) remoteConfigPath() string {
+	return filepath.Join(eg.cfg.DataDir, "config.json")
+}
+
+// loadRemoteConfig applies the settings saved by the last set_config over
+// the environment
+func (eg *EdgeGateway) loadRemoteConfig() {
+	data, err := os.ReadFile(eg.remoteConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read saved config: %v", err)
+		}
+		return
+	}
+	var saved RemoteConfig
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Ignoring unreadable saved config: %v", err)
+		return
+	}
+	eg.settingsLock.Lock()
+	settings, err := saved.apply(eg.baseSettings)
+	if err != nil {
+		eg.settingsLock.Unlock()
+		log.Printf("Ignoring saved config: %v", err)
+		return
+	}
+	eg.remoteConfig = saved
+	eg.liveSettings = settings
+	eg.settingsLock.Unlock()
+	setLogLevel(settings.LogLevel)
+	log.Printf("Applied config saved from the cloud")
+}
+
+// handleSetConfig applies a set_config delta on top of earlier ones, saves
+// the result so it survives restarts, and acks with the effective settings.
+// Scan settings take effect from the next scan, ICE servers for new viewers,
+// HLS settings for streams started afterwards, and overlays at once. It
+// returns why a delta was rejected.
+func (eg *EdgeGateway) handleSetConfig(delta RemoteConfig) error {
+	eg.settingsLock.Lock()
+	merged := eg.remoteConfig.merge(delta)
+	settings, err := merged.apply(eg.baseSettings)
+	if err != nil {
+		current := eg.liveSettings
+		eg.settingsLock.Unlock()
+		log.Printf("Rejected set_config: %v", err)
+		eg.sendEvent("config_ack", map[string]interface{}{
+			"applied": false,
+			"error":   err.Error(),
+			"config":  current.remoteConfig(),
+		})
+		return err
+	}
+	previous := eg.liveSettings
+	eg.remoteConfig = merged
+	eg.liveSettings = settings
+	eg.settingsLock.Unlock()
+	eg.settingsChanged(previous, settings)
+
+	saved := true
+	data, _ := json.Marshal(merged)
+	if err := writeFileAtomic(eg.remoteConfigPath(), data); err != nil {
+		log.Printf("Failed to save config: %v", err)
+		saved = false
+	}
+
+	log.Printf("Applied config from the cloud")
+	eg.sendEvent("config_ack", map[string]interface{}{
+		"applied": true,
+		"saved":   saved,
+		"config":  settings.remoteConfig(),
+	})
+	return nil
+}
+
+// settingsChanged puts new settings into effect: the log level and
+// overlays at once, and the scan interval from the next scan
+func (eg *EdgeGateway) settingsChanged(previous, current Settings) {
+	setLogLevel(current.LogLevel)
+	if current.ScanInterval != previous.ScanInterval {
+		eg.scanner.Reschedule()
+	}
+	eg.restartOverlaid(previous, current)
+}
+
+// reloadConfig loads the configuration again, as on SIGHUP, and applies
+// the settings set_config can change, under the cloud's own. The default
+// camera credentials are read afresh too; other settings need a restart.
+func (eg *EdgeGateway) reloadConfig() error {
+	base := settingsFromConfig(loadConfig())
+
+	eg.settingsLock.Lock()
+	settings, err := eg.remoteConfig.apply(base)
+	if err != nil {
+		eg.settingsLock.Unlock()
+		return err
+	}
+	previous := eg.liveSettings
+	eg.baseSettings = base
+	eg.liveSettings = settings
+	eg.settingsLock.Unlock()
+	eg.settingsChanged(previous, settings)
+	return nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SessionUpdate is the update_session payload. Fields left out are
+// unchanged.
+type SessionUpdate struct {
+	SessionID string `json:"session_id"`
+	// Profile switches the viewer to another stream of its camera
+	Profile string `json:"profile,omitempty"`
+	// Audio adds or removes the camera's audio
+	Audio *bool `json:"audio,omitempty"`
+	// AddCameras and RemoveCameras add or remove the video of other
+	// cameras, sent alongside the session's own
+	AddCameras    []string `json:"add_cameras,omitempty"`
+	RemoveCameras []string `json:"remove_cameras,omitempty"`
+	// Watermark sets the viewer identity drawn on the video, or removes
+	// it if empty
+	Watermark *string `json:"watermark,omitempty"`
+	// Token permits the session to view AddCameras, if
+	// STREAM_TOKEN_PUBLIC_KEY requires one
+	Token string `json:"token,omitempty"`
+}
+
+// viewerCamera is another camera sent on a viewer's connection
+type viewerCamera struct {
+	stream *CameraStream
+	sender *webrtc.RTPSender
+}
+
+// cameraOutboundID is the uplink reservation of another camera on a
+// viewer's connection
+func cameraOutboundID(sessionID, cameraID string) string {
+	return sessionID + "/" + cameraID
+}
+
+// updateSession changes the tracks of a viewer's peer connection without
+// tearing it down. Profile switches replace the video track in place; the
+// other changes are renegotiated with a webrtc_renegotiate offer. Changes
+// made before one fails are kept, and still renegotiated.
+func (eg *EdgeGateway) updateSession(req SessionUpdate) error {
+	v := eg.viewer(req.SessionID)
+	if v == nil {
+		return errors.New("no such viewer session")
+	}
+	negotiate := req.Audio != nil || len(req.AddCameras) > 0 || len(req.RemoveCameras) > 0
+	if negotiate {
+		if v.Kind != viewerKindWebRTC {
+			return errors.New("WHEP sessions can't be renegotiated, only switch profile")
+		}
+		if v.pc.SignalingState() != webrtc.SignalingStateStable {
+			return errors.New("viewer session is already negotiating")
+		}
+	}
+	if len(req.AddCameras) > 0 {
+		if err := eg.authorizeStream(req.Token, v.ID, req.AddCameras...); err != nil {
+			return err
+		}
+	}
+
+	changed, err := eg.applySessionUpdate(v, req)
+	if changed {
+		// Profile switches need no new offer
+		if negotiate {
+			if negotiateErr := eg.renegotiate(v, "update_session"); err == nil {
+				err = negotiateErr
+			}
+		}
+		eg.sendEvent("session_updated", v.tracksPayload())
+	}
+	return err
+}
+
+// applySessionUpdate makes the changes of an update_session, reporting
+// whether any was made before one failed
+func (eg *EdgeGateway) applySessionUpdate(v *Viewer, req SessionUpdate) (bool, error) {
+	changed := false
+	if req.Profile != "" {
+		switched, err := eg.switchViewerProfile(v, req.Profile)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || switched
+	}
+	if req.Watermark != nil {
+		switched, err := eg.setViewerWatermark(v, *req.Watermark)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || switched
+	}
+	if req.Audio != nil {
+		if err := eg.setViewerAudio(v, *req.Audio); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	for _, cameraID := range req.RemoveCameras {
+		if err := eg.removeViewerCamera(v, cameraID); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	for _, cameraID := range req.AddCameras {
+		if err := eg.addViewerCamera(v, cameraID); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// switchViewerProfile moves a viewer to another stream of its camera. It
+// reports whether the profile changed.
+func (eg *EdgeGateway) switchViewerProfile(v *Viewer, profile string) (bool, error) {
+	profile, err := normalizeViewerProfile(profile)
+	if err != nil {
+		return false, err
+	}
+	v.lock.Lock()
+	current, wm, layered, replaying := v.Profile, v.watermark, v.layers != nil, v.replay != nil
+	v.lock.Unlock()
+	switch {
+	case layered:
+		return false, errors.New("simulcast viewer sessions switch with select_layer")
+	case replaying:
+		return false, errors.New("viewer session is playing a recording")
+	case profile == current:
+		return false, nil
+	}
+
+	if err := eg.switchOutbound(v.ID, v.CameraID, profile); err != nil {
+		return false, err
+	}
+	if err := eg.switchViewerStream(v, profile, wm); err != nil {
+		eg.switchOutbound(v.ID, v.CameraID, current)
+		return false, err
+	}
+	log.Printf("Viewer session %s switched to %s profile of camera %s", v.ID, profileName(profile), v.CameraID)
+	return true, nil
+}
+
+// setViewerWatermark moves a viewer to a stream with another watermark, or
+// none if text is empty. It reports whether the watermark changed.
+func (eg *EdgeGateway) setViewerWatermark(v *Viewer, text string) (bool, error) {
+	wm := newWatermark(v.ID, text)
+	v.lock.Lock()
+	current, profile, layered, replaying := v.watermark, v.Profile, v.layers != nil, v.replay != nil
+	v.lock.Unlock()
+	switch {
+	case layered:
+		return false, errors.New("simulcast viewer sessions can't be watermarked")
+	case replaying:
+		return false, errors.New("viewer session is playing a recording")
+	case wm.equal(current):
+		return false, nil
+	}
+
+	if err := eg.switchViewerStream(v, profile, wm); err != nil {
+		return false, err
+	}
+	log.Printf("Viewer session %s of camera %s watermarked: %t", v.ID, v.CameraID, wm != nil)
+	return true, nil
+}
+
+// switchViewerStream moves a viewer to the stream of a profile and
+// watermark, replacing the track its video sender sends
+func (eg *EdgeGateway) switchViewerStream(v *Viewer, profile string, wm *streamWatermark) error {
+	stream, err := eg.openVariantStream(v.CameraID, profile, v.Codec, wm, true)
+	if err != nil {
+		return err
+	}
+	stream.addViewer()
+
+	v.lock.Lock()
+	if err := v.sender.ReplaceTrack(stream.videoTrack); err != nil {
+		v.lock.Unlock()
+		eg.releaseViewer(stream)
+		return fmt.Errorf("failed to switch video track: %v", err)
+	}
+	previous := v.profileStream
+	v.stream, v.profileStream, v.Profile, v.watermark = stream, stream, profile, wm
+	if v.audioSender != nil {
+		// nil stops the audio until the new stream has some
+		var track webrtc.TrackLocal
+		if audio := stream.audio(); audio != nil {
+			track = audio
+		}
+		if err := v.audioSender.ReplaceTrack(track); err != nil {
+			log.Printf("Failed to switch audio track of session %s: %v", v.ID, err)
+		}
+	}
+	v.lock.Unlock()
+
+	eg.releaseViewer(previous)
+	stream.sendBufferedKeyframe()
+	return nil
+}
+
+// setViewerAudio adds or removes the audio of a viewer's camera. Audio isn't
+// end-to-end encrypted, so encrypted cameras don't send it.
+func (eg *EdgeGateway) setViewerAudio(v *Viewer, on bool) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if !on {
+		if v.audioSender == nil {
+			return nil
+		}
+		if err := v.pc.RemoveTrack(v.audioSender); err != nil {
+			return fmt.Errorf("failed to remove audio track: %v", err)
+		}
+		v.audioSender = nil
+		return nil
+	}
+
+	if v.audioSender != nil {
+		return nil
+	}
+	if eg.e2ee.Get(v.CameraID) != nil {
+		return errors.New("audio of end-to-end encrypted cameras isn't sent")
+	}
+	track := v.profileStream.audio()
+	if track == nil {
+		return errors.New("camera stream has no G.711 or Opus audio")
+	}
+	sender, err := v.pc.AddTrack(track)
+	if err != nil {
+		return fmt.Errorf("failed to add audio track: %v", err)
+	}
+	go drainRTCP(sender)
+	v.audioSender = sender
+	return nil
+}
+
+// addViewerCamera sends another camera's main stream, or the best profile
+// its uplink budget allows, on a viewer's connection
+func (eg *EdgeGateway) addViewerCamera(v *Viewer, cameraID string) error {
+	v.lock.Lock()
+	_, exists := v.cameras[cameraID]
+	v.lock.Unlock()
+	if exists || cameraID == v.CameraID {
+		return nil
+	}
+	if eg.cfg.E2EERequired && eg.e2ee.Get(cameraID) == nil {
+		return fmt.Errorf("camera %s has no end-to-end encryption key", cameraID)
+	}
+	if tenant, exists := eg.cameraTenant(cameraID); exists && tenant != v.Tenant {
+		return errTenantDenied
+	}
+
+	outboundID := cameraOutboundID(v.ID, cameraID)
+	profile, err := eg.admitOutbound(outboundID, cameraID, viewerProfileMain, true)
+	if err != nil {
+		return err
+	}
+	stream, err := eg.openCodecStream(cameraID, profile, videoCodecH264, true)
+	if err != nil {
+		eg.releaseOutbound(outboundID)
+		return err
+	}
+	stream.addViewer()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	sender, err := v.pc.AddTrack(stream.videoTrack)
+	if err != nil {
+		eg.releaseViewer(stream)
+		eg.releaseOutbound(outboundID)
+		return fmt.Errorf("failed to add video track of camera %s: %v", cameraID, err)
+	}
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			v.touch()
+			stream.stats.recordRTCP(packets)
+		}
+	}()
+	if v.cameras == nil {
+		v.cameras = make(map[string]*viewerCamera)
+	}
+	v.cameras[cameraID] = &viewerCamera{stream: stream, sender: sender}
+	log.Printf("Viewer session %s added camera %s", v.ID, cameraID)
+	return nil
+}
+
+// removeViewerCamera stops sending another camera on a viewer's connection
+func (eg *EdgeGateway) removeViewerCamera(v *Viewer, cameraID string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	c, exists := v.cameras[cameraID]
+	if !exists {
+		return nil
+	}
+	if err := v.pc.RemoveTrack(c.sender); err != nil {
+		return fmt.Errorf("failed to remove video track of camera %s: %v", cameraID, err)
+	}
+	delete(v.cameras, cameraID)
+	eg.releaseViewer(c.stream)
+	eg.releaseOutbound(cameraOutboundID(v.ID, cameraID))
+	log.Printf("Viewer session %s removed camera %s", v.ID, cameraID)
+	return nil
+}
+
+// releaseViewerCameras releases the other cameras of a closed viewer
+func (eg *EdgeGateway) releaseViewerCameras(v *Viewer) {
+	v.lock.Lock()
+	cameras := v.cameras
+	v.cameras = nil
+	v.lock.Unlock()
+	for cameraID, c := range cameras {
+		eg.releaseViewer(c.stream)
+		eg.releaseOutbound(cameraOutboundID(v.ID, cameraID))
+	}
+}
+
+// renegotiate sends a cloud viewer an offer for its changed tracks as
+// webrtc_renegotiate. Like an ICE restart, the session is closed if no
+// answer comes back.
+func (eg *EdgeGateway) renegotiate(v *Viewer, reason string) error {
+	v.lock.Lock()
+	if v.pc.SignalingState() != webrtc.SignalingStateStable {
+		v.lock.Unlock()
+		return errors.New("viewer session is already negotiating")
+	}
+	offer, err := v.pc.CreateOffer(nil)
+	if err == nil {
+		err = v.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		v.lock.Unlock()
+		return fmt.Errorf("failed to create offer: %v", err)
+	}
+	v.restartGen++
+	gen := v.restartGen
+	v.lock.Unlock()
+	if v.simulcast {
+		offer.SDP = sendOnlySimulcast(offer.SDP)
+	}
+
+	log.Printf("Renegotiating camera %s viewer %s (%s)", v.CameraID, v.ID, reason)
+	payload := v.tracksPayload()
+	payload["reason"] = reason
+	payload["sdp"] = offer
+	eg.sendEvent("webrtc_renegotiate", payload)
+
+	time.AfterFunc(iceRestartTimeout, func() {
+		v.lock.Lock()
+		expired := v.restartGen == gen && v.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer
+		v.lock.Unlock()
+		if !expired {
+			return
+		}
+		log.Printf("No renegotiation answer for camera %s viewer %s, closing", v.CameraID, v.ID)
+		eg.sendEvent("webrtc_closed", map[string]interface{}{
+			"camera_id":  v.CameraID,
+			"session_id": v.ID,
+			"reason":     sessionReasonRestartTimeout,
+		})
+		v.close(sessionReasonRestartTimeout)
+	})
+	return nil
+}
+
+// handleRenegotiateAnswer applies the viewer's answer to a
+// webrtc_renegotiate offer
+func (eg *EdgeGateway) handleRenegotiateAnswer(sessionID string, answer webrtc.SessionDescription) {
+	v := eg.viewer(sessionID)
+	if v == nil {
+		log.Printf("No viewer session %s for renegotiation answer", sessionID)
+		return
+	}
+	if err := v.pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("Failed to apply renegotiation answer for session %s: %v", sessionID, err)
+	}
+}
+
+// handleReoffer answers a new offer from the player of an existing session,
+// which renegotiates the connection from its side
+func (eg *EdgeGateway) handleReoffer(v *Viewer, offer OfferMessage) {
+	v.lock.Lock()
+	// The new offer's token, checked already, replaces the session's
+	v.token = offer.Token
+	err := v.pc.SetRemoteDescription(offer.SDP)
+	var answer webrtc.SessionDescription
+	if err == nil {
+		answer, err = v.pc.CreateAnswer(nil)
+	}
+	if err == nil {
+		err = v.pc.SetLocalDescription(answer)
+	}
+	v.lock.Unlock()
+	if err != nil {
+		log.Printf("Failed to renegotiate session %s for camera %s: %v", v.ID, v.CameraID, err)
+		return
+	}
+	if v.simulcast {
+		answer.SDP = sendOnlySimulcast(answer.SDP)
+	}
+
+	log.Printf("Viewer session %s for camera %s renegotiated", v.ID, v.CameraID)
+	eg.sendEvent("webrtc_answer", map[string]interface{}{
+		"camera_id":  v.CameraID,
+		"session_id": v.ID,
+		"sdp":        answer,
+		"codec":      codecName(v.Codec),
+	})
+}
+
+// tracksPayload describes a viewer's tracks for session_updated and
+// webrtc_renegotiate: its profile, whether audio is on, and the media ID of
+// each camera's video in the SDP, so the player can tell them apart
+func (v *Viewer) tracksPayload() map[string]interface{} {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	senders := map[*webrtc.RTPSender]string{v.sender: v.CameraID}
+	cameras := []string{}
+	for cameraID, c := range v.cameras {
+		senders[c.sender] = cameraID
+		cameras = append(cameras, cameraID)
+	}
+	sort.Strings(cameras)
+	mids := make(map[string]string)
+	for _, transceiver := range v.pc.GetTransceivers() {
+		if cameraID, ok := senders[transceiver.Sender()]; ok && transceiver.Mid() != "" {
+			mids[cameraID] = transceiver.Mid()
+		}
+	}
+
+	payload := map[string]interface{}{
+		"camera_id":   v.CameraID,
+		"session_id":  v.ID,
+		"audio":       v.audioSender != nil,
+		"cameras":     cameras,
+		"mids":        mids,
+		"watermarked": v.watermark != nil,
+	}
+	if v.Profile != viewerProfileMain {
+		payload["profile"] = v.Profile
+	}
+	return payload
+}
+
+// drainRTCP reads a sender's RTCP, which its interceptors need, until the
+// sender stops
+func drainRTCP(sender *webrtc.RTPSender) {
+	for {
+		if _, _, err := sender.ReadRTCP(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,906 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// Where a replay's recording comes from
+const (
+	replaySourceLocal = "local" // the camera's HLS segments in memory
+	replaySourceGCS   = "gcs"   // HLS segments pushed to HLS_GCS_BUCKET
+)
+
+// Replay states, reported on the replay data channel and in replay_status
+const (
+	replayStatePlaying = "playing"
+	replayStatePaused  = "paused"
+	replayStateEnded   = "ended" // reached the end; waiting for a seek or live
+	replayStateLive    = "live"  // back on the camera's live video
+	replayStateError   = "error"
+)
+
+// Playback speed limits
+const (
+	replayMinSpeed = 0.25
+	replayMaxSpeed = 8
+)
+
+// replayChannelLabel is the label of the data channel replays are
+// controlled on
+const replayChannelLabel = "replay"
+
+// replayReportInterval is how often the playback position is reported on
+// the data channel while playing
+const replayReportInterval = time.Second
+
+// ReplayRequest is the replay_start payload: play a viewer session a
+// recording of its camera instead of the live video
+type ReplayRequest struct {
+	SessionID string `json:"session_id"`
+	Source    string `json:"source"` // local (default) or gcs
+	// Playlist is the GCS object of the playlist to play, by default the
+	// camera's HLS playlist. It must be one of the camera's own objects.
+	Playlist string `json:"playlist,omitempty"`
+	// Start is where to begin, as a time or as seconds into the recording;
+	// without either playback starts at the beginning
+	Start    *time.Time `json:"start,omitempty"`
+	Position float64    `json:"position,omitempty"`
+	Speed    float64    `json:"speed,omitempty"`
+}
+
+// ReplayControl is a playback command from the player on the replay data
+// channel
+type ReplayControl struct {
+	Action   string     `json:"action"` // pause, resume, seek, speed or live
+	Position *float64   `json:"position,omitempty"`
+	Time     *time.Time `json:"time,omitempty"`
+	Speed    float64    `json:"speed,omitempty"`
+}
+
+// ReplayStatus reports a replay's state, on the data channel and, when the
+// state changes, to the cloud as replay_status
+type ReplayStatus struct {
+	SessionID string     `json:"session_id"`
+	CameraID  string     `json:"camera_id"`
+	State     string     `json:"state"`
+	Position  float64    `json:"position"`       // seconds into the recording
+	Time      *time.Time `json:"time,omitempty"` // recorded wall clock time, if known
+	Duration  float64    `json:"duration"`
+	Speed     float64    `json:"speed"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// replaySegment is one fMP4 media segment of a recording
+type replaySegment struct {
+	name     string
+	init     string
+	start    time.Time // zero if the playlist has no program date times
+	offset   time.Duration
+	duration time.Duration
+}
+
+// replayRecording is a sequence of segments and where to load them from
+type replayRecording struct {
+	segments []replaySegment
+	duration time.Duration
+	load     func(ctx context.Context, name string) ([]byte, error)
+}
+
+// recording snapshots the packager's segments, which stay available to the
+// replay after the window has moved past them
+func (h *HLSPackager) recording() *replayRecording {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	objects := make(map[string][]byte)
+	for version, data := range h.inits {
+		objects[fmt.Sprintf("init-%d.mp4", version)] = data
+	}
+	rec := &replayRecording{}
+	for _, seg := range h.segments {
+		name := fmt.Sprintf("seg-%d.m4s", seg.seq)
+		objects[name] = seg.data
+		rec.segments = append(rec.segments, replaySegment{
+			name:     name,
+			init:     fmt.Sprintf("init-%d.mp4", seg.initVersion),
+			start:    seg.start,
+			offset:   rec.duration,
+			duration: seg.duration,
+		})
+		rec.duration += seg.duration
+	}
+	rec.load = func(ctx context.Context, name string) ([]byte, error) {
+		data, ok := objects[name]
+		if !ok {
+			return nil, fmt.Errorf("no segment %s", name)
+		}
+		return data, nil
+	}
+	return rec
+}
+
+// parseReplayPlaylist reads the segments of an fMP4 HLS media playlist
+func parseReplayPlaylist(playlist []byte) (*replayRecording, error) {
+	rec := &replayRecording{}
+	var init string
+	var start time.Time
+	var duration time.Duration
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			_, uri, _ := strings.Cut(line, `URI="`)
+			init, _, _ = strings.Cut(uri, `"`)
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			start, _ = time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXTINF %q", line)
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		case line != "" && !strings.HasPrefix(line, "#"):
+			if init == "" {
+				return nil, errors.New("not an fMP4 playlist")
+			}
+			rec.segments = append(rec.segments, replaySegment{
+				name:     line,
+				init:     init,
+				start:    start,
+				offset:   rec.duration,
+				duration: duration,
+			})
+			rec.duration += duration
+			start = time.Time{}
+		}
+	}
+	return rec, scanner.Err()
+}
+
+// seekOffset returns where a time is in the recording, clamped to it
+func (rec *replayRecording) seekOffset(t time.Time) time.Duration {
+	for _, seg := range rec.segments {
+		if seg.start.IsZero() {
+			continue
+		}
+		if t.Before(seg.start.Add(seg.duration)) {
+			return max(seg.offset+t.Sub(seg.start), 0)
+		}
+	}
+	return rec.duration
+}
+
+// timeAt returns the recorded wall clock time at an offset, if known
+func (rec *replayRecording) timeAt(offset time.Duration) *time.Time {
+	for _, seg := range rec.segments {
+		if offset < seg.offset+seg.duration {
+			if seg.start.IsZero() {
+				return nil
+			}
+			t := seg.start.Add(offset - seg.offset)
+			return &t
+		}
+	}
+	return nil
+}
+
+// replayPlayer plays a recording to one viewer, on a track of its own that
+// replaces the camera's live track on the viewer's video sender
+type replayPlayer struct {
+	eg       *EdgeGateway
+	viewer   *Viewer
+	rec      *replayRecording
+	track    *webrtc.TrackLocalStaticSample
+	controls chan ReplayControl
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	codecs     map[string]h264parser.CodecData // by init segment
+	timescales map[string]uint32
+	state      string
+	position   time.Duration
+	speed      float64
+	reported   time.Time
+}
+
+// startReplay switches a viewer session to a recording of its camera
+func (eg *EdgeGateway) startReplay(ctx context.Context, req ReplayRequest) error {
+	v := eg.viewer(req.SessionID)
+	if v == nil {
+		return errors.New("no such viewer session")
+	}
+	if v.sender == nil {
+		return errors.New("viewer session has no video")
+	}
+	if v.Codec != videoCodecH264 {
+		// Recordings are H.264, which the session didn't negotiate
+		return fmt.Errorf("viewer session receives %s, replays need H.264", codecName(v.Codec))
+	}
+	v.lock.Lock()
+	watermarked := v.watermark != nil
+	v.lock.Unlock()
+	if watermarked {
+		// Recordings are sent as stored, without the viewer's watermark
+		return errors.New("watermarked viewer sessions can't play recordings")
+	}
+
+	if req.Source == "" {
+		req.Source = replaySourceLocal
+	}
+	var rec *replayRecording
+	var err error
+	switch req.Source {
+	case replaySourceLocal:
+		rec, err = eg.localRecording(v.CameraID)
+	case replaySourceGCS:
+		rec, err = eg.gcsRecording(ctx, v.CameraID, req.Playlist)
+	default:
+		err = fmt.Errorf("unknown replay source %q", req.Source)
+	}
+	if err != nil {
+		return err
+	}
+	if len(rec.segments) == 0 {
+		return errors.New("recording has no segments")
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "replay0")
+	if err != nil {
+		return err
+	}
+	playCtx, cancel := context.WithCancel(eg.ctx)
+	p := &replayPlayer{
+		eg:         eg,
+		viewer:     v,
+		rec:        rec,
+		track:      track,
+		controls:   make(chan ReplayControl, 16),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		codecs:     make(map[string]h264parser.CodecData),
+		timescales: make(map[string]uint32),
+		state:      replayStatePlaying,
+		position:   time.Duration(req.Position * float64(time.Second)),
+		speed:      clampReplaySpeed(req.Speed),
+	}
+	if req.Start != nil {
+		p.position = rec.seekOffset(*req.Start)
+	}
+	p.position = max(min(p.position, rec.duration), 0)
+
+	v.lock.Lock()
+	previous := v.replay
+	v.replay = p
+	v.lock.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+
+	if err := v.sender.ReplaceTrack(track); err != nil {
+		cancel()
+		v.lock.Lock()
+		v.replay = nil
+		v.lock.Unlock()
+		return fmt.Errorf("failed to switch to the recording: %v", err)
+	}
+	log.Printf("Replaying %s of camera %s to session %s from %s", req.Source, v.CameraID, v.ID, p.position)
+	go p.run(playCtx)
+	return nil
+}
+
+// localRecording snapshots the HLS segments of a camera's running stream
+func (eg *EdgeGateway) localRecording(cameraID string) (*replayRecording, error) {
+	eg.streamsLock.RLock()
+	stream := eg.streams[streamKey(cameraID, viewerProfileMain)]
+	eg.streamsLock.RUnlock()
+	if stream == nil || stream.hls == nil {
+		return nil, errors.New("no local recording: the camera's stream isn't packaged as HLS")
+	}
+	return stream.hls.recording(), nil
+}
+
+// gcsRecording reads a playlist of segments pushed to HLS_GCS_BUCKET, by
+// default the camera's live one. The playlist and its segments must be
+// objects under the camera's prefix, so a session can't play another
+// camera's recordings.
+func (eg *EdgeGateway) gcsRecording(ctx context.Context, cameraID, playlist string) (*replayRecording, error) {
+	if eg.cfg.HLSGCSBucket == "" {
+		return nil, errors.New("no GCS recording: HLS_GCS_BUCKET is not set")
+	}
+	prefix := path.Join(eg.cfg.HLSGCSPrefix, getGatewayID(), cameraID) + "/"
+	if playlist == "" {
+		playlist = prefix + "index.m3u8"
+	}
+	if !replayObjectAllowed(prefix, playlist) {
+		return nil, fmt.Errorf("playlist %s is not a recording of camera %s", playlist, cameraID)
+	}
+	uploader, err := NewGCSUploader(eg.ctx, eg.cfg.HLSGCSBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := uploader.Download(ctx, playlist)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseReplayPlaylist(data)
+	if err != nil {
+		return nil, fmt.Errorf("playlist %s: %v", playlist, err)
+	}
+	dir := path.Dir(playlist)
+	for _, seg := range rec.segments {
+		if !replayObjectAllowed(prefix, path.Join(dir, seg.name)) || !replayObjectAllowed(prefix, path.Join(dir, seg.init)) {
+			return nil, fmt.Errorf("playlist %s: segment %s is not a recording of camera %s", playlist, seg.name, cameraID)
+		}
+	}
+	rec.load = func(ctx context.Context, name string) ([]byte, error) {
+		return uploader.Download(ctx, path.Join(dir, name))
+	}
+	return rec, nil
+}
+
+// replayObjectAllowed reports whether a GCS object name lies under prefix,
+// without any ".." that might lead out of it
+func replayObjectAllowed(prefix, object string) bool {
+	if !strings.HasPrefix(object, prefix) || path.Clean(object) != object {
+		return false
+	}
+	return !slices.Contains(strings.Split(object, "/"), "..")
+}
+
+// stopReplay returns a viewer session to its camera's live video
+func (eg *EdgeGateway) stopReplay(sessionID string) error {
+	v := eg.viewer(sessionID)
+	if v == nil {
+		return errors.New("no such viewer session")
+	}
+	v.lock.Lock()
+	p := v.replay
+	v.lock.Unlock()
+	if p == nil {
+		return errors.New("session is not replaying")
+	}
+	p.control(ReplayControl{Action: "live"})
+	return nil
+}
+
+// handleReplayControl handles a message on a viewer's replay data channel
+func (v *Viewer) handleReplayControl(data []byte) {
+	var ctrl ReplayControl
+	if err := json.Unmarshal(data, &ctrl); err != nil {
+		return
+	}
+	v.lock.Lock()
+	p := v.replay
+	v.lock.Unlock()
+	if p != nil {
+		p.control(ctrl)
+	}
+}
+
+// stopReplay ends the viewer's replay, if any, without switching tracks, as
+// when the session closes
+func (v *Viewer) stopReplay() {
+	v.lock.Lock()
+	p := v.replay
+	v.replay = nil
+	v.lock.Unlock()
+	if p != nil {
+		p.stop()
+	}
+}
+
+func clampReplaySpeed(speed float64) float64 {
+	if speed == 0 {
+		return 1
+	}
+	return math.Max(replayMinSpeed, math.Min(replayMaxSpeed, speed))
+}
+
+// control queues a playback command, dropping it if the player is behind
+func (p *replayPlayer) control(ctrl ReplayControl) {
+	select {
+	case p.controls <- ctrl:
+	default:
+	}
+}
+
+// stop ends playback and waits for the player to finish
+func (p *replayPlayer) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// run plays the recording from p.position, following controls, until the
+// player asks for live video or the session ends
+func (p *replayPlayer) run(ctx context.Context) {
+	defer close(p.done)
+	p.report(true)
+
+	for ctx.Err() == nil {
+		var err error
+		var live bool
+		switch p.state {
+		case replayStatePlaying:
+			live, err = p.play(ctx)
+		default:
+			live = p.wait(ctx)
+		}
+		if err != nil {
+			log.Printf("Replay for session %s failed: %v", p.viewer.ID, err)
+			p.state = replayStateError
+			p.reportError(err)
+			live = true
+		}
+		if live {
+			p.goLive()
+			return
+		}
+	}
+}
+
+// play sends frames from p.position until the end of the recording or a
+// control that interrupts playback. It returns true to go live.
+func (p *replayPlayer) play(ctx context.Context) (bool, error) {
+	// Frames are due at wall clock times counted from the last rebase
+	rebase := func() (time.Time, time.Duration) { return time.Now(), p.position }
+	wallStart, posStart := rebase()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	target := p.position
+	for _, seg := range p.rec.segments {
+		if seg.offset+seg.duration <= target && seg.offset+seg.duration < p.rec.duration {
+			continue
+		}
+		packets, codec, err := p.loadSegment(ctx, seg)
+		if err != nil {
+			return false, err
+		}
+
+		// Start on the last keyframe at or before the target
+		first := 0
+		for i, pkt := range packets {
+			if pkt.IsKeyFrame && pkt.Time <= target {
+				first = i
+			}
+		}
+		if first < len(packets) && packets[first].Time < target {
+			p.position = packets[first].Time
+			wallStart, posStart = rebase()
+		}
+
+		for _, pkt := range packets[first:] {
+			due := wallStart.Add(time.Duration(float64(pkt.Time-posStart) / p.speed))
+			if time.Since(due) > time.Second {
+				// Loading the segment took a while; don't rush to catch up
+				wallStart, posStart = time.Now(), pkt.Time
+				due = wallStart
+			}
+			resetTimer(timer, time.Until(due))
+			for waiting := true; waiting; {
+				select {
+				case <-ctx.Done():
+					return false, nil
+				case <-timer.C:
+					waiting = false
+				case ctrl := <-p.controls:
+					switch p.apply(ctrl) {
+					case replayApplyLive:
+						return true, nil
+					case replayApplyRestart:
+						return false, nil
+					case replayApplyRebase:
+						wallStart, posStart = rebase()
+						resetTimer(timer, time.Until(wallStart.Add(time.Duration(float64(pkt.Time-posStart)/p.speed))))
+					}
+				}
+			}
+
+			p.writeFrame(pkt, codec)
+			p.position = pkt.Time
+			p.report(false)
+		}
+		target = seg.offset + seg.duration
+	}
+
+	p.position = p.rec.duration
+	p.state = replayStateEnded
+	p.report(true)
+	return false, nil
+}
+
+// resetTimer resets a timer that may have fired without being received from
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// wait handles controls while paused or ended. It returns true to go live.
+func (p *replayPlayer) wait(ctx context.Context) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case ctrl := <-p.controls:
+			switch p.apply(ctrl) {
+			case replayApplyLive:
+				return true
+			case replayApplyRestart, replayApplyRebase:
+				if p.state == replayStatePlaying {
+					return false
+				}
+			}
+		}
+	}
+}
+
+// What applying a control means for the playback loop
+const (
+	replayApplyNone    = iota
+	replayApplyRebase  // continue from the current position
+	replayApplyRestart // leave the loop: paused, or seeked elsewhere
+	replayApplyLive
+)
+
+// apply updates the player's state for a control
+func (p *replayPlayer) apply(ctrl ReplayControl) int {
+	result := replayApplyNone
+	switch ctrl.Action {
+	case "live":
+		return replayApplyLive
+	case "pause":
+		if p.state == replayStatePlaying {
+			p.state = replayStatePaused
+			result = replayApplyRestart
+		}
+	case "resume":
+		if p.state == replayStatePaused {
+			p.state = replayStatePlaying
+			result = replayApplyRebase
+		}
+	case "speed":
+		p.speed = clampReplaySpeed(ctrl.Speed)
+		result = replayApplyRebase
+	case "seek":
+		switch {
+		case ctrl.Time != nil:
+			p.position = p.rec.seekOffset(*ctrl.Time)
+		case ctrl.Position != nil:
+			p.position = time.Duration(*ctrl.Position * float64(time.Second))
+		default:
+			return replayApplyNone
+		}
+		p.position = max(min(p.position, p.rec.duration), 0)
+		if p.state == replayStateEnded {
+			p.state = replayStatePlaying
+		}
+		result = replayApplyRestart
+	default:
+		return replayApplyNone
+	}
+	p.report(true)
+	return result
+}
+
+// loadSegment returns a segment's frames, timed from the start of the
+// recording, and its codec
+func (p *replayPlayer) loadSegment(ctx context.Context, seg replaySegment) ([]av.Packet, h264parser.CodecData, error) {
+	codec, ok := p.codecs[seg.init]
+	if !ok {
+		init, err := p.rec.load(ctx, seg.init)
+		if err != nil {
+			return nil, codec, err
+		}
+		var timescale uint32
+		if codec, timescale, err = parseFMP4Init(init); err != nil {
+			return nil, codec, fmt.Errorf("%s: %v", seg.init, err)
+		}
+		p.codecs[seg.init], p.timescales[seg.init] = codec, timescale
+	}
+
+	data, err := p.rec.load(ctx, seg.name)
+	if err != nil {
+		return nil, codec, err
+	}
+	packets, err := parseFMP4Segment(data, p.timescales[seg.init])
+	if err != nil {
+		return nil, codec, fmt.Errorf("%s: %v", seg.name, err)
+	}
+	if len(packets) > 0 {
+		base := packets[0].Time
+		for i := range packets {
+			packets[i].Time += seg.offset - base
+		}
+	}
+	return packets, codec, nil
+}
+
+// writeFrame sends a frame in Annex B form, with the parameter sets ahead
+// of keyframes since recordings may not carry them in band
+func (p *replayPlayer) writeFrame(pkt av.Packet, codec h264parser.CodecData) {
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	if pkt.IsKeyFrame {
+		nalus = append([][]byte{codec.SPS(), codec.PPS()}, nalus...)
+	}
+	var data []byte
+	for _, nalu := range nalus {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nalu...)
+	}
+	if key := p.eg.e2ee.Get(p.viewer.CameraID); key != nil {
+		data = key.encryptFrame(data)
+	}
+
+	duration := time.Duration(float64(pkt.Duration) / p.speed)
+	if err := p.track.WriteSample(media.Sample{Data: data, Duration: duration}); err != nil {
+		debugf("Replay for session %s: %v", p.viewer.ID, err)
+	}
+}
+
+// goLive puts the camera's live track back on the viewer's video sender
+func (p *replayPlayer) goLive() {
+	v := p.viewer
+	v.lock.Lock()
+	if v.replay == p {
+		v.replay = nil
+	}
+	// The live stream may be another simulcast layer by now
+	live := v.stream
+	v.lock.Unlock()
+
+	if err := v.sender.ReplaceTrack(live.videoTrack); err != nil {
+		log.Printf("Failed to return session %s to live video: %v", v.ID, err)
+	}
+	live.sendBufferedKeyframe()
+	if p.state != replayStateError {
+		p.state = replayStateLive
+		p.report(true)
+	}
+	log.Printf("Session %s back on live video of camera %s", v.ID, v.CameraID)
+}
+
+// report sends the status on the data channel, at most once per
+// replayReportInterval unless forced, and to the cloud when forced
+func (p *replayPlayer) report(force bool) {
+	if !force && time.Since(p.reported) < replayReportInterval {
+		return
+	}
+	p.reported = time.Now()
+	status := p.status()
+	if channel := p.viewer.replayChannel; channel != nil {
+		if data, err := json.Marshal(status); err == nil {
+			channel.SendText(string(data))
+		}
+	}
+	if force {
+		p.eg.sendEvent("replay_status", status)
+	}
+}
+
+// reportError reports a failed replay
+func (p *replayPlayer) reportError(err error) {
+	status := p.status()
+	status.Error = err.Error()
+	if channel := p.viewer.replayChannel; channel != nil {
+		if data, err := json.Marshal(status); err == nil {
+			channel.SendText(string(data))
+		}
+	}
+	p.eg.sendEvent("replay_status", status)
+}
+
+func (p *replayPlayer) status() ReplayStatus {
+	return ReplayStatus{
+		SessionID: p.viewer.ID,
+		CameraID:  p.viewer.CameraID,
+		State:     p.state,
+		Position:  p.position.Seconds(),
+		Time:      p.rec.timeAt(p.position),
+		Duration:  p.rec.duration.Seconds(),
+		Speed:     p.speed,
+	}
+}
+
+// mp4Box returns the payload of the box at a path of box types, looking in
+// data's top-level boxes first
+func mp4Box(data []byte, types ...string) []byte {
+	for _, typ := range types {
+		found := false
+		for len(data) >= 8 {
+			size := int(binary.BigEndian.Uint32(data))
+			if size < 8 || size > len(data) {
+				return nil
+			}
+			if string(data[4:8]) == typ {
+				data, found = data[8:size], true
+				break
+			}
+			data = data[size:]
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+// parseFMP4Init returns the H.264 codec and timescale of an fMP4 init
+// segment's first track
+func parseFMP4Init(init []byte) (h264parser.CodecData, uint32, error) {
+	var codec h264parser.CodecData
+	mdia := mp4Box(init, "moov", "trak", "mdia")
+	mdhd := mp4Box(mdia, "mdhd")
+	if len(mdhd) < 24 {
+		return codec, 0, errors.New("no media header")
+	}
+	timescale := binary.BigEndian.Uint32(mdhd[12:])
+	if mdhd[0] == 1 {
+		timescale = binary.BigEndian.Uint32(mdhd[20:])
+	}
+	if timescale == 0 {
+		return codec, 0, errors.New("no timescale")
+	}
+
+	// stsd has a version, flags and entry count before its entries, and
+	// avc1 has 78 bytes of sample entry fields before its boxes
+	stsd := mp4Box(mdia, "minf", "stbl", "stsd")
+	if len(stsd) < 8 {
+		return codec, 0, errors.New("no sample description")
+	}
+	avc1 := mp4Box(stsd[8:], "avc1")
+	if len(avc1) < 78 {
+		return codec, 0, errors.New("not H.264")
+	}
+	avcC := mp4Box(avc1[78:], "avcC")
+	if avcC == nil {
+		return codec, 0, errors.New("no avcC")
+	}
+	codec, err := h264parser.NewCodecDataFromAVCDecoderConfRecord(avcC)
+	return codec, timescale, err
+}
+
+// parseFMP4Segment returns the samples of an fMP4 media segment's first
+// track, timed by their decode time
+func parseFMP4Segment(data []byte, timescale uint32) ([]av.Packet, error) {
+	var packets []av.Packet
+	for rest := data; len(rest) >= 8; {
+		size := int(binary.BigEndian.Uint32(rest))
+		if size < 8 || size > len(rest) {
+			return nil, errors.New("truncated box")
+		}
+		if string(rest[4:8]) == "moof" {
+			fragment, err := parseMoof(rest, size, timescale)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, fragment...)
+		}
+		rest = rest[size:]
+	}
+	return packets, nil
+}
+
+// parseMoof returns the samples of a fragment's first track. data starts
+// at the moof box, which sample data offsets are relative to.
+func parseMoof(data []byte, moofSize int, timescale uint32) ([]av.Packet, error) {
+	traf := mp4Box(data[8:moofSize], "traf")
+	tfhd := mp4Box(traf, "tfhd")
+	trun := mp4Box(traf, "trun")
+	if len(tfhd) < 8 || len(trun) < 8 {
+		return nil, errors.New("fragment without tfhd and trun")
+	}
+	u32 := func(b []byte, off *int) uint32 {
+		if *off+4 > len(b) {
+			*off = len(b) + 1
+			return 0
+		}
+		v := binary.BigEndian.Uint32(b[*off:])
+		*off += 4
+		return v
+	}
+
+	// Track fragment defaults
+	off := 8
+	tfhdFlags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+	var defaultDuration, defaultSize, defaultFlags uint32
+	if tfhdFlags&0x1 != 0 {
+		off += 8 // base data offset
+	}
+	if tfhdFlags&0x2 != 0 {
+		off += 4 // sample description index
+	}
+	if tfhdFlags&0x8 != 0 {
+		defaultDuration = u32(tfhd, &off)
+	}
+	if tfhdFlags&0x10 != 0 {
+		defaultSize = u32(tfhd, &off)
+	}
+	if tfhdFlags&0x20 != 0 {
+		defaultFlags = u32(tfhd, &off)
+	}
+
+	var decodeTime uint64
+	if tfdt := mp4Box(traf, "tfdt"); len(tfdt) >= 8 {
+		if tfdt[0] == 1 && len(tfdt) >= 12 {
+			decodeTime = binary.BigEndian.Uint64(tfdt[4:])
+		} else {
+			decodeTime = uint64(binary.BigEndian.Uint32(tfdt[4:]))
+		}
+	}
+
+	off = 4
+	trunFlags := binary.BigEndian.Uint32(trun) & 0xffffff
+	count := int(u32(trun, &off))
+	dataOffset := moofSize + 8
+	if trunFlags&0x1 != 0 {
+		dataOffset = int(int32(u32(trun, &off)))
+	}
+	firstFlags, hasFirstFlags := defaultFlags, trunFlags&0x4 != 0
+	if hasFirstFlags {
+		firstFlags = u32(trun, &off)
+	}
+
+	toTime := func(ts uint64) time.Duration {
+		return time.Duration(ts * uint64(time.Second) / uint64(timescale))
+	}
+	packets := make([]av.Packet, 0, count)
+	for i := 0; i < count; i++ {
+		duration, size, flags, cts := defaultDuration, defaultSize, defaultFlags, uint32(0)
+		if trunFlags&0x100 != 0 {
+			duration = u32(trun, &off)
+		}
+		if trunFlags&0x200 != 0 {
+			size = u32(trun, &off)
+		}
+		if trunFlags&0x400 != 0 {
+			flags = u32(trun, &off)
+		} else if i == 0 && hasFirstFlags {
+			flags = firstFlags
+		}
+		if trunFlags&0x800 != 0 {
+			cts = u32(trun, &off)
+		}
+		if off > len(trun) || dataOffset < 0 || dataOffset+int(size) > len(data) {
+			return nil, errors.New("truncated fragment")
+		}
+
+		packets = append(packets, av.Packet{
+			// sample_is_non_sync_sample is clear on keyframes
+			IsKeyFrame:      flags&0x10000 == 0,
+			Time:            toTime(decodeTime),
+			Duration:        toTime(uint64(duration)),
+			CompositionTime: toTime(uint64(cts)),
+			Data:            data[dataOffset : dataOffset+int(size)],
+		})
+		decodeTime += uint64(duration)
+		dataOffset += int(size)
+	}
+	return packets, nil
+}
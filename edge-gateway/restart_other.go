@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// restartSelf is not supported on this platform; the gateway exits and its
+// service manager starts it again
+func restartSelf() error {
+	return errors.New("restarting in place is not supported on this platform")
+}
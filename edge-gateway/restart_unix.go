@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// restartSelf replaces the process with a fresh start of the gateway
+// binary, which may have been swapped by an update
+func restartSelf() error {
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(binary, os.Args, os.Environ())
+}
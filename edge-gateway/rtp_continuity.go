@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// continuityFactory creates continuityInterceptors
+type continuityFactory struct{}
+
+func (continuityFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &continuityInterceptor{}, nil
+}
+
+// continuityInterceptor keeps the sequence numbers and timestamps of each
+// RTP stream a viewer is sent continuous when its sender switches tracks,
+// as replays do. Every track numbers its packets on its own, and the viewer
+// would drop those of the new track as replayed or late.
+type continuityInterceptor struct {
+	interceptor.NoOp
+}
+
+// BindLocalStream rewrites the stream's packets to carry on from the last
+// one sent whenever a packet does not follow the previous one
+func (i *continuityInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var (
+		lock      sync.Mutex
+		started   bool
+		lastSeq   uint16 // of the last packet written, before rewriting
+		seqOffset uint16
+		tsOffset  uint32
+		lastOut   rtp.Header
+		lastAt    time.Time
+	)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		lock.Lock()
+		if started && header.SequenceNumber != lastSeq+1 {
+			// Advance the timestamp by the time since the last packet
+			elapsed := uint32(time.Since(lastAt).Seconds() * float64(info.ClockRate))
+			seqOffset = lastOut.SequenceNumber + 1 - header.SequenceNumber
+			tsOffset = lastOut.Timestamp + max(elapsed, 1) - header.Timestamp
+		}
+		started, lastSeq, lastAt = true, header.SequenceNumber, time.Now()
+
+		// Tracks share headers between their viewers, so rewrite a copy
+		out := *header
+		out.SequenceNumber += seqOffset
+		out.Timestamp += tsOffset
+		lastOut = out
+		lock.Unlock()
+		return writer.Write(&out, payload, attributes)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/format/rtsp"
+)
+
+// dialRTSP connects to an RTSP server through an rtspTunnel, giving up early
+// if ctx is cancelled. tlsConfig is used for rtsps:// URLs. Errors never
+// contain the credentials embedded in the URL.
+func dialRTSP(ctx context.Context, rtspURL string, tlsConfig *tls.Config, timeout time.Duration) (*rtsp.Client, error) {
+	type dialResult struct {
+		client *rtsp.Client
+		err    error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		localURL, err := openRTSPTunnel(ctx, rtspURL, tlsConfig, timeout)
+		var client *rtsp.Client
+		if err == nil {
+			client, err = rtsp.DialTimeout(localURL, timeout)
+		}
+		if err != nil {
+			err = errors.New(redactCredentials(err.Error()))
+		}
+		result <- dialResult{client, err}
+	}()
+
+	select {
+	case res := <-result:
+		if res.err == nil {
+			// Bound every RTSP request/response exchange
+			res.client.RtspTimeout = timeout
+		}
+		return res.client, res.err
+	case <-ctx.Done():
+		// Close the connection if the dial completes after we gave up
+		go func() {
+			if res := <-result; res.err == nil {
+				res.client.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// closeOnDone closes the client when ctx is cancelled, unblocking any
+// pending reads. The returned function stops the watcher.
+func closeOnDone(ctx context.Context, client io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// isRTSPAuthError reports whether an RTSP error is the camera refusing the
+// login. vdk answers a 401 the tunnel couldn't authenticate with "no
+// username".
+func isRTSPAuthError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "StatusCode=401") || strings.Contains(err.Error(), "no username"))
+}
+
+// probeRTSP checks that the URL answers an RTSP DESCRIBE
+func probeRTSP(ctx context.Context, rtspURL string, tlsConfig *tls.Config, timeout time.Duration) error {
+	client, err := dialRTSP(ctx, rtspURL, tlsConfig, timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stop := closeOnDone(ctx, client)
+	defer stop()
+
+	_, err = client.Describe()
+	return err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vendorONVIF is the profile whose stream path is asked from the camera
+// via ONVIF instead of taken from the table
+const vendorONVIF = "onvif"
+
+// RTSPProfile maps a camera vendor to the RTSP path of its main stream
+type RTSPProfile struct {
+	Vendor string `json:"vendor"`
+	Path   string `json:"path,omitempty"`
+}
+
+// defaultRTSPProfiles are the built-in vendor path templates, in probe order
+var defaultRTSPProfiles = []RTSPProfile{
+	{Vendor: "axis", Path: "/axis-media/media.amp"},
+	{Vendor: "hikvision", Path: "/Streaming/Channels/101"},
+	{Vendor: "dahua", Path: "/cam/realmonitor?channel=1&subtype=0"},
+	{Vendor: vendorONVIF},
+}
+
+// parseRTSPProfiles merges "vendor=/path,..." overrides into the default
+// profile table. Overrides for known vendors replace their path; new
+// vendors are probed before the generic ONVIF profile.
+func parseRTSPProfiles(spec string) []RTSPProfile {
+	profiles := make([]RTSPProfile, len(defaultRTSPProfiles))
+	copy(profiles, defaultRTSPProfiles)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		vendor, path, ok := strings.Cut(item, "=")
+		vendor = strings.ToLower(strings.TrimSpace(vendor))
+		path = strings.TrimSpace(path)
+		if !ok || vendor == "" || !strings.HasPrefix(path, "/") {
+			log.Printf("Ignoring invalid RTSP path profile %q", item)
+			continue
+		}
+
+		replaced := false
+		for i := range profiles {
+			if profiles[i].Vendor == vendor {
+				profiles[i].Path = path
+				replaced = true
+			}
+		}
+		if !replaced {
+			// Keep ONVIF as the last resort
+			last := len(profiles) - 1
+			profiles = append(profiles[:last], RTSPProfile{Vendor: vendor, Path: path}, profiles[last])
+		}
+	}
+	return profiles
+}
+
+// defaultVendorOUIs are MAC address prefixes registered to the vendors of
+// the built-in profiles
+var defaultVendorOUIs = map[string]string{
+	"00408C": "axis",
+	"ACCC8E": "axis",
+	"B8A44F": "axis",
+	"E82725": "axis",
+	"4419B6": "hikvision",
+	"4CBD8F": "hikvision",
+	"BCAD28": "hikvision",
+	"C056E3": "hikvision",
+	"54C415": "hikvision",
+	"2857BE": "hikvision",
+	"C42F90": "hikvision",
+	"A41437": "hikvision",
+	"1868CB": "hikvision",
+	"3CEF8C": "dahua",
+	"9002A9": "dahua",
+	"4C11BF": "dahua",
+	"E0508B": "dahua",
+	"38AF29": "dahua",
+	"A0BD1D": "dahua",
+	"14A78B": "dahua",
+	"BC325F": "dahua",
+}
+
+// parseVendorOUIs merges "vendor=OUI,..." entries into the default OUI
+// table. An OUI listed again is moved to the new vendor.
+func parseVendorOUIs(spec string) map[string]string {
+	ouis := make(map[string]string, len(defaultVendorOUIs))
+	for oui, vendor := range defaultVendorOUIs {
+		ouis[oui] = vendor
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		vendor, prefix, _ := strings.Cut(item, "=")
+		vendor = strings.ToLower(strings.TrimSpace(vendor))
+		oui, ok := parseOUI(prefix)
+		if !ok || vendor == "" {
+			log.Printf("Ignoring invalid vendor OUI %q", item)
+			continue
+		}
+		ouis[oui] = vendor
+	}
+	return ouis
+}
+
+// fingerprintVendor returns the vendor of the camera at ip by the MAC
+// address the ARP table holds for it, or empty if it has none, or one of
+// no vendor with a profile
+func (eg *EdgeGateway) fingerprintVendor(ip string) string {
+	mac := neighborMAC(ip)
+	if len(mac) < 8 {
+		return ""
+	}
+	oui, ok := parseOUI(mac[:8])
+	if !ok {
+		return ""
+	}
+	vendor := eg.cfg.VendorOUIs[oui]
+	if _, ok := eg.rtspProfile(vendor); !ok {
+		return ""
+	}
+	return vendor
+}
+
+// rtspProfile returns the profile for a vendor
+func (eg *EdgeGateway) rtspProfile(vendor string) (RTSPProfile, bool) {
+	for _, profile := range eg.cfg.RTSPProfiles {
+		if profile.Vendor == strings.ToLower(vendor) {
+			return profile, true
+		}
+	}
+	return RTSPProfile{}, false
+}
+
+// buildRTSPURL assembles an RTSP URL; credentials are added only when dialing
+func buildRTSPURL(ip string, port int, path string) string {
+	if port == 0 {
+		port = 554
+	}
+	u := &url.URL{
+		Scheme: "rtsp",
+		Host:   net.JoinHostPort(ip, strconv.Itoa(port)),
+	}
+	if p, query, ok := strings.Cut(path, "?"); ok {
+		u.Path, u.RawQuery = p, query
+	} else {
+		u.Path = path
+	}
+	return u.String()
+}
+
+// resolveRTSPURL works out the stream URL for a camera from its per-camera
+// path override or its vendor profile
+func (eg *EdgeGateway) resolveRTSPURL(ctx context.Context, camera *Camera) (string, error) {
+	if camera.RTSPPath != "" {
+		return buildRTSPURL(camera.IP, 554, camera.RTSPPath), nil
+	}
+
+	profile, ok := eg.rtspProfile(camera.Vendor)
+	if !ok {
+		return "", fmt.Errorf("unknown camera vendor %q", camera.Vendor)
+	}
+	if profile.Vendor != vendorONVIF {
+		return buildRTSPURL(camera.IP, 554, profile.Path), nil
+	}
+
+	uri, err := onvifStreamURI(ctx, eg.httpClients.Client(camera))
+	if err != nil {
+		return "", err
+	}
+	return stripCredentials(uri), nil
+}
+
+// detectRTSPProfile probes each vendor profile in turn until the camera
+// answers an RTSP DESCRIBE, setting the camera's vendor and RTSP URL. It
+// fails with errCredentialsRejected if any profile's path refused the login
+// and none answered.
+//
+// A camera whose MAC address names its vendor is probed with that vendor's
+// profile first. If it refuses the login there, the other profiles aren't
+// tried, since each refused login counts toward the lockout of cameras
+// with brute-force protection.
+func (eg *EdgeGateway) detectRTSPProfile(ctx context.Context, camera *Camera) error {
+	profiles := eg.cfg.RTSPProfiles
+	vendor := eg.fingerprintVendor(camera.IP)
+	if vendor != "" {
+		debugf("Camera at %s is a %s camera by its MAC address", camera.IP, vendor)
+		ordered := make([]RTSPProfile, 0, len(profiles))
+		for _, profile := range profiles {
+			if profile.Vendor == vendor {
+				ordered = append(ordered, profile)
+			}
+		}
+		for _, profile := range profiles {
+			if profile.Vendor != vendor {
+				ordered = append(ordered, profile)
+			}
+		}
+		profiles = ordered
+	}
+
+	var lastErr, authErr error
+	for _, profile := range profiles {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		candidate := *camera
+		candidate.Vendor = profile.Vendor
+		candidate.RTSPPath = ""
+
+		rtspURL, err := eg.resolveRTSPURL(ctx, &candidate)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := probeRTSP(ctx, eg.credentials.URL(camera.ID, rtspURL), nil, 3*time.Second); err != nil {
+			lastErr = err
+			if isRTSPAuthError(err) {
+				authErr = err
+				if profile.Vendor == vendor {
+					break
+				}
+			}
+			continue
+		}
+
+		camera.Vendor = profile.Vendor
+		camera.RTSPUrl = rtspURL
+		return nil
+	}
+	if authErr != nil {
+		return fmt.Errorf("%w (%v)", errCredentialsRejected, authErr)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no RTSP profiles configured")
+	}
+	return lastErr
+}
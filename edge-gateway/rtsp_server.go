@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	// rtspServerRealm is the authentication realm sent to clients
+	rtspServerRealm = "Edge Gateway"
+	// rtspServerMTU caps RTP packet size so streams also fit UDP relays
+	rtspServerMTU = 1400
+	// rtspServerQueueSize is how many packets a session buffers before dropping
+	rtspServerQueueSize = 512
+	// rtspServerSetupTimeout bounds the time from connect to PLAY
+	rtspServerSetupTimeout = 60 * time.Second
+)
+
+// errRTSPTracksChanged ends a session when the camera's codecs change shape
+var errRTSPTracksChanged = errors.New("camera tracks changed")
+
+// startRTSPServer re-serves ingested cameras at rtsp://gateway:8554/{cameraID}
+// so on-site NVR/VMS software can record them
+func (eg *EdgeGateway) startRTSPServer(ctx context.Context) {
+	addr := eg.cfg.RTSPServerAddr
+	if addr == "" || addr == "off" {
+		return
+	}
+	if eg.cfg.RTSPServerUsername == "" || eg.cfg.RTSPServerPassword == "" {
+		log.Printf("RTSP server disabled: RTSP_SERVER_USERNAME and RTSP_SERVER_PASSWORD are required")
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("RTSP server error: %v", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Printf("RTSP server listening on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("RTSP server error: %v", err)
+			}
+			return
+		}
+		c := newRTSPServerConn(eg, conn, eg.openRTSPStream, eg.cfg.RTSPServerUsername, eg.cfg.RTSPServerPassword)
+		go c.serve(ctx)
+	}
+}
+
+// rtspSource is what an RTSP server client plays: a camera's stream, or a
+// simulated camera
+type rtspSource interface {
+	addSink(sink packetSink)
+	removeSink(sink packetSink)
+	playSink(sink packetSink, play func())
+}
+
+// rtspOpener opens the source for a camera ID, returning a function to call
+// once the client is done with it
+type rtspOpener func(cameraID string) (rtspSource, func(), error)
+
+// openRTSPStream opens a camera's stream for an RTSP server client
+func (eg *EdgeGateway) openRTSPStream(cameraID string) (rtspSource, func(), error) {
+	stream, err := eg.openStream(cameraID, viewerProfileMain, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream.addViewer()
+	return stream, func() { eg.releaseViewer(stream) }, nil
+}
+
+// rtspServerTrack is one media section of a re-served stream
+type rtspServerTrack struct {
+	idx         int8 // ingest stream index
+	codec       av.CodecData
+	payloadType uint8
+	clockRate   uint32
+	channel     byte // interleaved RTP channel chosen in SETUP
+	setup       bool
+	ssrc        uint32
+	seq         uint16
+	h264        codecs.H264Payloader
+}
+
+// rtspServerConn is one client connection; it implements packetSink
+type rtspServerConn struct {
+	eg       *EdgeGateway
+	conn     net.Conn
+	reader   *bufio.Reader
+	text     *textproto.Reader
+	nonce    string
+	open     rtspOpener
+	username string
+	password string
+
+	writeLock sync.Mutex
+	frame     []byte // interleaved RTP frame being written, guarded by writeLock
+	session   string
+	source    rtspSource
+	cameraID  string
+	release   func()
+	tracks    []*rtspServerTrack
+	events    chan relayEvent
+	playing   bool
+
+	// Timestamps keep increasing across camera reconnects
+	timeOffset time.Duration
+	lastTime   time.Duration
+
+	lock       sync.Mutex
+	codecs     []av.CodecData
+	ready      chan struct{} // closed once codecs are known
+	forwarding bool
+	waitKey    bool
+}
+
+func newRTSPServerConn(eg *EdgeGateway, conn net.Conn, open rtspOpener, username, password string) *rtspServerConn {
+	reader := bufio.NewReader(conn)
+	return &rtspServerConn{
+		eg:       eg,
+		conn:     conn,
+		reader:   reader,
+		text:     textproto.NewReader(reader),
+		nonce:    randomHex(16),
+		open:     open,
+		username: username,
+		password: password,
+		events:   make(chan relayEvent, rtspServerQueueSize),
+		ready:    make(chan struct{}),
+		waitKey:  true,
+	}
+}
+
+// Reset implements packetSink
+func (c *rtspServerConn) Reset(codecs []av.CodecData) {
+	c.lock.Lock()
+	if c.codecs == nil {
+		close(c.ready)
+	}
+	c.codecs = codecs
+	forwarding := c.forwarding
+	c.lock.Unlock()
+	if !forwarding {
+		return
+	}
+
+	select {
+	case c.events <- relayEvent{codecs: codecs}:
+	default:
+		c.drop()
+	}
+}
+
+// WritePacket implements packetSink without blocking the ingest
+func (c *rtspServerConn) WritePacket(pkt av.Packet) {
+	c.lock.Lock()
+	if !c.forwarding || (c.waitKey && !pkt.IsKeyFrame) {
+		c.lock.Unlock()
+		return
+	}
+	c.waitKey = false
+	c.lock.Unlock()
+
+	select {
+	case c.events <- relayEvent{packet: pkt}:
+	default:
+		c.drop()
+	}
+}
+
+func (c *rtspServerConn) drop() {
+	c.lock.Lock()
+	c.waitKey = true
+	c.lock.Unlock()
+}
+
+// serve handles requests until the client disconnects
+func (c *rtspServerConn) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		c.conn.Close()
+	}()
+
+	defer func() {
+		if c.source != nil {
+			c.source.removeSink(c)
+			c.release()
+		}
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(rtspServerSetupTimeout))
+	for {
+		method, uri, header, err := c.readRequest()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil && !c.playing {
+				log.Printf("RTSP client %s: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if !c.handleRequest(ctx, method, uri, header) {
+			return
+		}
+	}
+}
+
+// readRequest reads the next request, skipping interleaved RTCP from the client
+func (c *rtspServerConn) readRequest() (string, string, textproto.MIMEHeader, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		var frame [4]byte
+		if _, err := io.ReadFull(c.reader, frame[:]); err != nil {
+			return "", "", nil, err
+		}
+		if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(frame[2:]))); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", "", nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return "", "", nil, fmt.Errorf("malformed request line %q", line)
+	}
+	header, err := c.text.ReadMIMEHeader()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if _, err := c.reader.Discard(n); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return parts[0], parts[1], header, nil
+}
+
+// handleRequest answers one request; it returns false to close the connection
+func (c *rtspServerConn) handleRequest(ctx context.Context, method, uri string, header textproto.MIMEHeader) bool {
+	cseq := header.Get("CSeq")
+
+	if method == "OPTIONS" {
+		c.respond(cseq, 200, "OK", map[string]string{
+			"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER",
+		}, "")
+		return true
+	}
+
+	if !c.authorized(method, uri, header.Get("Authorization")) {
+		c.respond(cseq, 401, "Unauthorized", map[string]string{
+			"WWW-Authenticate": fmt.Sprintf(`Digest realm="%s", nonce="%s"`, rtspServerRealm, c.nonce),
+		}, "")
+		return true
+	}
+
+	cameraID, control, err := parseRTSPServerURL(uri)
+	if err != nil {
+		c.respond(cseq, 400, "Bad Request", nil, "")
+		return true
+	}
+
+	switch method {
+	case "DESCRIBE":
+		return c.describe(ctx, cseq, uri, cameraID)
+	case "SETUP":
+		return c.setup(cseq, control, header.Get("Transport"))
+	case "PLAY":
+		return c.play(ctx, cseq)
+	case "GET_PARAMETER":
+		c.respond(cseq, 200, "OK", c.sessionHeader(), "")
+		return true
+	case "TEARDOWN":
+		c.respond(cseq, 200, "OK", c.sessionHeader(), "")
+		return false
+	}
+	c.respond(cseq, 501, "Not Implemented", nil, "")
+	return true
+}
+
+// parseRTSPServerURL splits a request URL into camera ID and track control
+func parseRTSPServerURL(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return "", "", fmt.Errorf("missing camera ID")
+	}
+	cameraID, control, _ := strings.Cut(path, "/")
+	return cameraID, control, nil
+}
+
+// authorized checks Digest or Basic credentials against the server's user
+func (c *rtspServerConn) authorized(method, uri, authorization string) bool {
+	scheme, params, _ := strings.Cut(authorization, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(params))
+		if err != nil {
+			return false
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return subtle.ConstantTimeCompare([]byte(username), []byte(c.username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.password)) == 1
+
+	case "digest":
+		p := parseAuthParams(params)
+		if p["username"] != c.username || p["nonce"] != c.nonce {
+			return false
+		}
+		ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", c.username, rtspServerRealm, c.password))
+		ha2 := md5Hex(fmt.Sprintf("%s:%s", method, p["uri"]))
+		var expected string
+		if p["qop"] == "auth" {
+			expected = md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, c.nonce, p["nc"], p["cnonce"], p["qop"], ha2))
+		} else {
+			expected = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, c.nonce, ha2))
+		}
+		return subtle.ConstantTimeCompare([]byte(p["response"]), []byte(expected)) == 1
+	}
+	return false
+}
+
+// describe opens the camera's stream and answers with its SDP
+func (c *rtspServerConn) describe(ctx context.Context, cseq, uri, cameraID string) bool {
+	if c.source == nil {
+		source, release, err := c.open(cameraID)
+		if err != nil {
+			c.respond(cseq, 404, "Not Found", nil, "")
+			return true
+		}
+		source.addSink(c)
+		c.source, c.cameraID, c.release = source, cameraID, release
+	} else if c.cameraID != cameraID {
+		c.respond(cseq, 455, "Method Not Valid in This State", nil, "")
+		return true
+	}
+
+	// Wait for the camera session to report its codecs
+	select {
+	case <-c.ready:
+	case <-time.After(c.eg.cfg.RTSPDialTimeout):
+		c.respond(cseq, 503, "Service Unavailable", nil, "")
+		return false
+	case <-ctx.Done():
+		return false
+	}
+
+	c.lock.Lock()
+	c.tracks = rtspServerTracks(c.codecs)
+	c.lock.Unlock()
+	if len(c.tracks) == 0 {
+		c.respond(cseq, 415, "Unsupported Media Type", nil, "")
+		return false
+	}
+
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	c.respond(cseq, 200, "OK", map[string]string{
+		"Content-Base": strings.TrimSuffix(uri, "/") + "/",
+		"Content-Type": "application/sdp",
+	}, rtspServerSDP(host, cameraID, c.tracks))
+	return true
+}
+
+// setup binds a track to interleaved channels; only RTP over TCP is offered
+func (c *rtspServerConn) setup(cseq, control, transport string) bool {
+	if c.tracks == nil {
+		c.respond(cseq, 455, "Method Not Valid in This State", nil, "")
+		return true
+	}
+
+	var track *rtspServerTrack
+	for i, t := range c.tracks {
+		if control == fmt.Sprintf("trackID=%d", i) || (control == "" && len(c.tracks) == 1) {
+			track = t
+		}
+	}
+	if track == nil {
+		c.respond(cseq, 404, "Not Found", nil, "")
+		return true
+	}
+
+	if !strings.Contains(transport, "RTP/AVP/TCP") {
+		c.respond(cseq, 461, "Unsupported Transport", nil, "")
+		return true
+	}
+	channel := byte(2 * rtspServerTrackIndex(c.tracks, track))
+	for _, param := range strings.Split(transport, ";") {
+		if value, ok := strings.CutPrefix(param, "interleaved="); ok {
+			first, _, _ := strings.Cut(value, "-")
+			if n, err := strconv.Atoi(first); err == nil && n >= 0 && n < 255 {
+				channel = byte(n)
+			}
+		}
+	}
+	track.channel = channel
+	track.setup = true
+
+	if c.session == "" {
+		c.session = randomHex(8)
+	}
+	header := c.sessionHeader()
+	header["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", channel, channel+1, track.ssrc)
+	c.respond(cseq, 200, "OK", header, "")
+	return true
+}
+
+// play starts forwarding packets to the client
+func (c *rtspServerConn) play(ctx context.Context, cseq string) bool {
+	if c.session == "" {
+		c.respond(cseq, 455, "Method Not Valid in This State", nil, "")
+		return true
+	}
+	c.respond(cseq, 200, "OK", c.sessionHeader(), "")
+
+	if !c.playing {
+		c.playing = true
+		// Clients that are playing may stay silent; a dead one fails writes
+		c.conn.SetReadDeadline(time.Time{})
+		// The client starts on the stream's buffered keyframe
+		c.source.playSink(c, func() {
+			c.lock.Lock()
+			c.forwarding = true
+			c.lock.Unlock()
+		})
+		go c.writeLoop(ctx)
+		log.Printf("RTSP client %s playing camera %s", c.conn.RemoteAddr(), c.cameraID)
+	}
+	return true
+}
+
+func (c *rtspServerConn) sessionHeader() map[string]string {
+	if c.session == "" {
+		return map[string]string{}
+	}
+	return map[string]string{"Session": c.session + ";timeout=60"}
+}
+
+// respond writes an RTSP response
+func (c *rtspServerConn) respond(cseq string, code int, reason string, header map[string]string, body string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\nCSeq: %s\r\nServer: edge-gateway/%s\r\n", code, reason, cseq, Version)
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.conn.Write([]byte(b.String()))
+}
+
+// writeLoop packetizes queued camera packets into interleaved RTP
+func (c *rtspServerConn) writeLoop(ctx context.Context) {
+	defer c.conn.Close()
+
+	byIdx := make(map[int8]*rtspServerTrack)
+	for _, t := range c.tracks {
+		byIdx[t.idx] = t
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-c.events:
+			if ev.codecs != nil {
+				if err := c.updateTracks(ev.codecs); err != nil {
+					log.Printf("RTSP client %s: %v", c.conn.RemoteAddr(), err)
+					return
+				}
+				continue
+			}
+
+			track, ok := byIdx[ev.packet.Idx]
+			if !ok || !track.setup {
+				continue
+			}
+			if err := c.writePacket(track, ev.packet); err != nil {
+				log.Printf("RTSP client %s disconnected: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// updateTracks applies codecs from a new camera session, keeping timestamps
+// monotonic. Parameter changes are sent in-band; a different track layout
+// ends the session so the client re-describes.
+func (c *rtspServerConn) updateTracks(codecs []av.CodecData) error {
+	tracks := rtspServerTracks(codecs)
+	if len(tracks) != len(c.tracks) {
+		return errRTSPTracksChanged
+	}
+	for i, t := range tracks {
+		if t.idx != c.tracks[i].idx || t.payloadType != c.tracks[i].payloadType {
+			return errRTSPTracksChanged
+		}
+		c.tracks[i].codec = t.codec
+	}
+	c.timeOffset = c.lastTime + 100*time.Millisecond
+	return nil
+}
+
+// writePacket sends one camera packet as RTP packets
+func (c *rtspServerConn) writePacket(track *rtspServerTrack, pkt av.Packet) error {
+	ts := pkt.Time + pkt.CompositionTime + c.timeOffset
+	if ts > c.lastTime {
+		c.lastTime = ts
+	}
+	timestamp := uint32(int64(ts) * int64(track.clockRate) / int64(time.Second))
+
+	var payloads [][]byte
+	switch codec := track.codec.(type) {
+	case h264parser.CodecData:
+		nalus, _ := h264parser.SplitNALUs(pkt.Data)
+		if pkt.IsKeyFrame && !containsSPS(nalus) {
+			// Repeat parameter sets so clients can join or follow a re-profile
+			nalus = append([][]byte{codec.SPS(), codec.PPS()}, nalus...)
+		}
+		for _, nalu := range nalus {
+			payloads = append(payloads, track.h264.Payload(rtspServerMTU, nalu)...)
+		}
+	case aacparser.CodecData:
+		// RFC 3640 AAC-hbr: one AU header of 13-bit size and 3-bit index
+		payload := make([]byte, 4+len(pkt.Data))
+		binary.BigEndian.PutUint16(payload[0:], 16)
+		binary.BigEndian.PutUint16(payload[2:], uint16(len(pkt.Data)<<3))
+		copy(payload[4:], pkt.Data)
+		payloads = [][]byte{payload}
+	default:
+		payloads = [][]byte{pkt.Data}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	for i, payload := range payloads {
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    track.payloadType,
+				SequenceNumber: track.seq,
+				Timestamp:      timestamp,
+				SSRC:           track.ssrc,
+			},
+			Payload: payload,
+		}
+		track.seq++
+
+		// Marshalled straight after the interleaved header, into a buffer
+		// reused packet to packet
+		size := packet.MarshalSize()
+		if cap(c.frame) < 4+size {
+			c.frame = make([]byte, 4+size)
+		}
+		frame := c.frame[:4+size]
+		frame[0] = '$'
+		frame[1] = track.channel
+		binary.BigEndian.PutUint16(frame[2:], uint16(size))
+		if _, err := packet.MarshalTo(frame[4:]); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsSPS(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1f == 7 {
+			return true
+		}
+	}
+	return false
+}
+
+// rtspServerTracks maps ingest codecs to RTP tracks, skipping codecs that
+// can't be re-served
+func rtspServerTracks(codecs []av.CodecData) []*rtspServerTrack {
+	var tracks []*rtspServerTrack
+	for i, codec := range codecs {
+		track := &rtspServerTrack{
+			idx:   int8(i),
+			codec: codec,
+			ssrc:  rand.Uint32(),
+			seq:   uint16(rand.Uint32()),
+		}
+		switch codec.Type() {
+		case av.H264:
+			track.payloadType, track.clockRate = 96, 90000
+		case av.AAC:
+			track.payloadType = 97
+			track.clockRate = uint32(codec.(av.AudioCodecData).SampleRate())
+		case av.PCM_MULAW:
+			track.payloadType, track.clockRate = 0, 8000
+		case av.PCM_ALAW:
+			track.payloadType, track.clockRate = 8, 8000
+		default:
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+func rtspServerTrackIndex(tracks []*rtspServerTrack, track *rtspServerTrack) int {
+	for i, t := range tracks {
+		if t == track {
+			return i
+		}
+	}
+	return 0
+}
+
+// rtspServerSDP describes the tracks of a re-served camera
+func rtspServerSDP(host, cameraID string, tracks []*rtspServerTrack) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=- 0 0 IN IP4 %s\r\ns=%s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n", host, cameraID)
+
+	for i, track := range tracks {
+		switch codec := track.codec.(type) {
+		case h264parser.CodecData:
+			sps, pps := codec.SPS(), codec.PPS()
+			fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\na=rtpmap:%d H264/90000\r\n", track.payloadType, track.payloadType)
+			fmt.Fprintf(&b, "a=fmtp:%d packetization-mode=1", track.payloadType)
+			if len(sps) >= 4 {
+				fmt.Fprintf(&b, "; profile-level-id=%s", hex.EncodeToString(sps[1:4]))
+			}
+			fmt.Fprintf(&b, "; sprop-parameter-sets=%s,%s\r\n",
+				base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps))
+
+		case aacparser.CodecData:
+			fmt.Fprintf(&b, "m=audio 0 RTP/AVP %d\r\na=rtpmap:%d mpeg4-generic/%d/%d\r\n",
+				track.payloadType, track.payloadType, codec.SampleRate(), codec.ChannelLayout().Count())
+			fmt.Fprintf(&b, "a=fmtp:%d streamtype=5; profile-level-id=1; mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config=%s\r\n",
+				track.payloadType, hex.EncodeToString(codec.MPEG4AudioConfigBytes()))
+
+		default:
+			fmt.Fprintf(&b, "m=audio 0 RTP/AVP %d\r\n", track.payloadType)
+		}
+		fmt.Fprintf(&b, "a=control:trackID=%d\r\n", i)
+	}
+	return b.String()
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rtspsDefaultPort is the standard port for RTSP over TLS
+const rtspsDefaultPort = "322"
+
+// rtspMaxBody bounds the body of an RTSP message, such as an SDP
+const rtspMaxBody = 1 << 20
+
+// rtspTunnel relays an RTSP session between the vdk client, which connects
+// to a loopback listener, and the camera. vdk only knows basic auth and
+// digest without qop, and can't speak TLS, so the tunnel answers the
+// camera's auth challenges itself and carries rtsps:// sessions over TLS.
+// Interleaved RTP is copied through untouched.
+type rtspTunnel struct {
+	client     net.Conn
+	camera     net.Conn
+	localBase  string   // rtsp://127.0.0.1:port, as vdk sees the camera
+	cameraBase string   // the camera's scheme://host[:port]
+	cameraURLs []string // forms of cameraBase the camera may use in SDP
+	username   string
+	password   string
+
+	// lock serializes writes to the camera and guards the fields below
+	lock    sync.Mutex
+	digest  *digestChallenge
+	basic   bool
+	pending map[string]*rtspMessage // requests by CSeq, kept for an auth retry
+}
+
+// rtspMessage is an RTSP request or response, or an interleaved frame
+type rtspMessage struct {
+	frame   []byte   // a whole $-framed packet, if this is one
+	lines   []string // the start line, then the headers
+	body    []byte
+	retried bool
+}
+
+// openRTSPTunnel connects to the camera at rtspURL, over TLS for rtsps://,
+// and returns a credential-free rtsp:// URL on the loopback interface that
+// leads to it. The tunnel serves a single connection and closes with it.
+func openRTSPTunnel(ctx context.Context, rtspURL string, tlsConfig *tls.Config, timeout time.Duration) (string, error) {
+	u, err := url.Parse(rtspURL)
+	if err != nil || u.Hostname() == "" {
+		return "", errors.New("invalid RTSP URL")
+	}
+	if u.Scheme != "rtsp" && u.Scheme != "rtsps" {
+		return "", fmt.Errorf("unsupported RTSP scheme %q", u.Scheme)
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		port := "554"
+		if u.Scheme == "rtsps" {
+			port = rtspsDefaultPort
+		}
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "rtsps" {
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return "", fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	t := &rtspTunnel{
+		camera:     conn,
+		localBase:  "rtsp://" + listener.Addr().String(),
+		cameraBase: u.Scheme + "://" + u.Host,
+		// The longer form first, so the port isn't left behind
+		cameraURLs: []string{u.Scheme + "://" + hostPort, u.Scheme + "://" + u.Host},
+		pending:    make(map[string]*rtspMessage),
+	}
+	if u.User != nil {
+		t.username = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+
+	go func() {
+		if timeout > 0 {
+			listener.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+		}
+		client, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		t.client = client
+		t.run()
+	}()
+
+	local := *u
+	local.Scheme = "rtsp"
+	local.Host = listener.Addr().String()
+	local.User = nil
+	return local.String(), nil
+}
+
+// run relays messages both ways until either side closes
+func (t *rtspTunnel) run() {
+	done := make(chan struct{}, 2)
+	go func() {
+		t.fromClient()
+		done <- struct{}{}
+	}()
+	go func() {
+		t.fromCamera()
+		done <- struct{}{}
+	}()
+	<-done
+	t.client.Close()
+	t.camera.Close()
+	<-done
+}
+
+// fromClient forwards vdk's requests to the camera, pointing them at the
+// camera's URL and adding the current credentials
+func (t *rtspTunnel) fromClient() {
+	r := bufio.NewReader(t.client)
+	for {
+		msg, err := readRTSPMessage(r)
+		if err != nil {
+			return
+		}
+		if msg.frame == nil {
+			msg.lines[0] = t.rewriteRequestLine(msg.lines[0])
+			if cseq := rtspHeader(msg.lines, "CSeq"); cseq != "" {
+				t.lock.Lock()
+				t.pending[cseq] = msg
+				t.lock.Unlock()
+			}
+		}
+		if err := t.sendToCamera(msg); err != nil {
+			return
+		}
+	}
+}
+
+// fromCamera forwards the camera's responses and RTP to vdk. A request the
+// camera challenges is sent again once with credentials for the challenge.
+func (t *rtspTunnel) fromCamera() {
+	r := bufio.NewReader(t.camera)
+	w := t.client
+	for {
+		msg, err := readRTSPMessage(r)
+		if err != nil {
+			return
+		}
+		if msg.frame != nil {
+			if _, err := w.Write(msg.frame); err != nil {
+				return
+			}
+			continue
+		}
+
+		cseq := rtspHeader(msg.lines, "CSeq")
+		t.lock.Lock()
+		req := t.pending[cseq]
+		delete(t.pending, cseq)
+		retry := req != nil && !req.retried && rtspStatus(msg.lines[0]) == 401 &&
+			t.username != "" && t.challenge(msg.lines)
+		if retry {
+			req.retried = true
+			t.pending[cseq] = req
+		}
+		t.lock.Unlock()
+		if retry {
+			if err := t.sendToCamera(req); err != nil {
+				return
+			}
+			continue
+		}
+
+		if len(msg.body) > 0 {
+			body := string(msg.body)
+			for _, base := range t.cameraURLs {
+				body = strings.ReplaceAll(body, base, t.localBase)
+			}
+			msg.body = []byte(body)
+			msg.lines = setRTSPHeader(msg.lines, "Content-Length", strconv.Itoa(len(msg.body)))
+		}
+		if err := writeRTSPMessage(w, msg); err != nil {
+			return
+		}
+	}
+}
+
+// sendToCamera writes a message to the camera, authorizing requests
+func (t *rtspTunnel) sendToCamera(msg *rtspMessage) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if msg.frame != nil {
+		_, err := t.camera.Write(msg.frame)
+		return err
+	}
+
+	out := *msg
+	if method, uri, ok := rtspRequestLine(msg.lines[0]); ok {
+		if auth := t.authorization(method, uri); auth != "" {
+			out.lines = setRTSPHeader(append([]string(nil), msg.lines...), "Authorization", auth)
+		}
+	}
+	return writeRTSPMessage(t.camera, &out)
+}
+
+// challenge takes the auth scheme from a 401 response, preferring digest.
+// The caller holds lock.
+func (t *rtspTunnel) challenge(lines []string) bool {
+	values := rtspHeaderValues(lines, "WWW-Authenticate")
+	if digest := parseDigestChallenge(values); digest != nil {
+		t.digest, t.basic = digest, false
+		return true
+	}
+	for _, value := range values {
+		if strings.HasPrefix(strings.ToLower(value), "basic") {
+			t.digest, t.basic = nil, true
+			return true
+		}
+	}
+	return false
+}
+
+// authorization returns the Authorization header for a request, if the
+// camera has asked for credentials. The caller holds lock.
+func (t *rtspTunnel) authorization(method, uri string) string {
+	switch {
+	case t.digest != nil:
+		return t.digest.authorization(method, uri, t.username, t.password)
+	case t.basic:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(t.username+":"+t.password))
+	}
+	return ""
+}
+
+// rewriteRequestLine points a request at the camera instead of the tunnel
+func (t *rtspTunnel) rewriteRequestLine(line string) string {
+	method, uri, ok := rtspRequestLine(line)
+	if !ok || !strings.HasPrefix(uri, t.localBase) {
+		return line
+	}
+	version := line[strings.LastIndexByte(line, ' ')+1:]
+	return method + " " + t.cameraBase + strings.TrimPrefix(uri, t.localBase) + " " + version
+}
+
+// readRTSPMessage reads the next interleaved frame or RTSP message
+func readRTSPMessage(r *bufio.Reader) (*rtspMessage, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == '$' {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		frame := make([]byte, 4+int(binary.BigEndian.Uint16(header[2:])))
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[4:]); err != nil {
+			return nil, err
+		}
+		return &rtspMessage{frame: frame}, nil
+	}
+
+	msg := &rtspMessage{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(msg.lines) == 0 {
+				continue
+			}
+			break
+		}
+		if len(msg.lines) >= 128 {
+			return nil, errors.New("rtsp: too many header lines")
+		}
+		msg.lines = append(msg.lines, line)
+	}
+
+	if n, _ := strconv.Atoi(rtspHeader(msg.lines, "Content-Length")); n > 0 {
+		if n > rtspMaxBody {
+			return nil, fmt.Errorf("rtsp: body of %d bytes too large", n)
+		}
+		msg.body = make([]byte, n)
+		if _, err := io.ReadFull(r, msg.body); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// writeRTSPMessage writes an RTSP message in a single write
+func writeRTSPMessage(w io.Writer, msg *rtspMessage) error {
+	var b strings.Builder
+	for _, line := range msg.lines {
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(msg.body)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// rtspRequestLine splits "METHOD uri RTSP/1.0"
+func rtspRequestLine(line string) (method, uri string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "RTSP/") {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+// rtspStatus returns the status code of a response line
+func rtspStatus(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+// rtspHeader returns the first value of a header
+func rtspHeader(lines []string, name string) string {
+	if values := rtspHeaderValues(lines, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// rtspHeaderValues returns every value of a header
+func rtspHeaderValues(lines []string, name string) []string {
+	var values []string
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
+
+// setRTSPHeader replaces a header's value, adding it if missing
+func setRTSPHeader(lines []string, name, value string) []string {
+	for i, line := range lines[1:] {
+		key, _, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			lines[i+1] = name + ": " + value
+			return lines
+		}
+	}
+	return append(lines, name+": "+value)
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scan states reported in scan_progress messages
+const (
+	scanStateRunning   = "running"
+	scanStateCompleted = "completed"
+	scanStateCancelled = "cancelled"
+)
+
+// ScanProgress describes the current or most recent network scan
+type ScanProgress struct {
+	ScanID     string     `json:"scan_id"`
+	State      string     `json:"state"`
+	Total      int        `json:"total"`
+	Scanned    int        `json:"scanned"`
+	Skipped    int        `json:"skipped"`
+	Found      int        `json:"found"`
+	Resumed    bool       `json:"resumed"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// scanCheckpoint is persisted so an interrupted scan resumes where it
+// stopped instead of starting over
+type scanCheckpoint struct {
+	ScanID      string `json:"scan_id"`
+	Fingerprint string `json:"fingerprint"`
+	Next        int    `json:"next"`
+}
+
+// NetworkScanner probes local subnets for RTSP cameras with a bounded
+// worker pool
+type NetworkScanner struct {
+	eg         *EdgeGateway
+	trigger    chan struct{}
+	reschedule chan struct{}
+
+	lock     sync.Mutex
+	progress *ScanProgress
+	cancel   context.CancelFunc
+}
+
+func NewNetworkScanner(eg *EdgeGateway) *NetworkScanner {
+	return &NetworkScanner{
+		eg:         eg,
+		trigger:    make(chan struct{}, 1),
+		reschedule: make(chan struct{}, 1),
+	}
+}
+
+// Run scans immediately and then on the configured schedule or on demand
+// until ctx is cancelled
+func (s *NetworkScanner) Run(ctx context.Context) {
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	schedule := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if interval := s.eg.settings().ScanInterval; interval > 0 {
+			ticker = time.NewTicker(interval)
+			tick = ticker.C
+		}
+	}
+	schedule()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		s.scan(ctx)
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				break wait
+			case <-s.trigger:
+				break wait
+			case <-s.reschedule:
+				schedule()
+			}
+		}
+	}
+}
+
+// Trigger requests a scan as soon as the current one (if any) finishes
+func (s *NetworkScanner) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Reschedule restarts the scan schedule after the interval changes
+func (s *NetworkScanner) Reschedule() {
+	select {
+	case s.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel stops the running scan; its position is kept for resumption
+func (s *NetworkScanner) Cancel() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cancel == nil {
+		return false
+	}
+	s.cancel()
+	return true
+}
+
+// Progress returns a copy of the current or last scan's progress
+func (s *NetworkScanner) Progress() *ScanProgress {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.progress == nil {
+		return nil
+	}
+	p := *s.progress
+	return &p
+}
+
+// scan runs a single pass over all scan targets
+func (s *NetworkScanner) scan(parent context.Context) {
+	targets := s.eg.scanTargets()
+	if len(targets) == 0 {
+		return
+	}
+	if err := s.eg.checkHeadroom(""); err != nil {
+		log.Printf("Skipping network scan: %v", err)
+		return
+	}
+	fingerprint := targetsFingerprint(targets)
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// Resume an interrupted scan over the same targets
+	progress := &ScanProgress{
+		ScanID:    fmt.Sprintf("scan-%d", time.Now().Unix()),
+		State:     scanStateRunning,
+		Total:     len(targets),
+		StartedAt: time.Now(),
+	}
+	start := 0
+	if cp := s.loadCheckpoint(); cp != nil && cp.Fingerprint == fingerprint && cp.Next > 0 && cp.Next < len(targets) {
+		start = cp.Next
+		progress.ScanID = cp.ScanID
+		progress.Scanned = cp.Next
+		progress.Resumed = true
+		log.Printf("Resuming network scan %s at %d/%d", cp.ScanID, cp.Next, len(targets))
+	}
+
+	s.lock.Lock()
+	s.progress = progress
+	s.cancel = cancel
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.cancel = nil
+		s.lock.Unlock()
+	}()
+
+	// Workers are cut to fit under MAX_GOROUTINES
+	workers := s.eg.cfg.ScanWorkers
+	if limit := s.eg.cfg.MaxGoroutines; limit > 0 {
+		workers = min(workers, limit-runtime.NumGoroutine())
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	log.Printf("Starting network scan %s of %d hosts with %d workers",
+		progress.ScanID, len(targets)-start, workers)
+
+	jobs := make(chan int)
+	results := make(chan scanResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- s.probe(ctx, i, targets[i])
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+
+		// Pace probes so large subnets don't flood the network
+		var limiter *time.Ticker
+		if rate := s.eg.cfg.ScanRate; rate > 0 {
+			limiter = time.NewTicker(time.Second / time.Duration(rate))
+			defer limiter.Stop()
+		}
+
+		for i := start; i < len(targets); i++ {
+			if limiter != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-limiter.C:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- i:
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Track the highest index below which every target has been probed
+	done := make([]bool, len(targets))
+	next := start
+	report := time.NewTicker(5 * time.Second)
+	defer report.Stop()
+	lastSaved := next
+
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				s.finish(ctx, progress, fingerprint, next, len(targets))
+				return
+			}
+			done[res.index] = true
+			for next < len(targets) && done[next] {
+				next++
+			}
+
+			s.lock.Lock()
+			progress.Scanned++
+			if res.skipped {
+				progress.Skipped++
+			}
+			if res.found {
+				progress.Found++
+			}
+			s.lock.Unlock()
+
+		case <-report.C:
+			s.reportProgress()
+			if next != lastSaved {
+				s.saveCheckpoint(&scanCheckpoint{ScanID: progress.ScanID, Fingerprint: fingerprint, Next: next})
+				lastSaved = next
+			}
+		}
+	}
+}
+
+type scanResult struct {
+	index   int
+	found   bool
+	skipped bool
+}
+
+// probe checks one host unless it is already a known camera, or waiting for
+// its login
+func (s *NetworkScanner) probe(ctx context.Context, index int, ip string) scanResult {
+	if s.eg.knownCameraIP(ip) || s.eg.credentialsPending(ip) {
+		return scanResult{index: index, skipped: true}
+	}
+	return scanResult{index: index, found: s.eg.checkRTSPPort(ctx, ip)}
+}
+
+// finish records the outcome of a scan pass
+func (s *NetworkScanner) finish(ctx context.Context, progress *ScanProgress, fingerprint string, next, total int) {
+	now := time.Now()
+
+	s.lock.Lock()
+	progress.FinishedAt = &now
+	if ctx.Err() != nil && next < total {
+		progress.State = scanStateCancelled
+	} else {
+		progress.State = scanStateCompleted
+	}
+	s.lock.Unlock()
+
+	if progress.State == scanStateCancelled {
+		s.saveCheckpoint(&scanCheckpoint{ScanID: progress.ScanID, Fingerprint: fingerprint, Next: next})
+		log.Printf("Network scan %s interrupted at %d/%d", progress.ScanID, next, total)
+	} else {
+		os.Remove(s.checkpointPath())
+		log.Printf("Network scan %s complete: %d hosts, %d cameras found",
+			progress.ScanID, progress.Total, progress.Found)
+	}
+	s.reportProgress()
+}
+
+// reportProgress sends the current scan progress to cloud
+func (s *NetworkScanner) reportProgress() {
+	if p := s.Progress(); p != nil {
+		s.eg.sendEvent("scan_progress", p)
+	}
+}
+
+func (s *NetworkScanner) checkpointPath() string {
+	return filepath.Join(s.eg.cfg.DataDir, "scan-checkpoint.json")
+}
+
+func (s *NetworkScanner) loadCheckpoint() *scanCheckpoint {
+	data, err := os.ReadFile(s.checkpointPath())
+	if err != nil {
+		return nil
+	}
+	var cp scanCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil
+	}
+	return &cp
+}
+
+func (s *NetworkScanner) saveCheckpoint(cp *scanCheckpoint) {
+	data, _ := json.Marshal(cp)
+	if err := writeFileAtomic(s.checkpointPath(), data); err != nil {
+		log.Printf("Failed to save scan checkpoint: %v", err)
+	}
+}
+
+// scanMaxHostBits caps the size of a single scanned subnet (a /16 for IPv4)
+const scanMaxHostBits = 16
+
+// scanTargets lists the host addresses to probe, after allow/deny filtering
+func (eg *EdgeGateway) scanTargets() []string {
+	seen := make(map[string]bool)
+	var targets []string
+
+	subnets := append(eg.interfaceSubnets(), eg.settings().ScanSubnets...)
+	for _, subnet := range subnets {
+		hosts, err := subnetHosts(subnet)
+		if err != nil {
+			log.Printf("Not scanning %s: %v", subnet, err)
+			continue
+		}
+		for _, ip := range hosts {
+			key := ip.String()
+			if seen[key] || !eg.scanAllowed(ip) {
+				continue
+			}
+			seen[key] = true
+			targets = append(targets, key)
+		}
+	}
+
+	sort.Strings(targets)
+	return targets
+}
+
+// interfaceSubnets returns the IPv4 networks of the local interfaces,
+// narrowed to SCAN_INTERFACE_PREFIX. IPv6 interface networks are far too
+// large to sweep; IPv6 cameras are found via mDNS or SCAN_SUBNETS.
+func (eg *EdgeGateway) interfaceSubnets() []*net.IPNet {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("Failed to get network interfaces: %v", err)
+		return nil
+	}
+
+	var subnets []*net.IPNet
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+
+			ones, _ := ipNet.Mask.Size()
+			if ones < eg.cfg.ScanInterfacePrefix {
+				ones = eg.cfg.ScanInterfacePrefix
+			}
+			mask := net.CIDRMask(ones, 32)
+			subnets = append(subnets, &net.IPNet{IP: ipNet.IP.To4().Mask(mask), Mask: mask})
+		}
+	}
+	return subnets
+}
+
+// subnetHosts enumerates the host addresses of a subnet, leaving out the
+// network address and, for IPv4, the broadcast address
+func subnetHosts(subnet *net.IPNet) ([]net.IP, error) {
+	ones, bits := subnet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > scanMaxHostBits {
+		return nil, fmt.Errorf("subnet larger than /%d", bits-scanMaxHostBits)
+	}
+
+	base := subnet.IP.Mask(subnet.Mask)
+	size := 1 << hostBits
+	first, last := 0, size-1
+	if hostBits > 1 {
+		first = 1
+		if bits == 32 {
+			last = size - 2
+		}
+	}
+
+	hosts := make([]net.IP, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		ip := make(net.IP, len(base))
+		copy(ip, base)
+		// The host bits of base are zero, so the offset can be OR'd in
+		n := len(ip)
+		ip[n-1] |= byte(i)
+		ip[n-2] |= byte(i >> 8)
+		ip[n-3] |= byte(i >> 16)
+		hosts = append(hosts, ip)
+	}
+	return hosts, nil
+}
+
+// scanAllowed applies the ignored IPs and the configured CIDR allow and
+// deny lists
+func (eg *EdgeGateway) scanAllowed(ip net.IP) bool {
+	settings := eg.settings()
+	for _, ignored := range settings.IgnoredIPs {
+		if ignored.Equal(ip) {
+			return false
+		}
+	}
+	for _, deny := range settings.ScanDenyCIDRs {
+		if deny.Contains(ip) {
+			return false
+		}
+	}
+	if len(settings.ScanAllowCIDRs) == 0 {
+		return true
+	}
+	for _, allow := range settings.ScanAllowCIDRs {
+		if allow.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownCameraIP reports whether a camera is already registered at ip
+func (eg *EdgeGateway) knownCameraIP(ip string) bool {
+	eg.camerasLock.RLock()
+	defer eg.camerasLock.RUnlock()
+
+	for _, camera := range eg.cameras {
+		if camera.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRTSPPort checks if RTSP is available on the given IP and registers
+// the camera if so
+func (eg *EdgeGateway) checkRTSPPort(ctx context.Context, ip string) bool {
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, "554"))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	// Try to connect via RTSP with the camera's stored or default credentials
+	camera := &Camera{
+		ID:   cameraIDFromIP(ip),
+		Name: fmt.Sprintf("Camera-%s", ip),
+		IP:   ip,
+		Port: 554,
+	}
+
+	// Find the vendor path the camera actually serves
+	status := "discovered"
+	if err := eg.detectRTSPProfile(ctx, camera); err != nil {
+		if !errors.Is(err, errCredentialsRejected) {
+			return false
+		}
+		if !eg.initializeCamera(ctx, camera) {
+			eg.requireCredentials(camera, "scan", err)
+			return false
+		}
+		if err := eg.detectRTSPProfile(ctx, camera); err != nil {
+			log.Printf("Camera at %s initialized but not streaming: %v", ip, err)
+			return false
+		}
+		status = "provisioned"
+	}
+	eg.probeCapabilities(ctx, camera)
+
+	if !eg.admitCamera(camera) || !eg.registerCamera(camera) {
+		return false
+	}
+
+	log.Printf("Found camera via network scan: %s", ip)
+	eg.notifyCameraStatus(camera, status)
+	eg.registerChannels(ctx, camera, status)
+	return true
+}
+
+// targetsFingerprint identifies a target list so checkpoints are only
+// resumed against the same set of hosts
+func targetsFingerprint(targets []string) string {
+	h := sha1.New()
+	h.Write([]byte(strings.Join(targets, ",")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeFileAtomic writes data to a temp file and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,144 @@
+#!/bin/bash
+
+# Macvlan Network Helper for Edge Gateway
+# Gives the gateway container its own address on the camera LAN, so mDNS
+# discovery and network scans work without host networking
+
+set -euo pipefail
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+BLUE='\033[0;34m'
+NC='\033[0m' # No Color
+
+# Defaults
+NETWORK="edge-gateway-lan"
+PARENT=""
+SUBNET=""
+GATEWAY=""
+IP_RANGE=""
+SHIM_IP=""
+ACTION="create"
+
+log() {
+    echo -e "${BLUE}[INFO]${NC} $1"
+}
+
+warn() {
+    echo -e "${YELLOW}[WARN]${NC} $1"
+}
+
+error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+    exit 1
+}
+
+success() {
+    echo -e "${GREEN}[SUCCESS]${NC} $1"
+}
+
+usage() {
+    cat << EOF
+Macvlan Network Helper for Edge Gateway
+
+Usage: $0 [OPTIONS] [ACTION]
+
+ACTIONS:
+    create      Create the macvlan network and host shim (default)
+    remove      Remove them
+
+OPTIONS:
+    -i, --interface IFACE   Host interface on the camera LAN (default: the default route's)
+    -s, --subnet CIDR       The LAN's subnet (default: the interface's)
+    -g, --gateway IP        The LAN's router (default: the default route's)
+    -r, --ip-range CIDR     Addresses Docker may give containers, outside the LAN's DHCP pool
+    -S, --shim-ip IP        Host address on the shim, so host and gateway can reach each other
+    -n, --network NAME      Docker network name (default: $NETWORK)
+    -h, --help              Show this help message
+
+Then start the gateway on it:
+    GATEWAY_LAN_IP=192.168.1.240 docker compose -f docker-compose.yml -f docker-compose.macvlan.yml up -d
+EOF
+}
+
+while [[ $# -gt 0 ]]; do
+    case $1 in
+        -i|--interface) PARENT="$2"; shift 2 ;;
+        -s|--subnet) SUBNET="$2"; shift 2 ;;
+        -g|--gateway) GATEWAY="$2"; shift 2 ;;
+        -r|--ip-range) IP_RANGE="$2"; shift 2 ;;
+        -S|--shim-ip) SHIM_IP="$2"; shift 2 ;;
+        -n|--network) NETWORK="$2"; shift 2 ;;
+        -h|--help) usage; exit 0 ;;
+        create|remove) ACTION="$1"; shift ;;
+        *) error "Unknown option: $1" ;;
+    esac
+done
+
+SHIM="${NETWORK:0:11}-shim"
+
+remove_network() {
+    if ip link show "$SHIM" &> /dev/null; then
+        log "Removing host shim $SHIM..."
+        sudo ip link del "$SHIM"
+    fi
+    if docker network inspect "$NETWORK" &> /dev/null; then
+        log "Removing Docker network $NETWORK..."
+        docker network rm "$NETWORK" > /dev/null
+    fi
+    success "Macvlan network removed"
+}
+
+create_network() {
+    command -v docker &> /dev/null || error "Docker is not installed"
+    command -v ip &> /dev/null || error "The ip command (iproute2) is required"
+
+    if [[ -z "$PARENT" ]]; then
+        PARENT=$(ip route show default | awk '/default/ {print $5; exit}')
+        [[ -n "$PARENT" ]] || error "No default route, pass --interface"
+    fi
+    if [[ -z "$GATEWAY" ]]; then
+        GATEWAY=$(ip route show default dev "$PARENT" | awk '/default/ {print $3; exit}')
+    fi
+    if [[ -z "$SUBNET" ]]; then
+        SUBNET=$(ip -4 route show dev "$PARENT" scope link | awk '{print $1; exit}')
+        [[ -n "$SUBNET" ]] || error "Could not find the subnet of $PARENT, pass --subnet"
+    fi
+    [[ -n "$IP_RANGE" ]] || warn "No --ip-range: Docker may hand out addresses the LAN's DHCP server uses too"
+
+    if docker network inspect "$NETWORK" &> /dev/null; then
+        warn "Docker network $NETWORK already exists, leaving it"
+    else
+        log "Creating macvlan network $NETWORK on $PARENT ($SUBNET via $GATEWAY)..."
+        args=(-d macvlan --subnet "$SUBNET" -o parent="$PARENT")
+        [[ -n "$GATEWAY" ]] && args+=(--gateway "$GATEWAY")
+        [[ -n "$IP_RANGE" ]] && args+=(--ip-range "$IP_RANGE")
+        docker network create "${args[@]}" "$NETWORK" > /dev/null
+    fi
+
+    # Macvlan containers can't talk to their host directly; a macvlan
+    # interface on the host bridges the two
+    if [[ -n "$SHIM_IP" ]]; then
+        if ip link show "$SHIM" &> /dev/null; then
+            warn "Host shim $SHIM already exists, leaving it"
+        else
+            log "Creating host shim $SHIM with $SHIM_IP..."
+            sudo ip link add "$SHIM" link "$PARENT" type macvlan mode bridge
+            sudo ip addr add "$SHIM_IP/32" dev "$SHIM"
+            sudo ip link set "$SHIM" up
+            [[ -n "$IP_RANGE" ]] && sudo ip route add "$IP_RANGE" dev "$SHIM"
+            warn "The shim doesn't survive a reboot; add it to the host's network configuration to keep it"
+        fi
+    fi
+
+    success "Macvlan network $NETWORK ready"
+    echo "Start the gateway on it with an address in ${IP_RANGE:-$SUBNET}:"
+    echo "    GATEWAY_LAN_IP=<address> docker compose -f docker-compose.yml -f docker-compose.macvlan.yml up -d"
+}
+
+case $ACTION in
+    create) create_network ;;
+    remove) remove_network ;;
+esac
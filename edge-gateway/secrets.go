@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Credentials is a camera login. It is kept out of Camera so it can never be
+// marshaled to the cloud or the local API, and it prints without the password.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// String hides the password when credentials end up in a log line
+func (c Credentials) String() string {
+	return c.Username + ":[REDACTED]"
+}
+
+// GoString hides the password from %#v
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// defaultCredentials returns the CAMERA_USERNAME/CAMERA_PASSWORD login used
+// for discovered cameras
+func defaultCredentials() Credentials {
+	creds := Credentials{
+		Username: os.Getenv("CAMERA_USERNAME"),
+		Password: os.Getenv("CAMERA_PASSWORD"),
+	}
+	if creds.Username == "" {
+		creds.Username = "root"
+	}
+	if creds.Password == "" {
+		creds.Password = "pass"
+	}
+	return creds
+}
+
+// CredentialStore holds per-camera credentials by camera ID. Cameras without
+// an entry use the default credentials. Once loaded from a file, every
+// change is saved back to it.
+type CredentialStore struct {
+	lock  sync.RWMutex
+	creds map[string]Credentials
+	path  string
+}
+
+// savedCredentials is a login as saved to disk
+type savedCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func NewCredentialStore() *CredentialStore {
+	return &CredentialStore{creds: make(map[string]Credentials)}
+}
+
+// Get returns the credentials for a camera
+func (s *CredentialStore) Get(cameraID string) Credentials {
+	if creds, ok := s.Lookup(cameraID); ok {
+		return creds
+	}
+	return defaultCredentials()
+}
+
+// Lookup returns a camera's own credentials, if it has any
+func (s *CredentialStore) Lookup(cameraID string) (Credentials, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	creds, ok := s.creds[cameraID]
+	return creds, ok
+}
+
+// Set stores credentials for a camera
+func (s *CredentialStore) Set(cameraID string, creds Credentials) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, ok := s.creds[cameraID]; ok && existing == creds {
+		return
+	}
+	s.creds[cameraID] = creds
+	s.saveLocked()
+}
+
+// Delete forgets a camera's credentials
+func (s *CredentialStore) Delete(cameraID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.creds[cameraID]; !ok {
+		return
+	}
+	delete(s.creds, cameraID)
+	s.saveLocked()
+}
+
+// Load restores the credentials saved at path, which is only readable by
+// the gateway's user, and saves later changes there. Credentials set before
+// it is called take precedence.
+func (s *CredentialStore) Load(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read saved credentials: %v", err)
+		}
+		return
+	}
+	var saved map[string]savedCredentials
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Discarding unreadable saved credentials: %v", err)
+		return
+	}
+	for id, creds := range saved {
+		if _, ok := s.creds[id]; !ok {
+			s.creds[id] = Credentials{Username: creds.Username, Password: creds.Password}
+		}
+	}
+}
+
+// saveLocked writes the credentials to the store's file, if it has one. The
+// caller holds lock.
+func (s *CredentialStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	saved := make(map[string]savedCredentials, len(s.creds))
+	for id, creds := range s.creds {
+		saved[id] = savedCredentials{Username: creds.Username, Password: creds.Password}
+	}
+	data, _ := json.Marshal(saved)
+	if err := writeFileAtomic(s.path, data); err != nil {
+		log.Printf("Failed to save credentials: %v", err)
+	}
+}
+
+// URL returns rawURL with the camera's credentials embedded, for dialing only.
+// The result must not be logged or stored.
+func (s *CredentialStore) URL(cameraID, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	creds := s.Get(cameraID)
+	u.User = url.UserPassword(creds.Username, creds.Password)
+	return u.String()
+}
+
+// userinfoPattern matches the user:password@ part of URLs in free text
+var userinfoPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// stripCredentials removes any user:password@ from a URL
+func stripCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactCredentials(rawURL)
+	}
+	u.User = nil
+	return u.String()
+}
+
+// redactCredentials removes user:password@ from every URL in s, such as
+// error messages from RTSP and HTTP libraries that echo the request URL
+func redactCredentials(s string) string {
+	return userinfoPattern.ReplaceAllString(s, "$1")
+}
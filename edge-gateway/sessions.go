@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Reasons a viewer session ends, reported in session_close
+const (
+	sessionReasonClosed         = "closed"        // the viewer hung up
+	sessionReasonFailed         = "failed"        // ICE or DTLS failed
+	sessionReasonCloudRequest   = "cloud_request" // session_close from the cloud
+	sessionReasonTimeout        = "timeout"       // no RTCP within VIEWER_IDLE_TIMEOUT
+	sessionReasonRestartTimeout = "ice_restart_timeout"
+	sessionReasonShutdown       = "gateway_shutdown"
+	sessionReasonOverCapacity   = "over_capacity" // refused by the uplink budget
+	sessionReasonUnauthorized   = "unauthorized"  // refused without a stream token
+	sessionReasonTenantChanged  = "tenant_changed"
+	sessionReasonHandoff        = "handoff" // moved to another member of the cluster
+	// Offers for a camera another member of the cluster streams
+	sessionReasonClusterRedirect = "cluster_redirect"
+	// Offers that couldn't be answered, such as for a camera that is down
+	sessionReasonSetupFailed = "setup_failed"
+)
+
+// touch records RTCP from the viewer, which keeps its session alive
+func (v *Viewer) touch() {
+	v.lastRTCP.Store(time.Now().UnixNano())
+}
+
+// idleFor is how long the viewer has sent no RTCP, counted from the start of
+// the session until its first report
+func (v *Viewer) idleFor(now time.Time) time.Duration {
+	last := v.since
+	if nanos := v.lastRTCP.Load(); nanos != 0 {
+		last = time.Unix(0, nanos)
+	}
+	return now.Sub(last)
+}
+
+// close ends the session, keeping the first reason given for session_close
+func (v *Viewer) close(reason string) {
+	v.lock.Lock()
+	if v.closeReason == "" {
+		v.closeReason = reason
+	}
+	v.lock.Unlock()
+	v.pc.Close()
+}
+
+// endReason is why the session ended once its connection is closed or failed
+func (v *Viewer) endReason(state webrtc.PeerConnectionState) string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	switch {
+	case v.closeReason != "":
+		return v.closeReason
+	case state == webrtc.PeerConnectionStateFailed:
+		return sessionReasonFailed
+	default:
+		return sessionReasonClosed
+	}
+}
+
+// viewer returns the viewer with a session ID, or nil
+func (eg *EdgeGateway) viewer(sessionID string) *Viewer {
+	eg.viewersLock.Lock()
+	defer eg.viewersLock.Unlock()
+	return eg.viewers[sessionID]
+}
+
+// openSession reports a new viewer session to the cloud
+func (eg *EdgeGateway) openSession(v *Viewer) {
+	payload := map[string]interface{}{
+		"session_id": v.ID,
+		"kind":       v.Kind,
+		"camera_id":  v.CameraID,
+	}
+	if v.Profile != viewerProfileMain {
+		payload["profile"] = v.Profile
+	}
+	if v.Codec != videoCodecH264 {
+		payload["codec"] = v.Codec
+	}
+	if v.layers != nil {
+		payload["layer"] = v.Layer
+		payload["simulcast"] = v.simulcast
+	}
+	if v.watermark != nil {
+		payload["watermarked"] = true
+	}
+	if key := eg.e2ee.Get(v.CameraID); key != nil {
+		payload["e2ee_key_id"] = key.id
+	}
+	eg.sendEvent("session_open", payload)
+}
+
+// endSession reports a viewer session that has ended
+func (eg *EdgeGateway) endSession(v *Viewer, reason string) {
+	log.Printf("Viewer session %s for camera %s ended (%s)", v.ID, v.CameraID, reason)
+	payload := map[string]interface{}{
+		"session_id":    v.ID,
+		"kind":          v.Kind,
+		"camera_id":     v.CameraID,
+		"reason":        reason,
+		"duration_secs": time.Since(v.since).Seconds(),
+	}
+	if reason == sessionReasonFailed {
+		payload["error_code"] = errorCodeICEFailed
+	}
+	eg.sendEvent("session_close", payload)
+}
+
+// handleSessionClose closes one viewer's peer connection at the cloud's
+// request, leaving the camera's stream and other viewers running
+func (eg *EdgeGateway) handleSessionClose(sessionID string) error {
+	v := eg.viewer(sessionID)
+	if v == nil {
+		log.Printf("No viewer session %s to close", sessionID)
+		return errors.New("no such viewer session")
+	}
+	v.close(sessionReasonCloudRequest)
+	return nil
+}
+
+// reapIdleSessions closes viewers that have sent no RTCP for
+// VIEWER_IDLE_TIMEOUT. A player that went away without hanging up, or whose
+// path broke, otherwise holds its stream open until ICE gives up.
+func (eg *EdgeGateway) reapIdleSessions(ctx context.Context) {
+	timeout := eg.cfg.ViewerIdleTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	interval := timeout / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			eg.viewersLock.Lock()
+			viewers := make([]*Viewer, 0, len(eg.viewers))
+			for _, v := range eg.viewers {
+				viewers = append(viewers, v)
+			}
+			eg.viewersLock.Unlock()
+
+			now := time.Now()
+			for _, v := range viewers {
+				v.lock.Lock()
+				closing := v.closeReason != ""
+				v.lock.Unlock()
+				idle := v.idleFor(now)
+				if closing || idle < timeout {
+					continue
+				}
+				log.Printf("Viewer session %s for camera %s sent no RTCP for %s, closing",
+					v.ID, v.CameraID, idle.Round(time.Second))
+				eg.sendEvent("session_timeout", map[string]interface{}{
+					"session_id": v.ID,
+					"kind":       v.Kind,
+					"camera_id":  v.CameraID,
+					"idle_secs":  idle.Seconds(),
+				})
+				go v.close(sessionReasonTimeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// drain winds the gateway down before cleanup closes everything: it tells
+// the cloud, closes viewers' peer connections so players see the stream end
+// instead of timing out, finalizes HLS playlists, and delivers what is still
+// queued. It gives up after SHUTDOWN_DRAIN_TIMEOUT, which counts against
+// SHUTDOWN_TIMEOUT.
+func (eg *EdgeGateway) drain() {
+	timeout := eg.cfg.ShutdownDrainTimeout
+	if timeout > eg.cfg.ShutdownTimeout {
+		timeout = eg.cfg.ShutdownTimeout
+	}
+	if timeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	started := time.Now()
+
+	viewers := 0
+	eg.peerConnsLock.RLock()
+	for _, p := range eg.peerConns {
+		if p.pc != nil {
+			viewers++
+		}
+	}
+	eg.peerConnsLock.RUnlock()
+	eg.whepLock.Lock()
+	viewers += len(eg.whepSessions)
+	eg.whepLock.Unlock()
+
+	reason := "shutdown"
+	if eg.pendingRestart() != "" {
+		reason = "restart"
+	}
+	eg.sendEvent("gateway_shutdown", map[string]interface{}{
+		"reason":        reason,
+		"viewers":       viewers,
+		"drain_timeout": timeout.Seconds(),
+	})
+
+	// Clustered gateways leave first, so players can move to the members
+	// that take over their cameras
+	if eg.cluster != nil {
+		eg.setClusterDraining(true, 0)
+	}
+	eg.closeViewers(ctx)
+	eg.finishHLS()
+
+	// Events raised while draining, and any left from an earlier send
+	// failure, go out before the connection closes
+	eg.flushInventory()
+	eg.cloudLock.Lock()
+	if eg.cloudConn != nil {
+		eg.deliverOutbox()
+	}
+	eg.cloudLock.Unlock()
+
+	// Let the final segments and playlists reach GCS
+	eg.waitHLSUploads(ctx)
+
+	log.Printf("Drained %d viewers in %s", viewers, time.Since(started).Round(time.Millisecond))
+}
+
+// closeViewers closes every cloud and WHEP peer connection, which sends
+// viewers a DTLS close_notify, and tells the cloud which sessions ended
+func (eg *EdgeGateway) closeViewers(ctx context.Context) {
+	var pcs []*webrtc.PeerConnection
+	closed := make(map[string]string) // camera ID by session ID
+
+	eg.viewersLock.Lock()
+	for _, v := range eg.viewers {
+		v.lock.Lock()
+		if v.closeReason == "" {
+			v.closeReason = sessionReasonShutdown
+		}
+		v.lock.Unlock()
+	}
+	eg.viewersLock.Unlock()
+
+	eg.peerConnsLock.Lock()
+	for sessionID, p := range eg.peerConns {
+		if p.pc != nil {
+			closed[sessionID] = p.cameraID
+			pcs = append(pcs, p.pc)
+		}
+		delete(eg.peerConns, sessionID)
+	}
+	eg.peerConnsLock.Unlock()
+
+	for sessionID, cameraID := range closed {
+		eg.sendEvent("webrtc_closed", map[string]interface{}{
+			"camera_id":  cameraID,
+			"session_id": sessionID,
+			"reason":     sessionReasonShutdown,
+		})
+	}
+
+	eg.whepLock.Lock()
+	for sessionID, pc := range eg.whepSessions {
+		pcs = append(pcs, pc)
+		delete(eg.whepSessions, sessionID)
+	}
+	eg.whepLock.Unlock()
+
+	// Close concurrently; each close waits for its DTLS alert to be sent
+	done := make(chan struct{}, len(pcs))
+	for _, pc := range pcs {
+		go func(pc *webrtc.PeerConnection) {
+			pc.Close()
+			done <- struct{}{}
+		}(pc)
+	}
+	for range pcs {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// finishHLS closes the segment in progress on every HLS stream and ends its
+// playlist, so players and GCS copies don't wait for segments that will
+// never come
+func (eg *EdgeGateway) finishHLS() {
+	eg.streamsLock.RLock()
+	defer eg.streamsLock.RUnlock()
+	for _, stream := range eg.streams {
+		if stream.hls != nil {
+			stream.hls.Finish()
+		}
+	}
+}
+
+// waitHLSUploads waits for queued HLS uploads to finish or ctx to expire
+func (eg *EdgeGateway) waitHLSUploads(ctx context.Context) {
+	for eg.hlsPending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("HLS: %d uploads still pending at shutdown", eg.hlsPending.Load())
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
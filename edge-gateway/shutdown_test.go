@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeCloudConn records the messages sent to the cloud, failing once
+// failAfter have been sent when it is set
+type fakeCloudConn struct {
+	lock      sync.Mutex
+	sent      []WSMessage
+	failAfter int
+	closed    bool
+}
+
+func (c *fakeCloudConn) Send(msg WSMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return errCloudConnClosed
+	}
+	if c.failAfter > 0 && len(c.sent) >= c.failAfter {
+		return errors.New("connection reset")
+	}
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+func (c *fakeCloudConn) Receive() (WSMessage, error) {
+	return WSMessage{}, errCloudConnClosed
+}
+
+func (c *fakeCloudConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeCloudConn) Encoding() string { return cloudEncodingJSON }
+
+// sentTypes returns how many messages of each type were sent
+func (c *fakeCloudConn) sentTypes() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	types := make(map[string]int)
+	for _, msg := range c.sent {
+		types[msg.Type]++
+	}
+	return types
+}
+
+// testConfig loads the configuration with a private data directory and the
+// given variables set
+func testConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	t.Setenv("DATA_DIR", t.TempDir())
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	return loadConfig()
+}
+
+// hangingListener accepts connections and never answers them, as a camera
+// or orchestrator that stopped responding does, but for the first refused,
+// which it closes at once. Each connection is signalled on the channel.
+func hangingListener(t *testing.T, refused int) (string, <-chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{}, 64)
+	var lock sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			if refused > 0 {
+				refused--
+				conn.Close()
+			} else {
+				conns = append(conns, conn)
+			}
+			lock.Unlock()
+			select {
+			case accepted <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().String(), accepted
+}
+
+// awaitConnection waits for a hanging listener to accept a connection
+func awaitConnection(t *testing.T, name string, accepted <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("gateway never connected to the %s", name)
+	}
+}
+
+func TestShutdownWithinTimeout(t *testing.T) {
+	// The orchestrator goes away once the gateway is up
+	cloud, cloudAccepted := hangingListener(t, 1)
+	cameraHTTP, httpAccepted := hangingListener(t, 0)
+	cameraRTSP, rtspAccepted := hangingListener(t, 0)
+	cfg := testConfig(t, map[string]string{
+		"CLOUD_ORCHESTRATOR_URL": "ws://" + cloud + "/gateway",
+		"LOCAL_API_ADDR":         "off",
+		"RTSP_SERVER_ADDR":       "off",
+		"MDNS_ENABLED":           "false",
+		"SCAN_DENY_CIDRS":        "0.0.0.0/0,::/0",
+		"SHUTDOWN_TIMEOUT":       "2s",
+		"SHUTDOWN_DRAIN_TIMEOUT": "1s",
+	})
+	_, port, _ := net.SplitHostPort(cameraHTTP)
+	httpPort, _ := strconv.Atoi(port)
+	cameras, _ := json.Marshal([]*Camera{{
+		ID:       "cam-1",
+		Name:     "Hanging camera",
+		IP:       "127.0.0.1",
+		HTTPPort: httpPort,
+		RTSPUrl:  "rtsp://" + cameraRTSP + "/stream",
+		Manual:   true,
+		Vendor:   "axis",
+	}})
+	if err := os.WriteFile(filepath.Join(cfg.DataDir, "cameras.json"), cameras, 0600); err != nil {
+		t.Fatal(err)
+	}
+	eg := NewEdgeGateway(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exited := make(chan error, 1)
+	go func() { exited <- eg.Start(ctx) }()
+
+	// Stuck redialing the orchestrator once running, and on a camera's
+	// HTTP and RTSP
+	awaitConnection(t, "orchestrator", cloudAccepted)
+	awaitConnection(t, "orchestrator again", cloudAccepted)
+	go eg.startStream("cam-1")
+	go eg.cameraSnapshot(ctx, "cam-1")
+	awaitConnection(t, "camera's RTSP", rtspAccepted)
+	awaitConnection(t, "camera's HTTP", httpAccepted)
+
+	cancel()
+	started := time.Now()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("Start returned %v", err)
+		}
+	case <-time.After(cfg.ShutdownTimeout + 5*time.Second):
+		t.Fatalf("still running %s after cancellation", time.Since(started).Round(time.Millisecond))
+	}
+	if elapsed := time.Since(started); elapsed > cfg.ShutdownTimeout {
+		t.Errorf("shutdown took %s, over SHUTDOWN_TIMEOUT %s", elapsed.Round(time.Millisecond), cfg.ShutdownTimeout)
+	}
+	// Nothing left stuck on the endpoints for the process exit to cut off
+	workers := make(chan struct{})
+	go func() {
+		eg.workers.Wait()
+		close(workers)
+	}()
+	select {
+	case <-workers:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("background tasks still running after Start returned")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "outbox.jsonl")); err != nil {
+		t.Errorf("undelivered events not journaled: %v", err)
+	}
+}
+
+func TestDrainDeliversViewersAndOutbox(t *testing.T) {
+	tests := []struct {
+		name      string
+		acks      string
+		failAfter int
+		delivered bool
+	}{
+		{name: "delivered", acks: "false", delivered: true},
+		{name: "delivered with acks", acks: "true", delivered: true},
+		{name: "send fails", acks: "false", failAfter: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{
+				"SHUTDOWN_TIMEOUT":       "3s",
+				"SHUTDOWN_DRAIN_TIMEOUT": "2s",
+				"OFFLINE_QUEUE_ACKS":     tt.acks,
+			})
+			eg := NewEdgeGateway(cfg)
+
+			// Events raised while the cloud was unreachable
+			for i := 0; i < 5; i++ {
+				eg.sendEvent("camera_event", map[string]interface{}{"camera_id": "cam-1", "seq": i})
+			}
+			if n := eg.outbox.Len(); n != 5 {
+				t.Fatalf("queued %d events, want 5", n)
+			}
+
+			// Two viewers watching, over a connection that just came back
+			for _, sessionID := range []string{"session-1", "session-2"} {
+				pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				eg.peerConns[sessionID] = &cloudPeer{cameraID: "cam-1", pc: pc}
+			}
+			conn := &fakeCloudConn{failAfter: tt.failAfter}
+			eg.cloudConn = conn
+
+			eg.drain()
+			eg.cleanup()
+
+			if len(eg.peerConns) != 0 {
+				t.Errorf("%d peer connections left open", len(eg.peerConns))
+			}
+			_, err := os.Stat(filepath.Join(cfg.DataDir, "outbox.jsonl"))
+			journaled := err == nil
+			types := conn.sentTypes()
+			if !tt.delivered {
+				if !journaled {
+					t.Errorf("undelivered events not journaled")
+				}
+				return
+			}
+			if types["camera_event"] != 5 {
+				t.Errorf("delivered %d queued events, want 5", types["camera_event"])
+			}
+			if types["gateway_shutdown"] != 1 || types["webrtc_closed"] != 2 {
+				t.Errorf("sent %v, want gateway_shutdown and webrtc_closed for each viewer", types)
+			}
+			// With acks, the events stay journaled until acknowledged
+			if want := tt.acks == "true"; journaled != want {
+				t.Errorf("journal kept = %v, want %v", journaled, want)
+			}
+		})
+	}
+}
+
+func TestShutdownClosedSessionIDs(t *testing.T) {
+	cfg := testConfig(t, nil)
+	eg := NewEdgeGateway(cfg)
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eg.peerConns["session-1"] = &cloudPeer{cameraID: "cam-1", pc: pc}
+	conn := &fakeCloudConn{}
+	eg.cloudConn = conn
+
+	eg.closeViewers(context.Background())
+	for _, msg := range conn.sent {
+		if msg.Type != "webrtc_closed" {
+			continue
+		}
+		var payload struct {
+			CameraID  string `json:"camera_id"`
+			SessionID string `json:"session_id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.CameraID != "cam-1" || payload.SessionID != "session-1" {
+			t.Errorf("webrtc_closed for %+v, want cam-1 session-1", payload)
+		}
+		return
+	}
+	t.Error("no webrtc_closed sent")
+}
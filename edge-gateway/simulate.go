@@ -0,0 +1,752 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/mp4"
+)
+
+// The generated test pattern is 256x144, 16x9 macroblocks
+const (
+	simPatternWidth  = 256
+	simPatternHeight = 144
+)
+
+// Simulated PTZ speeds at full speed, and the zoom range
+const (
+	simPanDegreesPerSecond  = 30
+	simZoomPerSecond        = 1
+	simMaxZoom              = 4
+	simMaxTiltDegrees       = 45
+	simPanDegreesPerPattern = 90 // pan that scrolls the pattern by its width
+)
+
+// simClip is a video file the simulated cameras loop
+type simClip struct {
+	codec  h264parser.CodecData
+	frames []av.Packet // Time from 0, Duration set
+}
+
+// cameraSimulator serves the simulated cameras registered with --simulate:
+// their video over RTSP on a loopback port, through the same server as the
+// gateway's RTSP re-streaming, and a VAPIX PTZ API on a port of their own.
+// The gateway ingests and controls them like any other camera.
+type cameraSimulator struct {
+	eg      *EdgeGateway
+	clip    *simClip // nil for the test pattern
+	pattern *testPatternEncoder
+	cameras map[string]*simulatedCamera
+}
+
+// startSimulator registers cfg.SimulateCameras simulated cameras
+func (eg *EdgeGateway) startSimulator(ctx context.Context) {
+	count := eg.cfg.SimulateCameras
+	if count <= 0 {
+		return
+	}
+
+	sim := &cameraSimulator{eg: eg, cameras: make(map[string]*simulatedCamera)}
+	if eg.cfg.SimulateSource != "" {
+		clip, err := loadSimClip(eg.cfg.SimulateSource, eg.cfg.SimulateFPS)
+		if err != nil {
+			log.Printf("Simulator: failed to load %s: %v", eg.cfg.SimulateSource, err)
+			return
+		}
+		sim.clip = clip
+	} else {
+		pattern, err := newTestPatternEncoder()
+		if err != nil {
+			log.Printf("Simulator: %v", err)
+			return
+		}
+		sim.pattern = pattern
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Simulator: RTSP listener: %v", err)
+		return
+	}
+	rtspPort := listener.Addr().(*net.TCPAddr).Port
+	creds := defaultCredentials()
+	eg.goTracked(func() {
+		<-ctx.Done()
+		listener.Close()
+	})
+	eg.goTracked(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := newRTSPServerConn(eg, conn, sim.open, creds.Username, creds.Password)
+			go c.serve(ctx)
+		}
+	})
+
+	for i := 1; i <= count; i++ {
+		sc := newSimulatedCamera(sim, i, creds)
+		httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Printf("Simulator: VAPIX listener for %s: %v", sc.id, err)
+			continue
+		}
+		server := &http.Server{Handler: http.HandlerFunc(sc.handleVAPIX)}
+		eg.goTracked(func() { server.Serve(httpListener) })
+		eg.goTracked(func() {
+			<-ctx.Done()
+			server.Close()
+		})
+		sim.cameras[sc.id] = sc
+		eg.goTracked(func() { sc.run(ctx) })
+
+		camera := &Camera{
+			ID:        sc.id,
+			Name:      fmt.Sprintf("Simulated Camera %d", i),
+			Model:     "Simulated",
+			IP:        "127.0.0.1",
+			Port:      rtspPort,
+			RTSPUrl:   fmt.Sprintf("rtsp://127.0.0.1:%d/%s", rtspPort, sc.id),
+			HasPTZ:    true,
+			Manual:    true,
+			HTTPPort:  httpListener.Addr().(*net.TCPAddr).Port,
+			Simulated: true,
+		}
+		if eg.registerCamera(camera) {
+			eg.notifyCameraStatus(camera, "added")
+		}
+	}
+
+	source := "test pattern"
+	if sim.clip != nil {
+		source = eg.cfg.SimulateSource
+	}
+	log.Printf("Simulator: %d cameras playing %s, RTSP on 127.0.0.1:%d", len(sim.cameras), source, rtspPort)
+}
+
+// open is the simulator's rtspOpener
+func (s *cameraSimulator) open(cameraID string) (rtspSource, func(), error) {
+	sc, exists := s.cameras[cameraID]
+	if !exists {
+		return nil, nil, errCameraNotFound
+	}
+	return sc, func() {}, nil
+}
+
+// simulatedCamera is one simulated camera; it implements rtspSource
+type simulatedCamera struct {
+	sim      *cameraSimulator
+	index    int
+	id       string
+	username string
+	password string
+
+	sinksLock sync.Mutex
+	sinks     []packetSink
+	codecs    []av.CodecData
+	gop       gopBuffer
+
+	// PTZ position and the speeds it is moving at since moved
+	ptzLock   sync.Mutex
+	pan       float64 // degrees, -180 to 180
+	tilt      float64 // degrees
+	zoom      float64 // 1 to simMaxZoom
+	panSpeed  float64 // -1 to 1
+	tiltSpeed float64
+	zoomSpeed float64
+	moved     time.Time
+	// motion is the motion alarm state last sent to the event subscriber
+	motion bool
+}
+
+func newSimulatedCamera(sim *cameraSimulator, index int, creds Credentials) *simulatedCamera {
+	sc := &simulatedCamera{
+		sim:      sim,
+		index:    index,
+		id:       fmt.Sprintf("sim-%d", index),
+		username: creds.Username,
+		password: creds.Password,
+		gop:      gopBuffer{maxBytes: sim.eg.cfg.PrebufferMaxKB * 1024},
+		zoom:     1,
+		moved:    time.Now(),
+	}
+	if sim.clip != nil {
+		sc.codecs = []av.CodecData{sim.clip.codec}
+	} else {
+		sc.codecs = []av.CodecData{sim.pattern.codec}
+	}
+	return sc
+}
+
+// addSink attaches a sink, priming it with the codecs and the buffered GOP
+func (sc *simulatedCamera) addSink(sink packetSink) {
+	sc.sinksLock.Lock()
+	defer sc.sinksLock.Unlock()
+
+	sc.sinks = append(sc.sinks, sink)
+	sink.Reset(sc.codecs)
+	for _, pkt := range sc.gop.packets {
+		sink.WritePacket(pkt)
+	}
+}
+
+// removeSink detaches a sink
+func (sc *simulatedCamera) removeSink(sink packetSink) {
+	sc.sinksLock.Lock()
+	defer sc.sinksLock.Unlock()
+
+	for i, s := range sc.sinks {
+		if s == sink {
+			sc.sinks = append(sc.sinks[:i], sc.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+// playSink runs play, then writes the buffered GOP to the sink
+func (sc *simulatedCamera) playSink(sink packetSink, play func()) {
+	sc.sinksLock.Lock()
+	defer sc.sinksLock.Unlock()
+
+	play()
+	for _, pkt := range sc.gop.packets {
+		sink.WritePacket(pkt)
+	}
+}
+
+// run writes frames to the sinks in real time until ctx is done. Clips
+// loop with timestamps that keep increasing.
+func (sc *simulatedCamera) run(ctx context.Context) {
+	frameDuration := time.Second / time.Duration(sc.sim.eg.cfg.SimulateFPS)
+	start := time.Now()
+	var offset time.Duration
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for n := 0; ; n++ {
+		var pkt av.Packet
+		if clip := sc.sim.clip; clip != nil {
+			i := n % len(clip.frames)
+			if i == 0 && n > 0 {
+				last := clip.frames[len(clip.frames)-1]
+				offset += last.Time + last.Duration
+			}
+			pkt = clip.frames[i]
+			pkt.Time += offset
+		} else {
+			pan, tilt, zoom := sc.position()
+			pkt = av.Packet{
+				IsKeyFrame: true,
+				Time:       time.Duration(n) * frameDuration,
+				Duration:   frameDuration,
+				Data:       sc.sim.pattern.encode(n, sc.index, pan, tilt, zoom),
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		sc.write(pkt)
+		timer.Reset(time.Until(start.Add(pkt.Time + pkt.Duration)))
+	}
+}
+
+func (sc *simulatedCamera) write(pkt av.Packet) {
+	sc.sinksLock.Lock()
+	defer sc.sinksLock.Unlock()
+
+	sc.gop.add(pkt)
+	for _, sink := range sc.sinks {
+		sink.WritePacket(pkt)
+	}
+}
+
+// position returns where the camera points now
+func (sc *simulatedCamera) position() (pan, tilt, zoom float64) {
+	sc.ptzLock.Lock()
+	defer sc.ptzLock.Unlock()
+	sc.moveLocked()
+	return sc.pan, sc.tilt, sc.zoom
+}
+
+// moveLocked moves the camera at its speeds since it was last moved. The
+// caller holds ptzLock.
+func (sc *simulatedCamera) moveLocked() {
+	now := time.Now()
+	elapsed := now.Sub(sc.moved).Seconds()
+	sc.moved = now
+
+	sc.pan = math.Mod(sc.pan+sc.panSpeed*simPanDegreesPerSecond*elapsed+540, 360) - 180
+	sc.tilt = math.Max(-simMaxTiltDegrees, math.Min(simMaxTiltDegrees, sc.tilt+sc.tiltSpeed*simPanDegreesPerSecond*elapsed))
+	sc.zoom = math.Max(1, math.Min(simMaxZoom, sc.zoom+sc.zoomSpeed*simZoomPerSecond*elapsed))
+}
+
+// handleVAPIX serves the part of VAPIX ptz.cgi the gateway uses: continuous
+// moves, a position query, and imaging commands, which it accepts and
+// ignores, and the event service. It takes the default camera credentials
+// with basic auth.
+func (sc *simulatedCamera) handleVAPIX(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != sc.username || password != sc.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Simulated Camera"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/vapix/services" {
+		sc.handleEvents(w, r)
+		return
+	}
+	if r.URL.Path != "/axis-cgi/com/ptz.cgi" {
+		http.NotFound(w, r)
+		return
+	}
+
+	speed := func(s string) (float64, error) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return math.Max(-1, math.Min(1, v)), err
+	}
+	query := r.URL.Query()
+
+	sc.ptzLock.Lock()
+	defer sc.ptzLock.Unlock()
+	sc.moveLocked()
+
+	if move := query.Get("continuouspantiltmove"); move != "" {
+		panValue, tiltValue, _ := strings.Cut(move, ",")
+		panSpeed, err1 := speed(panValue)
+		tiltSpeed, err2 := speed(tiltValue)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Error: invalid continuouspantiltmove", http.StatusBadRequest)
+			return
+		}
+		sc.panSpeed, sc.tiltSpeed = panSpeed, tiltSpeed
+	}
+	if move := query.Get("continuouszoommove"); move != "" {
+		zoomSpeed, err := speed(move)
+		if err != nil {
+			http.Error(w, "Error: invalid continuouszoommove", http.StatusBadRequest)
+			return
+		}
+		sc.zoomSpeed = zoomSpeed
+	}
+	if query.Get("query") == "position" {
+		fmt.Fprintf(w, "pan=%.2f\ntilt=%.2f\nzoom=%.0f\n", sc.pan, sc.tilt, (sc.zoom-1)/(simMaxZoom-1)*9998+1)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEvents serves a pull point subscription to the camera's motion
+// alarm, which is on while the camera pans, tilts or zooms. There is one
+// subscription, whoever subscribed last.
+func (sc *simulatedCamera) handleEvents(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	request := string(body)
+
+	var response string
+	switch {
+	case strings.Contains(request, "CreatePullPointSubscription"):
+		sc.ptzLock.Lock()
+		sc.motion = false
+		sc.ptzLock.Unlock()
+		response = fmt.Sprintf(`<CreatePullPointSubscriptionResponse xmlns="http://www.onvif.org/ver10/events/wsdl">`+
+			`<SubscriptionReference><Address xmlns="http://www.w3.org/2005/08/addressing">http://%s/vapix/services</Address>`+
+			`</SubscriptionReference></CreatePullPointSubscriptionResponse>`, r.Host)
+
+	case strings.Contains(request, "PullMessages"):
+		timeout := time.Second
+		if _, rest, ok := strings.Cut(request, "<Timeout>PT"); ok {
+			if seconds, err := strconv.Atoi(strings.SplitN(rest, "S", 2)[0]); err == nil {
+				timeout = time.Duration(seconds) * time.Second
+			}
+		}
+		response = `<PullMessagesResponse xmlns="http://www.onvif.org/ver10/events/wsdl">` +
+			sc.pullMotion(r.Context(), timeout) + `</PullMessagesResponse>`
+
+	case strings.Contains(request, "Renew"):
+		response = `<RenewResponse xmlns="http://docs.oasis-open.org/wsn/b-2"/>`
+	case strings.Contains(request, "Unsubscribe"):
+		response = `<UnsubscribeResponse xmlns="http://docs.oasis-open.org/wsn/b-2"/>`
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body>%s</s:Body></s:Envelope>`, response)
+}
+
+// pullMotion waits up to timeout for the motion alarm to change, returning
+// the notification message of the change if it does
+func (sc *simulatedCamera) pullMotion(ctx context.Context, timeout time.Duration) string {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		sc.ptzLock.Lock()
+		moving := sc.panSpeed != 0 || sc.tiltSpeed != 0 || sc.zoomSpeed != 0
+		changed := moving != sc.motion
+		sc.motion = moving
+		sc.ptzLock.Unlock()
+
+		if changed {
+			state := 0
+			if moving {
+				state = 1
+			}
+			return fmt.Sprintf(`<NotificationMessage xmlns="http://docs.oasis-open.org/wsn/b-2">`+
+				`<Topic Dialect="http://www.onvif.org/ver10/tev/topicExpression/ConcreteSet">tns1:VideoSource/tnsaxis:MotionAlarm</Topic>`+
+				`<Message><Message xmlns="http://www.onvif.org/ver10/schema" UtcTime="%s" PropertyOperation="Changed">`+
+				`<Source><SimpleItem Name="channel" Value="1"/></Source>`+
+				`<Data><SimpleItem Name="State" Value="%d"/></Data></Message></Message></NotificationMessage>`,
+				time.Now().UTC().Format(time.RFC3339), state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-deadline:
+			return ""
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadSimClip loads an MP4 file, or else a raw H.264 (Annex B) file played
+// at fps
+func loadSimClip(path string, fps int) (*simClip, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var clip *simClip
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov":
+		clip, err = loadMP4Clip(file)
+	default:
+		clip, err = loadH264Clip(file, fps)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(clip.frames) == 0 || !clip.frames[0].IsKeyFrame {
+		return nil, errors.New("no H.264 keyframe")
+	}
+	return clip, nil
+}
+
+// loadMP4Clip reads the H.264 track of an MP4 file, from its first keyframe
+func loadMP4Clip(file io.ReadSeeker) (*simClip, error) {
+	demuxer := mp4.NewDemuxer(file)
+	streams, err := demuxer.Streams()
+	if err != nil {
+		return nil, err
+	}
+	idx := -1
+	clip := &simClip{}
+	for i, stream := range streams {
+		if codec, ok := stream.(h264parser.CodecData); ok {
+			idx, clip.codec = i, codec
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, errors.New("no H.264 track")
+	}
+
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if int(pkt.Idx) != idx || (len(clip.frames) == 0 && !pkt.IsKeyFrame) {
+			continue
+		}
+		pkt.Idx = 0
+		clip.frames = append(clip.frames, pkt)
+	}
+	if len(clip.frames) == 0 {
+		return clip, nil
+	}
+
+	// Rebase to 0 and fill in durations from the next frame's time
+	base := clip.frames[0].Time
+	for i := range clip.frames {
+		clip.frames[i].Time -= base
+	}
+	for i := 0; i < len(clip.frames)-1; i++ {
+		clip.frames[i].Duration = clip.frames[i+1].Time - clip.frames[i].Time
+	}
+	last := &clip.frames[len(clip.frames)-1]
+	if last.Duration <= 0 {
+		last.Duration = last.Time / time.Duration(max(len(clip.frames)-1, 1))
+	}
+	if last.Duration <= 0 {
+		last.Duration = 100 * time.Millisecond
+	}
+	return clip, nil
+}
+
+// loadH264Clip reads a raw H.264 stream and splits it into access units,
+// each starting at a parameter set, SEI or AUD after the last one's slices,
+// or at a slice that starts a picture
+func loadH264Clip(file io.Reader, fps int) (*simClip, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	nalus, typ := h264parser.SplitNALUs(data)
+	if typ != h264parser.NALU_ANNEXB {
+		return nil, errors.New("not an H.264 Annex B stream")
+	}
+
+	frameDuration := time.Second / time.Duration(fps)
+	clip := &simClip{}
+	var sps, pps []byte
+	var unit [][]byte
+	var hasSlice, isKey bool
+	flush := func() {
+		if hasSlice && (isKey || len(clip.frames) > 0) {
+			var data []byte
+			for _, nalu := range unit {
+				data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+				data = append(data, nalu...)
+			}
+			clip.frames = append(clip.frames, av.Packet{
+				IsKeyFrame: isKey,
+				Time:       time.Duration(len(clip.frames)) * frameDuration,
+				Duration:   frameDuration,
+				Data:       data,
+			})
+		}
+		unit, hasSlice, isKey = nil, false, false
+	}
+
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+		switch nalType := nalu[0] & 0x1f; {
+		case nalType == 1 || nalType == 5:
+			// first_mb_in_slice is 0 when its ue(v) is the single bit 1
+			if hasSlice && nalu[1]&0x80 != 0 {
+				flush()
+			}
+			hasSlice = true
+			isKey = isKey || nalType == 5
+			unit = append(unit, nalu)
+		case nalType == h264parser.NALU_AUD:
+			if hasSlice {
+				flush()
+			}
+		case nalType == h264parser.NALU_SPS || nalType == h264parser.NALU_PPS || nalType == h264parser.NALU_SEI:
+			if hasSlice {
+				flush()
+			}
+			if nalType == h264parser.NALU_SPS && sps == nil {
+				sps = nalu
+			} else if nalType == h264parser.NALU_PPS && pps == nil {
+				pps = nalu
+			}
+			unit = append(unit, nalu)
+		}
+	}
+	flush()
+
+	if sps == nil || pps == nil {
+		return nil, errors.New("no SPS and PPS")
+	}
+	if clip.codec, err = h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err != nil {
+		return nil, err
+	}
+	return clip, nil
+}
+
+// testPatternEncoder generates color bars as H.264 Baseline IDR frames made
+// of uncompressed (I_PCM) macroblocks, which any decoder plays and which
+// need no encoder library
+type testPatternEncoder struct {
+	codec h264parser.CodecData
+}
+
+// YCbCr of 75% color bars: white, yellow, cyan, green, magenta, red, blue
+// and black
+var testPatternBars = [8][3]byte{
+	{180, 128, 128}, {162, 44, 142}, {131, 156, 44}, {112, 72, 58},
+	{84, 184, 198}, {65, 100, 212}, {35, 212, 114}, {16, 128, 128},
+}
+
+func newTestPatternEncoder() (*testPatternEncoder, error) {
+	var sps h264BitWriter
+	sps.bits(66, 8)   // profile_idc: Baseline
+	sps.bits(0xc0, 8) // constraint_set0 and 1
+	sps.bits(30, 8)   // level_idc: 3.0
+	sps.ue(0)         // seq_parameter_set_id
+	sps.ue(0)         // log2_max_frame_num_minus4
+	sps.ue(2)         // pic_order_cnt_type
+	sps.ue(1)         // max_num_ref_frames
+	sps.bits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	sps.ue(simPatternWidth/16 - 1)
+	sps.ue(simPatternHeight/16 - 1)
+	sps.bits(1, 1) // frame_mbs_only_flag
+	sps.bits(1, 1) // direct_8x8_inference_flag
+	sps.bits(0, 1) // frame_cropping_flag
+	sps.bits(0, 1) // vui_parameters_present_flag
+	sps.trailing()
+
+	var pps h264BitWriter
+	pps.ue(0)      // pic_parameter_set_id
+	pps.ue(0)      // seq_parameter_set_id
+	pps.bits(0, 1) // entropy_coding_mode_flag: CAVLC
+	pps.bits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	pps.ue(0)      // num_slice_groups_minus1
+	pps.ue(0)      // num_ref_idx_l0_default_active_minus1
+	pps.ue(0)      // num_ref_idx_l1_default_active_minus1
+	pps.bits(0, 1) // weighted_pred_flag
+	pps.bits(0, 2) // weighted_bipred_idc
+	pps.se(0)      // pic_init_qp_minus26
+	pps.se(0)      // pic_init_qs_minus26
+	pps.se(0)      // chroma_qp_index_offset
+	pps.bits(1, 1) // deblocking_filter_control_present_flag
+	pps.bits(0, 1) // constrained_intra_pred_flag
+	pps.bits(0, 1) // redundant_pic_cnt_present_flag
+	pps.trailing()
+
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(
+		appendEscaped([]byte{0x67}, sps.buf), appendEscaped([]byte{0x68}, pps.buf))
+	if err != nil {
+		return nil, fmt.Errorf("test pattern: %v", err)
+	}
+	return &testPatternEncoder{codec: codec}, nil
+}
+
+// encode returns frame n of a camera's pattern, in AVCC form, as seen at a
+// PTZ position. Pan scrolls the bars, tilt moves the gray ramp below them,
+// zoom widens them, and a white line sweeping across shows the video is
+// live.
+func (e *testPatternEncoder) encode(n, camera int, pan, tilt, zoom float64) []byte {
+	const w, h = simPatternWidth, simPatternHeight
+	barWidth := float64(w) / 8 * zoom
+	scroll := pan / simPanDegreesPerPattern * w
+	rampTop := int(float64(h)*3/4 + tilt/simMaxTiltDegrees*float64(h)/4)
+	marker := n * 4 % w
+
+	sample := func(x, y int) [3]byte {
+		if x == marker || x == marker+1 {
+			return [3]byte{235, 128, 128}
+		}
+		if y >= rampTop {
+			return [3]byte{byte(16 + x*219/w), 128, 128}
+		}
+		u := (float64(x-w/2)+scroll*zoom)/barWidth + 4
+		bar := (int(math.Floor(u)) + camera - 1) % 8
+		if bar < 0 {
+			bar += 8
+		}
+		return testPatternBars[bar]
+	}
+
+	var slice h264BitWriter
+	slice.ue(0)           // first_mb_in_slice
+	slice.ue(7)           // slice_type: I, as are all slices of the picture
+	slice.ue(0)           // pic_parameter_set_id
+	slice.bits(0, 4)      // frame_num
+	slice.ue(uint(n % 2)) // idr_pic_id, differing from the last IDR's
+	slice.bits(0, 1)      // no_output_of_prior_pics_flag
+	slice.bits(0, 1)      // long_term_reference_flag
+	slice.se(0)           // slice_qp_delta
+	slice.ue(1)           // disable_deblocking_filter_idc
+	for mby := 0; mby < h/16; mby++ {
+		for mbx := 0; mbx < w/16; mbx++ {
+			slice.ue(25) // mb_type: I_PCM
+			slice.align()
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					slice.buf = append(slice.buf, sample(mbx*16+x, mby*16+y)[0])
+				}
+			}
+			for c := 1; c <= 2; c++ {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						slice.buf = append(slice.buf, sample(mbx*16+x*2, mby*16+y*2)[c])
+					}
+				}
+			}
+		}
+	}
+	slice.trailing()
+
+	nalu := appendEscaped([]byte{0x65}, slice.buf)
+	return append([]byte{byte(len(nalu) >> 24), byte(len(nalu) >> 16), byte(len(nalu) >> 8), byte(len(nalu))}, nalu...)
+}
+
+// h264BitWriter writes the bits of an H.264 RBSP
+type h264BitWriter struct {
+	buf   []byte
+	cur   byte
+	count int // bits in cur
+}
+
+// bits writes the low n bits of v
+func (b *h264BitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.cur = b.cur<<1 | byte(v>>uint(i)&1)
+		if b.count++; b.count == 8 {
+			b.buf = append(b.buf, b.cur)
+			b.cur, b.count = 0, 0
+		}
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code
+func (b *h264BitWriter) ue(v uint) {
+	n := bits.Len(v + 1)
+	b.bits(0, n-1)
+	b.bits(v+1, n)
+}
+
+// se writes a signed Exp-Golomb code
+func (b *h264BitWriter) se(v int) {
+	if v > 0 {
+		b.ue(uint(2*v - 1))
+	} else {
+		b.ue(uint(-2 * v))
+	}
+}
+
+// align pads with zero bits to a byte boundary
+func (b *h264BitWriter) align() {
+	if b.count > 0 {
+		b.bits(0, 8-b.count)
+	}
+}
+
+// trailing writes the RBSP stop bit and aligns
+func (b *h264BitWriter) trailing() {
+	b.bits(1, 1)
+	b.align()
+}
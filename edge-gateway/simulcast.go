@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// simulcastLayer is one encoding of a simulcast camera
+type simulcastLayer struct {
+	Name    string // as in select_layer
+	RID     string // the RTP stream ID it is sent with
+	Profile string // the stream it is read from
+	Divisor int    // of the main stream's width and height
+}
+
+// simulcastLayers are the main stream and the transcoder's half and quarter
+// resolution copies of it, largest first
+var simulcastLayers = []simulcastLayer{
+	{Name: "full", RID: "f", Profile: viewerProfileMain, Divisor: 1},
+	{Name: "half", RID: "h", Profile: "half", Divisor: 2},
+	{Name: "quarter", RID: "q", Profile: "quarter", Divisor: 4},
+}
+
+// profileLayer returns the simulcast layer read from a stream profile
+func profileLayer(profile string) (simulcastLayer, bool) {
+	for _, layer := range simulcastLayers {
+		if layer.Profile == profile {
+			return layer, true
+		}
+	}
+	return simulcastLayer{}, false
+}
+
+// layerDivisor returns how much a simulcast layer's stream profile is
+// scaled down, or 0 if it isn't one of the scaled layers
+func layerDivisor(profile string) int {
+	if layer, ok := profileLayer(profile); ok && layer.Divisor > 1 {
+		return layer.Divisor
+	}
+	return 0
+}
+
+// findLayer returns the simulcast layer of a name
+func findLayer(name string) (simulcastLayer, bool) {
+	for _, layer := range simulcastLayers {
+		if layer.Name == name {
+			return layer, true
+		}
+	}
+	return simulcastLayer{}, false
+}
+
+// simulcastEnabledFor reports whether a camera is in SIMULCAST_CAMERAS.
+// Layers come from the transcoder, so local cameras, which are captured
+// once, have none.
+func (eg *EdgeGateway) simulcastEnabledFor(camera *Camera) bool {
+	if eg.transcoder == nil || camera.Device != "" {
+		return false
+	}
+	for _, id := range eg.settings().SimulcastCameras {
+		if id == camera.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// offerSimulcast reports whether an SDP offer's video section asks to
+// receive exactly the layers' RTP stream IDs, as an SFU does
+func offerSimulcast(sdp string) bool {
+	video := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if media, ok := strings.CutPrefix(line, "m="); ok {
+			video = strings.HasPrefix(media, "video ")
+			continue
+		}
+		recv, ok := strings.CutPrefix(line, "a=simulcast:recv ")
+		if !video || !ok {
+			continue
+		}
+		rids := make(map[string]bool)
+		for _, alternatives := range strings.Split(recv, ";") {
+			for _, rid := range strings.Split(alternatives, ",") {
+				rids[strings.TrimPrefix(rid, "~")] = true
+			}
+		}
+		if len(rids) != len(simulcastLayers) {
+			return false
+		}
+		for _, layer := range simulcastLayers {
+			if !rids[layer.RID] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// sendOnlySimulcast drops the receive simulcast attributes pion copies from
+// the viewer's offer into the descriptions it creates, which send the
+// layers instead. pion won't take the edited description back, so only the
+// viewer gets it.
+func sendOnlySimulcast(sdp string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "a=simulcast:recv ") ||
+			strings.HasPrefix(trimmed, "a=rid:") && strings.HasSuffix(trimmed, " recv") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "")
+}
+
+// openLayers opens the half and quarter resolution layers of a simulcast
+// camera whose main stream is full, holding a viewer on each until the
+// returned release is called
+func (eg *EdgeGateway) openLayers(full *CameraStream) ([]*CameraStream, func(), error) {
+	layers := []*CameraStream{full}
+	release := func() {
+		for _, layer := range layers[1:] {
+			eg.releaseViewer(layer)
+		}
+	}
+	for _, layer := range simulcastLayers[1:] {
+		stream, err := eg.openStream(full.camera.ID, layer.Profile, true)
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("failed to open %s layer: %v", layer.Name, err)
+		}
+		stream.addViewer()
+		layers = append(layers, stream)
+	}
+	return layers, release, nil
+}
+
+// addSimulcastSender sends the layers as the encodings of one sender
+func addSimulcastSender(pc *webrtc.PeerConnection, layers []*CameraStream) (*webrtc.RTPSender, error) {
+	sender, err := pc.AddTrack(layers[0].ridTrack)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers[1:] {
+		if err := sender.AddEncoding(layer.ridTrack); err != nil {
+			return nil, err
+		}
+	}
+	return sender, nil
+}
+
+// selectLayer switches a viewer of a simulcast camera to another layer,
+// without renegotiating its peer connection
+func (eg *EdgeGateway) selectLayer(sessionID, name string) error {
+	v := eg.viewer(sessionID)
+	if v == nil {
+		return errors.New("no such viewer session")
+	}
+	layer, ok := findLayer(name)
+	if !ok {
+		return fmt.Errorf("unknown simulcast layer %q", name)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	switch {
+	case v.layers == nil:
+		return errors.New("viewer session isn't simulcast")
+	case v.simulcast:
+		return errors.New("viewer session receives every layer")
+	case v.replay != nil:
+		return errors.New("viewer session is playing a recording")
+	}
+	var stream *CameraStream
+	for _, s := range v.layers {
+		if s.profile == layer.Profile {
+			stream = s
+		}
+	}
+	if stream == nil || stream == v.stream {
+		return nil
+	}
+	if err := v.sender.ReplaceTrack(stream.videoTrack); err != nil {
+		return err
+	}
+	v.stream, v.Layer = stream, layer.Name
+	stream.sendBufferedKeyframe()
+	log.Printf("Viewer session %s switched to the %s layer of camera %s", v.ID, layer.Name, v.CameraID)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "github.com/deepch/vdk/av"
+
+// packetSink consumes the packets of a stream's RTSP sessions. Reset is
+// called with the codecs of each new session before its packets. Sinks
+// must not block the ingest.
+type packetSink interface {
+	Reset(codecs []av.CodecData)
+	WritePacket(pkt av.Packet)
+}
+
+// addSink attaches a sink, priming it with the current session's codecs and
+// the buffered GOP
+func (cs *CameraStream) addSink(sink packetSink) {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+
+	cs.sinks = append(cs.sinks, sink)
+	if cs.codecs != nil {
+		sink.Reset(cs.codecs)
+		for _, pkt := range cs.gop.packets {
+			sink.WritePacket(pkt)
+		}
+	}
+}
+
+// removeSink detaches a sink
+func (cs *CameraStream) removeSink(sink packetSink) {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+
+	for i, s := range cs.sinks {
+		if s == sink {
+			cs.sinks = append(cs.sinks[:i], cs.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (cs *CameraStream) resetSinks(codecs []av.CodecData) {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+
+	cs.codecs = codecs
+	cs.gop.reset()
+	for _, sink := range cs.sinks {
+		sink.Reset(codecs)
+	}
+}
+
+func (cs *CameraStream) writeSinks(pkt av.Packet) {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+
+	cs.gop.add(pkt)
+	for _, sink := range cs.sinks {
+		sink.WritePacket(pkt)
+	}
+}
+
+// hasCodecs reports whether an RTSP session has delivered the stream's codecs
+func (cs *CameraStream) hasCodecs() bool {
+	cs.sinksLock.Lock()
+	defer cs.sinksLock.Unlock()
+	return cs.codecs != nil
+}
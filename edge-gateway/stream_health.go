@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Stream health states reported in stream_health messages
+const (
+	streamHealthy  = "healthy"
+	streamDegraded = "degraded"
+	streamStalled  = "stalled"
+)
+
+// Thresholds for flagging a stream as degraded or stalled
+const (
+	streamStallTimeout    = 5 * time.Second
+	streamLossDegraded    = 0.05
+	streamMinFPSDegraded  = 5.0
+	streamMaxKeyframeSecs = 10.0
+)
+
+// StreamHealth is a point-in-time view of one stream's quality
+type StreamHealth struct {
+	CameraID         string     `json:"camera_id"`
+	State            string     `json:"state"`
+	Profile          string     `json:"profile,omitempty"`
+	Codec            string     `json:"codec,omitempty"` // vp9 or av1, empty for H.264
+	FPS              float64    `json:"fps"`
+	BitrateKbps      float64    `json:"bitrate_kbps"`
+	KeyframeInterval float64    `json:"keyframe_interval_secs"`
+	PacketLoss       float64    `json:"packet_loss"`
+	Jitter           uint32     `json:"jitter"`
+	Restarts         int        `json:"restarts"`
+	DroppedFrames    int        `json:"dropped_frames"`
+	QueueDepth       int        `json:"queue_depth"`
+	MaxWriteMs       float64    `json:"max_write_ms"`
+	Transcoder       string     `json:"transcoder,omitempty"` // hardware, when transcoded
+	LastFrameAt      *time.Time `json:"last_frame_at,omitempty"`
+}
+
+// streamStats accumulates ingest and viewer statistics for a stream
+type streamStats struct {
+	lock sync.Mutex
+
+	// Counters since the last sample
+	frames int
+	bytes  int
+
+	lastFrame    time.Time
+	lastKeyframe time.Time
+	keyframeGap  time.Duration
+	restarts     int
+
+	// From RTCP receiver reports
+	packetLoss float64
+	jitter     uint32
+
+	// Congestion of the WebRTC track: frames dropped in total and the
+	// slowest write since the last sample
+	dropped  int
+	writeMax time.Duration
+
+	// Rates computed at the last sample
+	sampledAt time.Time
+	fps       float64
+	bitrate   float64
+	maxWrite  time.Duration
+}
+
+func newStreamStats() *streamStats {
+	return &streamStats{sampledAt: time.Now()}
+}
+
+// recordFrame notes a video packet read from the camera
+func (s *streamStats) recordFrame(size int, keyframe bool) {
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.frames++
+	s.bytes += size
+	s.lastFrame = now
+	if keyframe {
+		if !s.lastKeyframe.IsZero() {
+			s.keyframeGap = now.Sub(s.lastKeyframe)
+		}
+		s.lastKeyframe = now
+	}
+}
+
+// recordRestart notes that the ingest was restarted after a failure
+func (s *streamStats) recordRestart() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restarts++
+}
+
+// recordDrop notes a frame dropped because viewers couldn't keep up
+func (s *streamStats) recordDrop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropped++
+}
+
+// recordWrite notes how long a frame took to reach viewers
+func (s *streamStats) recordWrite(took time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if took > s.writeMax {
+		s.writeMax = took
+	}
+}
+
+// recordRTCP takes packet loss and jitter from a viewer's receiver reports
+func (s *streamStats) recordRTCP(packets []rtcp.Packet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, packet := range packets {
+		rr, ok := packet.(*rtcp.ReceiverReport)
+		if !ok {
+			continue
+		}
+		for _, report := range rr.Reports {
+			s.packetLoss = float64(report.FractionLost) / 256
+			s.jitter = report.Jitter
+		}
+	}
+}
+
+// sample computes rates since the previous sample and resets the counters
+func (s *streamStats) sample() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.sampledAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	s.fps = float64(s.frames) / elapsed
+	s.bitrate = float64(s.bytes) * 8 / 1000 / elapsed
+	s.frames, s.bytes = 0, 0
+	s.maxWrite, s.writeMax = s.writeMax, 0
+	s.sampledAt = now
+}
+
+// health returns the stream's health as of the last sample
+func (s *streamStats) health(cameraID string) StreamHealth {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h := StreamHealth{
+		CameraID:         cameraID,
+		State:            streamHealthy,
+		FPS:              s.fps,
+		BitrateKbps:      s.bitrate,
+		KeyframeInterval: s.keyframeGap.Seconds(),
+		PacketLoss:       s.packetLoss,
+		Jitter:           s.jitter,
+		Restarts:         s.restarts,
+		DroppedFrames:    s.dropped,
+		MaxWriteMs:       float64(s.maxWrite) / float64(time.Millisecond),
+	}
+	if !s.lastFrame.IsZero() {
+		last := s.lastFrame
+		h.LastFrameAt = &last
+	}
+
+	switch {
+	case s.lastFrame.IsZero() || time.Since(s.lastFrame) > streamStallTimeout:
+		h.State = streamStalled
+	case h.PacketLoss > streamLossDegraded,
+		h.FPS < streamMinFPSDegraded,
+		h.KeyframeInterval > streamMaxKeyframeSecs:
+		h.State = streamDegraded
+	}
+	return h
+}
+
+// streamHealth returns the health of every active stream
+func (eg *EdgeGateway) streamHealth() []StreamHealth {
+	eg.streamsLock.RLock()
+	defer eg.streamsLock.RUnlock()
+
+	health := []StreamHealth{}
+	for _, stream := range eg.streams {
+		h := stream.stats.health(stream.camera.ID)
+		stream.runningLock.Lock()
+		h.Transcoder = stream.transcoding
+		stream.runningLock.Unlock()
+		h.QueueDepth = len(stream.videoQueue)
+		h.Codec = stream.codec
+		if stream.profile != viewerProfileMain {
+			h.Profile = stream.profile
+		} else if stream.abr != nil {
+			h.Profile = stream.abr.Profile().Name
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		if health[i].CameraID != health[j].CameraID {
+			return health[i].CameraID < health[j].CameraID
+		}
+		if health[i].Profile != health[j].Profile {
+			return health[i].Profile < health[j].Profile
+		}
+		return health[i].Codec < health[j].Codec
+	})
+	return health
+}
+
+// monitorStreamHealth samples stream statistics and reports them to cloud
+func (eg *EdgeGateway) monitorStreamHealth(ctx context.Context) {
+	if eg.cfg.StreamHealthInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(eg.cfg.StreamHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			eg.streamsLock.RLock()
+			for _, stream := range eg.streams {
+				stream.stats.sample()
+			}
+			eg.streamsLock.RUnlock()
+
+			if health := eg.streamHealth(); len(health) > 0 {
+				eg.sendEvent("stream_health", map[string]interface{}{
+					"streams": health,
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// streamTokenLeeway allows for the gateway's clock running ahead of the
+// orchestrator's when checking a token's expiry
+const streamTokenLeeway = 30 * time.Second
+
+// errStreamDenied is returned for offers and added cameras without a stream
+// token that grants them
+var errStreamDenied = errors.New("stream not permitted")
+
+// errPTZDenied is returned for data channel PTZ commands from a session
+// whose token doesn't grant them
+var errPTZDenied = errors.New("PTZ not permitted")
+
+// StreamToken is what a stream permission token grants: viewing the cameras
+// on one gateway until it expires, in one viewer session if SessionID is
+// set, and steering the PTZ cameras over the session's data channel.
+// Tokens are issued by the orchestrator's signing service as
+// base64url(JSON) "." base64url(signature), the Ed25519 signature, by a key
+// in STREAM_TOKEN_PUBLIC_KEY, of streamTokenSigningMessage.
+type StreamToken struct {
+	GatewayID string   `json:"gateway_id"`
+	CameraIDs []string `json:"camera_ids"`
+	SessionID string   `json:"session_id,omitempty"`
+	Expires   int64    `json:"exp"` // Unix seconds
+	// PTZ are the cameras the session may steer; only granted to one
+	// session
+	PTZ []string `json:"ptz,omitempty"`
+}
+
+// streamTokenSigningMessage is what a token's signature covers, kept apart
+// from anything else the signing service might sign
+func streamTokenSigningMessage(encodedClaims string) []byte {
+	return []byte("edge-gateway/stream-token/" + encodedClaims)
+}
+
+// parseStreamToken returns the grant of a token signed by one of the keys
+func parseStreamToken(token string, keys []ed25519.PublicKey) (*StreamToken, error) {
+	encodedClaims, encodedSignature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errors.New("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, streamTokenSigningMessage(encodedClaims), signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("token signature does not verify")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(encodedClaims)
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var grant StreamToken
+	if err := json.Unmarshal(claims, &grant); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	return &grant, nil
+}
+
+// checkStreamToken returns the grant of a token that is valid for the
+// session on this gateway
+func (eg *EdgeGateway) checkStreamToken(token, sessionID string) (*StreamToken, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	grant, err := parseStreamToken(token, eg.cfg.StreamTokenKeys)
+	if err != nil {
+		return nil, err
+	}
+	if grant.GatewayID != getGatewayID() {
+		return nil, fmt.Errorf("token is for gateway %q", grant.GatewayID)
+	}
+	if time.Now().After(time.Unix(grant.Expires, 0).Add(streamTokenLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if grant.SessionID != "" && grant.SessionID != sessionID {
+		return nil, fmt.Errorf("token is for session %q", grant.SessionID)
+	}
+	return grant, nil
+}
+
+// authorizeStream checks that a token permits a viewer session to receive
+// the cameras. Any session may receive any camera unless
+// STREAM_TOKEN_PUBLIC_KEY is set.
+func (eg *EdgeGateway) authorizeStream(token, sessionID string, cameraIDs ...string) error {
+	if !eg.cfg.StreamTokenRequired {
+		return nil
+	}
+	grant, err := eg.checkStreamToken(token, sessionID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errStreamDenied, err)
+	}
+	for _, cameraID := range cameraIDs {
+		if !slices.Contains(grant.CameraIDs, cameraID) {
+			return fmt.Errorf("%w: token doesn't grant camera %s", errStreamDenied, cameraID)
+		}
+	}
+	return nil
+}
+
+// authorizePTZ checks that the token of a viewer session's latest offer
+// permits it to steer the camera over its data channel. It is checked for
+// every command, so a token that expires stops the session steering. Any
+// session may steer unless STREAM_TOKEN_PUBLIC_KEY is set, and WHEP
+// viewers, on the local API, need no token.
+func (eg *EdgeGateway) authorizePTZ(v *Viewer, cameraID string) error {
+	if !eg.cfg.StreamTokenRequired || v.Kind == viewerKindWHEP {
+		return nil
+	}
+	v.lock.Lock()
+	token := v.token
+	v.lock.Unlock()
+	grant, err := eg.checkStreamToken(token, v.ID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPTZDenied, err)
+	}
+	if grant.SessionID == "" {
+		return fmt.Errorf("%w: token isn't for one session", errPTZDenied)
+	}
+	if !slices.Contains(grant.PTZ, cameraID) {
+		return fmt.Errorf("%w: token doesn't grant PTZ of camera %s", errPTZDenied, cameraID)
+	}
+	return nil
+}
+
+// refuseOffer reports an offer authorizeStream refused, so the player stops
+// waiting for an answer
+func (eg *EdgeGateway) refuseOffer(offer OfferMessage, err error) {
+	log.Printf("Refusing offer for camera %s: %v", offer.CameraID, err)
+	eg.sendError("webrtc_closed", map[string]interface{}{
+		"camera_id":  offer.CameraID,
+		"session_id": offer.SessionID,
+		"reason":     sessionReasonUnauthorized,
+	}, err)
+}
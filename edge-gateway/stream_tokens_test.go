@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signStreamToken issues a token for the grant as the orchestrator's
+// signing service would
+func signStreamToken(t *testing.T, key ed25519.PrivateKey, grant StreamToken) string {
+	t.Helper()
+	claims, err := json.Marshal(grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedClaims := base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(key, streamTokenSigningMessage(encodedClaims))
+	return encodedClaims + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// streamTokenGateway returns a gateway that requires stream tokens signed
+// by the key it returns
+func streamTokenGateway(t *testing.T) (*EdgeGateway, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{StreamTokenRequired: true, StreamTokenKeys: []ed25519.PublicKey{public}}
+	return &EdgeGateway{cfg: cfg}, private
+}
+
+func TestAuthorizeStream(t *testing.T) {
+	eg, key := streamTokenGateway(t)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	valid := StreamToken{
+		GatewayID: getGatewayID(),
+		CameraIDs: []string{"cam-1", "cam-2"},
+		Expires:   time.Now().Add(time.Minute).Unix(),
+	}
+
+	tests := []struct {
+		name      string
+		token     func() string
+		sessionID string
+		cameraIDs []string
+		allowed   bool
+	}{
+		{
+			name:      "granted",
+			token:     func() string { return signStreamToken(t, key, valid) },
+			cameraIDs: []string{"cam-1", "cam-2"},
+			allowed:   true,
+		},
+		{
+			name:  "no token",
+			token: func() string { return "" },
+		},
+		{
+			name:  "malformed",
+			token: func() string { return "not-a-token" },
+		},
+		{
+			name:      "signed by another key",
+			token:     func() string { return signStreamToken(t, otherKey, valid) },
+			cameraIDs: []string{"cam-1"},
+		},
+		{
+			name: "claims altered",
+			token: func() string {
+				_, signature, _ := strings.Cut(signStreamToken(t, key, valid), ".")
+				altered := valid
+				altered.CameraIDs = append(altered.CameraIDs, "cam-3")
+				claims, _, _ := strings.Cut(signStreamToken(t, key, altered), ".")
+				return claims + "." + signature
+			},
+			cameraIDs: []string{"cam-3"},
+		},
+		{
+			name: "expired",
+			token: func() string {
+				grant := valid
+				grant.Expires = time.Now().Add(-streamTokenLeeway - time.Second).Unix()
+				return signStreamToken(t, key, grant)
+			},
+			cameraIDs: []string{"cam-1"},
+		},
+		{
+			name: "expired within leeway",
+			token: func() string {
+				grant := valid
+				grant.Expires = time.Now().Add(-streamTokenLeeway / 2).Unix()
+				return signStreamToken(t, key, grant)
+			},
+			cameraIDs: []string{"cam-1"},
+			allowed:   true,
+		},
+		{
+			name: "other gateway",
+			token: func() string {
+				grant := valid
+				grant.GatewayID = "other-gateway"
+				return signStreamToken(t, key, grant)
+			},
+			cameraIDs: []string{"cam-1"},
+		},
+		{
+			name:      "camera not granted",
+			token:     func() string { return signStreamToken(t, key, valid) },
+			cameraIDs: []string{"cam-1", "cam-3"},
+		},
+		{
+			name: "no cameras granted",
+			token: func() string {
+				grant := valid
+				grant.CameraIDs = nil
+				return signStreamToken(t, key, grant)
+			},
+			cameraIDs: []string{"cam-1"},
+		},
+		{
+			name: "session matches",
+			token: func() string {
+				grant := valid
+				grant.SessionID = "session-1"
+				return signStreamToken(t, key, grant)
+			},
+			sessionID: "session-1",
+			cameraIDs: []string{"cam-1"},
+			allowed:   true,
+		},
+		{
+			name: "other session",
+			token: func() string {
+				grant := valid
+				grant.SessionID = "session-1"
+				return signStreamToken(t, key, grant)
+			},
+			sessionID: "session-2",
+			cameraIDs: []string{"cam-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := eg.authorizeStream(tt.token(), tt.sessionID, tt.cameraIDs...)
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, errStreamDenied) {
+				t.Errorf("got %v, want errStreamDenied", err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeStreamNotRequired(t *testing.T) {
+	eg := &EdgeGateway{cfg: &Config{}}
+	if err := eg.authorizeStream("", "session-1", "cam-1"); err != nil {
+		t.Errorf("refused without STREAM_TOKEN_PUBLIC_KEY: %v", err)
+	}
+}
+
+func TestAuthorizePTZ(t *testing.T) {
+	eg, key := streamTokenGateway(t)
+	valid := StreamToken{
+		GatewayID: getGatewayID(),
+		CameraIDs: []string{"cam-1", "cam-2"},
+		SessionID: "session-1",
+		Expires:   time.Now().Add(time.Minute).Unix(),
+		PTZ:       []string{"cam-1"},
+	}
+
+	tests := []struct {
+		name     string
+		grant    func(StreamToken) StreamToken
+		kind     string
+		cameraID string
+		allowed  bool
+	}{
+		{name: "granted", cameraID: "cam-1", allowed: true},
+		{name: "camera viewed but not steered", cameraID: "cam-2"},
+		{
+			name:     "no ptz claim",
+			grant:    func(g StreamToken) StreamToken { g.PTZ = nil; return g },
+			cameraID: "cam-1",
+		},
+		{
+			name:     "not for one session",
+			grant:    func(g StreamToken) StreamToken { g.SessionID = ""; return g },
+			cameraID: "cam-1",
+		},
+		{
+			name:     "for another session",
+			grant:    func(g StreamToken) StreamToken { g.SessionID = "session-2"; return g },
+			cameraID: "cam-1",
+		},
+		{
+			name: "expired",
+			grant: func(g StreamToken) StreamToken {
+				g.Expires = time.Now().Add(-time.Hour).Unix()
+				return g
+			},
+			cameraID: "cam-1",
+		},
+		{
+			name:     "other gateway",
+			grant:    func(g StreamToken) StreamToken { g.GatewayID = "other-gateway"; return g },
+			cameraID: "cam-1",
+		},
+		{
+			name:     "whep viewer",
+			grant:    func(g StreamToken) StreamToken { g.PTZ = nil; return g },
+			kind:     viewerKindWHEP,
+			cameraID: "cam-1",
+			allowed:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant := valid
+			if tt.grant != nil {
+				grant = tt.grant(grant)
+			}
+			kind := tt.kind
+			if kind == "" {
+				kind = viewerKindWebRTC
+			}
+			v := &Viewer{ID: "session-1", Kind: kind, token: signStreamToken(t, key, grant)}
+			err := eg.authorizePTZ(v, tt.cameraID)
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, errPTZDenied) {
+				t.Errorf("got %v, want errPTZDenied", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errStreamStuck ends a session that stayed connected but delivered no
+// video for STREAM_STALL_TIMEOUT, as when the camera's encoder is wedged
+var errStreamStuck = errors.New("connected but no video")
+
+// watchStall ends the session, through end, once it has delivered no video
+// for timeout. The read loop records each video packet in lastVideo.
+func (cs *CameraStream) watchStall(session context.Context, timeout time.Duration, end func()) {
+	if timeout <= 0 {
+		return
+	}
+	cs.lastVideo.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, cs.lastVideo.Load())) < timeout {
+			continue
+		}
+		cs.runningLock.Lock()
+		cs.stuck = true
+		cs.runningLock.Unlock()
+		end()
+		return
+	}
+}
+
+// takeStuck returns errStreamStuck if the watchdog ended the session,
+// clearing the mark for the next one
+func (cs *CameraStream) takeStuck() error {
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	if !cs.stuck {
+		return nil
+	}
+	cs.stuck = false
+	return fmt.Errorf("%w for %s", errStreamStuck, cs.localConfig.StreamStallTimeout)
+}
+
+// recordStall counts a stuck session of a camera. The camera's pipeline
+// is wedged if reconnecting doesn't help, so after STREAM_STALL_REBOOT_AFTER
+// in a row the cloud is told to reboot it, once until the camera recovers.
+func (eg *EdgeGateway) recordStall(cameraID string) {
+	eg.stallsLock.Lock()
+	eg.stalls[cameraID]++
+	stalls := eg.stalls[cameraID]
+	eg.stallsLock.Unlock()
+	if stalls != eg.cfg.StreamStallRebootAfter {
+		return
+	}
+
+	log.Printf("Camera %s: %d sessions in a row delivered no video, suggesting a reboot", cameraID, stalls)
+	eg.sendEvent("camera_reboot_suggested", map[string]interface{}{
+		"camera_id": cameraID,
+		"reason":    "stream_stuck",
+		"stalls":    stalls,
+	})
+}
+
+// clearStalls forgets a camera's stuck sessions once a stream of it has
+// stayed up through the quarantine probation period
+func (eg *EdgeGateway) clearStalls(cameraID string) {
+	eg.stallsLock.Lock()
+	defer eg.stallsLock.Unlock()
+	delete(eg.stalls, cameraID)
+}
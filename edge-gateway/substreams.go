@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// viewerProfileMain is the camera's main stream
+const viewerProfileMain = ""
+
+// resolutionPattern matches explicit profiles such as "640x360"
+var resolutionPattern = regexp.MustCompile(`^[1-9][0-9]{1,4}x[1-9][0-9]{1,4}$`)
+
+// normalizeViewerProfile validates a profile requested in an offer. It
+// returns viewerProfileMain for the full-quality stream.
+func normalizeViewerProfile(profile string) (string, error) {
+	profile = strings.ToLower(strings.TrimSpace(profile))
+	switch profile {
+	case "", "high", "main":
+		return viewerProfileMain, nil
+	}
+	if resolutionPattern.MatchString(profile) {
+		return profile, nil
+	}
+	for _, p := range abrLadder[1:] {
+		if p.Name == profile {
+			return profile, nil
+		}
+	}
+	return "", fmt.Errorf("unknown stream profile %q", profile)
+}
+
+// streamKey identifies a stream by camera and viewer profile
+func streamKey(cameraID, profile string) string {
+	if profile == viewerProfileMain {
+		return cameraID
+	}
+	return cameraID + "@" + profile
+}
+
+// subStreamURL returns the RTSP URL of the camera stream that best matches
+// a viewer profile. Axis cameras scale to any resolution; Hikvision and
+// Dahua cameras serve a fixed-size sub-stream. Other cameras fall back to
+// the main stream.
+func subStreamURL(camera *Camera, profile string) string {
+	// Simulcast layers are scaled from the main stream, so they keep its
+	// aspect ratio
+	if profile == viewerProfileMain || layerDivisor(profile) > 1 {
+		return camera.RTSPUrl
+	}
+
+	u, err := url.Parse(camera.RTSPUrl)
+	if err != nil {
+		return camera.RTSPUrl
+	}
+
+	switch {
+	case strings.Contains(u.Path, "/axis-media/media.amp"):
+		if resolutionPattern.MatchString(profile) {
+			return withStreamProfile(camera.RTSPUrl, abrProfile{Resolution: profile})
+		}
+		for _, p := range abrLadder {
+			if p.Name == profile {
+				return withStreamProfile(camera.RTSPUrl, p)
+			}
+		}
+
+	case strings.HasPrefix(u.Path, "/Streaming/Channels/") && strings.HasSuffix(u.Path, "01"):
+		u.Path = strings.TrimSuffix(u.Path, "01") + "02"
+		return u.String()
+
+	case u.Path == "/cam/realmonitor":
+		q := u.Query()
+		q.Set("subtype", "1")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	log.Printf("Camera %s has no known sub-stream, using main stream for %s profile", camera.ID, profile)
+	return camera.RTSPUrl
+}
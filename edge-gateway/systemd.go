@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state to the service manager, as sd_notify(3) does, if
+// it started the gateway with NOTIFY_SOCKET. It is a no-op otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets are named with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the service manager expects a
+// watchdog ping, or 0 if it doesn't watch the gateway
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the service manager's watchdog at half its interval
+// while the gateway is healthy, so a wedged gateway is restarted
+func (eg *EdgeGateway) runWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("systemd watchdog enabled, every %s", interval)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := eg.watchdogHealth(ctx, interval/4); err != nil {
+			log.Printf("Withholding systemd watchdog ping: %v", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Failed to ping systemd watchdog: %v", err)
+		}
+	}
+}
+
+// watchdogHealth returns why the gateway is wedged, or nil while it is
+// connected to the cloud or its local API answers
+func (eg *EdgeGateway) watchdogHealth(ctx context.Context, timeout time.Duration) error {
+	if eg.CloudStatus().State == cloudStateConnected {
+		return nil
+	}
+	if eg.cfg.LocalAPIAddr == "" || eg.cfg.LocalAPIAddr == "off" {
+		return fmt.Errorf("cloud %s and local API off", eg.CloudStatus().State)
+	}
+	_, port, err := net.SplitHostPort(eg.cfg.LocalAPIAddr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	healthURL, client := localAPIHealthURL(eg.cfg, "127.0.0.1", port, 0)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloud %s and local API unreachable: %v", eg.CloudStatus().State, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cloud %s and local API returned status %d", eg.CloudStatus().State, resp.StatusCode)
+	}
+	return nil
+}
+
+// reload reloads the configuration on SIGHUP, telling the service manager
+// while it does
+func (eg *EdgeGateway) reload() {
+	sdNotify("RELOADING=1")
+	err := eg.reloadConfig()
+	if err != nil {
+		log.Printf("Reload failed, keeping the current settings: %v", err)
+	} else {
+		log.Printf("Reloaded configuration; settings set_config can't change take effect on restart")
+	}
+	eg.audit(AuditOrigin{Source: auditSourceSignal}, "reload", "", nil, err)
+	sdNotify("READY=1")
+}
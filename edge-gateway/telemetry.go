@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Thresholds for the warnings in a telemetry report
+const (
+	telemetryCPUWarnPercent    = 90.0
+	telemetryMemoryWarnPercent = 90.0
+	telemetryDiskWarnPercent   = 95.0
+	telemetryTempWarnC         = 80.0
+)
+
+// Telemetry is the gateway's resource usage and load, reported so the
+// orchestrator can place streams on the least loaded gateway and alert
+// before one runs out of resources
+type Telemetry struct {
+	CPU          CPUUsage     `json:"cpu"`
+	Memory       MemoryUsage  `json:"memory"`
+	Disk         StorageInfo  `json:"disk"`
+	TemperatureC *float64     `json:"temperature_c,omitempty"` // hottest thermal zone
+	Network      NetworkUsage `json:"network"`
+	Load         GatewayLoad  `json:"load"`
+	Clock        *ClockStatus `json:"clock,omitempty"` // the last clock audit
+	// Warnings names the resources past their thresholds: cpu, memory,
+	// disk, temperature, or clock
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// CPUUsage is the busy share of all cores since the previous report
+type CPUUsage struct {
+	Cores          int       `json:"cores"`
+	Percent        float64   `json:"percent"`
+	ProcessPercent float64   `json:"process_percent"`
+	LoadAverage    []float64 `json:"load_average,omitempty"` // 1, 5 and 15 minutes
+}
+
+// MemoryUsage covers the host and the gateway process
+type MemoryUsage struct {
+	TotalBytes     uint64  `json:"total_bytes,omitempty"`
+	AvailableBytes uint64  `json:"available_bytes,omitempty"`
+	UsedPercent    float64 `json:"used_percent,omitempty"`
+	ProcessBytes   uint64  `json:"process_bytes"`
+}
+
+// NetworkUsage is the host's traffic on all interfaces but loopback, and the
+// video read from cameras, since the previous report
+type NetworkUsage struct {
+	RxKbps     float64 `json:"rx_kbps"`
+	TxKbps     float64 `json:"tx_kbps"`
+	IngestKbps float64 `json:"ingest_kbps"`
+	// UplinkKbps is the estimated video sent to viewers and relays
+	UplinkKbps float64 `json:"uplink_kbps"`
+}
+
+// GatewayLoad counts the work the gateway is doing
+type GatewayLoad struct {
+	Streams     int `json:"streams"`
+	Viewers     int `json:"viewers"`
+	WHEPViewers int `json:"whep_viewers"`
+	Relays      int `json:"relays"`
+	Transcodes  int `json:"transcodes"`
+	Goroutines  int `json:"goroutines"`
+	// PeerConnections counts those open, as MAX_PEER_CONNECTIONS does
+	PeerConnections int `json:"peer_connections"`
+	// Tenants is the share of each tenant with cameras
+	Tenants map[string]*TenantLoad `json:"tenants,omitempty"`
+}
+
+// systemCounters are cumulative host counters, read by platform code.
+// Fields the platform can't provide are left zero, with ok false.
+type systemCounters struct {
+	ok           bool
+	at           time.Time
+	cpuBusy      uint64 // in clock ticks
+	cpuTotal     uint64
+	processCPU   time.Duration
+	netRx        uint64 // in bytes
+	netTx        uint64
+	memTotal     uint64
+	memAvailable uint64
+	processRSS   uint64
+	loadAverage  []float64
+	temperature  *float64
+}
+
+// telemetrySampler turns successive counter readings into rates
+type telemetrySampler struct {
+	lock sync.Mutex
+	last systemCounters
+	// latest is the last report, for /status
+	latest *Telemetry
+}
+
+// telemetry samples the host and the gateway's load
+func (eg *EdgeGateway) telemetry() *Telemetry {
+	now := readSystemCounters()
+
+	eg.telemetrySampler.lock.Lock()
+	prev := eg.telemetrySampler.last
+	eg.telemetrySampler.last = now
+	eg.telemetrySampler.lock.Unlock()
+
+	t := &Telemetry{
+		CPU: CPUUsage{
+			Cores:       runtime.NumCPU(),
+			LoadAverage: now.loadAverage,
+		},
+		Memory: MemoryUsage{
+			TotalBytes:     now.memTotal,
+			AvailableBytes: now.memAvailable,
+			ProcessBytes:   now.processRSS,
+		},
+		Disk:         dataDirStorage(eg.cfg.DataDir),
+		TemperatureC: now.temperature,
+		Load:         eg.load(),
+		Clock:        eg.clockStatus(),
+	}
+	if t.Memory.ProcessBytes == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		t.Memory.ProcessBytes = m.Sys
+	}
+	if now.memTotal > 0 {
+		t.Memory.UsedPercent = 100 * float64(now.memTotal-now.memAvailable) / float64(now.memTotal)
+	}
+
+	if now.ok && prev.ok {
+		if total := now.cpuTotal - prev.cpuTotal; total > 0 {
+			t.CPU.Percent = 100 * float64(now.cpuBusy-prev.cpuBusy) / float64(total)
+		}
+		if elapsed := now.at.Sub(prev.at); elapsed > 0 {
+			t.CPU.ProcessPercent = 100 * float64(now.processCPU-prev.processCPU) /
+				float64(elapsed) / float64(runtime.NumCPU())
+			secs := elapsed.Seconds()
+			t.Network.RxKbps = float64(now.netRx-prev.netRx) * 8 / 1000 / secs
+			t.Network.TxKbps = float64(now.netTx-prev.netTx) * 8 / 1000 / secs
+		}
+	}
+	for _, h := range eg.streamHealth() {
+		t.Network.IngestKbps += h.BitrateKbps
+	}
+	t.Network.UplinkKbps = eg.uplinkKbps()
+
+	if t.CPU.Percent >= telemetryCPUWarnPercent {
+		t.Warnings = append(t.Warnings, "cpu")
+	}
+	if t.Memory.UsedPercent >= telemetryMemoryWarnPercent {
+		t.Warnings = append(t.Warnings, "memory")
+	}
+	if t.Disk.TotalBytes > 0 && 100*float64(t.Disk.TotalBytes-t.Disk.FreeBytes)/float64(t.Disk.TotalBytes) >= telemetryDiskWarnPercent {
+		t.Warnings = append(t.Warnings, "disk")
+	}
+	if t.TemperatureC != nil && *t.TemperatureC >= telemetryTempWarnC {
+		t.Warnings = append(t.Warnings, "temperature")
+	}
+	if t.Clock != nil && t.Clock.clockWarning(eg.cfg.ClockMaxDrift) {
+		t.Warnings = append(t.Warnings, "clock")
+	}
+
+	eg.telemetrySampler.lock.Lock()
+	eg.telemetrySampler.latest = t
+	eg.telemetrySampler.lock.Unlock()
+	return t
+}
+
+// latestTelemetry returns the last report, or nil before the first
+func (eg *EdgeGateway) latestTelemetry() *Telemetry {
+	eg.telemetrySampler.lock.Lock()
+	defer eg.telemetrySampler.lock.Unlock()
+	return eg.telemetrySampler.latest
+}
+
+// load counts streams, viewers, relays and transcodes
+func (eg *EdgeGateway) load() GatewayLoad {
+	l := GatewayLoad{Goroutines: runtime.NumGoroutine(), PeerConnections: int(eg.peerConnCount.Load())}
+
+	eg.streamsLock.RLock()
+	l.Streams = len(eg.streams)
+	eg.streamsLock.RUnlock()
+
+	eg.viewersLock.Lock()
+	for _, v := range eg.viewers {
+		if v.Kind == viewerKindWHEP {
+			l.WHEPViewers++
+		} else {
+			l.Viewers++
+		}
+	}
+	eg.viewersLock.Unlock()
+
+	eg.relaysLock.Lock()
+	l.Relays = len(eg.relays)
+	eg.relaysLock.Unlock()
+
+	if eg.transcoder != nil {
+		l.Transcodes = len(eg.transcoder.slots)
+	}
+	l.Tenants = eg.tenantLoad()
+	return l
+}
+
+// monitorTelemetry reports resource usage to the cloud
+func (eg *EdgeGateway) monitorTelemetry(ctx context.Context) {
+	if eg.cfg.TelemetryInterval <= 0 {
+		return
+	}
+	// The first reading is the baseline for rates
+	eg.telemetry()
+
+	ticker := time.NewTicker(eg.cfg.TelemetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			eg.sendEvent("telemetry", eg.telemetry())
+		}
+	}
+}
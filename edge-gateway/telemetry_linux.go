@@ -0,0 +1,115 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readSystemCounters reads the host counters from /proc and /sys
+func readSystemCounters() systemCounters {
+	c := systemCounters{at: time.Now()}
+
+	if data, err := os.ReadFile("/proc/stat"); err == nil {
+		// cpu  user nice system idle iowait irq softirq steal ...
+		line, _, _ := strings.Cut(string(data), "\n")
+		fields := strings.Fields(line)
+		if len(fields) > 5 && fields[0] == "cpu" {
+			for i, f := range fields[1:] {
+				if i >= 8 {
+					break // guest time is already in user
+				}
+				n, _ := strconv.ParseUint(f, 10, 64)
+				c.cpuTotal += n
+				if i != 3 && i != 4 { // idle and iowait
+					c.cpuBusy += n
+				}
+			}
+			c.ok = true
+		}
+	}
+
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err == nil {
+		c.processCPU = time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	}
+
+	if f, err := os.Open("/proc/net/dev"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			name, stats, ok := strings.Cut(scanner.Text(), ":")
+			if !ok || strings.TrimSpace(name) == "lo" {
+				continue
+			}
+			// rx bytes packets errs drop fifo frame compressed multicast, then tx
+			fields := strings.Fields(stats)
+			if len(fields) < 9 {
+				continue
+			}
+			rx, _ := strconv.ParseUint(fields[0], 10, 64)
+			tx, _ := strconv.ParseUint(fields[8], 10, 64)
+			c.netRx += rx
+			c.netTx += tx
+		}
+		f.Close()
+	}
+
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			switch fields[0] {
+			case "MemTotal:":
+				c.memTotal = kb * 1024
+			case "MemAvailable:":
+				c.memAvailable = kb * 1024
+			}
+		}
+		f.Close()
+	}
+
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		// size resident shared ..., in pages
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			c.processRSS = pages * uint64(os.Getpagesize())
+		}
+	}
+
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) >= 3 {
+			for _, f := range fields[:3] {
+				load, _ := strconv.ParseFloat(f, 64)
+				c.loadAverage = append(c.loadAverage, load)
+			}
+		}
+	}
+
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*/temp")
+	for _, zone := range zones {
+		data, err := os.ReadFile(zone)
+		if err != nil {
+			continue
+		}
+		milli, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || milli <= 0 {
+			continue
+		}
+		celsius := float64(milli) / 1000
+		if c.temperature == nil || celsius > *c.temperature {
+			c.temperature = &celsius
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// readSystemCounters is not supported on this platform; telemetry then
+// carries only the gateway's own load, memory and disk
+func readSystemCounters() systemCounters {
+	return systemCounters{at: time.Now()}
+}
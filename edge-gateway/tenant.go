@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// errTenantDenied is returned for commands and sessions that reach across
+// tenants
+var errTenantDenied = errors.New("camera belongs to another tenant")
+
+// errOperatorOnly is returned for tenantOperatorMessages from a tenant
+var errOperatorOnly = errors.New("reserved to the gateway's operator")
+
+// tenantIDPattern is what a tenant ID may look like
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// tenantOperatorMessages are cloud messages about the gateway as a whole,
+// which only the gateway's operator may send, not a tenant's users
+var tenantOperatorMessages = map[string]bool{
+	"scan_network":      true,
+	"cancel_scan":       true,
+	"set_config":        true,
+	"update_gateway":    true,
+	"set_camera_tenant": true,
+	"cluster_leader":    true,
+	"cluster_drain":     true,
+	"inventory_request": true,
+	"events_ack":        true,
+}
+
+// tenantSubnet assigns the cameras discovered in a subnet to a tenant
+type tenantSubnet struct {
+	Tenant string
+	Net    *net.IPNet
+}
+
+// parseTenantSubnets parses tenant=CIDR items
+func parseTenantSubnets(field string, items []string) ([]tenantSubnet, error) {
+	var subnets []tenantSubnet
+	for _, item := range items {
+		tenant, cidr, _ := strings.Cut(item, "=")
+		tenant = strings.TrimSpace(tenant)
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if !tenantIDPattern.MatchString(tenant) || err != nil {
+			return nil, fmt.Errorf("invalid tenant subnet %q in %s", item, field)
+		}
+		subnets = append(subnets, tenantSubnet{Tenant: tenant, Net: ipNet})
+	}
+	return subnets, nil
+}
+
+// subnetTenant returns the tenant of the most specific TENANT_SUBNETS entry
+// holding an address, or "" if none does
+func (eg *EdgeGateway) subnetTenant(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	tenant, best := "", -1
+	for _, subnet := range eg.cfg.TenantSubnets {
+		if ones, _ := subnet.Net.Mask.Size(); subnet.Net.Contains(addr) && ones > best {
+			tenant, best = subnet.Tenant, ones
+		}
+	}
+	return tenant
+}
+
+// cameraTenant returns the tenant a camera belongs to, and whether the
+// camera exists. Cameras of no tenant belong to the gateway's operator.
+func (eg *EdgeGateway) cameraTenant(cameraID string) (string, bool) {
+	eg.camerasLock.RLock()
+	defer eg.camerasLock.RUnlock()
+	camera, exists := eg.cameras[cameraID]
+	if !exists {
+		return "", false
+	}
+	return camera.Tenant, true
+}
+
+// authorizeTenant checks that a cloud message from a tenant's user only
+// names cameras and viewer sessions of that tenant. Messages from the
+// gateway's operator, with no tenant, may name any.
+func (eg *EdgeGateway) authorizeTenant(origin AuditOrigin, msgType string, payload json.RawMessage) error {
+	if origin.TenantID == "" {
+		return nil
+	}
+	if tenantOperatorMessages[msgType] {
+		return fmt.Errorf("%s is %w", msgType, errOperatorOnly)
+	}
+
+	var p struct {
+		CameraID      string   `json:"camera_id"`
+		CameraIDs     []string `json:"camera_ids"`
+		SessionID     string   `json:"session_id"`
+		AddCameras    []string `json:"add_cameras"`
+		RemoveCameras []string `json:"remove_cameras"`
+		Tenant        string   `json:"tenant"`
+	}
+	json.Unmarshal(payload, &p)
+	if p.Tenant != "" && p.Tenant != origin.TenantID {
+		return errTenantDenied
+	}
+	cameras := append([]string{p.CameraID}, p.CameraIDs...)
+	cameras = append(cameras, p.AddCameras...)
+	cameras = append(cameras, p.RemoveCameras...)
+	for _, cameraID := range cameras {
+		if err := eg.authorizeCamera(origin, cameraID); err != nil {
+			return err
+		}
+	}
+	// New sessions of webrtc_offer aren't known yet, and take the tenant
+	// of their camera
+	if p.SessionID == "" {
+		return nil
+	}
+	if v := eg.viewer(p.SessionID); v != nil && v.Tenant != origin.TenantID {
+		return errors.New("viewer session belongs to another tenant")
+	}
+	return nil
+}
+
+// authorizeCamera checks that a tenant's user only acts on the tenant's
+// cameras. Unknown cameras are refused as they would be for the operator.
+func (eg *EdgeGateway) authorizeCamera(origin AuditOrigin, cameraID string) error {
+	if origin.TenantID == "" || cameraID == "" {
+		return nil
+	}
+	if tenant, exists := eg.cameraTenant(cameraID); exists && tenant != origin.TenantID {
+		return errTenantDenied
+	}
+	return nil
+}
+
+// denyTenant reports a cloud message refused by authorizeTenant
+func (eg *EdgeGateway) denyTenant(origin AuditOrigin, msgType string, payload json.RawMessage, err error) {
+	var p struct {
+		CameraID  string `json:"camera_id"`
+		SessionID string `json:"session_id"`
+	}
+	json.Unmarshal(payload, &p)
+	log.Printf("Refused %s of tenant %s for camera %q: %v", msgType, origin.TenantID, p.CameraID, err)
+	eg.audit(origin, msgType, p.CameraID, nil, err)
+	eg.sendEvent("command_denied", map[string]interface{}{
+		"action":     msgType,
+		"camera_id":  p.CameraID,
+		"session_id": p.SessionID,
+		"tenant_id":  origin.TenantID,
+		"error":      err.Error(),
+	})
+}
+
+// CameraTenantUpdate is the set_camera_tenant payload. An empty tenant
+// returns the camera to the gateway's operator.
+type CameraTenantUpdate struct {
+	CameraID string `json:"camera_id"`
+	Tenant   string `json:"tenant"`
+}
+
+// setCameraTenant moves a camera, and the sensors of a multi-sensor camera,
+// to a tenant, closing the viewer sessions of its previous one
+func (eg *EdgeGateway) setCameraTenant(u CameraTenantUpdate) error {
+	if u.Tenant != "" && !tenantIDPattern.MatchString(u.Tenant) {
+		return fmt.Errorf("invalid tenant %q", u.Tenant)
+	}
+	eg.camerasLock.Lock()
+	camera, exists := eg.cameras[u.CameraID]
+	if !exists {
+		eg.camerasLock.Unlock()
+		return errCameraNotFound
+	}
+	var moved []*Camera
+	for id, other := range eg.cameras {
+		if (other == camera || other.ParentID == camera.ID) && other.Tenant != u.Tenant {
+			updated := *other
+			updated.Tenant = u.Tenant
+			eg.cameras[id] = &updated
+			moved = append(moved, &updated)
+		}
+	}
+	if len(moved) > 0 {
+		eg.saveCamerasLocked()
+	}
+	eg.camerasLock.Unlock()
+
+	for _, camera := range moved {
+		log.Printf("Camera %s moved to tenant %q", camera.ID, camera.Tenant)
+		eg.closeOtherTenants(camera.ID, camera.Tenant)
+		eg.notifyCameraStatus(camera, "updated")
+	}
+	return nil
+}
+
+// closeOtherTenants closes the viewer sessions of a camera, or with it added,
+// that belong to another tenant than the camera's
+func (eg *EdgeGateway) closeOtherTenants(cameraID, tenant string) {
+	eg.viewersLock.Lock()
+	var closing []*Viewer
+	for _, v := range eg.viewers {
+		v.lock.Lock()
+		_, added := v.cameras[cameraID]
+		v.lock.Unlock()
+		if (v.CameraID == cameraID || added) && v.Tenant != tenant {
+			closing = append(closing, v)
+		}
+	}
+	eg.viewersLock.Unlock()
+	for _, v := range closing {
+		v.close(sessionReasonTenantChanged)
+	}
+}
+
+// labelTenant adds the tenant_id of the camera or viewer session an event
+// is about to its payload, unless it has one or there is none
+func (eg *EdgeGateway) labelTenant(data []byte) []byte {
+	var p struct {
+		CameraID  string `json:"camera_id"`
+		SessionID string `json:"session_id"`
+		Camera    struct {
+			ID string `json:"id"`
+		} `json:"camera"`
+		TenantID *string `json:"tenant_id"`
+	}
+	if json.Unmarshal(data, &p) != nil || p.TenantID != nil {
+		return data
+	}
+	tenant := ""
+	switch {
+	case p.CameraID != "":
+		tenant, _ = eg.cameraTenant(p.CameraID)
+	case p.Camera.ID != "":
+		tenant, _ = eg.cameraTenant(p.Camera.ID)
+	case p.SessionID != "":
+		if v := eg.viewer(p.SessionID); v != nil {
+			tenant = v.Tenant
+		}
+	}
+	if tenant == "" {
+		return data
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return data
+	}
+	fields["tenant_id"], _ = json.Marshal(tenant)
+	labeled, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return labeled
+}
+
+// TenantLoad is the share of the gateway's load of one tenant
+type TenantLoad struct {
+	Cameras int `json:"cameras"`
+	Streams int `json:"streams"`
+	Viewers int `json:"viewers"`
+}
+
+// tenantLoad returns the load of each tenant with cameras, or nil if no
+// camera belongs to a tenant
+func (eg *EdgeGateway) tenantLoad() map[string]*TenantLoad {
+	tenants := make(map[string]*TenantLoad)
+	owners := make(map[string]string)
+	eg.camerasLock.RLock()
+	for _, camera := range eg.cameras {
+		if camera.Tenant == "" {
+			continue
+		}
+		owners[camera.ID] = camera.Tenant
+		if tenants[camera.Tenant] == nil {
+			tenants[camera.Tenant] = &TenantLoad{}
+		}
+		tenants[camera.Tenant].Cameras++
+	}
+	eg.camerasLock.RUnlock()
+	if len(tenants) == 0 {
+		return nil
+	}
+
+	eg.streamsLock.RLock()
+	for _, stream := range eg.streams {
+		if load := tenants[owners[stream.camera.ID]]; load != nil {
+			load.Streams++
+		}
+	}
+	eg.streamsLock.RUnlock()
+
+	eg.viewersLock.Lock()
+	for _, v := range eg.viewers {
+		if load := tenants[v.Tenant]; load != nil {
+			load.Viewers++
+		}
+	}
+	eg.viewersLock.Unlock()
+	return tenants
+}
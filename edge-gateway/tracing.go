@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// firstFrameTimeout bounds how long a viewer trace waits for video
+const firstFrameTimeout = 30 * time.Second
+
+// tracer is a no-op until initTracing installs a provider
+var tracer = otel.Tracer("edge-gateway")
+
+// initTracing exports spans to Cloud Trace when TRACING_ENABLED is set. The
+// returned function flushes pending spans on shutdown.
+func initTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !cfg.TracingEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []texporter.Option{
+		texporter.WithTraceClientOptions([]option.ClientOption{
+			option.WithGRPCDialOption(grpc.WithContextDialer(dialEgress)),
+		}),
+	}
+	if cfg.TraceProjectID != "" {
+		opts = append(opts, texporter.WithProjectID(cfg.TraceProjectID))
+	}
+	exporter, err := texporter.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Trace exporter: %v", err)
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "edge-gateway"),
+		attribute.String("service.version", Version),
+		attribute.String("service.instance.id", getGatewayID()),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	log.Printf("Tracing enabled, sampling %.0f%% of viewer sessions", cfg.TraceSampleRatio*100)
+	return provider.Shutdown, nil
+}
+
+// startViewerSpan starts the root span of a viewer's setup, continuing the
+// cloud's trace when the offer carried a W3C traceparent
+func startViewerSpan(name, traceParent, cameraID, profile string) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if traceParent != "" {
+		carrier := propagation.MapCarrier{"traceparent": traceParent}
+		ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("camera.id", cameraID),
+		attribute.String("stream.profile", profileName(profile)),
+	))
+}
+
+// endSpan records err, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceViewerSetup times ICE gathering, ICE connectivity, and the wait for
+// the first video frame as children of ctx's span, and ends root once
+// video flows or the connection fails. It must be called before
+// SetLocalDescription so gathering is observed from the start.
+func traceViewerSetup(ctx context.Context, root trace.Span, pc *webrtc.PeerConnection, cs *CameraStream) {
+	var (
+		lock       sync.Mutex
+		gathering  trace.Span
+		connecting trace.Span
+		done       bool
+	)
+	finish := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if done {
+			return
+		}
+		done = true
+		for _, span := range []trace.Span{gathering, connecting} {
+			if span != nil {
+				span.End()
+			}
+		}
+		endSpan(root, err)
+	}
+
+	root.SetAttributes(attribute.Bool("stream.cold_start", !cs.hasCodecs()))
+
+	pc.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch state {
+		case webrtc.ICEGathererStateGathering:
+			_, gathering = tracer.Start(ctx, "ice.gathering")
+		case webrtc.ICEGathererStateComplete:
+			if gathering != nil {
+				gathering.End()
+				gathering = nil
+			}
+		}
+	})
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		switch state {
+		case webrtc.ICEConnectionStateChecking:
+			lock.Lock()
+			if connecting == nil && !done {
+				_, connecting = tracer.Start(ctx, "ice.connect")
+			}
+			lock.Unlock()
+
+		case webrtc.ICEConnectionStateConnected:
+			lock.Lock()
+			if connecting != nil {
+				connecting.End()
+				connecting = nil
+			}
+			lock.Unlock()
+
+			// Video starts on the stream's next keyframe
+			_, waiting := tracer.Start(ctx, "first_frame")
+			go func() {
+				select {
+				case <-cs.nextFrame():
+					waiting.End()
+					finish(nil)
+				case <-time.After(firstFrameTimeout):
+					err := fmt.Errorf("no video within %v", firstFrameTimeout)
+					endSpan(waiting, err)
+					finish(err)
+				case <-cs.ctx.Done():
+					endSpan(waiting, cs.ctx.Err())
+					finish(fmt.Errorf("stream stopped"))
+				}
+			}()
+
+		case webrtc.ICEConnectionStateFailed:
+			finish(fmt.Errorf("ICE failed"))
+		case webrtc.ICEConnectionStateClosed:
+			finish(fmt.Errorf("connection closed before video"))
+		}
+	})
+}
+
+// profileName returns a readable viewer profile for span attributes
+func profileName(profile string) string {
+	if profile == viewerProfileMain {
+		return "main"
+	}
+	return profile
+}
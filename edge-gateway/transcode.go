@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/ts"
+)
+
+// Hardware acceleration modes for TRANSCODE_HWACCEL
+const (
+	hwaccelNone    = "none" // libx264 on the CPU
+	hwaccelVAAPI   = "vaapi"
+	hwaccelNVENC   = "nvenc"
+	hwaccelV4L2M2M = "v4l2m2m" // Raspberry Pi and other SoC encoders
+)
+
+// transcodeStopTimeout bounds how long a stopped ffmpeg gets to exit
+const transcodeStopTimeout = 2 * time.Second
+
+// ingestSource is a running camera session: an RTSP client or a transcoder
+type ingestSource interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+	Close() error
+}
+
+// Transcoder re-encodes camera streams to H.264 with an external ffmpeg
+// process, for viewer profiles the camera can't serve itself, cameras whose
+// codec viewers can't play, and burned-in timestamps, or to VP9 or AV1 for
+// viewers that negotiated them. Concurrent sessions are capped so a small
+// edge box isn't saturated.
+type Transcoder struct {
+	cfg     *Config
+	cameras map[string]bool // empty for only when needed
+	slots   chan struct{}
+}
+
+// NewTranscoder returns nil unless TRANSCODE_ENABLED is set
+func NewTranscoder(cfg *Config) *Transcoder {
+	if !cfg.TranscodeEnabled {
+		return nil
+	}
+	t := &Transcoder{
+		cfg:     cfg,
+		cameras: make(map[string]bool),
+		slots:   make(chan struct{}, cfg.TranscodeMaxSessions),
+	}
+	for _, id := range cfg.TranscodeCameras {
+		t.cameras[id] = true
+	}
+	return t
+}
+
+// needed reports whether a stream must be transcoded: it is VP9 or AV1,
+// the camera is listed in TRANSCODE_CAMERAS, has privacy masks or an
+// overlay, a viewer profile has no native camera sub-stream, the camera is
+// digitally zoomed, or its codec can't be forwarded as-is
+func (t *Transcoder) needed(cs *CameraStream, rtspURL string) bool {
+	if cs.codec != videoCodecH264 {
+		return true
+	}
+	if t.cameras[cs.camera.ID] || len(cs.privacy.Get(cs.camera.ID)) > 0 {
+		return true
+	}
+	if cs.dptz != nil && cs.dptz.active() {
+		return true
+	}
+	if cs.overlay != nil && cs.overlay() != "" {
+		return true
+	}
+	if cs.profile != viewerProfileMain && rtspURL == cs.camera.RTSPUrl {
+		return true
+	}
+	cs.runningLock.Lock()
+	defer cs.runningLock.Unlock()
+	return cs.unsupportedCodec
+}
+
+// Start runs ffmpeg on the camera's RTSP URL, waiting for a free session if
+// TRANSCODE_MAX_SESSIONS are already running. zoom is a digital PTZ filter,
+// mask a privacy mask filter and osd an overlay filter, any of them empty.
+func (t *Transcoder) Start(ctx context.Context, cameraID, rtspURL, profile, codec, zoom, mask, osd string) (ingestSource, error) {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		log.Printf("Camera %s waiting for a free transcoder", cameraID)
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	session, err := startFFmpeg(t.cfg.FFmpegPath, t.args(rtspURL, profile, codec, zoom, mask, osd), codec, func() { <-t.slots })
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Transcoding camera %s (%s, %s, %s)", cameraID, profileName(profile), codecName(codec), t.hwaccel(codec))
+	return session, nil
+}
+
+// startFFmpeg runs ffmpeg with args, which must write MPEG-TS to stdout,
+// or IVF for VP9 and AV1. release is called once it has exited, or if it
+// fails to start.
+func startFFmpeg(path string, args []string, codec string, release func()) (*transcodeSession, error) {
+	cmd := exec.Command(path, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	stderr := &tailWriter{limit: 2048}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		release()
+		return nil, fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	var demuxer av.Demuxer = ts.NewDemuxer(stdout)
+	if codec != videoCodecH264 {
+		demuxer = newIVFDemuxer(stdout)
+	}
+	return &transcodeSession{
+		cmd:     cmd,
+		stdout:  stdout,
+		stderr:  stderr,
+		demuxer: demuxer,
+		release: release,
+	}, nil
+}
+
+// args builds the ffmpeg command line: decode the camera stream, black out
+// privacy masks, crop or scale it for digital PTZ and the profile,
+// optionally draw the overlay, and encode H.264 with AAC audio as MPEG-TS on
+// stdout, or VP9 or AV1 without audio as IVF. Without an overlay,
+// TRANSCODE_TIMESTAMP draws just the time.
+func (t *Transcoder) args(rtspURL, profile, codec, zoom, mask, osd string) []string {
+	height, kbps := t.profileSize(profile)
+	hw := t.hwaccel(codec)
+	// The output size as ffmpeg expressions, empty to keep the camera's
+	var w, h string
+	switch div := layerDivisor(profile); {
+	case div > 1:
+		w, h = fmt.Sprintf("trunc(iw/%d)*2", 2*div), fmt.Sprintf("trunc(ih/%d)*2", 2*div)
+	case height > 0:
+		w, h = "-2", strconv.Itoa(height)
+	}
+	if osd == "" && t.cfg.TranscodeTimestamp {
+		osd = timestampFilter
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	switch hw {
+	case hwaccelVAAPI:
+		args = append(args,
+			"-init_hw_device", "vaapi=va:"+t.cfg.TranscodeDevice,
+			"-filter_hw_device", "va",
+			"-hwaccel", "vaapi", "-hwaccel_device", "va", "-hwaccel_output_format", "vaapi")
+	case hwaccelNVENC:
+		args = append(args, "-hwaccel", "cuda", "-hwaccel_output_format", "cuda")
+	}
+	args = append(args,
+		"-rtsp_transport", "tcp",
+		"-fflags", "nobuffer",
+		"-i", rtspURL,
+		"-map", "0:v:0", "-map", "0:a:0?")
+
+	// Frames stay in GPU memory unless the overlay must be drawn on them,
+	// they are masked, or they are cropped for digital PTZ, which also scales
+	// them. Masks go on the whole frame before it is cropped.
+	var filters []string
+	switch {
+	case zoom != "" || mask != "":
+		if hw == hwaccelVAAPI || hw == hwaccelNVENC {
+			filters = append(filters, "hwdownload", "format=nv12")
+		}
+		if mask != "" {
+			filters = append(filters, mask)
+		}
+		if zoom != "" {
+			filters = append(filters, zoom)
+		} else if h != "" {
+			filters = append(filters, fmt.Sprintf("scale=%s:%s", w, h))
+		}
+		if osd != "" {
+			filters = append(filters, osd)
+		}
+		switch hw {
+		case hwaccelVAAPI:
+			filters = append(filters, "format=nv12", "hwupload")
+		case hwaccelNVENC:
+			filters = append(filters, "format=nv12", "hwupload_cuda")
+		default:
+			filters = append(filters, "format=yuv420p")
+		}
+	case hw == hwaccelVAAPI:
+		if h != "" {
+			filters = append(filters, fmt.Sprintf("scale_vaapi=w=%s:h=%s:format=nv12", w, h))
+		}
+		if osd != "" {
+			filters = append(filters, "hwdownload", "format=nv12", osd, "format=nv12", "hwupload")
+		}
+	case hw == hwaccelNVENC:
+		if h != "" {
+			filters = append(filters, fmt.Sprintf("scale_cuda=%s:%s", w, h))
+		}
+		if osd != "" {
+			filters = append(filters, "hwdownload", "format=nv12", osd, "hwupload_cuda")
+		}
+	default:
+		if h != "" {
+			filters = append(filters, fmt.Sprintf("scale=%s:%s", w, h))
+		}
+		if osd != "" {
+			filters = append(filters, osd)
+		}
+		filters = append(filters, "format=yuv420p")
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+
+	if codec != videoCodecH264 {
+		args = append(args, videoEncoderArgs(hw, codec, kbps)...)
+		return append(args, "-an", "-f", "ivf", "-flush_packets", "1", "pipe:1")
+	}
+	args = append(args, h264EncoderArgs(hw, kbps)...)
+	args = append(args,
+		"-c:a", "aac", "-b:a", "64k",
+		"-f", "mpegts", "-flush_packets", "1", "pipe:1")
+	return args
+}
+
+// hwaccel returns the TRANSCODE_HWACCEL mode a codec is encoded with:
+// VP9 and AV1 fall back to the CPU on hardware without an encoder for them
+func (t *Transcoder) hwaccel(codec string) string {
+	hw := t.cfg.TranscodeHWAccel
+	switch {
+	case codec == videoCodecVP9 && hw != hwaccelVAAPI,
+		codec == videoCodecAV1 && hw != hwaccelVAAPI && hw != hwaccelNVENC:
+		return hwaccelNone
+	}
+	return hw
+}
+
+// videoEncoderArgs are the ffmpeg options encoding VP9 or AV1 at kbps,
+// tuned for latency like h264EncoderArgs
+func videoEncoderArgs(hw, codec string, kbps int) []string {
+	var args []string
+	switch {
+	case codec == videoCodecVP9 && hw == hwaccelVAAPI:
+		args = append(args, "-c:v", "vp9_vaapi")
+	case codec == videoCodecVP9:
+		args = append(args, "-c:v", "libvpx-vp9", "-deadline", "realtime", "-cpu-used", "8",
+			"-row-mt", "1", "-lag-in-frames", "0", "-error-resilient", "1")
+	case hw == hwaccelVAAPI:
+		args = append(args, "-c:v", "av1_vaapi")
+	case hw == hwaccelNVENC:
+		args = append(args, "-c:v", "av1_nvenc", "-preset", "p1", "-tune", "ll")
+	default:
+		args = append(args, "-c:v", "libsvtav1", "-preset", "10")
+	}
+
+	bitrate := strconv.Itoa(kbps) + "k"
+	return append(args,
+		"-b:v", bitrate, "-maxrate", bitrate, "-bufsize", bitrate,
+		"-force_key_frames", "expr:gte(t,n_forced*2)")
+}
+
+// h264EncoderArgs are the ffmpeg options encoding H.264 at kbps with the
+// encoder of a hardware acceleration mode
+func h264EncoderArgs(hw string, kbps int) []string {
+	var args []string
+	switch hw {
+	case hwaccelVAAPI:
+		args = append(args, "-c:v", "h264_vaapi")
+	case hwaccelNVENC:
+		args = append(args, "-c:v", "h264_nvenc", "-preset", "p1", "-tune", "ll")
+	case hwaccelV4L2M2M:
+		args = append(args, "-c:v", "h264_v4l2m2m")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-profile:v", "baseline")
+	}
+
+	// Keyframes every two seconds keep HLS segments and viewer joins short
+	bitrate := strconv.Itoa(kbps) + "k"
+	return append(args,
+		"-b:v", bitrate, "-maxrate", bitrate, "-bufsize", bitrate,
+		"-bf", "0",
+		"-force_key_frames", "expr:gte(t,n_forced*2)")
+}
+
+// timestampFilter draws the gateway's local time in the top-left corner
+const timestampFilter = `drawtext=text='%{localtime\:%Y-%m-%d %H\\\:%M\\\:%S}':x=8:y=8:fontsize=24:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=4`
+
+// profileSize returns the output height (0 to keep the camera's) and video
+// bitrate for a viewer profile. Simulcast layers keep the camera's height
+// here, as they are scaled by a fraction of it.
+func (t *Transcoder) profileSize(profile string) (int, int) {
+	resolution := ""
+	kbps := t.cfg.TranscodeBitrate
+	if div := layerDivisor(profile); div > 1 {
+		return 0, max(kbps/(div*div), 200)
+	}
+	if resolutionPattern.MatchString(profile) {
+		resolution = profile
+	}
+	for _, p := range abrLadder {
+		if p.Name == profile {
+			resolution = p.Resolution
+			if p.MaxBitrate > 0 {
+				kbps = p.MaxBitrate
+			}
+		}
+	}
+	if resolution == "" {
+		return 0, kbps
+	}
+
+	var width, height int
+	fmt.Sscanf(resolution, "%dx%d", &width, &height)
+	if resolutionPattern.MatchString(profile) {
+		// Scale the full-resolution bitrate by area, relative to 1080p
+		kbps = kbps * width * height / (1920 * 1080)
+		if kbps < 200 {
+			kbps = 200
+		}
+	}
+	return height &^ 1, kbps
+}
+
+// transcodeSession reads a running ffmpeg's MPEG-TS or IVF output
+type transcodeSession struct {
+	cmd     *exec.Cmd
+	stdout  io.ReadCloser
+	stderr  *tailWriter
+	demuxer av.Demuxer
+	release func()
+	once    sync.Once
+}
+
+func (s *transcodeSession) Streams() ([]av.CodecData, error) {
+	codecs, err := s.demuxer.Streams()
+	if err != nil {
+		return nil, s.exitError(err)
+	}
+	return codecs, nil
+}
+
+func (s *transcodeSession) ReadPacket() (av.Packet, error) {
+	pkt, err := s.demuxer.ReadPacket()
+	if err != nil {
+		return pkt, s.exitError(err)
+	}
+	return pkt, nil
+}
+
+// Close stops ffmpeg, killing it if it doesn't exit promptly
+func (s *transcodeSession) Close() error {
+	s.once.Do(func() {
+		s.stdout.Close()
+		done := make(chan struct{})
+		go func() {
+			s.cmd.Wait()
+			close(done)
+		}()
+		s.cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-done:
+		case <-time.After(transcodeStopTimeout):
+			s.cmd.Process.Kill()
+			<-done
+		}
+		s.release()
+	})
+	return nil
+}
+
+// exitError explains a read failure with ffmpeg's last error output
+func (s *transcodeSession) exitError(err error) error {
+	if msg := s.stderr.String(); msg != "" {
+		return fmt.Errorf("transcoder: %s", redactCredentials(msg))
+	}
+	return fmt.Errorf("transcoder: %v", err)
+}
+
+// tailWriter keeps the last line written to it, up to limit bytes
+type tailWriter struct {
+	lock  sync.Mutex
+	buf   []byte
+	limit int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	if over := len(w.buf) - w.limit; over > 0 {
+		w.buf = w.buf[over:]
+	}
+	return len(p), nil
+}
+
+// String returns the last non-empty line
+func (w *tailWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	lines := strings.Split(strings.TrimSpace(string(w.buf)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
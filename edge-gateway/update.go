@@ -0,0 +1,415 @@
+package main
+
+import (
+	"cmp"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Self-update states reported in update_status messages
+const (
+	updateStateDownloading = "downloading"
+	updateStateInstalling  = "installing"
+	updateStateRestarting  = "restarting"
+	updateStateCompleted   = "completed"
+	updateStateUpToDate    = "up_to_date"
+	updateStateFailed      = "failed"
+	updateStateRolledBack  = "rolled_back"
+)
+
+// updateMaxSize bounds a downloaded release binary
+const updateMaxSize = 512 << 20
+
+// UpdateRequest is the update_gateway payload. Signature is the base64
+// Ed25519 signature, by the key in UPDATE_PUBLIC_KEY, of
+// updateSigningMessage for the release. Only newer versions are installed,
+// unless the release is signed as a rollback.
+type UpdateRequest struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	Rollback  bool   `json:"rollback,omitempty"`
+}
+
+// pendingUpdate is saved to DATA_DIR across the restart into a new version,
+// so the new binary can confirm itself or roll back
+type pendingUpdate struct {
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version"`
+	Binary          string    `json:"binary"`
+	Backup          string    `json:"backup"`
+	InstalledAt     time.Time `json:"installed_at"`
+	Boots           int       `json:"boots"`
+	RolledBack      bool      `json:"rolled_back,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// updateSigningMessage is what a release's signature covers. The platform
+// is included so a binary for another architecture can't be installed, and
+// a rollback is signed as one, so an ordinary release's signature can't be
+// replayed to downgrade the gateway.
+func updateSigningMessage(version, sha256Hex string, rollback bool) []byte {
+	message := fmt.Sprintf("edge-gateway/%s/%s/%s/%s", version, runtime.GOOS, runtime.GOARCH, strings.ToLower(sha256Hex))
+	if rollback {
+		message += "/rollback"
+	}
+	return []byte(message)
+}
+
+// compareVersions compares two versions such as 1.4.2 or v1.5.0-rc.1,
+// returning -1, 0 or 1, or false if either isn't one. A pre-release is
+// older than its release.
+func compareVersions(a, b string) (int, bool) {
+	parse := func(v string) ([]int, string, bool) {
+		v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+		core, pre, _ := strings.Cut(v, "-")
+		var numbers []int
+		for _, field := range strings.Split(core, ".") {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return nil, "", false
+			}
+			numbers = append(numbers, n)
+		}
+		return numbers, pre, true
+	}
+	an, apre, aok := parse(a)
+	bn, bpre, bok := parse(b)
+	if !aok || !bok {
+		return 0, false
+	}
+	for i := 0; i < max(len(an), len(bn)); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			return cmp.Compare(x, y), true
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0, true
+	case apre == "":
+		return 1, true
+	case bpre == "":
+		return -1, true
+	}
+	return strings.Compare(apre, bpre), true
+}
+
+func (eg *EdgeGateway) updatePath() string {
+	return filepath.Join(eg.cfg.DataDir, "update.json")
+}
+
+// reportUpdate sends an update_status message
+func (eg *EdgeGateway) reportUpdate(version, state string, progress float64, err error) {
+	payload := map[string]interface{}{
+		"version":          version,
+		"state":            state,
+		"current_version":  Version,
+		"progress_percent": progress,
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+		log.Printf("Update to %s %s: %v", version, state, err)
+	} else {
+		log.Printf("Update to %s: %s", version, state)
+	}
+	eg.sendEvent("update_status", payload)
+}
+
+// handleUpdateGateway runs an update_gateway request: download the release,
+// check its signature, swap the binary and restart into it. Only one update
+// runs at a time. It returns once the release is installed and the restart
+// requested, or why it wasn't.
+func (eg *EdgeGateway) handleUpdateGateway(req UpdateRequest) error {
+	if !eg.updating.CompareAndSwap(false, true) {
+		err := errors.New("an update is already in progress")
+		eg.reportUpdate(req.Version, updateStateFailed, 0, err)
+		return err
+	}
+	if err := eg.installUpdate(req); err != nil {
+		eg.reportUpdate(req.Version, updateStateFailed, 0, err)
+		eg.updating.Store(false)
+		return err
+	}
+	return nil
+}
+
+func (eg *EdgeGateway) installUpdate(req UpdateRequest) error {
+	if eg.cfg.UpdatePublicKey == nil {
+		return errors.New("self-update is disabled (UPDATE_PUBLIC_KEY is not set)")
+	}
+	if req.Version == "" || req.SHA256 == "" || req.Signature == "" {
+		return errors.New("version, sha256 and signature are required")
+	}
+	if req.Version == Version {
+		eg.reportUpdate(req.Version, updateStateUpToDate, 100, nil)
+		eg.updating.Store(false)
+		return nil
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Scheme != "https" {
+		return fmt.Errorf("invalid release URL %q: https is required", redactCredentials(req.URL))
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	if !ed25519.Verify(eg.cfg.UpdatePublicKey, updateSigningMessage(req.Version, req.SHA256, req.Rollback), signature) {
+		return errors.New("release signature does not verify")
+	}
+	if !req.Rollback {
+		newer, ok := compareVersions(req.Version, Version)
+		if !ok {
+			return fmt.Errorf("can't compare version %q with the running %s", req.Version, Version)
+		}
+		if newer <= 0 {
+			return fmt.Errorf("version %s isn't newer than the running %s; downgrades must be signed as a rollback", req.Version, Version)
+		}
+	}
+
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot locate the gateway binary: %v", err)
+	}
+
+	// Download next to the binary so the swap is a rename on one filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(binary), ".edge-gateway-update-*")
+	if err != nil {
+		return fmt.Errorf("binary directory is not writable: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	eg.reportUpdate(req.Version, updateStateDownloading, 0, nil)
+	sum, err := eg.downloadUpdate(req, tmp)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, req.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %s", sum)
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	eg.reportUpdate(req.Version, updateStateInstalling, 100, nil)
+	backup := binary + ".prev"
+	os.Remove(backup)
+	if err := os.Link(binary, backup); err != nil {
+		return fmt.Errorf("failed to keep the current binary for rollback: %v", err)
+	}
+	pending := pendingUpdate{
+		Version:         req.Version,
+		PreviousVersion: Version,
+		Binary:          binary,
+		Backup:          backup,
+		InstalledAt:     time.Now(),
+	}
+	if err := eg.savePendingUpdate(&pending); err != nil {
+		return fmt.Errorf("failed to record the update: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), binary); err != nil {
+		os.Remove(eg.updatePath())
+		return fmt.Errorf("failed to replace the binary: %v", err)
+	}
+
+	eg.reportUpdate(req.Version, updateStateRestarting, 100, nil)
+	eg.requestRestart("update")
+	return nil
+}
+
+// downloadUpdate streams the release into f, reporting progress every ten
+// percent, and returns its SHA-256
+func (eg *EdgeGateway) downloadUpdate(req UpdateRequest, f *os.File) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	httpReq, err := http.NewRequestWithContext(eg.ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("download failed: %v", redactCredentials(err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed with status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > updateMaxSize {
+		return "", fmt.Errorf("release is too large (%d bytes)", resp.ContentLength)
+	}
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	buf := make([]byte, 256<<10)
+	var written int64
+	lastReported := 0
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return "", werr
+			}
+			written += int64(n)
+			if written > updateMaxSize {
+				return "", errors.New("release is too large")
+			}
+			if resp.ContentLength > 0 {
+				if percent := int(written * 100 / resp.ContentLength); percent >= lastReported+10 && percent < 100 {
+					lastReported = percent - percent%10
+					eg.reportUpdate(req.Version, updateStateDownloading, float64(lastReported), nil)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("download failed: %v", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (eg *EdgeGateway) savePendingUpdate(pending *pendingUpdate) error {
+	data, _ := json.Marshal(pending)
+	return writeFileAtomic(eg.updatePath(), data)
+}
+
+func (eg *EdgeGateway) loadPendingUpdate() *pendingUpdate {
+	data, err := os.ReadFile(eg.updatePath())
+	if err != nil {
+		return nil
+	}
+	var pending pendingUpdate
+	if err := json.Unmarshal(data, &pending); err != nil {
+		log.Printf("Discarding unreadable update record: %v", err)
+		os.Remove(eg.updatePath())
+		return nil
+	}
+	return &pending
+}
+
+// checkPendingUpdate runs at startup after an update. The new version counts
+// its boots and must reach the cloud within UPDATE_CONFIRM_TIMEOUT; if it
+// restarts or times out first the previous binary is put back. The previous
+// version, once rolled back to, reports the rollback.
+func (eg *EdgeGateway) checkPendingUpdate() {
+	pending := eg.loadPendingUpdate()
+	if pending == nil {
+		return
+	}
+
+	if pending.Version != Version {
+		state := updateStateFailed
+		var err error
+		if pending.RolledBack {
+			state = updateStateRolledBack
+			err = errors.New(pending.Error)
+		} else {
+			err = fmt.Errorf("running %s after installing %s", Version, pending.Version)
+		}
+		eg.reportUpdate(pending.Version, state, 0, err)
+		os.Remove(eg.updatePath())
+		return
+	}
+
+	pending.Boots++
+	if pending.Boots > 1 {
+		eg.rollbackUpdate(pending, "restarted before reaching the cloud")
+		return
+	}
+	if err := eg.savePendingUpdate(pending); err != nil {
+		log.Printf("Failed to record update boot: %v", err)
+	}
+	eg.updating.Store(true)
+	eg.goTracked(func() { eg.confirmUpdate(pending) })
+}
+
+// confirmUpdate waits for the new version to connect to the cloud
+func (eg *EdgeGateway) confirmUpdate(pending *pendingUpdate) {
+	watcher, stop := eg.watchCloud()
+	defer stop()
+
+	timeout := time.NewTimer(eg.cfg.UpdateConfirmTimeout)
+	defer timeout.Stop()
+
+	if eg.CloudStatus().State != cloudStateConnected {
+		for connected := false; !connected; {
+			select {
+			case <-eg.ctx.Done():
+				return
+			case <-timeout.C:
+				eg.rollbackUpdate(pending, fmt.Sprintf("no cloud connection within %s", eg.cfg.UpdateConfirmTimeout))
+				return
+			case status := <-watcher:
+				connected = status.State == cloudStateConnected
+			}
+		}
+	}
+
+	os.Remove(pending.Backup)
+	os.Remove(eg.updatePath())
+	eg.updating.Store(false)
+	eg.reportUpdate(pending.Version, updateStateCompleted, 100, nil)
+}
+
+// rollbackUpdate puts the previous binary back and restarts into it
+func (eg *EdgeGateway) rollbackUpdate(pending *pendingUpdate, reason string) {
+	log.Printf("Rolling back update to %s: %s", pending.Version, reason)
+	if err := os.Rename(pending.Backup, pending.Binary); err != nil {
+		eg.reportUpdate(pending.Version, updateStateFailed, 0, fmt.Errorf("%s, and rollback failed: %v", reason, err))
+		os.Remove(eg.updatePath())
+		return
+	}
+	pending.RolledBack = true
+	pending.Error = reason
+	if err := eg.savePendingUpdate(pending); err != nil {
+		log.Printf("Failed to record update rollback: %v", err)
+	}
+	eg.requestRestart("rollback")
+}
+
+// requestRestart shuts the gateway down gracefully and has main start the
+// binary again
+func (eg *EdgeGateway) requestRestart(reason string) {
+	eg.restartLock.Lock()
+	eg.restartReason = reason
+	eg.restartLock.Unlock()
+	eg.stop()
+}
+
+// pendingRestart returns why the gateway should start again after Start
+// returns, or "" for a normal shutdown
+func (eg *EdgeGateway) pendingRestart() string {
+	eg.restartLock.Lock()
+	defer eg.restartLock.Unlock()
+	return eg.restartReason
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCameraCircuitOpen is returned when a camera's web server has been
+// failing and requests are being held off
+var ErrCameraCircuitOpen = errors.New("camera HTTP circuit open")
+
+// CameraHTTPManager hands out one pooled HTTP client per camera so PTZ,
+// snapshot, config, and event calls share connections and limits
+type CameraHTTPManager struct {
+	cfg         *Config
+	credentials *CredentialStore
+	clients     map[string]*CameraHTTPClient
+	lock        sync.Mutex
+}
+
+// CameraHTTPClient performs VAPIX requests against a single camera
+type CameraHTTPClient struct {
+	camera      *Camera
+	credentials *CredentialStore
+	client      *http.Client
+	upload      *http.Client // without CAMERA_HTTP_TIMEOUT
+	transport   *http.Transport
+	sem         chan struct{}
+	breaker     *circuitBreaker
+	https       bool // CAMERA_HTTPS, for cameras that don't set it
+
+	lock   sync.Mutex
+	digest *digestChallenge
+}
+
+func NewCameraHTTPManager(cfg *Config, credentials *CredentialStore) *CameraHTTPManager {
+	return &CameraHTTPManager{
+		cfg:         cfg,
+		credentials: credentials,
+		clients:     make(map[string]*CameraHTTPClient),
+	}
+}
+
+// Client returns the shared HTTP client for a camera, creating it on first use
+func (m *CameraHTTPManager) Client(camera *Camera) *CameraHTTPClient {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if c, exists := m.clients[camera.ID]; exists {
+		c.setCamera(camera)
+		return c
+	}
+
+	maxConcurrent := m.cfg.CameraHTTPMaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: maxConcurrent,
+		MaxConnsPerHost:     maxConcurrent,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     cameraTLSConfig(m.cfg, camera),
+	}
+
+	c := &CameraHTTPClient{
+		camera:      camera,
+		credentials: m.credentials,
+		transport:   transport,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   m.cfg.CameraHTTPTimeout,
+		},
+		upload:  &http.Client{Transport: transport},
+		sem:     make(chan struct{}, maxConcurrent),
+		breaker: newCircuitBreaker(m.cfg.CameraHTTPBreakerThreshold, m.cfg.CameraHTTPBreakerCooldown),
+		https:   m.cfg.CameraHTTPS,
+	}
+	m.clients[camera.ID] = c
+	return c
+}
+
+// Remove closes and forgets the client for a camera
+func (m *CameraHTTPManager) Remove(cameraID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if c, exists := m.clients[cameraID]; exists {
+		c.transport.CloseIdleConnections()
+		delete(m.clients, cameraID)
+	}
+}
+
+// CloseAll closes idle connections for every camera
+func (m *CameraHTTPManager) CloseAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for id, c := range m.clients {
+		c.transport.CloseIdleConnections()
+		delete(m.clients, id)
+	}
+}
+
+// Get issues a GET request for a VAPIX path such as /axis-cgi/param.cgi?...
+func (c *CameraHTTPClient) Get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends a request to the camera, handling auth, the concurrency limit, and
+// circuit breaking. The caller must close the response body.
+func (c *CameraHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return c.send(req, func(req *http.Request) (*http.Response, error) {
+		return c.doWithAuth(req, c.client)
+	})
+}
+
+// Upload is Do for requests that may outlast CAMERA_HTTP_TIMEOUT, such as
+// firmware uploads; only the request's context bounds them
+func (c *CameraHTTPClient) Upload(req *http.Request) (*http.Response, error) {
+	return c.send(req, func(req *http.Request) (*http.Response, error) {
+		return c.doWithAuth(req, c.upload)
+	})
+}
+
+// DoAnonymous is Do without credentials, for factory-new cameras that have
+// none yet
+func (c *CameraHTTPClient) DoAnonymous(req *http.Request) (*http.Response, error) {
+	return c.send(req, c.client.Do)
+}
+
+func (c *CameraHTTPClient) send(req *http.Request, do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	// Limit concurrent requests to the camera's web server. The slot is
+	// taken before asking the breaker, so a half-open breaker's trial is
+	// always followed by its outcome.
+	select {
+	case c.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if !c.breaker.Allow() {
+		<-c.sem
+		return nil, ErrCameraCircuitOpen
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		<-c.sem
+		c.recordFailure(err.Error())
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= http.StatusInternalServerError {
+		c.recordFailure(fmt.Sprintf("status %d", resp.StatusCode))
+	} else {
+		c.breaker.Success()
+	}
+
+	// Hold the slot until the caller is done with the body
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-c.sem }}
+	return resp, nil
+}
+
+// doWithAuth sends the request using cached digest credentials when the
+// camera has asked for them, falling back to basic auth otherwise
+func (c *CameraHTTPClient) doWithAuth(req *http.Request, client *http.Client) (*http.Response, error) {
+	c.authorize(req)
+
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := parseDigestChallenge(resp.Header.Values("WWW-Authenticate"))
+	if challenge == nil {
+		return resp, nil
+	}
+
+	// Retry once with the fresh digest challenge
+	retry, err := cloneRequest(req)
+	if err != nil {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	c.lock.Lock()
+	c.digest = challenge
+	c.lock.Unlock()
+
+	c.authorize(retry)
+	return client.Do(retry)
+}
+
+// setCamera points the client at an updated camera record, dropping pooled
+// connections if the camera moved to a new address
+func (c *CameraHTTPClient) setCamera(camera *Camera) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.camera.IP != camera.IP || c.camera.HTTPS != camera.HTTPS {
+		c.transport.CloseIdleConnections()
+		c.digest = nil
+	}
+	c.camera = camera
+}
+
+// authorize sets the Authorization header for the request
+func (c *CameraHTTPClient) authorize(req *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	creds := c.credentials.Get(c.camera.ID)
+	if c.digest != nil {
+		req.Header.Set("Authorization", c.digest.authorization(req.Method, req.URL.RequestURI(),
+			creds.Username, creds.Password))
+		return
+	}
+	req.SetBasicAuth(creds.Username, creds.Password)
+}
+
+// login returns the credentials used for the camera
+func (c *CameraHTTPClient) login() Credentials {
+	return c.credentials.Get(c.cameraID())
+}
+
+func (c *CameraHTTPClient) recordFailure(reason string) {
+	if c.breaker.Failure() {
+		log.Printf("Camera %s web server failing (%s), pausing HTTP requests", c.cameraID(), reason)
+	}
+}
+
+func (c *CameraHTTPClient) cameraID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.camera.ID
+}
+
+func (c *CameraHTTPClient) url(path string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	host := c.camera.IP
+	if c.camera.HTTPPort > 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.camera.HTTPPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	scheme := "http"
+	if c.camera.HTTPS || c.https {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
+// cloneRequest copies a request so it can be re-sent with new credentials
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("request body cannot be replayed")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+// releasingBody frees a concurrency slot once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest header
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	qop       string
+	algorithm string
+	nc        uint32
+}
+
+// parseDigestChallenge returns the first digest challenge found, or nil
+func parseDigestChallenge(headers []string) *digestChallenge {
+	for _, header := range headers {
+		if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+			continue
+		}
+
+		params := parseAuthParams(header[len("digest "):])
+		challenge := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		for _, qop := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(qop) == "auth" {
+				challenge.qop = "auth"
+			}
+		}
+		if challenge.nonce == "" {
+			continue
+		}
+		return challenge
+	}
+	return nil
+}
+
+// parseAuthParams splits comma-separated key=value pairs, honoring quotes
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				value, s = s, ""
+			} else {
+				value, s = s[:end], s[end:]
+			}
+		}
+		params[key] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+// authorization builds the Authorization header value for a request
+func (d *digestChallenge) authorization(method, uri, username, password string) string {
+	d.nc++
+	nc := fmt.Sprintf("%08x", d.nc)
+	cnonce := randomHex(8)
+
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, d.realm, password))
+	if strings.EqualFold(d.algorithm, "MD5-sess") {
+		ha1 = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, d.nonce, cnonce))
+	}
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+
+	var response string
+	if d.qop == "auth" {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, d.nonce, nc, cnonce, d.qop, ha2))
+	} else {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, d.nonce, ha2))
+	}
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, d.realm, d.nonce, uri, response)
+	if d.algorithm != "" {
+		header += fmt.Sprintf(`, algorithm=%s`, d.algorithm)
+	}
+	if d.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, d.opaque)
+	}
+	if d.qop == "auth" {
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, nc, cnonce)
+	}
+	return header
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// errWatermarkUnsupported is returned for watermarked sessions the
+// transcoder can't encode: with transcoding off, or of local cameras, which
+// are captured once for every viewer
+var errWatermarkUnsupported = errors.New("watermarks need TRANSCODE_ENABLED and a network camera")
+
+// streamWatermark is the identity drawn on the video of one viewer session,
+// so a screen recording of it can be traced back to the viewer
+type streamWatermark struct {
+	SessionID string
+	Text      string
+}
+
+// newWatermark returns the watermark of a session with the identity the
+// orchestrator gave, or nil for none
+func newWatermark(sessionID, text string) *streamWatermark {
+	if text == "" {
+		return nil
+	}
+	return &streamWatermark{SessionID: sessionID, Text: text}
+}
+
+// keySuffix sets the stream of a watermark apart from the camera's shared
+// streams, and from the session's earlier watermarks, whose stream may
+// still be stopping
+func (w *streamWatermark) keySuffix() string {
+	if w == nil {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(w.Text))
+	return fmt.Sprintf("#wm-%s-%08x", w.SessionID, h.Sum32())
+}
+
+// equal reports whether two watermarks, either of them nil, are the same
+func (w *streamWatermark) equal(other *streamWatermark) bool {
+	if w == nil || other == nil {
+		return w == other
+	}
+	return *w == *other
+}
+
+// filter is the drawtext filter of the watermark: the identity and the
+// session ID, translucent, drifting slowly around the frame so no part of
+// it can be cropped away for long
+func (w *streamWatermark) filter() string {
+	text := overlayText(w.SessionID)
+	if identity := overlayText(w.Text); identity != "" {
+		text = identity + "  " + text
+	}
+	return fmt.Sprintf("drawtext=text='%s':x='(w-tw)*(0.5+0.45*sin(t/7))':y='(h-th)*(0.5+0.45*sin(t/11))'"+
+		":fontsize=32:fontcolor=white@0.35:shadowcolor=black@0.35:shadowx=2:shadowy=2", text)
+}
+
+// watermarkFilter is the overlay of a watermarked stream: the camera's
+// overlay, or the transcoder's timestamp, then the watermark
+func (eg *EdgeGateway) watermarkFilter(cameraID string, w *streamWatermark) string {
+	osd := eg.overlayFilter(cameraID)
+	if osd == "" && eg.cfg.TranscodeTimestamp {
+		osd = timestampFilter
+	}
+	if osd == "" {
+		return w.filter()
+	}
+	return osd + "," + w.filter()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// setupWebRTCNetwork applies the WEBRTC_* port and address settings to the
+// setting engine shared by viewer peer connections, opening the ICE mux
+// sockets if configured. A setting that can't be applied is logged and left
+// at pion's default, so viewers still connect on open networks.
+func (eg *EdgeGateway) setupWebRTCNetwork() {
+	cfg := eg.cfg
+	se := webrtc.SettingEngine{}
+
+	if cfg.WebRTCUDPPortMin > 0 || cfg.WebRTCUDPPortMax > 0 {
+		if err := se.SetEphemeralUDPPortRange(uint16(cfg.WebRTCUDPPortMin), uint16(cfg.WebRTCUDPPortMax)); err != nil {
+			log.Printf("Invalid WebRTC UDP port range %d-%d: %v", cfg.WebRTCUDPPortMin, cfg.WebRTCUDPPortMax, err)
+		}
+	}
+
+	if len(cfg.WebRTCNAT1To1IPs) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if cfg.WebRTCNAT1To1CandidateType == "srflx" {
+			candidateType = webrtc.ICECandidateTypeSrflx
+		}
+		se.SetNAT1To1IPs(cfg.WebRTCNAT1To1IPs, candidateType)
+	}
+
+	if cfg.WebRTCUDPMuxPort > 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.WebRTCUDPMuxPort})
+		if err != nil {
+			log.Printf("WebRTC UDP mux disabled: %v", err)
+		} else {
+			mux := webrtc.NewICEUDPMux(nil, conn)
+			se.SetICEUDPMux(mux)
+			eg.iceMuxes = append(eg.iceMuxes, mux)
+			log.Printf("WebRTC ICE UDP on port %d", cfg.WebRTCUDPMuxPort)
+		}
+	}
+
+	if cfg.WebRTCTCPMuxPort > 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: cfg.WebRTCTCPMuxPort})
+		if err != nil {
+			log.Printf("WebRTC TCP mux disabled: %v", err)
+		} else {
+			mux := webrtc.NewICETCPMux(nil, listener, 8)
+			se.SetICETCPMux(mux)
+			eg.iceMuxes = append(eg.iceMuxes, mux)
+			log.Printf("WebRTC ICE TCP on port %d", cfg.WebRTCTCPMuxPort)
+		}
+	}
+
+	eg.webrtcSettings = se
+}
+
+// iceServers returns the ICE servers for viewer peer connections: those set
+// with set_config, or a public STUN server. pion rejects STUN servers
+// alongside NAT 1:1 server reflexive candidates, which stand in for what
+// STUN would discover, so only TURN servers are kept then.
+func (eg *EdgeGateway) iceServers() []webrtc.ICEServer {
+	configured := eg.settings().ICEServers
+	if configured == nil {
+		configured = []ICEServerConfig{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+	}
+	noSTUN := len(eg.cfg.WebRTCNAT1To1IPs) > 0 && eg.cfg.WebRTCNAT1To1CandidateType == "srflx"
+
+	var servers []webrtc.ICEServer
+	for _, server := range configured {
+		var urls []string
+		for _, u := range server.URLs {
+			if !noSTUN || strings.HasPrefix(u, "turn") {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		s := webrtc.ICEServer{URLs: urls, Username: server.Username}
+		if server.Credential != "" {
+			s.Credential = server.Credential
+			s.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// closeICEMuxes closes the shared ICE sockets
+func (eg *EdgeGateway) closeICEMuxes() {
+	for _, mux := range eg.iceMuxes {
+		mux.Close()
+	}
+	eg.iceMuxes = nil
+}
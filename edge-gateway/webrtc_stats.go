@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+// Viewer kinds
+const (
+	viewerKindWebRTC = "webrtc" // signalled through the cloud
+	viewerKindWHEP   = "whep"
+)
+
+// Viewer is a peer connection watching a camera. Its ID is the session ID
+// used in session messages.
+type Viewer struct {
+	ID       string
+	Kind     string
+	CameraID string
+	Tenant   string // of the camera when the session opened
+	Codec    string // videoCodecH264 unless VP9 or AV1 was negotiated
+	// Profile is the viewer profile, and Layer the simulcast layer the
+	// viewer receives, both guarded by lock once it is attached
+	Profile string
+	Layer   string
+
+	pc    *webrtc.PeerConnection
+	stats stats.Getter
+	bwe   cc.BandwidthEstimator // nil without CONGESTION_CONTROL
+	ssrc  uint32                // of the video sender
+	since time.Time
+
+	// The video sender and the stream whose track it sends when live, and
+	// the data channel replays are controlled on, if negotiated
+	sender        *webrtc.RTPSender
+	stream        *CameraStream
+	replayChannel *webrtc.DataChannel
+	// The streams of a simulcast camera's layers, largest first, and
+	// whether the viewer is an SFU receiving them all
+	layers    []*CameraStream
+	simulcast bool
+	// lastRTCP is when the viewer last sent RTCP, in Unix nanoseconds
+	lastRTCP atomic.Int64
+
+	// Counters at the last report, for the bitrate, the current ICE
+	// restart, why the gateway closed the session, and the stream token
+	// of its latest offer, guarded by lock
+	lock             sync.Mutex
+	lastBytes        uint64
+	lastAt           time.Time
+	restartGen       int
+	closeReason      string
+	token            string
+	replay           *replayPlayer       // while playing a recording
+	analyticsChannel *webrtc.DataChannel // if analytics metadata is forwarded
+	metaChannel      *webrtc.DataChannel
+	// The stream of the viewer's profile, which it holds open, the sender
+	// of the camera's audio while it is on, and the other cameras sent on
+	// the same connection, by camera ID
+	profileStream *CameraStream
+	audioSender   *webrtc.RTPSender
+	cameras       map[string]*viewerCamera
+	watermark     *streamWatermark // drawn on the viewer's own stream
+}
+
+// ViewerStats is a point-in-time view of one viewer's connection quality
+type ViewerStats struct {
+	ViewerID      string  `json:"viewer_id"`
+	Kind          string  `json:"kind"`
+	CameraID      string  `json:"camera_id"`
+	Profile       string  `json:"profile,omitempty"`
+	Codec         string  `json:"codec,omitempty"` // vp9 or av1, empty for H.264
+	Layer         string  `json:"layer,omitempty"` // of simulcast cameras
+	State         string  `json:"state"`
+	ConnectedSecs float64 `json:"connected_secs"`
+	RTTMs         float64 `json:"rtt_ms"`
+	JitterMs      float64 `json:"jitter_ms"`
+	PacketsSent   uint64  `json:"packets_sent"`
+	PacketsLost   int64   `json:"packets_lost"`
+	FractionLost  float64 `json:"fraction_lost"`
+	BitrateKbps   float64 `json:"bitrate_kbps"`
+	NACKCount     uint32  `json:"nack_count"`
+	PLICount      uint32  `json:"pli_count"`
+	FIRCount      uint32  `json:"fir_count"`
+	// The send-side bandwidth estimate, with CONGESTION_CONTROL
+	TargetBitrateKbps float64 `json:"target_bitrate_kbps,omitempty"`
+}
+
+// newPeerConnection creates a viewer peer connection with pion's default
+// codecs and interceptors, plus the stats interceptor that tracks each RTP
+// stream from the viewer's RTCP reports and, outermost, the continuity
+// interceptor that lets senders switch between live and replay tracks.
+// With CONGESTION_CONTROL, innermost, the pacer sends at the bandwidth
+// estimate returned, and packets carry the TWCC sequence numbers it is
+// made from. It fails with a capacityError at MAX_PEER_CONNECTIONS.
+func (eg *EdgeGateway) newPeerConnection() (pc *webrtc.PeerConnection, getter stats.Getter, bwe cc.BandwidthEstimator, err error) {
+	release, err := eg.reservePeerConnection()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, nil, err
+	}
+	registry := &interceptor.Registry{}
+	if eg.cfg.CongestionControl {
+		ccFactory, err := eg.congestionControl()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ccFactory.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			bwe = estimator
+		})
+		registry.Add(ccFactory)
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, nil, nil, err
+	}
+	statsFactory, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	statsFactory.OnNewPeerConnection(func(_ string, g stats.Getter) {
+		getter = g
+	})
+	registry.Add(statsFactory)
+	registry.Add(continuityFactory{})
+	registry.Add(peerCountFactory{release: release})
+
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(eg.webrtcSettings),
+	)
+	pc, err = api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: eg.iceServers(),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pc, getter, bwe, nil
+}
+
+// trackViewer registers a viewer for stats reporting
+func (eg *EdgeGateway) trackViewer(v *Viewer) {
+	eg.viewersLock.Lock()
+	defer eg.viewersLock.Unlock()
+	eg.viewers[v.ID] = v
+}
+
+// untrackViewer drops a viewer once its connection closes
+func (eg *EdgeGateway) untrackViewer(v *Viewer) {
+	eg.viewersLock.Lock()
+	defer eg.viewersLock.Unlock()
+	delete(eg.viewers, v.ID)
+}
+
+// viewerStats samples every viewer. With commit set the sample starts a new
+// bitrate window; otherwise bitrates cover the time since the last commit.
+func (eg *EdgeGateway) viewerStats(commit bool) []ViewerStats {
+	eg.viewersLock.Lock()
+	viewers := make([]*Viewer, 0, len(eg.viewers))
+	for _, v := range eg.viewers {
+		viewers = append(viewers, v)
+	}
+	eg.viewersLock.Unlock()
+
+	result := []ViewerStats{}
+	for _, v := range viewers {
+		result = append(result, v.sample(commit))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CameraID != result[j].CameraID {
+			return result[i].CameraID < result[j].CameraID
+		}
+		return result[i].ViewerID < result[j].ViewerID
+	})
+	return result
+}
+
+// sample reads the viewer's current stats
+func (v *Viewer) sample(commit bool) ViewerStats {
+	now := time.Now()
+	s := ViewerStats{
+		ViewerID:      v.ID,
+		Kind:          v.Kind,
+		CameraID:      v.CameraID,
+		Codec:         v.Codec,
+		State:         v.pc.ConnectionState().String(),
+		ConnectedSecs: now.Sub(v.since).Seconds(),
+	}
+
+	v.lock.Lock()
+	s.Profile, s.Layer = v.Profile, v.Layer
+	v.lock.Unlock()
+
+	if st := v.stats.Get(v.ssrc); st != nil {
+		out, remote := st.OutboundRTPStreamStats, st.RemoteInboundRTPStreamStats
+		s.PacketsSent = out.PacketsSent
+		s.NACKCount = out.NACKCount
+		s.PLICount = out.PLICount
+		s.FIRCount = out.FIRCount
+		s.PacketsLost = remote.PacketsLost
+		s.FractionLost = remote.FractionLost
+		s.JitterMs = remote.Jitter * 1000
+		if remote.RoundTripTimeMeasurements > 0 {
+			s.RTTMs = float64(remote.RoundTripTime) / float64(time.Millisecond)
+		}
+
+		v.lock.Lock()
+		lastBytes, lastAt := v.lastBytes, v.lastAt
+		if lastAt.IsZero() {
+			lastAt = v.since
+		}
+		if elapsed := now.Sub(lastAt).Seconds(); elapsed > 0 && out.BytesSent >= lastBytes {
+			s.BitrateKbps = float64(out.BytesSent-lastBytes) * 8 / 1000 / elapsed
+		}
+		if commit {
+			v.lastBytes, v.lastAt = out.BytesSent, now
+		}
+		v.lock.Unlock()
+	}
+	if v.bwe != nil {
+		s.TargetBitrateKbps = float64(v.bwe.GetTargetBitrate()) / 1000
+	}
+
+	// Until the viewer's first RTCP report, use the ICE connectivity checks
+	if s.RTTMs == 0 {
+		for _, report := range v.pc.GetStats() {
+			if pair, ok := report.(webrtc.ICECandidatePairStats); ok && pair.Nominated && pair.CurrentRoundTripTime > 0 {
+				s.RTTMs = pair.CurrentRoundTripTime * 1000
+				break
+			}
+		}
+	}
+	return s
+}
+
+// monitorViewerStats periodically reports viewer stats to cloud
+func (eg *EdgeGateway) monitorViewerStats(ctx context.Context) {
+	if eg.cfg.WebRTCStatsInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(eg.cfg.WebRTCStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if viewers := eg.viewerStats(true); len(viewers) > 0 {
+				eg.sendEvent("webrtc_stats", map[string]interface{}{
+					"viewers": viewers,
+				})
+			}
+		}
+	}
+}
+
+// handleViewersAPI reports the stats of connected viewers
+func (eg *EdgeGateway) handleViewersAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, eg.viewerStats(false))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// whepGatherTimeout bounds how long an answer waits for ICE gathering
+const whepGatherTimeout = 10 * time.Second
+
+// handleWHEP serves WHEP playback (draft-ietf-wish-whep):
+// POST /whep/{cameraID} with an SDP offer creates a session and
+// DELETE /whep/{cameraID}/{sessionID} ends it. The optional profile query
+// parameter selects a viewer profile as in webrtc_offer.
+func (eg *EdgeGateway) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/whep/"), "/"), "/")
+	cameraID := parts[0]
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && len(parts) == 1 && cameraID != "":
+		eg.createWHEPSession(w, r, cameraID)
+
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		if !eg.closeWHEPSession(parts[1]) {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPatch && len(parts) == 2:
+		// Trickle ICE isn't supported; the answer carries all candidates
+		w.Header().Set("Allow", "DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "trickle ICE not supported")
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// createWHEPSession answers a WHEP offer for a camera
+func (eg *EdgeGateway) createWHEPSession(w http.ResponseWriter, r *http.Request, cameraID string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		writeError(w, http.StatusUnsupportedMediaType, "expected application/sdp")
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read offer")
+		return
+	}
+
+	profile, err := normalizeViewerProfile(r.URL.Query().Get("profile"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	eg.camerasLock.RLock()
+	_, exists := eg.cameras[cameraID]
+	eg.camerasLock.RUnlock()
+	if !exists {
+		writeError(w, http.StatusNotFound, "camera not found")
+		return
+	}
+
+	// Players present a stream token as their bearer token, as cloud
+	// offers do. The gateway picks the session ID, so the token can't name
+	// one. On-site tooling with LOCAL_API_TOKEN needs none.
+	if eg.cfg.StreamTokenRequired && (eg.cfg.LocalAPIToken == "" || !eg.localAPIAuthorized(r)) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := eg.authorizeStream(token, "", cameraID); err != nil {
+			log.Printf("Refusing WHEP offer for camera %s from %s: %v", cameraID, r.RemoteAddr, err)
+			eg.audit(localOrigin(r), "whep_offer", cameraID, nil, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="edge-gateway"`)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	pc, statsGetter, bwe, err := eg.newPeerConnection()
+	if errors.Is(err, errOverCapacity) {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	traceCtx, span := startViewerSpan("whep.viewer_setup", r.Header.Get("traceparent"), cameraID, profile)
+
+	// WHEP clients don't send start_stream, so streams open on demand
+	sessionID := randomHex(16)
+	closeSession := func() { eg.closeWHEPSession(sessionID) }
+	viewer := &Viewer{
+		ID:       sessionID,
+		Kind:     viewerKindWHEP,
+		CameraID: cameraID,
+		Profile:  profile,
+		pc:       pc,
+		stats:    statsGetter,
+		bwe:      bwe,
+	}
+	stream, err := eg.attachViewer(viewer, false, closeSession)
+	if err != nil {
+		endSpan(span, err)
+		pc.Close()
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	traceViewerSetup(traceCtx, span, pc, stream)
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		pc.Close()
+		writeError(w, http.StatusBadRequest, "invalid offer: "+err.Error())
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Non-trickle: wait for all local candidates before answering
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), whepGatherTimeout)
+	defer cancel()
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		pc.Close()
+		writeError(w, http.StatusGatewayTimeout, "ICE gathering timed out")
+		return
+	}
+
+	eg.whepLock.Lock()
+	eg.whepSessions[sessionID] = pc
+	eg.whepLock.Unlock()
+
+	log.Printf("WHEP session %s started for camera %s", sessionID, cameraID)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+cameraID+"/"+sessionID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, pc.LocalDescription().SDP)
+}
+
+// closeWHEPSession ends a WHEP session; it returns false if it is unknown
+func (eg *EdgeGateway) closeWHEPSession(sessionID string) bool {
+	eg.whepLock.Lock()
+	pc, exists := eg.whepSessions[sessionID]
+	delete(eg.whepSessions, sessionID)
+	eg.whepLock.Unlock()
+
+	if !exists {
+		return false
+	}
+	pc.Close()
+	log.Printf("WHEP session %s ended", sessionID)
+	return true
+}